@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// benchWorkloads lists the supported workloads and what they do.
+var benchWorkloads = map[string]string{
+	"seqwrite": "create files of -size bytes",
+	"create":   "create empty files",
+	"seqread":  "read files in directory order",
+	"randread": "read files in random order",
+	"mixed":    "random reads and file creations, -read-ratio of them reads",
+}
+
+// benchDevices lists the devices the scratch copy can live on.
+var benchDevices = map[string]string{
+	"memory": "an in-memory array",
+	"file":   "a temporary image file, through the host's page cache",
+	"direct": "a temporary image file opened with O_DIRECT",
+	"mmap":   "a temporary image file mapped into memory",
+}
+
+// bench runs a workload against a scratch copy of an image.
+// Whenever the scratch filesystem fills up, it is reset to the original
+// image; the time spent resetting isn't measured.
+type bench struct {
+	image []byte
+	// dev holds the scratch copy
+	dev fs.BlockDevice
+	fs  *fs.FileSystem
+	// dataMode and allocPolicy are what the scratch filesystem is mounted
+	// with
+	dataMode    fs.DataMode
+	allocPolicy fs.AllocPolicy
+	// allocs sums the allocation statistics of the scratch filesystems
+	// reset away
+	allocs fs.AllocStats
+	// files holds the inodes of the files that can be read
+	files   []int
+	created int
+	size    int
+	rng     *rand.Rand
+}
+
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	workload := flags.String("workload", "seqread", "workload to run: seqwrite, create, seqread, randread or mixed")
+	ops := flags.Int("ops", 1000, "number of operations to run")
+	size := flags.Int("size", fs.BlockSize, "file size in bytes for writes")
+	readRatio := flags.Float64("read-ratio", 0.7, "fraction of reads in the mixed workload")
+	seed := flags.Int64("seed", 1, "random seed")
+	device := flags.String("device", "memory", "where the scratch copy lives: memory, file, direct or mmap")
+	queues := flags.Int("queues", 1, "number of device queues serving block operations concurrently")
+	cacheBlocks := flags.Int("cache", 0, "number of blocks to cache in memory in front of the device (0 for none)")
+	data := flags.String("data", "writeback", "how data writes are ordered against metadata: writeback or ordered")
+	alloc := flags.String("alloc", "contiguous", "how data blocks are allocated: contiguous, first-fit or best-fit")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs bench [-workload name] [-ops n] [-size bytes] [-device name] [-queues n] [-cache blocks] [-data mode] [-alloc policy] <image>")
+	}
+	dataModes := map[string]fs.DataMode{"writeback": fs.DataWriteback, "ordered": fs.DataOrdered}
+	dataMode, ok := dataModes[*data]
+	if !ok {
+		return fmt.Errorf("unknown data mode %q", *data)
+	}
+	allocPolicies := map[string]fs.AllocPolicy{"contiguous": fs.AllocContiguous, "first-fit": fs.AllocFirstFit, "best-fit": fs.AllocBestFit}
+	allocPolicy, ok := allocPolicies[*alloc]
+	if !ok {
+		return fmt.Errorf("unknown allocation policy %q", *alloc)
+	}
+	if _, ok := benchWorkloads[*workload]; !ok {
+		return fmt.Errorf("unknown workload %q", *workload)
+	}
+	if _, ok := benchDevices[*device]; !ok {
+		return fmt.Errorf("unknown device %q", *device)
+	}
+	if *ops < 1 {
+		return errors.New("-ops must be at least 1")
+	}
+
+	image, err := readImageBytes(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	b := &bench{
+		image:       image,
+		size:        *size,
+		rng:         rand.New(rand.NewSource(*seed)),
+		dataMode:    dataMode,
+		allocPolicy: allocPolicy,
+	}
+	if *device == "memory" {
+		b.dev = fs.NewArrayBlockDevice(make([]byte, len(image)))
+	} else {
+		dev, cleanup, err := newScratchFile(len(image), *device)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		b.dev = dev
+	}
+	if *queues > 1 {
+		dev := fs.NewMultiQueueDevice(b.dev, *queues)
+		defer dev.Close()
+		b.dev = dev
+	}
+	var cache *fs.CachedBlockDevice
+	if *cacheBlocks > 0 {
+		cache = fs.NewCachedBlockDevice(b.dev, *cacheBlocks)
+		b.dev = cache
+	}
+	err = b.reset()
+	if err != nil {
+		return err
+	}
+
+	latencies := make([]time.Duration, 0, *ops)
+	var bytesMoved int64
+	start := time.Now()
+	for i := 0; i < *ops; i++ {
+		var elapsed time.Duration
+		var n int
+		switch *workload {
+		case "seqwrite":
+			elapsed, n, err = b.write(b.size)
+		case "create":
+			elapsed, n, err = b.write(0)
+		case "seqread":
+			elapsed, n, err = b.read(i)
+		case "randread":
+			elapsed, n, err = b.read(-1)
+		case "mixed":
+			if b.rng.Float64() < *readRatio {
+				elapsed, n, err = b.read(-1)
+			} else {
+				elapsed, n, err = b.write(b.size)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		latencies = append(latencies, elapsed)
+		bytesMoved += int64(n)
+	}
+	wall := time.Since(start)
+
+	var busy time.Duration
+	for _, l := range latencies {
+		busy += l
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("workload:   %s (%s)\n", *workload, benchWorkloads[*workload])
+	fmt.Printf("device:     %s (%s), %d queues, data=%s\n", *device, benchDevices[*device], *queues, dataMode)
+	if cache != nil {
+		stats := cache.Stats()
+		fmt.Printf("cache:      %d blocks, %d hits, %d misses, %d write-backs\n", *cacheBlocks, stats.Hits, stats.Misses, stats.WriteBacks)
+	}
+	if allocs := b.allocStats(); allocs.Allocations > 0 {
+		fmt.Printf("allocation: %s, %d allocations of %d blocks in %d runs, %d fragmented, %d continued\n",
+			allocPolicy, allocs.Allocations, allocs.Blocks, allocs.Runs, allocs.Fragmented, allocs.Continued)
+	}
+	fmt.Printf("operations: %d in %v (%v wall clock)\n", len(latencies), busy, wall)
+	fmt.Printf("iops:       %.0f\n", float64(len(latencies))/busy.Seconds())
+	fmt.Printf("throughput: %.2f MiB/s\n", float64(bytesMoved)/busy.Seconds()/(1<<20))
+	fmt.Printf("latency:    p50 %v  p90 %v  p99 %v  max %v\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	return nil
+}
+
+// scratchDevice is a device backed by a scratch image file.
+type scratchDevice interface {
+	fs.BlockDevice
+	Close() error
+}
+
+// newScratchFile creates a temporary image file of the given size and opens
+// it as the named device. cleanup closes and removes it.
+func newScratchFile(size int, device string) (dev scratchDevice, cleanup func(), err error) {
+	f, err := os.CreateTemp("", "fs-bench-*.img")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := f.Name()
+	err = f.Truncate(int64(size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && device == "mmap" {
+		dev, err = fs.OpenMmapBlockDevice(path, fs.MmapDeviceOptions{})
+	} else if err == nil {
+		dev, err = fs.OpenFileBlockDevice(path, fs.FileDeviceOptions{Direct: device == "direct"})
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, err
+	}
+	return dev, func() {
+		dev.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// reset restores the scratch filesystem to the original image.
+func (b *bench) reset() error {
+	if b.fs != nil {
+		b.allocs = b.allocStats()
+	}
+	for i := 0; i < len(b.image)/fs.BlockSize; i++ {
+		err := b.dev.WriteBlock(uint64(i), b.image[i*fs.BlockSize:(i+1)*fs.BlockSize])
+		if err != nil {
+			return fmt.Errorf("error resetting the scratch image: %w", err)
+		}
+	}
+	filesystem, err := fs.LoadFilesystemWithOptions(b.dev, fs.MountOptions{DataMode: b.dataMode, AllocPolicy: b.allocPolicy})
+	if err != nil {
+		return err
+	}
+	b.fs = filesystem
+
+	entries, err := filesystem.ReadDir(0)
+	if err != nil {
+		return err
+	}
+	b.files = b.files[:0]
+	for _, entry := range entries {
+		if entry.Type == fs.InodeTypeFile {
+			b.files = append(b.files, int(entry.Inode))
+		}
+	}
+	return nil
+}
+
+// write creates a file with n bytes, resetting the scratch filesystem first
+// if it is full.
+func (b *bench) write(n int) (time.Duration, int, error) {
+	contents := make([]byte, n)
+	b.rng.Read(contents)
+
+	for attempt := 0; ; attempt++ {
+		b.created++
+		name := fmt.Sprintf("/bench%d", b.created)
+		start := time.Now()
+		inode, err := b.fs.CreateFile(name, bytes.NewBuffer(contents))
+		elapsed := time.Since(start)
+		if err == nil {
+			b.files = append(b.files, int(inode.Index))
+			return elapsed, n, nil
+		}
+		if attempt > 0 {
+			return 0, 0, fmt.Errorf("error creating %s on a freshly reset image: %w", name, err)
+		}
+		// assume the filesystem is full
+		err = b.reset()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// read reads the i-th file, or a random one if i is negative. If there are
+// no files yet, the filesystem is filled up first.
+func (b *bench) read(i int) (time.Duration, int, error) {
+	if len(b.files) == 0 {
+		err := b.fill()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if i < 0 {
+		i = b.rng.Intn(len(b.files))
+	}
+
+	start := time.Now()
+	contents, err := b.fs.ReadFileContents(b.files[i%len(b.files)])
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	return elapsed, contents.Len(), nil
+}
+
+// fill creates files of the configured size until the filesystem is full.
+func (b *bench) fill() error {
+	contents := make([]byte, b.size)
+	for {
+		b.created++
+		inode, err := b.fs.CreateFile(fmt.Sprintf("/bench%d", b.created), bytes.NewBuffer(contents))
+		if err != nil {
+			break
+		}
+		b.files = append(b.files, int(inode.Index))
+	}
+	if len(b.files) == 0 {
+		return errors.New("image has no room for a single file to read")
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// allocStats returns the allocation statistics of every scratch filesystem
+// so far.
+func (b *bench) allocStats() fs.AllocStats {
+	stats := b.allocs
+	if b.fs != nil {
+		current := b.fs.AllocStats()
+		stats.Allocations += current.Allocations
+		stats.Blocks += current.Blocks
+		stats.Runs += current.Runs
+		stats.Fragmented += current.Fragmented
+		stats.Continued += current.Continued
+		stats.Failed += current.Failed
+	}
+	return stats
+}
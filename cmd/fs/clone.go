@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runClone(args []string) (err error) {
+	flags := flag.NewFlagSet("clone", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite the destination if it exists")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: fs clone [-force] <src> <dst>")
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+
+	srcDev, err := fs.OpenFileBlockDevice(src, fs.FileDeviceOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer srcDev.Close()
+	filesystem, err := fs.LoadFilesystem(srcDev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the clone is as big as the filesystem, and sparse where it is free
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *force {
+		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(dst, flag, 0644)
+	if errors.Is(err, os.ErrExist) {
+		err = fmt.Errorf("%w; overwrite it with -force", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(filesystem.Geometry().BlockCount) * fs.BlockSize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	dstDev, err := fs.OpenFileBlockDevice(dst, fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dstDev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return filesystem.CloneToWithOptions(dstDev, fs.CloneOptions{Zeroed: true})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"brenoafb.com/very-simple-filesystem/pkg/fsdebug"
+)
+
+const debugUsage = `usage: fs debug <image> [what]
+
+what is one of:
+  super               the superblock and the layout (the default)
+  bitmap inode|data   the inode or data bitmap
+  inode <n>           inode n, decoded and raw
+  block <n>           block n in hex
+  blocks [<n>[-<m>]]  blocks n to m in hex, all of them by default
+  path <path>         each step of resolving an absolute path`
+
+// runDebug prints the structures of an image as the device holds them, for
+// debugging damaged images. It never writes to the image.
+func runDebug(args []string) (err error) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return errors.New(debugUsage)
+	}
+	what := []string{"super"}
+	if flags.NArg() > 1 {
+		what = flags.Args()[1:]
+	}
+
+	dev, err := fs.OpenFileBlockDevice(flags.Arg(0), fs.FileDeviceOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	number := func() (uint64, error) {
+		if len(what) != 2 {
+			return 0, errors.New(debugUsage)
+		}
+		n, err := strconv.ParseUint(what[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s number %q", what[0], what[1])
+		}
+		return n, nil
+	}
+	// blocks are dumped even if the superblock is damaged, and whatever
+	// the device holds
+	if what[0] == "block" {
+		n, err := number()
+		if err != nil {
+			return err
+		}
+		return fsdebug.DumpBlock(os.Stdout, dev, n)
+	}
+
+	if what[0] == "blocks" {
+		blocks, err := parseBlockRange(what[1:])
+		if err != nil {
+			return err
+		}
+		return fsdebug.HexDump(dev, blocks, os.Stdout)
+	}
+
+	img, err := fs.OpenImage(dev)
+	if err != nil {
+		return fmt.Errorf("%w; 'fs debug <image> block 0' dumps the superblock", err)
+	}
+	switch {
+	case what[0] == "super" && len(what) == 1:
+		return fsdebug.DumpSuperblock(os.Stdout, img)
+	case what[0] == "bitmap" && len(what) == 2:
+		return fsdebug.DumpBitmap(os.Stdout, img, what[1])
+	case what[0] == "inode":
+		n, err := number()
+		if err != nil {
+			return err
+		}
+		return fsdebug.DumpInode(os.Stdout, img, int(n))
+	case what[0] == "path" && len(what) == 2:
+		return fsdebug.TracePath(os.Stdout, img, what[1])
+	}
+	return errors.New(debugUsage)
+}
+
+// parseBlockRange parses the range of fs debug blocks: none for the whole
+// device, n for block n, or n-m for blocks n to m.
+func parseBlockRange(args []string) (fsdebug.BlockRange, error) {
+	if len(args) == 0 {
+		return fsdebug.BlockRange{}, nil
+	}
+	if len(args) > 1 {
+		return fsdebug.BlockRange{}, errors.New(debugUsage)
+	}
+	first, last, ranged := strings.Cut(args[0], "-")
+	if !ranged {
+		last = first
+	}
+	start, err := strconv.ParseUint(first, 10, 64)
+	if err == nil {
+		var end uint64
+		end, err = strconv.ParseUint(last, 10, 64)
+		if err == nil && end >= start {
+			return fsdebug.BlockRange{Start: start, End: end + 1}, nil
+		}
+	}
+	return fsdebug.BlockRange{}, fmt.Errorf("invalid block range %q", args[0])
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runDefrag(args []string) (err error) {
+	flags := flag.NewFlagSet("defrag", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs defrag <image>")
+	}
+
+	dev, err := fs.OpenFileBlockDevice(flags.Arg(0), fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	report, err := filesystem.Defrag()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %d of %d files, %d blocks", report.Moved, report.Files, report.BlocksMoved)
+	if report.Fragmented > 0 {
+		fmt.Printf("; %d files stay fragmented, no run of free blocks holds them", report.Fragmented)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func runDf(args []string) error {
+	flags := flag.NewFlagSet("df", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs df <image>")
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	stats, err := filesystem.Statfs()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "\ttotal\tused\tfree\tuse%\t")
+	fmt.Fprintf(w, "blocks\t%d\t%d\t%d\t%d%%\t\n", stats.Blocks, stats.UsedBlocks, stats.FreeBlocks, percent(stats.UsedBlocks, stats.Blocks))
+	fmt.Fprintf(w, "inodes\t%d\t%d\t%d\t%d%%\t\n", stats.Inodes, stats.UsedInodes, stats.FreeInodes, percent(stats.UsedInodes, stats.Inodes))
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes free in blocks of %d bytes, files of up to %d bytes\n",
+		stats.FreeBytes(), stats.BlockSize, stats.MaxFileSize)
+	if filesystem.Geometry().DedupBlocks > 0 {
+		fmt.Printf("%d blocks saved by sharing them between files\n", stats.SavedBlocks)
+	}
+	return nil
+}
+
+// percent returns used as a percentage of total, rounded up like df does.
+func percent(used, total uint64) uint64 {
+	if total == 0 {
+		return 0
+	}
+	return (used*100 + total - 1) / total
+}
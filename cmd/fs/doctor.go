@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	workers := flags.Int("workers", 0, "number of concurrent checkers (0 uses every CPU)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs doctor [-workers n] <image>")
+	}
+
+	dev, err := readImage(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	findings := fs.DiagnoseWithOptions(dev, fs.DiagnoseOptions{Workers: *workers})
+	problems := 0
+	for _, f := range findings {
+		fmt.Printf("[%s] %s: %s\n", f.Severity, f.Check, f.Message)
+		if f.Remedy != "" {
+			fmt.Printf("    remedy: %s\n", f.Remedy)
+		}
+		if f.Severity == fs.SeverityError {
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d errors", problems)
+	}
+	fmt.Println("no errors found")
+	return nil
+}
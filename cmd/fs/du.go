@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+)
+
+func runDu(args []string) error {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	summary := flags.Bool("s", false, "print only the total, not the entries of the directory")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: fs du [-s] <image> [path]")
+	}
+	name := "/"
+	if flags.NArg() == 2 {
+		name = path.Join("/", flags.Arg(1))
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "blocks\tbytes\tname")
+	show := func(name string) error {
+		bytes, blocks, err := filesystem.DiskUsage(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\n", blocks, bytes, name)
+		return nil
+	}
+	// like du -d 1, the entries of a directory come before its total
+	if info.IsDir() && !*summary {
+		entries, err := filesystem.ReadDirByPath(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = show(path.Join(name, entry.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = show(name)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
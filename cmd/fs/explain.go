@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// runExplain runs a small workload on an in-memory disk with the
+// filesystem narrating each step, to show what the operations do on the
+// device.
+func runExplain(args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	name := flags.String("name", "/hello.txt", "name of the file to create")
+	contents := flags.String("contents", "Hello, world!", "contents of the file")
+	flags.Parse(args)
+
+	disk := make([]byte, (fs.DataStartIndex+32)*fs.BlockSize)
+	filesystem, err := fs.NewFileSystem(fs.NewArrayBlockDevice(disk))
+	if err != nil {
+		return err
+	}
+	filesystem.SetExplain(os.Stdout)
+
+	_, err = filesystem.CreateFile(*name, bytes.NewBufferString(*contents))
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+
+	f, err := filesystem.OpenFile(*name, fs.O_RDWR|fs.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	f.Close()
+
+	f, err = filesystem.OpenFile(*name, fs.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	fmt.Println()
+
+	return filesystem.Close()
+}
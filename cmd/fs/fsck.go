@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runFsck(args []string) (err error) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems that can be fixed, writing to the image")
+	workers := flags.Int("workers", 0, "number of concurrent checkers (0 uses every CPU)")
+	progress := flags.Bool("progress", false, "report the inodes checked on stderr")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs fsck [-repair] [-workers n] [-progress] <image>")
+	}
+
+	dev, err := fs.OpenFileBlockDevice(flags.Arg(0), fs.FileDeviceOptions{ReadOnly: !*repair})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	opts := fs.FsckOptions{Repair: *repair, Workers: *workers}
+	if *progress {
+		opts.Progress = func(p fs.Progress) {
+			fmt.Fprintf(os.Stderr, "\rchecked %d/%d inodes", p.Items, p.TotalItems)
+			if p.Items == p.TotalItems {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+	report, err := fs.Fsck(dev, opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range report.Problems {
+		fmt.Printf("[%s] %s: %s\n", f.Severity, f.Check, f.Message)
+	}
+	for _, r := range report.Repairs {
+		fmt.Printf("repaired: %s\n", r)
+	}
+	if len(report.Repairs) > 0 {
+		for _, f := range report.Remaining {
+			fmt.Printf("remaining: [%s] %s: %s\n", f.Severity, f.Check, f.Message)
+		}
+	}
+
+	if n := len(report.Remaining); n > 0 {
+		if !*repair {
+			return fmt.Errorf("found %d problems; run with -repair to fix what can be fixed", n)
+		}
+		return fmt.Errorf("%d problems remain; see 'fs doctor' for remedies", n)
+	}
+	fmt.Println("the filesystem is consistent")
+	return nil
+}
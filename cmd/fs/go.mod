@@ -4,4 +4,15 @@ go 1.20
 
 replace brenoafb.com/very-simple-filesystem/pkg/fs => ../../pkg/fs
 
-require brenoafb.com/very-simple-filesystem/pkg/fs v0.0.0-00010101000000-000000000000 // indirect
+replace brenoafb.com/very-simple-filesystem/pkg/fsapi => ../../pkg/fsapi
+
+replace brenoafb.com/very-simple-filesystem/pkg/fsdebug => ../../pkg/fsdebug
+
+replace brenoafb.com/very-simple-filesystem/pkg/httpfs => ../../pkg/httpfs
+
+require (
+	brenoafb.com/very-simple-filesystem/pkg/fs v0.0.0-00010101000000-000000000000 // indirect
+	brenoafb.com/very-simple-filesystem/pkg/fsapi v0.0.0-00010101000000-000000000000 // indirect
+	brenoafb.com/very-simple-filesystem/pkg/fsdebug v0.0.0-00010101000000-000000000000 // indirect
+	brenoafb.com/very-simple-filesystem/pkg/httpfs v0.0.0-00010101000000-000000000000 // indirect
+)
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// goldenManifest describes the contents of a golden image. It is read by
+// the regression test in pkg/fs, which keeps its own copy of the type.
+type goldenManifest struct {
+	Version uint32       `json:"version"`
+	Files   []goldenFile `json:"files"`
+}
+
+type goldenFile struct {
+	Path   string            `json:"path"`
+	Size   int               `json:"size"`
+	SHA256 string            `json:"sha256"`
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	Uid    uint32            `json:"uid,omitempty"`
+	Gid    uint32            `json:"gid,omitempty"`
+}
+
+// goldenSource is a file stored in the golden images.
+type goldenSource struct {
+	path       string
+	contents   []byte
+	compressed bool
+	xattrs     map[string]string
+	uid, gid   uint32
+}
+
+// goldenContents returns the files stored in the golden image of the current
+// format version.
+func goldenContents() []goldenSource {
+	pattern := func(n int) []byte {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = byte(i % 251)
+		}
+		return buf
+	}
+
+	sources := []goldenSource{
+		// the attributes fit in the inode
+		{"/hello.txt", []byte("Hello, world!\n"), false, map[string]string{"user.mime_type": "text/plain"}, 0, 0},
+		// has an owner other than root
+		{"/owned", []byte("owned by 1000:100\n"), false, nil, 1000, 100},
+		// needs binary directory entries
+		{"/two words", []byte("a name with a space\n"), false, nil, 0, 0},
+		{"/empty", []byte{}, false, nil, 0, 0},
+		// the attributes need an xattr block
+		{"/blocks", pattern(2*fs.BlockSize + fs.BlockSize/2), false, map[string]string{"user.origin": strings.Repeat("generated by fs golden; ", 40)}, 0, 0},
+		{"/max", pattern(16 * fs.BlockSize), false, nil, 0, 0},
+		// reaches into the double indirect block
+		{"/indirect", pattern((16+1024+2)*fs.BlockSize + 7), false, nil, 0, 0},
+		{"/compressed", pattern(3*fs.BlockSize + 5), true, nil, 0, 0},
+	}
+	// fill the root directory past a block, so it is indexed
+	for i := 0; i < 100; i++ {
+		sources = append(sources, goldenSource{fmt.Sprintf("/an entry of the indexed root directory %03d", i), []byte{}, false, nil, 0, 0})
+	}
+	return sources
+}
+
+// runGolden writes the canonical image for the current format version,
+// gzipped, along with a JSON manifest of its contents.
+func runGolden(args []string) error {
+	flags := flag.NewFlagSet("golden", flag.ExitOnError)
+	dir := flags.String("o", "pkg/fs/testdata/golden", "output directory")
+	force := flags.Bool("force", false, "overwrite an existing image for the current version")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: fs golden [-o dir] [-force]")
+	}
+
+	base := filepath.Join(*dir, fmt.Sprintf("v%d", fs.FormatVersion))
+	if _, err := os.Stat(base + ".img.gz"); err == nil && !*force {
+		return fmt.Errorf("%s.img.gz already exists; images of released versions must not change (use -force to overwrite)", base)
+	}
+
+	// with a journal and checksums, so the image has every region of the
+	// format
+	const blocks, journalBlocks = 1200, 32
+	disk := make([]byte, blocks*fs.BlockSize)
+	filesystem, err := fs.NewFileSystemWithOptions(fs.NewArrayBlockDevice(disk), fs.MkfsOptions{Blocks: blocks, JournalBlocks: journalBlocks, Checksums: true})
+	if err != nil {
+		return err
+	}
+
+	manifest := goldenManifest{Version: fs.FormatVersion, Files: []goldenFile{}}
+	for _, f := range goldenContents() {
+		opts := fs.CreateOptions{}
+		if f.compressed {
+			opts.Compression = fs.CompressionGzip
+		}
+		_, err := filesystem.CreateFileWithOptions(f.path, bytes.NewReader(f.contents), opts)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", f.path, err)
+		}
+		for name, value := range f.xattrs {
+			err = filesystem.SetXattr(f.path, name, []byte(value))
+			if err != nil {
+				return fmt.Errorf("error setting attribute %s of %s: %w", name, f.path, err)
+			}
+		}
+		if f.uid != 0 || f.gid != 0 {
+			err = filesystem.Chown(f.path, int(f.uid), int(f.gid))
+			if err != nil {
+				return fmt.Errorf("error changing the owner of %s: %w", f.path, err)
+			}
+		}
+		sum := sha256.Sum256(f.contents)
+		manifest.Files = append(manifest.Files, goldenFile{
+			Path:   f.path,
+			Size:   len(f.contents),
+			SHA256: hex.EncodeToString(sum[:]),
+			Xattrs: f.xattrs,
+			Uid:    f.uid,
+			Gid:    f.gid,
+		})
+	}
+	// charges every file to the root directory
+	err = filesystem.SetQuota("/", fs.Quota{MaxBytes: 1 << 30, MaxInodes: 1000})
+	if err != nil {
+		return err
+	}
+	err = filesystem.Close()
+	if err != nil {
+		return err
+	}
+
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	_, err = zw.Write(disk)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(*dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(base+".img.gz", compressed.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(base+".json", append(manifestJSON, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s.img.gz and %s.json\n", base, base)
+	return nil
+}
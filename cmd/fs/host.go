@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runPut(args []string) (err error) {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		return errors.New("usage: fs put <image> <local> [path]")
+	}
+	image, local := flags.Arg(0), flags.Arg(1)
+	name := "/" + filepath.Base(local)
+	if flags.NArg() == 3 {
+		name = flags.Arg(2)
+	}
+
+	dev, err := fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return filesystem.PutFromHost(local, name)
+}
+
+func runGet(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		return errors.New("usage: fs get <image> <path> [local]")
+	}
+	name := flags.Arg(1)
+	local := path.Base(name)
+	if flags.NArg() == 3 {
+		local = flags.Arg(2)
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if local == "-" {
+		return catFile(filesystem, name)
+	}
+	return filesystem.GetToHost(name, local)
+}
+
+// catFile streams the file name of filesystem to stdout.
+func catFile(filesystem *fs.FileSystem, name string) error {
+	f, err := filesystem.Open(name, fs.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", name, err)
+	}
+	return nil
+}
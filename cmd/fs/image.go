@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// readImage loads an image file into an in-memory block device.
+// Changes made through the device are not written back to the file.
+func readImage(path string) (*fs.ArrayBlockDevice, error) {
+	buf, err := readImageBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewArrayBlockDevice(buf), nil
+}
+
+// loadReadOnly loads the filesystem of an image that is only read, so it
+// doesn't matter if it is dirty.
+func loadReadOnly(image string) (*fs.FileSystem, error) {
+	dev, err := readImage(image)
+	if err != nil {
+		return nil, err
+	}
+	return fs.LoadFilesystemWithOptions(dev, fs.MountOptions{Recovery: fs.RecoveryForce})
+}
+
+// readImageBytes reads the raw contents of an image file.
+func readImageBytes(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image: %w", err)
+	}
+	if len(buf)%fs.BlockSize != 0 {
+		return nil, fmt.Errorf("image size %d is not a multiple of the block size %d", len(buf), fs.BlockSize)
+	}
+	return buf, nil
+}
+
+// imageDevice is a block device backed by an image.
+type imageDevice interface {
+	fs.BlockDevice
+	Close() error
+}
+
+// passphraseVar is the environment variable holding the passphrase of
+// encrypted images, so it doesn't show in the list of processes.
+const passphraseVar = "FS_PASSPHRASE"
+
+// openEncrypted wraps dev, an encrypted image, in an EncryptedBlockDevice,
+// encrypting it if it is new.
+func openEncrypted(dev imageDevice) (*fs.EncryptedBlockDevice, error) {
+	passphrase := os.Getenv(passphraseVar)
+	if passphrase == "" {
+		return nil, fmt.Errorf("set the passphrase of the image in %s", passphraseVar)
+	}
+	return fs.OpenEncryptedBlockDevice(dev, passphrase)
+}
+
+// openImage opens an image for reading and writing: an image file, an
+// image served by 'fs serve' if image is a tcp://host:port address, or an
+// image in S3 if it is an s3://bucket/prefix URL. Images in S3 are created
+// with the given number of blocks if they don't exist yet.
+func openImage(image string, blocks uint64) (imageDevice, error) {
+	if addr, ok := strings.CutPrefix(image, "tcp://"); ok {
+		return fs.DialBlockDevice(addr)
+	}
+	if path, ok := strings.CutPrefix(image, "s3://"); ok {
+		return openS3Image(path, blocks)
+	}
+	return fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{})
+}
+
+// openS3Image opens the image under bucket/prefix in S3, or a service
+// compatible with it. The credentials, region and endpoint are taken from
+// the usual AWS environment variables.
+func openS3Image(path string, blocks uint64) (imageDevice, error) {
+	bucket, prefix, _ := strings.Cut(path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	store := &fs.S3ObjectStore{
+		Endpoint:  endpoint,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	return fs.OpenObjectStoreBlockDevice(store, fs.ObjectDeviceOptions{Prefix: prefix, Blocks: blocks})
+}
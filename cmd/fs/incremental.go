@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: fs diff <older> <newer>")
+	}
+	older, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	newer, err := loadReadOnly(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	// both are listed in the same order, whatever their defaults
+	older.SetDirOrder(fs.DirOrderName)
+	newer.SetDirOrder(fs.DirOrderName)
+	changes, err := fs.Diff(older, newer)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		name := change.Name
+		if change.Type == fs.InodeTypeDirectory && name != "/" {
+			name += "/"
+		}
+		fmt.Printf("%-8s  %s\n", change.Kind, name)
+	}
+	return nil
+}
+
+func runIncremental(args []string) (err error) {
+	flags := flag.NewFlagSet("incremental", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		return errors.New("usage: fs incremental <image> <since> [stream]")
+	}
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	filesystem.SetDirOrder(fs.DirOrderName)
+
+	if flags.NArg() == 2 || flags.Arg(2) == "-" {
+		return filesystem.ExportIncremental(os.Stdout, flags.Arg(1))
+	}
+	f, err := os.Create(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return filesystem.ExportIncremental(f, flags.Arg(1))
+}
+
+func runApply(args []string) (err error) {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: fs apply <image> [stream]")
+	}
+	var stream io.Reader = os.Stdin
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stream = f
+	}
+
+	dev, err := fs.OpenFileBlockDevice(flags.Arg(0), fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return filesystem.ApplyIncremental(stream)
+}
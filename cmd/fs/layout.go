@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func runLayout(args []string) error {
+	flags := flag.NewFlagSet("layout", flag.ExitOnError)
+	format := flags.String("format", "dot", "output format: dot or svg")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs layout [-format dot|svg] [-o file] <image>")
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "dot":
+		return filesystem.WriteLayoutDot(w)
+	case "svg":
+		return filesystem.WriteLayoutSVG(w)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runLs(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	recursive := flags.Bool("R", false, "list the directories below too")
+	names := flags.Bool("1", false, "list only names, a line each, without reading the inodes of the entries")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: fs ls [-R] [-1] <image> [path]")
+	}
+	dirname := "/"
+	if flags.NArg() == 2 {
+		dirname = flags.Arg(1)
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return listDir(filesystem, dirname, *recursive, *names, true)
+}
+
+// listDir prints the entries of a directory, and with recursive, those of
+// the directories below it, each under a heading naming it. With names, it
+// prints only their names, directories with a trailing slash.
+func listDir(filesystem *fs.FileSystem, dirname string, recursive, names, first bool) error {
+	read := filesystem.ReadDirByPath
+	if names {
+		read = filesystem.ListDir
+	}
+	entries, err := read(dirname)
+	if err != nil {
+		return err
+	}
+	if recursive {
+		if !first {
+			fmt.Println()
+		}
+		fmt.Printf("%s:\n", dirname)
+	}
+
+	if names {
+		for _, entry := range entries {
+			suffix := ""
+			if entry.Type == fs.InodeTypeDirectory {
+				suffix = "/"
+			}
+			fmt.Printf("%s%s\n", entry.Name, suffix)
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "name\ttype\tsize\tinode")
+		for _, entry := range entries {
+			kind := "file"
+			if entry.Type == fs.InodeTypeDirectory {
+				kind = "directory"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", entry.Name, kind, entry.Size, entry.Inode)
+		}
+		err = w.Flush()
+	}
+	if err != nil || !recursive {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Type == fs.InodeTypeDirectory {
+			err = listDir(filesystem, path.Join(dirname, entry.Name), true, names, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,15 +1,93 @@
 package main
 
 import (
-    "bytes"
-    "fmt"
+	"bytes"
+	"fmt"
+	"os"
 
-    "brenoafb.com/very-simple-filesystem/pkg/fs"
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
 )
 
+// command is a subcommand of the fs tool.
+type command struct {
+	name string
+	// usage describes the arguments, e.g. "doctor <image>"
+	usage string
+	// summary is a one-line description shown in the help output
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"doctor", "doctor <image>", "diagnose an image and suggest fixes", runDoctor},
+	{"fsck", "fsck [-repair] [-workers n] [-progress] <image>", "check an image's consistency and repair it", runFsck},
+	{"mkfs", "mkfs [-blocks n] [-inodes n] [-journal blocks] [-checksums] [-dedup] [-worm [-retention d]] [-encrypt] [-force] <image>", "format an image, creating it if needed", runMkfs},
+	{"df", "df <image>", "report the free blocks and inodes of an image", runDf},
+	{"ls", "ls [-R] [-1] <image> [path]", "list a directory of an image", runLs},
+	{"du", "du [-s] <image> [path]", "sum the space a directory of an image and its entries take", runDu},
+	{"scrub", "scrub <image>", "check the contents of every file against its checksum", runScrub},
+	{"defrag", "defrag <image>", "make files contiguous and gather the free space", runDefrag},
+	{"clone", "clone [-force] <src> <dst>", "copy an image, writing only the blocks it uses", runClone},
+	{"resize", "resize <image> <blocks>", "grow or shrink the filesystem of an image", runResize},
+	{"debug", "debug <image> [what]", "dump the superblock, bitmaps, inodes and blocks of an image", runDebug},
+	{"import", "import <image> [archive]", "copy the contents of a tar archive into an image", runImport},
+	{"export", "export <image> [archive]", "write the contents of an image as a tar archive", runExport},
+	{"diff", "diff <older> <newer>", "list the files and directories that differ between two images", runDiff},
+	{"incremental", "incremental <image> <since> [stream]", "write the changes since an older copy of an image as a change stream", runIncremental},
+	{"apply", "apply <image> [stream]", "apply a change stream to the older copy of an image", runApply},
+	{"put", "put <image> <local> [path]", "copy a local file into an image", runPut},
+	{"get", "get <image> <path> [local]", "copy a file out of an image, to stdout if local is -", runGet},
+	{"layout", "layout <image>", "render the block layout as Graphviz or SVG", runLayout},
+	{"serve", "serve [-http] [-addr host:port] <image>", "serve an image to remote clients over TCP, or its files over HTTP", runServe},
+	{"serve-api", "serve-api [-addr host:port] <image>", "serve the filesystem of an image through a REST API", runServeAPI},
+	{"bench", "bench <image>", "measure performance with a synthetic workload", runBench},
+	{"golden", "golden [-o dir]", "generate the golden image for the current format", runGolden},
+	{"explain", "explain [-name file]", "narrate what each operation does on the device", runExplain},
+	{"shell", "shell [-mkfs blocks] <image>", "browse and change an image, or a served one, interactively", runShell},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: fs <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Without a command, fs runs a small demo on an in-memory disk.")
+}
+
 func main() {
-	// create a 32KiB array
-	disk := make([]byte, 32*1024)
+	if len(os.Args) < 2 {
+		runDemo()
+		return
+	}
+
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fs %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "fs: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func runDemo() {
+	// create an array big enough to hold every data block
+	disk := make([]byte, (fs.DataStartIndex+32)*fs.BlockSize)
 	// create a BlockDevice that uses the array as storage
 	dev := fs.NewArrayBlockDevice(disk)
 
@@ -26,7 +104,7 @@ func main() {
 	// Add a file
 	contentString := "Hello, world!"
 	content := bytes.NewBufferString(contentString)
-	inode, err := filesystem.CreateFile("/foo.txt", *content)
+	inode, err := filesystem.CreateFile("/foo.txt", content)
 	if err != nil {
 		panic(err)
 	}
@@ -35,7 +113,7 @@ func main() {
 	filesystem.DisplayInfo()
 
 	// Read back the file
-	buf, err := filesystem.ReadFileContents(inode.Index)
+	buf, err := filesystem.ReadFileContents(int(inode.Index))
 
 	if err != nil {
 		panic(err)
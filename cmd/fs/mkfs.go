@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runMkfs(args []string) (err error) {
+	flags := flag.NewFlagSet("mkfs", flag.ExitOnError)
+	blocks := flags.Uint("blocks", 0, "size of the filesystem in blocks (0 uses the whole image, which must exist)")
+	inodes := flags.Uint("inodes", 0, "number of inodes (0 gives one per 16 KiB)")
+	journal := flags.Uint("journal", 0, "size of the journal in blocks (0 for none)")
+	checksums := flags.Bool("checksums", false, "checksum the metadata, so damage to it is detected")
+	dedup := flags.Bool("dedup", false, "share the blocks files have in common")
+	worm := flags.Bool("worm", false, "make the filesystem write-once")
+	retention := flags.Duration("retention", 0, "with -worm, how long files stay write-once (0 for forever)")
+	force := flags.Bool("force", false, "format the image even if it holds a filesystem, destroying it")
+	encrypt := flags.Bool("encrypt", false, "encrypt the image with the passphrase in $"+passphraseVar+", in a block more than the filesystem")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs mkfs [-blocks n] [-inodes n] [-journal blocks] [-checksums] [-dedup] [-worm [-retention d]] [-encrypt] [-force] <image>")
+	}
+	for _, f := range []struct {
+		name  string
+		value uint
+	}{{"blocks", *blocks}, {"inodes", *inodes}, {"journal", *journal}} {
+		if f.value > math.MaxUint32 {
+			return fmt.Errorf("-%s %d is too big; the most is %d", f.name, f.value, uint32(math.MaxUint32))
+		}
+	}
+	if *retention != 0 && !*worm {
+		return errors.New("-retention only applies with -worm")
+	}
+	image := flags.Arg(0)
+
+	// create the image if it doesn't exist, or grow it to fit
+	if _, statErr := os.Stat(image); os.IsNotExist(statErr) && *blocks == 0 {
+		return fmt.Errorf("%s doesn't exist; give its size with -blocks", image)
+	}
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	imageBlocks := int64(*blocks)
+	if *encrypt && imageBlocks > 0 {
+		// the encryption superblock takes a block before the filesystem
+		imageBlocks++
+	}
+	info, err := f.Stat()
+	if err == nil && imageBlocks*fs.BlockSize > info.Size() {
+		err = f.Truncate(imageBlocks * fs.BlockSize)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var dev interface {
+		imageDevice
+		BlockCount() uint64
+	}
+	dev, err = fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	if *encrypt {
+		encrypted, err := openEncrypted(dev)
+		if err != nil {
+			dev.Close()
+			return err
+		}
+		dev = encrypted
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if *blocks == 0 {
+		n := dev.BlockCount()
+		if n > math.MaxUint32 {
+			return fmt.Errorf("%s has %d blocks, more than a filesystem can span; give its size with -blocks", image, n)
+		}
+		*blocks = uint(n)
+	}
+
+	err = fs.Mkfs(dev, fs.MkfsOptions{
+		Force:         *force,
+		WORM:          *worm,
+		Retention:     *retention,
+		Blocks:        uint32(*blocks),
+		Inodes:        uint32(*inodes),
+		JournalBlocks: uint32(*journal),
+		Checksums:     *checksums,
+		Dedup:         *dedup,
+	})
+	if errors.Is(err, fs.ErrFormatted) {
+		err = fmt.Errorf("%w; use -force to overwrite it", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	sb, err := fs.ReadSuperblock(dev)
+	if err != nil {
+		return err
+	}
+	g := sb.Geometry
+	fmt.Printf("formatted %s: %d blocks of %d bytes, %d inodes, %d data blocks",
+		image, g.BlockCount, g.BlockSize, g.InodeCount, g.DataBlocks())
+	if g.JournalBlocks > 0 {
+		fmt.Printf(", a journal of %d blocks", g.JournalBlocks)
+	}
+	if g.ChecksumBlocks > 0 {
+		fmt.Printf(", a checksum table of %d blocks", g.ChecksumBlocks)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// runResize grows or shrinks the filesystem of an image. Image files are
+// extended before growing and truncated after shrinking; other devices keep
+// their size.
+func runResize(args []string) (err error) {
+	flags := flag.NewFlagSet("resize", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: fs resize <image> <blocks>")
+	}
+	image := flags.Arg(0)
+	blocks, err := strconv.ParseUint(flags.Arg(1), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid block count %q: %w", flags.Arg(1), err)
+	}
+	size := int64(blocks) * fs.BlockSize
+	info, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	regular := info.Mode().IsRegular()
+	if regular && info.Size() < size {
+		err = os.Truncate(image, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	before, err := resizeImage(image, blocks)
+	if err != nil {
+		return err
+	}
+	if regular && blocks < uint64(before) {
+		err = os.Truncate(image, size)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("resized from %d to %d blocks\n", before, blocks)
+	return nil
+}
+
+// resizeImage resizes the filesystem of image to the given number of blocks,
+// returning the number it had before.
+func resizeImage(image string, blocks uint64) (before uint32, err error) {
+	dev, err := fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	before = filesystem.Geometry().BlockCount
+	return before, filesystem.Resize(blocks)
+}
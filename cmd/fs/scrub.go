@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+func runScrub(args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs scrub <image>")
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	report, err := filesystem.Scrub()
+	if err != nil {
+		return err
+	}
+
+	for _, mismatch := range report.Mismatches {
+		fmt.Println(mismatch)
+	}
+	fmt.Printf("checked %d files, %d bytes", report.Files-report.Unchecked, report.Bytes)
+	if report.Unchecked > 0 {
+		fmt.Printf("; %d files have no checksum", report.Unchecked)
+	}
+	fmt.Println()
+	if n := len(report.Mismatches); n > 0 {
+		return fmt.Errorf("%d files don't match their checksum", n)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"brenoafb.com/very-simple-filesystem/pkg/httpfs"
+)
+
+// serveUsage describes the arguments of 'fs serve'.
+const serveUsage = "usage: fs serve [-http [-nolisting]] [-addr host:port] [-readonly] <image>"
+
+func runServe(args []string) (err error) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", "", "TCP address to listen on (default localhost:10809, or :8080 with -http)")
+	readOnly := flags.Bool("readonly", false, "serve the image for reading only")
+	files := flags.Bool("http", false, "serve the files of the image over HTTP instead of its blocks")
+	noListing := flags.Bool("nolisting", false, "with -http, don't list directories without an index.html")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New(serveUsage)
+	}
+	image := flags.Arg(0)
+	if *files {
+		if *addr == "" {
+			*addr = ":8080"
+		}
+		return serveFiles(image, *addr, httpfs.Options{NoListing: *noListing})
+	}
+	if *addr == "" {
+		*addr = "localhost:10809"
+	}
+
+	dev, err := fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{ReadOnly: *readOnly})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	// stop serving on interrupt, so the image is closed cleanly
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		l.Close()
+	}()
+
+	fmt.Printf("serving %s (%d blocks) on %s; use it as tcp://%s\n", image, dev.BlockCount(), l.Addr(), l.Addr())
+	return fs.ServeBlockDevice(l, dev)
+}
+
+// serveFiles serves the files of an image over HTTP until interrupted. The
+// image is read into memory, so it is never changed.
+func serveFiles(image, addr string, opts httpfs.Options) error {
+	filesystem, err := loadReadOnly(image)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: httpfs.NewHandler(filesystem, opts)}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		server.Close()
+	}()
+
+	fmt.Printf("serving the files of %s on http://%s\n", image, l.Addr())
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
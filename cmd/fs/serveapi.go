@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"brenoafb.com/very-simple-filesystem/pkg/fsapi"
+)
+
+// runServeAPI serves the filesystem of an image through the REST API of
+// package fsapi until interrupted, owning the image meanwhile, so several
+// processes or machines can share it.
+func runServeAPI(args []string) (err error) {
+	flags := flag.NewFlagSet("serve-api", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8081", "TCP address to listen on")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs serve-api [-addr host:port] <image>")
+	}
+	image := flags.Arg(0)
+
+	dev, err := openImage(image, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: fsapi.NewServer(filesystem)}
+
+	// stop serving on interrupt, so the image is closed cleanly
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		server.Close()
+	}()
+
+	fmt.Printf("serving the filesystem of %s on http://%s\n", image, l.Addr())
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// shell runs commands against a mounted image, one line at a time.
+type shell struct {
+	filesystem *fs.FileSystem
+	// cwd is the absolute name of the current directory
+	cwd string
+	out io.Writer
+}
+
+// shellCommand is a command of the interactive shell.
+type shellCommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(s *shell, args []string) error
+}
+
+var shellCommands []shellCommand
+
+func init() {
+	// assigned here, as help refers to the table
+	shellCommands = []shellCommand{
+		{"ls", "ls [dir]", "list a directory", (*shell).ls},
+		{"cat", "cat <file>", "print a file", (*shell).cat},
+		{"put", "put <local> [file]", "copy a local file into the image", (*shell).put},
+		{"get", "get <file> [local]", "copy a file out of the image", (*shell).get},
+		{"rm", "rm <file>", "delete a file", (*shell).rm},
+		{"ln", "ln <file> <name>", "give a file another name", (*shell).ln},
+		{"cp", "cp <file> <name>", "copy a file within the image", (*shell).cp},
+		{"truncate", "truncate <file> <size>", "shrink or extend a file", (*shell).truncate},
+		{"mkdir", "mkdir <dir>", "create a directory", (*shell).mkdir},
+		{"cd", "cd [dir]", "change the current directory", (*shell).cd},
+		{"stat", "stat <path>", "show the inode of a file or directory", (*shell).stat},
+		{"chmod", "chmod <mode> <path>", "set the permission bits of a file or directory, in octal", (*shell).chmod},
+		{"chown", "chown <uid>[:<gid>] <path>", "set the owner of a file or directory", (*shell).chown},
+		{"df", "df", "show the free space", (*shell).df},
+		{"quota", "quota <dir> [max-bytes max-inodes]", "show or set the quota of a directory; 0 is no limit", (*shell).quota},
+		{"xattr", "xattr <path> [name [value]]", "list, show or set the extended attributes of a file or directory", (*shell).xattr},
+		{"rmxattr", "rmxattr <path> <name>", "remove an extended attribute", (*shell).rmxattr},
+		{"help", "help", "list the commands", (*shell).help},
+	}
+}
+
+func runShell(args []string) (err error) {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	mkfs := flags.Uint("mkfs", 0, "create the image with this many blocks first")
+	journal := flags.Uint("journal", 0, "with -mkfs, give the filesystem a journal of this many blocks")
+	gzip := flags.Bool("gzip", false, "compress the files created with gzip")
+	encrypted := flags.Bool("encrypted", false, "the image is encrypted with the passphrase in $"+passphraseVar+", or with -mkfs, encrypt it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: fs shell [-mkfs blocks [-journal blocks]] [-gzip] [-encrypted] <image | tcp://host:port | s3://bucket/prefix>")
+	}
+	image := flags.Arg(0)
+
+	// served images already exist, and images in S3 are created when
+	// opened, so both are only formatted
+	if *mkfs > 0 && !strings.HasPrefix(image, "tcp://") && !strings.HasPrefix(image, "s3://") {
+		f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		imageBlocks := int64(*mkfs)
+		if *encrypted {
+			imageBlocks++
+		}
+		err = f.Truncate(imageBlocks * fs.BlockSize)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dev, err := openImage(image, uint64(*mkfs))
+	if err != nil {
+		return err
+	}
+	if *encrypted {
+		encryptedDev, err := openEncrypted(dev)
+		if err != nil {
+			dev.Close()
+			return err
+		}
+		dev = encryptedDev
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var filesystem *fs.FileSystem
+	if *mkfs > 0 {
+		filesystem, err = fs.NewFileSystemWithOptions(dev, fs.MkfsOptions{Blocks: uint32(*mkfs), JournalBlocks: uint32(*journal)})
+	} else {
+		filesystem, err = fs.LoadFilesystem(dev)
+		if errors.Is(err, fs.ErrDirty) {
+			err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if *gzip {
+		filesystem.SetCompression(fs.CompressionGzip)
+	}
+
+	s := &shell{filesystem: filesystem, cwd: "/", out: os.Stdout}
+	s.loop(os.Stdin)
+	return nil
+}
+
+// loop runs the commands read from r until it is exhausted or exit is
+// entered. Errors are printed, and don't end the loop.
+func (s *shell) loop(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(s.out, "fs:%s> ", s.cwd)
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return
+		}
+		err := s.run(args)
+		if err != nil {
+			fmt.Fprintf(s.out, "%s: %v\n", args[0], err)
+		}
+	}
+}
+
+// run runs a single command.
+func (s *shell) run(args []string) error {
+	for _, cmd := range shellCommands {
+		if cmd.name == args[0] {
+			return cmd.run(s, args[1:])
+		}
+	}
+	return errors.New("unknown command; try help")
+}
+
+// resolve turns a name relative to the current directory into an absolute
+// one.
+func (s *shell) resolve(name string) string {
+	return path.Clean(path.Join(s.cwd, name))
+}
+
+// lookup finds the inode with the given absolute name.
+func (s *shell) lookup(name string) (*fs.Inode, error) {
+	if name == "/" {
+		return s.filesystem.GetInode(0)
+	}
+	return s.filesystem.FindInodeByName(name)
+}
+
+// argument returns args[i], or def if there are fewer arguments. It fails
+// if there are more than max.
+func argument(args []string, i, max int, def string) (string, error) {
+	if len(args) > max || len(args) <= i && def == "" {
+		return "", errors.New("wrong number of arguments; try help")
+	}
+	if len(args) <= i {
+		return def, nil
+	}
+	return args[i], nil
+}
+
+func (s *shell) ls(args []string) error {
+	name, err := argument(args, 0, 1, ".")
+	if err != nil {
+		return err
+	}
+	dir, err := s.lookup(s.resolve(name))
+	if err != nil {
+		return err
+	}
+	if dir.Type != fs.InodeTypeDirectory {
+		fmt.Fprintf(s.out, "%8d %s\n", dir.Size, dir.Filename)
+		return nil
+	}
+	entries, err := s.filesystem.ReadDir(int(dir.Index))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		suffix := ""
+		if entry.Type == fs.InodeTypeDirectory {
+			suffix = "/"
+		}
+		fmt.Fprintf(s.out, "%8d %s%s\n", entry.Size, entry.Name, suffix)
+	}
+	return nil
+}
+
+func (s *shell) cat(args []string) error {
+	name, err := argument(args, 0, 1, "")
+	if err != nil {
+		return err
+	}
+	f, err := s.filesystem.Open(s.resolve(name), fs.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(s.out, f)
+	return err
+}
+
+func (s *shell) put(args []string) error {
+	local, err := argument(args, 0, 2, "")
+	if err != nil {
+		return err
+	}
+	name, err := argument(args, 1, 2, filepath.Base(local))
+	if err != nil {
+		return err
+	}
+	return s.filesystem.PutFromHost(local, s.resolve(name))
+}
+
+func (s *shell) get(args []string) error {
+	name, err := argument(args, 0, 2, "")
+	if err != nil {
+		return err
+	}
+	local, err := argument(args, 1, 2, path.Base(name))
+	if err != nil {
+		return err
+	}
+	return s.filesystem.GetToHost(s.resolve(name), local)
+}
+
+func (s *shell) rm(args []string) error {
+	name, err := argument(args, 0, 1, "")
+	if err != nil {
+		return err
+	}
+	return s.filesystem.DeleteFile(s.resolve(name))
+}
+
+func (s *shell) ln(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	return s.filesystem.Link(s.resolve(args[0]), s.resolve(args[1]))
+}
+
+func (s *shell) cp(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	return s.filesystem.CopyFile(s.resolve(args[0]), s.resolve(args[1]))
+}
+
+func (s *shell) truncate(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", args[1])
+	}
+	return s.filesystem.Truncate(s.resolve(args[0]), size)
+}
+
+func (s *shell) mkdir(args []string) error {
+	name, err := argument(args, 0, 1, "")
+	if err != nil {
+		return err
+	}
+	return s.filesystem.Mkdir(s.resolve(name))
+}
+
+func (s *shell) cd(args []string) error {
+	name, err := argument(args, 0, 1, "/")
+	if err != nil {
+		return err
+	}
+	dirname := s.resolve(name)
+	dir, err := s.lookup(dirname)
+	if err != nil {
+		return err
+	}
+	if dir.Type != fs.InodeTypeDirectory {
+		return fmt.Errorf("%s is not a directory", dirname)
+	}
+	s.cwd = dirname
+	return nil
+}
+
+func (s *shell) stat(args []string) error {
+	name, err := argument(args, 0, 1, "")
+	if err != nil {
+		return err
+	}
+	info, err := s.filesystem.Stat(s.resolve(name))
+	if err != nil {
+		return err
+	}
+	inode := info.Sys().(*fs.Inode)
+	kind := "file"
+	if info.IsDir() {
+		kind = "directory"
+	}
+	fmt.Fprintf(s.out, "name:       %s\n", s.resolve(name))
+	fmt.Fprintf(s.out, "inode:      %d\n", inode.Index)
+	fmt.Fprintf(s.out, "type:       %s\n", kind)
+	fmt.Fprintf(s.out, "size:       %d bytes, %d blocks\n", inode.Size, inode.StoredBlocks())
+	if c := inode.Compression(); c != fs.CompressionNone {
+		fmt.Fprintf(s.out, "compressed: %v\n", c)
+	}
+	fmt.Fprintf(s.out, "mode:       %04o\n", inode.Mode)
+	uid, gid := info.Owner()
+	fmt.Fprintf(s.out, "owner:      %d:%d\n", uid, gid)
+	fmt.Fprintf(s.out, "links:      %d\n", info.Links())
+	for _, t := range []struct {
+		label string
+		time  time.Time
+	}{
+		{"created:   ", info.CreateTime()},
+		{"modified:  ", info.ModTime()},
+		{"accessed:  ", info.AccessTime()},
+		{"changed:   ", info.ChangeTime()},
+	} {
+		if !t.time.IsZero() {
+			fmt.Fprintf(s.out, "%s %s\n", t.label, t.time.Format(time.RFC3339))
+		}
+	}
+	if inode.Project != 0 {
+		fmt.Fprintf(s.out, "project:    %d\n", inode.Project)
+	}
+	fmt.Fprintf(s.out, "generation: %d\n", inode.Generation)
+	return nil
+}
+
+func (s *shell) quota(args []string) error {
+	switch len(args) {
+	case 1:
+		usage, err := s.filesystem.GetQuotaUsage(s.resolve(args[0]))
+		if err != nil {
+			return err
+		}
+		limit := func(max uint64) string {
+			if max == 0 {
+				return "no limit"
+			}
+			return fmt.Sprintf("of %d", max)
+		}
+		fmt.Fprintf(s.out, "bytes:  %d used, %s\n", usage.Bytes, limit(usage.MaxBytes))
+		fmt.Fprintf(s.out, "inodes: %d used, %s\n", usage.Inodes, limit(usage.MaxInodes))
+		return nil
+	case 3:
+		maxBytes, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid byte limit %q", args[1])
+		}
+		maxInodes, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid inode limit %q", args[2])
+		}
+		return s.filesystem.SetQuota(s.resolve(args[0]), fs.Quota{MaxBytes: maxBytes, MaxInodes: maxInodes})
+	}
+	return errors.New("wrong number of arguments; try help")
+}
+
+func (s *shell) xattr(args []string) error {
+	switch len(args) {
+	case 1:
+		names, err := s.filesystem.ListXattr(s.resolve(args[0]))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			value, err := s.filesystem.GetXattr(s.resolve(args[0]), name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(s.out, "%s=%q\n", name, value)
+		}
+		return nil
+	case 2:
+		value, err := s.filesystem.GetXattr(s.resolve(args[0]), args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "%s\n", value)
+		return nil
+	case 3:
+		return s.filesystem.SetXattr(s.resolve(args[0]), args[1], []byte(args[2]))
+	}
+	return errors.New("wrong number of arguments; try help")
+}
+
+func (s *shell) chmod(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid mode %q", args[0])
+	}
+	return s.filesystem.Chmod(s.resolve(args[1]), iofs.FileMode(mode))
+}
+
+func (s *shell) chown(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	owner, group, hasGroup := strings.Cut(args[0], ":")
+	uid, err := strconv.ParseUint(owner, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid user %q", owner)
+	}
+	gid := -1
+	if hasGroup {
+		g, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid group %q", group)
+		}
+		gid = int(g)
+	}
+	return s.filesystem.Chown(s.resolve(args[1]), int(uid), gid)
+}
+
+func (s *shell) rmxattr(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments; try help")
+	}
+	return s.filesystem.RemoveXattr(s.resolve(args[0]), args[1])
+}
+
+func (s *shell) df(args []string) error {
+	if len(args) != 0 {
+		return errors.New("df takes no arguments")
+	}
+	layout, err := s.filesystem.Layout()
+	if err != nil {
+		return err
+	}
+	g := s.filesystem.Geometry()
+	free := 0
+	for _, b := range layout {
+		if b.Kind == fs.BlockKindFree {
+			free++
+		}
+	}
+	// only reachable inodes are counted
+	inodes := 0
+	err = s.filesystem.Walk("/", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		inodes++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// data block 0 holds the end of the inode table
+	total := int(g.DataBlocks()) - 1
+	fmt.Fprintf(s.out, "blocks: %d used, %d free, %d total (%d KiB free)\n", total-free, free, total, free*fs.BlockSize/1024)
+	fmt.Fprintf(s.out, "inodes: %d used, %d free, %d total\n", inodes, int(g.InodeCount)-inodes, g.InodeCount)
+	return nil
+}
+
+func (s *shell) help(args []string) error {
+	for _, cmd := range shellCommands {
+		fmt.Fprintf(s.out, "  %-20s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintf(s.out, "  %-20s %s\n", "exit", "close the image and leave")
+	return nil
+}
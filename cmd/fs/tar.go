@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+func runImport(args []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: fs import <image> [archive.tar]")
+	}
+	image := flags.Arg(0)
+
+	var archive io.Reader = os.Stdin
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive = f
+	}
+
+	dev, err := fs.OpenFileBlockDevice(image, fs.FileDeviceOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	filesystem, err := fs.LoadFilesystem(dev)
+	if errors.Is(err, fs.ErrDirty) {
+		err = fmt.Errorf("%w; check it with 'fs fsck' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := filesystem.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var done fs.Progress
+	err = filesystem.ImportTarWithOptions(archive, fs.TarOptions{Progress: func(p fs.Progress) {
+		done = p
+	}})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d entries, %d bytes, into %s\n", done.Items, done.Bytes, image)
+	return nil
+}
+
+func runExport(args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: fs export <image> [archive.tar]")
+	}
+
+	filesystem, err := loadReadOnly(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 1 || flags.Arg(1) == "-" {
+		return filesystem.ExportTar(os.Stdout)
+	}
+	f, err := os.Create(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return filesystem.ExportTar(f)
+}
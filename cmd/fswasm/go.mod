@@ -0,0 +1,7 @@
+module brenoafb.com/very-simple-filesystem/cmd/fswasm
+
+go 1.20
+
+replace brenoafb.com/very-simple-filesystem/pkg/fs => ../../pkg/fs
+
+require brenoafb.com/very-simple-filesystem/pkg/fs v0.0.0-00010101000000-000000000000 // indirect
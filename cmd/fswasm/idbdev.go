@@ -0,0 +1,175 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// blockStore is the IndexedDB object store holding the blocks, keyed by
+// block number.
+const blockStore = "blocks"
+
+// idbDevice is a block device kept in memory, in an ArrayBlockDevice, and
+// persisted to an IndexedDB database of the browser. IndexedDB is
+// asynchronous, so blocks are written to it on Sync only, all the blocks
+// written since the last Sync in one transaction: a page closed before a
+// Sync loses the changes made since, as a crash would.
+//
+// Its methods wait for IndexedDB, so they must not be called from the
+// goroutine running JavaScript callbacks.
+type idbDevice struct {
+	*fs.ArrayBlockDevice
+	db js.Value
+
+	mu    sync.Mutex
+	dirty map[uint64]bool
+}
+
+// openIDBDevice opens the device stored in the IndexedDB database name,
+// creating it if needed, with the given number of blocks. It reports
+// whether the database held any block, and thus a filesystem to mount.
+func openIDBDevice(name string, blocks uint64) (*idbDevice, bool, error) {
+	req := js.Global().Get("indexedDB").Call("open", name, 1)
+	upgrade := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		req.Get("result").Call("createObjectStore", blockStore)
+		return nil
+	})
+	defer upgrade.Release()
+	req.Set("onupgradeneeded", upgrade)
+	db, err := await(req, "onsuccess")
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening the database %s: %w", name, err)
+	}
+
+	dev := &idbDevice{
+		ArrayBlockDevice: fs.NewArrayBlockDevice(make([]byte, blocks*fs.BlockSize)),
+		db:               db,
+		dirty:            map[uint64]bool{},
+	}
+	// both requests are made at once, as the transaction ends when it has
+	// none pending
+	tx := db.Call("transaction", blockStore, "readonly")
+	store := tx.Call("objectStore", blockStore)
+	keysDone := watch(store.Call("getAllKeys"), "onsuccess")
+	valuesDone := watch(store.Call("getAll"), "onsuccess")
+	keys, err := keysDone()
+	if err != nil {
+		return nil, false, fmt.Errorf("error loading the blocks: %w", err)
+	}
+	values, err := valuesDone()
+	if err != nil {
+		return nil, false, fmt.Errorf("error loading the blocks: %w", err)
+	}
+	buf := make([]byte, fs.BlockSize)
+	for i := 0; i < keys.Length(); i++ {
+		blockNum := uint64(keys.Index(i).Int())
+		if blockNum >= blocks {
+			continue
+		}
+		js.CopyBytesToGo(buf, values.Index(i))
+		err = dev.ArrayBlockDevice.WriteBlock(blockNum, buf)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return dev, keys.Length() > 0, nil
+}
+
+// WriteBlock writes a block to memory, to be stored on the next Sync.
+func (dev *idbDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	err := dev.ArrayBlockDevice.WriteBlock(blockNum, buf)
+	if err != nil {
+		return err
+	}
+	dev.mu.Lock()
+	dev.dirty[blockNum] = true
+	dev.mu.Unlock()
+	return nil
+}
+
+// Sync stores the blocks written since the last Sync in the database, in
+// one transaction, so either all of them are stored or none.
+func (dev *idbDevice) Sync() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if len(dev.dirty) == 0 {
+		return nil
+	}
+	tx := dev.db.Call("transaction", blockStore, "readwrite")
+	store := tx.Call("objectStore", blockStore)
+	buf := make([]byte, fs.BlockSize)
+	for blockNum := range dev.dirty {
+		err := dev.ArrayBlockDevice.ReadBlock(blockNum, buf)
+		if err != nil {
+			tx.Call("abort")
+			return err
+		}
+		block := js.Global().Get("Uint8Array").New(fs.BlockSize)
+		js.CopyBytesToJS(block, buf)
+		store.Call("put", block, blockNum)
+	}
+	_, err := await(tx, "oncomplete")
+	if err != nil {
+		return fmt.Errorf("error storing the blocks: %w", err)
+	}
+	dev.dirty = map[uint64]bool{}
+	return nil
+}
+
+// await waits for an IndexedDB request or transaction to fire the event
+// done, returning the result of requests, or for it to fail.
+func await(target js.Value, done string) (js.Value, error) {
+	return watch(target, done)()
+}
+
+// watch starts watching an IndexedDB request or transaction for the event
+// done, or for it to fail, and returns a function waiting for that, which
+// must be called once. Events fired before a handler is set are missed, so
+// requests are watched as soon as they are made.
+func watch(target js.Value, done string) func() (js.Value, error) {
+	type outcome struct {
+		result js.Value
+		err    error
+	}
+	ch := make(chan outcome, 1)
+	send := func(o outcome) {
+		// only the first event counts
+		select {
+		case ch <- o:
+		default:
+		}
+	}
+	success := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var result js.Value
+		if done == "onsuccess" {
+			result = target.Get("result")
+		}
+		send(outcome{result: result})
+		return nil
+	})
+	failure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		msg := "request failed"
+		if e := target.Get("error"); e.Truthy() {
+			msg = e.Get("message").String()
+		}
+		send(outcome{err: errors.New(msg)})
+		return nil
+	})
+	target.Set(done, success)
+	target.Set("onerror", failure)
+	if done == "oncomplete" {
+		target.Set("onabort", failure)
+	}
+	return func() (js.Value, error) {
+		o := <-ch
+		success.Release()
+		failure.Release()
+		return o.result, o.err
+	}
+}
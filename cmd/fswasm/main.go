@@ -0,0 +1,297 @@
+//go:build js && wasm
+
+// Command fswasm runs the filesystem in a web browser, for teaching: a
+// page types commands at a filesystem on a device kept in the browser's
+// IndexedDB, so it survives reloading the page, and draws the layout of
+// its blocks as they change. Build it with 'make wasm' and serve this
+// directory, with index.html, over HTTP.
+//
+// It exports two functions to JavaScript, both returning promises:
+// fsRun(line) runs a command line and resolves to what it prints, and
+// fsLayout() resolves to the block layout as SVG.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"syscall/js"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+const (
+	// database is the IndexedDB database holding the device.
+	database = "very-simple-filesystem"
+	// blocks is the size of the device, 2 MiB.
+	blocks = 512
+)
+
+// demo is the filesystem of the page and its device.
+type demo struct {
+	dev        *idbDevice
+	filesystem *fs.FileSystem
+}
+
+// demoCommand is a command fsRun understands.
+type demoCommand struct {
+	name  string
+	usage string
+	run   func(d *demo, w io.Writer, args []string) error
+}
+
+var demoCommands []demoCommand
+
+func init() {
+	// assigned here, as help refers to the table
+	demoCommands = []demoCommand{
+		{"ls", "ls [dir]", (*demo).ls},
+		{"cat", "cat <file>", (*demo).cat},
+		{"write", "write <file> <text>", (*demo).write},
+		{"append", "append <file> <text>", (*demo).append},
+		{"rm", "rm <file>", (*demo).rm},
+		{"mkdir", "mkdir <dir>", (*demo).mkdir},
+		{"mv", "mv <path> <new path>", (*demo).mv},
+		{"stat", "stat <path>", (*demo).stat},
+		{"df", "df", (*demo).df},
+		{"format", "format", (*demo).format},
+		{"help", "help", (*demo).help},
+	}
+}
+
+func main() {
+	d := &demo{}
+	err := d.open()
+	if err != nil {
+		js.Global().Get("console").Call("error", err.Error())
+		return
+	}
+	js.Global().Set("fsRun", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		line := ""
+		if len(args) > 0 {
+			line = args[0].String()
+		}
+		return promise(func() (string, error) {
+			return d.run(line), nil
+		})
+	}))
+	js.Global().Set("fsLayout", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return promise(func() (string, error) {
+			var buf bytes.Buffer
+			err := d.filesystem.WriteLayoutSVG(&buf)
+			return buf.String(), err
+		})
+	}))
+	// the functions are called until the page is closed
+	select {}
+}
+
+// promise runs f in a goroutine of its own, as it may wait for IndexedDB,
+// which the goroutine running JavaScript callbacks can't, and returns a
+// promise of its result.
+func promise(f func() (string, error)) js.Value {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			result, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+// open opens the device, mounting the filesystem it holds, or formatting
+// it the first time.
+func (d *demo) open() error {
+	dev, formatted, err := openIDBDevice(database, blocks)
+	if err != nil {
+		return err
+	}
+	d.dev = dev
+	if !formatted {
+		return d.mkfs()
+	}
+	// pages are closed without unmounting, which leaves no harm as long
+	// as every command is synced
+	d.filesystem, err = fs.LoadFilesystemWithOptions(dev, fs.MountOptions{Recovery: fs.RecoveryForce, DirOrder: fs.DirOrderName})
+	return err
+}
+
+// mkfs formats the device and mounts the new filesystem.
+func (d *demo) mkfs() error {
+	filesystem, err := fs.NewFileSystemWithOptions(d.dev, fs.MkfsOptions{Blocks: blocks, JournalBlocks: 16, Force: true})
+	if err != nil {
+		return err
+	}
+	filesystem.SetDirOrder(fs.DirOrderName)
+	d.filesystem = filesystem
+	return filesystem.Sync()
+}
+
+// run runs a command line, returning what it prints. Every command is
+// synced, so its changes are stored by the time it returns.
+func (d *demo) run(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return ""
+	}
+	var out bytes.Buffer
+	for _, cmd := range demoCommands {
+		if cmd.name == args[0] {
+			err := cmd.run(d, &out, args[1:])
+			if err == nil {
+				err = d.filesystem.Sync()
+			}
+			if err != nil {
+				fmt.Fprintf(&out, "%s: %v\n", cmd.name, err)
+			}
+			return out.String()
+		}
+	}
+	return fmt.Sprintf("unknown command %q, try help\n", args[0])
+}
+
+// absolute makes a path given to a command absolute; there is no current
+// directory, so relative paths are relative to the root.
+func absolute(name string) string {
+	return path.Join("/", name)
+}
+
+// usage is the error of a command given the wrong arguments.
+func usage(name string) error {
+	for _, cmd := range demoCommands {
+		if cmd.name == name {
+			return fmt.Errorf("usage: %s", cmd.usage)
+		}
+	}
+	return errors.New("wrong arguments")
+}
+
+func (d *demo) ls(w io.Writer, args []string) error {
+	dir := "/"
+	if len(args) > 1 {
+		return usage("ls")
+	}
+	if len(args) == 1 {
+		dir = absolute(args[0])
+	}
+	entries, err := d.filesystem.ReadDirByPath(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type == fs.InodeTypeDirectory {
+			fmt.Fprintf(w, "%s/\n", entry.Name)
+		} else {
+			fmt.Fprintf(w, "%-24s %8d bytes  inode %d\n", entry.Name, entry.Size, entry.Inode)
+		}
+	}
+	return nil
+}
+
+func (d *demo) cat(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return usage("cat")
+	}
+	data, err := d.filesystem.ReadFile(absolute(args[0]))
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func (d *demo) write(w io.Writer, args []string) error {
+	if len(args) < 2 {
+		return usage("write")
+	}
+	text := strings.Join(args[1:], " ") + "\n"
+	return d.filesystem.WriteFileAtomic(absolute(args[0]), bytes.NewBufferString(text))
+}
+
+func (d *demo) append(w io.Writer, args []string) error {
+	if len(args) < 2 {
+		return usage("append")
+	}
+	return d.filesystem.Append(absolute(args[0]), []byte(strings.Join(args[1:], " ")+"\n"))
+}
+
+func (d *demo) rm(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return usage("rm")
+	}
+	return d.filesystem.DeleteFile(absolute(args[0]))
+}
+
+func (d *demo) mkdir(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return usage("mkdir")
+	}
+	return d.filesystem.Mkdir(absolute(args[0]))
+}
+
+func (d *demo) mv(w io.Writer, args []string) error {
+	if len(args) != 2 {
+		return usage("mv")
+	}
+	return d.filesystem.Rename(absolute(args[0]), absolute(args[1]))
+}
+
+func (d *demo) stat(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return usage("stat")
+	}
+	name := absolute(args[0])
+	info, err := d.filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %v, %d bytes, modified %s\n", name, info.Mode(), info.Size(), info.ModTime().Format("2006-01-02 15:04:05"))
+	if name == "/" {
+		return nil
+	}
+	inode, err := d.filesystem.FindInodeByName(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "inode %d, %d links, %d blocks stored\n", inode.Index, inode.Links, inode.StoredBlocks())
+	return nil
+}
+
+func (d *demo) df(w io.Writer, args []string) error {
+	stats, err := d.filesystem.Statfs()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d of %d data blocks free, %d of %d inodes free\n",
+		stats.FreeBlocks, stats.Blocks, stats.FreeInodes, stats.Inodes)
+	return nil
+}
+
+func (d *demo) format(w io.Writer, args []string) error {
+	err := d.mkfs()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "formatted a new filesystem")
+	return nil
+}
+
+func (d *demo) help(w io.Writer, args []string) error {
+	for _, cmd := range demoCommands {
+		fmt.Fprintln(w, cmd.usage)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//go:build !race
+
+// The race detector makes sync.Pool drop buffers at random, so allocations
+// are only counted without it.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newReadBenchFileSystem creates /d0 through /d9 with two blocks each.
+func newReadBenchFileSystem(tb testing.TB) *FileSystem {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(tb, err)
+	for i := 0; i < 10; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/d%d", i), bytes.NewBuffer(make([]byte, 2*BlockSize)))
+		require.NoError(tb, err)
+	}
+	return filesystem
+}
+
+func TestReadPathDoesNotAllocate(t *testing.T) {
+	filesystem := newReadBenchFileSystem(t)
+	f, err := filesystem.OpenFile("/d9", O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 1000)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := f.Read(buf)
+		if err == io.EOF {
+			f.offset = 0
+		}
+	})
+	require.Zero(t, allocs, "File.Read")
+
+	allocs = testing.AllocsPerRun(100, func() {
+		_, _ = filesystem.FindInodeByName("/d9")
+	})
+	require.Zero(t, allocs, "FindInodeByName")
+}
+
+func TestIndexedLookupDoesNotAllocate(t *testing.T) {
+	filesystem, _ := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", 200)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = filesystem.FindInodeByName("/big/file number 0150")
+	})
+	require.Zero(t, allocs)
+}
+
+func BenchmarkFileRead(b *testing.B) {
+	for _, size := range []int{512, BlockSize} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			filesystem := newReadBenchFileSystem(b)
+			f, err := filesystem.OpenFile("/d9", O_RDONLY, 0)
+			require.NoError(b, err)
+			defer f.Close()
+			buf := make([]byte, size)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := f.Read(buf)
+				if err == io.EOF {
+					f.offset = 0
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFindInodeByName(b *testing.B) {
+	filesystem := newReadBenchFileSystem(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := filesystem.FindInodeByName("/d9")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fs
+
+import "fmt"
+
+// Data blocks for file contents are allocated by the allocator of the
+// AllocPolicy in effect, which picks them from the free runs of the data
+// bitmap, see freeExtents, given a goal: the block right after the file's
+// last one, so the file can go on in the same run. Metadata blocks, such as
+// pointer blocks, always take the lowest free blocks, and so does
+// FindEmptyBlocks.
+//
+// The free runs keep a count of the free blocks, so a request for more than
+// there are fails without looking at the runs, and Statfs doesn't count
+// them.
+
+// AllocPolicy chooses the free data blocks new file contents go to.
+type AllocPolicy int
+
+const (
+	// AllocContiguous continues files right after their last block if it
+	// is free, and takes the rest from the first run of free blocks
+	// holding all of it, or failing that from the longest runs, so files
+	// take few extents.
+	AllocContiguous AllocPolicy = iota
+	// AllocFirstFit takes the lowest free blocks, wherever the file is.
+	AllocFirstFit
+	// AllocBestFit is AllocContiguous, taking the rest from the smallest
+	// run holding all of it, which leaves the long runs to large files.
+	AllocBestFit
+)
+
+func (p AllocPolicy) String() string {
+	switch p {
+	case AllocContiguous:
+		return "contiguous"
+	case AllocFirstFit:
+		return "first-fit"
+	case AllocBestFit:
+		return "best-fit"
+	default:
+		return "unknown"
+	}
+}
+
+// allocator picks n entries from the free runs of a bitmap, near goal or
+// anywhere for a negative goal. It returns as many as there are if fewer are
+// free.
+type allocator interface {
+	allocate(free *freeExtents, n, goal int) []int
+}
+
+type contiguousAllocator struct{}
+
+func (contiguousAllocator) allocate(free *freeExtents, n, goal int) []int {
+	return free.contiguous(n, goal)
+}
+
+type firstFitAllocator struct{}
+
+func (firstFitAllocator) allocate(free *freeExtents, n, goal int) []int {
+	return free.lowest(n)
+}
+
+type bestFitAllocator struct{}
+
+func (bestFitAllocator) allocate(free *freeExtents, n, goal int) []int {
+	return free.bestFit(n, goal)
+}
+
+// allocator returns the allocator of the policy.
+func (p AllocPolicy) allocator() allocator {
+	switch p {
+	case AllocFirstFit:
+		return firstFitAllocator{}
+	case AllocBestFit:
+		return bestFitAllocator{}
+	default:
+		return contiguousAllocator{}
+	}
+}
+
+// SetAllocPolicy sets how data blocks are chosen for new file contents. The
+// default is AllocContiguous.
+func (fs *FileSystem) SetAllocPolicy(policy AllocPolicy) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.allocPolicy = policy
+}
+
+// AllocStats counts the data block allocations made since the filesystem was
+// mounted, whether or not the operations they were for succeeded.
+type AllocStats struct {
+	// Allocations is the number of allocations and Blocks the number of
+	// blocks they took.
+	Allocations uint64
+	Blocks      uint64
+	// Runs is the number of runs of consecutive blocks the allocations
+	// took, and Fragmented the number of allocations taking more than one.
+	Runs       uint64
+	Fragmented uint64
+	// Continued is the number of allocations that continued a file right
+	// after its last block.
+	Continued uint64
+	// Failed is the number of allocations that failed for lack of space.
+	Failed uint64
+}
+
+// AllocStats returns the allocation statistics of the filesystem.
+func (fs *FileSystem) AllocStats() AllocStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.allocStats
+}
+
+// allocateBlocks picks n free data blocks with a, given the entry of the
+// goal in the data bitmap, and counts the allocation. It returns device
+// block indices. The caller marks them allocated.
+func (fs *FileSystem) allocateBlocks(n, goal int, a allocator) ([]uint32, error) {
+	dataBlockIndices := []uint32{}
+	if n == 0 {
+		return dataBlockIndices, nil
+	}
+	stats := &fs.allocStats
+	stats.Allocations++
+	if n > fs.freeBlocks.free {
+		stats.Failed++
+		return dataBlockIndices, fmt.Errorf("not enough free data blocks: %w", ErrNoSpace)
+	}
+
+	entries := a.allocate(fs.freeBlocks, n, goal)
+	runs := uint64(0)
+	for k, i := range entries {
+		if k == 0 || i != entries[k-1]+1 {
+			runs++
+		}
+		dataBlockIndices = append(dataBlockIndices, uint32(i)+fs.geometry.DataStart)
+	}
+	stats.Blocks += uint64(len(entries))
+	stats.Runs += runs
+	if runs > 1 {
+		stats.Fragmented++
+	}
+	if goal >= 0 && entries[0] == goal {
+		stats.Continued++
+	}
+	return dataBlockIndices, nil
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newHoleyFileSystem returns a filesystem with a hole of three free blocks
+// and then one of a single block, and the blocks of each.
+func newHoleyFileSystem(t *testing.T, policy AllocPolicy) (*FileSystem, []uint32, []uint32) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, (DataStartIndex+64)*BlockSize)))
+	require.NoError(t, err)
+	filesystem.SetAllocPolicy(policy)
+	sizes := []int{1, 3, 1, 1, 1}
+	inodes := []*Inode{}
+	for i, size := range sizes {
+		inode, err := filesystem.CreateFile("/"+string(rune('a'+i)), bytes.NewBuffer(make([]byte, size*BlockSize)))
+		require.NoError(t, err)
+		inodes = append(inodes, inode)
+	}
+	big := append([]uint32{}, inodes[1].usedBlocks()...)
+	small := append([]uint32{}, inodes[3].usedBlocks()...)
+	require.NoError(t, filesystem.DeleteFile("/b"))
+	require.NoError(t, filesystem.DeleteFile("/d"))
+	return filesystem, big, small
+}
+
+func TestAllocPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy AllocPolicy
+		// hole is 0 for the hole of three blocks, 1 for the single block
+		hole int
+	}{
+		{AllocContiguous, 0},
+		{AllocFirstFit, 0},
+		{AllocBestFit, 1},
+	} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			filesystem, big, small := newHoleyFileSystem(t, tt.policy)
+			inode, err := filesystem.CreateFile("/new", bytes.NewBuffer(make([]byte, BlockSize)))
+			require.NoError(t, err)
+			hole := [][]uint32{big, small}[tt.hole]
+			require.Equal(t, hole[:1], inode.usedBlocks())
+		})
+	}
+}
+
+func TestAllocPolicyAppend(t *testing.T) {
+	filesystem, _, _ := newHoleyFileSystem(t, AllocBestFit)
+	e, err := filesystem.FindInodeByName("/e")
+	require.NoError(t, err)
+	last := e.usedBlocks()[0]
+	before := filesystem.AllocStats()
+
+	// appending goes on after the last block of /e rather than into a hole
+	require.NoError(t, filesystem.Append("/e", make([]byte, 2*BlockSize)))
+	require.Equal(t, []uint32{last, last + 1, last + 2}, e.usedBlocks())
+	stats := filesystem.AllocStats()
+	require.Equal(t, before.Allocations+1, stats.Allocations)
+	require.Equal(t, before.Blocks+2, stats.Blocks)
+	require.Equal(t, before.Runs+1, stats.Runs)
+	require.Equal(t, before.Continued+1, stats.Continued)
+	require.Equal(t, before.Fragmented, stats.Fragmented)
+}
+
+func TestAllocStatsNoSpace(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, (DataStartIndex+32)*BlockSize)))
+	require.NoError(t, err)
+	free := filesystem.freeBlocks.free
+	_, err = filesystem.CreateFile("/big", bytes.NewBuffer(make([]byte, (free+1)*BlockSize)))
+	require.ErrorIs(t, err, ErrNoSpace)
+	stats := filesystem.AllocStats()
+	require.Equal(t, uint64(1), stats.Failed)
+	require.Empty(t, filesystem.checkFreeSpaceIndex())
+}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+)
+
+// WriteFileAtomic sets the contents of the file with the given absolute name
+// to what r holds, creating the file if it doesn't exist. Unlike truncating
+// and rewriting the file, readers see the old contents or the new ones,
+// never a mix and never a missing file: the new contents go to a new inode
+// that no directory refers to, and once it is written, the directory entry
+// is switched over to it, which rewrites the directory once. The old inode
+// is then dropped as by DeleteFile.
+//
+// The new file gets the permission bits of the old one. Other names of the
+// old file, see Link, keep the old contents, and open Files of it fail with
+// ErrStale once it is freed. On write-once filesystems, replacing a file
+// fails with ErrWORM until its retention period has passed. With a journal,
+// a crash leaves the old contents or the new ones as well; without one, the
+// inode that isn't in the directory at the time of a crash is freed by the
+// next mount, see orphan.go.
+func (fs *FileSystem) WriteFileAtomic(filename string, r io.Reader) (err error) {
+	return fs.WriteFileAtomicContext(context.Background(), filename, r)
+}
+
+// WriteFileAtomicContext is WriteFileAtomic under ctx, see context.go.
+// Reading r isn't cancelled by ctx.
+func (fs *FileSystem) WriteFileAtomicContext(ctx context.Context, filename string, r io.Reader) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("WriteFileAtomic %s", filename)
+	defer fs.checkInvariantsAfter("WriteFileAtomic")()
+	defer fs.withContext(ctx)()
+	return fs.writeFileAtomic(filename, r)
+}
+
+// writeFileAtomic is WriteFileAtomic, for callers holding fs.mu.
+func (fs *FileSystem) writeFileAtomic(filename string, r io.Reader) error {
+	name := baseName(filename)
+	err := checkName(name)
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+	parent, err := fs.findParent(filename)
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+	if parent.Type != InodeTypeDirectory {
+		return fmt.Errorf("error replacing %s: parent: %w", filename, ErrNotDirectory)
+	}
+	old, err := fs.lookup(int(parent.Index), name)
+	if errors.Is(err, ErrNotExist) {
+		_, err = fs.createFile(filename, r, DefaultFileMode)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+	if old.Type != InodeTypeFile {
+		return fmt.Errorf("error replacing %s: %w", filename, ErrIsDirectory)
+	}
+	err = fs.checkAccess(parent, accessWrite)
+	if err == nil {
+		err = fs.checkRetained(old)
+	}
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+	// keep the old inode loaded until it is dropped
+	fs.inodes.pin(int(old.Index))
+	defer fs.inodes.unpin(int(old.Index))
+	blocks, err := fs.readBlockMap(old)
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+
+	_, err = fs.newInode(parent, filename, InodeTypeFile, r, iofs.FileMode(old.Mode), fs.compression, func(snapshot *metadataSnapshot, inode *Inode) error {
+		fs.include(snapshot, int(old.Index))
+		if old.links() <= 1 {
+			err := fs.addOrphan(int(old.Index))
+			if err != nil {
+				return err
+			}
+		}
+		err := fs.replaceEntry(int(parent.Index), name, int(inode.Index))
+		if err != nil {
+			return err
+		}
+		return fs.dropLink(snapshot, old, blocks)
+	})
+	if err != nil {
+		return fmt.Errorf("error replacing %s: %w", filename, err)
+	}
+	return nil
+}
+
+// replaceEntry points the entry of a directory with the given name at
+// another inode of the same type, rewriting the directory once.
+func (fs *FileSystem) replaceEntry(dirInodeIndex int, name string, inodeIndex int) error {
+	records, err := fs.readDirRecords(dirInodeIndex)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range records {
+		if records[i].name == name {
+			found = true
+			records[i].inode = inodeIndex
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("error replacing %s in directory %d: %w", name, dirInodeIndex, ErrNotExist)
+	}
+
+	err = fs.writeDirRecords(dirInodeIndex, records)
+	if err != nil {
+		return fmt.Errorf("error updating directory contents: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts MkfsOptions
+	}{
+		{"plain", MkfsOptions{Blocks: 300}},
+		{"journal", MkfsOptions{Blocks: 300, JournalBlocks: 32}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := make([]byte, 300*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), tt.opts)
+			require.NoError(t, err)
+			stats, err := filesystem.Statfs()
+			require.NoError(t, err)
+			free := stats.FreeBlocks
+
+			// a missing file is created
+			require.NoError(t, filesystem.WriteFileAtomic("/config", bytes.NewBuffer(patterned(3*BlockSize))))
+			require.NoError(t, filesystem.Chmod("/config", 0o600))
+			before, err := filesystem.Handle("/config")
+			require.NoError(t, err)
+			f, err := filesystem.Open("/config", O_RDONLY)
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Link("/config", "/backup"))
+
+			want := []byte("the new contents")
+			require.NoError(t, filesystem.WriteFileAtomic("/config", bytes.NewBuffer(want)))
+			data, err := filesystem.ReadFile("/config")
+			require.NoError(t, err)
+			require.Equal(t, want, data)
+			info, err := filesystem.Stat("/config")
+			require.NoError(t, err)
+			require.Equal(t, "-rw-------", info.Mode().String())
+			after, err := filesystem.Handle("/config")
+			require.NoError(t, err)
+			require.NotEqual(t, before, after)
+			// the other name keeps the old contents, so the old file is open
+			data, err = filesystem.ReadFile("/backup")
+			require.NoError(t, err)
+			require.Equal(t, patterned(3*BlockSize), data)
+			_, err = io.ReadAll(f)
+			require.NoError(t, err)
+
+			require.NoError(t, filesystem.DeleteFile("/backup"))
+			_, err = io.ReadAll(f)
+			require.ErrorIs(t, err, ErrStale)
+			require.NoError(t, f.Close())
+			stats, err = filesystem.Statfs()
+			require.NoError(t, err)
+			// a block of / and one of /config
+			require.Equal(t, free-2, stats.FreeBlocks)
+			entries, err := filesystem.ReadDirByPath("/")
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+
+			// a failed write leaves the old file
+			err = filesystem.WriteFileAtomic("/config", iotest.ErrReader(errInjected))
+			require.ErrorIs(t, err, errInjected)
+			data, err = filesystem.ReadFile("/config")
+			require.NoError(t, err)
+			require.Equal(t, want, data)
+			stats, err = filesystem.Statfs()
+			require.NoError(t, err)
+			// a block of / and one of /config
+			require.Equal(t, free-2, stats.FreeBlocks)
+
+			require.NoError(t, filesystem.Mkdir("/dir"))
+			require.ErrorIs(t, filesystem.WriteFileAtomic("/dir", bytes.NewBuffer(want)), ErrIsDirectory)
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+			report, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Problems)
+		})
+	}
+}
+
+func TestWriteFileAtomicCrash(t *testing.T) {
+	old, want := patterned(2*BlockSize), []byte("new")
+	image := make([]byte, 300*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(image), MkfsOptions{Blocks: 300, JournalBlocks: 32})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBuffer(old))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// count the writes of a run without a crash
+	dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(bytes.Clone(image)))
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, before := dev.Operations()
+	require.NoError(t, filesystem.WriteFileAtomic("/file", bytes.NewBuffer(want)))
+	_, after := dev.Operations()
+
+	sawOld, sawNew := false, false
+	for n := 0; n <= after-before; n++ {
+		disk := bytes.Clone(image)
+		dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(disk))
+		filesystem, err := LoadFilesystem(dev)
+		require.NoError(t, err)
+		dev.CrashAfter(n)
+		filesystem.WriteFileAtomic("/file", bytes.NewBuffer(want))
+
+		// mounting replays the journal
+		recovered, err := LoadFilesystem(NewArrayBlockDevice(disk))
+		require.NoError(t, err, "crash after %d writes", n)
+		data, err := recovered.ReadFile("/file")
+		require.NoError(t, err, "crash after %d writes", n)
+		if bytes.Equal(data, want) {
+			sawNew = true
+		} else {
+			require.Equal(t, old, data, "crash after %d writes", n)
+			require.False(t, sawNew, "crash after %d writes", n)
+			sawOld = true
+		}
+		require.NoError(t, recovered.Close())
+	}
+	require.True(t, sawOld)
+	require.True(t, sawNew)
+}
+
+func TestWriteFileAtomicReaders(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	contents := [][]byte{bytes.Repeat([]byte("a"), 3*BlockSize), bytes.Repeat([]byte("b"), BlockSize+1)}
+	require.NoError(t, filesystem.WriteFileAtomic("/file", bytes.NewBuffer(contents[0])))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := filesystem.WriteFileAtomic("/file", bytes.NewBuffer(contents[i%2])); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, err := filesystem.ReadFile("/file")
+		require.NoError(t, err)
+		require.Contains(t, contents, data)
+	}
+}
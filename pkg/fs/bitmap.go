@@ -0,0 +1,326 @@
+package fs
+
+import (
+	"bytes"
+	"math/bits"
+	"strings"
+)
+
+// Bitmap is a set of entries, each taken or free, packed a bit per entry,
+// least significant bit first. The filesystem keeps its inode and data
+// bitmaps in memory as Bitmaps, and stores them so from version 14 on, see
+// Geometry.PackedBitmaps. The zero value has no entries.
+type Bitmap struct {
+	// bits holds the entries; the bits past the last entry are always 0
+	bits []byte
+	n    int
+}
+
+// NewBitmap returns a bitmap of n free entries.
+func NewBitmap(n int) *Bitmap {
+	return &Bitmap{bits: make([]byte, (n+7)/8), n: n}
+}
+
+// Len returns the number of entries.
+func (b *Bitmap) Len() int {
+	return b.n
+}
+
+// Test reports whether entry i is taken.
+func (b *Bitmap) Test(i int) bool {
+	return b.bits[i/8]&(1<<(i%8)) != 0
+}
+
+// Set marks entry i taken.
+func (b *Bitmap) Set(i int) {
+	if i >= b.n {
+		panic("fs: bitmap entry out of range")
+	}
+	b.bits[i/8] |= 1 << (i % 8)
+}
+
+// Clear marks entry i free.
+func (b *Bitmap) Clear(i int) {
+	if i >= b.n {
+		panic("fs: bitmap entry out of range")
+	}
+	b.bits[i/8] &^= 1 << (i % 8)
+}
+
+// FindFirstClear returns the first free entry from entry from on, and false
+// if there is none.
+func (b *Bitmap) FindFirstClear(from int) (int, bool) {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < b.n; {
+		byteIndex := i / 8
+		// the bits before i count as taken
+		taken := b.bits[byteIndex] | byte(1<<(i%8)-1)
+		if taken == 0xff {
+			i = (byteIndex + 1) * 8
+			continue
+		}
+		i = byteIndex*8 + bits.TrailingZeros8(^taken)
+		if i >= b.n {
+			break
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// CountFree returns the number of free entries.
+func (b *Bitmap) CountFree() int {
+	taken := 0
+	for _, x := range b.bits {
+		taken += bits.OnesCount8(x)
+	}
+	return b.n - taken
+}
+
+// Clone returns a copy of the bitmap.
+func (b *Bitmap) Clone() *Bitmap {
+	return &Bitmap{bits: bytes.Clone(b.bits), n: b.n}
+}
+
+// Equal reports whether two bitmaps have the same entries.
+func (b *Bitmap) Equal(other *Bitmap) bool {
+	return b.n == other.n && bytes.Equal(b.bits, other.bits)
+}
+
+// String returns the entries, '1' for taken and '0' for free.
+func (b *Bitmap) String() string {
+	var s strings.Builder
+	s.Grow(b.n)
+	for i := 0; i < b.n; i++ {
+		if b.Test(i) {
+			s.WriteByte('1')
+		} else {
+			s.WriteByte('0')
+		}
+	}
+	return s.String()
+}
+
+// resize grows or shrinks the bitmap to n entries. New entries are free.
+func (b *Bitmap) resize(n int) {
+	size := (n + 7) / 8
+	if size > len(b.bits) {
+		b.bits = append(b.bits, make([]byte, size-len(b.bits))...)
+	}
+	b.bits = b.bits[:size]
+	b.n = n
+	if n%8 != 0 {
+		b.bits[size-1] &= 1<<(n%8) - 1
+	}
+}
+
+// bitmap caches a bitmap of the device, the inode bitmap or the data
+// bitmap, block by block. The cached blocks are the blocks on the device,
+// plus the changes not written yet, which mark their blocks dirty until
+// flushBitmap writes them; nothing else is kept in memory, so a mounted
+// filesystem and a fresh LoadFilesystem of its device see the same bitmap
+// once it is flushed.
+//
+// entries may be read directly; changes must go through set or replace, or
+// they never reach the device.
+type bitmap struct {
+	// start is the device block the bitmap starts at
+	start uint32
+	// entries holds the entries
+	entries *Bitmap
+	// free is the number of free entries, kept as they change so the
+	// superblock can record it without counting, see counters.go
+	free int
+	// packed is set if the device holds a bit per entry rather than a byte,
+	// see Geometry.PackedBitmaps
+	packed bool
+	// dirty marks the blocks of the bitmap changed since they were written
+	dirty []bool
+	// invalid is the first entry of a byte-per-entry bitmap that was read
+	// with a value other than 0 or 1, and invalidValue that value; these
+	// are read as taken, and validate reports them. invalidValue is 0 if
+	// there is none.
+	invalid      int
+	invalidValue byte
+}
+
+// entriesPerBlock returns how many entries a block of a bitmap holds.
+func entriesPerBlock(packed bool) int {
+	if packed {
+		return 8 * BlockSize
+	}
+	return BlockSize
+}
+
+// bitmapBlocks returns the number of blocks a bitmap of n entries takes.
+func bitmapBlocks(n uint32, packed bool) uint32 {
+	if packed {
+		return blocksFor((uint64(n) + 7) / 8)
+	}
+	return blocksFor(uint64(n))
+}
+
+// newBitmap returns a bitmap of n free entries starting at block start, with
+// every block dirty, for formatting.
+func newBitmap(start, n uint32, packed bool) *bitmap {
+	b := &bitmap{
+		start:   start,
+		entries: NewBitmap(int(n)),
+		free:    int(n),
+		packed:  packed,
+		dirty:   make([]bool, bitmapBlocks(n, packed)),
+	}
+	for i := range b.dirty {
+		b.dirty[i] = true
+	}
+	return b
+}
+
+func (b *bitmap) len() int {
+	return b.entries.n
+}
+
+// test reports whether entry i is taken.
+func (b *bitmap) test(i int) bool {
+	return b.entries.Test(i)
+}
+
+// set marks entry i taken or free, marking its block dirty if that changes
+// it.
+func (b *bitmap) set(i int, taken bool) {
+	if b.entries.Test(i) == taken {
+		return
+	}
+	if taken {
+		b.entries.Set(i)
+		b.free--
+	} else {
+		b.entries.Clear(i)
+		b.free++
+	}
+	b.dirty[i/entriesPerBlock(b.packed)] = true
+}
+
+// clone returns a copy of the entries, for snapshots.
+func (b *bitmap) clone() *Bitmap {
+	return b.entries.Clone()
+}
+
+// replace replaces every entry with those of entries, marking the blocks
+// that change dirty. The bitmap keeps its own copy.
+func (b *bitmap) replace(entries *Bitmap) {
+	perBlock := entriesPerBlock(b.packed)
+	for i := 0; i < b.len(); i++ {
+		if taken := entries.Test(i); taken != b.entries.Test(i) {
+			b.dirty[i/perBlock] = true
+		}
+	}
+	copy(b.entries.bits, entries.bits)
+	b.free = b.entries.CountFree()
+}
+
+// encodeBlock returns block i of the bitmap as the device holds it.
+func (b *bitmap) encodeBlock(i int) []byte {
+	if b.packed {
+		start := i * BlockSize
+		end := start + BlockSize
+		if end > len(b.entries.bits) {
+			end = len(b.entries.bits)
+		}
+		return b.entries.bits[start:end]
+	}
+	start, end := i*BlockSize, (i+1)*BlockSize
+	if end > b.len() {
+		end = b.len()
+	}
+	buf := make([]byte, end-start)
+	for j := range buf {
+		if b.entries.Test(start + j) {
+			buf[j] = 1
+		}
+	}
+	return buf
+}
+
+// readBitmapEntries reads the n entries of the bitmap starting at block
+// start, a byte per entry as byte-per-entry filesystems store them, or
+// unpacked from a bit per entry if packed is set. Values other than 0 and 1
+// are kept, for validate and inspection.
+func (fs *FileSystem) readBitmapEntries(start, n uint32, packed bool) ([]byte, error) {
+	entries := make([]byte, n)
+	buf := make([]byte, BlockSize)
+	perBlock := entriesPerBlock(packed)
+	for i := 0; i < int(bitmapBlocks(n, packed)); i++ {
+		err := fs.readMetadata(uint64(start)+uint64(i), buf)
+		if err != nil {
+			return nil, err
+		}
+		if !packed {
+			copy(entries[i*perBlock:], buf)
+			continue
+		}
+		for j := i * perBlock; j < (i+1)*perBlock && j < int(n); j++ {
+			entries[j] = buf[j/8%BlockSize] >> (j % 8) & 1
+		}
+	}
+	return entries, nil
+}
+
+// readBitmap reads a bitmap of n entries starting at block start.
+func (fs *FileSystem) readBitmap(start, n uint32, packed bool) (*bitmap, error) {
+	entries, err := fs.readBitmapEntries(start, n, packed)
+	if err != nil {
+		return nil, err
+	}
+	b := &bitmap{
+		start:   start,
+		entries: NewBitmap(int(n)),
+		free:    int(n),
+		packed:  packed,
+		dirty:   make([]bool, bitmapBlocks(n, packed)),
+	}
+	for i, taken := range entries {
+		if taken == 0 {
+			continue
+		}
+		b.entries.Set(i)
+		b.free--
+		if taken > 1 && b.invalidValue == 0 {
+			b.invalid, b.invalidValue = i, taken
+		}
+	}
+	return b, nil
+}
+
+// flushBitmap writes the dirty blocks of a bitmap to the device. Blocks that
+// fail to be written stay dirty.
+func (fs *FileSystem) flushBitmap(b *bitmap) error {
+	for i, dirty := range b.dirty {
+		if !dirty {
+			continue
+		}
+		err := fs.writeMetadata(uint64(b.start)+uint64(i), b.encodeBlock(i))
+		if err != nil {
+			return err
+		}
+		b.dirty[i] = false
+	}
+	return nil
+}
+
+// resize grows or shrinks the bitmap to n entries. New entries are free;
+// the blocks from the one the old end is in on are marked dirty, so they are
+// written with the new entries.
+func (b *bitmap) resize(n int) {
+	old := b.len()
+	b.entries.resize(n)
+	b.free = b.entries.CountFree()
+	dirty := make([]bool, bitmapBlocks(uint32(n), b.packed))
+	copy(dirty, b.dirty)
+	for i := old / entriesPerBlock(b.packed); i < len(dirty); i++ {
+		dirty[i] = true
+	}
+	b.dirty = dirty
+}
@@ -0,0 +1,193 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bitmapOf returns a bitmap with the given entries, 1 for taken.
+func bitmapOf(entries ...byte) *Bitmap {
+	b := NewBitmap(len(entries))
+	for i, taken := range entries {
+		if taken != 0 {
+			b.Set(i)
+		}
+	}
+	return b
+}
+
+func TestBitmapMatchesDevice(t *testing.T) {
+	dev := &orderDevice{BlockDevice: newSparseDevice(t, 40000)}
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 40000})
+	require.NoError(t, err)
+	require.Greater(t, len(filesystem.dataBitmap.dirty), 1)
+
+	// only the block of the data bitmap that changed is written
+	dev.log = nil
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	start := filesystem.geometry.DataBitmapStart
+	require.Contains(t, dev.log, fmt.Sprintf("write %d", start))
+	require.NotContains(t, dev.log, fmt.Sprintf("write %d", start+1))
+	for _, dirty := range append(filesystem.inodeBitmap.dirty, filesystem.dataBitmap.dirty...) {
+		require.False(t, dirty)
+	}
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev.BlockDevice)
+	require.NoError(t, err)
+	require.Equal(t, filesystem.inodeBitmap.entries, reloaded.inodeBitmap.entries)
+	require.Equal(t, filesystem.dataBitmap.entries, reloaded.dataBitmap.entries)
+}
+
+func TestBitmapDataBlockZero(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	require.Equal(t, byte(1), disk[DataBitmapIndex*BlockSize])
+
+	// older filesystems left data block 0 free on the device; it is taken
+	// when mounted, and recorded with the next change
+	disk[DataBitmapIndex*BlockSize] = 0
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.True(t, reloaded.dataBitmap.test(0))
+	require.True(t, reloaded.dataBitmap.dirty[0])
+	_, err = reloaded.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.Equal(t, byte(1), disk[DataBitmapIndex*BlockSize]&1)
+}
+
+func TestBitmapReplace(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		perBlock := entriesPerBlock(packed)
+		b := newBitmap(DataBitmapIndex, uint32(3*perBlock), packed)
+		b.dirty = make([]bool, 3)
+		entries := NewBitmap(3 * perBlock)
+		entries.Set(perBlock + 7)
+		b.replace(entries)
+		require.Equal(t, []bool{false, true, false}, b.dirty)
+		require.Equal(t, entries, b.entries)
+
+		// setting an entry to what it holds leaves its block clean
+		b.set(0, false)
+		require.False(t, b.dirty[0])
+		b.set(2*perBlock, true)
+		require.Equal(t, []bool{false, true, true}, b.dirty)
+	}
+}
+
+func TestBitmapInvalidValue(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	// store the bitmaps a byte per entry, as older filesystems do
+	filesystem.geometry.PackedBitmaps = false
+	for _, b := range []*bitmap{filesystem.inodeBitmap, filesystem.dataBitmap} {
+		b.packed = false
+		b.dirty[0] = true
+	}
+	require.NoError(t, filesystem.PersistInodeBitmap())
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.writeState(StateClean))
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.False(t, reloaded.geometry.PackedBitmaps)
+
+	// a byte-per-entry bitmap holds values a packed one can't
+	disk[DataBitmapIndex*BlockSize+5] = 7
+	_, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.Contains(t, err.Error(), "data bitmap entry 5 has invalid value 7")
+}
+
+func TestBitmap(t *testing.T) {
+	b := NewBitmap(20)
+	require.Equal(t, 20, b.Len())
+	require.Equal(t, 20, b.CountFree())
+	b.Set(0)
+	b.Set(9)
+	b.Set(19)
+	require.True(t, b.Test(9))
+	require.False(t, b.Test(10))
+	require.Equal(t, 17, b.CountFree())
+	require.Equal(t, "10000000010000000001", b.String())
+	b.Clear(9)
+	require.False(t, b.Test(9))
+	require.Panics(t, func() { b.Set(20) })
+
+	clone := b.Clone()
+	require.True(t, clone.Equal(b))
+	clone.Set(1)
+	require.False(t, clone.Equal(b))
+	require.False(t, b.Test(1))
+
+	// the entries past the end are never free
+	b.resize(3)
+	require.Equal(t, "100", b.String())
+	b.resize(12)
+	require.Equal(t, "100000000000", b.String())
+	require.Equal(t, 11, b.CountFree())
+}
+
+func TestBitmapFindFirstClear(t *testing.T) {
+	b := NewBitmap(20)
+	for i := 0; i < 17; i++ {
+		b.Set(i)
+	}
+	i, ok := b.FindFirstClear(0)
+	require.True(t, ok)
+	require.Equal(t, 17, i)
+	b.Clear(3)
+	i, ok = b.FindFirstClear(0)
+	require.True(t, ok)
+	require.Equal(t, 3, i)
+	i, ok = b.FindFirstClear(4)
+	require.True(t, ok)
+	require.Equal(t, 17, i)
+	i, ok = b.FindFirstClear(19)
+	require.True(t, ok)
+	require.Equal(t, 19, i)
+
+	for i := 17; i < 20; i++ {
+		b.Set(i)
+	}
+	_, ok = b.FindFirstClear(4)
+	require.False(t, ok)
+	_, ok = NewBitmap(0).FindFirstClear(0)
+	require.False(t, ok)
+}
+
+func TestBitmapPacked(t *testing.T) {
+	disk := make([]byte, 10000*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 10000})
+	require.NoError(t, err)
+	g := filesystem.Geometry()
+	require.True(t, g.PackedBitmaps)
+	// a bit per entry: 2500 inodes and 10000 blocks take a block each
+	require.Equal(t, g.InodeBitmapStart+1, g.DataBitmapStart)
+	require.Equal(t, g.DataBitmapStart+1, g.InodeTableStart)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(patterned(3*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// inodes 0 and 1 are taken
+	require.Equal(t, byte(0b11), disk[int(g.InodeBitmapStart)*BlockSize])
+	blocks, err := filesystem.fileBlocks(inode)
+	require.NoError(t, err)
+	for _, blockIndex := range blocks {
+		i := int(blockIndex - g.DataStart)
+		require.NotZero(t, disk[int(g.DataBitmapStart)*BlockSize+i/8]&(1<<(i%8)))
+	}
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, filesystem.dataBitmap.entries, reloaded.dataBitmap.entries)
+	report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+}
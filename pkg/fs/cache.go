@@ -0,0 +1,180 @@
+package fs
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultBlockCacheSize is the number of blocks a CachedBlockDevice holds
+// unless told otherwise, 1 MiB worth.
+const DefaultBlockCacheSize = 256
+
+// CachedBlockDevice wraps a BlockDevice and keeps the most recently used
+// blocks in memory, so reading them again doesn't reach the wrapped device.
+// Writes are cached too, and only reach the wrapped device when Sync writes
+// back the dirty blocks, or when a dirty block is evicted to make room for
+// another; until then the wrapped device doesn't hold them. A FileSystem
+// syncs its device at the points where it needs its writes to be stable,
+// such as Close and journal commits, so it can be mounted on a cache like on
+// any other device.
+//
+// It is safe for concurrent use, but serves one operation at a time,
+// including the reads and writes of the wrapped device it makes.
+type CachedBlockDevice struct {
+	dev      BlockDevice
+	capacity int
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	// lru orders the cached blocks from most to least recently used
+	lru   *list.List
+	stats CacheStats
+}
+
+// CacheStats counts what a CachedBlockDevice did.
+type CacheStats struct {
+	// Hits and Misses count the reads found in the cache and those that
+	// went to the wrapped device.
+	Hits   uint64
+	Misses uint64
+	// WriteBacks counts the dirty blocks written to the wrapped device.
+	WriteBacks uint64
+}
+
+type cachedBlock struct {
+	blockNum uint64
+	data     []byte
+	// dirty is set on blocks written since they were last written back
+	dirty bool
+}
+
+// NewCachedBlockDevice wraps dev with a cache of the given number of blocks,
+// or DefaultBlockCacheSize if it is less than 1.
+func NewCachedBlockDevice(dev BlockDevice, blocks int) *CachedBlockDevice {
+	if blocks < 1 {
+		blocks = DefaultBlockCacheSize
+	}
+	return &CachedBlockDevice{
+		dev:      dev,
+		capacity: blocks,
+		entries:  map[uint64]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// ReadBlock reads a block from the cache, or from the wrapped device,
+// caching it.
+func (c *CachedBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[blockNum]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(elem)
+		copy(buf, elem.Value.(*cachedBlock).data)
+		return nil
+	}
+	c.stats.Misses++
+	err := c.dev.ReadBlock(blockNum, buf)
+	if err != nil {
+		return err
+	}
+	// not caching the block isn't an error for the read; the next write
+	// back reports the failure
+	if c.makeRoom() == nil {
+		c.insert(blockNum, buf, false)
+	}
+	return nil
+}
+
+// WriteBlock writes a block to the cache. It reaches the wrapped device on
+// Sync, or earlier if the block is evicted.
+func (c *CachedBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[blockNum]; ok {
+		block := elem.Value.(*cachedBlock)
+		copy(block.data, buf)
+		block.dirty = true
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	err := c.makeRoom()
+	if err != nil {
+		return err
+	}
+	c.insert(blockNum, buf, true)
+	return nil
+}
+
+// insert caches a copy of buf as the most recently used block.
+func (c *CachedBlockDevice) insert(blockNum uint64, buf []byte, dirty bool) {
+	data := make([]byte, BlockSize)
+	copy(data, buf)
+	c.entries[blockNum] = c.lru.PushFront(&cachedBlock{blockNum: blockNum, data: data, dirty: dirty})
+}
+
+// makeRoom evicts the least recently used block if the cache is full,
+// writing it back if it is dirty. If that fails, the block stays cached.
+func (c *CachedBlockDevice) makeRoom() error {
+	if c.lru.Len() < c.capacity {
+		return nil
+	}
+	elem := c.lru.Back()
+	block := elem.Value.(*cachedBlock)
+	if block.dirty {
+		err := c.writeBack(block)
+		if err != nil {
+			return err
+		}
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, block.blockNum)
+	return nil
+}
+
+func (c *CachedBlockDevice) writeBack(block *cachedBlock) error {
+	err := c.dev.WriteBlock(block.blockNum, block.data)
+	if err != nil {
+		return fmt.Errorf("error writing back block %d: %w", block.blockNum, err)
+	}
+	block.dirty = false
+	c.stats.WriteBacks++
+	return nil
+}
+
+// Sync writes the dirty blocks back to the wrapped device, in ascending
+// order, then syncs it if it supports syncing. Blocks that fail to be
+// written stay dirty.
+func (c *CachedBlockDevice) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirty := []*cachedBlock{}
+	for _, elem := range c.entries {
+		if block := elem.Value.(*cachedBlock); block.dirty {
+			dirty = append(dirty, block)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].blockNum < dirty[j].blockNum })
+	for _, block := range dirty {
+		err := c.writeBack(block)
+		if err != nil {
+			return err
+		}
+	}
+	return flushDevice(c.dev)
+}
+
+// Stats returns the counts of what the cache did so far.
+func (c *CachedBlockDevice) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// BlockCount returns the number of blocks of the wrapped device, or 0 if it
+// doesn't report its size.
+func (c *CachedBlockDevice) BlockCount() uint64 {
+	return deviceSize(c.dev)
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedBlockDevice(t *testing.T) {
+	disk := make([]byte, 8*BlockSize)
+	backing := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	cache := NewCachedBlockDevice(backing, 2)
+	block := func(b byte) []byte { return bytes.Repeat([]byte{b}, BlockSize) }
+	buf := make([]byte, BlockSize)
+
+	// reads of cached blocks don't reach the device
+	require.NoError(t, cache.ReadBlock(1, buf))
+	require.NoError(t, cache.ReadBlock(1, buf))
+	require.Equal(t, 1, backing.reads)
+
+	// writes stay in the cache until they are synced
+	require.NoError(t, cache.WriteBlock(2, block('a')))
+	require.Equal(t, 0, backing.writes)
+	require.NoError(t, cache.ReadBlock(2, buf))
+	require.Equal(t, block('a'), buf)
+	require.NoError(t, cache.Sync())
+	require.Equal(t, 1, backing.writes)
+	require.Equal(t, block('a'), disk[2*BlockSize:3*BlockSize])
+	require.NoError(t, cache.Sync())
+	require.Equal(t, 1, backing.writes)
+
+	// the least recently used block is evicted, and written back if dirty
+	require.NoError(t, cache.WriteBlock(2, block('b')))
+	require.NoError(t, cache.ReadBlock(1, buf))
+	require.NoError(t, cache.ReadBlock(3, buf))
+	require.Equal(t, block('b'), disk[2*BlockSize:3*BlockSize])
+	require.NoError(t, cache.ReadBlock(1, buf))
+	require.NoError(t, cache.ReadBlock(2, buf))
+	require.Equal(t, block('b'), buf)
+	require.Equal(t, CacheStats{Hits: 4, Misses: 3, WriteBacks: 2}, cache.Stats())
+
+	// a block that can't be written back stays dirty
+	require.NoError(t, cache.WriteBlock(4, block('c')))
+	require.NoError(t, cache.ReadBlock(2, buf))
+	backing.failWriteAt = backing.writes + 1
+	require.ErrorIs(t, cache.WriteBlock(5, block('d')), errInjected)
+	require.NoError(t, cache.Sync())
+	require.Equal(t, block('c'), disk[4*BlockSize:5*BlockSize])
+	require.Equal(t, uint64(8), NewCachedBlockDevice(NewArrayBlockDevice(disk), 0).BlockCount())
+}
+
+func TestFileSystemOnCache(t *testing.T) {
+	disk := make([]byte, 200*BlockSize)
+	cache := NewCachedBlockDevice(NewArrayBlockDevice(disk), 16)
+	filesystem, err := NewFileSystemWithOptions(cache, MkfsOptions{Blocks: 200, JournalBlocks: 32})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(bytes.Repeat([]byte{'f'}, 20*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.NoError(t, filesystem.Rename("/foo", "/dir/foo"))
+	require.NoError(t, filesystem.Close())
+	require.NotZero(t, cache.Stats().Hits)
+
+	// everything reached the disk
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/dir/foo")
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{'f'}, 20*BlockSize), contents.Bytes())
+	for _, f := range Diagnose(NewArrayBlockDevice(disk)) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
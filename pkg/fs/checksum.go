@@ -0,0 +1,282 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// Filesystems formatted with checksums, see MkfsOptions.Checksums, keep a
+// CRC-32C of each metadata block in the checksum table, which follows the
+// journal. The table holds a little endian uint32 per block of the
+// filesystem, in block order; only the entries of the metadata blocks mean
+// anything:
+//   - the dedup table and the inode and data bitmaps
+//   - the inode table
+//   - pointer blocks and the blocks of directories
+//
+// Metadata blocks are written through writeMetadata, which updates the
+// entry and writes the block of the table holding it, in the same
+// transaction if there is a journal. Reading a metadata block checks it
+// against its entry and fails with a ChecksumError on a mismatch, so damage
+// to the image is reported as such rather than as whatever misreading the
+// block leads to. The superblock carries its own checksum.
+//
+// Diagnose checks every metadata block instead, reporting mismatches as
+// findings, and Fsck recomputes the checksums after its repairs.
+
+// ErrChecksum is returned when a metadata block doesn't match its checksum.
+// Errors wrapping it wrap ErrCorrupt too.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ChecksumError describes a metadata block that doesn't match its checksum.
+type ChecksumError struct {
+	// Block is the device block, and What says what it holds.
+	Block uint64
+	What  string
+	// Recorded is the checksum in the checksum table, or in the superblock,
+	// and Computed that of the block as read.
+	Recorded uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("block %d (%s) doesn't match its checksum: recorded %08x, computed %08x", e.Block, e.What, e.Recorded, e.Computed)
+}
+
+// Is makes ChecksumErrors match ErrChecksum and ErrCorrupt.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum || target == ErrCorrupt
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C of buf.
+func checksum(buf []byte) uint32 {
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// checksumsPerBlock is the number of entries in a block of the checksum
+// table.
+const checksumsPerBlock = BlockSize / 4
+
+// checksumBlocksFor returns the size of the checksum table of a filesystem
+// of blockCount blocks.
+func checksumBlocksFor(blockCount uint32) uint32 {
+	return blocksFor(uint64(blockCount) * 4)
+}
+
+// checksumTable is the checksum table, loaded in memory.
+type checksumTable struct {
+	sums []uint32
+	// verify is set when reads check metadata blocks against their
+	// checksums; Diagnose and Fsck read without checking
+	verify bool
+}
+
+// readChecksums loads the checksum table, if the filesystem has one. Reads
+// check the checksums if verify is set.
+func (fs *FileSystem) readChecksums(verify bool) error {
+	g := fs.geometry
+	if g.ChecksumBlocks == 0 {
+		return nil
+	}
+	sums := make([]uint32, g.BlockCount)
+	buf := make([]byte, BlockSize)
+	for i := uint32(0); i < checksumBlocksFor(g.BlockCount); i++ {
+		err := fs.readBlock(uint64(g.ChecksumStart+i), buf)
+		if err != nil {
+			return fmt.Errorf("error reading block %d of the checksum table: %w", i, err)
+		}
+		for j := 0; j < checksumsPerBlock && int(i)*checksumsPerBlock+j < len(sums); j++ {
+			sums[int(i)*checksumsPerBlock+j] = binary.LittleEndian.Uint32(buf[j*4:])
+		}
+	}
+	fs.checksums = &checksumTable{sums: sums, verify: verify}
+	return nil
+}
+
+// writeChecksumBlock writes block i of the checksum table, in the
+// transaction if there is a journal.
+func (fs *FileSystem) writeChecksumBlock(i int) error {
+	buf := make([]byte, BlockSize)
+	sums := fs.checksums.sums[i*checksumsPerBlock:]
+	for j := 0; j < checksumsPerBlock && j < len(sums); j++ {
+		binary.LittleEndian.PutUint32(buf[j*4:], sums[j])
+	}
+	err := fs.logBlock(uint64(fs.geometry.ChecksumStart)+uint64(i), buf)
+	if err != nil {
+		return fmt.Errorf("error writing block %d of the checksum table: %w", i, err)
+	}
+	return nil
+}
+
+// writeChecksummed is writeMetadata for filesystems with checksums. The
+// block is written whole, zero-padded past a short buf, so its checksum
+// covers what the device holds.
+func (fs *FileSystem) writeChecksummed(blockNum uint64, buf []byte) error {
+	block := make([]byte, BlockSize)
+	copy(block, buf)
+	err := fs.logBlock(blockNum, block)
+	if err != nil {
+		return err
+	}
+	sums := fs.checksums.sums
+	old, sum := sums[blockNum], checksum(block)
+	if old == sum {
+		return nil
+	}
+	fs.explainf("checksum of block %d: %08x -> %08x", blockNum, old, sum)
+	sums[blockNum] = sum
+	err = fs.writeChecksumBlock(int(blockNum / checksumsPerBlock))
+	if err != nil {
+		// keep the table in memory as it is on the device
+		sums[blockNum] = old
+		return err
+	}
+	return nil
+}
+
+// formatChecksums finishes formatting a filesystem with checksums: the
+// blocks of the inode table after the first are zeroed, as the checksums
+// cover them whole, and the checksum table is written out.
+func (fs *FileSystem) formatChecksums() error {
+	g := fs.geometry
+	zero := make([]byte, BlockSize)
+	for i := uint32(1); i < g.inodeTableBlocks(); i++ {
+		err := fs.dev.WriteBlock(uint64(g.InodeTableStart+i), zero)
+		if err != nil {
+			return fmt.Errorf("error clearing the inode table: %w", err)
+		}
+		fs.checksums.sums[g.InodeTableStart+i] = checksum(zero)
+	}
+	for i := 0; i < int(checksumBlocksFor(g.BlockCount)); i++ {
+		err := fs.writeChecksumBlock(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBlock checks a metadata block read from the device against its
+// checksum, if the filesystem has checksums and reads check them.
+func (fs *FileSystem) verifyBlock(blockNum uint64, buf []byte) error {
+	c := fs.checksums
+	// blocks outside the filesystem are left for validate to report
+	if c == nil || !c.verify || blockNum >= uint64(len(c.sums)) {
+		return nil
+	}
+	if recorded, computed := c.sums[blockNum], checksum(buf); recorded != computed {
+		return &ChecksumError{Block: blockNum, What: fs.describeBlock(blockNum), Recorded: recorded, Computed: computed}
+	}
+	return nil
+}
+
+// readMetadata reads a metadata block and checks it against its checksum.
+func (fs *FileSystem) readMetadata(blockNum uint64, buf []byte) error {
+	err := fs.readBlock(blockNum, buf)
+	if err != nil {
+		return err
+	}
+	return fs.verifyBlock(blockNum, buf)
+}
+
+// metadataBlocks lists the checksummed blocks, in ascending order: the dedup
+// table, the bitmaps, the inode table, and the pointer blocks, xattr blocks
+// and directory blocks of the inodes of scan, if it isn't nil.
+func (fs *FileSystem) metadataBlocks(scan *inodeScan) []uint64 {
+	g := fs.geometry
+	blocks := []uint64{}
+	region := func(start, n uint32) {
+		for i := uint32(0); i < n; i++ {
+			blocks = append(blocks, uint64(start+i))
+		}
+	}
+	region(g.DedupStart, g.DedupBlocks)
+	region(g.InodeBitmapStart, blocksFor(uint64(g.InodeCount)))
+	region(g.DataBitmapStart, blocksFor(uint64(g.DataBlocks())))
+	region(g.InodeTableStart, g.inodeTableBlocks())
+	if scan != nil {
+		for i, inode := range scan.inodes {
+			m := scan.blockMaps[i]
+			if inode == nil || m == nil {
+				continue
+			}
+			for _, blockIndex := range m.pointers() {
+				blocks = append(blocks, uint64(blockIndex))
+			}
+			if m.xattrs != 0 {
+				blocks = append(blocks, uint64(m.xattrs))
+			}
+			if inode.Type == InodeTypeDirectory {
+				for _, blockIndex := range m.data {
+					blocks = append(blocks, uint64(blockIndex))
+				}
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// checksumMismatches checks the blocks listed by metadataBlocks against
+// their checksums. Blocks that can't be read, or are outside the
+// filesystem, are left for the other checks.
+func (fs *FileSystem) checksumMismatches(scan *inodeScan) []*ChecksumError {
+	c := fs.checksums
+	if c == nil {
+		return nil
+	}
+	mismatches := []*ChecksumError{}
+	buf := make([]byte, BlockSize)
+	for _, blockNum := range fs.metadataBlocks(scan) {
+		if blockNum >= uint64(len(c.sums)) || fs.readBlock(blockNum, buf) != nil {
+			continue
+		}
+		if recorded, computed := c.sums[blockNum], checksum(buf); recorded != computed {
+			mismatches = append(mismatches, &ChecksumError{Block: blockNum, What: fs.describeBlock(blockNum), Recorded: recorded, Computed: computed})
+		}
+	}
+	return mismatches
+}
+
+// checkChecksums reports the metadata blocks that don't match their
+// checksums.
+func (fs *FileSystem) checkChecksums(scan *inodeScan) []Finding {
+	findings := []Finding{}
+	for _, e := range fs.checksumMismatches(scan) {
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Check:    "checksums",
+			Message:  e.Error(),
+			Remedy:   "the block was changed outside the filesystem; run fsck with repair to fix what it can and recompute the checksums, or restore the image from a backup",
+		})
+	}
+	return findings
+}
+
+// recomputeChecksums makes the checksums of the metadata blocks match what
+// they hold, and returns the blocks whose checksum changed.
+func (fs *FileSystem) recomputeChecksums(scan *inodeScan) ([]uint64, error) {
+	mismatches := fs.checksumMismatches(scan)
+	fixed := []uint64{}
+	for _, e := range mismatches {
+		fs.checksums.sums[e.Block] = e.Computed
+		fixed = append(fixed, e.Block)
+	}
+	// the mismatches are in ascending order, and so are their table blocks
+	last := -1
+	for _, blockNum := range fixed {
+		if i := int(blockNum / checksumsPerBlock); i != last {
+			err := fs.writeChecksumBlock(i)
+			if err != nil {
+				return nil, err
+			}
+			last = i
+		}
+	}
+	return fixed, nil
+}
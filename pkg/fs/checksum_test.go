@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newChecksummedFileSystem creates a filesystem of 200 blocks with
+// checksums on dev, holding /dir/foo, which has an indirect block.
+func newChecksummedFileSystem(t *testing.T, dev BlockDevice, opts MkfsOptions) *FileSystem {
+	opts.Blocks, opts.Checksums = 200, true
+	filesystem, err := NewFileSystemWithOptions(dev, opts)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	_, err = filesystem.CreateFile("/dir/foo", bytes.NewBuffer(patterned((directBlocks+2)*BlockSize)))
+	require.NoError(t, err)
+	return filesystem
+}
+
+func TestChecksumGeometry(t *testing.T) {
+	g, err := MkfsOptions{Blocks: 200, JournalBlocks: 32, Checksums: true}.geometry()
+	require.NoError(t, err)
+	require.Equal(t, Geometry{
+		BlockSize: 4096, BlockCount: 200, InodeCount: 56,
+		InodeBitmapStart: 34, DataBitmapStart: 35, InodeTableStart: 36, DataStart: 43,
+		JournalStart: 1, JournalBlocks: 32,
+		ChecksumStart: 33, ChecksumBlocks: 1,
+		PackedBitmaps: true,
+	}, g)
+
+	g.ChecksumStart = 32
+	require.ErrorContains(t, g.check(), "the journal doesn't fit before the checksum table")
+	g.ChecksumStart, g.ChecksumBlocks = 33, 2
+	require.ErrorContains(t, g.check(), "the checksum table doesn't fit before the inode bitmap")
+	g, err = MkfsOptions{Blocks: 5000, Checksums: true}.geometry()
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), g.ChecksumBlocks)
+	g.ChecksumBlocks = 4
+	require.ErrorContains(t, g.check(), "the checksum table has 4 blocks, too few for 5000 blocks")
+
+	disk := make([]byte, 200*BlockSize)
+	filesystem := newChecksummedFileSystem(t, NewArrayBlockDevice(disk), MkfsOptions{})
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Equal(t, BlockKindChecksums, layout[1].Kind)
+	require.Equal(t, BlockKindInodeBitmap, layout[2].Kind)
+}
+
+func TestChecksums(t *testing.T) {
+	for name, opts := range map[string]MkfsOptions{
+		"plain":   {},
+		"journal": {JournalBlocks: 32},
+	} {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, 200*BlockSize)
+			filesystem := newChecksummedFileSystem(t, NewArrayBlockDevice(disk), opts)
+			require.NoError(t, filesystem.Truncate("/dir/foo", 10))
+			require.NoError(t, filesystem.Rename("/dir/foo", "/foo"))
+			want := dumpTree(t, filesystem)
+			require.NoError(t, filesystem.Close())
+
+			for _, f := range Diagnose(NewArrayBlockDevice(disk)) {
+				require.Equal(t, SeverityInfo, f.Severity, f.Message)
+			}
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.Equal(t, want, dumpTree(t, reloaded))
+		})
+	}
+}
+
+func TestChecksumsDetectDamage(t *testing.T) {
+	// blocks to damage, by what they hold
+	blocks := map[string]func(*FileSystem) uint64{
+		"superblock":   func(*FileSystem) uint64 { return SuperblockIndex },
+		"inode bitmap": func(fs *FileSystem) uint64 { return uint64(fs.geometry.InodeBitmapStart) },
+		"data bitmap":  func(fs *FileSystem) uint64 { return uint64(fs.geometry.DataBitmapStart) },
+		"inode table":  func(fs *FileSystem) uint64 { return uint64(fs.geometry.InodeTableStart) },
+		"directory": func(fs *FileSystem) uint64 {
+			inode, err := fs.FindInodeByName("/dir")
+			require.NoError(t, err)
+			return uint64(inode.Blocks[0])
+		},
+		"indirect block": func(fs *FileSystem) uint64 {
+			inode, err := fs.FindInodeByName("/dir/foo")
+			require.NoError(t, err)
+			return uint64(inode.Indirect)
+		},
+	}
+	for name, block := range blocks {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, 200*BlockSize)
+			filesystem := newChecksummedFileSystem(t, NewArrayBlockDevice(disk), MkfsOptions{})
+			want := dumpTree(t, filesystem)
+			blockNum := block(filesystem)
+			require.NoError(t, filesystem.Close())
+
+			// the last byte of each of these blocks is unused
+			disk[(blockNum+1)*BlockSize-1] ^= 0xff
+			err := func() error {
+				filesystem, err := LoadFilesystem(NewArrayBlockDevice(disk))
+				if err != nil {
+					return err
+				}
+				inode, err := filesystem.FindInodeByName("/dir/foo")
+				if err != nil {
+					return err
+				}
+				_, err = filesystem.ReadFileContents(int(inode.Index))
+				return err
+			}()
+			require.ErrorIs(t, err, ErrChecksum)
+			require.ErrorIs(t, err, ErrCorrupt)
+			var checksumErr *ChecksumError
+			require.ErrorAs(t, err, &checksumErr)
+			require.Equal(t, blockNum, checksumErr.Block)
+			require.NotEqual(t, checksumErr.Recorded, checksumErr.Computed)
+
+			findings := Diagnose(NewArrayBlockDevice(disk))
+			require.NotEmpty(t, findings)
+			require.Equal(t, SeverityError, findings[0].Severity)
+			if blockNum == SuperblockIndex {
+				// there is nothing to go by to repair the superblock
+				require.Equal(t, "superblock", findings[0].Check)
+				return
+			}
+			require.Equal(t, "checksums", findings[0].Check, findings[0].Message)
+			require.Contains(t, findings[0].Message, checksumErr.Error())
+
+			report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{Repair: true})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+			require.Contains(t, strings.Join(report.Repairs, "\n"), fmt.Sprintf("block %d (%s)", blockNum, checksumErr.What))
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.Equal(t, want, dumpTree(t, reloaded))
+		})
+	}
+}
+
+func TestChecksumsCrash(t *testing.T) {
+	states := func() []string {
+		disk := make([]byte, 200*BlockSize)
+		filesystem := newChecksummedFileSystem(t, NewArrayBlockDevice(disk), MkfsOptions{JournalBlocks: 32})
+		before := dumpTree(t, filesystem)
+		require.NoError(t, filesystem.DeleteFile("/dir/foo"))
+		return []string{before, dumpTree(t, filesystem)}
+	}()
+
+	for failAt := 1; ; failAt++ {
+		disk := make([]byte, 200*BlockSize)
+		dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+		filesystem := newChecksummedFileSystem(t, dev, MkfsOptions{JournalBlocks: 32})
+
+		// the table is logged along with the blocks it covers, so a crash
+		// never leaves them disagreeing
+		dev.writes = 0
+		dev.failWriteAt = failAt
+		dev.sticky = true
+		err := filesystem.DeleteFile("/dir/foo")
+		if err == nil {
+			break
+		}
+		for _, f := range Diagnose(NewArrayBlockDevice(bytes.Clone(disk))) {
+			require.Equal(t, SeverityInfo, f.Severity, "crash at write %d: %s", failAt, f.Message)
+		}
+		reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+		require.NoError(t, err, "crash at write %d", failAt)
+		require.Contains(t, states, dumpTree(t, reloaded), "crash at write %d", failAt)
+	}
+}
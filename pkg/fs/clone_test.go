@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCountingDevice counts the blocks written to it.
+type writeCountingDevice struct {
+	*ArrayBlockDevice
+	written map[uint64]bool
+}
+
+func (dev *writeCountingDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev.written[blockNum] = true
+	return dev.ArrayBlockDevice.WriteBlock(blockNum, buf)
+}
+
+func (dev *writeCountingDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	for i := range bufs {
+		dev.written[start+uint64(i)] = true
+	}
+	return dev.ArrayBlockDevice.WriteBlocks(start, bufs)
+}
+
+func TestCloneTo(t *testing.T) {
+	disk := make([]byte, 600*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 600, JournalBlocks: 16})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	contents := patterned((directBlocks + 5) * BlockSize)
+	_, err = filesystem.CreateFile("/dir/big", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/small", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.DeleteFile("/small"))
+
+	dst := &writeCountingDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, 600*BlockSize)), written: map[uint64]bool{}}
+	require.NoError(t, filesystem.CloneTo(dst))
+	g := filesystem.Geometry()
+	used := g.DataBlocks() - uint32(filesystem.dataBitmap.free)
+	// the metadata and the used data blocks, but data block 0 is the last
+	// block of the inode table
+	require.Len(t, dst.written, int(g.DataStart)+int(used))
+
+	// the clone mounts clean, with the same contents, while the filesystem
+	// stays mounted
+	clone, err := LoadFilesystem(dst)
+	require.NoError(t, err)
+	data, err := clone.ReadFile("/dir/big")
+	require.NoError(t, err)
+	require.Equal(t, contents, data)
+	_, err = clone.Stat("/small")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.NoError(t, clone.CheckInvariants())
+	require.NoError(t, clone.Close())
+	require.Empty(t, findingsBySeverity(Diagnose(dst), SeverityWarning))
+	_, err = filesystem.CreateFile("/later", &bytes.Buffer{})
+	require.NoError(t, err)
+
+	// on zeroed devices, blocks of zeroes are skipped
+	zeroed := &writeCountingDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, 600*BlockSize)), written: map[uint64]bool{}}
+	require.NoError(t, filesystem.CloneToWithOptions(zeroed, CloneOptions{Zeroed: true}))
+	require.Less(t, len(zeroed.written), int(g.DataStart))
+	clone, err = LoadFilesystem(zeroed)
+	require.NoError(t, err)
+	_, err = clone.Stat("/later")
+	require.NoError(t, err)
+	data, err = clone.ReadFile("/dir/big")
+	require.NoError(t, err)
+	require.Equal(t, contents, data)
+	require.NoError(t, clone.CheckInvariants())
+
+	// devices too small for it are refused
+	err = filesystem.CloneTo(NewArrayBlockDevice(make([]byte, 100*BlockSize)))
+	require.ErrorIs(t, err, ErrGeometry)
+}
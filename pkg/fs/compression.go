@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Files can be compressed, see CreateOptions and SetCompression. The whole
+// contents of a compressed file are compressed together and stored in its
+// blocks like the contents of any other file; Size stays the size of the
+// uncompressed contents, which reads return, and the inode records the
+// algorithm and the size of the compressed contents, which sets the number
+// of blocks it maps. Both are kept after the gob encoding like contentSum,
+// and only filesystems of compressionVersion or later have them.
+//
+// Reads decompress the whole file, and writes, truncations included,
+// decompress it, change it and compress it again, so compression suits
+// files written once and read in large chunks. Content checksums and quotas
+// are over the uncompressed contents.
+
+// compressionVersion is the first format version with compressed files.
+const compressionVersion = 9
+
+// Compression selects how file contents are compressed.
+type Compression uint8
+
+const (
+	// CompressionDefault, in CreateOptions, uses the compression set with
+	// SetCompression. As the filesystem-wide default, it means
+	// CompressionNone.
+	CompressionDefault Compression = iota
+	// CompressionNone stores the contents as they are.
+	CompressionNone
+	// CompressionGzip compresses them with gzip.
+	CompressionGzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionDefault:
+		return "default"
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return "unknown"
+	}
+}
+
+// CreateOptions controls how CreateFileWithOptions creates a file. The zero
+// value creates it like CreateFileFromReader.
+type CreateOptions struct {
+	// Compression compresses the contents of the file.
+	Compression Compression
+	// SizeHint, if positive, is the number of bytes the reader is expected
+	// to hold, so the blocks for them are allocated at once. Readers that
+	// know their length, such as bytes.Reader, need none. The file gets
+	// what the reader holds either way.
+	SizeHint int64
+}
+
+// SetCompression sets how the contents of files created from now on are
+// compressed, unless CreateOptions say otherwise. The default is
+// CompressionNone. Filesystems older than format version 9 ignore it.
+func (fs *FileSystem) SetCompression(c Compression) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.compression = c
+}
+
+// CreateFileWithOptions is CreateFileFromReader with options. Filesystems
+// older than format version 9 can't compress files.
+func (fs *FileSystem) CreateFileWithOptions(filename string, r io.Reader, opts CreateOptions) (inode *Inode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("CreateFileWithOptions %s (compression %v)", filename, opts.Compression)
+	defer fs.checkInvariantsAfter("CreateFileWithOptions")()
+
+	compression := opts.Compression
+	switch compression {
+	case CompressionDefault:
+		compression = fs.compression
+	case CompressionNone:
+	case CompressionGzip:
+		if fs.version < compressionVersion {
+			return nil, fmt.Errorf("error creating %s: format version %d has no compression, it needs version %d", filename, fs.version, compressionVersion)
+		}
+	default:
+		return nil, fmt.Errorf("error creating %s: unknown compression %d", filename, compression)
+	}
+	if opts.SizeHint > 0 && opts.SizeHint <= MaxFileSize {
+		r = sizeHinted{Reader: r, n: int(opts.SizeHint)}
+	}
+	return fs.createInode(filename, InodeTypeFile, r, DefaultFileMode, compression)
+}
+
+// compressed reports whether the contents of inode are compressed.
+func (inode *Inode) compressed() bool {
+	return inode.compression == CompressionGzip
+}
+
+// Compression returns how the contents of the inode are compressed.
+func (inode *Inode) Compression() Compression {
+	if inode.compressed() {
+		return inode.compression
+	}
+	return CompressionNone
+}
+
+// storedSize returns the number of bytes the contents of inode take in its
+// blocks.
+func (inode *Inode) storedSize() int {
+	if inode.compressed() {
+		return int(inode.compressedSize)
+	}
+	return int(inode.Size)
+}
+
+// StoredBlocks returns the number of data blocks holding the contents of
+// the inode, which for compressed files is set by the compressed size.
+func (inode *Inode) StoredBlocks() int {
+	return GetSizeInBlocks(inode.storedSize())
+}
+
+// compress compresses data with the algorithm of inode.
+func (inode *Inode) compress(data []byte) ([]byte, error) {
+	bb := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(bb, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error compressing inode %d: %w", inode.Index, err)
+	}
+	return bb.Bytes(), nil
+}
+
+// decompress decompresses the stored contents of inode, which must
+// decompress to its size.
+func (inode *Inode) decompress(stored []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, corruptf("inode %d: compressed contents can't be read: %v", inode.Index, err)
+	}
+	data := make([]byte, inode.Size)
+	_, err = io.ReadFull(r, data)
+	if err == nil {
+		// the contents must end where the size does
+		var n int
+		n, err = r.Read(make([]byte, 1))
+		if n > 0 {
+			err = fmt.Errorf("more than %d bytes", inode.Size)
+		} else if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, corruptf("inode %d: compressed contents can't be read: %v", inode.Index, err)
+	}
+	return data, nil
+}
+
+// readAllFrom reads r until io.EOF, failing with ErrTooLarge past
+// MaxFileSize.
+func readAllFrom(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFileSize {
+		return nil, fmt.Errorf("more than %d bytes: %w", int64(MaxFileSize), ErrTooLarge)
+	}
+	return data, nil
+}
+
+// storeCompressed replaces the contents of the compressed inode with data,
+// compressing it into as many blocks as it needs, allocating or freeing
+// blocks in the in-memory data bitmap. The caller persists the inode and
+// the bitmap, or rolls them back on failure.
+func (fs *FileSystem) storeCompressed(inode *Inode, data []byte) error {
+	stored, err := inode.compress(data)
+	if err != nil {
+		return err
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	nCurrentBlocks := len(old.data)
+	nTotalBlocks := GetSizeInBlocks(len(stored))
+	blocks := append([]uint32{}, old.data...)
+	if nTotalBlocks > nCurrentBlocks {
+		newBlocks, err := fs.findContiguousBlocks(nTotalBlocks-nCurrentBlocks, blocks)
+		if err != nil {
+			return fmt.Errorf("not enough free blocks to fit %d compressed bytes: %w", len(stored), err)
+		}
+		for _, blockIndex := range newBlocks {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		blocks = append(blocks, newBlocks...)
+	} else {
+		for _, blockIndex := range blocks[nTotalBlocks:] {
+			fs.setBlockAllocated(blockIndex, false)
+		}
+		blocks = blocks[:nTotalBlocks]
+	}
+	inode.Size = uint32(len(data))
+	inode.compressedSize = uint32(len(stored))
+	err = fs.mapBlocks(inode, old, blocks)
+	if err != nil {
+		return err
+	}
+	err = fs.writeContents(inode, blocks, bytes.NewBuffer(stored))
+	if err != nil {
+		return err
+	}
+	inode.contentSum, inode.contentSummed = checksum(data), true
+	return nil
+}
+
+// rewriteCompressed replaces the contents of the compressed file inode with
+// data, and persists the inode table and the data bitmap. If it fails, the
+// inode and the data bitmap are left as they were.
+func (fs *FileSystem) rewriteCompressed(inode *Inode, data []byte) (err error) {
+	snapshot := fs.snapshot(int(inode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	err = fs.chargeQuota(snapshot, inode, int64(len(data))-int64(inode.Size), 0)
+	if err != nil {
+		return err
+	}
+	err = fs.storeCompressed(inode, data)
+	if err != nil {
+		return err
+	}
+	fs.touch(inode)
+	err = fs.writeInodeTable()
+	if err != nil {
+		return err
+	}
+	return fs.persistDataBitmap()
+}
+
+// writeCompressedAt is writeAt for compressed files.
+func (fs *FileSystem) writeCompressedAt(inode *Inode, p []byte, offset int64) error {
+	contents, err := fs.readContents(inode)
+	if err != nil {
+		return err
+	}
+	data := contents.Bytes()
+	if end := offset + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[offset:], p)
+	return fs.rewriteCompressed(inode, data)
+}
+
+// readCompressedAt is File.Read for compressed files: it reads the file at
+// offset into p, decompressing all of it.
+func (fs *FileSystem) readCompressedAt(inode *Inode, p []byte, offset int64) (int, error) {
+	contents, err := fs.readContents(inode)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, contents.Bytes()[offset:]), nil
+}
@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	// so the root directory has its block already
+	_, err = filesystem.CreateFile("/first", &bytes.Buffer{})
+	require.NoError(t, err)
+	before, err := filesystem.Statfs()
+	require.NoError(t, err)
+
+	contents := bytes.Repeat([]byte("compressible "), 4*BlockSize)
+	inode, err := filesystem.CreateFileWithOptions("/file", bytes.NewReader(contents), CreateOptions{Compression: CompressionGzip})
+	require.NoError(t, err)
+	require.Equal(t, CompressionGzip, inode.Compression())
+	require.Equal(t, uint32(len(contents)), inode.Size)
+	require.Equal(t, 1, inode.StoredBlocks())
+	after, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before.FreeBlocks-1, after.FreeBlocks)
+
+	// reads see the uncompressed contents, however they are made
+	read, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+	f, err := filesystem.Open("/file", O_RDONLY)
+	require.NoError(t, err)
+	_, err = f.Seek(BlockSize-3, io.SeekStart)
+	require.NoError(t, err)
+	p := make([]byte, 10)
+	_, err = io.ReadFull(f, p)
+	require.NoError(t, err)
+	require.Equal(t, contents[BlockSize-3:BlockSize+7], p)
+	require.NoError(t, f.Close())
+
+	// writes and truncations recompress the file
+	require.NoError(t, filesystem.WriteAt("/file", []byte("changed"), 100))
+	copy(contents[100:], "changed")
+	require.NoError(t, filesystem.Append("/file", []byte("appended")))
+	contents = append(contents, "appended"...)
+	f, err = filesystem.Open("/file", O_RDWR)
+	require.NoError(t, err)
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("in place"))
+	require.NoError(t, err)
+	copy(contents[5:], "in place")
+	require.NoError(t, f.Close())
+	require.NoError(t, filesystem.Truncate("/file", 3*BlockSize))
+	contents = contents[:3*BlockSize]
+	require.NoError(t, filesystem.Truncate("/file", 3*BlockSize+10))
+	contents = append(contents, make([]byte, 10)...)
+	require.NoError(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	data, err := FS{reloaded}.ReadFile("file")
+	require.NoError(t, err)
+	require.Equal(t, contents, data)
+	scrub, err := reloaded.Scrub()
+	require.NoError(t, err)
+	require.Empty(t, scrub.Mismatches)
+	require.Zero(t, scrub.Unchecked)
+	report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Remaining)
+}
+
+func TestCompressionDefault(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	filesystem.SetCompression(CompressionGzip)
+
+	compressed, err := filesystem.CreateFile("/compressed", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.Equal(t, CompressionGzip, compressed.Compression())
+	plain, err := filesystem.CreateFileWithOptions("/plain", strings.NewReader("hello"), CreateOptions{Compression: CompressionNone})
+	require.NoError(t, err)
+	require.Equal(t, CompressionNone, plain.Compression())
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	dir, err := filesystem.FindInodeByName("/dir")
+	require.NoError(t, err)
+	require.Equal(t, CompressionNone, dir.Compression())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystemWithOptions(NewArrayBlockDevice(disk), MountOptions{Compression: CompressionGzip})
+	require.NoError(t, err)
+	inode, err := reloaded.CreateFileFromReader("/another", strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.Equal(t, CompressionGzip, inode.Compression())
+	inode, err = reloaded.FindInodeByName("/plain")
+	require.NoError(t, err)
+	require.Equal(t, CompressionNone, inode.Compression())
+}
+
+func TestCompressionOlderVersions(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	filesystem.version = compressionVersion - 1
+	_, err = filesystem.CreateFileWithOptions("/file", strings.NewReader("hello"), CreateOptions{Compression: CompressionGzip})
+	require.ErrorContains(t, err, "no compression")
+
+	// the default is ignored
+	filesystem.SetCompression(CompressionGzip)
+	inode, err := filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.Equal(t, CompressionNone, inode.Compression())
+}
+
+func TestCompressionCorrupt(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := filesystem.CreateFileWithOptions("/file", strings.NewReader("hello, hello, hello"), CreateOptions{Compression: CompressionGzip})
+	require.NoError(t, err)
+
+	block := inode.Blocks[0]
+	copy(disk[int(block)*BlockSize:], "garbage")
+	_, err = filesystem.ReadFileContents(int(inode.Index))
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestCompressionQuota(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/q"))
+	require.NoError(t, filesystem.SetQuota("/q", Quota{MaxBytes: 2 * BlockSize}))
+
+	// quotas count the uncompressed size
+	_, err = filesystem.CreateFileWithOptions("/q/big", bytes.NewReader(make([]byte, 3*BlockSize)), CreateOptions{Compression: CompressionGzip})
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = filesystem.CreateFileWithOptions("/q/small", bytes.NewReader(make([]byte, BlockSize)), CreateOptions{Compression: CompressionGzip})
+	require.NoError(t, err)
+	require.ErrorIs(t, filesystem.Truncate("/q/small", 3*BlockSize), ErrQuotaExceeded)
+	usage, err := filesystem.GetQuotaUsage("/q")
+	require.NoError(t, err)
+	require.Equal(t, uint64(BlockSize), usage.Bytes)
+	require.NoError(t, filesystem.CheckInvariants())
+}
@@ -0,0 +1,203 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Files carry a CRC-32C of their contents in their inode, so that data
+// damaged on the device is reported by ReadFileContents, and found by Scrub,
+// rather than returned. Operations holding fs.mu for writing keep the
+// checksum up to date as they change the contents: appends extend it, and
+// other changes recompute it from the device.
+//
+// Writes overwriting a file in place hold fs.mu only for reading, so they
+// can't change the inode. They record the modification time, see times.go,
+// which marks the checksum as stale until Sync or Close recompute it; until
+// then the file isn't verified.
+
+// ErrChecksumMismatch is returned when the contents of a file don't match
+// their checksum. Errors wrapping it wrap ErrCorrupt too.
+var ErrChecksumMismatch = errors.New("file contents don't match their checksum")
+
+// ContentChecksumError describes a file whose contents don't match their
+// checksum.
+type ContentChecksumError struct {
+	Inode uint32
+	// Expected is the checksum recorded in the inode, and Actual that of
+	// the contents as read.
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ContentChecksumError) Error() string {
+	return fmt.Sprintf("the contents of inode %d don't match their checksum: expected %08x, actual %08x", e.Inode, e.Expected, e.Actual)
+}
+
+// Is makes ContentChecksumErrors match ErrChecksumMismatch and ErrCorrupt.
+func (e *ContentChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch || target == ErrCorrupt
+}
+
+// contentSumStale reports whether inode was overwritten in place since it
+// was last written, so its checksum is out of date.
+func (fs *FileSystem) contentSumStale(inode *Inode) bool {
+	return fs.pending(int(inode.Index)).modified != 0
+}
+
+// verifyContents checks contents, read from inode, against its checksum, if
+// it has an up to date one.
+func (fs *FileSystem) verifyContents(inode *Inode, contents []byte) error {
+	if !inode.contentSummed || fs.contentSumStale(inode) {
+		return nil
+	}
+	if sum := checksum(contents); sum != inode.contentSum {
+		return &ContentChecksumError{Inode: inode.Index, Expected: inode.contentSum, Actual: sum}
+	}
+	return nil
+}
+
+// extendContentSum updates the checksum of inode for data appended to its
+// contents. The gap written between the end of the file and the data, if
+// any, holds zeros.
+func (fs *FileSystem) extendContentSum(inode *Inode, gap int64, data []byte) {
+	if !inode.contentSummed || fs.contentSumStale(inode) {
+		return
+	}
+	sum := inode.contentSum
+	zeros := make([]byte, BlockSize)
+	for gap > 0 {
+		n := int64(len(zeros))
+		if gap < n {
+			n = gap
+		}
+		sum = crc32.Update(sum, castagnoli, zeros[:n])
+		gap -= n
+	}
+	inode.contentSum = crc32.Update(sum, castagnoli, data)
+}
+
+// recomputeContentSum computes the checksum of inode from its contents on
+// the device, for files whose contents changed other than by appending.
+// Files overwritten in place are left to flushTimes.
+func (fs *FileSystem) recomputeContentSum(inode *Inode) error {
+	if inode.Type != InodeTypeFile || fs.contentSumStale(inode) {
+		return nil
+	}
+	if inode.compressed() {
+		contents, err := fs.readContents(inode)
+		if err != nil {
+			return err
+		}
+		inode.contentSum, inode.contentSummed = checksum(contents.Bytes()), true
+		return nil
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return err
+	}
+	sum := uint32(0)
+	block := make([]byte, BlockSize)
+	left := int64(inode.Size)
+	for _, blockIndex := range blocks {
+		err := fs.readBlock(uint64(blockIndex), block)
+		if err != nil {
+			return fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+		n := int64(BlockSize)
+		if left < n {
+			n = left
+		}
+		sum = crc32.Update(sum, castagnoli, block[:n])
+		left -= n
+	}
+	inode.contentSum, inode.contentSummed = sum, true
+	return nil
+}
+
+// ScrubOptions configures ScrubWithOptions.
+type ScrubOptions struct {
+	// Progress, if set, is called after each inode, with the inodes and
+	// the bytes of file contents checked so far.
+	Progress ProgressFunc
+}
+
+// ScrubReport describes what Scrub found.
+type ScrubReport struct {
+	// Files is the number of files found.
+	Files int
+	// Unchecked is the number of those that weren't checked, as they have no
+	// checksum or were overwritten since it was last computed.
+	Unchecked int
+	// Bytes is the size of the files checked.
+	Bytes int64
+	// Mismatches lists the files whose contents don't match their checksum.
+	Mismatches []*ContentChecksumError
+}
+
+// Scrub reads every file of the filesystem and checks its contents against
+// its checksum, to find damaged data before it is read. Files are checked
+// one at a time, so other goroutines may use the filesystem meanwhile.
+func (fs *FileSystem) Scrub() (*ScrubReport, error) {
+	return fs.ScrubWithOptions(ScrubOptions{})
+}
+
+// ScrubWithOptions is Scrub with options.
+func (fs *FileSystem) ScrubWithOptions(opts ScrubOptions) (*ScrubReport, error) {
+	return fs.ScrubContext(context.Background(), opts)
+}
+
+// ScrubContext is ScrubWithOptions under ctx, see context.go. Once ctx is
+// done, it stops before the next file, and returns what it found so far.
+func (fs *FileSystem) ScrubContext(ctx context.Context, opts ScrubOptions) (*ScrubReport, error) {
+	report := &ScrubReport{}
+	count := int(fs.Geometry().InodeCount)
+	progress := Progress{Op: "scrub", TotalItems: count}
+	for i := 0; i < count; i++ {
+		err := ctx.Err()
+		if err != nil {
+			return report, err
+		}
+		err = fs.scrubInode(ctx, i, report, &progress)
+		if err != nil {
+			return report, err
+		}
+		progress.Items++
+		opts.Progress.report(progress)
+	}
+	return report, nil
+}
+
+// scrubInode checks the inode with the given index, if it is a file.
+func (fs *FileSystem) scrubInode(ctx context.Context, inodeIndex int, report *ScrubReport, progress *Progress) error {
+	defer fs.lockRead(ctx)()
+	lock := fs.inodeLock(inodeIndex)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	inode, err := fs.inode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	if inode == nil || inode.Type != InodeTypeFile {
+		return nil
+	}
+	report.Files++
+	if !inode.contentSummed || fs.contentSumStale(inode) {
+		report.Unchecked++
+		return nil
+	}
+	contents, err := fs.readInodeContents(inodeIndex)
+	if err != nil {
+		return fmt.Errorf("error reading inode %d: %w", inodeIndex, err)
+	}
+	report.Bytes += int64(contents.Len())
+	progress.Bytes += int64(contents.Len())
+	var mismatch *ContentChecksumError
+	if errors.As(fs.verifyContents(inode, contents.Bytes()), &mismatch) {
+		report.Mismatches = append(report.Mismatches, mismatch)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentSum(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	want := patterned(directBlocks*BlockSize + 100)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBuffer(want[:BlockSize+7]))
+	require.NoError(t, err)
+
+	// appends extend the checksum, and other writes recompute it
+	f, err := filesystem.OpenFile("/foo", O_WRONLY|O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(want[BlockSize+7 : 3*BlockSize])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = filesystem.Open("/foo", O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.Seek(3*BlockSize-10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write(want[3*BlockSize-10:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, filesystem.Truncate("/foo", int64(len(want)-50)))
+	want = want[:len(want)-50]
+
+	// writing past the end fills the gap with zeros
+	f, err = filesystem.Open("/foo", O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.Seek(int64(len(want))+BlockSize, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("tail"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	want = append(want, make([]byte, BlockSize)...)
+	want = append(want, "tail"...)
+
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.True(t, inode.contentSummed)
+	require.Equal(t, checksum(want), inode.contentSum)
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+}
+
+func TestContentSumMismatch(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("some contents"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("other contents"))
+	require.NoError(t, err)
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+
+	disk[int(inode.Blocks[0])*BlockSize] ^= 0xff
+	_, err = filesystem.ReadFileContents(int(inode.Index))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.ErrorIs(t, err, ErrCorrupt)
+	var mismatch *ContentChecksumError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, inode.Index, mismatch.Inode)
+	require.Equal(t, checksum([]byte("some contents")), mismatch.Expected)
+	require.NotEqual(t, mismatch.Expected, mismatch.Actual)
+
+	progress := []Progress{}
+	report, err := filesystem.ScrubWithOptions(ScrubOptions{Progress: func(p Progress) {
+		progress = append(progress, p)
+	}})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Files)
+	require.Zero(t, report.Unchecked)
+	require.Equal(t, int64(len("some contents")+len("other contents")), report.Bytes)
+	require.Equal(t, []*ContentChecksumError{mismatch}, report.Mismatches)
+	count := int(filesystem.Geometry().InodeCount)
+	require.Len(t, progress, count)
+	require.Equal(t, Progress{Op: "scrub", Items: count, TotalItems: count, Bytes: report.Bytes}, progress[count-1])
+}
+
+func TestContentSumOverwrite(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("some contents"))
+	require.NoError(t, err)
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+
+	// an overwrite within the file leaves the checksum stale until Sync
+	f, err := filesystem.Open("/foo", O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("SOME"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	report, err := filesystem.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Unchecked)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "SOME contents", contents.String())
+
+	require.NoError(t, filesystem.Sync())
+	report, err = filesystem.Scrub()
+	require.NoError(t, err)
+	require.Zero(t, report.Unchecked)
+	require.Empty(t, report.Mismatches)
+	disk[int(inode.Blocks[0])*BlockSize] ^= 0xff
+	_, err = filesystem.ReadFileContents(int(inode.Index))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestContentSumLongName(t *testing.T) {
+	// the checksum follows the encoded inode in its slot, which must leave
+	// room for it with the longest names
+	filesystem, disk := newBigTestFileSystem(t)
+	name := "/" + strings.Repeat("x", MaxNameLength)
+	want := patterned((directBlocks + 1) * BlockSize)
+	_, err := filesystem.CreateFile(name, bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName(name)
+	require.NoError(t, err)
+	require.True(t, inode.contentSummed)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+}
@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"context"
+)
+
+// Operations that may move many blocks have variants taking a
+// context.Context, named after them with Context appended, such as
+// ReadFileContext, so that operations over slow devices, such as a
+// NetBlockDevice or an ObjectStoreBlockDevice, can be cancelled and held to
+// deadlines. Once the context is done, the operation fails with its error,
+// context.Canceled or context.DeadlineExceeded, at its next block operation:
+// like a failing device, this rolls back what it changed. Devices
+// implementing ContextBlockDevice get the context of each block operation,
+// so they can give up on one in progress as well.
+//
+// The context of an operation is fs.ctx, which the block operations use
+// while the operation holds fs.mu for writing. Operations that otherwise
+// share fs.mu, such as ReadFile, take it for writing when given a context
+// that can be done, so that concurrent reads don't see each other's
+// contexts; the contexts of context.Background and context.TODO, which are
+// never done, leave them sharing it.
+
+// ContextBlockDevice is implemented by block devices whose operations can
+// be cancelled or held to a deadline.
+type ContextBlockDevice interface {
+	BlockDevice
+	// ReadBlockCtx is ReadBlock, giving up with the error of ctx once it is
+	// done.
+	ReadBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error
+	// WriteBlockCtx is WriteBlock, giving up with the error of ctx once it
+	// is done. The block may or may not be written then.
+	WriteBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error
+}
+
+// readBlockContext reads a block of dev, failing if ctx is done, and
+// passing ctx on to devices that take it.
+func readBlockContext(ctx context.Context, dev BlockDevice, blockNum uint64, buf []byte) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if dev, ok := dev.(ContextBlockDevice); ok {
+		return dev.ReadBlockCtx(ctx, blockNum, buf)
+	}
+	return dev.ReadBlock(blockNum, buf)
+}
+
+// writeBlockContext is readBlockContext for writes.
+func writeBlockContext(ctx context.Context, dev BlockDevice, blockNum uint64, buf []byte) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if dev, ok := dev.(ContextBlockDevice); ok {
+		return dev.WriteBlockCtx(ctx, blockNum, buf)
+	}
+	return dev.WriteBlock(blockNum, buf)
+}
+
+// withContext makes ctx the context of the block operations of the running
+// operation, which holds fs.mu for writing, until the returned function is
+// called. A nil ctx lifts the context, for writes that must be done
+// whatever it says, such as a rollback.
+func (fs *FileSystem) withContext(ctx context.Context) func() {
+	if ctx != nil && ctx.Done() == nil {
+		// it is never done
+		ctx = nil
+	}
+	saved := fs.ctx
+	fs.ctx = ctx
+	return func() { fs.ctx = saved }
+}
+
+// lockRead takes fs.mu for an operation that only reads, under ctx: shared,
+// unless ctx can be done, see above. It returns the function unlocking it.
+func (fs *FileSystem) lockRead(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		fs.mu.RLock()
+		return fs.mu.RUnlock
+	}
+	fs.mu.Lock()
+	restore := fs.withContext(ctx)
+	return func() {
+		restore()
+		fs.mu.Unlock()
+	}
+}
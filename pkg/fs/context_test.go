@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// contextKey tags the contexts of the tests, so the device can tell them
+// apart.
+type contextKey struct{}
+
+// cancellingDevice is a ContextBlockDevice counting the block operations
+// under a context, which it cancels once it has seen cancelAfter of them.
+type cancellingDevice struct {
+	*ArrayBlockDevice
+	ops         int
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (dev *cancellingDevice) ReadBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	err := dev.count(ctx)
+	if err != nil {
+		return err
+	}
+	return dev.ReadBlock(blockNum, buf)
+}
+
+func (dev *cancellingDevice) WriteBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	err := dev.count(ctx)
+	if err != nil {
+		return err
+	}
+	return dev.WriteBlock(blockNum, buf)
+}
+
+func (dev *cancellingDevice) count(ctx context.Context) error {
+	if ctx.Value(contextKey{}) == nil {
+		panic("block operation without the context of the test")
+	}
+	dev.ops++
+	if dev.ops == dev.cancelAfter {
+		dev.cancel()
+	}
+	return ctx.Err()
+}
+
+// newCancellingFileSystem returns a filesystem on a cancellingDevice, and
+// a context for its operations.
+func newCancellingFileSystem(t *testing.T) (*FileSystem, *cancellingDevice, context.Context) {
+	dev := &cancellingDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, (DataStartIndex+64)*BlockSize))}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, true))
+	t.Cleanup(cancel)
+	dev.cancel = cancel
+	return filesystem, dev, ctx
+}
+
+func TestContext(t *testing.T) {
+	filesystem, dev, ctx := newCancellingFileSystem(t)
+	contents := bytes.Repeat([]byte("0123456789"), BlockSize/4)
+	_, err := filesystem.CreateFileFromReaderContext(ctx, "/foo", bytes.NewReader(contents))
+	require.NoError(t, err)
+	require.NotZero(t, dev.ops)
+
+	// the context reaches the device
+	dev.ops = 0
+	data, err := filesystem.ReadFileContext(ctx, "/foo")
+	require.NoError(t, err)
+	require.Equal(t, contents, data)
+	require.NotZero(t, dev.ops)
+	p := make([]byte, 10)
+	_, err = filesystem.ReadAtContext(ctx, "/foo", p, BlockSize)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteAtContext(ctx, "/foo", []byte("hello"), 3))
+	require.NoError(t, filesystem.CopyFileContext(ctx, "/foo", "/bar"))
+	require.NoError(t, filesystem.TruncateContext(ctx, "/bar", 5))
+	require.NoError(t, filesystem.WriteFileAtomicContext(ctx, "/bar", bytes.NewBufferString("world")))
+	report, err := filesystem.ScrubContext(ctx, ScrubOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Mismatches)
+	require.NoError(t, filesystem.DeleteFileContext(ctx, "/bar"))
+
+	// operations without one leave the device alone
+	dev.ops = 0
+	_, err = filesystem.ReadFile("/foo")
+	require.NoError(t, err)
+	require.Zero(t, dev.ops)
+
+	// once it is done, operations fail with its error
+	dev.cancel()
+	_, err = filesystem.ReadFileContext(ctx, "/foo")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = filesystem.ScrubContext(ctx, ScrubOptions{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, filesystem.DeleteFileContext(ctx, "/foo"), context.Canceled)
+	data, err = filesystem.ReadFile("/foo")
+	require.NoError(t, err)
+	require.Equal(t, "012hello89", string(data[:10]))
+}
+
+func TestContextCancelledMidway(t *testing.T) {
+	for cancelAfter := 1; ; cancelAfter++ {
+		filesystem, dev, ctx := newCancellingFileSystem(t)
+		_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+		dev.ops, dev.cancelAfter = 0, cancelAfter
+
+		contents := bytes.Repeat([]byte("x"), 3*BlockSize)
+		_, err = filesystem.CreateFileFromReaderContext(ctx, "/bar", bytes.NewReader(contents))
+		if err == nil {
+			// the operation ended before the device cancelled it
+			require.Less(t, dev.ops, cancelAfter)
+			return
+		}
+		require.ErrorIs(t, err, context.Canceled)
+
+		// the operation is rolled back
+		require.NoError(t, filesystem.CheckInvariants())
+		_, err = filesystem.Stat("/bar")
+		require.ErrorIs(t, err, ErrNotExist, "cancelled after %d block operations", cancelAfter)
+		require.NoError(t, filesystem.Close())
+		require.Empty(t, findingsBySeverity(Diagnose(dev), SeverityWarning))
+	}
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	iofs "io/fs"
+)
+
+// CopyFile creates dstPath as a copy of the file srcPath, both absolute: a
+// new inode with the same contents, permission bits and compression, in
+// blocks of its own, unless the filesystem has a dedup table: then the copy
+// shares the blocks of the original, see dedup.go. It fails with ErrExist if
+// dstPath is taken, and with ErrIsDirectory if srcPath is a directory.
+func (fs *FileSystem) CopyFile(srcPath, dstPath string) (err error) {
+	return fs.CopyFileContext(context.Background(), srcPath, dstPath)
+}
+
+// CopyFileContext is CopyFile under ctx, see context.go.
+func (fs *FileSystem) CopyFileContext(ctx context.Context, srcPath, dstPath string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("CopyFile %s -> %s", srcPath, dstPath)
+	defer fs.checkInvariantsAfter("CopyFile")()
+	defer fs.withContext(ctx)()
+	return fs.copyFile(srcPath, dstPath)
+}
+
+// copyFile is CopyFile, for callers holding fs.mu.
+func (fs *FileSystem) copyFile(srcPath, dstPath string) error {
+	src, err := fs.findFile(srcPath)
+	if err == nil {
+		err = fs.checkAccess(src, accessRead)
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", srcPath, err)
+	}
+	contents, err := fs.readContentsInto(src, nil)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", srcPath, err)
+	}
+	err = fs.verifyContents(src, contents)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", srcPath, err)
+	}
+	fs.noteAccess(int(src.Index))
+
+	_, err = fs.createInode(dstPath, InodeTypeFile, bytes.NewReader(contents), iofs.FileMode(src.Mode), src.compression)
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", srcPath, dstPath, err)
+	}
+	return nil
+}
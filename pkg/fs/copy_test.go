@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFile(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents := bytes.Repeat([]byte("copy"), BlockSize)
+	src, err := filesystem.CreateFile("/src", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	require.NoError(t, filesystem.CopyFile("/src", "/dir/dst"))
+	dst, err := filesystem.FindInodeByName("/dir/dst")
+	require.NoError(t, err)
+	require.NotEqual(t, src.Index, dst.Index)
+	require.Equal(t, src.Size, dst.Size)
+	require.Equal(t, src.Mode, dst.Mode)
+	require.NotEqual(t, src.Blocks[0], dst.Blocks[0])
+	read, err := filesystem.ReadFileContents(int(dst.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+
+	// the copies change independently
+	require.NoError(t, filesystem.WriteAt("/dir/dst", []byte("changed"), 0))
+	read, err = filesystem.ReadFileContents(int(src.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+
+	require.NoError(t, filesystem.Close())
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	dst, err = reloaded.FindInodeByName("/dir/dst")
+	require.NoError(t, err)
+	read, err = reloaded.ReadFileContents(int(dst.Index))
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(read.Bytes()[:7]))
+}
+
+func TestCopyFileCompressed(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents := bytes.Repeat([]byte("compressible "), 2*BlockSize)
+	_, err = filesystem.CreateFileWithOptions("/src", bytes.NewReader(contents), CreateOptions{Compression: CompressionGzip})
+	require.NoError(t, err)
+
+	require.NoError(t, filesystem.CopyFile("/src", "/dst"))
+	dst, err := filesystem.FindInodeByName("/dst")
+	require.NoError(t, err)
+	require.Equal(t, CompressionGzip, dst.Compression())
+	read, err := filesystem.ReadFileContents(int(dst.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+}
+
+func TestCopyFileErrors(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/src", bytes.NewBufferString("src"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/taken", bytes.NewBufferString("taken"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	before, err := filesystem.Statfs()
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.CopyFile("/src", "/taken"), ErrExist)
+	require.ErrorIs(t, filesystem.CopyFile("/missing", "/dst"), ErrNotExist)
+	require.ErrorIs(t, filesystem.CopyFile("/dir", "/dst"), ErrIsDirectory)
+	require.ErrorIs(t, filesystem.CopyFile("/src", "/missing/dst"), ErrNotExist)
+	after, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	inode, err := filesystem.FindInodeByName("/taken")
+	require.NoError(t, err)
+	read, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "taken", read.String())
+}
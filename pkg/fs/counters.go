@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// The superblock records how many data blocks and inodes are free. The
+// bitmaps keep the counts as entries are taken and freed, and every write
+// of the superblock records them, so they are exact once the filesystem is
+// closed; mounting a clean filesystem checks them against the bitmaps it
+// reads. Counts that disagree mean something changed the bitmaps behind the
+// filesystem's back, or the superblock was damaged: the filesystem is
+// marked with FlagCheck for Fsck, and mounted with the counts of its
+// bitmaps.
+
+// counterMismatch describes how the free counts the superblock held when
+// the filesystem was read differ from its bitmaps, or returns "" if they
+// agree. Counts of filesystems before version 15, which don't record them,
+// and of dirty ones, whose superblock was written before their last
+// changes, aren't checked.
+func (fs *FileSystem) counterMismatch() string {
+	if fs.version < 15 || fs.dirty {
+		return ""
+	}
+	blocks, inodes := uint32(fs.dataBitmap.free), uint32(fs.inodeBitmap.free)
+	switch {
+	case fs.sbFreeBlocks != blocks:
+		return fmt.Sprintf("the superblock counts %d free data blocks, but the data bitmap has %d", fs.sbFreeBlocks, blocks)
+	case fs.sbFreeInodes != inodes:
+		return fmt.Sprintf("the superblock counts %d free inodes, but the inode bitmap has %d", fs.sbFreeInodes, inodes)
+	}
+	return ""
+}
+
+// checkCounters marks the filesystem with FlagCheck if its free counts
+// disagree with its bitmaps, when it is mounted.
+func (fs *FileSystem) checkCounters() error {
+	mismatch := fs.counterMismatch()
+	if mismatch == "" || fs.flags&FlagCheck != 0 {
+		return nil
+	}
+	fs.explainf("superblock: %s; flagging the filesystem for fsck", mismatch)
+	fs.flags |= FlagCheck
+	err := fs.writeState(StateClean)
+	if err != nil {
+		return fmt.Errorf("error flagging the filesystem for fsck: %w", err)
+	}
+	return nil
+}
+
+// checkCounterFindings reports free counts that disagree with the bitmaps,
+// and the flag a mount left for them.
+func (fs *FileSystem) checkCounterFindings() []Finding {
+	if mismatch := fs.counterMismatch(); mismatch != "" {
+		return []Finding{{
+			Severity: SeverityWarning,
+			Check:    "counters",
+			Message:  mismatch,
+			Remedy:   "run fsck with repair, which rewrites the counts from the bitmaps",
+		}}
+	}
+	if fs.flags&FlagCheck != 0 {
+		return []Finding{{
+			Severity: SeverityWarning,
+			Check:    "counters",
+			Message:  "a mount found the free counts of the superblock disagreeing with the bitmaps",
+			Remedy:   "run fsck with repair to check the filesystem and clear the flag",
+		}}
+	}
+	return nil
+}
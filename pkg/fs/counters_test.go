@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireCounters checks that the superblock of dev records the free counts
+// Statfs reports.
+func requireCounters(t *testing.T, dev BlockDevice, filesystem *FileSystem) {
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, stats.FreeBlocks, uint64(sb.FreeBlocks))
+	require.Equal(t, stats.FreeInodes, uint64(sb.FreeInodes))
+}
+
+func TestSuperblockCounters(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	requireCounters(t, dev, filesystem)
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(31), sb.FreeBlocks)
+	require.Equal(t, uint32(31), sb.FreeInodes)
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.Equal(t, 27, filesystem.dataBitmap.free)
+	require.Equal(t, 29, filesystem.inodeBitmap.free)
+	require.NoError(t, filesystem.Close())
+	requireCounters(t, dev, filesystem)
+
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.DeleteFile("/foo"))
+	require.NoError(t, filesystem.Close())
+	requireCounters(t, dev, filesystem)
+	require.Empty(t, findingsBySeverity(Diagnose(dev), SeverityWarning))
+}
+
+func TestSuperblockCountersMismatch(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// the data bitmap is changed without the superblock
+	binary.LittleEndian.PutUint32(disk[344:348], 12)
+	findings := Diagnose(dev)
+	require.Equal(t, "counters", findings[0].Check)
+	require.Equal(t, "the superblock counts 12 free data blocks, but the data bitmap has 29", findings[0].Message)
+
+	// mounting flags it for fsck, and works with the counts of the bitmaps
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, uint64(29), stats.FreeBlocks)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	requireCounters(t, dev, filesystem)
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(FlagCheck), sb.Flags&FlagCheck)
+
+	// the flag stays until fsck clears it
+	findings = Diagnose(dev)
+	require.Equal(t, "counters", findings[0].Check)
+	require.Contains(t, findings[0].Message, "a mount found the free counts")
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"cleared the check flag of the superblock"}, report.Repairs)
+	require.Empty(t, report.Remaining)
+
+	// fsck rewrites wrong counts
+	binary.LittleEndian.PutUint32(disk[348:352], 0)
+	report, err = Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"rewrote the free counts of the superblock"}, report.Repairs)
+	require.Empty(t, report.Remaining)
+	sb, err = ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Zero(t, sb.Flags&FlagCheck)
+	require.Equal(t, uint32(29), sb.FreeInodes)
+}
+
+func TestSuperblockCountersUnchecked(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	binary.LittleEndian.PutUint32(disk[344:348], 12)
+
+	// filesystems that weren't closed cleanly have their counts behind
+	binary.LittleEndian.PutUint32(disk[8:12], StateDirty)
+	require.Empty(t, findingsBySeverity(Diagnose(dev), SeverityError))
+	for _, f := range Diagnose(dev) {
+		require.NotEqual(t, "counters", f.Check)
+	}
+
+	// and filesystems before version 15 don't record them
+	binary.LittleEndian.PutUint32(disk[8:12], StateClean)
+	binary.LittleEndian.PutUint32(disk[4:8], 14)
+	require.Empty(t, findingsBySeverity(Diagnose(dev), SeverityWarning))
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.Zero(t, filesystem.flags&FlagCheck)
+}
@@ -0,0 +1,55 @@
+package fs
+
+import "fmt"
+
+// DataMode selects how writes of file data are ordered against writes of the
+// metadata referencing it, like the data= mount option of ext3 and ext4.
+// File data is never journaled: it goes to the device in place, and the
+// ordering is enforced with sync barriers on devices that can sync, such as
+// FileBlockDevice and MultiQueueDevice. Other devices complete writes in the
+// order they are issued, so both modes behave the same on them.
+type DataMode int
+
+const (
+	// DataWriteback issues data and metadata writes without barriers, so
+	// the device may persist them in any order. After a crash, an inode may
+	// point at blocks holding stale data. It is the fastest mode.
+	DataWriteback DataMode = iota
+	// DataOrdered syncs the data written by an operation before the inode
+	// table is written, so inodes never reach stable storage ahead of the
+	// blocks they point at. It costs a sync per inode table write.
+	DataOrdered
+)
+
+func (m DataMode) String() string {
+	switch m {
+	case DataWriteback:
+		return "writeback"
+	case DataOrdered:
+		return "ordered"
+	default:
+		return "unknown"
+	}
+}
+
+// SetDataMode sets how data writes are ordered against metadata writes. The
+// default is DataWriteback.
+func (fs *FileSystem) SetDataMode(mode DataMode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dataMode = mode
+}
+
+// orderData is called before writing the inode table. In DataOrdered mode it
+// syncs the data written so far.
+func (fs *FileSystem) orderData() error {
+	if fs.dataMode != DataOrdered {
+		return nil
+	}
+	fs.explainf("sync the device, so data is stable before the inodes pointing at it")
+	err := fs.syncDevice()
+	if err != nil {
+		return fmt.Errorf("error syncing data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// orderDevice logs the writes and syncs issued to it.
+type orderDevice struct {
+	BlockDevice
+	log []string
+}
+
+func (dev *orderDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev.log = append(dev.log, fmt.Sprintf("write %d", blockNum))
+	return dev.BlockDevice.WriteBlock(blockNum, buf)
+}
+
+func (dev *orderDevice) Sync() error {
+	dev.log = append(dev.log, "sync")
+	return nil
+}
+
+func TestDataMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode DataMode
+		want []string
+	}{
+		{DataWriteback, []string{"write 7", "write 3"}},
+		{DataOrdered, []string{"write 7", "sync", "write 3"}},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			disk := make([]byte, (DataStartIndex+32)*BlockSize)
+			filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Close())
+
+			dev := &orderDevice{BlockDevice: NewArrayBlockDevice(disk)}
+			filesystem, err = LoadFilesystemWithOptions(dev, MountOptions{DataMode: tc.mode})
+			require.NoError(t, err)
+			_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+			require.NoError(t, err)
+
+			// the superblock is marked dirty first, then the file's data
+			// block and inode are written
+			require.Equal(t, "write 0", dev.log[0])
+			require.Equal(t, tc.want, dev.log[1:1+len(tc.want)])
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Filesystems formatted with dedup, see MkfsOptions.Dedup, keep an entry
+// per data block in the dedup table, which follows the checksum table: the
+// FNV-64a hash of the block and the number of references to it from the
+// block maps of files. Entries with no references mean the block isn't
+// indexed, and belongs to at most one file; the entries of indexed blocks
+// are kept in memory, along with an index of their hashes.
+//
+// When the contents of a file are written whole, as by CreateFile, each
+// block is hashed and looked up in the index before a block is allocated
+// for it. A block with the same hash is read and compared, and if it holds
+// the same bytes it is referenced again rather than written. Blocks of the
+// contents that aren't found are written as usual and indexed.
+//
+// Freeing a block drops a reference, and only frees the block once the last
+// one is gone. Writing to a block in place first unshares it: a block with
+// other references is copied to a block of its own, and a block with no
+// others is dropped from the index, as its contents are about to change.
+// Writes at an offset, and the blocks of compressed files and directories,
+// aren't deduplicated.
+//
+// The table is metadata: it is written through writeMetadata along with the
+// data bitmap, see persistDataBitmap, and rolled back with it.
+
+// dedupEntrySize is the size of an entry of the dedup table: the hash
+// (uint64) and the number of references (uint32), little endian, followed by
+// four reserved bytes.
+const dedupEntrySize = 16
+
+// dedupEntriesPerBlock is the number of entries in a block of the dedup
+// table.
+const dedupEntriesPerBlock = BlockSize / dedupEntrySize
+
+// dedupBlocksFor returns the size of the dedup table of a filesystem of
+// blockCount blocks. There are fewer data blocks than blocks, so it is
+// enough for them.
+func dedupBlocksFor(blockCount uint32) uint32 {
+	return blocksFor(uint64(blockCount) * dedupEntrySize)
+}
+
+// dedupHash returns the hash of a block in the dedup table.
+func dedupHash(block []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(block)
+	return h.Sum64()
+}
+
+// dedupEntry is an entry of the dedup table.
+type dedupEntry struct {
+	hash uint64
+	refs uint32
+}
+
+// dedupTable is the dedup table, loaded in memory. Like a bitmap, it
+// marks the blocks of the table changed since they were written dirty.
+type dedupTable struct {
+	// start is the device block the table starts at, and dataStart the
+	// device block of data block 0, whose entry comes first
+	start     uint32
+	dataStart uint32
+	// entries holds an entry per data block
+	entries []dedupEntry
+	// index maps hashes to the indexed blocks holding them
+	index map[uint64][]uint32
+	// saved is the number of references past the first to indexed blocks
+	saved uint64
+	dirty []bool
+}
+
+// newDedupTable returns a table of n entries, none indexed, for the data
+// blocks of geometry g, with every block dirty. The blocks past those
+// holding entries are written with none.
+func newDedupTable(g Geometry, n int) *dedupTable {
+	t := &dedupTable{
+		start:     g.DedupStart,
+		dataStart: g.DataStart,
+		entries:   make([]dedupEntry, n),
+		index:     map[uint64][]uint32{},
+		dirty:     make([]bool, g.DedupBlocks),
+	}
+	for i := range t.dirty {
+		t.dirty[i] = true
+	}
+	return t
+}
+
+// readDedup loads the dedup table, if the filesystem has one, once the
+// geometry is known to be good.
+func (fs *FileSystem) readDedup() error {
+	g := fs.geometry
+	if g.DedupBlocks == 0 {
+		return nil
+	}
+	t := newDedupTable(g, int(g.DataBlocks()))
+	buf := make([]byte, BlockSize)
+	for i := range t.dirty {
+		err := fs.readMetadata(uint64(t.start)+uint64(i), buf)
+		if err != nil {
+			return fmt.Errorf("error reading block %d of the dedup table: %w", i, err)
+		}
+		for j := 0; j < dedupEntriesPerBlock && i*dedupEntriesPerBlock+j < len(t.entries); j++ {
+			e := buf[j*dedupEntrySize:]
+			t.set(i*dedupEntriesPerBlock+j, dedupEntry{
+				hash: binary.LittleEndian.Uint64(e[0:8]),
+				refs: binary.LittleEndian.Uint32(e[8:12]),
+			})
+		}
+		t.dirty[i] = false
+	}
+	fs.dedup = t
+	return nil
+}
+
+// flushDedup writes the dirty blocks of the dedup table, if the filesystem
+// has one. Blocks that fail to be written stay dirty.
+func (fs *FileSystem) flushDedup() error {
+	t := fs.dedup
+	if t == nil {
+		return nil
+	}
+	buf := make([]byte, BlockSize)
+	for i, dirty := range t.dirty {
+		if !dirty {
+			continue
+		}
+		for j := range buf {
+			buf[j] = 0
+		}
+		for j := 0; j < dedupEntriesPerBlock && i*dedupEntriesPerBlock+j < len(t.entries); j++ {
+			e := t.entries[i*dedupEntriesPerBlock+j]
+			binary.LittleEndian.PutUint64(buf[j*dedupEntrySize:], e.hash)
+			binary.LittleEndian.PutUint32(buf[j*dedupEntrySize+8:], e.refs)
+		}
+		err := fs.writeMetadata(uint64(t.start)+uint64(i), buf)
+		if err != nil {
+			return fmt.Errorf("error writing block %d of the dedup table: %w", i, err)
+		}
+		t.dirty[i] = false
+	}
+	return nil
+}
+
+// set sets entry i to e, keeping the index up to date and marking its block
+// dirty if that changes it.
+func (t *dedupTable) set(i int, e dedupEntry) {
+	old := t.entries[i]
+	if old == e {
+		return
+	}
+	blockIndex := uint32(i) + t.dataStart
+	if old.refs > 0 {
+		t.saved -= uint64(old.refs - 1)
+		blocks := t.index[old.hash]
+		for k, b := range blocks {
+			if b == blockIndex {
+				blocks = append(blocks[:k], blocks[k+1:]...)
+				break
+			}
+		}
+		if len(blocks) == 0 {
+			delete(t.index, old.hash)
+		} else {
+			t.index[old.hash] = blocks
+		}
+	}
+	if e.refs > 0 {
+		t.saved += uint64(e.refs - 1)
+		t.index[e.hash] = append(t.index[e.hash], blockIndex)
+	}
+	t.entries[i] = e
+	t.dirty[i/dedupEntriesPerBlock] = true
+}
+
+// entry returns the entry of a data block.
+func (t *dedupTable) entry(blockIndex uint32) dedupEntry {
+	return t.entries[blockIndex-t.dataStart]
+}
+
+// ref adds a reference to a data block holding contents with the given
+// hash, indexing it if it wasn't.
+func (t *dedupTable) ref(blockIndex uint32, hash uint64) {
+	e := t.entry(blockIndex)
+	if e.refs == 0 {
+		e.hash = hash
+	}
+	e.refs++
+	t.set(int(blockIndex-t.dataStart), e)
+}
+
+// unref drops a reference to an indexed data block, and returns the number
+// left. The block is dropped from the index with its last one.
+func (t *dedupTable) unref(blockIndex uint32) uint32 {
+	e := t.entry(blockIndex)
+	if e.refs <= 1 {
+		e = dedupEntry{}
+	} else {
+		e.refs--
+	}
+	t.set(int(blockIndex-t.dataStart), e)
+	return e.refs
+}
+
+// replace replaces every entry with entries, as copied by clone, marking the
+// blocks that change dirty.
+func (t *dedupTable) replace(entries []dedupEntry) {
+	for i, e := range entries {
+		t.set(i, e)
+	}
+}
+
+// clone copies the entries, for rolling back.
+func (t *dedupTable) clone() []dedupEntry {
+	return append([]dedupEntry(nil), t.entries...)
+}
+
+// resize grows or shrinks the table to n entries, as the data bitmap is
+// resized, within the blocks of the table. New entries index nothing; the
+// entries cut off must index nothing either, as their blocks are free.
+func (t *dedupTable) resize(n int) {
+	old := len(t.entries)
+	if n > old {
+		t.entries = append(t.entries, make([]dedupEntry, n-old)...)
+		for i := old / dedupEntriesPerBlock; i < int(blocksFor(uint64(n)*dedupEntrySize)); i++ {
+			t.dirty[i] = true
+		}
+		return
+	}
+	for i := n; i < old; i++ {
+		t.set(i, dedupEntry{})
+	}
+	t.entries = t.entries[:n]
+}
+
+// findDuplicate looks for an indexed block holding the same bytes as block,
+// whose hash is given, reading the candidates into scratch. It returns the
+// block, and false if there is none.
+func (fs *FileSystem) findDuplicate(block []byte, hash uint64, scratch []byte) (uint32, bool, error) {
+	for _, blockIndex := range fs.dedup.index[hash] {
+		err := fs.readBlock(uint64(blockIndex), scratch)
+		if err != nil {
+			return 0, false, fmt.Errorf("error reading block %d to compare it: %w", blockIndex, err)
+		}
+		if bytes.Equal(block, scratch) {
+			return blockIndex, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// releaseBlock frees a block of an inode in the in-memory data bitmap, once
+// nothing else references it; see setBlockAllocated.
+func (fs *FileSystem) releaseBlock(blockIndex uint32) {
+	if t := fs.dedup; t != nil && t.entry(blockIndex).refs > 0 {
+		if left := t.unref(blockIndex); left > 0 {
+			fs.explainf("dedup table: block %d has %d references left", blockIndex, left)
+			return
+		}
+	}
+	fs.setBlockAllocated(blockIndex, false)
+}
+
+// sharesBlocks reports whether any of blocks is referenced more than once,
+// by other files or repeatedly by one.
+func (fs *FileSystem) sharesBlocks(blocks []uint32) bool {
+	if fs.dedup == nil {
+		return false
+	}
+	for _, blockIndex := range blocks {
+		if fs.dedup.entry(blockIndex).refs > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// indexCopies indexes the blocks of to, which hold copies of the blocks of
+// from, as the blocks they were copied from are indexed. Each copy gets a
+// reference of its own; the caller releases the blocks of from.
+func (fs *FileSystem) indexCopies(from, to []uint32) {
+	if fs.dedup == nil {
+		return
+	}
+	for i, blockIndex := range from {
+		if e := fs.dedup.entry(blockIndex); e.refs > 0 {
+			fs.dedup.ref(to[i], e.hash)
+		}
+	}
+}
+
+// unshare prepares the data blocks of inode with indices first to end, in
+// file order, to be written in place: blocks referenced elsewhere too are
+// copied to new blocks, replacing them in blocks, and indexed blocks with no
+// other references are dropped from the index. The contents of the blocks
+// are copied only if keep is set. It returns whether any block was
+// replaced; the caller maps the blocks then. It does nothing on filesystems
+// without a dedup table.
+func (fs *FileSystem) unshare(inode *Inode, blocks []uint32, first, end int, keep bool) (bool, error) {
+	t := fs.dedup
+	if t == nil {
+		return false, nil
+	}
+	if end > len(blocks) {
+		end = len(blocks)
+	}
+	replaced := false
+	var buf []byte
+	for i := first; i < end; i++ {
+		blockIndex := blocks[i]
+		switch t.entry(blockIndex).refs {
+		case 0:
+			continue
+		case 1:
+			t.unref(blockIndex)
+			continue
+		}
+		copies, err := fs.findContiguousBlocks(1, blocks[:i])
+		if err != nil {
+			return replaced, fmt.Errorf("error finding a block to unshare block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+		fs.setBlockAllocated(copies[0], true)
+		if keep {
+			if buf == nil {
+				buf = make([]byte, BlockSize)
+			}
+			err = fs.readBlock(uint64(blockIndex), buf)
+			if err != nil {
+				return replaced, fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inode.Index, err)
+			}
+			fs.revoke(uint64(copies[0]))
+			err = fs.writeBlock(uint64(copies[0]), buf)
+			if err != nil {
+				return replaced, fmt.Errorf("error writing block %d of inode %d: %w", copies[0], inode.Index, err)
+			}
+		}
+		fs.explainf("unshare block %d of inode %d as block %d", blockIndex, inode.Index, copies[0])
+		t.unref(blockIndex)
+		blocks[i] = copies[0]
+		replaced = true
+	}
+	return replaced, nil
+}
+
+// unshareMapped is unshare for the blocks of inode as mapped, which are
+// mapped again if any is replaced. It returns the data blocks of inode, as
+// fileBlocks does.
+func (fs *FileSystem) unshareMapped(inode *Inode, first, end int, keep bool) ([]uint32, error) {
+	if fs.dedup == nil {
+		return fs.fileBlocks(inode)
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return nil, err
+	}
+	blocks := append([]uint32{}, old.data...)
+	replaced, err := fs.unshare(inode, blocks, first, end, keep)
+	if err != nil || !replaced {
+		return blocks, err
+	}
+	return blocks, fs.mapBlocks(inode, old, blocks)
+}
+
+// dedupMismatches compares the references to each data block, counted in
+// refs, with the dedup table, and describes the blocks whose entry doesn't
+// count them, in block order. Blocks referenced once need no entry, and
+// blocks referenced more than once need one counting them all.
+func (fs *FileSystem) dedupMismatches(refs map[uint32]int) []string {
+	t := fs.dedup
+	blocks := []uint32{}
+	for blockIndex, n := range refs {
+		if n > 1 && fs.isDataBlock(blockIndex) {
+			blocks = append(blocks, blockIndex)
+		}
+	}
+	for i, e := range t.entries {
+		if blockIndex := uint32(i) + t.dataStart; e.refs > 0 && refs[blockIndex] <= 1 {
+			blocks = append(blocks, blockIndex)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	mismatches := []string{}
+	for _, blockIndex := range blocks {
+		n, recorded := refs[blockIndex], t.entry(blockIndex).refs
+		if recorded == 0 && n <= 1 || int(recorded) == n {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("block %d is referenced %d times, but the dedup table counts %d", blockIndex, n, recorded))
+	}
+	return mismatches
+}
+
+// repairDedup recounts the references to the data blocks of files in the
+// dedup table, indexing the blocks referenced more than once that weren't,
+// and reports each entry it changes. Blocks referenced once keep their
+// entry only if it counts one reference.
+func (fs *FileSystem) repairDedup(scan *inodeScan, fixed func(string, ...interface{})) error {
+	t := fs.dedup
+	refs := map[uint32]uint32{}
+	for i, inode := range scan.inodes {
+		if inode == nil || inode.Type != InodeTypeFile || inode.compressed() || scan.blockMaps[i] == nil {
+			continue
+		}
+		for _, blockIndex := range scan.blockMaps[i].data {
+			refs[blockIndex]++
+		}
+	}
+	buf := make([]byte, BlockSize)
+	for i, e := range t.entries {
+		blockIndex := uint32(i) + t.dataStart
+		n := refs[blockIndex]
+		want := e
+		switch {
+		case n > 1 && e.refs == 0:
+			err := fs.readBlock(uint64(blockIndex), buf)
+			if err != nil {
+				return fmt.Errorf("error reading block %d to index it: %w", blockIndex, err)
+			}
+			want = dedupEntry{hash: dedupHash(buf), refs: n}
+		case n > 1:
+			want.refs = n
+		case e.refs != 0 && (n == 0 || e.refs != 1):
+			want = dedupEntry{}
+		}
+		if want != e {
+			fixed("block %d: recounted its references in the dedup table as %d, not %d", blockIndex, want.refs, e.refs)
+			t.set(i, want)
+		}
+	}
+	return nil
+}
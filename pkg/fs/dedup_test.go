@@ -0,0 +1,189 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts MkfsOptions
+	}{
+		{"plain", MkfsOptions{Blocks: 300, Dedup: true}},
+		{"journal", MkfsOptions{Blocks: 300, JournalBlocks: 32, Checksums: true, Dedup: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := make([]byte, 300*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), tt.opts)
+			require.NoError(t, err)
+			require.NotZero(t, filesystem.Geometry().DedupBlocks)
+			free := func() uint64 {
+				stats, err := filesystem.Statfs()
+				require.NoError(t, err)
+				return stats.FreeBlocks
+			}
+			contents := func(name string) []byte {
+				data, err := filesystem.ReadFile(name)
+				require.NoError(t, err)
+				return data
+			}
+
+			want := patterned(5*BlockSize + 100)
+			_, err = filesystem.CreateFile("/a", bytes.NewBuffer(want))
+			require.NoError(t, err)
+			before := free()
+			// identical files, and identical blocks of a file, share blocks
+			_, err = filesystem.CreateFile("/b", bytes.NewBuffer(want))
+			require.NoError(t, err)
+			require.NoError(t, filesystem.CopyFile("/a", "/c"))
+			_, err = filesystem.CreateFile("/zeros", bytes.NewBuffer(make([]byte, 8*BlockSize)))
+			require.NoError(t, err)
+			require.Equal(t, before-1, free())
+			stats, err := filesystem.Statfs()
+			require.NoError(t, err)
+			require.Equal(t, uint64(6+6+7), stats.SavedBlocks)
+
+			// writing to a shared block copies it first
+			require.NoError(t, filesystem.WriteAt("/b", []byte("changed"), BlockSize+10))
+			require.Equal(t, before-2, free())
+			changed := bytes.Clone(want)
+			copy(changed[BlockSize+10:], "changed")
+			require.Equal(t, changed, contents("/b"))
+			require.Equal(t, want, contents("/a"))
+			require.NoError(t, filesystem.Truncate("/c", 2*BlockSize+1))
+			require.Equal(t, want[:2*BlockSize+1], contents("/c"))
+			require.Equal(t, want, contents("/a"))
+
+			// the blocks stay until the last file referencing them is gone
+			require.NoError(t, filesystem.DeleteFile("/a"))
+			require.Equal(t, changed, contents("/b"))
+			require.NoError(t, filesystem.DeleteFile("/zeros"))
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.NoError(t, reloaded.CheckInvariants())
+			data, err := reloaded.ReadFile("/c")
+			require.NoError(t, err)
+			require.Equal(t, want[:2*BlockSize+1], data)
+			// what is left is found again, but for the block written at
+			// an offset, which isn't indexed
+			_, err = reloaded.CreateFile("/d", bytes.NewBuffer(changed))
+			require.NoError(t, err)
+			stats, err = reloaded.Statfs()
+			require.NoError(t, err)
+			require.Equal(t, uint64(1+5), stats.SavedBlocks)
+			require.NoError(t, reloaded.Close())
+			report, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Problems)
+		})
+	}
+}
+
+func TestDedupRollback(t *testing.T) {
+	disk := make([]byte, 300*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 300, Dedup: true})
+	require.NoError(t, err)
+	want := patterned(3 * BlockSize)
+	_, err = filesystem.CreateFile("/a", bytes.NewBuffer(want))
+	require.NoError(t, err)
+
+	txn := filesystem.Begin()
+	_, err = txn.Create("/b", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), filesystem.dedup.saved)
+	require.NoError(t, txn.Rollback())
+	require.Zero(t, filesystem.dedup.saved)
+	require.NoError(t, filesystem.CheckInvariants())
+
+	// a failed operation gives its references back
+	require.NoError(t, filesystem.SetQuota("/", Quota{MaxBytes: 4 * BlockSize}))
+	_, err = filesystem.CreateFile("/b", bytes.NewBuffer(want))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.Zero(t, filesystem.dedup.saved)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestFsckRecountsDedupReferences(t *testing.T) {
+	disk := make([]byte, 300*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 300, Dedup: true})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/a", bytes.NewBufferString("same"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/b", bytes.NewBufferString("same"))
+	require.NoError(t, err)
+	inode, err := filesystem.FindInodeByName("/a")
+	require.NoError(t, err)
+	blockIndex := inode.usedBlocks()[0]
+	e := filesystem.dedup.entry(blockIndex)
+	require.Equal(t, uint32(2), e.refs)
+	e.refs = 1
+	filesystem.dedup.set(int(blockIndex-filesystem.geometry.DataStart), e)
+	require.NoError(t, filesystem.flushDedup())
+	require.Error(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	_, err = LoadFilesystem(dev)
+	require.ErrorIs(t, err, ErrCorrupt)
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Contains(t, report.Repairs, fmt.Sprintf("block %d: recounted its references in the dedup table as 2, not 1", blockIndex))
+	require.Empty(t, report.Remaining)
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, reloaded.DeleteFile("/a"))
+	data, err := reloaded.ReadFile("/b")
+	require.NoError(t, err)
+	require.Equal(t, []byte("same"), data)
+}
+
+func TestDedupResize(t *testing.T) {
+	disk := make([]byte, 1000*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 500, Dedup: true})
+	require.NoError(t, err)
+	max := filesystem.Geometry().maxBlockCount()
+	require.Less(t, max, uint32(1000))
+	err = filesystem.Resize(uint64(max) + 1)
+	require.ErrorIs(t, err, ErrGeometry)
+	require.NoError(t, filesystem.Resize(uint64(max)))
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+
+	// blocks of their own up to the old end, so the shared ones are past it
+	n := int(stats.FreeBlocks) - int(max-500)
+	fill := make([]byte, n*BlockSize)
+	for i := 0; i < n; i++ {
+		fill[i*BlockSize] = byte(i)
+		fill[i*BlockSize+1] = byte(i >> 8)
+	}
+	_, err = filesystem.CreateFile("/fill", bytes.NewBuffer(fill))
+	require.NoError(t, err)
+	want := patterned(3 * BlockSize)
+	for _, name := range []string{"/a", "/b"} {
+		_, err = filesystem.CreateFile(name, bytes.NewBuffer(want))
+		require.NoError(t, err)
+	}
+	inode, err := filesystem.FindInodeByName("/a")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, inode.usedBlocks()[0], uint32(500))
+	require.NoError(t, filesystem.DeleteFile("/fill"))
+
+	require.NoError(t, filesystem.Resize(500))
+	require.NoError(t, filesystem.CheckInvariants())
+	for _, name := range []string{"/a", "/b"} {
+		data, err := filesystem.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, want, data)
+	}
+	require.NoError(t, filesystem.Close())
+	report, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+}
@@ -0,0 +1,262 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Defrag moves the data blocks of files to single runs of free blocks, so
+// each file is contiguous, and moves files down into free runs below them
+// that hold them, so the free space gathers at the end of the data region.
+// It first makes the fragmented files contiguous, then goes through every
+// file in the order of its first block, so the space a file leaves is taken
+// by the files after it, until nothing moves. Each move is an operation of
+// its own: the data is copied to the new blocks first, and
+// the inode and the bitmap are then changed together, in one transaction of
+// the journal if there is one. Until then the file keeps its old blocks, so
+// an interruption leaves it whole wherever it is. The blocks of directories
+// and extended attributes stay where they are, and so do files with blocks
+// shared through the dedup table, see dedup.go.
+
+// defragChunk is the number of blocks Defrag copies at a time.
+const defragChunk = 256
+
+// DefragOptions configures DefragWithOptions.
+type DefragOptions struct {
+	// Progress, if set, is called after each file, with the files looked
+	// at and the bytes moved so far.
+	Progress ProgressFunc
+}
+
+// DefragReport describes what Defrag did.
+type DefragReport struct {
+	// Files is the number of files with data blocks.
+	Files int
+	// Moved is the number of files moved, and BlocksMoved the number of
+	// data blocks they took.
+	Moved       int
+	BlocksMoved int
+	// Fragmented is the number of files left in several runs, as no run of
+	// free blocks holds them.
+	Fragmented int
+}
+
+// Defrag makes files contiguous and gathers the free space; see
+// DefragWithOptions.
+func (fs *FileSystem) Defrag() (*DefragReport, error) {
+	return fs.DefragWithOptions(DefragOptions{})
+}
+
+// DefragWithOptions makes every file contiguous that a run of free blocks
+// can hold, and moves files down to free runs below them, leaving the free
+// space in as few runs as it can. Files are moved one at a time, so other
+// goroutines may use the filesystem meanwhile; if a move fails, the file
+// stays where it was and Defrag stops, returning the report so far.
+func (fs *FileSystem) DefragWithOptions(opts DefragOptions) (*DefragReport, error) {
+	report := &DefragReport{}
+	_, fragmented, err := fs.filesByFirstBlock()
+	if err != nil {
+		return nil, err
+	}
+	progress := Progress{Op: "defrag"}
+	pass := func(files []int) (int, error) {
+		progress.TotalItems += len(files)
+		moves := 0
+		for _, inodeIndex := range files {
+			moved, err := fs.defragFile(inodeIndex, report)
+			if err != nil {
+				return moves, err
+			}
+			if moved > 0 {
+				moves++
+			}
+			progress.Items++
+			progress.Bytes += int64(moved) * BlockSize
+			opts.Progress.report(progress)
+		}
+		return moves, nil
+	}
+	_, err = pass(fragmented)
+	if err != nil {
+		return report, err
+	}
+	// moving a file may free blocks below the files before it, such as
+	// its pointer blocks, so the passes go on until one moves nothing
+	for {
+		files, _, err := fs.filesByFirstBlock()
+		if err != nil {
+			return report, err
+		}
+		report.Files, report.Fragmented = 0, 0
+		moves, err := pass(files)
+		if err != nil || moves == 0 {
+			return report, err
+		}
+	}
+}
+
+// filesByFirstBlock returns the indices of the files with data blocks,
+// ordered by their first one, and those of the fragmented ones among them.
+func (fs *FileSystem) filesByFirstBlock() (files, fragmented []int, err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	first := map[int]uint32{}
+	err = fs.forEachInode(func(inodeIndex int, inode *Inode) error {
+		if inode.Type != InodeTypeFile {
+			return nil
+		}
+		blocks, err := fs.fileBlocks(inode)
+		if err != nil {
+			return err
+		}
+		if len(blocks) > 0 {
+			files = append(files, inodeIndex)
+			first[inodeIndex] = blocks[0]
+		}
+		if countExtents(blocks) > 1 {
+			fragmented = append(fragmented, inodeIndex)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return first[files[i]] < first[files[j]] })
+	return files, fragmented, nil
+}
+
+// defragFile moves the data blocks of a file to a run of free blocks, if
+// Defrag should, returning the number of blocks moved.
+func (fs *FileSystem) defragFile(inodeIndex int, report *DefragReport) (moved int, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Defrag inode %d", inodeIndex)
+	defer fs.checkInvariantsAfter("Defrag")()
+
+	// the file may be gone since it was listed
+	inode, err := fs.inode(inodeIndex)
+	if err != nil || inode == nil || inode.Type != InodeTypeFile {
+		return 0, err
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return 0, err
+	}
+	n := len(old.data)
+	if n == 0 {
+		return 0, nil
+	}
+	report.Files++
+	target := fs.defragTarget(old.data)
+	// moving a block shared with other files would copy it
+	if target < 0 || fs.sharesBlocks(old.data) {
+		if countExtents(old.data) > 1 {
+			report.Fragmented++
+		}
+		return 0, nil
+	}
+
+	snapshot := fs.snapshot(inodeIndex)
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return 0, err
+	}
+	data := make([]uint32, n)
+	for i := range data {
+		data[i] = uint32(target+i) + fs.geometry.DataStart
+		fs.setBlockAllocated(data[i], true)
+	}
+	err = fs.copyBlocks(inode, old.data, data)
+	if err != nil {
+		return 0, err
+	}
+	fs.indexCopies(old.data, data)
+	// the pointer or extent blocks are written afresh for the new blocks,
+	// and those of old freed with its data blocks
+	err = fs.mapBlocks(inode, &blockMap{}, data)
+	if err != nil {
+		return 0, err
+	}
+	for _, blockIndex := range old.data {
+		fs.releaseBlock(blockIndex)
+	}
+	for _, blockIndex := range old.pointers() {
+		fs.setBlockAllocated(blockIndex, false)
+	}
+
+	err = fs.writeInodeTable()
+	if err != nil {
+		return 0, fmt.Errorf("error writing inode table: %w", err)
+	}
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return 0, fmt.Errorf("error writing data bitmap: %w", err)
+	}
+	report.Moved++
+	report.BlocksMoved += n
+	return n, nil
+}
+
+// defragTarget returns the entry in the data bitmap where the run of free
+// blocks a file with the given data blocks should move to starts, or -1 if
+// it should stay: the first run holding the file, if it lies below the
+// file, or if the file is fragmented.
+func (fs *FileSystem) defragTarget(blocks []uint32) int {
+	r := firstHolding(fs.freeBlocks.runs, len(blocks))
+	if r < 0 {
+		return -1
+	}
+	start := fs.freeBlocks.runs[r].start
+	if uint32(start)+fs.geometry.DataStart < blocks[0] || countExtents(blocks) > 1 {
+		return start
+	}
+	return -1
+}
+
+// copyBlocks copies the data blocks of inode from one list of blocks to
+// another, a chunk at a time. The blocks of directories are copied as
+// metadata, as writeContents writes them.
+func (fs *FileSystem) copyBlocks(inode *Inode, from, to []uint32) error {
+	if (fs.journal != nil || fs.checksums != nil) && inode.Type == InodeTypeDirectory {
+		buf := make([]byte, BlockSize)
+		for i, blockIndex := range from {
+			err := fs.readMetadata(uint64(blockIndex), buf)
+			if err != nil {
+				return fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inode.Index, err)
+			}
+			err = fs.writeMetadata(uint64(to[i]), buf)
+			if err != nil {
+				return fmt.Errorf("error writing block %d of inode %d: %w", to[i], inode.Index, err)
+			}
+		}
+		return nil
+	}
+	buf := make([]byte, defragChunk*BlockSize)
+	for i := 0; i < len(from); i += defragChunk {
+		end := i + defragChunk
+		if end > len(from) {
+			end = len(from)
+		}
+		chunk := buf[:(end-i)*BlockSize]
+		err := fs.transferBlocks(false, inode.Index, from[i:end], chunk)
+		if err != nil {
+			return err
+		}
+		for _, blockIndex := range to[i:end] {
+			fs.revoke(uint64(blockIndex))
+		}
+		err = fs.transferBlocks(true, inode.Index, to[i:end], chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefrag(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		newFS func(t *testing.T) (*FileSystem, []byte)
+	}{
+		{"extents", newBigTestFileSystem},
+		{"pointers", newPointerTestFileSystem},
+		{"journal", func(t *testing.T) (*FileSystem, []byte) {
+			disk := make([]byte, 2400*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 2400, JournalBlocks: 32, Checksums: true})
+			require.NoError(t, err)
+			return filesystem, disk
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filesystem, disk := tt.newFS(t)
+			// more blocks than the inode holds, so it needs an extent or
+			// pointer block
+			want, inode := fragment(t, filesystem, directBlocks+3)
+			for i := 0; i < directBlocks+3; i += 2 {
+				require.NoError(t, filesystem.DeleteFile(fmt.Sprintf("/spacer%d", i)))
+			}
+			blocks, err := filesystem.fileBlocks(inode)
+			require.NoError(t, err)
+			require.Greater(t, countExtents(blocks), 1)
+			free := filesystem.freeBlocks.free
+
+			var last Progress
+			report, err := filesystem.DefragWithOptions(DefragOptions{Progress: func(p Progress) { last = p }})
+			require.NoError(t, err)
+			require.Equal(t, "defrag", last.Op)
+			require.Equal(t, last.TotalItems, last.Items)
+			require.Equal(t, int64(report.BlocksMoved)*BlockSize, last.Bytes)
+			require.GreaterOrEqual(t, report.Moved, 1)
+			require.GreaterOrEqual(t, report.BlocksMoved, len(want)/BlockSize)
+			require.Zero(t, report.Fragmented)
+
+			blocks, err = filesystem.fileBlocks(inode)
+			require.NoError(t, err)
+			require.Equal(t, 1, countExtents(blocks))
+			// a contiguous file needs no extent block, but pointers still do
+			if tt.name == "pointers" {
+				require.Equal(t, free, filesystem.freeBlocks.free)
+			} else {
+				require.Equal(t, free+1, filesystem.freeBlocks.free)
+			}
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			contents, err := reloaded.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, want, contents.Bytes())
+			report2, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report2.Remaining)
+
+			// there is nothing left to do
+			report, err = reloaded.Defrag()
+			require.NoError(t, err)
+			require.Zero(t, report.Moved)
+		})
+	}
+}
+
+func TestDefragCompactsFreeSpace(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, (DataStartIndex+64)*BlockSize)))
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBuffer(patterned(2*BlockSize)))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 6; i += 2 {
+		require.NoError(t, filesystem.DeleteFile(fmt.Sprintf("/f%d", i)))
+	}
+	require.Greater(t, len(filesystem.freeBlocks.runs), 1)
+
+	report, err := filesystem.Defrag()
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Files)
+	require.Equal(t, 3, report.Moved)
+	require.Equal(t, 6, report.BlocksMoved)
+	require.Len(t, filesystem.freeBlocks.runs, 1)
+	for i := 1; i < 6; i += 2 {
+		inode, err := filesystem.FindInodeByName(fmt.Sprintf("/f%d", i))
+		require.NoError(t, err)
+		contents, err := filesystem.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, patterned(2*BlockSize), contents.Bytes())
+	}
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestDefragNoRoom(t *testing.T) {
+	filesystem, _ := newBigTestFileSystem(t)
+	fragment(t, filesystem, 4)
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	// leave three free blocks, none of them next to each other
+	_, err = filesystem.CreateFile("/fill", bytes.NewBuffer(make([]byte, int(stats.FreeBlocks-3)*BlockSize)))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, filesystem.DeleteFile(fmt.Sprintf("/spacer%d", i)))
+	}
+
+	report, err := filesystem.Defrag()
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Fragmented)
+	require.NoError(t, filesystem.CheckInvariants())
+}
@@ -0,0 +1,218 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+)
+
+// DeleteFile removes the file with the given absolute name. If it was its
+// last name, see Link, the inode and data blocks are freed, and open Files
+// for it fail with ErrStale afterwards.
+// Directories are removed with Rmdir. On write-once filesystems, deleting a
+// file fails with ErrWORM until its retention period has passed.
+func (fs *FileSystem) DeleteFile(filename string) (err error) {
+	return fs.DeleteFileContext(context.Background(), filename)
+}
+
+// DeleteFileContext is DeleteFile under ctx, see context.go.
+func (fs *FileSystem) DeleteFileContext(ctx context.Context, filename string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("DeleteFile %s", filename)
+	defer fs.checkInvariantsAfter("DeleteFile")()
+	defer fs.withContext(ctx)()
+	return fs.deleteFile(filename)
+}
+
+func (fs *FileSystem) deleteFile(filename string) (err error) {
+	parentInode, err := fs.findParent(filename)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", filename, err)
+	}
+	name := baseName(filename)
+	inode, err := fs.lookup(int(parentInode.Index), name)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", filename, err)
+	}
+	if inode.Type != InodeTypeFile {
+		return fmt.Errorf("error deleting %s: %w", filename, ErrIsDirectory)
+	}
+	err = fs.checkAccess(parentInode, accessWrite)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", filename, err)
+	}
+	err = fs.checkRetained(inode)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", filename, err)
+	}
+
+	blocks, err := fs.readBlockMap(inode)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", filename, err)
+	}
+
+	inodeIndex := int(inode.Index)
+	snapshot := fs.snapshot(inodeIndex, int(parentInode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	// unlink the file first, so that a crash midway leaves its inode on the
+	// orphan list rather than an entry pointing at a free inode
+	if inode.links() <= 1 {
+		err = fs.addOrphan(inodeIndex)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.removeFromDir(int(parentInode.Index), name)
+	if err != nil {
+		return err
+	}
+	return fs.dropLink(snapshot, inode, blocks)
+}
+
+// Rmdir removes the empty directory with the given absolute name, freeing
+// its inode and blocks. It fails with ErrNotEmpty if the directory has
+// entries, and with ErrNotDirectory if the name is a file. The root
+// directory can't be removed.
+func (fs *FileSystem) Rmdir(dirname string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Rmdir %s", dirname)
+	defer fs.checkInvariantsAfter("Rmdir")()
+	return fs.rmdir(dirname)
+}
+
+func (fs *FileSystem) rmdir(dirname string) (err error) {
+	if baseName(dirname) == "" {
+		return fmt.Errorf("error removing %s: the root directory can't be removed: %w", dirname, ErrPermission)
+	}
+	parentInode, err := fs.findParent(dirname)
+	if err != nil {
+		return fmt.Errorf("error removing %s: %w", dirname, err)
+	}
+	name := baseName(dirname)
+	inode, err := fs.lookup(int(parentInode.Index), name)
+	if err != nil {
+		return fmt.Errorf("error removing %s: %w", dirname, err)
+	}
+	if inode.Type != InodeTypeDirectory {
+		return fmt.Errorf("error removing %s: %w", dirname, ErrNotDirectory)
+	}
+	err = fs.checkAccess(parentInode, accessWrite)
+	if err != nil {
+		return fmt.Errorf("error removing %s: %w", dirname, err)
+	}
+	records, err := fs.readDirRecords(int(inode.Index))
+	if err != nil {
+		return fmt.Errorf("error removing %s: %w", dirname, err)
+	}
+	if len(records) > 0 {
+		return fmt.Errorf("error removing %s: %w", dirname, ErrNotEmpty)
+	}
+
+	blocks, err := fs.readBlockMap(inode)
+	if err != nil {
+		return fmt.Errorf("error removing %s: %w", dirname, err)
+	}
+
+	inodeIndex := int(inode.Index)
+	snapshot := fs.snapshot(inodeIndex, int(parentInode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	// as in deleteFile, the inode is an orphan until it is freed
+	err = fs.addOrphan(inodeIndex)
+	if err != nil {
+		return err
+	}
+	err = fs.removeFromDir(int(parentInode.Index), name)
+	if err != nil {
+		return err
+	}
+	return fs.dropLink(snapshot, inode, blocks)
+}
+
+// dropLink takes a name away from inode, whose entry is gone, freeing it
+// and the blocks it maps if it was the last, and taking it off the orphan
+// list. The inode must be in snapshot.
+func (fs *FileSystem) dropLink(snapshot *metadataSnapshot, inode *Inode, blocks *blockMap) error {
+	if inode.links() > 1 {
+		inode.Links--
+		inode.Changed = fs.now().Unix()
+		err := fs.writeInodeTable()
+		if err != nil {
+			return fmt.Errorf("error writing inode table: %w", err)
+		}
+		return nil
+	}
+
+	bytes := -int64(inode.Size)
+	if inode.Type == InodeTypeDirectory {
+		bytes = 0
+	}
+	err := fs.chargeQuota(snapshot, inode, bytes, -1)
+	if err != nil {
+		return err
+	}
+	for _, blockIndex := range blocks.owned() {
+		fs.releaseBlock(blockIndex)
+	}
+	fs.freeInode(int(inode.Index))
+	fs.inodes.put(int(inode.Index), nil)
+
+	// the inode is marked free before its slot is cleared, and its blocks
+	// after that, so a crash midway never leaves an allocated inode that
+	// can't be read, or that maps free blocks
+	err = fs.persistInodeBitmap()
+	if err != nil {
+		return fmt.Errorf("error writing inode bitmap: %w", err)
+	}
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return fmt.Errorf("error writing data bitmap: %w", err)
+	}
+	return fs.removeOrphan(int(inode.Index))
+}
+
+// removeFromDir removes the entry with the given name from a directory,
+// shrinking it if it needs fewer blocks.
+func (fs *FileSystem) removeFromDir(dirInodeIndex int, name string) error {
+	records, err := fs.readDirRecords(dirInodeIndex)
+	if err != nil {
+		return err
+	}
+
+	updated := []dirRecord{}
+	found := false
+	for _, record := range records {
+		if record.name == name && !found {
+			found = true
+			continue
+		}
+		updated = append(updated, record)
+	}
+	if !found {
+		return fmt.Errorf("error removing %s from directory %d: %w", name, dirInodeIndex, ErrNotExist)
+	}
+
+	err = fs.writeDirRecords(dirInodeIndex, updated)
+	if err != nil {
+		return fmt.Errorf("error updating directory contents: %w", err)
+	}
+	return nil
+}
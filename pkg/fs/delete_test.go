@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteFile(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	freeBlocks := filesystem.freeBlocks.free
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	fooIndex := int(foo.Index)
+
+	require.NoError(t, filesystem.DeleteFile("/foo"))
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, ErrNotExist)
+	entries, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "bar", entries[0].Name)
+	require.False(t, filesystem.inodeBitmap.test(fooIndex))
+	// only /bar and the root directory hold blocks now
+	require.Equal(t, freeBlocks-2, filesystem.freeBlocks.free)
+
+	// the space is reused
+	free, err := filesystem.FindFreeInode()
+	require.NoError(t, err)
+	require.Equal(t, fooIndex, free)
+
+	// the deletion is persisted
+	require.NoError(t, filesystem.Close())
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.CheckInvariants())
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.Equal(t, freeBlocks-2, filesystem.freeBlocks.free)
+
+	require.ErrorIs(t, filesystem.DeleteFile("/foo"), ErrNotExist)
+	require.ErrorContains(t, filesystem.DeleteFile("/"), "error deleting /")
+	require.ErrorContains(t, filesystem.DeleteFile("bar"), "must be absolute")
+}
+
+func TestDeleteOpenFile(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	f, err := filesystem.OpenFile("/foo", O_RDWR, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, filesystem.DeleteFile("/foo"))
+	_, err = io.ReadAll(f)
+	require.ErrorIs(t, err, ErrStale)
+
+	// the index is reused, but the open file still refers to the old one
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(f)
+	require.ErrorIs(t, err, ErrStale)
+	require.NoError(t, f.Close())
+}
+
+func TestDeleteFileWORM(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{WORM: true})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/audit.log", bytes.NewBufferString("login\n"))
+	require.NoError(t, err)
+	require.ErrorIs(t, filesystem.DeleteFile("/audit.log"), ErrWORM)
+	_, err = filesystem.FindInodeByName("/audit.log")
+	require.NoError(t, err)
+}
+
+func TestDeleteFileRollsBack(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	before := filesystem.describeMetadata()
+
+	// fail each write in turn until the deletion goes through
+	for i := 1; ; i++ {
+		dev.failWriteAt = dev.writes + i
+		err = filesystem.DeleteFile("/foo")
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, errInjected)
+		require.Equal(t, before, filesystem.describeMetadata(), "failing write %d", i)
+		require.NoError(t, filesystem.CheckInvariants())
+		inode, err := filesystem.FindInodeByName("/foo")
+		require.NoError(t, err)
+		contents, err := filesystem.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, "foo", contents.String())
+	}
+}
+
+func TestRmdir(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, (DataStartIndex+32)*BlockSize)))
+	require.NoError(t, err)
+	before, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	_, err = filesystem.CreateFile("/dir/file", bytes.NewBufferString("file"))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.Rmdir("/dir"), ErrNotEmpty)
+	require.ErrorIs(t, filesystem.Rmdir("/dir/file"), ErrNotDirectory)
+	require.ErrorIs(t, filesystem.Rmdir("/missing"), ErrNotExist)
+	require.ErrorIs(t, filesystem.Rmdir("/"), ErrPermission)
+
+	require.NoError(t, filesystem.DeleteFile("/dir/file"))
+	require.NoError(t, filesystem.Rmdir("/dir"))
+	_, err = filesystem.Stat("/dir")
+	require.ErrorIs(t, err, ErrNotExist)
+	after, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before.FreeBlocks, after.FreeBlocks)
+	require.Equal(t, before.FreeInodes, after.FreeInodes)
+	require.NoError(t, filesystem.CheckInvariants())
+}
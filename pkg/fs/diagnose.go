@@ -0,0 +1,393 @@
+package fs
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Severity ranks how urgently a Finding needs attention.
+type Severity int
+
+const (
+	// SeverityInfo findings are informational only.
+	SeverityInfo Severity = iota
+	// SeverityWarning findings waste space or time but don't lose data.
+	SeverityWarning
+	// SeverityError findings mean data is lost or about to be.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Finding is a single result reported by Diagnose.
+type Finding struct {
+	Severity Severity
+	// Check names the check that produced the finding.
+	Check string
+	// Message describes what was found.
+	Message string
+	// Remedy suggests how to fix the problem. It is empty when there is
+	// nothing to fix.
+	Remedy string
+}
+
+// DiagnoseOptions configures DiagnoseWithOptions.
+type DiagnoseOptions struct {
+	// Workers is the number of goroutines reading and checking the image.
+	// Zero means runtime.GOMAXPROCS(0). With more than one worker, dev must
+	// allow concurrent calls to ReadBlock.
+	Workers int
+	// Progress receives an update, with Op "fsck", for every inode read.
+	// It is called from one goroutine at a time.
+	Progress ProgressFunc
+}
+
+// Diagnose runs every health check against the filesystem on dev and returns
+// the findings, most severe first. It never writes to the device.
+//
+// The checks run in order: superblock validation, geometry, the journal,
+// reading the metadata, clean shutdown, the free counts of the superblock,
+// inode validation, directory structure, free-space accounting, quota usage
+// and fragmentation analysis. If the superblock is invalid, the geometry is
+// wrong, or the journal or the metadata can't be read, the remaining checks
+// are skipped. A transaction committed to the journal is checked as if it
+// was replayed.
+func Diagnose(dev BlockDevice) []Finding {
+	return DiagnoseWithOptions(dev, DiagnoseOptions{})
+}
+
+// DiagnoseWithOptions is Diagnose with options.
+func DiagnoseWithOptions(dev BlockDevice, opts DiagnoseOptions) []Finding {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	fs, err := readSuperblockOnly(dev)
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "superblock",
+			Message:  err.Error(),
+			Remedy:   "make sure the image is a filesystem image; if it is, restore it from a backup",
+		}}
+	}
+
+	err = fs.checkGeometry()
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "geometry",
+			Message:  err.Error(),
+			Remedy:   "if the image was truncated, restore it from a backup; otherwise check it with a version that supports its geometry",
+		}}
+	}
+
+	replayed, err := fs.loadJournal()
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "journal",
+			Message:  err.Error(),
+			Remedy:   "the journal can't be replayed; restore the image from a backup",
+		}}
+	}
+
+	// the checksums are checked below, rather than failing the reads
+	err = fs.readChecksums(false)
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "checksums",
+			Message:  err.Error(),
+			Remedy:   "the checksum table is unreadable; restore the image from a backup",
+		}}
+	}
+
+	err = fs.readBitmaps()
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "mount",
+			Message:  err.Error(),
+			Remedy:   "the bitmaps are unreadable; restore the image from a backup",
+		}}
+	}
+
+	err = fs.readDedup()
+	if err != nil {
+		return []Finding{{
+			Severity: SeverityError,
+			Check:    "dedup",
+			Message:  err.Error(),
+			Remedy:   "the dedup table is unreadable; restore the image from a backup",
+		}}
+	}
+
+	findings := []Finding{}
+	switch {
+	case fs.dirty && fs.journal != nil:
+		findings = append(findings, Finding{
+			Severity: SeverityInfo,
+			Check:    "state",
+			Message:  "the filesystem was not closed cleanly; its journal keeps the metadata consistent",
+		})
+	case fs.dirty:
+		findings = append(findings, Finding{
+			Severity: SeverityWarning,
+			Check:    "state",
+			Message:  "the filesystem was not closed cleanly",
+			Remedy:   "if no other problems are found, mount it with RecoveryForce and close it",
+		})
+	}
+	findings = append(findings, fs.checkCounterFindings()...)
+	if replayed > 0 {
+		findings = append(findings, Finding{
+			Severity: SeverityInfo,
+			Check:    "journal",
+			Message:  fmt.Sprintf("the journal holds a committed transaction of %d blocks, which mounting replays", replayed),
+		})
+	}
+	scan, err := fs.scanInodeTable(workers, opts.Progress)
+	if err != nil {
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Check:    "inodes",
+			Message:  err.Error(),
+			Remedy:   "the inode table is unreadable; restore the image from a backup",
+		})
+	} else {
+		findings = append(findings, fs.checkInodes(scan)...)
+		findings = append(findings, fs.checkDirectories(scan, workers)...)
+		findings = append(findings, fs.checkSpaceAccounting(scan)...)
+		findings = append(findings, fs.checkQuotas(scan)...)
+		findings = append(findings, fs.checkFragmentation(scan)...)
+	}
+	findings = append(findings, fs.checkChecksums(scan)...)
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	return findings
+}
+
+// checkInodes reports malformed inodes and a missing root directory. Block
+// ownership is left to checkSpaceAccounting.
+func (fs *FileSystem) checkInodes(scan *inodeScan) []Finding {
+	findings := []Finding{}
+
+	rootMissing := func() {
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Check:    "inodes",
+			Message:  "the root directory is missing",
+			Remedy:   "copy the files off the image and recreate it",
+		})
+	}
+	if !fs.inodeBitmap.test(0) {
+		rootMissing()
+	}
+
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		if i == 0 && inode.Type != InodeTypeDirectory {
+			rootMissing()
+		}
+		if err := scan.invalid[i]; err != nil {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "inodes",
+				Message:  err.Error(),
+				Remedy:   "the file's contents can't be trusted; restore it from a backup",
+			})
+		}
+	}
+
+	return findings
+}
+
+// checkSpaceAccounting compares the bitmaps against the blocks actually
+// referenced by inodes.
+func (fs *FileSystem) checkSpaceAccounting(scan *inodeScan) []Finding {
+	findings := []Finding{}
+
+	// map each data block to the inodes that reference it
+	owners := map[uint32][]uint32{}
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		for _, blockIndex := range scan.ownedBlocks(i) {
+			owners[blockIndex] = append(owners[blockIndex], inode.Index)
+		}
+	}
+
+	blockIndices := make([]uint32, 0, len(owners))
+	for blockIndex := range owners {
+		blockIndices = append(blockIndices, blockIndex)
+	}
+	sort.Slice(blockIndices, func(i, j int) bool { return blockIndices[i] < blockIndices[j] })
+
+	for _, blockIndex := range blockIndices {
+		inodeIndices := owners[blockIndex]
+		if !fs.isDataBlock(blockIndex) {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "free-space",
+				Message:  fmt.Sprintf("block %d used by inodes %v is outside the data region", blockIndex, inodeIndices),
+				Remedy:   "copy the files off the image and recreate it",
+			})
+			continue
+		}
+		if len(inodeIndices) > 1 && fs.dedup == nil {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "free-space",
+				Message:  fmt.Sprintf("block %d is shared by inodes %v", blockIndex, inodeIndices),
+				Remedy:   "copy the files off the image and recreate it; at most one of them has intact contents",
+			})
+		}
+		if !fs.dataBitmap.test(int(blockIndex - fs.geometry.DataStart)) {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "free-space",
+				Message:  fmt.Sprintf("block %d is used by inodes %v but marked free", blockIndex, inodeIndices),
+				Remedy:   "stop writing to the image: new files may overwrite this block",
+			})
+		}
+	}
+
+	if fs.dedup != nil {
+		refs := map[uint32]int{}
+		for blockIndex, inodeIndices := range owners {
+			refs[blockIndex] = len(inodeIndices)
+		}
+		for _, mismatch := range fs.dedupMismatches(refs) {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "dedup",
+				Message:  mismatch,
+				Remedy:   "run fsck with repair, which recounts the references; until then, deleting the files may free a block still in use",
+			})
+		}
+		findings = append(findings, Finding{
+			Severity: SeverityInfo,
+			Check:    "dedup",
+			Message:  fmt.Sprintf("the dedup table saves %d data blocks", fs.dedup.saved),
+		})
+	}
+
+	// data block 0 is reserved
+	leaked := []int{}
+	usedBlocks := 1
+	for i := 1; i < fs.dataBitmap.len(); i++ {
+		if !fs.dataBitmap.test(i) {
+			continue
+		}
+		usedBlocks++
+		if blockIndex := uint32(i) + fs.geometry.DataStart; owners[blockIndex] == nil {
+			leaked = append(leaked, int(blockIndex))
+		}
+	}
+	if len(leaked) > 0 {
+		findings = append(findings, Finding{
+			Severity: SeverityWarning,
+			Check:    "free-space",
+			Message:  fmt.Sprintf("blocks %v are marked used but belong to no inode", leaked),
+			Remedy:   "the space is lost until the blocks are marked free again",
+		})
+	}
+
+	usedInodes := fs.inodeBitmap.len() - fs.inodeBitmap.entries.CountFree()
+	findings = append(findings, Finding{
+		Severity: SeverityInfo,
+		Check:    "free-space",
+		Message: fmt.Sprintf("%d of %d inodes and %d of %d data blocks in use",
+			usedInodes, fs.inodeBitmap.len(), usedBlocks, fs.dataBitmap.len()),
+	})
+
+	return findings
+}
+
+// checkFragmentation reports files whose blocks aren't contiguous.
+func (fs *FileSystem) checkFragmentation(scan *inodeScan) []Finding {
+	findings := []Finding{}
+
+	multiBlock := 0
+	fragmented := 0
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		blocks := scan.dataBlocks(i)
+		if len(blocks) < 2 {
+			continue
+		}
+		multiBlock++
+		extents := countExtents(blocks)
+		if extents > 1 {
+			fragmented++
+			findings = append(findings, Finding{
+				Severity: SeverityInfo,
+				Check:    "fragmentation",
+				Message:  fmt.Sprintf("inode %d (%s) is split into %d extents", inode.Index, inode.Filename, extents),
+			})
+		}
+	}
+
+	findings = append(findings, Finding{
+		Severity: SeverityInfo,
+		Check:    "fragmentation",
+		Message:  fmt.Sprintf("%d of %d multi-block inodes are fragmented", fragmented, multiBlock),
+	})
+
+	return findings
+}
+
+// usedBlocks returns the blocks occupied by the inode, in file order, as far
+// as the inode holds them itself.
+func (inode *Inode) usedBlocks() []uint32 {
+	if inode.extentMapped {
+		blocks := []uint32{}
+		for _, e := range inode.inlineExtents() {
+			for i := 0; i < e.length; i++ {
+				blocks = append(blocks, uint32(e.start+i))
+			}
+		}
+		return blocks
+	}
+	for i, blockIndex := range inode.Blocks {
+		if blockIndex == 0 {
+			return inode.Blocks[:i]
+		}
+	}
+	return inode.Blocks[:]
+}
+
+// countExtents returns the number of runs of consecutive block numbers.
+func countExtents(blocks []uint32) int {
+	if len(blocks) == 0 {
+		return 0
+	}
+	extents := 1
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i] != blocks[i-1]+1 {
+			extents++
+		}
+	}
+	return extents
+}
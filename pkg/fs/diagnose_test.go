@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// findingsBySeverity returns the findings with the given severity.
+func findingsBySeverity(findings []Finding, severity Severity) []Finding {
+	filtered := []Finding{}
+	for _, f := range findings {
+		if f.Severity == severity {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+func TestDiagnoseHealthy(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+
+	// until it is closed, the filesystem is dirty
+	warnings := findingsBySeverity(Diagnose(dev), SeverityWarning)
+	require.Len(t, warnings, 1)
+	require.Equal(t, "state", warnings[0].Check)
+
+	require.NoError(t, filesystem.Close())
+	findings := Diagnose(dev)
+	require.Empty(t, findingsBySeverity(findings, SeverityError))
+	require.Empty(t, findingsBySeverity(findings, SeverityWarning))
+	require.NotEmpty(t, findings)
+}
+
+func TestDiagnoseInvalidSuperblock(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+
+	findings := Diagnose(dev)
+	require.Len(t, findings, 1)
+	require.Equal(t, SeverityError, findings[0].Severity)
+	require.Equal(t, "superblock", findings[0].Check)
+}
+
+func TestDiagnoseSpaceAccounting(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+
+	// mark the file's block as free, and leak another one
+	filesystem.dataBitmap.set(int(inode.Blocks[0]-DataStartIndex), false)
+	filesystem.dataBitmap.set(20, true)
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.Close())
+
+	findings := Diagnose(dev)
+	errors := findingsBySeverity(findings, SeverityError)
+	require.Len(t, errors, 1)
+	require.Contains(t, errors[0].Message, "marked free")
+	warnings := findingsBySeverity(findings, SeverityWarning)
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0].Message, "belong to no inode")
+	// errors come first
+	require.Equal(t, SeverityError, findings[0].Severity)
+}
+
+func TestDiagnoseFragmentation(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 2*BlockSize)))
+	require.NoError(t, err)
+
+	// move the second block of the file away from the first one
+	first := inode.Blocks[0]
+	filesystem.dataBitmap.set(int(first+1-DataStartIndex), false)
+	filesystem.dataBitmap.set(30, true)
+	inode.setInlineExtents([]extent{{start: int(first), length: 1}, {start: 30 + DataStartIndex, length: 1}})
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.Close())
+
+	findings := Diagnose(dev)
+	require.Empty(t, findingsBySeverity(findings, SeverityError))
+	require.Empty(t, findingsBySeverity(findings, SeverityWarning))
+
+	fragmented := []Finding{}
+	for _, f := range findings {
+		if f.Check == "fragmentation" {
+			fragmented = append(fragmented, f)
+		}
+	}
+	require.Len(t, fragmented, 2)
+	require.Contains(t, fragmented[0].Message, "split into 2 extents")
+	require.Contains(t, fragmented[1].Message, "1 of 1 multi-block inodes")
+}
+
+func TestDiagnoseInodes(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+
+	// the image no longer mounts, but can still be diagnosed
+	inode.Size = 2 * BlockSize
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.Close())
+	_, err = LoadFilesystem(dev)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	errors := findingsBySeverity(Diagnose(dev), SeverityError)
+	require.Len(t, errors, 1)
+	require.Equal(t, "inodes", errors[0].Check)
+	require.Contains(t, errors[0].Message, "needs 2 blocks")
+}
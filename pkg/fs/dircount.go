@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// Directories of entryCountVersion or later record how many entries they
+// hold, kept after the gob encoding like contentSum, so a directory can be
+// sized up without reading its contents. The count changes along with the
+// entries in writeDirRecords. Directories of earlier versions have none.
+//
+// The type of the inode an entry points at is recorded in the entry itself,
+// see dirent.go, so ListDir lists a directory of binary entries without
+// reading any other inode.
+
+// entryCountVersion is the first format version with entry counts.
+const entryCountVersion = 12
+
+// Entries returns the number of entries of a directory, and false if the
+// directory doesn't record it.
+func (inode *Inode) Entries() (int, bool) {
+	return int(inode.entries), inode.entriesCounted
+}
+
+// countsEntries reports whether the entries of dir are counted when they
+// are written: on filesystems with entry counts, and in directories that
+// have one already.
+func (fs *FileSystem) countsEntries(dir *Inode) bool {
+	return fs.version >= entryCountVersion || dir.entriesCounted
+}
+
+// ListDir is ReadDirByPath without the sizes of the entries, which are left
+// zero. The types of the entries are those recorded in the directory, so for
+// directories of binary entries no other inode is read, however many
+// entries there are; directories of text entries don't record them, and
+// their inodes are read as with ReadDir.
+func (fs *FileSystem) ListDir(dirname string) ([]DirEntry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findDir(dirname)
+	if err == nil {
+		err = fs.checkAccess(dir, accessRead)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", dirname, err)
+	}
+	return fs.listDir(dir)
+}
+
+// listDir lists a directory as ListDir does.
+func (fs *FileSystem) listDir(dir *Inode) ([]DirEntry, error) {
+	if !dir.BinaryDir {
+		entries, err := fs.readDir(int(dir.Index))
+		for i := range entries {
+			entries[i].Size = 0
+		}
+		return entries, err
+	}
+	records, err := fs.readDirRecords(int(dir.Index))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DirEntry, 0, len(records))
+	for _, record := range records {
+		// the bitmap is in memory, so this reads nothing
+		if record.inode >= fs.inodeBitmap.len() || !fs.inodeBitmap.test(record.inode) {
+			return nil, fmt.Errorf("directory entry %s points at unallocated inode %d", record.name, record.inode)
+		}
+		entries = append(entries, DirEntry{Name: record.name, Inode: uint32(record.inode), Type: record.typ})
+	}
+	fs.sortDirEntries(entries)
+	return entries, nil
+}
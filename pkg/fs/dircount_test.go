@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryCount(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	entries := func(fs *FileSystem, name string) int {
+		inode, err := fs.findInodeOrRoot(name)
+		require.NoError(t, err)
+		n, ok := inode.Entries()
+		require.True(t, ok, "%s has no entry count", name)
+		return n
+	}
+	require.Equal(t, 0, entries(filesystem, "/"))
+
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.Equal(t, 0, entries(filesystem, "/dir"))
+	for i := 0; i < 3; i++ {
+		_, err = filesystem.CreateFile(fmt.Sprintf("/dir/f%d", i), bytes.NewBufferString("x"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.DeleteFile("/dir/f0"))
+	require.NoError(t, filesystem.Rename("/dir/f1", "/f1"))
+	require.Equal(t, 2, entries(filesystem, "/"))
+	require.Equal(t, 1, entries(filesystem, "/dir"))
+	require.NoError(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, 2, entries(reloaded, "/"))
+	require.Equal(t, 1, entries(reloaded, "/dir"))
+
+	// files have none, and directories of older versions neither
+	file, err := reloaded.FindInodeByName("/f1")
+	require.NoError(t, err)
+	_, ok := file.Entries()
+	require.False(t, ok)
+	reloaded.version = entryCountVersion - 1
+	require.NoError(t, reloaded.Mkdir("/old"))
+	_, err = reloaded.CreateFile("/old/file", bytes.NewBufferString("x"))
+	require.NoError(t, err)
+	old, err := reloaded.FindInodeByName("/old")
+	require.NoError(t, err)
+	_, ok = old.Entries()
+	require.False(t, ok)
+	require.Equal(t, 3, entries(reloaded, "/"))
+}
+
+func TestListDir(t *testing.T) {
+	const n = 200
+	filesystem, dev := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", n)
+	require.NoError(t, filesystem.Mkdir("/big/dir"))
+	dir, err := filesystem.FindInodeByName("/big")
+	require.NoError(t, err)
+	blocks := dir.StoredBlocks()
+
+	// the entries are listed from the directory's blocks alone, while
+	// ReadDir reads the inode of every entry that isn't loaded
+	dev.reads = 0
+	entries, err := filesystem.ListDir("/big")
+	require.NoError(t, err)
+	require.LessOrEqual(t, dev.reads, blocks)
+	require.Len(t, entries, n+1)
+	require.Equal(t, DirEntry{Name: "file number 0000", Inode: entries[0].Inode, Type: InodeTypeFile}, entries[0])
+	require.Equal(t, InodeTypeDirectory, entries[n].Type)
+	require.Zero(t, entries[n].Size)
+	dev.reads = 0
+	full, err := filesystem.ReadDirByPath("/big")
+	require.NoError(t, err)
+	require.Greater(t, dev.reads, blocks+n/16)
+	for i := range full {
+		full[i].Size = 0
+	}
+	require.Equal(t, full, entries)
+
+	_, err = filesystem.ListDir("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+	_, err = filesystem.ListDir("/big/file number 0000")
+	require.ErrorIs(t, err, ErrNotDirectory)
+}
+
+func TestFsckRecountsEntries(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	root, err := filesystem.allocatedInode(0)
+	require.NoError(t, err)
+	root.entries = 7
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.Error(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Contains(t, report.Repairs, "directory 0: recounted its entries as 1, not 7")
+	require.Empty(t, report.Remaining)
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, reloaded.CheckInvariants())
+}
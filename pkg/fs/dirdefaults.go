@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DirDefaults are attributes a directory hands down to the files and
+// directories created in it. New directories inherit the defaults
+// themselves, so they apply to whole subtrees. The zero value hands down
+// nothing.
+type DirDefaults struct {
+	// ModeMask holds permission bits cleared from the mode of new files,
+	// like a umask.
+	ModeMask uint32
+	// Project is the project id of new files, to group files for
+	// accounting. Zero means no project.
+	Project uint32
+}
+
+// DirDefaults returns the defaults of the directory with the given absolute
+// name.
+func (fs *FileSystem) DirDefaults(dirname string) (DirDefaults, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findDir(dirname)
+	if err != nil {
+		return DirDefaults{}, err
+	}
+	return dir.Defaults, nil
+}
+
+// SetDirDefaults sets the defaults of the directory with the given absolute
+// name. Files already in the directory keep their attributes.
+func (fs *FileSystem) SetDirDefaults(dirname string, defaults DirDefaults) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("SetDirDefaults %s", dirname)
+	defer fs.checkInvariantsAfter("SetDirDefaults")()
+
+	if defaults.ModeMask&^0777 != 0 {
+		return fmt.Errorf("mode mask %o has bits other than permissions", defaults.ModeMask)
+	}
+	dir, err := fs.findDir(dirname)
+	if err != nil {
+		return err
+	}
+
+	snapshot := fs.snapshot(int(dir.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	dir.Defaults = defaults
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	return nil
+}
+
+// findDir looks up a directory by its absolute name; "/" is the root.
+func (fs *FileSystem) findDir(dirname string) (*Inode, error) {
+	if !strings.HasPrefix(dirname, "/") {
+		return nil, fmt.Errorf("filename must be absolute")
+	}
+	dir, err := fs.traversePath(strings.TrimSuffix(dirname, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if dir.Type != InodeTypeDirectory {
+		return nil, fmt.Errorf("%s: %w", dirname, ErrNotDirectory)
+	}
+	return dir, nil
+}
+
+// inherit applies the defaults of dir to an inode being created in it, and
+// charges it to the quota directory of dir, see quota.go.
+func (inode *Inode) inherit(dir *Inode) {
+	inode.Mode &^= dir.Defaults.ModeMask
+	inode.Project = dir.Defaults.Project
+	if inode.Type == InodeTypeDirectory {
+		inode.Defaults = dir.Defaults
+	}
+	inode.quotaDir, inode.inQuota = quotaOwner(dir)
+}
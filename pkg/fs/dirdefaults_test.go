@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirDefaults(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	defaults, err := filesystem.DirDefaults("/")
+	require.NoError(t, err)
+	require.Zero(t, defaults)
+
+	before, err := filesystem.CreateFile("/before", bytes.NewBufferString("before"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.SetDirDefaults("/", DirDefaults{ModeMask: 0027, Project: 7}))
+
+	inode, err := filesystem.CreateFile("/after", bytes.NewBufferString("after"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(0640), inode.Mode)
+	require.Equal(t, uint32(7), inode.Project)
+	f, err := filesystem.OpenFile("/opened", O_CREATE|O_WRONLY, 0777)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	inode, err = filesystem.FindInodeByName("/opened")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0750), inode.Mode)
+
+	// existing files keep their attributes
+	require.Equal(t, uint32(DefaultFileMode), before.Mode)
+	require.Zero(t, before.Project)
+
+	// the defaults are persisted
+	require.NoError(t, filesystem.Close())
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	defaults, err = filesystem.DirDefaults("/")
+	require.NoError(t, err)
+	require.Equal(t, DirDefaults{ModeMask: 0027, Project: 7}, defaults)
+	inode, err = filesystem.FindInodeByName("/after")
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), inode.Project)
+
+	require.ErrorContains(t, filesystem.SetDirDefaults("/", DirDefaults{ModeMask: 01000}), "bits other than permissions")
+	require.ErrorIs(t, filesystem.SetDirDefaults("/after", DirDefaults{}), ErrNotDirectory)
+	_, err = filesystem.DirDefaults("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+}
+
+func TestDirDefaultsInheritedBySubdirectories(t *testing.T) {
+	dir := &Inode{Type: InodeTypeDirectory, Defaults: DirDefaults{ModeMask: 0022, Project: 3}}
+	sub := &Inode{Type: InodeTypeDirectory, Mode: 0777}
+	sub.inherit(dir)
+	require.Equal(t, uint32(0755), sub.Mode)
+	require.Equal(t, uint32(3), sub.Project)
+	require.Equal(t, dir.Defaults, sub.Defaults)
+
+	file := &Inode{Type: InodeTypeFile, Mode: 0666}
+	file.inherit(dir)
+	require.Equal(t, uint32(0644), file.Mode)
+	require.Zero(t, file.Defaults)
+}
+
+func TestSetDirDefaultsRollsBack(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	dev.failWriteAt = dev.writes + 2
+	err = filesystem.SetDirDefaults("/", DirDefaults{Project: 1})
+	require.ErrorIs(t, err, errInjected)
+	defaults, err := filesystem.DirDefaults("/")
+	require.NoError(t, err)
+	require.Zero(t, defaults)
+}
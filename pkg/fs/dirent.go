@@ -0,0 +1,335 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// A directory's contents are a sequence of entries, each laid out as
+// (little endian):
+//
+//	offset 0: inode       (uint32)
+//	offset 4: name length (uint8)
+//	offset 5: type        (uint8, the InodeType of the inode)
+//	offset 6: name
+//
+// Directories written before format version 4 hold one "<inode> <name>"
+// line per entry instead, which can't store names with spaces or line
+// breaks. They are read as such until they are next changed, when they are
+// rewritten in the binary format; Inode.BinaryDir says which one a
+// directory uses.
+//
+// Path lookups read the contents into pooled buffers and scan them in
+// place, so that resolving a path whose inodes are cached doesn't allocate.
+// Directories of more than a block of entries are indexed, see dirindex.go.
+
+// MaxNameLength is the length limit of a name in a directory, in bytes. It
+// is what fits in the Filename of an inode. Names are stored as given, so
+// any bytes make a name, spaces, line breaks and UTF-8 included, except
+// for '/', which separates the components of paths, and NUL; "." and ".."
+// aren't names either, as hosts give them a meaning of their own.
+const MaxNameLength = 128
+
+const (
+	direntHeaderSize = 6
+
+	// dirVersion is the first format version with binary directory
+	// entries; older filesystems are upgraded to it when a directory is
+	// first written.
+	dirVersion = 4
+)
+
+// contentsPool holds buffers for reading directory contents.
+var contentsPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, BlockSize)
+		return &buf
+	},
+}
+
+// dirRecord is an entry as stored in the contents of a directory.
+type dirRecord struct {
+	name  string
+	inode int
+	// typ is the type of the inode, as recorded in binary entries; text
+	// entries don't record it
+	typ InodeType
+}
+
+// parseDir decodes the contents of the directory dir, without checking the
+// inodes the entries point at.
+func parseDir(dir *Inode, contents *bytes.Buffer) ([]dirRecord, error) {
+	records := []dirRecord{}
+	r := newDirReader(dir, contents.Bytes())
+	for r.next() {
+		records = append(records, dirRecord{name: string(r.name), inode: r.inode, typ: r.typ})
+	}
+	return records, r.err
+}
+
+// encodeDir encodes directory entries in the binary format. It fails if a
+// name is longer than MaxNameLength, as text entries may be.
+func encodeDir(records []dirRecord) (*bytes.Buffer, error) {
+	contents := &bytes.Buffer{}
+	header := make([]byte, direntHeaderSize)
+	for _, record := range records {
+		if len(record.name) > MaxNameLength {
+			return nil, fmt.Errorf("name %q is longer than %d bytes", record.name, MaxNameLength)
+		}
+		binary.LittleEndian.PutUint32(header[0:4], uint32(record.inode))
+		header[4] = byte(len(record.name))
+		header[5] = byte(record.typ)
+		contents.Write(header)
+		contents.WriteString(record.name)
+	}
+	return contents, nil
+}
+
+// dirReader iterates over the entries in the contents of a directory
+// without allocating, except to report malformed entries.
+type dirReader struct {
+	contents []byte
+	// binary is set for directories of binary entries
+	binary bool
+	// indexed is set for the entries of indexed directories, which are
+	// packed into blocks, and offset is how far into them the reader is
+	indexed bool
+	offset  int
+	// name, inode and typ describe the current entry; name points into
+	// contents
+	name  []byte
+	inode int
+	typ   InodeType
+	err   error
+}
+
+// newDirReader returns a reader of contents, read from the directory dir.
+func newDirReader(dir *Inode, contents []byte) dirReader {
+	r := dirReader{contents: contents, binary: dir.BinaryDir}
+	if dir.dirIndexed {
+		start, err := dirEntriesStart(contents, len(contents))
+		if err != nil {
+			r.err = err
+			return r
+		}
+		r.contents, r.indexed = contents[start:], true
+	}
+	return r
+}
+
+// next advances to the next entry. It returns false at the end of the
+// contents, or at a malformed entry, in which case err is set.
+func (r *dirReader) next() bool {
+	if r.indexed && r.err == nil {
+		r.skipPadding()
+	}
+	if r.err != nil || len(r.contents) == 0 {
+		return false
+	}
+	if r.binary {
+		return r.nextBinary()
+	}
+	return r.nextLine()
+}
+
+func (r *dirReader) nextBinary() bool {
+	if len(r.contents) < direntHeaderSize {
+		r.err = fmt.Errorf("truncated entry in directory: %d bytes left", len(r.contents))
+		return false
+	}
+	n := int(r.contents[4])
+	if n == 0 {
+		r.err = fmt.Errorf("entry with an empty name in directory")
+		return false
+	}
+	if len(r.contents) < direntHeaderSize+n {
+		r.err = fmt.Errorf("truncated entry in directory: %d bytes left, for a %d-byte name", len(r.contents), n)
+		return false
+	}
+	if r.indexed && r.offset%BlockSize+direntHeaderSize+n > BlockSize {
+		r.err = fmt.Errorf("entry straddles blocks %d and %d of the directory", r.offset/BlockSize, r.offset/BlockSize+1)
+		return false
+	}
+	r.inode = int(binary.LittleEndian.Uint32(r.contents[0:4]))
+	r.typ = InodeType(r.contents[5])
+	r.name = r.contents[direntHeaderSize : direntHeaderSize+n]
+	r.contents = r.contents[direntHeaderSize+n:]
+	r.offset += direntHeaderSize + n
+	return true
+}
+
+// skipPadding skips the zeros at the end of the blocks of an indexed
+// directory: what is left of a block after its last entry, which is too
+// short for an entry or starts with an empty name.
+func (r *dirReader) skipPadding() {
+	for len(r.contents) > 0 {
+		left := BlockSize - r.offset%BlockSize
+		if left >= direntHeaderSize && len(r.contents) >= direntHeaderSize && r.contents[4] != 0 {
+			return
+		}
+		if left > len(r.contents) {
+			left = len(r.contents)
+		}
+		for _, b := range r.contents[:left] {
+			if b != 0 {
+				r.err = fmt.Errorf("malformed entry in block %d of the directory", r.offset/BlockSize)
+				return
+			}
+		}
+		r.contents = r.contents[left:]
+		r.offset += left
+	}
+}
+
+// nextLine reads a text entry.
+func (r *dirReader) nextLine() bool {
+	line := r.contents
+	r.contents = nil
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line, r.contents = line[:i], line[i+1:]
+	}
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 || bytes.IndexByte(line[sep+1:], ' ') >= 0 {
+		r.err = fmt.Errorf("invalid line in directory: %s", line)
+		return false
+	}
+	inode, ok := parseIndex(line[:sep])
+	if !ok {
+		r.err = fmt.Errorf("invalid inode index in directory: %s", line[:sep])
+		return false
+	}
+	r.name, r.inode = line[sep+1:], inode
+	return true
+}
+
+// parseIndex parses a decimal inode index.
+func parseIndex(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 9 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// readContentsInto reads the contents of inode into buf, reallocating it if
+// it is too small, and returns them. Compressed contents are decompressed
+// into a new buffer.
+func (fs *FileSystem) readContentsInto(inode *Inode, buf []byte) ([]byte, error) {
+	buf, err := fs.readStoredInto(inode, buf)
+	if err != nil || !inode.compressed() {
+		return buf, err
+	}
+	return inode.decompress(buf)
+}
+
+// readStoredInto is readContentsInto without decompressing the contents.
+func (fs *FileSystem) readStoredInto(inode *Inode, buf []byte) ([]byte, error) {
+	// devices with queues read the blocks concurrently instead
+	if _, queued := fs.dev.(queuedDevice); inode.extentMapped && inode.Indirect == 0 && !queued {
+		return fs.readInlineExtents(inode, buf)
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return nil, err
+	}
+	if cap(buf) < len(blocks)*BlockSize {
+		buf = make([]byte, len(blocks)*BlockSize)
+	}
+	buf = buf[:len(blocks)*BlockSize]
+	err = fs.transferBlocks(false, inode.Index, blocks, buf)
+	if err != nil {
+		return nil, err
+	}
+	if inode.Type == InodeTypeDirectory {
+		for i, blockIndex := range blocks {
+			err = fs.verifyBlock(uint64(blockIndex), buf[i*BlockSize:(i+1)*BlockSize])
+			if err != nil {
+				return nil, fmt.Errorf("error reading directory %d: %w", inode.Index, err)
+			}
+		}
+	}
+	if inode.storedSize() < len(buf) {
+		buf = buf[:inode.storedSize()]
+	}
+	return buf, nil
+}
+
+// readDirRecords reads the entries of a directory.
+func (fs *FileSystem) readDirRecords(dirInodeIndex int) ([]dirRecord, error) {
+	dir, err := fs.allocatedInode(dirInodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if dir.Type != InodeTypeDirectory {
+		return nil, fmt.Errorf("inode %d: %w", dirInodeIndex, ErrNotDirectory)
+	}
+	contents, err := fs.readContents(dir)
+	if err != nil {
+		return nil, err
+	}
+	return parseDir(dir, contents)
+}
+
+// writeDirRecords replaces the entries of a directory, as setInodeContents
+// does. Directories of text entries are converted to binary ones, upgrading
+// the format version of the filesystem if needed, and directories are
+// indexed or unindexed as they outgrow a block or shrink back into one.
+// Directories with an entry count get the number of records.
+func (fs *FileSystem) writeDirRecords(dirInodeIndex int, records []dirRecord) (err error) {
+	fs.dirWrites++
+	dir, err := fs.allocatedInode(dirInodeIndex)
+	if err != nil {
+		return err
+	}
+	contents, err := encodeDir(records)
+	if err != nil {
+		return err
+	}
+	indexed := fs.version >= dirIndexVersion && contents.Len() > BlockSize
+	if indexed {
+		contents, err = encodeIndexedDir(records)
+		if err != nil {
+			return err
+		}
+	}
+	counted := fs.countsEntries(dir)
+	if !dir.BinaryDir || dir.dirIndexed != indexed || counted {
+		snapshot := fs.snapshot(dirInodeIndex)
+		defer func() {
+			if err != nil {
+				err = fs.rollback(snapshot, err)
+			}
+			fs.release(snapshot)
+		}()
+		if !dir.BinaryDir && fs.version < dirVersion {
+			fs.explainf("superblock: format version %d -> %d, as directory %d gets binary entries", fs.version, dirVersion, dirInodeIndex)
+			err = fs.markDirty()
+			if err != nil {
+				return err
+			}
+			fs.version = dirVersion
+			err = fs.writeState(StateDirty)
+			if err != nil {
+				return fmt.Errorf("error upgrading the format version: %w", err)
+			}
+		}
+		dir.BinaryDir = true
+		dir.dirIndexed = indexed
+		if counted {
+			dir.entries, dir.entriesCounted = uint32(len(records)), true
+		}
+	}
+	return fs.setInodeContents(dirInodeIndex, contents)
+}
@@ -0,0 +1,212 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDir(t *testing.T) {
+	want := []dirRecord{
+		{name: "foo", inode: 1, typ: InodeTypeFile},
+		{name: "two words", inode: 12, typ: InodeTypeDirectory},
+		{name: "line\nbreak", inode: 3, typ: InodeTypeFile},
+	}
+	contents, err := encodeDir(want)
+	require.NoError(t, err)
+	binaryDir := &Inode{BinaryDir: true}
+	records, err := parseDir(binaryDir, contents)
+	require.NoError(t, err)
+	require.Equal(t, want, records)
+
+	records, err = parseDir(binaryDir, &bytes.Buffer{})
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	encoded := contents.Bytes()
+	for contents, want := range map[string]string{
+		string(encoded[:3]):                  "truncated entry in directory: 3 bytes left",
+		string(encoded[:direntHeaderSize+1]): "truncated entry in directory: 7 bytes left, for a 3-byte name",
+		"\x01\x00\x00\x00\x00\x01":           "entry with an empty name in directory",
+	} {
+		_, err := parseDir(binaryDir, bytes.NewBufferString(contents))
+		require.EqualError(t, err, want, contents)
+	}
+
+	_, err = encodeDir([]dirRecord{{name: string(make([]byte, MaxNameLength+1)), inode: 1}})
+	require.ErrorContains(t, err, "is longer than 128 bytes")
+}
+
+func TestParseTextDir(t *testing.T) {
+	textDir := &Inode{}
+	records, err := parseDir(textDir, bytes.NewBufferString("1 foo\n12 bar\r\n3 baz"))
+	require.NoError(t, err)
+	require.Equal(t, []dirRecord{{name: "foo", inode: 1}, {name: "bar", inode: 12}, {name: "baz", inode: 3}}, records)
+
+	records, err = parseDir(textDir, &bytes.Buffer{})
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	for contents, want := range map[string]string{
+		"1 foo\n\n":      "invalid line in directory: ",
+		"1 foo bar\n":    "invalid line in directory: 1 foo bar",
+		"x foo\n":        "invalid inode index in directory: x",
+		"-1 foo\n":       "invalid inode index in directory: -1",
+		"1234567890 a\n": "invalid inode index in directory: 1234567890",
+	} {
+		_, err := parseDir(textDir, bytes.NewBufferString(contents))
+		require.EqualError(t, err, want, contents)
+	}
+}
+
+func TestTraversePath(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, foo, inode)
+	inode, err = filesystem.FindParentInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), inode.Index)
+
+	// paths aren't cleaned
+	for _, name := range []string{"/", "//foo", "/fo"} {
+		_, err = filesystem.FindInodeByName(name)
+		require.ErrorIs(t, err, ErrNotExist, name)
+	}
+	_, err = filesystem.FindInodeByName("foo")
+	require.EqualError(t, err, "filename must be absolute")
+}
+
+func TestTextDirMigration(t *testing.T) {
+	f, err := os.Open("testdata/golden/v3.img.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	disk, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	dev := NewArrayBlockDevice(disk)
+
+	filesystem, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	root, err := filesystem.GetInode(0)
+	require.NoError(t, err)
+	require.False(t, root.BinaryDir)
+	before, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+
+	// text entries can't hold the name, so the root is rewritten in binary
+	_, err = filesystem.CreateFile("/two words", bytes.NewBufferString("hi"))
+	require.NoError(t, err)
+	require.True(t, root.BinaryDir)
+	require.NoError(t, filesystem.Close())
+
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(dirVersion), sb.Version)
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	after, err := reloaded.ReadDir(0)
+	require.NoError(t, err)
+	require.Len(t, after, len(before)+1)
+	require.Equal(t, before, after[:len(before)])
+	require.Equal(t, "two words", after[len(before)].Name)
+	for _, f := range Diagnose(dev) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
+
+// nameRunes are what generated names are made of: ASCII, whitespace,
+// accented letters, CJK, emoji, and bytes that aren't valid UTF-8.
+var nameRunes = []string{"a", "Z", "0", ".", "-", " ", "\t", "\n", "\\", "é", "ü", "ß", "日", "本", "語", "😀", "\xff", "\xfe"}
+
+// testName is a valid name, generated by quick.Check.
+type testName string
+
+func (testName) Generate(rand *rand.Rand, size int) reflect.Value {
+	name := ""
+	for n := 1 + rand.Intn(MaxNameLength); ; {
+		r := nameRunes[rand.Intn(len(nameRunes))]
+		if len(name)+len(r) > n {
+			break
+		}
+		name += r
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "x" + name
+	}
+	return reflect.ValueOf(testName(name))
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	// entries hold any valid name
+	encode := func(names []testName) bool {
+		records := []dirRecord{}
+		for i, name := range names {
+			records = append(records, dirRecord{name: string(name), inode: i + 1, typ: InodeTypeFile})
+		}
+		contents, err := encodeDir(records)
+		if err != nil {
+			return false
+		}
+		parsed, err := parseDir(&Inode{BinaryDir: true}, contents)
+		return err == nil && reflect.DeepEqual(records, parsed)
+	}
+	require.NoError(t, quick.Check(encode, nil))
+
+	// and so do directories, also once the filesystem is reloaded, and
+	// after renames
+	roundTrip := func(name, renamed testName) bool {
+		if name == renamed {
+			// the file would replace its directory
+			return true
+		}
+		disk := make([]byte, 200*BlockSize)
+		filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 200})
+		require.NoError(t, err)
+		require.NoError(t, filesystem.Mkdir("/"+string(name)))
+		path := "/" + string(name) + "/" + string(name)
+		_, err = filesystem.CreateFile(path, bytes.NewBufferString("hello"))
+		require.NoError(t, err, "%q", name)
+		require.NoError(t, filesystem.Rename(path, "/"+string(renamed)))
+		require.NoError(t, filesystem.Close())
+
+		reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+		require.NoError(t, err)
+		entries, err := reloaded.ReadDirByPath("/")
+		require.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		want := []string{string(name), string(renamed)}
+		data, err := reloaded.ReadFile("/" + string(renamed))
+		return err == nil && string(data) == "hello" && reflect.DeepEqual(want, names)
+	}
+	require.NoError(t, quick.Check(roundTrip, &quick.Config{MaxCount: 50}))
+}
+
+func TestInvalidNames(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	for _, name := range []string{"", ".", "..", "nul\x00", string(make([]byte, MaxNameLength+1))} {
+		_, err := filesystem.CreateFile("/"+name, &bytes.Buffer{})
+		require.ErrorIs(t, err, ErrInvalidName, "%q", name)
+	}
+	long := string(bytes.Repeat([]byte("é"), MaxNameLength/2))
+	require.True(t, utf8.ValidString(long))
+	_, err := filesystem.CreateFile("/"+long, bytes.NewBufferString("hi"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/"+long+"x", &bytes.Buffer{})
+	require.ErrorIs(t, err, ErrInvalidName)
+}
@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Directories whose entries take more than a block are indexed, so that
+// looking up a name reads a few of their blocks rather than all of them.
+// The contents of an indexed directory are the index, padded to whole
+// blocks, followed by the entries in the binary format, in the order they
+// were added. No entry straddles two blocks: the end of a block too short
+// for the next entry is left zero. The index is (little endian):
+//
+//	offset 0: number of entries      (uint32)
+//	offset 4: number of index blocks (uint32)
+//	offset 8: a record per entry, sorted by hash and then by block:
+//	          hash of the name       (uint32, FNV-1a)
+//	          block of the entry     (uint32, counting from the first block
+//	                                  after the index)
+//
+// A lookup binary searches the records for the hash of the name, reading
+// only the index blocks it lands on, and then scans the blocks of entries
+// the matching records point at. The first block of the index is kept for
+// the whole search, as every search starts and often ends there.
+// Inode.dirIndexed marks indexed directories; it is kept after the gob
+// encoding like extentMapped.
+
+const (
+	// dirIndexVersion is the first format version with indexed
+	// directories. Directories of older filesystems stay unindexed.
+	dirIndexVersion = 7
+
+	dirIndexHeaderSize = 8
+	dirIndexRecordSize = 8
+)
+
+// nameHash returns the FNV-1a hash of a name, without allocating.
+func nameHash(name string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// dirIndexBlocks returns the number of blocks the index of n entries takes.
+func dirIndexBlocks(n uint32) uint32 {
+	return blocksFor(dirIndexHeaderSize + dirIndexRecordSize*uint64(n))
+}
+
+// encodeIndexedDir encodes directory entries as an indexed directory.
+func encodeIndexedDir(records []dirRecord) (*bytes.Buffer, error) {
+	type indexRecord struct {
+		hash, block uint32
+	}
+	index := make([]indexRecord, 0, len(records))
+	entries := &bytes.Buffer{}
+	header := make([]byte, direntHeaderSize)
+	for _, record := range records {
+		if len(record.name) > MaxNameLength {
+			return nil, fmt.Errorf("name %q is longer than %d bytes", record.name, MaxNameLength)
+		}
+		if used := entries.Len() % BlockSize; used+direntHeaderSize+len(record.name) > BlockSize {
+			entries.Write(make([]byte, BlockSize-used))
+		}
+		index = append(index, indexRecord{hash: nameHash(record.name), block: uint32(entries.Len() / BlockSize)})
+		binary.LittleEndian.PutUint32(header[0:4], uint32(record.inode))
+		header[4] = byte(len(record.name))
+		header[5] = byte(record.typ)
+		entries.Write(header)
+		entries.WriteString(record.name)
+	}
+	sort.Slice(index, func(i, j int) bool {
+		if index[i].hash != index[j].hash {
+			return index[i].hash < index[j].hash
+		}
+		return index[i].block < index[j].block
+	})
+
+	indexBlocks := dirIndexBlocks(uint32(len(index)))
+	contents := bytes.NewBuffer(make([]byte, 0, int(indexBlocks)*BlockSize+entries.Len()))
+	binary.Write(contents, binary.LittleEndian, [2]uint32{uint32(len(index)), indexBlocks})
+	for _, record := range index {
+		binary.Write(contents, binary.LittleEndian, [2]uint32{record.hash, record.block})
+	}
+	contents.Write(make([]byte, int(indexBlocks)*BlockSize-contents.Len()))
+	contents.Write(entries.Bytes())
+	return contents, nil
+}
+
+// dirEntriesStart checks the header of the index of an indexed directory
+// of size bytes, read from the start of its contents, and returns the offset
+// of its first block of entries.
+func dirEntriesStart(header []byte, size int) (int, error) {
+	if len(header) < dirIndexHeaderSize {
+		return 0, fmt.Errorf("indexed directory of %d bytes has no index", size)
+	}
+	n := binary.LittleEndian.Uint32(header[0:4])
+	indexBlocks := binary.LittleEndian.Uint32(header[4:8])
+	if indexBlocks != dirIndexBlocks(n) || uint64(indexBlocks)*BlockSize > uint64(size) {
+		return 0, fmt.Errorf("directory index of %d entries in %d blocks, in %d bytes of contents", n, indexBlocks, size)
+	}
+	return int(indexBlocks) * BlockSize, nil
+}
+
+// readDirBlock reads block i of a directory into buf, which also serves
+// to read the pointer or extent blocks on the way.
+func (fs *FileSystem) readDirBlock(dir *Inode, i int, buf []byte) error {
+	if i >= GetSizeInBlocks(int(dir.Size)) {
+		return corruptf("directory %d has no block %d", dir.Index, i)
+	}
+	blockIndex, err := fs.blockAt(dir, i, buf)
+	if err != nil {
+		return err
+	}
+	err = fs.transferBlock(false, dir.Index, blockIndex, buf)
+	if err != nil {
+		return err
+	}
+	return fs.verifyBlock(uint64(blockIndex), buf)
+}
+
+// lookupIndexed is lookup for indexed directories. Like lookup, it doesn't
+// allocate unless it fails.
+func (fs *FileSystem) lookupIndexed(dir *Inode, name string) (*Inode, error) {
+	bufp := contentsPool.Get().(*[]byte)
+	defer contentsPool.Put(bufp)
+	if cap(*bufp) < 3*BlockSize {
+		*bufp = make([]byte, 0, 3*BlockSize)
+	}
+	first, index, block := (*bufp)[:BlockSize], (*bufp)[BlockSize:2*BlockSize], (*bufp)[2*BlockSize:3*BlockSize]
+
+	err := fs.readDirBlock(dir, 0, first)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+	}
+	entriesStart, err := dirEntriesStart(first, int(dir.Size))
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", name, corruptf("directory %d: %v", dir.Index, err))
+	}
+	n := int(binary.LittleEndian.Uint32(first[0:4]))
+	firstEntryBlock := entriesStart / BlockSize
+	// loaded is the block of the index in index, if any
+	loaded := 0
+	record := func(i int) (uint32, uint32, error) {
+		pos := dirIndexHeaderSize + dirIndexRecordSize*i
+		buf := first
+		if b := pos / BlockSize; b > 0 {
+			if b != loaded {
+				err := fs.readDirBlock(dir, b, index)
+				if err != nil {
+					return 0, 0, err
+				}
+				loaded = b
+			}
+			buf = index
+		}
+		r := buf[pos%BlockSize:]
+		return binary.LittleEndian.Uint32(r[0:4]), binary.LittleEndian.Uint32(r[4:8]), nil
+	}
+
+	hash := nameHash(name)
+	lo, hi := 0, n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		h, _, err := record(mid)
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+		}
+		if h < hash {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	for i := lo; i < n; i++ {
+		h, entryBlock, err := record(i)
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+		}
+		if h != hash {
+			break
+		}
+		b := firstEntryBlock + int(entryBlock)
+		err = fs.readDirBlock(dir, b, block)
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+		}
+		end := int(dir.Size) - b*BlockSize
+		if end > BlockSize {
+			end = BlockSize
+		}
+		r := dirReader{contents: block[:end], binary: true, indexed: true}
+		for r.next() {
+			if string(r.name) == name {
+				return fs.lookupChild(r.inode, name)
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %w", name, r.err)
+		}
+	}
+	return nil, fmt.Errorf("%s not found: %w", name, ErrNotExist)
+}
@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readCountingDevice is an ArrayBlockDevice counting the blocks read.
+type readCountingDevice struct {
+	*ArrayBlockDevice
+	reads int
+}
+
+func (dev *readCountingDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	dev.reads++
+	return dev.ArrayBlockDevice.ReadBlock(blockNum, buf)
+}
+
+// newIndexTestFileSystem returns a filesystem of many inodes, which keeps
+// few of them loaded, as every operation writes back the loaded ones, and
+// doesn't check invariants after every operation; both would make filling
+// large directories slow.
+func newIndexTestFileSystem(tb testing.TB) (*FileSystem, *readCountingDevice) {
+	dev := &readCountingDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, 2400*BlockSize))}
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 2400, InodeRatio: BlockSize})
+	require.NoError(tb, err)
+	filesystem.inodes = newInodeCache(16)
+	filesystem.SetInvariantChecks(InvariantsOff, nil)
+	return filesystem, dev
+}
+
+// fillDir makes dir a new directory of n empty files, named after their
+// position.
+func fillDir(tb testing.TB, filesystem *FileSystem, dir string, n int) {
+	if dir != "/" {
+		require.NoError(tb, filesystem.Mkdir(dir))
+	}
+	for i := 0; i < n; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("%s/file number %04d", strings.TrimSuffix(dir, "/"), i), &bytes.Buffer{})
+		require.NoError(tb, err)
+	}
+}
+
+func TestDirIndex(t *testing.T) {
+	const n = 520
+	filesystem, dev := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", n)
+	dir, err := filesystem.FindInodeByName("/big")
+	require.NoError(t, err)
+	require.True(t, dir.dirIndexed)
+
+	// the index takes two blocks, and a lookup reads at most both and a
+	// block of entries, after the block of the root directory
+	contents, err := filesystem.readContents(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint32(n), binary.LittleEndian.Uint32(contents.Bytes()))
+	require.Equal(t, uint32(2), binary.LittleEndian.Uint32(contents.Bytes()[4:]))
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("/big/file number %04d", i)
+		_, err := filesystem.FindInodeByName(name)
+		require.NoError(t, err)
+		dev.reads = 0
+		inode, err := filesystem.FindInodeByName(name)
+		require.NoError(t, err)
+		require.Equal(t, name[len("/big/"):], inode.Filename)
+		require.LessOrEqual(t, dev.reads, 1+3, name)
+	}
+	_, err = filesystem.FindInodeByName("/big/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+
+	// listings keep the order entries were added in
+	entries, err := filesystem.ReadDir(int(dir.Index))
+	require.NoError(t, err)
+	require.Len(t, entries, n)
+	for i, entry := range entries {
+		require.Equal(t, fmt.Sprintf("file number %04d", i), entry.Name)
+	}
+
+	require.NoError(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev.ArrayBlockDevice)
+	require.NoError(t, err)
+	_, err = reloaded.FindInodeByName("/big/file number 0519")
+	require.NoError(t, err)
+	report, err := Fsck(dev.ArrayBlockDevice, FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Remaining)
+}
+
+func TestDirIndexShrink(t *testing.T) {
+	filesystem, _ := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", 200)
+
+	// deleting entries until the rest fit in a block drops the index
+	for i := 0; i < 100; i++ {
+		require.NoError(t, filesystem.DeleteFile(fmt.Sprintf("/big/file number %04d", i)))
+	}
+	dir, err := filesystem.FindInodeByName("/big")
+	require.NoError(t, err)
+	require.False(t, dir.dirIndexed)
+	entries, err := filesystem.ReadDir(int(dir.Index))
+	require.NoError(t, err)
+	require.Len(t, entries, 100)
+	_, err = filesystem.FindInodeByName("/big/file number 0150")
+	require.NoError(t, err)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestDirIndexOlderVersions(t *testing.T) {
+	filesystem, _ := newIndexTestFileSystem(t)
+	filesystem.version = dirIndexVersion - 1
+	fillDir(t, filesystem, "/", 200)
+	root, err := filesystem.GetInode(0)
+	require.NoError(t, err)
+	require.False(t, root.dirIndexed)
+	_, err = filesystem.FindInodeByName("/file number 0199")
+	require.NoError(t, err)
+}
+
+func TestDirIndexCorruption(t *testing.T) {
+	filesystem, _ := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", 200)
+	dir, err := filesystem.FindInodeByName("/big")
+	require.NoError(t, err)
+
+	// an index claiming more blocks than the directory has
+	blockIndex := dir.Blocks[0]
+	buf := make([]byte, BlockSize)
+	require.NoError(t, filesystem.dev.ReadBlock(uint64(blockIndex), buf))
+	binary.LittleEndian.PutUint32(buf[4:], 9)
+	require.NoError(t, filesystem.dev.WriteBlock(uint64(blockIndex), buf))
+	_, err = filesystem.FindInodeByName("/big/file number 0001")
+	require.ErrorIs(t, err, ErrCorrupt)
+	_, err = filesystem.ReadDir(int(dir.Index))
+	require.ErrorContains(t, err, "directory index of 200 entries in 9 blocks")
+}
@@ -0,0 +1,188 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+)
+
+// DirIter lists a directory an entry at a time, see OpenDir. Only a block
+// of the directory is held at a time, so listing a huge directory takes
+// little memory; ReadDir reads it whole instead. A DirIter may be used along
+// with other operations on the filesystem, but not from several goroutines
+// at once.
+type DirIter struct {
+	fs   *FileSystem
+	name string
+	dir  Handle
+	// cookie is the position of the next entry
+	cookie uint64
+	// records are the entries of chunk chunk of the directory, the first of
+	// which is at position start, and more is set if there are chunks
+	// after it. They were read when fs.dirWrites was stamp; loaded is
+	// cleared when they must be read again.
+	chunk   int
+	start   uint64
+	records []dirRecord
+	more    bool
+	stamp   uint64
+	loaded  bool
+	closed  bool
+}
+
+// OpenDir opens the directory with the given absolute name for listing an
+// entry at a time with Next. Entries come in the order they are stored,
+// which is the order they were added, whatever SetDirOrder says.
+//
+// Each entry has a position, counting from 0, and Cookie returns the
+// position of the next entry, which Seek goes back to, even on another
+// DirIter of the directory, as offsets of readdir do in FUSE. Positions are
+// counted afresh whenever the directory changes: once entries before a
+// position are removed, the position stands for a later entry.
+func (fs *FileSystem) OpenDir(dirname string) (*DirIter, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findDir(dirname)
+	if err == nil {
+		err = fs.checkAccess(dir, accessRead)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", dirname, err)
+	}
+	return &DirIter{
+		fs:   fs,
+		name: dirname,
+		dir:  Handle{Index: dir.Index, Generation: dir.Generation},
+	}, nil
+}
+
+// Next returns the next entry of the directory, and io.EOF after the last.
+// Entries added after the ones listed so far are listed too. It fails with
+// ErrStale if the directory is gone.
+func (it *DirIter) Next() (DirEntry, error) {
+	if it.closed {
+		return DirEntry{}, ErrClosed
+	}
+	fs := it.fs
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.handleInode(it.dir)
+	if err != nil {
+		return DirEntry{}, fmt.Errorf("error listing %s: %w", it.name, err)
+	}
+	if !it.loaded || it.stamp != fs.dirWrites {
+		// the directory may have changed, so its chunks are counted from
+		// the first one again
+		err = it.load(dir, 0, 0)
+		if err != nil {
+			return DirEntry{}, fmt.Errorf("error listing %s: %w", it.name, err)
+		}
+	}
+	for it.cookie >= it.start+uint64(len(it.records)) {
+		if !it.more {
+			return DirEntry{}, io.EOF
+		}
+		err = it.load(dir, it.chunk+1, it.start+uint64(len(it.records)))
+		if err != nil {
+			return DirEntry{}, fmt.Errorf("error listing %s: %w", it.name, err)
+		}
+	}
+
+	record := it.records[it.cookie-it.start]
+	child, err := fs.lookupChild(record.inode, record.name)
+	if err != nil {
+		return DirEntry{}, fmt.Errorf("error listing %s: %w", it.name, err)
+	}
+	it.cookie++
+	return DirEntry{
+		Name:  record.name,
+		Inode: uint32(record.inode),
+		Type:  child.Type,
+		Size:  child.Size,
+	}, nil
+}
+
+// Cookie returns the position of the entry Next returns next.
+func (it *DirIter) Cookie() uint64 {
+	return it.cookie
+}
+
+// Seek makes Next continue at the entry at the position cookie, as returned
+// by Cookie; 0 lists the directory from the start again.
+func (it *DirIter) Seek(cookie uint64) error {
+	if it.closed {
+		return ErrClosed
+	}
+	it.cookie = cookie
+	if cookie < it.start {
+		it.loaded = false
+	}
+	return nil
+}
+
+// Close closes the DirIter. Further calls fail with ErrClosed.
+func (it *DirIter) Close() error {
+	if it.closed {
+		return ErrClosed
+	}
+	it.closed = true
+	it.records = nil
+	return nil
+}
+
+// load reads chunk i of dir, whose first entry is at position start. The
+// chunks of indexed directories are their blocks of entries; other
+// directories take a block at most, unless they were written before
+// directories were indexed, and are read whole as a single chunk.
+func (it *DirIter) load(dir *Inode, i int, start uint64) error {
+	fs := it.fs
+	it.chunk, it.start, it.stamp, it.loaded = i, start, fs.dirWrites, true
+	if !dir.dirIndexed {
+		records, err := fs.readDirRecords(int(dir.Index))
+		if err != nil {
+			it.loaded = false
+			return err
+		}
+		it.records, it.more = records, false
+		return nil
+	}
+
+	bufp := contentsPool.Get().(*[]byte)
+	defer contentsPool.Put(bufp)
+	if cap(*bufp) < BlockSize {
+		*bufp = make([]byte, 0, BlockSize)
+	}
+	block := (*bufp)[:BlockSize]
+	err := fs.readDirBlock(dir, 0, block)
+	if err == nil {
+		var entriesStart int
+		entriesStart, err = dirEntriesStart(block, int(dir.Size))
+		if err != nil {
+			err = corruptf("directory %d: %v", dir.Index, err)
+		}
+		b := entriesStart/BlockSize + i
+		if err == nil && b*BlockSize < int(dir.Size) {
+			err = fs.readDirBlock(dir, b, block)
+		}
+		if err == nil {
+			end := int(dir.Size) - b*BlockSize
+			if end > BlockSize {
+				end = BlockSize
+			}
+			if end < 0 {
+				end = 0
+			}
+			it.records = it.records[:0]
+			r := dirReader{contents: block[:end], binary: true, indexed: true}
+			for r.next() {
+				it.records = append(it.records, dirRecord{name: string(r.name), inode: r.inode, typ: r.typ})
+			}
+			err = r.err
+			it.more = (b+1)*BlockSize < int(dir.Size)
+		}
+	}
+	if err != nil {
+		it.loaded = false
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readDirIter lists the rest of the directory it lists.
+func readDirIter(t *testing.T, it *DirIter) []DirEntry {
+	entries := []DirEntry{}
+	for {
+		entry, err := it.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+}
+
+func TestDirIter(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	_, err := filesystem.CreateFile("/dir/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir/sub"))
+	_, err = filesystem.CreateFile("/dir/bar", bytes.NewBufferString("hi"))
+	require.NoError(t, err)
+
+	it, err := filesystem.OpenDir("/dir")
+	require.NoError(t, err)
+	entries := readDirIter(t, it)
+	expected, err := filesystem.ReadDirByPath("/dir")
+	require.NoError(t, err)
+	require.Equal(t, expected, entries)
+	require.Equal(t, []string{"foo", "sub", "bar"}, []string{entries[0].Name, entries[1].Name, entries[2].Name})
+	require.Equal(t, uint32(5), entries[0].Size)
+	require.Equal(t, InodeTypeDirectory, entries[1].Type)
+	require.Equal(t, uint64(3), it.Cookie())
+
+	// entries added later are listed too
+	_, err = filesystem.CreateFile("/dir/baz", &bytes.Buffer{})
+	require.NoError(t, err)
+	entry, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, "baz", entry.Name)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// a cookie resumes the listing, on another DirIter too
+	require.NoError(t, it.Seek(1))
+	entry, err = it.Next()
+	require.NoError(t, err)
+	require.Equal(t, "sub", entry.Name)
+	other, err := filesystem.OpenDir("/dir")
+	require.NoError(t, err)
+	require.NoError(t, other.Seek(it.Cookie()))
+	entry, err = other.Next()
+	require.NoError(t, err)
+	require.Equal(t, "bar", entry.Name)
+
+	// removing an entry before a cookie shifts what it stands for: baz
+	// moves to position 2, which was listed already
+	require.NoError(t, filesystem.DeleteFile("/dir/foo"))
+	_, err = other.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, other.Seek(2))
+	entry, err = other.Next()
+	require.NoError(t, err)
+	require.Equal(t, "baz", entry.Name)
+
+	require.NoError(t, it.Close())
+	require.ErrorIs(t, it.Close(), ErrClosed)
+	_, err = it.Next()
+	require.ErrorIs(t, err, ErrClosed)
+
+	_, err = filesystem.OpenDir("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+	_, err = filesystem.OpenDir("/dir/bar")
+	require.ErrorIs(t, err, ErrNotDirectory)
+}
+
+func TestDirIterStale(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	it, err := filesystem.OpenDir("/dir")
+	require.NoError(t, err)
+	// directories can't be deleted, so one that is gone is made up
+	it.dir.Generation++
+	_, err = it.Next()
+	require.ErrorIs(t, err, ErrStale)
+}
+
+func TestDirIterPermissions(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/private"))
+	require.NoError(t, filesystem.Chmod("/private", 0700))
+	filesystem.SetCredentials(&Credentials{Uid: 1000, Gid: 100})
+	_, err := filesystem.OpenDir("/private")
+	require.ErrorIs(t, err, ErrPermission)
+}
+
+func TestDirIterIndexed(t *testing.T) {
+	const n = 520
+	filesystem, dev := newIndexTestFileSystem(t)
+	fillDir(t, filesystem, "/big", n)
+	dir, err := filesystem.FindInodeByName("/big")
+	require.NoError(t, err)
+	require.True(t, dir.dirIndexed)
+
+	it, err := filesystem.OpenDir("/big")
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		dev.reads = 0
+		entry, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("file number %04d", i), entry.Name)
+		// a block of entries at a time, the index block and the inode
+		require.LessOrEqual(t, dev.reads, 3)
+		if i == n/2 {
+			require.Less(t, len(it.records), n/2)
+		}
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// resuming in the middle of the directory
+	require.NoError(t, it.Seek(n-10))
+	entries := readDirIter(t, it)
+	require.Len(t, entries, 10)
+	require.Equal(t, fmt.Sprintf("file number %04d", n-10), entries[0].Name)
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// diskUsage is the sum DiskUsage is adding up.
+type diskUsage struct {
+	bytes uint64
+	// inodes and blocks are those counted already
+	inodes map[uint32]bool
+	blocks map[uint32]bool
+}
+
+// DiskUsage sums the space taken by the file or directory with the given
+// absolute name and, for a directory, by everything below it, as du does:
+// bytes is the sum of the sizes of the files and directories, and blocks is
+// the number of data blocks they take, their pointer, extent and extended
+// attribute blocks included. A file with several names below the directory
+// is counted once, and so is a block files share through the dedup table,
+// see MkfsOptions.Dedup; compressed files count the blocks they are stored
+// in. Directories that can't be read for lack of permission fail it, see
+// SetCredentials.
+//
+// The tree is summed under the filesystem's lock, so the sum is of the tree
+// as it was at one time.
+func (fs *FileSystem) DiskUsage(name string) (bytes uint64, blocks uint64, err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error summing the usage of %s: %w", name, err)
+	}
+	u := &diskUsage{inodes: map[uint32]bool{}, blocks: map[uint32]bool{}}
+	err = fs.addDiskUsage(u, inode)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error summing the usage of %s: %w", name, err)
+	}
+	return u.bytes, uint64(len(u.blocks)), nil
+}
+
+// addDiskUsage adds inode and, if it is a directory, everything below it to
+// u.
+func (fs *FileSystem) addDiskUsage(u *diskUsage, inode *Inode) error {
+	if u.inodes[inode.Index] {
+		return nil
+	}
+	u.inodes[inode.Index] = true
+	u.bytes += uint64(inode.Size)
+	m, err := fs.readBlockMap(inode)
+	if err != nil {
+		return fmt.Errorf("error reading the blocks of inode %d: %w", inode.Index, err)
+	}
+	for _, blockIndex := range m.owned() {
+		u.blocks[blockIndex] = true
+	}
+	if inode.Type != InodeTypeDirectory {
+		return nil
+	}
+
+	err = fs.checkAccess(inode, accessRead)
+	if err != nil {
+		return fmt.Errorf("error listing directory %d: %w", inode.Index, err)
+	}
+	records, err := fs.readDirRecords(int(inode.Index))
+	if err != nil {
+		return fmt.Errorf("error reading directory %d: %w", inode.Index, err)
+	}
+	for _, record := range records {
+		child, err := fs.allocatedInode(record.inode)
+		if err != nil {
+			return err
+		}
+		err = fs.addDiskUsage(u, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
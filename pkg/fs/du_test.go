@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.NoError(t, filesystem.Mkdir("/dir/sub"))
+	_, err := filesystem.CreateFile("/dir/foo", bytes.NewBuffer(make([]byte, 2*BlockSize+1)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/dir/sub/bar", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/baz", bytes.NewBufferString("outside"))
+	require.NoError(t, err)
+
+	dir, err := filesystem.FindInodeByName("/dir")
+	require.NoError(t, err)
+	sub, err := filesystem.FindInodeByName("/dir/sub")
+	require.NoError(t, err)
+
+	// a file counts its size and its blocks
+	size, blocks, err := filesystem.DiskUsage("/dir/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*BlockSize+1), size)
+	require.Equal(t, uint64(3), blocks)
+
+	// a directory counts itself and everything below it
+	size, blocks, err = filesystem.DiskUsage("/dir")
+	require.NoError(t, err)
+	require.Equal(t, uint64(dir.Size+sub.Size+2*BlockSize+1+5), size)
+	require.Equal(t, uint64(1+1+3+1), blocks)
+
+	// another name of a file below it counts once
+	require.NoError(t, filesystem.Link("/dir/foo", "/dir/sub/foo"))
+	sub, err = filesystem.FindInodeByName("/dir/sub")
+	require.NoError(t, err)
+	size, blocks, err = filesystem.DiskUsage("/dir")
+	require.NoError(t, err)
+	require.Equal(t, uint64(dir.Size+sub.Size+2*BlockSize+1+5), size)
+	require.Equal(t, uint64(1+1+3+1), blocks)
+
+	// the root holds everything
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	_, blocks, err = filesystem.DiskUsage("/")
+	require.NoError(t, err)
+	// data block 0 belongs to no file
+	require.Equal(t, stats.UsedBlocks-1, blocks)
+
+	_, _, err = filesystem.DiskUsage("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+}
+
+func TestDiskUsagePermissions(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/private"))
+	_, err := filesystem.CreateFile("/private/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Chmod("/private", 0700))
+
+	filesystem.SetCredentials(&Credentials{Uid: 1000, Gid: 100})
+	_, _, err = filesystem.DiskUsage("/")
+	require.ErrorIs(t, err, ErrPermission)
+	// files in it are summed without listing it
+	size, blocks, err := filesystem.DiskUsage("/private/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), size)
+	require.Equal(t, uint64(1), blocks)
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrWrongPassphrase is returned when opening an EncryptedBlockDevice with
+// a passphrase other than the one it was created with.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// An encrypted device keeps a superblock of its own in the first block of
+// the wrapped device, before the blocks it exposes: the magic, the number
+// of PBKDF2 iterations, the salt and the verifier, followed by zeros.
+// PBKDF2-HMAC-SHA256 turns the passphrase and the salt into 96 bytes: the
+// two AES-256 keys of XTS, and the verifier telling whether a passphrase
+// is the right one. The verifier gives away nothing about the keys.
+const (
+	encryptionMagic      = "VSFSXTS1"
+	encryptionIterations = 100000
+	encryptionSaltSize   = 16
+	encryptionKeySize    = 32
+)
+
+// EncryptedBlockDevice wraps a BlockDevice and encrypts every block written
+// to it with AES-256 in XTS mode, the mode of disk encryption, keyed by a
+// passphrase; see OpenEncryptedBlockDevice. A block is encrypted with its
+// block number as the tweak, so it takes no more room than it did, but
+// equal contents written to the same block encrypt to the same ciphertext.
+// XTS keeps the data confidential, not authentic: tampering with a block
+// garbles it without being detected, short of the filesystem's checksums.
+type EncryptedBlockDevice struct {
+	dev BlockDevice
+	// data encrypts the blocks, and tweak their block numbers
+	data  cipher.Block
+	tweak cipher.Block
+}
+
+// OpenEncryptedBlockDevice opens the encrypted device held by dev with the
+// given passphrase. If the first block of dev is all zeros, dev is new: a
+// superblock with a fresh salt is written there, and the passphrase becomes
+// the device's. Otherwise the passphrase is checked against the verifier,
+// failing with ErrWrongPassphrase if it is not the right one. Block 0 of the
+// encrypted device is block 1 of dev, and so on.
+func OpenEncryptedBlockDevice(dev BlockDevice, passphrase string) (*EncryptedBlockDevice, error) {
+	header := make([]byte, BlockSize)
+	err := dev.ReadBlock(0, header)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the encryption superblock: %w", err)
+	}
+
+	var salt, verifier []byte
+	iterations := encryptionIterations
+	if bytes.Equal(header, make([]byte, BlockSize)) {
+		salt = make([]byte, encryptionSaltSize)
+		_, err = io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, fmt.Errorf("error generating the salt: %w", err)
+		}
+	} else {
+		if string(header[:len(encryptionMagic)]) != encryptionMagic {
+			return nil, errors.New("the device isn't encrypted: its first block isn't an encryption superblock")
+		}
+		iterations = int(binary.LittleEndian.Uint32(header[8:12]))
+		salt = header[12 : 12+encryptionSaltSize]
+		verifier = header[12+encryptionSaltSize : 12+encryptionSaltSize+sha256.Size]
+	}
+
+	key := pbkdf2([]byte(passphrase), salt, iterations, 2*encryptionKeySize+sha256.Size)
+	if verifier != nil && !hmac.Equal(verifier, key[2*encryptionKeySize:]) {
+		return nil, ErrWrongPassphrase
+	}
+	if verifier == nil {
+		copy(header, encryptionMagic)
+		binary.LittleEndian.PutUint32(header[8:12], uint32(iterations))
+		copy(header[12:], salt)
+		copy(header[12+encryptionSaltSize:], key[2*encryptionKeySize:])
+		err = dev.WriteBlock(0, header)
+		if err != nil {
+			return nil, fmt.Errorf("error writing the encryption superblock: %w", err)
+		}
+	}
+
+	data, err := aes.NewCipher(key[:encryptionKeySize])
+	if err != nil {
+		return nil, err
+	}
+	tweak, err := aes.NewCipher(key[encryptionKeySize : 2*encryptionKeySize])
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedBlockDevice{dev: dev, data: data, tweak: tweak}, nil
+}
+
+// pbkdf2 derives a key of keyLen bytes from password and salt, with
+// PBKDF2-HMAC-SHA256 as in RFC 8018.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// ReadBlock reads a block and decrypts it into buf. Like the other devices,
+// it reads the first len(buf) bytes of the block if buf is shorter.
+func (dev *EncryptedBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	block := buf
+	if len(buf) < BlockSize {
+		block = make([]byte, BlockSize)
+	}
+	err := dev.dev.ReadBlock(blockNum+1, block)
+	if err != nil {
+		return err
+	}
+	dev.xts(false, blockNum, block[:BlockSize], block[:BlockSize])
+	copy(buf, block)
+	return nil
+}
+
+// WriteBlock encrypts buf, leaving it as it is, and writes it. A buf
+// shorter than a block is written as if padded with zeros.
+func (dev *EncryptedBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	encrypted := make([]byte, BlockSize)
+	copy(encrypted, buf)
+	dev.xts(true, blockNum, encrypted, encrypted)
+	return dev.dev.WriteBlock(blockNum+1, encrypted)
+}
+
+// xts encrypts or decrypts the block src with the given block number into
+// dst, which may be src. Blocks are a whole number of AES blocks, so there
+// is no ciphertext stealing.
+func (dev *EncryptedBlockDevice) xts(encrypt bool, blockNum uint64, dst, src []byte) {
+	var tweak, x [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:8], blockNum)
+	dev.tweak.Encrypt(tweak[:], tweak[:])
+	for i := 0; i < len(src); i += aes.BlockSize {
+		for j := range x {
+			x[j] = src[i+j] ^ tweak[j]
+		}
+		if encrypt {
+			dev.data.Encrypt(x[:], x[:])
+		} else {
+			dev.data.Decrypt(x[:], x[:])
+		}
+		for j := range x {
+			dst[i+j] = x[j] ^ tweak[j]
+		}
+		// multiply the tweak by x in GF(2^128)
+		carry := tweak[aes.BlockSize-1] >> 7
+		for j := aes.BlockSize - 1; j > 0; j-- {
+			tweak[j] = tweak[j]<<1 | tweak[j-1]>>7
+		}
+		tweak[0] = tweak[0]<<1 ^ carry*0x87
+	}
+}
+
+// BlockCount returns the number of blocks of the encrypted device, one less
+// than the wrapped device has, or 0 if its size isn't known.
+func (dev *EncryptedBlockDevice) BlockCount() uint64 {
+	n := deviceSize(dev.dev)
+	if n == 0 {
+		return 0
+	}
+	return n - 1
+}
+
+// Sync syncs the wrapped device, if it supports syncing.
+func (dev *EncryptedBlockDevice) Sync() error {
+	return flushDevice(dev.dev)
+}
+
+// Close closes the wrapped device, if it can be closed.
+func (dev *EncryptedBlockDevice) Close() error {
+	if c, ok := dev.dev.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
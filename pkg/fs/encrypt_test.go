@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedBlockDevice(t *testing.T) {
+	disk := make([]byte, 401*BlockSize)
+	dev, err := OpenEncryptedBlockDevice(NewArrayBlockDevice(disk), "secret")
+	require.NoError(t, err)
+	require.Equal(t, uint64(400), dev.BlockCount())
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 400, JournalBlocks: 32, Checksums: true})
+	require.NoError(t, err)
+	contents := bytes.Repeat([]byte("confidential "), 1000)
+	_, err = filesystem.CreateFile("/confidential", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// neither the contents nor the names are on the device in the clear
+	require.False(t, bytes.Contains(disk, []byte("confidential")))
+
+	_, err = OpenEncryptedBlockDevice(NewArrayBlockDevice(disk), "guess")
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+	dev, err = OpenEncryptedBlockDevice(NewArrayBlockDevice(disk), "secret")
+	require.NoError(t, err)
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/confidential")
+	require.NoError(t, err)
+	read, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+	require.NoError(t, reloaded.Close())
+	report, err := Fsck(dev, FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Remaining)
+}
+
+func TestEncryptedBlockDeviceNotEncrypted(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	_, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = OpenEncryptedBlockDevice(NewArrayBlockDevice(disk), "secret")
+	require.ErrorContains(t, err, "isn't encrypted")
+}
+
+func TestEncryptedBlockDeviceBuffers(t *testing.T) {
+	dev, err := OpenEncryptedBlockDevice(NewArrayBlockDevice(make([]byte, 3*BlockSize)), "secret")
+	require.NoError(t, err)
+	buf := bytes.Repeat([]byte{7}, BlockSize)
+	require.NoError(t, dev.WriteBlock(1, buf))
+	require.Equal(t, bytes.Repeat([]byte{7}, BlockSize), buf)
+	read := make([]byte, BlockSize)
+	require.NoError(t, dev.ReadBlock(1, read))
+	require.Equal(t, buf, read)
+
+	// short buffers are a prefix of the block, as on other devices
+	require.NoError(t, dev.WriteBlock(0, []byte("short")))
+	short := make([]byte, 5)
+	require.NoError(t, dev.ReadBlock(0, short))
+	require.Equal(t, "short", string(short))
+}
+
+func TestXTS(t *testing.T) {
+	// vector 1 of IEEE 1619, with AES-128 keys
+	data, err := aes.NewCipher(make([]byte, 16))
+	require.NoError(t, err)
+	tweak, err := aes.NewCipher(make([]byte, 16))
+	require.NoError(t, err)
+	dev := &EncryptedBlockDevice{data: data, tweak: tweak}
+	out := make([]byte, 32)
+	dev.xts(true, 0, out, make([]byte, 32))
+	require.Equal(t, "917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e", hex.EncodeToString(out))
+	dev.xts(false, 0, out, out)
+	require.Equal(t, make([]byte, 32), out)
+}
+
+func TestPBKDF2(t *testing.T) {
+	// from RFC 7914
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	require.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(key))
+}
@@ -0,0 +1,277 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Explain mode narrates what the filesystem does on the device: every block
+// read and written, every bitmap bit flipped and every inode field changed,
+// one line per step under a line naming the operation. It turns the package
+// into something to watch while learning how a simple filesystem works:
+//
+//	CreateFile /notes
+//	  read block 3 (inode table, inodes 0-7)
+//	  inode bitmap: bit 1 0 -> 1, inode 1 is allocated
+//	  ...
+//
+// Narration happens only while a writer is set, so the hot paths check
+// fs.explain before building their messages.
+
+// explainer is the state of explain mode.
+type explainer struct {
+	w io.Writer
+	// mu serializes the narration, as blocks of a file may be transferred
+	// concurrently, and guards inodes, as readers add to it
+	mu sync.Mutex
+	// inodes holds copies of the inodes as last read from or written to the
+	// inode table, so writes can be narrated field by field
+	inodes map[int]Inode
+}
+
+// SetExplain makes the filesystem narrate each operation to w, step by
+// step. Pass nil to stop narrating.
+func (fs *FileSystem) SetExplain(w io.Writer) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if w == nil {
+		fs.explain = nil
+		return
+	}
+	fs.explain = &explainer{w: w, inodes: map[int]Inode{}}
+}
+
+// explainOp narrates the start of a public operation.
+func (fs *FileSystem) explainOp(format string, args ...interface{}) {
+	if fs.explain == nil {
+		return
+	}
+	fs.explain.mu.Lock()
+	defer fs.explain.mu.Unlock()
+	fmt.Fprintf(fs.explain.w, format+"\n", args...)
+}
+
+// explainf narrates a step of the current operation.
+func (fs *FileSystem) explainf(format string, args ...interface{}) {
+	if fs.explain == nil {
+		return
+	}
+	fs.explain.mu.Lock()
+	defer fs.explain.mu.Unlock()
+	fmt.Fprintf(fs.explain.w, "  "+format+"\n", args...)
+}
+
+// readBlock reads a device block, narrating it in explain mode. Blocks
+// written since the last commit are read from the journal's transaction.
+func (fs *FileSystem) readBlock(blockNum uint64, buf []byte) error {
+	if fs.explain != nil {
+		fs.explainf("read block %d (%s)", blockNum, fs.describeBlock(blockNum))
+	}
+	if fs.journal.read(blockNum, buf) {
+		return nil
+	}
+	if fs.ctx != nil {
+		return readBlockContext(fs.ctx, fs.dev, blockNum, buf)
+	}
+	return fs.dev.ReadBlock(blockNum, buf)
+}
+
+// readBlocks reads the run of device blocks starting at blockNum into buf,
+// in one operation on VectoredBlockDevices, narrating it in explain mode.
+func (fs *FileSystem) readBlocks(blockNum uint64, buf []byte) error {
+	n := uint64(len(buf) / BlockSize)
+	dev, ok := fs.vectoredDevice()
+	if !ok || n == 1 || fs.journal.holdsAny(blockNum, n) {
+		for i := uint64(0); i < n; i++ {
+			err := fs.readBlock(blockNum+i, buf[i*BlockSize:(i+1)*BlockSize])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if fs.explain != nil {
+		fs.explainf("read blocks %d to %d (%s)", blockNum, blockNum+n-1, fs.describeBlock(blockNum))
+	}
+	if fs.ctx != nil {
+		err := fs.ctx.Err()
+		if err != nil {
+			return err
+		}
+	}
+	return dev.ReadBlocks(blockNum, splitBlocks(buf))
+}
+
+// writeBlock writes a device block, narrating it in explain mode.
+func (fs *FileSystem) writeBlock(blockNum uint64, buf []byte) error {
+	if fs.explain != nil {
+		fs.explainf("write block %d (%s)", blockNum, fs.describeBlock(blockNum))
+	}
+	if fs.ctx != nil {
+		return writeBlockContext(fs.ctx, fs.dev, blockNum, buf)
+	}
+	return fs.dev.WriteBlock(blockNum, buf)
+}
+
+// writeBlocks writes the buffers to the run of device blocks starting at
+// blockNum, in one operation on VectoredBlockDevices, narrating it in
+// explain mode.
+func (fs *FileSystem) writeBlocks(blockNum uint64, bufs [][]byte) error {
+	dev, ok := fs.vectoredDevice()
+	if !ok || len(bufs) == 1 {
+		for i, buf := range bufs {
+			err := fs.writeBlock(blockNum+uint64(i), buf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if fs.explain != nil {
+		fs.explainf("write blocks %d to %d (%s)", blockNum, blockNum+uint64(len(bufs))-1, fs.describeBlock(blockNum))
+	}
+	if fs.ctx != nil {
+		err := fs.ctx.Err()
+		if err != nil {
+			return err
+		}
+	}
+	return dev.WriteBlocks(blockNum, bufs)
+}
+
+// vectoredDevice returns the device as a VectoredBlockDevice, if it is one.
+// Devices that take the context of the running operation get their blocks
+// one at a time, as runs don't carry it.
+func (fs *FileSystem) vectoredDevice() (VectoredBlockDevice, bool) {
+	dev, ok := fs.dev.(VectoredBlockDevice)
+	if !ok {
+		return nil, false
+	}
+	if _, takesContext := fs.dev.(ContextBlockDevice); takesContext && fs.ctx != nil {
+		return nil, false
+	}
+	return dev, true
+}
+
+// describeBlocks says how the inode maps its blocks, and lists the ones it
+// holds itself: as block indices, or as extents of a first block and a
+// number of blocks.
+func (inode *Inode) describeBlocks() (string, string) {
+	if !inode.extentMapped {
+		return "blocks", fmt.Sprint(inode.usedBlocks())
+	}
+	extents := []string{}
+	for _, e := range inode.inlineExtents() {
+		extents = append(extents, fmt.Sprintf("%d+%d", e.start, e.length))
+	}
+	return "extents", "[" + strings.Join(extents, " ") + "]"
+}
+
+// describeBlock says what a device block holds, by its place in the layout.
+func (fs *FileSystem) describeBlock(blockNum uint64) string {
+	g := fs.geometry
+	tableEnd := uint64(g.InodeTableStart) + uint64(g.inodeTableBlocks())
+	switch {
+	case blockNum >= uint64(g.InodeTableStart) && blockNum < tableEnd:
+		inodesPerBlock := uint64(BlockSize / InodeSize)
+		first := (blockNum - uint64(g.InodeTableStart)) * inodesPerBlock
+		return fmt.Sprintf("inode table, inodes %d-%d", first, first+inodesPerBlock-1)
+	case blockNum > uint64(g.DataStart):
+		return fmt.Sprintf("data block %d", blockNum-uint64(g.DataStart))
+	default:
+		return fs.regionKind(uint32(blockNum)).String()
+	}
+}
+
+// explainBit narrates bit i of a bitmap changing from old, if it does. The
+// bit tracks the object of the given kind and index.
+func (fs *FileSystem) explainBit(bitmap string, i int, old bool, allocated bool, kind string, index uint64) {
+	if fs.explain == nil || old == allocated {
+		return
+	}
+	if allocated {
+		fs.explainf("%s: bit %d 0 -> 1, %s %d is allocated", bitmap, i, kind, index)
+	} else {
+		fs.explainf("%s: bit %d 1 -> 0, %s %d is freed", bitmap, i, kind, index)
+	}
+}
+
+// explainInodeRead remembers an inode as read from the inode table.
+func (fs *FileSystem) explainInodeRead(inodeIndex int, inode *Inode) {
+	if fs.explain == nil {
+		return
+	}
+	fs.explain.mu.Lock()
+	defer fs.explain.mu.Unlock()
+	fs.explain.inodes[inodeIndex] = *inode
+}
+
+// explainInodeWrite narrates the fields of an inode that change when it is
+// written to the inode table; nil inodes are freed slots.
+func (fs *FileSystem) explainInodeWrite(inodeIndex int, inode *Inode) {
+	if fs.explain == nil {
+		return
+	}
+	old, known := fs.explain.inodes[inodeIndex]
+	switch {
+	case inode == nil:
+		delete(fs.explain.inodes, inodeIndex)
+		if known {
+			fs.explainf("inode %d: cleared", inodeIndex)
+		}
+		return
+	case !known:
+		what, blocks := inode.describeBlocks()
+		fs.explainf("inode %d: type=%s size=%d %s=%s name=%q mode=%o",
+			inodeIndex, describeInodeType(inode.Type), inode.Size, what, blocks, inode.Filename, inode.Mode)
+	default:
+		changes := []string{}
+		if old.Type != inode.Type {
+			changes = append(changes, fmt.Sprintf("type %s -> %s", describeInodeType(old.Type), describeInodeType(inode.Type)))
+		}
+		if old.Size != inode.Size {
+			changes = append(changes, fmt.Sprintf("size %d -> %d", old.Size, inode.Size))
+		}
+		if old.Blocks != inode.Blocks || old.extentMapped != inode.extentMapped {
+			oldWhat, oldBlocks := old.describeBlocks()
+			what, blocks := inode.describeBlocks()
+			if oldWhat == what {
+				changes = append(changes, fmt.Sprintf("%s %s -> %s", what, oldBlocks, blocks))
+			} else {
+				changes = append(changes, fmt.Sprintf("%s %s -> %s %s", oldWhat, oldBlocks, what, blocks))
+			}
+		}
+		if old.Indirect != inode.Indirect {
+			what := "indirect block"
+			if inode.extentMapped {
+				what = "extent block"
+			}
+			changes = append(changes, fmt.Sprintf("%s %d -> %d", what, old.Indirect, inode.Indirect))
+		}
+		if old.DoubleIndirect != inode.DoubleIndirect {
+			changes = append(changes, fmt.Sprintf("double indirect block %d -> %d", old.DoubleIndirect, inode.DoubleIndirect))
+		}
+		if old.Filename != inode.Filename {
+			changes = append(changes, fmt.Sprintf("name %q -> %q", old.Filename, inode.Filename))
+		}
+		if old.Mode != inode.Mode {
+			changes = append(changes, fmt.Sprintf("mode %o -> %o", old.Mode, inode.Mode))
+		}
+		if old.Defaults != inode.Defaults {
+			changes = append(changes, fmt.Sprintf("defaults %+v -> %+v", old.Defaults, inode.Defaults))
+		}
+		if len(changes) > 0 {
+			fs.explainf("inode %d: %s", inodeIndex, strings.Join(changes, ", "))
+		}
+	}
+	fs.explain.inodes[inodeIndex] = *inode
+}
+
+func describeInodeType(t InodeType) string {
+	if t == InodeTypeDirectory {
+		return "directory"
+	}
+	return "file"
+}
@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	out := &bytes.Buffer{}
+	filesystem.SetExplain(out)
+
+	_, err := filesystem.CreateFile("/notes", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	lines := strings.Split(out.String(), "\n")
+	require.Equal(t, "CreateFile /notes (5 bytes)", lines[0])
+	for _, step := range []string{
+		"  superblock: state clean -> dirty, so a crash before Close is noticed at the next mount",
+		"  write block 0 (superblock)",
+		"  data bitmap: bit 1 0 -> 1, block 7 is allocated",
+		"  write block 7 (data block 1)",
+		`  inode 1: type=file size=5 extents=[7+1] name="notes" mode=644`,
+		"  inode bitmap: bit 1 0 -> 1, inode 1 is allocated",
+		"  write block 1 (inode bitmap)",
+		"  read block 3 (inode table, inodes 0-7)",
+		"  inode 0: size 0 -> 11, extents [] -> [8+1]",
+	} {
+		require.Contains(t, lines, step)
+	}
+
+	out.Reset()
+	f, err := filesystem.OpenFile("/notes", O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(f)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+	lines = strings.Split(out.String(), "\n")
+	require.Contains(t, lines, "Read /notes (512 bytes at offset 0)")
+	require.Contains(t, lines, "  read block 7 (data block 1)")
+	require.Contains(t, lines, "Write /notes (1 bytes at offset 5)")
+	require.Contains(t, lines, "  inode 1: size 5 -> 6")
+
+	out.Reset()
+	filesystem.SetExplain(nil)
+	_, err = filesystem.CreateFile("/quiet", bytes.NewBufferString("quiet"))
+	require.NoError(t, err)
+	require.Empty(t, out.String())
+}
+
+func TestExplainRollback(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	filesystem.SetExplain(out)
+
+	dev.failWriteAt = dev.writes + 3
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.ErrorIs(t, err, errInjected)
+	lines := strings.Split(out.String(), "\n")
+	require.Contains(t, lines, "  failed (error writing inode table: error writing inode table block 0: injected device failure); restoring the bitmaps and inodes from before the operation")
+	require.Contains(t, lines, "  inode 1: cleared")
+}
@@ -0,0 +1,312 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Filesystems of format version 6 on map the data blocks of files with
+// extents, runs of consecutive blocks, rather than with a pointer per block,
+// so a contiguous file takes a few extents whatever its size, and its blocks
+// are read a run at a time. The Blocks of such inodes hold their first
+// inlineExtents extents as pairs of the device index of the first block and
+// the number of blocks, followed by zeros. Files with more extents have the
+// rest in a chain of extent blocks starting at Indirect; each starts with the
+// index of the next one, or zero, and the number of extents it holds, and
+// then holds them as pairs like Blocks does. DoubleIndirect is zero.
+//
+// Filesystems of earlier versions keep mapping files with pointers, so older
+// code can still read them.
+const (
+	inlineExtents   = directBlocks / 2
+	extentsPerBlock = (BlockSize - extentBlockHeader) / 8
+
+	// extentBlockHeader is the size of the header of extent blocks.
+	extentBlockHeader = 8
+
+	// extentVersion is the first format version mapping files with extents.
+	extentVersion = 6
+)
+
+// blockExtents returns the runs of consecutive blocks of blocks.
+func blockExtents(blocks []uint32) []extent {
+	extents := []extent{}
+	for _, blockIndex := range blocks {
+		if n := len(extents); n > 0 && extents[n-1].start+extents[n-1].length == int(blockIndex) {
+			extents[n-1].length++
+		} else {
+			extents = append(extents, extent{start: int(blockIndex), length: 1})
+		}
+	}
+	return extents
+}
+
+// inlineExtents returns the extents held in the Blocks of an extent mapped
+// inode, up to the first empty one.
+func (inode *Inode) inlineExtents() []extent {
+	extents := []extent{}
+	for i := 0; i < inlineExtents; i++ {
+		start, length := inode.Blocks[2*i], inode.Blocks[2*i+1]
+		if length == 0 {
+			break
+		}
+		extents = append(extents, extent{start: int(start), length: int(length)})
+	}
+	return extents
+}
+
+// setInlineExtents stores the first inlineExtents of extents in the Blocks
+// of inode.
+func (inode *Inode) setInlineExtents(extents []extent) {
+	inode.Blocks = [directBlocks]uint32{}
+	for i, e := range extents {
+		if i == inlineExtents {
+			break
+		}
+		inode.Blocks[2*i], inode.Blocks[2*i+1] = uint32(e.start), uint32(e.length)
+	}
+}
+
+// validateExtents checks the extents an inode stored in slot index holds
+// itself against its size.
+func (inode *Inode) validateExtents(index int) error {
+	if inode.DoubleIndirect != 0 {
+		return corruptf("inode %d: it is mapped with extents, but has a double indirect block", index)
+	}
+	total := uint64(0)
+	n := 0
+	for i := 0; i < inlineExtents; i++ {
+		start, length := inode.Blocks[2*i], inode.Blocks[2*i+1]
+		switch {
+		case length == 0 && start != 0:
+			return corruptf("inode %d: extent %d starts at block %d, but has no blocks", index, i, start)
+		case length == 0:
+			continue
+		case n < i:
+			return corruptf("inode %d: extent list has a gap", index)
+		}
+		total += uint64(length)
+		n++
+	}
+	need := uint64(inode.StoredBlocks())
+	switch {
+	case inode.Indirect == 0 && total != need:
+		return corruptf("inode %d: size %d needs %d blocks, but its extents hold %d", index, inode.storedSize(), need, total)
+	case inode.Indirect != 0 && (n < inlineExtents || total >= need):
+		return corruptf("inode %d: size %d needs no extent blocks, but there are some", index, inode.storedSize())
+	}
+	return nil
+}
+
+// readExtentMap is readBlockMap for inodes mapped with extents. It fails
+// with ErrCorrupt if the extents don't hold as many blocks as the size
+// needs, or an extent block is outside the data region or malformed.
+func (fs *FileSystem) readExtentMap(inode *Inode) (*blockMap, error) {
+	n := inode.StoredBlocks()
+	m := &blockMap{extents: inode.inlineExtents()}
+	var buf []byte
+	for next := inode.Indirect; next != 0; {
+		// every extent holds a block, so longer chains loop
+		if len(m.extentBlocks) >= n {
+			return nil, corruptf("inode %d: its extent blocks hold more extents than it has blocks", inode.Index)
+		}
+		if !fs.isDataBlock(next) {
+			return nil, corruptf("inode %d: extent block %d is outside the data region", inode.Index, next)
+		}
+		if buf == nil {
+			buf = make([]byte, BlockSize)
+		}
+		err := fs.readMetadata(uint64(next), buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading extent block %d of inode %d: %w", next, inode.Index, err)
+		}
+		m.extentBlocks = append(m.extentBlocks, next)
+		extents, err := decodeExtentBlock(buf)
+		if err != nil {
+			return nil, corruptf("inode %d: extent block %d %v", inode.Index, next, err)
+		}
+		m.extents = append(m.extents, extents...)
+		next = binary.LittleEndian.Uint32(buf)
+	}
+
+	total := 0
+	for _, e := range m.extents {
+		total += e.length
+		if total > n {
+			break
+		}
+	}
+	if total != n {
+		return nil, corruptf("inode %d: size %d needs %d blocks, but its extents hold %d", inode.Index, inode.storedSize(), n, total)
+	}
+	m.data = make([]uint32, 0, n)
+	for _, e := range m.extents {
+		for i := 0; i < e.length; i++ {
+			m.data = append(m.data, uint32(e.start+i))
+		}
+	}
+	return m, nil
+}
+
+// decodeExtentBlock returns the extents held in an extent block.
+func decodeExtentBlock(buf []byte) ([]extent, error) {
+	count := binary.LittleEndian.Uint32(buf[4:])
+	if count == 0 || count > extentsPerBlock {
+		return nil, fmt.Errorf("holds %d extents", count)
+	}
+	extents := make([]extent, count)
+	for i := range extents {
+		pair := buf[extentBlockHeader+8*i:]
+		extents[i] = extent{start: int(binary.LittleEndian.Uint32(pair)), length: int(binary.LittleEndian.Uint32(pair[4:]))}
+		if extents[i].length == 0 {
+			return nil, fmt.Errorf("has an extent of no blocks")
+		}
+	}
+	return extents, nil
+}
+
+// extentAt returns the device index of data block i of an inode mapped with
+// extents, and how many blocks of the file follow it on the device,
+// counting itself. It reads extent blocks into buf as needed, and doesn't
+// allocate.
+func (fs *FileSystem) extentAt(inode *Inode, i int, buf []byte) (uint32, int, error) {
+	want := i
+	for k := 0; k < inlineExtents && inode.Blocks[2*k+1] != 0; k++ {
+		start, length := inode.Blocks[2*k], int(inode.Blocks[2*k+1])
+		if i < length {
+			return start + uint32(i), length - i, nil
+		}
+		i -= length
+	}
+	for next, seen := inode.Indirect, 0; next != 0 && seen <= inode.storedSize()/BlockSize; seen++ {
+		if !fs.isDataBlock(next) {
+			return 0, 0, corruptf("inode %d: extent block %d is outside the data region", inode.Index, next)
+		}
+		err := fs.readMetadata(uint64(next), buf)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error reading extent block %d of inode %d: %w", next, inode.Index, err)
+		}
+		count := binary.LittleEndian.Uint32(buf[4:])
+		if count == 0 || count > extentsPerBlock {
+			return 0, 0, corruptf("inode %d: extent block %d holds %d extents", inode.Index, next, count)
+		}
+		for k := 0; k < int(count); k++ {
+			pair := buf[extentBlockHeader+8*k:]
+			start, length := binary.LittleEndian.Uint32(pair), int(binary.LittleEndian.Uint32(pair[4:]))
+			if i < length {
+				return start + uint32(i), length - i, nil
+			}
+			i -= length
+		}
+		next = binary.LittleEndian.Uint32(buf)
+	}
+	return 0, 0, corruptf("inode %d: its extents end before block %d", inode.Index, want)
+}
+
+// readInlineExtents is readStoredInto for inodes holding all their
+// extents themselves. It reads the contents a run at a time without listing
+// their blocks, so reading small files and directories doesn't allocate.
+func (fs *FileSystem) readInlineExtents(inode *Inode, buf []byte) ([]byte, error) {
+	n := inode.StoredBlocks()
+	if cap(buf) < n*BlockSize {
+		buf = make([]byte, n*BlockSize)
+	}
+	buf = buf[:n*BlockSize]
+	read := 0
+	for k := 0; k < inlineExtents && inode.Blocks[2*k+1] != 0 && read < n; k++ {
+		start, length := inode.Blocks[2*k], int(inode.Blocks[2*k+1])
+		if length > n-read {
+			length = n - read
+		}
+		run := buf[read*BlockSize : (read+length)*BlockSize]
+		var err error
+		if length == 1 {
+			err = fs.transferBlock(false, inode.Index, start, run)
+		} else if err = fs.readBlocks(uint64(start), run); err != nil {
+			err = fmt.Errorf("error reading blocks %d to %d of inode %d: %w", start, start+uint32(length)-1, inode.Index, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if inode.Type == InodeTypeDirectory {
+			for j := 0; j < length; j++ {
+				err = fs.verifyBlock(uint64(start)+uint64(j), run[j*BlockSize:(j+1)*BlockSize])
+				if err != nil {
+					return nil, fmt.Errorf("error reading directory %d: %w", inode.Index, err)
+				}
+			}
+		}
+		read += length
+	}
+	if read < n {
+		return nil, corruptf("inode %d: size %d needs %d blocks, but its extents hold %d", inode.Index, inode.storedSize(), n, read)
+	}
+	return buf[:inode.storedSize()], nil
+}
+
+// mapExtents is mapBlocks for filesystems mapping files with extents. It
+// converts inodes mapped with pointers, freeing their pointer blocks.
+//
+// The extent blocks are written afresh, and those of old freed, whenever
+// the extents they hold change, so until the inode is written, old still
+// describes the file as it was.
+func (fs *FileSystem) mapExtents(inode *Inode, old *blockMap, data []uint32) error {
+	extents := blockExtents(data)
+	rest, oldRest := []extent{}, []extent{}
+	if len(extents) > inlineExtents {
+		rest = extents[inlineExtents:]
+	}
+	if len(old.extents) > inlineExtents {
+		oldRest = old.extents[inlineExtents:]
+	}
+	chain := old.extentBlocks
+	if !inode.extentMapped || fmt.Sprint(rest) != fmt.Sprint(oldRest) {
+		var err error
+		chain, err = fs.findEmptyBlocks((len(rest) + extentsPerBlock - 1) / extentsPerBlock)
+		if err != nil {
+			return fmt.Errorf("not enough free blocks for the extents of %d data blocks: %w", len(data), err)
+		}
+		for _, blockIndex := range chain {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		buf := make([]byte, BlockSize)
+		for i, blockIndex := range chain {
+			held := rest[i*extentsPerBlock:]
+			if len(held) > extentsPerBlock {
+				held = held[:extentsPerBlock]
+			}
+			for j := range buf {
+				buf[j] = 0
+			}
+			if i+1 < len(chain) {
+				binary.LittleEndian.PutUint32(buf, chain[i+1])
+			}
+			binary.LittleEndian.PutUint32(buf[4:], uint32(len(held)))
+			for j, e := range held {
+				pair := buf[extentBlockHeader+8*j:]
+				binary.LittleEndian.PutUint32(pair, uint32(e.start))
+				binary.LittleEndian.PutUint32(pair[4:], uint32(e.length))
+			}
+			err := fs.writeMetadata(uint64(blockIndex), buf)
+			if err != nil {
+				return fmt.Errorf("error writing extent block %d of inode %d: %w", blockIndex, inode.Index, err)
+			}
+		}
+		for _, blockIndex := range old.extentBlocks {
+			fs.setBlockAllocated(blockIndex, false)
+		}
+	}
+	if !inode.extentMapped {
+		for _, blockIndex := range old.pointers() {
+			fs.setBlockAllocated(blockIndex, false)
+		}
+	}
+
+	inode.setInlineExtents(extents)
+	inode.Indirect, inode.DoubleIndirect = 0, 0
+	if len(chain) > 0 {
+		inode.Indirect = chain[0]
+	}
+	inode.extentMapped = true
+	return nil
+}
@@ -0,0 +1,167 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtents(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	free := filesystem.freeBlocks.free
+
+	// a contiguous file takes a single extent, and no other blocks
+	want := patterned((directBlocks+pointersPerBlock+5)*BlockSize + 100)
+	inode, err := filesystem.CreateFile("/big", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.True(t, inode.extentMapped)
+	require.Equal(t, []extent{{start: int(inode.Blocks[0]), length: GetSizeInBlocks(len(want))}}, inode.inlineExtents())
+	require.Zero(t, inode.Indirect)
+	require.Zero(t, inode.DoubleIndirect)
+	require.Equal(t, free-GetSizeInBlocks(len(want))-1, filesystem.freeBlocks.free)
+
+	// appending continues the last extent, unless the blocks after it are
+	// taken, as the root directory's is after the first append
+	for i := 0; i < 3; i++ {
+		require.NoError(t, filesystem.Append("/big", patterned(3*BlockSize)))
+		want = append(want, patterned(3*BlockSize)...)
+		require.Len(t, inode.inlineExtents(), 2)
+	}
+	require.NoError(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	require.NoError(t, reloaded.CheckInvariants())
+}
+
+// fragment makes /frag a file of n one-block extents, by creating a file
+// after each block appended to it.
+func fragment(t *testing.T, filesystem *FileSystem, n int) ([]byte, *Inode) {
+	inode, err := filesystem.CreateFile("/frag", bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	want := []byte{}
+	for i := 0; i < n; i++ {
+		block := patterned((i + 1) * BlockSize)[i*BlockSize:]
+		require.NoError(t, filesystem.Append("/frag", block))
+		want = append(want, block...)
+		_, err = filesystem.CreateFile(fmt.Sprintf("/spacer%d", i), bytes.NewBuffer([]byte("x")))
+		require.NoError(t, err)
+	}
+	return want, inode
+}
+
+func TestExtentBlocks(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	free := filesystem.freeBlocks.free
+
+	// the extents past the inline ones are held in an extent block
+	want, inode := fragment(t, filesystem, inlineExtents+3)
+	require.Len(t, inode.inlineExtents(), inlineExtents)
+	require.NotZero(t, inode.Indirect)
+	require.Zero(t, inode.DoubleIndirect)
+	require.NoError(t, filesystem.CheckInvariants())
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Equal(t, BlockKindExtents, layout[inode.Indirect].Kind)
+	require.Equal(t, int(inode.Index), layout[inode.Indirect].Inode)
+	// the data blocks, the extent block, the spacers and the root directory's
+	// block
+	require.Equal(t, free-len(want)/BlockSize-1-(inlineExtents+3)-1, filesystem.freeBlocks.free)
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	f, err := reloaded.Open("/frag", O_RDONLY)
+	require.NoError(t, err)
+	read, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, want, read)
+	require.NoError(t, f.Close())
+
+	// shrinking to the inline extents frees the extent block
+	free = reloaded.freeBlocks.free
+	require.NoError(t, reloaded.Truncate("/frag", 2*BlockSize))
+	inode, err = reloaded.FindInodeByName("/frag")
+	require.NoError(t, err)
+	require.Zero(t, inode.Indirect)
+	require.Equal(t, free+len(want)/BlockSize-2+1, reloaded.freeBlocks.free)
+	require.NoError(t, reloaded.CheckInvariants())
+	contents, err = reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want[:2*BlockSize], contents.Bytes())
+}
+
+func TestExtentsCorruption(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	want, inode := fragment(t, filesystem, inlineExtents+3)
+	require.NoError(t, filesystem.Close())
+
+	// an extent block holding no extents
+	buf := make([]byte, BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	require.NoError(t, dev.ReadBlock(uint64(inode.Indirect), buf))
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	require.NoError(t, dev.WriteBlock(uint64(inode.Indirect), buf))
+	_, err := LoadFilesystem(dev)
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.ErrorContains(t, err, "holds 0 extents")
+
+	// fsck keeps the inline extents
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Contains(t, report.Repairs, "inode 1: dropped its extent blocks")
+	require.Empty(t, report.Remaining)
+	repaired, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	contents, err := repaired.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want[:inlineExtents*BlockSize], contents.Bytes())
+	require.NoError(t, repaired.CheckInvariants())
+}
+
+// runDevice is an ArrayBlockDevice counting the runs of blocks read.
+type runDevice struct {
+	*ArrayBlockDevice
+	runs int
+}
+
+func (dev *runDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	dev.runs++
+	return dev.ArrayBlockDevice.ReadBlocks(start, bufs)
+}
+
+func TestExtentsReadRuns(t *testing.T) {
+	dev := &runDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, (DataStartIndex+32)*BlockSize))}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	want := patterned(5 * BlockSize)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(want))
+	require.NoError(t, err)
+
+	// the extent is read at once, by ReadFileContents and File.Read alike
+	dev.runs = 0
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	require.Equal(t, 1, dev.runs)
+
+	f, err := filesystem.Open("/foo", O_RDONLY)
+	require.NoError(t, err)
+	read := make([]byte, len(want))
+	_, err = io.ReadFull(f, read)
+	require.NoError(t, err)
+	require.Equal(t, want, read)
+	require.Equal(t, 2, dev.runs)
+	require.NoError(t, f.Close())
+}
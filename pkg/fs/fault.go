@@ -0,0 +1,206 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInjectedFault is returned by the operations a FaultInjectingBlockDevice
+// fails.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultKind is what a fault does to the operation it hits.
+type FaultKind int
+
+const (
+	// FaultFail fails the operation with ErrInjectedFault, leaving the
+	// block as it was.
+	FaultFail FaultKind = iota
+	// FaultTorn writes only the first half of the block and reports
+	// success, like a write cut short by a power failure. On reads, it
+	// fails like FaultFail.
+	FaultTorn
+	// FaultCorrupt flips the bits of a byte in the middle of the block:
+	// reads return corrupted data, and writes store it.
+	FaultCorrupt
+	// FaultDrop reports success without writing anything, like a write
+	// lost in a volatile cache. On reads, it fails like FaultFail.
+	FaultDrop
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultFail:
+		return "fail"
+	case FaultTorn:
+		return "torn"
+	case FaultCorrupt:
+		return "corrupt"
+	case FaultDrop:
+		return "drop"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault describes which operations of a FaultInjectingBlockDevice go wrong,
+// and how.
+type Fault struct {
+	Kind FaultKind
+	// Write selects writes; otherwise the fault hits reads.
+	Write bool
+	// Blocks restricts the fault to these blocks. Nil means every block.
+	Blocks []uint64
+	// After lets that many of the operations the fault selects through
+	// before it hits.
+	After int
+	// Count is how many operations it hits then. Zero means all of them.
+	Count int
+}
+
+// FaultInjectingBlockDevice wraps a BlockDevice and makes chosen operations
+// go wrong, to test how a FileSystem handles failing devices and crashes:
+// see Inject. It is safe for concurrent use.
+type FaultInjectingBlockDevice struct {
+	dev BlockDevice
+	// mu guards the faults and the counts
+	mu     sync.Mutex
+	faults []*injectedFault
+	reads  int
+	writes int
+}
+
+// injectedFault is a Fault and the operations it selected so far.
+type injectedFault struct {
+	Fault
+	seen int
+}
+
+// NewFaultInjectingBlockDevice wraps dev. It injects no faults until told
+// to with Inject.
+func NewFaultInjectingBlockDevice(dev BlockDevice) *FaultInjectingBlockDevice {
+	return &FaultInjectingBlockDevice{dev: dev}
+}
+
+// Inject adds a fault. When several faults select an operation, the one
+// injected first hits it.
+func (d *FaultInjectingBlockDevice) Inject(f Fault) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults = append(d.faults, &injectedFault{Fault: f})
+}
+
+// CrashAfter drops every write after the first n from now on, as if the
+// machine crashed then: the device keeps what was written before, and the
+// FileSystem carries on unaware. Mount the wrapped device again to see
+// what the crash left.
+func (d *FaultInjectingBlockDevice) CrashAfter(n int) {
+	d.Inject(Fault{Kind: FaultDrop, Write: true, After: n})
+}
+
+// Clear removes every fault.
+func (d *FaultInjectingBlockDevice) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults = nil
+}
+
+// Operations returns the number of reads and writes made so far, whether
+// they were hit by a fault or not.
+func (d *FaultInjectingBlockDevice) Operations() (reads, writes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads, d.writes
+}
+
+// hit counts an operation and returns the fault hitting it, if any.
+func (d *FaultInjectingBlockDevice) hit(write bool, blockNum uint64) (*Fault, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if write {
+		d.writes++
+	} else {
+		d.reads++
+	}
+	for _, f := range d.faults {
+		if f.Write != write || !f.selects(blockNum) {
+			continue
+		}
+		f.seen++
+		if f.seen > f.After && (f.Count == 0 || f.seen <= f.After+f.Count) {
+			return &f.Fault, true
+		}
+	}
+	return nil, false
+}
+
+// selects reports whether the fault is restricted to blockNum, if to any
+// blocks.
+func (f *injectedFault) selects(blockNum uint64) bool {
+	if f.Blocks == nil {
+		return true
+	}
+	for _, b := range f.Blocks {
+		if b == blockNum {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadBlock reads a block, unless a fault hits the read.
+func (d *FaultInjectingBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	f, ok := d.hit(false, blockNum)
+	if !ok {
+		return d.dev.ReadBlock(blockNum, buf)
+	}
+	if f.Kind != FaultCorrupt {
+		return fmt.Errorf("error reading block %d: %w", blockNum, ErrInjectedFault)
+	}
+	err := d.dev.ReadBlock(blockNum, buf)
+	if err != nil {
+		return err
+	}
+	corrupt(buf)
+	return nil
+}
+
+// WriteBlock writes a block, unless a fault hits the write.
+func (d *FaultInjectingBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	f, ok := d.hit(true, blockNum)
+	if !ok {
+		return d.dev.WriteBlock(blockNum, buf)
+	}
+	switch f.Kind {
+	case FaultTorn:
+		block := make([]byte, BlockSize)
+		err := d.dev.ReadBlock(blockNum, block)
+		if err != nil {
+			return err
+		}
+		copy(block[:BlockSize/2], buf)
+		return d.dev.WriteBlock(blockNum, block[:len(buf)])
+	case FaultCorrupt:
+		corrupted := append([]byte{}, buf...)
+		corrupt(corrupted)
+		return d.dev.WriteBlock(blockNum, corrupted)
+	case FaultDrop:
+		return nil
+	default:
+		return fmt.Errorf("error writing block %d: %w", blockNum, ErrInjectedFault)
+	}
+}
+
+// corrupt flips the bits of the byte in the middle of buf.
+func corrupt(buf []byte) {
+	if len(buf) > 0 {
+		buf[len(buf)/2] ^= 0xff
+	}
+}
+
+// BlockCount returns the number of blocks of the wrapped device, or 0 if
+// it doesn't know.
+func (d *FaultInjectingBlockDevice) BlockCount() uint64 {
+	return deviceSize(d.dev)
+}
@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjectingBlockDevice(t *testing.T) {
+	disk := make([]byte, 4*BlockSize)
+	dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(disk))
+	ones := bytes.Repeat([]byte{1}, BlockSize)
+	twos := bytes.Repeat([]byte{2}, BlockSize)
+	buf := make([]byte, BlockSize)
+
+	// the second write of block 1 fails, and only that one
+	dev.Inject(Fault{Kind: FaultFail, Write: true, Blocks: []uint64{1}, After: 1, Count: 1})
+	require.NoError(t, dev.WriteBlock(1, ones))
+	require.NoError(t, dev.WriteBlock(2, ones))
+	require.ErrorIs(t, dev.WriteBlock(1, twos), ErrInjectedFault)
+	require.Equal(t, ones, disk[BlockSize:2*BlockSize])
+	require.NoError(t, dev.WriteBlock(1, twos))
+	dev.Clear()
+
+	dev.Inject(Fault{Kind: FaultTorn, Write: true, Count: 1})
+	require.NoError(t, dev.WriteBlock(2, twos))
+	require.Equal(t, twos[:BlockSize/2], disk[2*BlockSize:2*BlockSize+BlockSize/2])
+	require.Equal(t, ones[BlockSize/2:], disk[2*BlockSize+BlockSize/2:3*BlockSize])
+
+	dev.Inject(Fault{Kind: FaultCorrupt, Count: 1})
+	require.NoError(t, dev.ReadBlock(1, buf))
+	require.NotEqual(t, twos, buf)
+	require.NoError(t, dev.ReadBlock(1, buf))
+	require.Equal(t, twos, buf)
+
+	dev.CrashAfter(1)
+	require.NoError(t, dev.WriteBlock(3, ones))
+	require.NoError(t, dev.WriteBlock(3, twos))
+	require.NoError(t, dev.WriteBlock(0, twos))
+	require.Equal(t, ones, disk[3*BlockSize:])
+	require.Equal(t, make([]byte, BlockSize), disk[:BlockSize])
+
+	reads, writes := dev.Operations()
+	require.Equal(t, 2, reads)
+	require.Equal(t, 8, writes)
+}
+
+func TestFaultInjectingBlockDeviceReadFailure(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(disk))
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	dev.Inject(Fault{Kind: FaultFail, Blocks: []uint64{uint64(inode.Blocks[0])}})
+	_, err = filesystem.ReadFileContents(int(inode.Index))
+	require.ErrorIs(t, err, ErrInjectedFault)
+}
+
+// TestCrashConsistency crashes a journaled filesystem after every write of a
+// few operations in turn, and checks that what each crash leaves mounts
+// and is consistent.
+func TestCrashConsistency(t *testing.T) {
+	opts := MkfsOptions{Blocks: 400, JournalBlocks: 64, Checksums: true}
+	image := make([]byte, int(opts.Blocks)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(image), opts)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/old", bytes.NewBufferString("old"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	run := func(filesystem *FileSystem) {
+		filesystem.Mkdir("/dir")
+		filesystem.CreateFile("/dir/file", bytes.NewBuffer(bytes.Repeat([]byte("x"), 3*BlockSize)))
+		filesystem.Rename("/old", "/dir/old")
+		filesystem.Truncate("/dir/file", 10)
+		filesystem.DeleteFile("/dir/old")
+	}
+
+	// count the writes of a run without a crash
+	dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(bytes.Clone(image)))
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, before := dev.Operations()
+	run(filesystem)
+	_, after := dev.Operations()
+	require.Greater(t, after-before, 10)
+
+	for n := 0; n < after-before; n++ {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			disk := bytes.Clone(image)
+			dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(disk))
+			filesystem, err := LoadFilesystem(dev)
+			require.NoError(t, err)
+			dev.CrashAfter(n)
+			run(filesystem)
+
+			// mounting replays the journal
+			recovered, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.NoError(t, recovered.Close())
+			report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+		})
+	}
+}
@@ -0,0 +1,647 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+)
+
+// ErrNotExist, ErrExist and ErrClosed are those of io/fs, so errors.Is
+// matches them against either. Errors are wrapped with the operation and
+// path, so callers should compare them with errors.Is.
+var (
+	// ErrNotExist is returned when a path doesn't name an existing file.
+	ErrNotExist = iofs.ErrNotExist
+	// ErrExist is returned when creating a file whose name is taken.
+	ErrExist = iofs.ErrExist
+	// ErrClosed is returned when using a File after closing it.
+	ErrClosed = iofs.ErrClosed
+	// ErrNoSpace is returned when there aren't enough free data blocks or
+	// inodes for an operation.
+	ErrNoSpace = errors.New("no space left on device")
+	// ErrIsDirectory is returned when a path names a directory where a
+	// file is needed.
+	ErrIsDirectory = errors.New("is a directory")
+	// ErrNotDirectory is returned when a path names a file where a
+	// directory is needed, including on the way to another file.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrNotEmpty is returned when removing a directory that has entries.
+	ErrNotEmpty = errors.New("directory not empty")
+	// ErrTooLarge is returned when a file would grow past MaxFileSize.
+	ErrTooLarge = errors.New("file too large")
+	// ErrInvalidName is returned when a name can't be stored in a
+	// directory, see MaxNameLength.
+	ErrInvalidName = errors.New("invalid name")
+	// ErrStale is returned when using a File that was deleted, even if its
+	// inode index was reused by another file since.
+	ErrStale = errors.New("stale file handle")
+	// ErrPermission is returned when the credentials in effect don't allow
+	// an operation, see SetCredentials. It is that of io/fs.
+	ErrPermission = iofs.ErrPermission
+)
+
+// Flags for OpenFile. Exactly one of O_RDONLY, O_WRONLY and O_RDWR must be
+// given; the others may be or'ed in to control behavior.
+const (
+	// O_RDONLY opens the file for reading only.
+	O_RDONLY = 0x0
+	// O_WRONLY opens the file for writing only.
+	O_WRONLY = 0x1
+	// O_RDWR opens the file for reading and writing.
+	O_RDWR = 0x2
+	// O_CREATE creates the file if it doesn't exist.
+	O_CREATE = 0x40
+	// O_EXCL, used with O_CREATE, makes OpenFile fail if the file exists.
+	O_EXCL = 0x80
+	// O_TRUNC truncates a writable file to zero length when opening it.
+	O_TRUNC = 0x200
+	// O_APPEND makes every write go to the end of the file.
+	O_APPEND = 0x400
+
+	// accessModeMask selects the O_RDONLY/O_WRONLY/O_RDWR part of the flags.
+	accessModeMask = 0x3
+)
+
+// File is an open file, returned by OpenFile.
+type File struct {
+	fs         *FileSystem
+	name       string
+	inodeIndex int
+	// generation is the generation of the inode when it was opened
+	generation uint32
+	flag       int
+	// offset is where the next read or write starts
+	offset int64
+	// block holds partially read blocks, so reads don't allocate
+	block  []byte
+	closed bool
+}
+
+// Open opens the file with the given absolute name, with the flag semantics
+// of os.OpenFile. Files it creates get DefaultFileMode.
+func (fs *FileSystem) Open(filename string, flag int) (*File, error) {
+	return fs.OpenFile(filename, flag, DefaultFileMode)
+}
+
+// OpenFile opens the file with the given absolute name, following the flag
+// semantics of os.OpenFile. If the file is created, it gets the permission
+// bits in perm.
+func (fs *FileSystem) OpenFile(filename string, flag int, perm iofs.FileMode) (_ *File, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("OpenFile %s", filename)
+	defer fs.checkInvariantsAfter("OpenFile")()
+
+	inode, err := fs.findInode(filename)
+	switch {
+	case err == nil:
+		if flag&O_CREATE != 0 && flag&O_EXCL != 0 {
+			return nil, fmt.Errorf("error opening %s: %w", filename, ErrExist)
+		}
+	case errors.Is(err, ErrNotExist) && flag&O_CREATE != 0:
+		inode, err = fs.createFile(filename, &bytes.Buffer{}, perm)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s: %w", filename, err)
+		}
+	default:
+		return nil, fmt.Errorf("error opening %s: %w", filename, err)
+	}
+
+	return fs.openInode(filename, inode, flag)
+}
+
+// openInode opens inode, a file found as filename, for OpenFile.
+func (fs *FileSystem) openInode(filename string, inode *Inode, flag int) (*File, error) {
+	// keep the inode loaded while the file is open
+	inode, err := fs.pinInode(int(inode.Index))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", filename, err)
+	}
+	if inode.Type != InodeTypeFile {
+		fs.inodes.unpin(int(inode.Index))
+		return nil, fmt.Errorf("error opening %s: %w", filename, ErrIsDirectory)
+	}
+	err = fs.checkOpenAccess(inode, flag)
+	if err != nil {
+		fs.inodes.unpin(int(inode.Index))
+		return nil, fmt.Errorf("error opening %s: %w", filename, err)
+	}
+
+	f := &File{
+		fs:         fs,
+		name:       filename,
+		inodeIndex: int(inode.Index),
+		generation: inode.Generation,
+		flag:       flag,
+	}
+
+	if flag&O_TRUNC != 0 && f.writable() && inode.Size > 0 {
+		err = fs.checkRetained(inode)
+		if err == nil {
+			err = fs.setInodeContents(f.inodeIndex, &bytes.Buffer{})
+		}
+		if err != nil {
+			fs.inodes.unpin(f.inodeIndex)
+			return nil, fmt.Errorf("error truncating %s: %w", filename, err)
+		}
+	}
+
+	return f, nil
+}
+
+// Name returns the name the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) readable() bool {
+	return f.flag&accessModeMask != O_WRONLY
+}
+
+func (f *File) writable() bool {
+	return f.flag&accessModeMask != O_RDONLY
+}
+
+// inode returns the file's inode, failing with ErrStale if it was deleted
+// since the file was opened.
+func (f *File) inode() (*Inode, error) {
+	inode, err := f.fs.inode(f.inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if inode == nil || inode.Generation != f.generation {
+		return nil, fmt.Errorf("error accessing %s: %w", f.name, ErrStale)
+	}
+	return inode, nil
+}
+
+// size returns the size of the file.
+func (f *File) size() (int64, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	inode, err := f.inode()
+	if err != nil {
+		return 0, err
+	}
+	return int64(inode.Size), nil
+}
+
+// Read reads up to len(p) bytes from the current offset.
+// It returns io.EOF at the end of the file.
+//
+// Only the blocks holding the requested bytes are read. Whole blocks are
+// read straight into p, a run of consecutive blocks at a time on devices that
+// support it, and once the File has read a partial block, further reads don't
+// allocate. Blocks past the direct blocks of the inode take a read or two of
+// pointer blocks each, and those past the inline extents a read of extent
+// blocks per run. Compressed files are decompressed whole on every read.
+func (f *File) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+	if !f.readable() {
+		return 0, fmt.Errorf("error reading %s: file not opened for reading", f.name)
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	lock := f.fs.inodeLock(f.inodeIndex)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	inode, err := f.inode()
+	if err != nil {
+		return 0, err
+	}
+	if f.fs.explain != nil {
+		f.fs.explainOp("Read %s (%d bytes at offset %d)", f.name, len(p), f.offset)
+	}
+	size := int64(inode.Size)
+	if f.offset >= size {
+		return 0, io.EOF
+	}
+	f.fs.noteAccess(f.inodeIndex)
+	n, err := f.fs.readAt(inode, p, f.offset, &f.block)
+	f.offset += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("error reading %s: %w", f.name, err)
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes of the file with the given absolute name,
+// starting at offset off, as io.ReaderAt does: if fewer bytes are read, it
+// is because the file ends, and the error is io.EOF. Only the blocks
+// holding the requested bytes are read, as in File.Read, so unlike
+// ReadFile it doesn't verify the contents checksum of the file.
+func (fs *FileSystem) ReadAt(filename string, p []byte, off int64) (int, error) {
+	return fs.ReadAtContext(context.Background(), filename, p, off)
+}
+
+// ReadAtContext is ReadAt under ctx, see context.go.
+func (fs *FileSystem) ReadAtContext(ctx context.Context, filename string, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("error reading %s: negative offset %d", filename, off)
+	}
+	defer fs.lockRead(ctx)()
+	inode, err := fs.findFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	lock := fs.inodeLock(int(inode.Index))
+	lock.RLock()
+	defer lock.RUnlock()
+	if fs.explain != nil {
+		fs.explainOp("ReadAt %s (%d bytes at offset %d)", filename, len(p), off)
+	}
+	err = fs.checkAccess(inode, accessRead)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	if off >= int64(inode.Size) {
+		return 0, io.EOF
+	}
+	fs.noteAccess(int(inode.Index))
+	n, err := fs.readAt(inode, p, off, nil)
+	if err != nil {
+		return n, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAt reads up to len(p) bytes of inode starting at offset, stopping at
+// the end of the file. Partial blocks are read into *block, which is
+// allocated on first use and may be kept for further reads.
+func (fs *FileSystem) readAt(inode *Inode, p []byte, offset int64, block *[]byte) (int, error) {
+	if inode.compressed() {
+		return fs.readCompressedAt(inode, p, offset)
+	}
+	if block == nil {
+		block = new([]byte)
+	}
+	size := int64(inode.Size)
+	n := 0
+	for n < len(p) && offset < size {
+		i := int(offset / BlockSize)
+		if (i >= directBlocks || inode.Indirect != 0) && *block == nil {
+			*block = make([]byte, BlockSize)
+		}
+		blockIndex, run, err := fs.runAt(inode, i, *block)
+		if err != nil {
+			return n, err
+		}
+		blockOffset := int(offset % BlockSize)
+		// read whole blocks that fit in p directly, a run at a time
+		direct := blockOffset == 0 && len(p)-n >= BlockSize && size-offset >= BlockSize
+		if whole := int((size - offset) / BlockSize); run > whole {
+			run = whole
+		}
+		if whole := (len(p) - n) / BlockSize; run > whole {
+			run = whole
+		}
+		if direct && run > 1 {
+			err = fs.readBlocks(uint64(blockIndex), p[n:n+run*BlockSize])
+			if err != nil {
+				return n, fmt.Errorf("error reading blocks %d to %d: %w", blockIndex, blockIndex+uint32(run)-1, err)
+			}
+			n += run * BlockSize
+			offset += int64(run) * BlockSize
+			continue
+		}
+		dst := p[n:]
+		if !direct {
+			if *block == nil {
+				*block = make([]byte, BlockSize)
+			}
+			dst = *block
+		}
+		err = fs.readBlock(uint64(blockIndex), dst[:BlockSize])
+		if err != nil {
+			return n, fmt.Errorf("error reading block %d: %w", blockIndex, err)
+		}
+
+		read := BlockSize - blockOffset
+		if left := size - offset; left < int64(read) {
+			read = int(left)
+		}
+		if !direct {
+			read = copy(p[n:], (*block)[blockOffset:blockOffset+read])
+		}
+		n += read
+		offset += int64(read)
+	}
+	return n, nil
+}
+
+// Write writes p at the current offset, or at the end of the file if it was
+// opened with O_APPEND, growing the file as needed. Writing past the end of
+// the file fills the gap with zeros. On write-once filesystems, overwriting
+// data fails with ErrWORM until the file's retention period has passed.
+//
+// Only the blocks p covers are written, along with the blocks filling a gap;
+// blocks that are partially overwritten are read first. If it fails, the
+// file is left as it was. Writes that stay within the file run concurrently
+// with reads and writes of other files.
+func (f *File) Write(p []byte) (n int, err error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+	if !f.writable() {
+		return 0, fmt.Errorf("error writing %s: file not opened for writing", f.name)
+	}
+	n, done, err := f.overwrite(p)
+	if done {
+		return n, err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	defer f.fs.commit(&err)
+	f.fs.explainOp("Write %s (%d bytes at offset %d)", f.name, len(p), f.offset)
+	defer f.fs.checkInvariantsAfter("Write")()
+
+	inode, err := f.inode()
+	if err != nil {
+		return 0, err
+	}
+	if f.flag&O_APPEND != 0 {
+		f.offset = int64(inode.Size)
+	}
+	if f.offset < int64(inode.Size) {
+		err = f.fs.checkRetained(inode)
+		if err != nil {
+			return 0, fmt.Errorf("error writing %s at offset %d: %w", f.name, f.offset, err)
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.block == nil {
+		f.block = make([]byte, BlockSize)
+	}
+	err = f.fs.writeAt(inode, p, f.offset, f.block)
+	if err != nil {
+		return 0, fmt.Errorf("error writing %s: %w", f.name, err)
+	}
+
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// overwrite is Write for writes within the file, which change no metadata
+// and so only hold the filesystem's lock for reading. It reports false,
+// having done nothing, if the write needs the lock for writing.
+func (f *File) overwrite(p []byte) (int, bool, error) {
+	if f.flag&O_APPEND != 0 || len(p) == 0 {
+		return 0, false, nil
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	inode, err := f.inode()
+	if err != nil || !f.fs.canOverwrite(inode, f.offset, len(p)) {
+		return 0, false, nil
+	}
+	f.fs.explainOp("Write %s (%d bytes at offset %d)", f.name, len(p), f.offset)
+	lock := f.fs.inodeLock(f.inodeIndex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = f.fs.checkRetained(inode)
+	if err != nil {
+		return 0, true, fmt.Errorf("error writing %s at offset %d: %w", f.name, f.offset, err)
+	}
+	if f.block == nil {
+		f.block = make([]byte, BlockSize)
+	}
+	err = f.fs.overwrite(inode, p, f.offset, f.block)
+	if err != nil {
+		return 0, true, fmt.Errorf("error writing %s: %w", f.name, err)
+	}
+	f.fs.noteModified(f.inodeIndex)
+	f.offset += int64(len(p))
+	return len(p), true, nil
+}
+
+// Seek sets the offset of the next Read or Write, relative to the start of
+// the file for io.SeekStart, to the current offset for io.SeekCurrent and to
+// the end of the file for io.SeekEnd, and returns the new offset. Seeking
+// past the end is allowed; writing there fills the gap with zeros.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("error seeking in %s: invalid whence %d", f.name, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("error seeking in %s: negative offset %d", f.name, offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// writeAt writes p to the contents of inode at offset, using block as
+// scratch space. It allocates the blocks the file grows into, and persists
+// the inode table and, if blocks were allocated, the data bitmap. If it
+// fails, the inode and the data bitmap are left as they were.
+func (fs *FileSystem) writeAt(inode *Inode, p []byte, offset int64, block []byte) (err error) {
+	size := int64(inode.Size)
+	end := offset + int64(len(p))
+	if end > MaxFileSize {
+		return fmt.Errorf("writing up to offset %d: %w", end, ErrTooLarge)
+	}
+	if inode.compressed() {
+		return fs.writeCompressedAt(inode, p, offset)
+	}
+	nBlocks := GetSizeInBlocks(int(size))
+	nTotalBlocks := nBlocks
+	if end > size {
+		nTotalBlocks = GetSizeInBlocks(int(end))
+	}
+
+	snapshot := fs.snapshot(int(inode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	if end > size && inode.Type == InodeTypeFile {
+		err = fs.chargeQuota(snapshot, inode, end-size, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	// the blocks written to, from the old end of the file if it is
+	// past it; blocks shared through the dedup table are copied first
+	first := offset
+	if size < first {
+		first = size
+	}
+	var blocks []uint32
+	if nTotalBlocks > nBlocks {
+		old, err := fs.readBlockMap(inode)
+		if err != nil {
+			return err
+		}
+		newBlocks, err := fs.findContiguousBlocks(nTotalBlocks-nBlocks, old.data)
+		if err != nil {
+			return fmt.Errorf("not enough free blocks to grow to %d bytes: %w", end, err)
+		}
+		for _, blockIndex := range newBlocks {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		blocks = append(append([]uint32{}, old.data...), newBlocks...)
+		_, err = fs.unshare(inode, blocks, int(first/BlockSize), nBlocks, true)
+		if err != nil {
+			return err
+		}
+		err = fs.mapBlocks(inode, old, blocks)
+		if err != nil {
+			return err
+		}
+	} else {
+		blocks, err = fs.unshareMapped(inode, int(first/BlockSize), GetSizeInBlocks(int(end)), true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fs.writeData(inode, blocks, size, p, offset, block)
+	if err != nil {
+		return err
+	}
+
+	if offset >= size {
+		fs.extendContentSum(inode, offset-size, p)
+	}
+	if end > size {
+		inode.Size = uint32(end)
+	}
+	if offset < size {
+		err = fs.recomputeContentSum(inode)
+		if err != nil {
+			return err
+		}
+	}
+	fs.touch(inode)
+	err = fs.writeInodeTable()
+	if err != nil {
+		return err
+	}
+	if nTotalBlocks > nBlocks || fs.dedup != nil {
+		return fs.persistDataBitmap()
+	}
+	return nil
+}
+
+// writeData writes p to the data blocks of inode at offset, along with the
+// zeros filling any gap from size, the size of the file before the write.
+// blocks lists the data blocks of the file grown to fit p.
+func (fs *FileSystem) writeData(inode *Inode, blocks []uint32, size int64, p []byte, offset int64, block []byte) error {
+	end := offset + int64(len(p))
+	nBlocks := GetSizeInBlocks(int(size))
+
+	// the blocks from the old end of the file, to zero a gap, or from the
+	// start of p, to the end of p
+	first := offset
+	if size < first {
+		first = size
+	}
+	for i := int(first / BlockSize); int64(i)*BlockSize < end; i++ {
+		blockStart := int64(i) * BlockSize
+		blockIndex := blocks[i]
+		// blocks p only partly covers are read first, to keep the rest
+		// of their data
+		covered := offset <= blockStart && end >= blockStart+BlockSize
+		if i < nBlocks && !covered {
+			err := fs.readBlock(uint64(blockIndex), block)
+			if err != nil {
+				return fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inode.Index, err)
+			}
+		} else {
+			for j := range block {
+				block[j] = 0
+			}
+		}
+		if offset < blockStart+BlockSize && end > blockStart {
+			from := offset - blockStart
+			if from < 0 {
+				from = 0
+			}
+			copy(block[from:], p[blockStart+from-offset:])
+		}
+		fs.revoke(uint64(blockIndex))
+		err := fs.writeBlock(uint64(blockIndex), block)
+		if err != nil {
+			return fmt.Errorf("error writing block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+	}
+	return nil
+}
+
+// canOverwrite reports whether n bytes can be written at offset of inode in
+// place, changing no metadata: they end within the file, the file isn't
+// compressed, the filesystem is already marked dirty and has no dedup table,
+// whose blocks may be shared, and the journal, if any, wasn't aborted.
+func (fs *FileSystem) canOverwrite(inode *Inode, offset int64, n int) bool {
+	return fs.dirty && fs.dedup == nil && !fs.journalAborted() && !inode.compressed() && offset+int64(n) <= int64(inode.Size)
+}
+
+// overwrite writes p to the contents of inode at offset, in place, using
+// block as scratch space. See canOverwrite.
+func (fs *FileSystem) overwrite(inode *Inode, p []byte, offset int64, block []byte) error {
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return err
+	}
+	return fs.writeData(inode, blocks, int64(inode.Size), p, offset, block)
+}
+
+// Stat describes the file. It implements io/fs.File along with Read and
+// Close, and returns a FileInfo.
+func (f *File) Stat() (iofs.FileInfo, error) {
+	if f.closed {
+		return nil, ErrClosed
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	inode, err := f.inode()
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.fileInfo(baseName(f.name), inode), nil
+}
+
+// Close closes the file. Writes are persisted as they happen, so closing
+// only invalidates the File and lets its inode be evicted from the cache.
+func (f *File) Close() error {
+	if f.closed {
+		return ErrClosed
+	}
+	f.closed = true
+	f.fs.inodes.unpin(f.inodeIndex)
+	return nil
+}
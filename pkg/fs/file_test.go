@@ -0,0 +1,339 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFileCreate(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+
+	// without O_CREATE, missing files can't be opened
+	_, err := filesystem.OpenFile("/foo", O_RDWR, 0600)
+	require.ErrorIs(t, err, ErrNotExist)
+
+	f, err := filesystem.OpenFile("/foo", O_RDWR|O_CREATE, 0600)
+	require.NoError(t, err)
+	require.Equal(t, "/foo", f.Name())
+	n, err := f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.NoError(t, f.Close())
+
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0600), inode.Mode)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "hello", contents.String())
+
+	// O_CREATE opens the existing file
+	f, err = filesystem.OpenFile("/foo", O_RDONLY|O_CREATE, 0600)
+	require.NoError(t, err)
+	buf, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// with O_EXCL it fails instead
+	_, err = filesystem.OpenFile("/foo", O_RDWR|O_CREATE|O_EXCL, 0600)
+	require.ErrorIs(t, err, ErrExist)
+
+	dir, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Len(t, dir, 1)
+}
+
+func TestOpenFileTruncate(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.NoError(t, err)
+	blocks := append([]uint32{}, inode.usedBlocks()...)
+
+	f, err := filesystem.OpenFile("/foo", O_WRONLY|O_TRUNC, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), inode.Size)
+	require.Empty(t, inode.usedBlocks())
+	// the blocks are free again
+	for _, blockIndex := range blocks {
+		require.False(t, filesystem.dataBitmap.test(int(blockIndex-DataStartIndex)))
+	}
+
+	_, err = f.Write([]byte("short"))
+	require.NoError(t, err)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "short", contents.String())
+}
+
+func TestOpenFileAppend(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/log", bytes.NewBufferString("one\n"))
+	require.NoError(t, err)
+
+	f, err := filesystem.OpenFile("/log", O_WRONLY|O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("two\n"))
+	require.NoError(t, err)
+	// growing past a block boundary allocates a new block
+	_, err = f.Write(bytes.Repeat([]byte("x"), BlockSize))
+	require.NoError(t, err)
+
+	inode, err := filesystem.FindInodeByName("/log")
+	require.NoError(t, err)
+	require.Len(t, inode.usedBlocks(), 2)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "one\ntwo\n", contents.String()[:8])
+	require.Equal(t, 8+BlockSize, contents.Len())
+}
+
+func TestFileAccessModes(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	r, err := filesystem.OpenFile("/foo", O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("x"))
+	require.Error(t, err)
+
+	w, err := filesystem.OpenFile("/foo", O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = w.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	// writes start at offset 0 without O_APPEND
+	_, err = w.Write([]byte("J"))
+	require.NoError(t, err)
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "Jello", string(buf))
+
+	require.NoError(t, w.Close())
+	_, err = w.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, w.Close(), ErrClosed)
+}
+
+func TestFileRead(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	contents := make([]byte, 3*BlockSize+100)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+	_, err := filesystem.CreateFile("/foo", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+
+	// buffers smaller than, equal to and larger than a block, misaligned
+	// with the blocks or not
+	for _, size := range []int{1, 1000, BlockSize, BlockSize + 1, 2 * BlockSize, 5 * BlockSize} {
+		f, err := filesystem.OpenFile("/foo", O_RDONLY, 0)
+		require.NoError(t, err)
+		read := []byte{}
+		buf := make([]byte, size)
+		for {
+			n, err := f.Read(buf)
+			read = append(read, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.NotZero(t, n)
+		}
+		require.Equal(t, contents, read, "reading %d bytes at a time", size)
+		require.NoError(t, f.Close())
+	}
+}
+
+func TestReadFileAndReadAt(t *testing.T) {
+	filesystem, _ := newBigTestFileSystem(t)
+	// past the direct blocks, so some reads go through the extent block
+	contents := patterned((directBlocks+3)*BlockSize + 100)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	read, err := filesystem.ReadFile("/foo")
+	require.NoError(t, err)
+	require.Equal(t, contents, read)
+	_, err = filesystem.ReadFile("/dir")
+	require.ErrorIs(t, err, ErrIsDirectory)
+	_, err = filesystem.ReadFile("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+
+	size := int64(len(contents))
+	for _, tt := range []struct {
+		off int64
+		n   int
+	}{
+		{0, 10},
+		{BlockSize - 5, 10},
+		{BlockSize, 3 * BlockSize},
+		{7, directBlocks * BlockSize},
+		{size - 50, 50},
+	} {
+		buf := make([]byte, tt.n)
+		n, err := filesystem.ReadAt("/foo", buf, tt.off)
+		require.NoError(t, err, "reading %d bytes at %d", tt.n, tt.off)
+		require.Equal(t, tt.n, n)
+		require.Equal(t, contents[tt.off:tt.off+int64(tt.n)], buf)
+	}
+
+	// short reads at the end of the file return io.EOF
+	buf := make([]byte, 100)
+	n, err := filesystem.ReadAt("/foo", buf, size-30)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 30, n)
+	require.Equal(t, contents[size-30:], buf[:n])
+	n, err = filesystem.ReadAt("/foo", buf, size)
+	require.ErrorIs(t, err, io.EOF)
+	require.Zero(t, n)
+	_, err = filesystem.ReadAt("/foo", buf, -1)
+	require.Error(t, err)
+	_, err = filesystem.ReadAt("/dir", buf, 0)
+	require.ErrorIs(t, err, ErrIsDirectory)
+}
+
+func TestFileWrite(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	want := bytes.Repeat([]byte("0123456789abcdef"), 4*BlockSize/16)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(bytes.Clone(want)))
+	require.NoError(t, err)
+
+	f, err := filesystem.Open("/foo", O_RDWR)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// overwriting within a block only writes that block, as the inode
+	// doesn't change
+	writes := dev.writes
+	_, err = f.Seek(2*BlockSize+10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 1, dev.writes-writes)
+	copy(want[2*BlockSize+10:], "hello")
+
+	// across a block boundary
+	_, err = f.Seek(BlockSize-2, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("span"))
+	require.NoError(t, err)
+	copy(want[BlockSize-2:], "span")
+
+	// past the end, leaving a gap of zeros
+	offset, err := f.Seek(BlockSize+3, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(5*BlockSize+3), offset)
+	_, err = f.Write([]byte("tail"))
+	require.NoError(t, err)
+	want = append(want, make([]byte, BlockSize+3)...)
+	want = append(want, "tail"...)
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.NoError(t, filesystem.CheckInvariants())
+
+	// a failed write leaves the file as it was
+	_, err = f.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	dev.failWriteAt = dev.writes + 2
+	_, err = f.Write(make([]byte, 2*BlockSize))
+	require.ErrorIs(t, err, errInjected)
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(len(want)), inode.Size)
+	require.NoError(t, filesystem.CheckInvariants())
+
+	_, err = f.Seek(MaxFileSize, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestFileSeek(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+	f, err := filesystem.Open("/foo", O_RDONLY)
+	require.NoError(t, err)
+
+	offset, err := f.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), offset)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.Equal(t, "wor", string(buf))
+
+	offset, err = f.Seek(-4, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), offset)
+	offset, err = f.Seek(-5, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), offset)
+
+	_, err = f.Seek(-1, io.SeekStart)
+	require.ErrorContains(t, err, "negative offset")
+	_, err = f.Seek(0, 3)
+	require.ErrorContains(t, err, "invalid whence")
+
+	require.NoError(t, f.Close())
+	_, err = f.Seek(0, io.SeekStart)
+	require.ErrorIs(t, err, ErrClosed)
+
+	// the File works with io.Copy and friends
+	var _ io.ReadWriteSeeker = f
+	var _ io.Closer = f
+}
+
+func TestErrors(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	file, err := filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	dir, err := filesystem.FindInodeByName("/dir")
+	require.NoError(t, err)
+
+	// the io/fs errors match either sentinel
+	_, err = filesystem.FindInodeByName("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.ErrorIs(t, err, iofs.ErrNotExist)
+	_, err = filesystem.CreateFile("/file", &bytes.Buffer{})
+	require.ErrorIs(t, err, iofs.ErrExist)
+
+	_, err = filesystem.Open("/dir", O_RDONLY)
+	require.ErrorIs(t, err, ErrIsDirectory)
+	require.ErrorIs(t, filesystem.DeleteFile("/dir"), ErrIsDirectory)
+	_, err = filesystem.ReadFileContents(int(dir.Index))
+	require.ErrorIs(t, err, ErrIsDirectory)
+
+	_, err = filesystem.FindInodeByName("/file/x")
+	require.ErrorIs(t, err, ErrNotDirectory)
+	_, err = filesystem.CreateFile("/file/x", &bytes.Buffer{})
+	require.ErrorIs(t, err, ErrNotDirectory)
+	_, err = filesystem.ReadDir(int(file.Index))
+	require.ErrorIs(t, err, ErrNotDirectory)
+
+	// running out of data blocks, and of inodes
+	_, err = filesystem.CreateFile("/big", bytes.NewBuffer(make([]byte, 40*BlockSize)))
+	require.ErrorIs(t, err, ErrNoSpace)
+	for i := 0; ; i++ {
+		_, err = filesystem.CreateFile(fmt.Sprintf("/dir/%d", i), &bytes.Buffer{})
+		if err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, ErrNoSpace)
+}
@@ -0,0 +1,256 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// ErrDirectUnsupported is returned when opening a FileBlockDevice with
+// Direct on a platform without O_DIRECT.
+var ErrDirectUnsupported = errors.New("O_DIRECT is not supported on this platform")
+
+// ErrLocked is returned when opening an image file another process, or
+// another FileBlockDevice, has open in a conflicting way.
+var ErrLocked = errors.New("image is in use")
+
+// FileDeviceOptions configures OpenFileBlockDevice.
+type FileDeviceOptions struct {
+	// Direct opens the image with O_DIRECT, so reads and writes bypass the
+	// host's page cache and benchmarks measure the filesystem rather than
+	// the OS. It is only available on Linux, and not every host filesystem
+	// supports it (tmpfs, for one, may refuse it with EINVAL).
+	Direct bool
+	// ReadOnly opens the image for reading only. Writing to the device
+	// fails.
+	ReadOnly bool
+}
+
+// FileBlockDevice is a BlockDevice backed by an image file. Unlike
+// ArrayBlockDevice, changes go straight to the file.
+type FileBlockDevice struct {
+	f       *os.File
+	nBlocks uint64
+	direct  bool
+}
+
+// OpenFileBlockDevice opens the image file at path, whose size must be a
+// multiple of the block size, for reading and writing.
+//
+// The image is locked against concurrent use: read-write devices take an
+// exclusive lock and read-only ones a shared lock, so any number of readers
+// or a single writer can have it open. If the lock is taken, it fails with
+// ErrLocked rather than waiting. The locks are advisory (flock on Unix,
+// LockFileEx on Windows) and held until Close.
+func OpenFileBlockDevice(path string, opts FileDeviceOptions) (*FileBlockDevice, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	if opts.Direct {
+		if directFlag == 0 {
+			return nil, ErrDirectUnsupported
+		}
+		flag |= directFlag
+	}
+	f, size, err := openImage(path, flag)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlockDevice{
+		f:       f,
+		nBlocks: uint64(size / BlockSize),
+		direct:  opts.Direct,
+	}, nil
+}
+
+// openImage opens and locks the image file at path with the given open
+// flags, locking it exclusively unless it is opened read-only, and returns
+// it along with its size.
+func openImage(path string, flag int) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening image: %w", err)
+	}
+	err = lockFile(f, flag&(os.O_WRONLY|os.O_RDWR) != 0)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("error locking image %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("error opening image: %w", err)
+	}
+	if info.Size()%BlockSize != 0 {
+		f.Close()
+		return nil, 0, fmt.Errorf("image size %d is not a multiple of the block size %d", info.Size(), BlockSize)
+	}
+	return f, info.Size(), nil
+}
+
+// alignedBlocks pools block buffers aligned to the block size, as O_DIRECT
+// requires of the memory it transfers to and from.
+var alignedBlocks = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 2*BlockSize)
+		offset := int(uintptr(unsafe.Pointer(&buf[0])) % BlockSize)
+		if offset != 0 {
+			offset = BlockSize - offset
+		}
+		buf = buf[offset : offset+BlockSize]
+		return &buf
+	},
+}
+
+// ReadBlock reads a block from the image into the buffer.
+func (dev *FileBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	if !dev.direct {
+		return dev.readAt(blockNum, buf)
+	}
+
+	aligned := alignedBlocks.Get().(*[]byte)
+	defer alignedBlocks.Put(aligned)
+	err = dev.readAt(blockNum, *aligned)
+	if err != nil {
+		return err
+	}
+	copy(buf, *aligned)
+	return nil
+}
+
+// ReadBlocks reads consecutive blocks, from start on, from the image, a
+// block into each buffer. Buffers that are consecutive blocks of one
+// buffer, as the FileSystem passes them, are read in one read, unless the
+// image is opened for direct I/O.
+func (dev *FileBlockDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	if joined := joinedBlocks(bufs); joined != nil && !dev.direct {
+		return dev.readAt(start, joined)
+	}
+	for i, buf := range bufs {
+		err = dev.ReadBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBlocks writes the buffers to consecutive blocks of the image, from
+// start on, in one write if ReadBlocks would read them in one read.
+func (dev *FileBlockDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	if joined := joinedBlocks(bufs); joined != nil && !dev.direct {
+		_, err = dev.f.WriteAt(joined, int64(start)*BlockSize)
+		if err != nil {
+			return fmt.Errorf("error writing blocks %d to %d: %w", start, start+uint64(len(bufs))-1, err)
+		}
+		return nil
+	}
+	for i, buf := range bufs {
+		err = dev.WriteBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBlock writes the buffer to a block of the image. Like
+// ArrayBlockDevice, a buffer shorter than a block only overwrites the start
+// of the block.
+func (dev *FileBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	if !dev.direct {
+		_, err = dev.f.WriteAt(buf, int64(blockNum)*BlockSize)
+		if err != nil {
+			return fmt.Errorf("error writing block %d: %w", blockNum, err)
+		}
+		return nil
+	}
+
+	// O_DIRECT only transfers whole, aligned blocks
+	aligned := alignedBlocks.Get().(*[]byte)
+	defer alignedBlocks.Put(aligned)
+	if len(buf) < BlockSize {
+		err = dev.readAt(blockNum, *aligned)
+		if err != nil {
+			return err
+		}
+	}
+	copy(*aligned, buf)
+	_, err = dev.f.WriteAt(*aligned, int64(blockNum)*BlockSize)
+	if err != nil {
+		return fmt.Errorf("error writing block %d: %w", blockNum, err)
+	}
+	return nil
+}
+
+func (dev *FileBlockDevice) readAt(blockNum uint64, buf []byte) error {
+	_, err := dev.f.ReadAt(buf, int64(blockNum)*BlockSize)
+	if err != nil {
+		return fmt.Errorf("error reading block %d: %w", blockNum, err)
+	}
+	return nil
+}
+
+// BlockCount returns the number of blocks in the image.
+func (dev *FileBlockDevice) BlockCount() uint64 {
+	return dev.nBlocks
+}
+
+// Size returns the number of blocks in the image, like BlockCount.
+func (dev *FileBlockDevice) Size() uint64 {
+	return dev.nBlocks
+}
+
+// checkBounds returns an error if blockNum is past the end of the image.
+func (dev *FileBlockDevice) checkBounds(blockNum uint64) error {
+	if blockNum >= dev.nBlocks {
+		return fmt.Errorf("block %d out of range (device has %d blocks)", blockNum, dev.nBlocks)
+	}
+	return nil
+}
+
+// Sync flushes the image file to stable storage.
+func (dev *FileBlockDevice) Sync() error {
+	return dev.f.Sync()
+}
+
+// Flush is Sync.
+func (dev *FileBlockDevice) Flush() error {
+	return dev.Sync()
+}
+
+// Close closes the image file, releasing its lock.
+func (dev *FileBlockDevice) Close() error {
+	return dev.f.Close()
+}
@@ -0,0 +1,6 @@
+package fs
+
+import "syscall"
+
+// directFlag is the open flag for O_DIRECT.
+const directFlag = syscall.O_DIRECT
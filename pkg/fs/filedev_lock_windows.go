@@ -0,0 +1,38 @@
+//go:build windows
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile locks all of f with LockFileEx without waiting, failing with
+// ErrLocked if another handle holds a conflicting lock. Closing f releases
+// it.
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	overlapped := &syscall.Overlapped{}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0,
+		uintptr(^uint32(0)), uintptr(^uint32(0)), uintptr(unsafe.Pointer(overlapped)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
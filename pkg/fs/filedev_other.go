@@ -0,0 +1,6 @@
+//go:build !linux
+
+package fs
+
+// directFlag is 0 where O_DIRECT isn't available.
+const directFlag = 0
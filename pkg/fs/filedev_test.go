@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newImageFile creates an empty image file big enough for every data block.
+func newImageFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "fs.img")
+	require.NoError(t, os.WriteFile(path, make([]byte, (DataStartIndex+32)*BlockSize), 0600))
+	return path
+}
+
+func TestFileBlockDevice(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		opts := FileDeviceOptions{Direct: direct}
+		path := newImageFile(t)
+		dev, err := OpenFileBlockDevice(path, opts)
+		if direct && (errors.Is(err, ErrDirectUnsupported) || errors.Is(err, syscall.EINVAL)) {
+			t.Skipf("O_DIRECT unavailable here: %v", err)
+		}
+		require.NoError(t, err)
+
+		filesystem, err := NewFileSystem(dev)
+		require.NoError(t, err)
+		_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+		require.NoError(t, filesystem.Close())
+		require.NoError(t, dev.Sync())
+		require.NoError(t, dev.Close())
+
+		// the changes are in the file
+		image, err := os.ReadFile(path)
+		require.NoError(t, err)
+		reloaded, err := LoadFilesystem(NewArrayBlockDevice(image))
+		require.NoError(t, err, "direct=%v", direct)
+		inode, err := reloaded.FindInodeByName("/foo")
+		require.NoError(t, err)
+		contents, err := reloaded.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, "hello", contents.String())
+
+		// short writes only change the start of the block
+		dev, err = OpenFileBlockDevice(path, opts)
+		require.NoError(t, err)
+		block := bytes.Repeat([]byte{7}, BlockSize)
+		require.NoError(t, dev.WriteBlock(10, block))
+		require.NoError(t, dev.WriteBlock(10, []byte{1, 2}))
+		buf := make([]byte, BlockSize)
+		require.NoError(t, dev.ReadBlock(10, buf))
+		require.Equal(t, append([]byte{1, 2}, block[2:]...), buf)
+
+		require.Error(t, dev.ReadBlock(DataStartIndex+32, buf))
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestOpenFileBlockDeviceRejectsPartialBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.img")
+	require.NoError(t, os.WriteFile(path, make([]byte, BlockSize+1), 0600))
+	_, err := OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.ErrorContains(t, err, "not a multiple of the block size")
+}
+
+func TestFileBlockDeviceLocking(t *testing.T) {
+	path := newImageFile(t)
+	writer, err := OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.NoError(t, err)
+	_, err = OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.ErrorIs(t, err, ErrLocked)
+	_, err = OpenFileBlockDevice(path, FileDeviceOptions{ReadOnly: true})
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, writer.Close())
+
+	// readers share the image, but keep writers out
+	reader, err := OpenFileBlockDevice(path, FileDeviceOptions{ReadOnly: true})
+	require.NoError(t, err)
+	other, err := OpenFileBlockDevice(path, FileDeviceOptions{ReadOnly: true})
+	require.NoError(t, err)
+	_, err = OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.ErrorIs(t, err, ErrLocked)
+	require.Error(t, reader.WriteBlock(0, make([]byte, BlockSize)))
+	require.NoError(t, reader.Close())
+	require.NoError(t, other.Close())
+
+	writer, err = OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
@@ -0,0 +1,301 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// extent is a run of consecutive bitmap entries.
+type extent struct {
+	start, length int
+}
+
+// freeExtents indexes the free entries of a bitmap as sorted, non-adjacent
+// runs, so allocating doesn't scan the whole bitmap: finding where an entry
+// belongs is a binary search, and collecting n free entries only visits the
+// runs they come from.
+//
+// The bitmaps stay the source of truth that gets persisted; every change to
+// them goes through the FileSystem methods below, which keep the index in
+// step.
+type freeExtents struct {
+	runs []extent
+	free int
+}
+
+// newFreeExtents indexes the free entries of bitmap.
+func newFreeExtents(bitmap *Bitmap) *freeExtents {
+	f := &freeExtents{}
+	for i := 0; i < bitmap.Len(); i++ {
+		if bitmap.Test(i) {
+			continue
+		}
+		f.free++
+		if n := len(f.runs); n > 0 && f.runs[n-1].start+f.runs[n-1].length == i {
+			f.runs[n-1].length++
+		} else {
+			f.runs = append(f.runs, extent{start: i, length: 1})
+		}
+	}
+	return f
+}
+
+// lowest returns the n lowest free entries, in ascending order, or as many
+// as there are if fewer are free.
+func (f *freeExtents) lowest(n int) []int {
+	if n > f.free {
+		n = f.free
+	}
+	entries := make([]int, 0, n)
+	for _, run := range f.runs {
+		for i := run.start; i < run.start+run.length && len(entries) < n; i++ {
+			entries = append(entries, i)
+		}
+		if len(entries) == n {
+			break
+		}
+	}
+	return entries
+}
+
+// contiguous returns n free entries in as few runs as it finds: the ones
+// from goal on, if goal is free, then the first run holding all the rest,
+// and failing that, the longest runs. It returns as many as there are if
+// fewer are free. A negative goal continues nothing.
+func (f *freeExtents) contiguous(n, goal int) []int {
+	return f.pick(n, goal, firstHolding)
+}
+
+// bestFit is contiguous, taking the rest from the smallest run holding all
+// of it rather than the first.
+func (f *freeExtents) bestFit(n, goal int) []int {
+	return f.pick(n, goal, smallestHolding)
+}
+
+// firstHolding returns the index of the first of runs at least n long, or
+// -1 if there is none.
+func firstHolding(runs []extent, n int) int {
+	for r, run := range runs {
+		if run.length >= n {
+			return r
+		}
+	}
+	return -1
+}
+
+// smallestHolding returns the index of the shortest of runs at least n
+// long, the first of them on ties, or -1 if there is none.
+func smallestHolding(runs []extent, n int) int {
+	best := -1
+	for r, run := range runs {
+		if run.length >= n && (best < 0 || run.length < runs[best].length) {
+			best = r
+		}
+	}
+	return best
+}
+
+// pick is contiguous, with holding choosing the run the rest comes from.
+func (f *freeExtents) pick(n, goal int, holding func(runs []extent, n int) int) []int {
+	if n > f.free {
+		n = f.free
+	}
+	entries := make([]int, 0, n)
+	takeFrom := func(run extent) {
+		for i := run.start; i < run.start+run.length && len(entries) < n; i++ {
+			entries = append(entries, i)
+		}
+	}
+
+	// the runs left to pick from once goal is continued
+	runs := f.runs
+	if r := f.find(goal); goal >= 0 && r < len(f.runs) && f.runs[r].start <= goal {
+		run := f.runs[r]
+		takeFrom(extent{start: goal, length: run.start + run.length - goal})
+		runs = append([]extent{}, f.runs[:r]...)
+		if goal > run.start {
+			runs = append(runs, extent{start: run.start, length: goal - run.start})
+		}
+		runs = append(runs, f.runs[r+1:]...)
+	}
+	if len(entries) == n {
+		return entries
+	}
+	if r := holding(runs, n-len(entries)); r >= 0 {
+		takeFrom(runs[r])
+		return entries
+	}
+	runs = append([]extent{}, runs...)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].length > runs[j].length })
+	for _, run := range runs {
+		takeFrom(run)
+		if len(entries) == n {
+			break
+		}
+	}
+	return entries
+}
+
+// find returns the index of the first run ending after entry i.
+func (f *freeExtents) find(i int) int {
+	return sort.Search(len(f.runs), func(r int) bool {
+		return f.runs[r].start+f.runs[r].length > i
+	})
+}
+
+// take removes entry i from the free runs, if it is free.
+func (f *freeExtents) take(i int) {
+	r := f.find(i)
+	if r == len(f.runs) || f.runs[r].start > i {
+		return
+	}
+	run := f.runs[r]
+	f.free--
+	switch {
+	case run.length == 1:
+		f.runs = append(f.runs[:r], f.runs[r+1:]...)
+	case i == run.start:
+		f.runs[r] = extent{start: i + 1, length: run.length - 1}
+	case i == run.start+run.length-1:
+		f.runs[r].length--
+	default:
+		// split the run around i
+		f.runs = append(f.runs, extent{})
+		copy(f.runs[r+2:], f.runs[r+1:])
+		f.runs[r] = extent{start: run.start, length: i - run.start}
+		f.runs[r+1] = extent{start: i + 1, length: run.start + run.length - i - 1}
+	}
+}
+
+// release adds entry i to the free runs, if it isn't free already.
+func (f *freeExtents) release(i int) {
+	r := f.find(i)
+	if r < len(f.runs) && f.runs[r].start <= i {
+		return
+	}
+	f.free++
+	joinsPrev := r > 0 && f.runs[r-1].start+f.runs[r-1].length == i
+	joinsNext := r < len(f.runs) && f.runs[r].start == i+1
+	switch {
+	case joinsPrev && joinsNext:
+		f.runs[r-1].length += 1 + f.runs[r].length
+		f.runs = append(f.runs[:r], f.runs[r+1:]...)
+	case joinsPrev:
+		f.runs[r-1].length++
+	case joinsNext:
+		f.runs[r].start--
+		f.runs[r].length++
+	default:
+		f.runs = append(f.runs, extent{})
+		copy(f.runs[r+1:], f.runs[r:])
+		f.runs[r] = extent{start: i, length: 1}
+	}
+}
+
+// truncate drops the free entries from n on.
+func (f *freeExtents) truncate(n int) {
+	r := f.find(n)
+	if r < len(f.runs) && f.runs[r].start < n {
+		f.free -= f.runs[r].start + f.runs[r].length - n
+		f.runs[r].length = n - f.runs[r].start
+		r++
+	}
+	for _, run := range f.runs[r:] {
+		f.free -= run.length
+	}
+	f.runs = f.runs[:r]
+}
+
+// indexFreeSpace rebuilds the free-space indices from the bitmaps, after
+// they were loaded or replaced wholesale.
+func (fs *FileSystem) indexFreeSpace() {
+	fs.freeInodes = newFreeExtents(fs.inodeBitmap.entries)
+	fs.freeBlocks = newFreeExtents(fs.dataBitmap.entries)
+	for _, q := range fs.quarantine {
+		fs.freeInodes.take(q.index)
+	}
+	if fs.txn != nil {
+		for _, i := range fs.txn.freedBlocks {
+			fs.freeBlocks.take(i)
+		}
+	}
+	if fs.shrinkLimit > 0 {
+		fs.freeBlocks.truncate(fs.shrinkLimit)
+	}
+}
+
+// setInodeAllocated marks an inode used or free in the inode bitmap.
+func (fs *FileSystem) setInodeAllocated(inodeIndex int, allocated bool) {
+	fs.explainBit("inode bitmap", inodeIndex, fs.inodeBitmap.test(inodeIndex), allocated, "inode", uint64(inodeIndex))
+	fs.inodeBitmap.set(inodeIndex, allocated)
+	if allocated {
+		fs.freeInodes.take(inodeIndex)
+	} else {
+		fs.freeInodes.release(inodeIndex)
+	}
+}
+
+// setBlockAllocated marks a data block, given by its device block index,
+// used or free in the data bitmap. Blocks freed in a transaction are kept out
+// of the free-space index until it commits, see Txn, and blocks past the end
+// of a filesystem being shrunk are kept out of it for good.
+func (fs *FileSystem) setBlockAllocated(blockIndex uint32, allocated bool) {
+	i := int(blockIndex - fs.geometry.DataStart)
+	fs.explainBit("data bitmap", i, fs.dataBitmap.test(i), allocated, "block", uint64(blockIndex))
+	fs.dataBitmap.set(i, allocated)
+	switch {
+	case allocated:
+		fs.freeBlocks.take(i)
+	case fs.txn != nil:
+		fs.txn.freedBlocks = append(fs.txn.freedBlocks, i)
+	case fs.shrinkLimit > 0 && i >= fs.shrinkLimit:
+	default:
+		fs.freeBlocks.release(i)
+	}
+}
+
+// checkFreeSpaceIndex reports differences between the free-space indices
+// and the bitmaps, and between the bitmaps and their free counts.
+// Quarantined inodes, blocks freed in a transaction and blocks past the end
+// of a filesystem being shrunk count as taken in the indices.
+func (fs *FileSystem) checkFreeSpaceIndex() []string {
+	inodeBitmap := fs.inodeBitmap.clone()
+	for _, q := range fs.quarantine {
+		inodeBitmap.Set(q.index)
+	}
+	dataBitmap := fs.dataBitmap.clone()
+	if fs.txn != nil {
+		for _, i := range fs.txn.freedBlocks {
+			dataBitmap.Set(i)
+		}
+	}
+	if fs.shrinkLimit > 0 {
+		for i := fs.shrinkLimit; i < dataBitmap.Len(); i++ {
+			dataBitmap.Set(i)
+		}
+	}
+	violations := []string{}
+	for _, index := range []struct {
+		name   string
+		bitmap *Bitmap
+		free   *freeExtents
+	}{
+		{"inode", inodeBitmap, fs.freeInodes},
+		{"data", dataBitmap, fs.freeBlocks},
+	} {
+		want := newFreeExtents(index.bitmap)
+		if fmt.Sprint(want.runs) != fmt.Sprint(index.free.runs) || want.free != index.free.free {
+			violations = append(violations, fmt.Sprintf("free %s index %v (%d free) doesn't match the bitmap %v (%d free)",
+				index.name, index.free.runs, index.free.free, want.runs, want.free))
+		}
+	}
+	for _, b := range []struct {
+		name   string
+		bitmap *bitmap
+	}{{"inode", fs.inodeBitmap}, {"data", fs.dataBitmap}} {
+		if free := b.bitmap.entries.CountFree(); b.bitmap.free != free {
+			violations = append(violations, fmt.Sprintf("%s bitmap counts %d free entries, but has %d", b.name, b.bitmap.free, free))
+		}
+	}
+	return violations
+}
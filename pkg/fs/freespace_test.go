@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeExtents(t *testing.T) {
+	free := newFreeExtents(bitmapOf(1, 0, 0, 1, 0, 1, 1, 0))
+	require.Equal(t, []extent{{1, 2}, {4, 1}, {7, 1}}, free.runs)
+	require.Equal(t, 4, free.free)
+	require.Equal(t, []int{1, 2, 4}, free.lowest(3))
+	require.Equal(t, []int{1, 2, 4, 7}, free.lowest(10))
+
+	// taking from the middle of a run splits it
+	free = newFreeExtents(NewBitmap(8))
+	free.take(3)
+	require.Equal(t, []extent{{0, 3}, {4, 4}}, free.runs)
+	// taking a used entry does nothing
+	free.take(3)
+	require.Equal(t, 7, free.free)
+	// releasing between two runs joins them
+	free.release(3)
+	require.Equal(t, []extent{{0, 8}}, free.runs)
+	free.release(3)
+	require.Equal(t, 8, free.free)
+}
+
+func TestFreeExtentsContiguous(t *testing.T) {
+	free := newFreeExtents(bitmapOf(1, 0, 0, 1, 0, 0, 0, 1, 0, 0))
+	// the goal is continued, then the first run holding the rest is used
+	require.Equal(t, []int{5, 6}, free.contiguous(2, 5))
+	require.Equal(t, []int{4, 5, 6}, free.contiguous(3, -1))
+	require.Equal(t, []int{2, 4, 5}, free.contiguous(3, 2))
+	// failing that, the longest runs
+	require.Equal(t, []int{4, 5, 6, 1, 2, 8}, free.contiguous(6, -1))
+	require.Equal(t, []int{4, 5, 6, 1, 2, 8, 9}, free.contiguous(10, 3))
+}
+
+func TestFreeExtentsBestFit(t *testing.T) {
+	free := newFreeExtents(bitmapOf(1, 0, 0, 0, 1, 0, 0, 1, 0, 1))
+	// the smallest run holding the rest, the first on ties
+	require.Equal(t, []int{8}, free.bestFit(1, -1))
+	require.Equal(t, []int{5, 6}, free.bestFit(2, -1))
+	require.Equal(t, []int{2, 3, 1}, free.bestFit(3, 2))
+	require.Equal(t, []int{1, 2, 3, 5}, free.bestFit(4, -1))
+}
+
+func TestFreeExtentsMatchBitmap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	bitmap := NewBitmap(64)
+	free := newFreeExtents(bitmap)
+	for n := 0; n < 1000; n++ {
+		i := rng.Intn(bitmap.Len())
+		if rng.Intn(2) == 0 {
+			bitmap.Set(i)
+			free.take(i)
+		} else {
+			bitmap.Clear(i)
+			free.release(i)
+		}
+		want := newFreeExtents(bitmap)
+		require.Equal(t, want.runs, free.runs, "after %d changes", n)
+		require.Equal(t, want.free, free.free)
+	}
+}
+
+func TestAllocationReusesFreedSpace(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 2*BlockSize)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	fooBlocks := append([]uint32{}, foo.usedBlocks()...)
+
+	// shrinking /foo frees its last block, which is the lowest free one now
+	require.NoError(t, filesystem.setInodeContents(int(foo.Index), bytes.NewBufferString("foo")))
+	blocks, err := filesystem.FindEmptyBlocks(1)
+	require.NoError(t, err)
+	require.Equal(t, fooBlocks[1:], blocks)
+
+	// a failed operation rolls the indices back with the bitmaps
+	free := filesystem.freeBlocks.free
+	dev.failWriteAt = dev.writes + 3
+	_, err = filesystem.CreateFile("/baz", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, free, filesystem.freeBlocks.free)
+	require.Empty(t, filesystem.checkFreeSpaceIndex())
+
+	blocks, err = filesystem.FindEmptyBlocks(40)
+	require.ErrorIs(t, err, ErrNoSpace)
+	require.Len(t, blocks, free)
+}
@@ -1,12 +1,16 @@
 package fs
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"io"
+	iofs "io/fs"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type BlockDevice interface {
@@ -14,17 +18,18 @@ type BlockDevice interface {
 	ReadBlock(blockNum uint64, buf []byte) error
 	// WriteBlock writes a block of data (4096 bytes) to the device.
 	WriteBlock(blockNum uint64, buf []byte) error
-	// Dump prints the contents of the device to stdout.
-	Dump()
 }
 
+// The layout of a filesystem with the default geometry. Other geometries
+// record their layout in the superblock, see Geometry; only the superblock
+// is always in block 0.
 const (
 	SuperblockIndex  = 0
 	InodeBitmapIndex = 1
 	DataBitmapIndex  = 2
 	InodeStartIndex  = 3
 	// assuming each inode is at most 512 bytes, each block fits
-	// 8 inodes. Since we can have at most 32 inodes, this means
+	// 8 inodes. Since we have 32 inodes, this means
 	// that our inode table needs to be 32/8 = 4 blocks long.
 	DataStartIndex = 3 + 3
 
@@ -48,123 +53,348 @@ type Inode struct {
 	Index uint32
 	// Type indicates whether it's a regular file or a directory
 	Type InodeType
-	// Blocks contains the index of the blocks occupied by the file.
+	// Blocks contains the index of the first blocks occupied by the file.
 	// If the file is smaller than 16 blocks, the remaining block indices
 	// are set to 0.
 	// Meaning that the blocks occupied by the file are B[0] through B[i],
 	// where i is the largest number for which B[i] > 0.
+	// Inodes mapped with extents hold their first extents here instead,
+	// see extent.go.
 	Blocks [16]uint32 // block numbers
+	// Indirect and DoubleIndirect are the pointer blocks leading to the
+	// blocks of files bigger than 16 blocks, or 0; see MaxFileSize. Inodes
+	// mapped with extents keep their further extents from Indirect on.
+	Indirect       uint32
+	DoubleIndirect uint32
 	// Filename contains the file's relative name.
 	// It can be up to 128 bytes in size.
 	Filename string
+	// Mode holds the permission bits the file was created with.
+	Mode uint32
+	// Created is when the file was created, in seconds since the Unix
+	// epoch, or zero if it predates creation times.
+	Created int64
+	// Modified, Accessed and Changed are when the contents were last
+	// written, when they were last read, and when the contents or the
+	// inode last changed, in seconds since the Unix epoch; see times.go.
+	// They are zero if the inode predates them.
+	Modified int64
+	Accessed int64
+	Changed  int64
+	// Links is the number of directory entries naming the inode, see Link,
+	// or 0 if the inode predates link counts and is in a single directory.
+	Links uint32
+	// Project is the project id the file was created with, see DirDefaults.
+	Project uint32
+	// Defaults holds what a directory hands down to new files in it.
+	Defaults DirDefaults
+	// Generation tells apart the inodes that used the same index over
+	// time. Inodes created before generations were recorded have zero.
+	Generation uint32
+	// BinaryDir is set on directories whose entries are in the binary
+	// format, see dirent.go.
+	BinaryDir bool
+	// contentSum is the CRC-32C of the contents of a file, if
+	// contentSummed is set; see contentsum.go. Files created before content
+	// checksums have none until their contents next change. They are kept
+	// after the gob encoding of the inode, see encodeInode.
+	contentSum    uint32
+	contentSummed bool
+	// extentMapped is set on inodes mapping their blocks with extents, see
+	// extent.go. It is kept after the gob encoding like contentSum.
+	extentMapped bool
+	// dirIndexed is set on indexed directories, see dirindex.go. It is
+	// kept after the gob encoding like contentSum.
+	dirIndexed bool
+	// quota is the quota of a directory and its usage, if quotaSet is set,
+	// and quotaDir the quota directory the inode is charged to, if inQuota
+	// is set; see quota.go. They are kept after the gob encoding like
+	// contentSum.
+	quota    QuotaUsage
+	quotaSet bool
+	quotaDir uint32
+	inQuota  bool
+	// compression is how the contents of a file are compressed, and
+	// compressedSize their size once compressed; see compression.go. They
+	// are kept after the gob encoding like contentSum.
+	compression    Compression
+	compressedSize uint32
+	// xattrs holds the extended attributes kept in the inode's slot, and
+	// xattrBlock the block holding them instead, or 0; see xattr.go. They
+	// are kept after the gob encoding like contentSum. The map is replaced,
+	// never changed, so snapshots can share it.
+	xattrs     map[string][]byte
+	xattrBlock uint32
+	// uid and gid are the user and group owning the inode, see
+	// permissions.go. They are kept after the gob encoding like
+	// contentSum.
+	uid uint32
+	gid uint32
+	// entries is the number of entries of a directory, if entriesCounted
+	// is set; see dircount.go. It is kept after the gob encoding like
+	// contentSum.
+	entries        uint32
+	entriesCounted bool
 	// ...
 }
 
+// FileSystem is a mounted filesystem. It is safe for concurrent use by
+// multiple goroutines: operations changing metadata run one at a time, while
+// reads, and writes overwriting files in place, run concurrently. Inodes
+// returned by GetInode and FindInodeByName are shared with the filesystem,
+// so only read them while no other goroutine is changing it. A File is not
+// safe for concurrent use; open one per goroutine instead.
+//
+// Operations are all or nothing: if one fails, every change it made to the
+// filesystem is rolled back, unless its doc says otherwise; see rollback.go.
 type FileSystem struct {
+	// mu guards the metadata, and inodeLocks the file data; see locking.go
+	mu         sync.RWMutex
+	inodeLocks [inodeLockCount]sync.RWMutex
 	// dev is the underlying block device
 	dev BlockDevice
-	// inode list
-	inodes [32]*Inode
-	// For simplicity, we'll just use a byte array to represent the bitmaps.
-	// Each byte is either 0 or 1
-	// indicates which inodes are taken
-	inodeBitmap [32]byte // up to 32 inodes
-	// indicates which data blocks are taken
-	dataBitmap [32]byte // up to 32 blocks
+	// inodes caches the loaded inodes; see inode
+	inodes *inodeCache
+	// inodeBitmap and dataBitmap cache the bitmaps of the device, with a
+	// bit per inode and per data block, as the device has them, or a byte
+	// on filesystems formatted before version 14; see bitmap
+	inodeBitmap *bitmap
+	dataBitmap  *bitmap
+	// freeInodes and freeBlocks index the free entries of the bitmaps for
+	// allocation, see freeExtents
+	freeInodes *freeExtents
+	freeBlocks *freeExtents
+	// shrinkLimit, while shrinking, is the number of data bitmap entries
+	// the filesystem keeps: blocks freed from there on stay out of
+	// freeBlocks. It is zero otherwise.
+	shrinkLimit int
+	// geometry is the size and layout recorded in the superblock
+	geometry Geometry
+	// checksums is the checksum table, or nil if the filesystem has none
+	checksums *checksumTable
+	// dedup is the dedup table, or nil if the filesystem has none
+	dedup *dedupTable
+	// version is the format version recorded in the superblock
+	version uint32
+	// flags are the superblock flags
+	flags uint32
+	// worm is the write-once mode in effect, or nil; see WORM
+	worm *wormPolicy
+	// now returns the current time, for the times of inodes and retention
+	now func() time.Time
+	// times holds the times of inodes recorded without changing them,
+	// guarded by timesMu; see times.go
+	timesMu sync.Mutex
+	times   map[int]pendingTimes
+	// nextGeneration is the generation of the next inode created, and
+	// generations up to generationLimit are reserved in the superblock;
+	// see nextInodeGeneration
+	nextGeneration  uint32
+	generationLimit uint32
+	// orphans are the inodes on the orphan list of the superblock, see
+	// orphan.go
+	orphans []uint32
+	// sbFreeBlocks and sbFreeInodes are the free counts the superblock
+	// held when the filesystem was read, see counters.go
+	sbFreeBlocks uint32
+	sbFreeInodes uint32
+	// inodeReuse delays the reuse of freed inode indices, which wait in
+	// quarantine; see SetInodeReuse
+	inodeReuse InodeReusePolicy
+	quarantine []quarantinedInode
+	// syncs counts the calls to Sync
+	syncs int
+	// dirty is set once the superblock records that the filesystem is
+	// being changed, see markDirty
+	dirty bool
+	// dirOrder is the order of directory listings, see SetDirOrder
+	dirOrder DirOrder
+	// dirWrites counts the calls to writeDirRecords, so that a DirIter
+	// knows when the directory it lists may have changed
+	dirWrites uint64
+	// allocPolicy chooses the data blocks of file contents, see
+	// SetAllocPolicy, and allocStats counts the allocations
+	allocPolicy AllocPolicy
+	allocStats  AllocStats
+	// dataMode orders data writes against metadata, see SetDataMode
+	dataMode DataMode
+	// compression is how new files are compressed, see SetCompression
+	compression Compression
+	// credentials are who uses the filesystem, see SetCredentials
+	credentials *Credentials
+
+	// invariantMode and invariantLog control debug checking, see
+	// SetInvariantChecks
+	invariantMode InvariantMode
+	invariantLog  io.Writer
+	// explain narrates operations, see SetExplain; nil when off
+	explain *explainer
+	// journal holds the metadata written by the running operation until
+	// it is committed, see journal.go; nil without a journal
+	journal *journal
+	// txn is the running transaction, see Begin, or nil
+	txn *Txn
+	// ctx is the context of the running operation, see context.go; nil
+	// when it has none
+	ctx context.Context
 }
 
+// NewFileSystem formats dev with an empty filesystem and mounts it. It
+// fails with ErrFormatted if dev already holds a filesystem; use
+// NewFileSystemWithOptions to overwrite it.
 func NewFileSystem(dev BlockDevice) (*FileSystem, error) {
-	// Write the superblock
-	superblock := map[string]interface{}{
-		"magic": 0xbafdb0,
+	return NewFileSystemWithOptions(dev, MkfsOptions{})
+}
+
+// format writes an empty filesystem to dev.
+func format(dev BlockDevice, opts MkfsOptions) (*FileSystem, error) {
+	geometry, err := opts.geometry()
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{
+		dev:         dev,
+		inodes:      newInodeCache(DefaultInodeCacheSize),
+		inodeBitmap: newBitmap(geometry.InodeBitmapStart, geometry.InodeCount, geometry.PackedBitmaps),
+		dataBitmap:  newBitmap(geometry.DataBitmapStart, geometry.DataBlocks(), geometry.PackedBitmaps),
+		geometry:    geometry,
+		version:     FormatVersion,
+		now:         time.Now,
+		times:       map[int]pendingTimes{},
+		// the root inode has generation 0
+		nextGeneration:  1,
+		generationLimit: 1,
+		invariantMode:   defaultInvariantMode,
+		invariantLog:    os.Stderr,
 	}
 
-	// create a 4096 byte buffer containing the superblock
-	buf := []byte{}
-	// write the magic number to the buffer
-	for i := 0; i < 3; i++ {
-		buf = append(buf, byte(superblock["magic"].(int)>>uint(8*i)))
+	// Write the superblock
+	superblock := &Superblock{
+		Magic:    Magic,
+		Version:  FormatVersion,
+		Geometry: geometry,
+
+		NextGeneration: 1,
+		// the root directory and data block 0 are taken
+		FreeBlocks: geometry.DataBlocks() - 1,
+		FreeInodes: geometry.InodeCount - 1,
+	}
+	if opts.WORM {
+		superblock.Flags |= FlagWORM
+		superblock.Retention = opts.Retention / time.Second * time.Second
+	}
+	fs.flags = superblock.Flags
+	fs.worm = wormFromSuperblock(superblock)
+	if geometry.ChecksumBlocks > 0 {
+		fs.checksums = &checksumTable{sums: make([]uint32, geometry.BlockCount), verify: true}
+	}
+	if geometry.DedupBlocks > 0 {
+		fs.dedup = newDedupTable(geometry, int(geometry.DataBlocks()))
 	}
+
 	// write the superblock to the device
-	err := dev.WriteBlock(SuperblockIndex, buf)
+	buf := superblock.encode()
+	err = dev.WriteBlock(SuperblockIndex, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error writing superblock: %w", err)
 	}
-	// write the inode bitmap (which is a 1 since we have only the root dir inode)
-	buf = []byte{1}
-	err = dev.WriteBlock(InodeBitmapIndex, buf)
+	// write the inode bitmap (only the root dir inode is taken) and the
+	// data bitmap (no data is allocated yet, but data block 0 is always
+	// taken, see readBitmaps)
+	fs.inodeBitmap.set(0, true)
+	err = fs.flushBitmap(fs.inodeBitmap)
 	if err != nil {
 		return nil, fmt.Errorf("error writing inode bitmap: %w", err)
 	}
-	// write the data bitmap (which is a 0 since no data is allocated yet)
-	buf = []byte{0}
-	dev.WriteBlock(DataBitmapIndex, buf)
+	fs.dataBitmap.set(0, true)
+	err = fs.flushBitmap(fs.dataBitmap)
+	if err != nil {
+		return nil, fmt.Errorf("error writing data bitmap: %w", err)
+	}
 
+	now := fs.now().Unix()
 	rootInode := &Inode{
 		Size:     0,
 		Index:    0,
 		Type:     InodeTypeDirectory,
 		Blocks:   [16]uint32{0},
 		Filename: "/",
+		Created:  now,
+		Modified: now,
+		Accessed: now,
+		Changed:  now,
+		Links:    1,
+
+		BinaryDir:      true,
+		extentMapped:   true,
+		entriesCounted: true,
 	}
 
 	// write the root inode
-	bb := bytes.NewBuffer([]byte{})
-	enc := gob.NewEncoder(bb)
-	err = enc.Encode(rootInode)
+	buf, err = encodeInode(rootInode)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding root inode: %w", err)
 	}
-	buf = bb.Bytes()
-	dev.WriteBlock(InodeStartIndex, buf)
+	if fs.checksums != nil {
+		err = fs.writeMetadata(uint64(geometry.InodeTableStart), buf)
+	} else {
+		err = dev.WriteBlock(uint64(geometry.InodeTableStart), buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing root inode: %w", err)
+	}
+	err = fs.flushDedup()
+	if err != nil {
+		return nil, err
+	}
+	if fs.checksums != nil {
+		err = fs.formatChecksums()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &FileSystem{
-		dev:         dev,
-		inodes:      [32]*Inode{rootInode},
-		inodeBitmap: [32]byte{1},
-		dataBitmap:  [32]byte{1},
-	}, nil
+	// the device may hold the journal of an earlier filesystem
+	if geometry.JournalBlocks > 0 {
+		err = dev.WriteBlock(uint64(geometry.JournalStart), make([]byte, BlockSize))
+		if err != nil {
+			return nil, fmt.Errorf("error clearing the journal: %w", err)
+		}
+		fs.journal = newJournal(geometry)
+	}
+
+	fs.indexFreeSpace()
+	return fs, nil
 }
 
 func (fs *FileSystem) DisplayInfo() {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
 	// print inode bitmap
-	// print it as a 16x2 bitmap
+	// print it in rows of 16
 	fmt.Println("-- inode bitmap --")
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 16; j++ {
-			if fs.inodeBitmap[i*16+j] != 0 {
-				fmt.Print("1")
-			} else {
-				fmt.Print("0")
-			}
-		}
-		fmt.Println()
-	}
+	printBitmap(fs.inodeBitmap.entries)
 	fmt.Println()
 	// convert inode bitmap into a list of existing inode indices
 	inodeIndices := []int{}
-	for i := 0; i < 32; i++ {
-		if fs.inodeBitmap[i] == 1 {
+	for i := 0; i < fs.inodeBitmap.len(); i++ {
+		if fs.inodeBitmap.test(i) {
 			inodeIndices = append(inodeIndices, i)
 		}
 	}
 	// print data bitmap
-	// print it as a 16x2 bitmap
+	// print it in rows of 16
 	fmt.Println("-- data bitmap --")
-	for i := 0; i < 2; i++ {
-		for j := 0; j < 16; j++ {
-			if fs.dataBitmap[i*16+j] != 0 {
-				fmt.Print("1")
-			} else {
-				fmt.Print("0")
-			}
-		}
-		fmt.Println()
-	}
+	printBitmap(fs.dataBitmap.entries)
 
 	// go through inode indices and decode/print the inodes
 	for _, inodeIndex := range inodeIndices {
-		inode := fs.inodes[inodeIndex]
+		inode, err := fs.allocatedInode(inodeIndex)
+		if err != nil {
+			fmt.Printf("error reading inode %d: %v\n", inodeIndex, err)
+			continue
+		}
 		switch inode.Type {
 		case InodeTypeFile:
 			fmt.Printf("-- file inode %d --\n", inodeIndex)
@@ -172,7 +402,7 @@ func (fs *FileSystem) DisplayInfo() {
 			fmt.Printf("-- directory inode %d --\n", inodeIndex)
 		}
 
-		contents, err := fs.ReadInodeContents(inodeIndex)
+		contents, err := fs.readInodeContents(inodeIndex)
 
 		fmt.Printf("size: %d\n", inode.Size)
 		fmt.Printf("blocks: %v\n", inode.Blocks)
@@ -185,257 +415,624 @@ func (fs *FileSystem) DisplayInfo() {
 
 		fmt.Println()
 	}
-
-	// // dump the contents of the block device
-	// fmt.Println("-- block device --")
-	// fs.dev.Dump()
 }
 
-func LoadFilesystem(dev BlockDevice) (*FileSystem, error) {
-	// read the superblock
-	buf := make([]byte, BlockSize)
-	dev.ReadBlock(SuperblockIndex, buf)
-	// read the magic number from the buffer
-	magic := 0
-	for i := 0; i < 3; i++ {
-		magic += int(buf[i]) << uint(8*i)
+// printBitmap prints a bitmap in rows of 16 entries.
+func printBitmap(bitmap *Bitmap) {
+	s := bitmap.String()
+	for len(s) > 16 {
+		fmt.Println(s[:16])
+		s = s[16:]
 	}
-	// check the magic number
-	if magic != 0xbafdb0 {
-		return nil, fmt.Errorf("Not a valid filesystem")
+	if len(s) > 0 {
+		fmt.Println(s)
 	}
-	// read the inode bitmap
-	dev.ReadBlock(InodeBitmapIndex, buf)
-	rawInodeBitmap := buf
+}
 
-	var inodeBitmap [32]byte
+// ValidateSuperblock checks that dev contains a filesystem superblock.
+func ValidateSuperblock(dev BlockDevice) error {
+	_, err := ReadSuperblock(dev)
+	return err
+}
 
-	copy(inodeBitmap[:], rawInodeBitmap)
+// LoadFilesystem mounts the filesystem on dev with the default MountOptions.
+// It validates the metadata it reads and fails with an error wrapping
+// ErrCorrupt if it is inconsistent, or with ErrDirty if the filesystem
+// wasn't closed cleanly.
+func LoadFilesystem(dev BlockDevice) (*FileSystem, error) {
+	return LoadFilesystemWithOptions(dev, MountOptions{})
+}
 
-	// convert inode bitmap into a list of existing inode indices
-	inodeIndices := []int{}
-	for i := 0; i < 32; i++ {
-		if inodeBitmap[i] == 1 {
-			inodeIndices = append(inodeIndices, i)
-		}
+// readFilesystem reads the metadata from dev without checking that it is
+// consistent. Only the geometry is checked, before anything is read
+// according to it, and the checksums of the metadata if verify is set. A
+// transaction committed to the journal is loaded, and read in place of the
+// blocks it changes until it is checkpointed.
+func readFilesystem(dev BlockDevice, verify bool) (*FileSystem, error) {
+	fs, err := readSuperblockOnly(dev)
+	if err != nil {
+		return nil, err
 	}
-	// read the data bitmap
-	dev.ReadBlock(DataBitmapIndex, buf)
-	rawDataBitmap := buf
-
-	var dataBitmap [32]byte
-
-	copy(dataBitmap[:], rawDataBitmap)
-
-	// go through inode indices and decode/print the inodes
-	inodes := [32]*Inode{}
-	for i, inodeIndex := range inodeIndices {
-		blockIndex := inodeIndex * InodeSize / BlockSize
-		blockOffset := inodeIndex * InodeSize % BlockSize
-		fmt.Printf("inode %d is in block %d at offset %d\n", inodeIndex, blockIndex+3, blockOffset)
-		dev.ReadBlock(uint64(blockIndex+3), buf)
-		inodeBytes := buf[blockOffset : blockOffset+InodeSize]
-		dec := gob.NewDecoder(bytes.NewBuffer(inodeBytes))
-		var inode Inode
-		err := dec.Decode(&inode)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding inode %d: %w\n", inodeIndex, err)
-		}
-		inodes[i] = &inode
+	err = fs.checkGeometry()
+	if err != nil {
+		return nil, err
 	}
+	_, err = fs.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.readChecksums(verify)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.readBitmaps()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.readDedup()
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
 
+// readSuperblockOnly sets up a filesystem from the superblock of dev, with
+// nothing else read yet. Diagnose uses it to check damaged filesystems step
+// by step; see readFilesystem.
+func readSuperblockOnly(dev BlockDevice) (*FileSystem, error) {
+	// check the superblock
+	sb, err := ReadSuperblock(dev)
+	if err != nil {
+		return nil, err
+	}
 	return &FileSystem{
-		dev:         dev,
-		inodes:      inodes,
-		inodeBitmap: inodeBitmap,
-		dataBitmap:  dataBitmap,
+		dev:             dev,
+		inodes:          newInodeCache(DefaultInodeCacheSize),
+		dirty:           sb.State == StateDirty,
+		geometry:        sb.Geometry,
+		version:         sb.Version,
+		flags:           sb.Flags,
+		worm:            wormFromSuperblock(sb),
+		now:             time.Now,
+		times:           map[int]pendingTimes{},
+		nextGeneration:  sb.NextGeneration,
+		generationLimit: sb.NextGeneration,
+		orphans:         sb.Orphans,
+		sbFreeBlocks:    sb.FreeBlocks,
+		sbFreeInodes:    sb.FreeInodes,
+		invariantMode:   defaultInvariantMode,
+		invariantLog:    os.Stderr,
+		journal:         newJournal(sb.Geometry),
 	}, nil
 }
 
-func (fs *FileSystem) GetInode(inodeIndex int) (*Inode, error) {
-	if inodeIndex >= 32 { // TODO remove hardcoded size
-		return nil, fmt.Errorf("inode index out of bounds: %d", inodeIndex)
+// readBitmaps reads the bitmaps, once the geometry is known to be good.
+func (fs *FileSystem) readBitmaps() error {
+	var err error
+	fs.inodeBitmap, err = fs.readBitmap(fs.geometry.InodeBitmapStart, fs.geometry.InodeCount, fs.geometry.PackedBitmaps)
+	if err != nil {
+		return fmt.Errorf("error reading inode bitmap: %w", err)
+	}
+	fs.dataBitmap, err = fs.readBitmap(fs.geometry.DataBitmapStart, fs.geometry.DataBlocks(), fs.geometry.PackedBitmaps)
+	if err != nil {
+		return fmt.Errorf("error reading data bitmap: %w", err)
 	}
-	return fs.inodes[inodeIndex], nil
+	// data block 0 is reserved, and may hold the last block of the inode
+	// table, so it is always taken. Filesystems made before it was recorded
+	// on the device have it free there, and get it fixed with the next
+	// change to the bitmap.
+	fs.dataBitmap.set(0, true)
+
+	fs.indexFreeSpace()
+	return nil
 }
 
-func (fs *FileSystem) ReadInodeContents(inodeIndex int) (*bytes.Buffer, error) {
-	inode := fs.inodes[inodeIndex]
+// GetInode returns the inode with the given index, or nil if it isn't
+// allocated. Unless the inode belongs to an open file, it may be evicted from
+// the inode cache later, so look it up again rather than holding on to it.
+func (fs *FileSystem) GetInode(inodeIndex int) (*Inode, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.inode(inodeIndex)
+}
 
-	// read the blocks
-	buf := make([]byte, BlockSize)
-	bb := bytes.NewBuffer([]byte{})
-	for _, blockIndex := range inode.Blocks {
-		if blockIndex == 0 {
-			break
-		}
-		fs.dev.ReadBlock(uint64(blockIndex), buf)
-		bb.Write(buf)
+func (fs *FileSystem) ReadInodeContents(inodeIndex int) (*bytes.Buffer, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	lock := fs.inodeLock(inodeIndex)
+	lock.RLock()
+	defer lock.RUnlock()
+	contents, err := fs.readInodeContents(inodeIndex)
+	if err != nil {
+		return nil, err
 	}
+	fs.noteAccess(inodeIndex)
+	return contents, nil
+}
 
-	// trim to the correct file size
-	bb.Truncate(int(inode.Size))
+func (fs *FileSystem) readInodeContents(inodeIndex int) (*bytes.Buffer, error) {
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	return fs.readContents(inode)
+}
 
-	return bb, nil
+// readContents reads the contents of inode from the device. It doesn't use
+// the inode cache, so Diagnose can call it from several goroutines.
+func (fs *FileSystem) readContents(inode *Inode) (*bytes.Buffer, error) {
+	buf, err := fs.readContentsInto(inode, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(buf), nil
 }
 
 func (fs *FileSystem) ReadFileContents(inodeIndex int) (*bytes.Buffer, error) {
-	inode := fs.inodes[inodeIndex]
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	lock := fs.inodeLock(inodeIndex)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
 	if inode.Type != InodeTypeFile {
-		return nil, fmt.Errorf("inode %d is not a file", inodeIndex)
+		return nil, fmt.Errorf("inode %d: %w", inodeIndex, ErrIsDirectory)
+	}
+	err = fs.checkAccess(inode, accessRead)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inode %d: %w", inodeIndex, err)
 	}
 
-	return fs.ReadInodeContents(inodeIndex)
+	return fs.readFileContents(inode)
 }
 
-func (fs *FileSystem) ReadDir(inodeIndex int) ([]*Inode, error) {
-	// The directory is a list of node indices along with their filenames.
-	// Example
-	// 1 foo
-	// 2 bar
-	// These are then returned as a list of Inodes
+// ReadFile returns the contents of the file with the given absolute name,
+// like ReadFileContents does for an inode index.
+func (fs *FileSystem) ReadFile(filename string) ([]byte, error) {
+	return fs.ReadFileContext(context.Background(), filename)
+}
+
+// ReadFileContext is ReadFile under ctx, see context.go.
+func (fs *FileSystem) ReadFileContext(ctx context.Context, filename string) ([]byte, error) {
+	defer fs.lockRead(ctx)()
+	inode, err := fs.findFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	lock := fs.inodeLock(int(inode.Index))
+	lock.RLock()
+	defer lock.RUnlock()
+	err = fs.checkAccess(inode, accessRead)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	contents, err := fs.readFileContents(inode)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	return contents.Bytes(), nil
+}
 
-	contents, err := fs.ReadInodeContents(inodeIndex)
+// readFileContents reads the contents of a file, verifies them against its
+// contents checksum and notes the access.
+func (fs *FileSystem) readFileContents(inode *Inode) (*bytes.Buffer, error) {
+	contents, err := fs.readContents(inode)
 	if err != nil {
 		return nil, err
 	}
+	err = fs.verifyContents(inode, contents.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	fs.noteAccess(int(inode.Index))
+	return contents, nil
+}
 
-	// read the contents
-	inodes := []*Inode{}
-	scanner := bufio.NewScanner(contents)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid line in directory: %s", line)
-		}
-		inodeIndex, err := strconv.Atoi(parts[0])
+// DirEntry describes an entry of a directory, as returned by ReadDir.
+// It is a copy: changing it doesn't affect the filesystem.
+type DirEntry struct {
+	// Name is the entry's name within the directory.
+	Name string
+	// Inode is the index of the inode the entry points at.
+	Inode uint32
+	// Type is the type of that inode.
+	Type InodeType
+	// Size is the size of that inode in bytes, or zero if listed by
+	// ListDir.
+	Size uint32
+}
+
+// ReadDir lists the directory with the given inode index, in the order set
+// with SetDirOrder.
+func (fs *FileSystem) ReadDir(inodeIndex int) ([]DirEntry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.checkAccess(dir, accessRead)
+	if err != nil {
+		return nil, fmt.Errorf("error listing directory %d: %w", inodeIndex, err)
+	}
+	return fs.readDir(inodeIndex)
+}
+
+// ReadDirByPath is ReadDir for the directory with the given absolute name;
+// "/" is the root. It fails with ErrNotDirectory if the name is a file's.
+func (fs *FileSystem) ReadDirByPath(dirname string) ([]DirEntry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findDir(dirname)
+	if err == nil {
+		err = fs.checkAccess(dir, accessRead)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", dirname, err)
+	}
+	return fs.readDir(int(dir.Index))
+}
+
+func (fs *FileSystem) readDir(inodeIndex int) ([]DirEntry, error) {
+	records, err := fs.readDirRecords(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []DirEntry{}
+	for _, record := range records {
+		child, err := fs.lookupChild(record.inode, record.name)
 		if err != nil {
-			return nil, fmt.Errorf("invalid inode index in directory: %s", parts[0])
+			return nil, err
 		}
-		inode := fs.inodes[inodeIndex]
-		inode.Filename = parts[1]
-		inodes = append(inodes, inode)
+		entries = append(entries, DirEntry{
+			Name:  record.name,
+			Inode: uint32(record.inode),
+			Type:  child.Type,
+			Size:  child.Size,
+		})
 	}
+	fs.sortDirEntries(entries)
 
-	return inodes, nil
+	return entries, nil
+}
+
+func (fs *FileSystem) AddFileToDir(dirInodeIndex int, fileInodeIndex int) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	return fs.addFileToDir(dirInodeIndex, fileInodeIndex)
+}
+
+func (fs *FileSystem) addFileToDir(dirInodeIndex int, fileInodeIndex int) error {
+	file, err := fs.allocatedInode(fileInodeIndex)
+	if err != nil {
+		return err
+	}
+	return fs.addEntry(dirInodeIndex, file.Filename, fileInodeIndex)
 }
 
-func (fs *FileSystem) AddFileToDir(dirInodeIndex int, fileInodeIndex int) error {
-	// read the directory contents
-	inode := fs.inodes[dirInodeIndex]
-	contents, err := fs.ReadInodeContents(dirInodeIndex)
+// addEntry adds an entry with the given name for an inode to a directory.
+func (fs *FileSystem) addEntry(dirInodeIndex int, name string, fileInodeIndex int) error {
+	// read the directory entries
+	records, err := fs.readDirRecords(dirInodeIndex)
 	if err != nil {
 		return err
 	}
 
 	// append the new file
-	contents.WriteString(fmt.Sprintf("%d %s\n", fileInodeIndex, fs.inodes[fileInodeIndex].Filename))
-	// update the size
-	fs.inodes[dirInodeIndex].Size = uint32(contents.Len())
-	// check if the current number of blocks allocated to the file suffice
-	nCurrentBlocks := 0
-	blockEndIndex := 0
-	for i, blockIndex := range inode.Blocks {
-		// Only nonzero blocks indicate actual blocks used by the file
-		// Whenever we reach a 0, it means that there are no more blocks taken
-		// by the file
-		if blockIndex == 0 {
-			blockEndIndex = i
-			break
-		}
-		nCurrentBlocks += 1
+	file, err := fs.allocatedInode(fileInodeIndex)
+	if err != nil {
+		return err
+	}
+	records = append(records, dirRecord{name: name, inode: fileInodeIndex, typ: file.Type})
+
+	// write the new contents, growing the directory if needed
+	err = fs.writeDirRecords(dirInodeIndex, records)
+	if err != nil {
+		return fmt.Errorf("error updating directory contents: %w", err)
 	}
 
+	return nil
+}
+
+// setInodeContents replaces the contents of an inode, allocating or freeing
+// data blocks as needed, and persists the inode table and data bitmap.
+// If it fails, the inode and the data bitmap are left as they were.
+func (fs *FileSystem) setInodeContents(inodeIndex int, contents *bytes.Buffer) (err error) {
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	if int64(contents.Len()) > MaxFileSize {
+		return fmt.Errorf("%d bytes are more than a file holds: %w", contents.Len(), ErrTooLarge)
+	}
+	if inode.compressed() {
+		return fs.rewriteCompressed(inode, contents.Bytes())
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	nCurrentBlocks := len(old.data)
 	nTotalBlocks := GetSizeInBlocks(contents.Len())
 
-	if nTotalBlocks <= nCurrentBlocks {
-		// Current block count is enough
-	} else {
+	snapshot := fs.snapshot(inodeIndex)
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	blocks := append([]uint32{}, old.data...)
+	if nTotalBlocks > nCurrentBlocks {
 		// We need extra blocks to fit the new content
-		// find nBlocks empty data blocks
-		added := 0
-		for i := 0; i < 32; i++ {
-			if fs.dataBitmap[i] == 0 {
-				// Found an empty block
-				// Remember that block indices are absolute,
-				// meaning that we have to add the start offset
-				inode.Blocks[blockEndIndex+added] = uint32(i) + DataStartIndex
-				fs.dataBitmap[i] = 1
-				added++
-				if added == nTotalBlocks-nCurrentBlocks {
-					break
-				}
-			}
+		newBlocks, err := fs.findContiguousBlocks(nTotalBlocks-nCurrentBlocks, blocks)
+		if err != nil {
+			return fmt.Errorf("not enough free blocks to fit %d bytes: %w", contents.Len(), err)
+		}
+		for _, blockIndex := range newBlocks {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		blocks = append(blocks, newBlocks...)
+	} else {
+		// Free the blocks past the new end of the contents
+		for _, blockIndex := range blocks[nTotalBlocks:] {
+			fs.releaseBlock(blockIndex)
 		}
+		blocks = blocks[:nTotalBlocks]
+	}
+	// the blocks kept are written over
+	_, err = fs.unshare(inode, blocks, 0, nCurrentBlocks, false)
+	if err != nil {
+		return err
+	}
+	err = fs.mapBlocks(inode, old, blocks)
+	if err != nil {
+		return err
+	}
 
-		if added < nTotalBlocks-nCurrentBlocks {
-			return fmt.Errorf("not enough free blocks to fit the new directory contents")
+	if inode.Type == InodeTypeFile {
+		err = fs.chargeQuota(snapshot, inode, int64(contents.Len())-int64(inode.Size), 0)
+		if err != nil {
+			return err
 		}
 	}
+	// update the size
+	inode.Size = uint32(contents.Len())
+	fs.touch(inode)
 
 	// write the new contents
-	err = fs.WriteInodeContents(dirInodeIndex, contents)
+	err = fs.writeContents(inode, blocks, contents)
 	if err != nil {
 		return err
 	}
+	if inode.Type == InodeTypeFile {
+		inode.contentSum, inode.contentSummed = checksum(contents.Bytes()), true
+	}
 
 	// flush the inode table
-	err = fs.WriteInodeTable()
+	err = fs.writeInodeTable()
+	if err != nil {
+		return err
+	}
 
 	// write the data bitmap
-	fs.PersistDataBitmap()
+	return fs.persistDataBitmap()
+}
 
-	return nil
+func (fs *FileSystem) WriteInodeContents(inodeIndex int, contents *bytes.Buffer) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	err = fs.checkAccess(inode, accessWrite)
+	if err != nil {
+		return fmt.Errorf("error writing inode %d: %w", inodeIndex, err)
+	}
+	if inode.compressed() {
+		return fs.rewriteCompressed(inode, contents.Bytes())
+	}
+	blocks, err := fs.unshareMapped(inode, 0, GetSizeInBlocks(contents.Len()), false)
+	if err != nil {
+		return err
+	}
+	err = fs.writeContents(inode, blocks, contents)
+	if err != nil || inode.Type != InodeTypeFile {
+		return err
+	}
+	err = fs.recomputeContentSum(inode)
+	if err != nil {
+		return err
+	}
+	err = fs.writeInodeTable()
+	if err != nil || fs.dedup == nil {
+		return err
+	}
+	return fs.persistDataBitmap()
 }
 
-func (fs *FileSystem) WriteInodeContents(inodeIndex int, contents *bytes.Buffer) error {
-	nBlocks := (contents.Len() + BlockSize - 1) / BlockSize
-	inode := fs.inodes[inodeIndex]
+// writeContents writes contents to the data blocks of inode, given in file
+// order. The contents of directories are metadata, logged in the journal if
+// there is one and checksummed if the filesystem has checksums.
+func (fs *FileSystem) writeContents(inode *Inode, blocks []uint32, contents *bytes.Buffer) error {
+	nBlocks := GetSizeInBlocks(contents.Len())
+	if nBlocks > len(blocks) {
+		return fmt.Errorf("%d bytes don't fit in the %d blocks of inode %d", contents.Len(), len(blocks), inode.Index)
+	}
 	// write the data blocks
-	blocks := make([]byte, nBlocks*BlockSize)
+	buf := make([]byte, nBlocks*BlockSize)
 	// copy the contents into the blocks
-	copy(blocks, contents.Bytes())
+	copy(buf, contents.Bytes())
 
-	for i := 0; i < nBlocks; i++ {
-		blockIndex := inode.Blocks[i]
-		fs.dev.WriteBlock(uint64(blockIndex), blocks[i*BlockSize:(i+1)*BlockSize])
+	if (fs.journal != nil || fs.checksums != nil) && inode.Type == InodeTypeDirectory {
+		for i, blockIndex := range blocks[:nBlocks] {
+			err := fs.writeMetadata(uint64(blockIndex), buf[i*BlockSize:(i+1)*BlockSize])
+			if err != nil {
+				return fmt.Errorf("error writing block %d of inode %d: %w", blockIndex, inode.Index, err)
+			}
+		}
+		return nil
 	}
+	for _, blockIndex := range blocks[:nBlocks] {
+		fs.revoke(uint64(blockIndex))
+	}
+	return fs.transferBlocks(true, inode.Index, blocks[:nBlocks], buf)
+}
 
-	return nil
+// WriteInodeTable writes the loaded inodes back to the inode table. Blocks of
+// the table without loaded inodes are left alone; in the others, the slots of
+// inodes that aren't loaded keep what the device holds. In DataOrdered mode
+// the data written before is synced first.
+func (fs *FileSystem) WriteInodeTable() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	return fs.writeInodeTable()
 }
 
-func (fs *FileSystem) WriteInodeTable() error {
-	// write the inode table
-	for i := 0; i < len(fs.inodes); i += BlockSize / InodeSize {
-		// each block is capable of holding 8 inodes
-		// this means that we have to encode 8 inodes at a time
-		// then write the block
-		buf := make([]byte, BlockSize)
-		for j := 0; j < BlockSize/InodeSize; j++ {
-			inodeIndex := i + j
-			if inodeIndex >= len(fs.inodes) {
-				break
+func (fs *FileSystem) writeInodeTable() error {
+	if fs.txn != nil {
+		// Txn.Commit writes it once for the whole transaction
+		return nil
+	}
+	err := fs.markDirty()
+	if err != nil {
+		return err
+	}
+	err = fs.orderData()
+	if err != nil {
+		return err
+	}
+
+	inodesPerBlock := BlockSize / InodeSize
+	buf := make([]byte, BlockSize)
+	for i := 0; i < fs.inodeBitmap.len(); i += inodesPerBlock {
+		loaded := 0
+		for j := i; j < i+inodesPerBlock; j++ {
+			if _, ok := fs.inodes.peek(j); ok {
+				loaded++
+			}
+		}
+		if loaded == 0 {
+			continue
+		}
+
+		blockIndex := uint64(i/inodesPerBlock) + uint64(fs.geometry.InodeTableStart)
+		if loaded < inodesPerBlock {
+			err := fs.readMetadata(blockIndex, buf)
+			if err != nil {
+				return fmt.Errorf("error reading inode table block %d: %w", i/inodesPerBlock, err)
 			}
-			inode := fs.inodes[inodeIndex]
+		}
+
+		for j := 0; j < inodesPerBlock; j++ {
+			inode, ok := fs.inodes.peek(i + j)
+			if !ok {
+				continue
+			}
+			slot := buf[j*InodeSize : (j+1)*InodeSize]
+			for k := range slot {
+				slot[k] = 0
+			}
+			fs.explainInodeWrite(i+j, inode)
 			if inode == nil {
-				// write all 0s
 				continue
 			}
-			enc := gob.NewEncoder(bytes.NewBuffer(buf[j*InodeSize : (j+1)*InodeSize]))
-			err := enc.Encode(inode)
+			encoded, err := encodeInode(inode)
 			if err != nil {
-				return fmt.Errorf("error encoding inode %d: %w", inodeIndex, err)
+				return fmt.Errorf("error encoding inode %d: %w", i+j, err)
+			}
+			if len(encoded) > InodeSize {
+				return fmt.Errorf("inode %d takes %d bytes, more than %d", i+j, len(encoded), InodeSize)
+			}
+			copy(slot, encoded)
+		}
+
+		err := fs.writeMetadata(blockIndex, buf)
+		if err != nil {
+			return fmt.Errorf("error writing inode table block %d: %w", i/inodesPerBlock, err)
+		}
+		// freed slots are zero on the device now; no need to remember them
+		for j := i; j < i+inodesPerBlock; j++ {
+			if inode, ok := fs.inodes.peek(j); ok && inode == nil {
+				fs.inodes.remove(j)
 			}
 		}
-		fs.dev.WriteBlock(uint64(i/8)+InodeStartIndex, buf)
 	}
 
 	return nil
 }
 
-func (fs *FileSystem) CreateFile(filename string, contents *bytes.Buffer) (*Inode, error) {
-	parentInode, err := fs.FindParentInodeByName(filename)
+// DefaultFileMode holds the permission bits of files made by CreateFile.
+const DefaultFileMode = 0644
+
+// CreateFile creates a file with the given absolute name and contents.
+// It fails with ErrExist if the name is taken; to overwrite an existing
+// file, use OpenFile with O_CREATE|O_TRUNC instead.
+func (fs *FileSystem) CreateFile(filename string, contents *bytes.Buffer) (inode *Inode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("CreateFile %s (%d bytes)", filename, contents.Len())
+	defer fs.checkInvariantsAfter("CreateFile")()
+	return fs.createFile(filename, bytes.NewReader(contents.Bytes()), DefaultFileMode)
+}
+
+// CreateFileFromReader is CreateFile with the contents read from r until
+// io.EOF. Blocks are allocated as the data arrives, so the size doesn't need
+// to be known up front, and the contents are never held in memory whole;
+// readers that know their length, such as bytes.Reader, get their blocks at
+// once instead, see CreateOptions.SizeHint. The inode and the bitmaps are
+// written once r is exhausted. It fails with ErrTooLarge if the contents are
+// bigger than MaxFileSize.
+func (fs *FileSystem) CreateFileFromReader(filename string, r io.Reader) (inode *Inode, err error) {
+	return fs.CreateFileFromReaderContext(context.Background(), filename, r)
+}
+
+// CreateFileFromReaderContext is CreateFileFromReader under ctx, see
+// context.go. Reading r isn't cancelled by ctx.
+func (fs *FileSystem) CreateFileFromReaderContext(ctx context.Context, filename string, r io.Reader) (inode *Inode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("CreateFileFromReader %s", filename)
+	defer fs.checkInvariantsAfter("CreateFileFromReader")()
+	defer fs.withContext(ctx)()
+	return fs.createFile(filename, r, DefaultFileMode)
+}
+
+// createFile is CreateFileFromReader with explicit permission bits.
+func (fs *FileSystem) createFile(filename string, r io.Reader, perm iofs.FileMode) (*Inode, error) {
+	return fs.createInode(filename, InodeTypeFile, r, perm, fs.compression)
+}
+
+// createInode creates an inode of the given type with the given absolute
+// name, permission bits and contents, and links it into its directory.
+// Files are compressed as given, if the format version allows.
+func (fs *FileSystem) createInode(filename string, typ InodeType, r io.Reader, perm iofs.FileMode, compression Compression) (inode *Inode, err error) {
+	err = checkName(baseName(filename))
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", filename, err)
+	}
+	parentInode, err := fs.findParent(filename)
 
 	if err != nil {
 		return nil, fmt.Errorf("error when finding parent inode: %w", err)
@@ -443,92 +1040,316 @@ func (fs *FileSystem) CreateFile(filename string, contents *bytes.Buffer) (*Inod
 
 	// check if the parent inode is a directory
 	if parentInode.Type != InodeTypeDirectory {
-		return nil, fmt.Errorf("parent inode is not a directory")
+		return nil, fmt.Errorf("error creating %s: parent: %w", filename, ErrNotDirectory)
+	}
+	err = fs.checkAccess(parentInode, accessWrite)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", filename, err)
+	}
+
+	// check that the name isn't taken
+	_, err = fs.lookup(int(parentInode.Index), baseName(filename))
+	if err == nil {
+		return nil, fmt.Errorf("error creating %s: %w", filename, ErrExist)
+	}
+	if !errors.Is(err, ErrNotExist) {
+		return nil, err
 	}
 
+	return fs.newInode(parentInode, filename, typ, r, perm, compression, func(_ *metadataSnapshot, inode *Inode) error {
+		err := fs.addFileToDir(int(parentInode.Index), int(inode.Index))
+		if err != nil {
+			return fmt.Errorf("error adding file to directory: %w", err)
+		}
+		return nil
+	})
+}
+
+// newInode creates the inode of createInode in parentInode, once the name
+// is checked, and calls link to give it its name once the inode and the
+// bitmaps are written. link may add to the snapshot the whole creation is
+// rolled back to if it fails.
+func (fs *FileSystem) newInode(parentInode *Inode, filename string, typ InodeType, r io.Reader, perm iofs.FileMode, compression Compression, link func(*metadataSnapshot, *Inode) error) (inode *Inode, err error) {
 	// find an free inode
-	inodeIndex, err := fs.FindFreeInode()
+	inodeIndex, err := fs.findFreeInode()
 
 	if err != nil {
 		return nil, fmt.Errorf("error when finding free inode: %w", err)
 	}
 
-	nBlocks := GetSizeInBlocks(contents.Len())
-
-	dataBlockIndices, err := fs.FindEmptyBlocks(nBlocks)
+	// from here on the filesystem gets modified; undo everything if a
+	// later step fails
+	snapshot := fs.snapshot(inodeIndex, int(parentInode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+			inode = nil
+		}
+		fs.release(snapshot)
+	}()
 
+	generation, err := fs.nextInodeGeneration()
 	if err != nil {
-		return nil, fmt.Errorf("error when finding blocks for new file: %w", err)
+		return nil, err
 	}
 
-	dataBlockIndicesArray := [16]uint32{}
-	copy(dataBlockIndicesArray[:], dataBlockIndices)
-
 	// create the inode
-	inode := &Inode{
+	now := fs.now().Unix()
+	inode = &Inode{
 		Index:    uint32(inodeIndex),
-		Type:     InodeTypeFile,
-		Size:     uint32(contents.Len()),
-		Blocks:   dataBlockIndicesArray,
-		Filename: GetRelativePathFromAbsolute(filename),
+		Type:     typ,
+		Filename: baseName(filename),
+		Mode:     uint32(perm.Perm()),
+		Created:  now,
+		Modified: now,
+		Accessed: now,
+		Changed:  now,
+		Links:    1,
+
+		Generation: generation,
+		BinaryDir:  typ == InodeTypeDirectory,
+		// the checksum of no contents is 0
+		contentSummed: typ == InodeTypeFile,
+		extentMapped:  fs.version >= extentVersion,
+		// new directories have no entries
+		entriesCounted: typ == InodeTypeDirectory && fs.version >= entryCountVersion,
+	}
+	if typ == InodeTypeFile && compression == CompressionGzip && fs.version >= compressionVersion {
+		inode.compression = compression
+	}
+	inode.inherit(parentInode)
+	fs.setOwner(inode)
+	fs.inodes.put(inodeIndex, inode)
+	fs.inodes.pin(inodeIndex)
+	defer fs.inodes.unpin(inodeIndex)
+	err = fs.chargeQuota(snapshot, inode, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", filename, err)
+	}
+
+	// write inode contents
+	err = fs.writeContentsFrom(inode, r)
+	if err != nil {
+		return nil, fmt.Errorf("error writing contents of %s: %w", filename, err)
+	}
+	if typ == InodeTypeFile {
+		// the size isn't known before r is exhausted
+		err = fs.chargeQuota(snapshot, inode, int64(inode.Size), 0)
+		if err != nil {
+			return nil, fmt.Errorf("error writing contents of %s: %w", filename, err)
+		}
 	}
 
 	// write the inode to the inode table
-	fs.inodes[inodeIndex] = inode
-	err = fs.WriteInodeTable()
+	err = fs.writeInodeTable()
 	if err != nil {
 		return nil, fmt.Errorf("error writing inode table: %w", err)
 	}
 
-	// write inode contents
-	err = fs.WriteInodeContents(int(inode.Index), contents)
+	// the inode is an orphan until link gives it its name, so a crash
+	// before that doesn't leak it
+	err = fs.addOrphan(inodeIndex)
 	if err != nil {
-		return nil, fmt.Errorf("error writing inode contents: %w", err)
+		return nil, err
+	}
+
+	// write the data bitmap, before the inode is marked allocated with
+	// blocks still marked free
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return nil, fmt.Errorf("error persisting data bitmap when creating file: %w", err)
 	}
 
 	// update the inode bitmap
-	fs.inodeBitmap[inodeIndex] = 1
+	fs.setInodeAllocated(inodeIndex, true)
 
 	// write the inode bitmap
-	err = fs.PersistInodeBitmap()
-
-	// update the data bitmap
-	for _, blockIndex := range dataBlockIndices {
-		fs.dataBitmap[blockIndex] = 1
-	}
-	// write the data bitmap
-	err = fs.PersistDataBitmap()
+	err = fs.persistInodeBitmap()
 	if err != nil {
 		return nil, fmt.Errorf("error persisting inode bitmap when creating file: %w", err)
 	}
 
+	// give the inode its name
+	err = link(snapshot, inode)
 	if err != nil {
-		return nil, fmt.Errorf("error persisting data bitmap when creating file: %w", err)
+		return nil, err
 	}
-
-	// update the parent directory
-	err = fs.AddFileToDir(int(parentInode.Index), inodeIndex)
+	err = fs.removeOrphan(inodeIndex)
 	if err != nil {
-		return nil, fmt.Errorf("error adding file to directory: %w", err)
+		return nil, err
 	}
 
 	return inode, nil
 }
 
+// writeContentsFrom copies r into new blocks appended to inode, a block at a
+// time, marking the blocks used in the in-memory data bitmap. If r knows
+// its length, see lenReader, the blocks for it are allocated at once, so
+// they come from one run if there is one, and any it doesn't fill are freed
+// at the end; past them, blocks are allocated as the data arrives. The
+// pointer blocks are allocated and written once r is exhausted. Compressed
+// files are read whole first instead, to compress them. On filesystems with
+// a dedup table, the blocks of files already holding the same bytes are
+// referenced instead of written, see dedup.go. The caller persists the inode
+// and the bitmap, or rolls them back on failure.
+func (fs *FileSystem) writeContentsFrom(inode *Inode, r io.Reader) error {
+	err := fs.markDirty()
+	if err != nil {
+		return err
+	}
+	if inode.compressed() {
+		data, err := readAllFrom(r)
+		if err != nil {
+			return err
+		}
+		return fs.storeCompressed(inode, data)
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	blocks := append([]uint32{}, old.data...)
+
+	// a hint of more than there is room for is left to fail as the data
+	// arrives
+	reserved := []uint32{}
+	if lr, ok := r.(lenReader); ok && lr.Len() > 0 && lr.Len() <= MaxFileSize {
+		if n := GetSizeInBlocks(lr.Len()); n <= fs.freeBlocks.free {
+			reserved, err = fs.findContiguousBlocks(n, blocks)
+			if err != nil {
+				return fmt.Errorf("error finding %d blocks: %w", n, err)
+			}
+			for _, blockIndex := range reserved {
+				fs.setBlockAllocated(blockIndex, true)
+			}
+		}
+	}
+
+	dedup := fs.dedup != nil && inode.Type == InodeTypeFile
+	var scratch []byte
+	if dedup {
+		scratch = make([]byte, BlockSize)
+	}
+	// on VectoredBlockDevices, blocks that follow each other are written
+	// in runs; duplicates are looked for among the blocks written before,
+	// so with dedup they are written at once
+	var run *runWriter
+	if _, ok := fs.vectoredDevice(); ok && !dedup {
+		run = &runWriter{fs: fs, inodeIndex: inode.Index}
+	}
+	buf := make([]byte, BlockSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if int64(inode.Size)+int64(n) > MaxFileSize {
+				return fmt.Errorf("more than %d bytes: %w", int64(MaxFileSize), ErrTooLarge)
+			}
+			// zero the rest of a final partial block
+			for i := n; i < BlockSize; i++ {
+				buf[i] = 0
+			}
+
+			var blockIndex uint32
+			var hash uint64
+			found := false
+			if dedup {
+				hash = dedupHash(buf)
+				blockIndex, found, err = fs.findDuplicate(buf, hash, scratch)
+				if err != nil {
+					return err
+				}
+			}
+			if !found {
+				if len(reserved) > 0 {
+					blockIndex, reserved = reserved[0], reserved[1:]
+				} else {
+					blockIndices, err := fs.findContiguousBlocks(1, blocks)
+					if err != nil {
+						return fmt.Errorf("error finding a block after %d bytes: %w", inode.Size, err)
+					}
+					blockIndex = blockIndices[0]
+					fs.setBlockAllocated(blockIndex, true)
+				}
+				fs.revoke(uint64(blockIndex))
+				if run != nil {
+					err = run.write(uint64(blockIndex), buf)
+				} else {
+					err = fs.writeBlock(uint64(blockIndex), buf)
+					if err != nil {
+						err = fmt.Errorf("error writing block %d of inode %d: %w", blockIndex, inode.Index, err)
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if dedup {
+				fs.dedup.ref(blockIndex, hash)
+			}
+			blocks = append(blocks, blockIndex)
+			fs.extendContentSum(inode, 0, buf[:n])
+			inode.Size += uint32(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			// r held less than it said
+			for _, blockIndex := range reserved {
+				fs.setBlockAllocated(blockIndex, false)
+			}
+			if run != nil {
+				err = run.flush()
+				if err != nil {
+					return err
+				}
+			}
+			return fs.mapBlocks(inode, old, blocks)
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// lenReader is implemented by readers that know how many bytes they have
+// left, such as bytes.Reader, and by the readers of files created with a
+// CreateOptions.SizeHint.
+type lenReader interface {
+	Len() int
+}
+
+// sizeHinted gives a reader the length it is expected to have.
+type sizeHinted struct {
+	io.Reader
+	n int
+}
+
+func (r sizeHinted) Len() int {
+	return r.n
+}
+
 func (fs *FileSystem) FindInodeByName(filename string) (*Inode, error) {
-	path := strings.Split(filename, "/")
-	if path[0] != "" {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.findInode(filename)
+}
+
+func (fs *FileSystem) findInode(filename string) (*Inode, error) {
+	if !strings.HasPrefix(filename, "/") {
 		return nil, fmt.Errorf("filename must be absolute")
 	}
-	return fs.traversePath(path)
+	return fs.traversePath(filename)
 }
 
 func (fs *FileSystem) FindParentInodeByName(filename string) (*Inode, error) {
-	path := strings.Split(filename, "/")
-	if path[0] != "" {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.findParent(filename)
+}
+
+func (fs *FileSystem) findParent(filename string) (*Inode, error) {
+	if !strings.HasPrefix(filename, "/") {
 		return nil, fmt.Errorf("filename must be absolute")
 	}
-	return fs.traversePath(path[:len(path)-1])
+	return fs.traversePath(filename[:strings.LastIndexByte(filename, '/')])
 }
 
 func GetRelativePathFromAbsolute(filename string) string {
@@ -539,69 +1360,169 @@ func GetRelativePathFromAbsolute(filename string) string {
 	return strings.Join(path[1:], "/")
 }
 
-func (fs *FileSystem) traversePath(path []string) (*Inode, error) {
+// traversePath resolves path from the root directory. Every component of
+// the path is preceded by a slash, so "" is the root itself and "/" is the
+// entry with an empty name in it. Paths aren't cleaned.
+func (fs *FileSystem) traversePath(path string) (*Inode, error) {
 	// start at the root inode
 	inodeIndex := 0
-	inode := fs.inodes[inodeIndex]
-	for i := 1; i < len(path); i++ {
-		children, err := fs.ReadDir(inodeIndex)
-		if err != nil {
-			return nil, fmt.Errorf("error reading directory %s: %w", path[i], err)
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	for path != "" {
+		name, rest := path[1:], ""
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, rest = name[:i], name[i:]
 		}
-		found := false
-		for _, child := range children {
-			if child.Filename == path[i] {
-				inodeIndex = int(child.Index)
-				inode = child
-				found = true
-				break
-			}
+		if inode.Type != InodeTypeDirectory {
+			return nil, fmt.Errorf("%s: %w", name, ErrNotDirectory)
 		}
-		if !found {
-			return nil, fmt.Errorf("directory %s not found", path[i])
+		child, err := fs.lookup(inodeIndex, name)
+		if err != nil {
+			return nil, err
 		}
+		inodeIndex = int(child.Index)
+		inode = child
+		path = rest
 	}
 
 	return inode, nil
 }
 
-func (fs *FileSystem) FindFreeInode() (int, error) {
-	for i := 0; i < 32; i++ {
-		if fs.inodeBitmap[i] == 0 {
-			return i, nil
+// lookup finds the entry with the given name in a directory.
+// It returns an error wrapping ErrNotExist if there is none.
+func (fs *FileSystem) lookup(dirInodeIndex int, name string) (*Inode, error) {
+	dir, err := fs.allocatedInode(dirInodeIndex)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+	}
+	if dir.dirIndexed {
+		return fs.lookupIndexed(dir, name)
+	}
+	bufp := contentsPool.Get().(*[]byte)
+	defer contentsPool.Put(bufp)
+	contents, err := fs.readContentsInto(dir, *bufp)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", name, err)
+	}
+	*bufp = contents[:0]
+
+	r := newDirReader(dir, contents)
+	for r.next() {
+		if string(r.name) == name {
+			return fs.lookupChild(r.inode, name)
 		}
 	}
+	if r.err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", name, r.err)
+	}
+	return nil, fmt.Errorf("%s not found: %w", name, ErrNotExist)
+}
 
-	return 0, fmt.Errorf("no empty inodes")
+// lookupChild returns the inode a directory entry points at.
+func (fs *FileSystem) lookupChild(inodeIndex int, name string) (*Inode, error) {
+	if inodeIndex >= fs.inodeBitmap.len() {
+		return nil, fmt.Errorf("directory entry %s points at invalid inode %d", name, inodeIndex)
+	}
+	child, err := fs.inode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if child == nil {
+		return nil, fmt.Errorf("directory entry %s points at unallocated inode %d", name, inodeIndex)
+	}
+	return child, nil
 }
 
-func (fs *FileSystem) PersistDataBitmap() error {
-	return fs.dev.WriteBlock(DataBitmapIndex, fs.dataBitmap[:])
+// FindFreeInode returns the lowest free inode index.
+func (fs *FileSystem) FindFreeInode() (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.findFreeInode()
 }
 
-func (fs *FileSystem) PersistInodeBitmap() error {
-	return fs.dev.WriteBlock(InodeBitmapIndex, fs.inodeBitmap[:])
+func (fs *FileSystem) findFreeInode() (int, error) {
+	fs.releaseQuarantine()
+	free := fs.freeInodes.lowest(1)
+	if len(free) == 0 {
+		return 0, fmt.Errorf("no free inodes: %w", ErrNoSpace)
+	}
+	return free[0], nil
 }
 
-func (fs *FileSystem) FindEmptyBlocks(n int) ([]uint32, error) {
-	dataBlockIndices := []uint32{}
+func (fs *FileSystem) PersistDataBitmap() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	return fs.persistDataBitmap()
+}
 
-	for i := 0; i < 32; i++ {
-		if fs.dataBitmap[i] == 0 {
-			dataBlockIndices = append(dataBlockIndices, uint32(i)+DataStartIndex)
-			if len(dataBlockIndices) == n {
-				break
-			}
-		}
+func (fs *FileSystem) persistDataBitmap() error {
+	if fs.txn != nil {
+		return nil
+	}
+	err := fs.markDirty()
+	if err != nil {
+		return err
 	}
+	err = fs.flushBitmap(fs.dataBitmap)
+	if err != nil {
+		return err
+	}
+	// the dedup table changes along with the data bitmap
+	return fs.flushDedup()
+}
 
-	if len(dataBlockIndices) != n {
-		return dataBlockIndices, fmt.Errorf("not enough empty data blocks")
+func (fs *FileSystem) PersistInodeBitmap() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	return fs.persistInodeBitmap()
+}
+
+func (fs *FileSystem) persistInodeBitmap() error {
+	if fs.txn != nil {
+		return nil
 	}
+	err := fs.markDirty()
+	if err != nil {
+		return err
+	}
+	return fs.flushBitmap(fs.inodeBitmap)
+}
 
+// FindEmptyBlocks returns the device indices of the n lowest free data
+// blocks, in ascending order.
+func (fs *FileSystem) FindEmptyBlocks(n int) ([]uint32, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dataBlockIndices := []uint32{}
+	for _, i := range fs.freeBlocks.lowest(n) {
+		dataBlockIndices = append(dataBlockIndices, uint32(i)+fs.geometry.DataStart)
+	}
+	if len(dataBlockIndices) != n {
+		return dataBlockIndices, fmt.Errorf("not enough free data blocks: %w", ErrNoSpace)
+	}
 	return dataBlockIndices, nil
 }
 
+// findEmptyBlocks allocates the n lowest free data blocks, for metadata.
+func (fs *FileSystem) findEmptyBlocks(n int) ([]uint32, error) {
+	return fs.allocateBlocks(n, -1, firstFitAllocator{})
+}
+
+// findContiguousBlocks allocates n data blocks to append to a file with the
+// given blocks, with the allocator of the policy in effect, which tries to
+// continue them after the file's last one; see AllocPolicy.
+func (fs *FileSystem) findContiguousBlocks(n int, blocks []uint32) ([]uint32, error) {
+	goal := -1
+	if len(blocks) > 0 {
+		goal = int(blocks[len(blocks)-1]+1) - int(fs.geometry.DataStart)
+	}
+	return fs.allocateBlocks(n, goal, fs.allocPolicy.allocator())
+}
+
 // GetSizeInBlocks computes how many blocks n bytes take up
 func GetSizeInBlocks(n int) int {
 	return (n + BlockSize - 1) / BlockSize
@@ -617,24 +1538,77 @@ func NewArrayBlockDevice(buf []byte) *ArrayBlockDevice {
 
 // ReadBlock reads a block from the device into the buffer
 func (dev *ArrayBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
 	copy(buf, dev.buf[blockNum*4096:(blockNum+1)*4096])
 	return nil
 }
 
+// ReadBlocks reads consecutive blocks, from start on, a block into each
+// buffer
+func (dev *ArrayBlockDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		blockNum := start + uint64(i)
+		copy(buf, dev.buf[blockNum*4096:(blockNum+1)*4096])
+	}
+	return nil
+}
+
+// WriteBlocks writes the buffers to consecutive blocks, from start on
+func (dev *ArrayBlockDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		blockNum := start + uint64(i)
+		copy(dev.buf[blockNum*4096:(blockNum+1)*4096], buf)
+	}
+	return nil
+}
+
+// Flush does nothing, as the device is in memory
+func (dev *ArrayBlockDevice) Flush() error {
+	return nil
+}
+
 // WriteBlock writes a block from the buffer to the device
 func (dev *ArrayBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
 	copy(dev.buf[blockNum*4096:(blockNum+1)*4096], buf)
 	return nil
 }
 
-// Dump prints the contents of the device
-func (dev *ArrayBlockDevice) Dump() {
-	fmt.Printf("ArrayBlockDevice: %d bytes\n", len(dev.buf))
-	for i := 0; i < len(dev.buf); i++ {
-		fmt.Printf("%02x ", dev.buf[i])
-		if i%16 == 15 {
-			fmt.Println()
-		}
+// BlockCount returns the number of blocks on the device.
+func (dev *ArrayBlockDevice) BlockCount() uint64 {
+	return uint64(len(dev.buf) / BlockSize)
+}
+
+// Size returns the number of blocks on the device, like BlockCount.
+func (dev *ArrayBlockDevice) Size() uint64 {
+	return dev.BlockCount()
+}
+
+// checkBounds returns an error if blockNum is past the end of the device.
+func (dev *ArrayBlockDevice) checkBounds(blockNum uint64) error {
+	nBlocks := uint64(len(dev.buf) / BlockSize)
+	if blockNum >= nBlocks {
+		return fmt.Errorf("block %d out of range (device has %d blocks)", blockNum, nBlocks)
 	}
-	fmt.Println()
+	return nil
 }
@@ -2,11 +2,53 @@ package fs
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
 
+// failingDevice wraps a device and fails the failReadAt-th read and the
+// failWriteAt-th write (counting from 1; 0 never fails). If sticky is set,
+// every operation after a failure fails too.
+type failingDevice struct {
+	BlockDevice
+	reads       int
+	writes      int
+	failReadAt  int
+	failWriteAt int
+	sticky      bool
+}
+
+var errInjected = errors.New("injected device failure")
+
+func (dev *failingDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	dev.reads++
+	if dev.failReadAt > 0 && (dev.reads == dev.failReadAt || dev.sticky && dev.reads > dev.failReadAt) {
+		return errInjected
+	}
+	return dev.BlockDevice.ReadBlock(blockNum, buf)
+}
+
+func (dev *failingDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev.writes++
+	if dev.failWriteAt > 0 && (dev.writes == dev.failWriteAt || dev.sticky && dev.writes > dev.failWriteAt) {
+		return errInjected
+	}
+	return dev.BlockDevice.WriteBlock(blockNum, buf)
+}
+
+// newTestFileSystem creates a filesystem on an array big enough to hold
+// every data block.
+func newTestFileSystem(t *testing.T) *FileSystem {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	return filesystem
+}
+
 func TestFSInit(t *testing.T) {
 	// create a 32KiB array
 	disk := make([]byte, 32*1024)
@@ -48,8 +90,9 @@ func TestFSInit(t *testing.T) {
 
 	require.NoError(t, err)
 
-	// All data blocks are free
-	for i := 0; i < BlockSize; i++ {
+	// data block 0 holds the end of the inode table; the others are free
+	require.Equal(t, byte(1), buf[0])
+	for i := 1; i < BlockSize; i++ {
 		require.Equal(t, byte(0), byte(buf[i]))
 	}
 
@@ -70,8 +113,8 @@ func TestFSInit(t *testing.T) {
 }
 
 func TestCreateFile(t *testing.T) {
-	// create a 32KiB array
-	disk := make([]byte, 32*1024)
+	// create an array big enough to hold every data block
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
 	// create a BlockDevice that uses the array as storage
 	dev := NewArrayBlockDevice(disk)
 
@@ -99,7 +142,322 @@ func TestCreateFile(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, len(dir), 1)
 
-	require.Equal(t, dir[0].Filename, "foo")
+	require.Equal(t, dir[0].Name, "foo")
 	require.Equal(t, dir[0].Type, InodeType(InodeTypeFile))
 	require.Equal(t, dir[0].Size, uint32(len(str)))
 }
+
+func TestCreateEmptyFile(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/empty", bytes.NewBuffer([]byte{}))
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), inode.Size)
+	require.Equal(t, uint32(0), inode.Blocks[0])
+
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, 0, contents.Len())
+}
+
+func TestCreateFileFromReader(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	contents := make([]byte, 3*BlockSize+10)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+
+	// the reader hands out a byte at a time
+	inode, err := filesystem.CreateFileFromReader("/foo", iotest.OneByteReader(bytes.NewReader(contents)))
+	require.NoError(t, err)
+	require.Equal(t, uint32(len(contents)), inode.Size)
+	require.Len(t, inode.usedBlocks(), 4)
+	read, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+	require.NoError(t, filesystem.CheckInvariants())
+
+	free := filesystem.freeBlocks.free
+	failures := map[string]io.Reader{
+		"no space":     bytes.NewReader(make([]byte, 32*BlockSize)),
+		"reader error": io.MultiReader(bytes.NewReader(make([]byte, 2*BlockSize)), iotest.ErrReader(errInjected)),
+	}
+	for name, r := range failures {
+		_, err = filesystem.CreateFileFromReader("/bar", r)
+		require.Error(t, err, name)
+		require.Equal(t, free, filesystem.freeBlocks.free, name)
+		_, err = filesystem.FindInodeByName("/bar")
+		require.ErrorIs(t, err, ErrNotExist, name)
+		require.NoError(t, filesystem.CheckInvariants(), name)
+	}
+
+	// a file past the direct blocks of its inode fits
+	_, err = filesystem.CreateFileFromReader("/bar", bytes.NewReader(make([]byte, 16*BlockSize+1)))
+	require.NoError(t, err)
+}
+
+func TestCreateFileSizeHint(t *testing.T) {
+	// a reader that doesn't know its length
+	stream := func(n int) io.Reader {
+		return struct{ io.Reader }{bytes.NewReader(patterned(n * BlockSize))}
+	}
+	for _, tt := range []struct {
+		name string
+		hint int64
+		// extents is the number of runs the file takes
+		extents int
+	}{
+		// block by block, the file starts in the first hole and goes on
+		// wherever there is room
+		{"none", 0, 2},
+		{"exact", 4 * BlockSize, 1},
+		// the blocks left over past the data are freed
+		{"over", 6 * BlockSize, 1},
+		// past the hint, blocks are allocated as the data arrives
+		{"under", 2 * BlockSize, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filesystem, _, _ := newHoleyFileSystem(t, AllocContiguous)
+			free := filesystem.freeBlocks.free
+			before := filesystem.AllocStats()
+			inode, err := filesystem.CreateFileWithOptions("/new", stream(4), CreateOptions{SizeHint: tt.hint})
+			require.NoError(t, err)
+			blocks, err := filesystem.fileBlocks(inode)
+			require.NoError(t, err)
+			require.Len(t, blocks, 4)
+			require.Equal(t, tt.extents, countExtents(blocks))
+			require.Equal(t, free-4, filesystem.freeBlocks.free)
+			if tt.hint >= 4*BlockSize {
+				require.Equal(t, before.Allocations+1, filesystem.AllocStats().Allocations)
+			}
+			contents, err := filesystem.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, patterned(4*BlockSize), contents.Bytes())
+			require.NoError(t, filesystem.CheckInvariants())
+		})
+	}
+
+	// readers knowing their length need no hint
+	filesystem, _, _ := newHoleyFileSystem(t, AllocContiguous)
+	inode, err := filesystem.CreateFile("/new", bytes.NewBuffer(patterned(4*BlockSize)))
+	require.NoError(t, err)
+	blocks, err := filesystem.fileBlocks(inode)
+	require.NoError(t, err)
+	require.Equal(t, 1, countExtents(blocks))
+}
+
+func TestCreateFileRejectsDuplicates(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("first"))
+	require.NoError(t, err)
+	inodeBitmap, dataBitmap := filesystem.inodeBitmap.clone(), filesystem.dataBitmap.clone()
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("second"))
+	require.ErrorIs(t, err, ErrExist)
+
+	// nothing was allocated
+	require.Equal(t, inodeBitmap, filesystem.inodeBitmap.entries)
+	require.Equal(t, dataBitmap, filesystem.dataBitmap.entries)
+	dir, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Len(t, dir, 1)
+
+	// overwriting goes through OpenFile
+	f, err := filesystem.OpenFile("/foo", O_WRONLY|O_CREATE|O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("second"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "second", contents.String())
+}
+
+func TestReadDirDoesNotMutateInodes(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	before := *inode
+
+	dir, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Equal(t, []DirEntry{{Name: "foo", Inode: inode.Index, Type: InodeTypeFile, Size: 5}}, dir)
+
+	// changing the entries doesn't touch the inodes
+	dir[0].Name = "bar"
+	dir[0].Size = 42
+	require.Equal(t, before, *inode)
+
+	dir, err = filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Equal(t, "foo", dir[0].Name)
+}
+
+func TestReadDirByPath(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	inode, err := filesystem.CreateFile("/dir/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	dir, err := filesystem.ReadDirByPath("/dir")
+	require.NoError(t, err)
+	require.Equal(t, []DirEntry{{Name: "foo", Inode: inode.Index, Type: InodeTypeFile, Size: 5}}, dir)
+	dir, err = filesystem.ReadDirByPath("/dir/")
+	require.NoError(t, err)
+	require.Len(t, dir, 1)
+	root, err := filesystem.ReadDirByPath("/")
+	require.NoError(t, err)
+	require.Equal(t, "dir", root[0].Name)
+
+	_, err = filesystem.ReadDirByPath("/dir/foo")
+	require.ErrorIs(t, err, ErrNotDirectory)
+	_, err = filesystem.ReadDirByPath("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+	_, err = filesystem.ReadDirByPath("dir")
+	require.Error(t, err)
+}
+
+func TestNewFileSystemWriteFailures(t *testing.T) {
+	for failAt := 1; ; failAt++ {
+		disk := make([]byte, (DataStartIndex+32)*BlockSize)
+		dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk), failWriteAt: failAt}
+		_, err := NewFileSystem(dev)
+		if err == nil {
+			require.Greater(t, failAt, 1)
+			return
+		}
+		require.ErrorIs(t, err, errInjected, "write %d", failAt)
+	}
+}
+
+func TestLoadFilesystemReadFailures(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	for failAt := 1; ; failAt++ {
+		dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk), failReadAt: failAt}
+		_, err := LoadFilesystem(dev)
+		if err == nil {
+			require.Greater(t, failAt, 1)
+			return
+		}
+		require.ErrorIs(t, err, errInjected, "read %d", failAt)
+	}
+}
+
+func TestLoadFilesystemPlacesInodesAtTheirIndex(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	bar, err := filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+
+	// free /foo, leaving a hole before /bar in the inode table
+	filesystem.inodeBitmap.set(int(foo.Index), false)
+	filesystem.dataBitmap.set(int(foo.Blocks[0]-DataStartIndex), false)
+	require.NoError(t, filesystem.PersistInodeBitmap())
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := reloaded.GetInode(int(foo.Index))
+	require.NoError(t, err)
+	require.Nil(t, inode)
+	inode, err = reloaded.GetInode(int(bar.Index))
+	require.NoError(t, err)
+	require.Equal(t, *bar, *inode)
+}
+
+func TestLoadFilesystemRejectsCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(fs *FileSystem, inode *Inode)
+		want    string
+	}{
+		{"missing root", func(fs *FileSystem, inode *Inode) { fs.inodeBitmap.set(0, false) }, "root directory inode"},
+		{"root type", func(fs *FileSystem, inode *Inode) {
+			root, _ := fs.GetInode(0)
+			root.Type = InodeTypeFile
+		}, "root inode is not a directory"},
+		{"index", func(fs *FileSystem, inode *Inode) { inode.Index = 9 }, "stored index is 9"},
+		{"type", func(fs *FileSystem, inode *Inode) { inode.Type = 42 }, "unknown type 42"},
+		{"extent block", func(fs *FileSystem, inode *Inode) { inode.Indirect = inode.Blocks[0] + 2 }, "needs no extent blocks"},
+		{"block count", func(fs *FileSystem, inode *Inode) { inode.Size = 3 * BlockSize }, "needs 3 blocks, but its extents hold 2"},
+		{"gap", func(fs *FileSystem, inode *Inode) {
+			inode.Blocks[0], inode.Blocks[1], inode.Blocks[4], inode.Blocks[5] = 0, 0, inode.Blocks[0], inode.Blocks[1]
+		}, "gap"},
+		{"block range", func(fs *FileSystem, inode *Inode) { inode.Blocks[0] = 2 }, "outside the data region"},
+		{"shared block", func(fs *FileSystem, inode *Inode) {
+			root, _ := fs.GetInode(0)
+			inode.Blocks[0] = root.Blocks[0] - 1
+		}, "used by both"},
+		{"free block", func(fs *FileSystem, inode *Inode) { fs.dataBitmap.set(int(inode.Blocks[0]-DataStartIndex), false) }, "marked free"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := make([]byte, (DataStartIndex+32)*BlockSize)
+			dev := NewArrayBlockDevice(disk)
+			filesystem, err := NewFileSystem(dev)
+			require.NoError(t, err)
+			inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 2*BlockSize)))
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Close())
+			_, err = LoadFilesystem(dev)
+			require.NoError(t, err)
+
+			tt.corrupt(filesystem, inode)
+			require.NoError(t, filesystem.WriteInodeTable())
+			require.NoError(t, filesystem.PersistInodeBitmap())
+			require.NoError(t, filesystem.PersistDataBitmap())
+			require.NoError(t, filesystem.Close())
+
+			_, err = LoadFilesystem(dev)
+			require.ErrorIs(t, err, ErrCorrupt)
+			require.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestReadFailuresPropagate(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	dev.reads = 0
+	dev.failReadAt = 1
+	_, err = filesystem.ReadFileContents(int(inode.Index))
+	require.ErrorIs(t, err, errInjected)
+
+	dev.reads = 0
+	_, err = filesystem.ReadDir(0)
+	require.ErrorIs(t, err, errInjected)
+
+	dev.reads = 0
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, errInjected)
+}
+
+func TestArrayBlockDeviceBounds(t *testing.T) {
+	dev := NewArrayBlockDevice(make([]byte, 2*BlockSize))
+	buf := make([]byte, BlockSize)
+	require.NoError(t, dev.ReadBlock(1, buf))
+	require.Error(t, dev.ReadBlock(2, buf))
+	require.Error(t, dev.WriteBlock(2, buf))
+}
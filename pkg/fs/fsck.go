@@ -0,0 +1,473 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// FsckOptions configures Fsck.
+type FsckOptions struct {
+	// Repair fixes the problems that can be fixed without guessing, see
+	// Fsck. Without it, the device is only read.
+	Repair bool
+	// Workers is the number of goroutines checking the image, as in
+	// DiagnoseOptions.
+	Workers int
+	// Progress receives an update, with Op "fsck", for every inode checked.
+	// In repair mode, the check after the repairs reports again from the
+	// start.
+	Progress ProgressFunc
+}
+
+// FsckReport is the outcome of Fsck.
+type FsckReport struct {
+	// Problems are the warnings and errors Diagnose found.
+	Problems []Finding
+	// Repairs describes each change made to fix them, in repair mode.
+	Repairs []string
+	// Remaining are the problems left afterwards; without repairs, these
+	// are the Problems.
+	Remaining []Finding
+}
+
+// Fsck checks the consistency of the filesystem on dev, like Diagnose but
+// reporting only warnings and errors: bitmaps that disagree with the blocks
+// inodes use, blocks used twice, or not as many times as the dedup table
+// counts, malformed inodes, directory entries pointing at free inodes, and
+// free counts of the superblock that disagree with the bitmaps.
+//
+// In repair mode, it then fixes what it can, and marks the filesystem
+// clean:
+//   - a transaction committed to the journal is replayed first
+//   - inodes with an unknown type are freed; block pointers past a gap or
+//     outside the data region are dropped, along with the indirect blocks
+//     of inodes that have any; sizes are cut down to the blocks there are,
+//     and blocks past the size are freed; the files get the checksum of
+//     the contents they are left with
+//   - malformed directory entries and entries pointing at free inodes are
+//     removed, and the entries of directories with an entry count are
+//     recounted
+//   - allocated inodes no directory references are linked into the root
+//     directory as "#<index>"
+//   - inodes charged to directories without a quota are charged to none,
+//     and the usage of quota directories is recounted
+//   - both bitmaps are rebuilt from the inodes, and the references to the
+//     blocks of files are recounted in the dedup table, if there is one
+//   - on filesystems with checksums, metadata blocks that don't match
+//     their checksums are rewritten from memory if the repairs cover them,
+//     and otherwise get their checksums recomputed from what they hold
+//   - the free counts of the superblock are rewritten from the bitmaps,
+//     and FlagCheck is cleared
+//
+// Blocks shared by several inodes, other than the blocks of files on
+// filesystems with a dedup table, duplicate names, unreadable blocks and a
+// missing root directory are left for a human to sort out.
+func Fsck(dev BlockDevice, opts FsckOptions) (*FsckReport, error) {
+	diagnose := func() []Finding {
+		problems := []Finding{}
+		for _, f := range DiagnoseWithOptions(dev, DiagnoseOptions{Workers: opts.Workers, Progress: opts.Progress}) {
+			if f.Severity >= SeverityWarning {
+				problems = append(problems, f)
+			}
+		}
+		return problems
+	}
+
+	report := &FsckReport{Problems: diagnose()}
+	report.Remaining = report.Problems
+	if !opts.Repair || len(report.Problems) == 0 {
+		return report, nil
+	}
+
+	fs, err := readFilesystem(dev, false)
+	if err != nil {
+		// Diagnose reported it
+		return report, nil
+	}
+	replayed := []string{}
+	if fs.journal != nil {
+		if n := len(fs.journal.blocks); n > 0 {
+			err = fs.checkpoint()
+			if err != nil {
+				return report, fmt.Errorf("error replaying the journal: %w", err)
+			}
+			replayed = append(replayed, fmt.Sprintf("replayed %d blocks from the journal", n))
+		}
+		// repairs are written in place, as nothing else uses the device
+		fs.journal = nil
+	}
+	report.Repairs, err = fs.repair()
+	report.Repairs = append(replayed, report.Repairs...)
+	if err != nil {
+		return report, fmt.Errorf("error repairing: %w", err)
+	}
+	if len(report.Repairs) > 0 {
+		report.Remaining = diagnose()
+	}
+	return report, nil
+}
+
+// repair fixes the filesystem as described for Fsck and returns the fixes.
+func (fs *FileSystem) repair() ([]string, error) {
+	scan, err := fs.scanInodeTable(1, nil)
+	if err != nil {
+		// the inode table is unreadable; there is nothing to go by
+		return nil, nil
+	}
+	root := scan.inodes[0]
+	if root == nil || root.Type != InodeTypeDirectory {
+		return nil, nil
+	}
+
+	wasDirty := fs.dirty
+	countersWrong := fs.counterMismatch() != ""
+	damaged := fs.checksumMismatches(scan)
+	repairs := []string{}
+	fixed := func(format string, args ...interface{}) {
+		repairs = append(repairs, fmt.Sprintf(format, args...))
+	}
+
+	// keep every inode loaded, so none is evicted before it is written
+	fs.inodes = newInodeCache(fs.inodeBitmap.len())
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		m, ok := fs.repairInode(i, inode, scan.blockMaps[i], fixed)
+		if !ok {
+			scan.inodes[i] = nil
+			fs.inodes.put(i, nil)
+			continue
+		}
+		scan.blockMaps[i] = m
+		fs.inodes.put(i, inode)
+	}
+
+	// rebuild the bitmaps from the inodes that are left
+	inodeBitmap := NewBitmap(fs.inodeBitmap.len())
+	dataBitmap := NewBitmap(fs.dataBitmap.len())
+	dataBitmap.Set(0)
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		inodeBitmap.Set(i)
+		for _, blockIndex := range scan.ownedBlocks(i) {
+			dataBitmap.Set(int(blockIndex - fs.geometry.DataStart))
+		}
+	}
+	// entries of invalid values are read as taken, so they are rewritten
+	// only if the bitmap changes otherwise
+	if !inodeBitmap.Equal(fs.inodeBitmap.entries) || fs.inodeBitmap.invalidValue != 0 {
+		fixed("rebuilt the inode bitmap")
+		fs.inodeBitmap.invalidValue = 0
+		for i := range fs.inodeBitmap.dirty {
+			fs.inodeBitmap.dirty[i] = true
+		}
+	}
+	if !dataBitmap.Equal(fs.dataBitmap.entries) || fs.dataBitmap.invalidValue != 0 {
+		fixed("rebuilt the data bitmap")
+		fs.dataBitmap.invalidValue = 0
+		for i := range fs.dataBitmap.dirty {
+			fs.dataBitmap.dirty[i] = true
+		}
+	}
+	fs.inodeBitmap.replace(inodeBitmap)
+	fs.dataBitmap.replace(dataBitmap)
+	fs.indexFreeSpace()
+	if fs.dedup != nil {
+		err = fs.repairDedup(scan, fixed)
+		if err != nil {
+			return repairs, err
+		}
+	}
+
+	err = fs.writeInodeTable()
+	if err != nil {
+		return repairs, err
+	}
+	err = fs.persistInodeBitmap()
+	if err != nil {
+		return repairs, err
+	}
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return repairs, err
+	}
+
+	// referenced counts the entries pointing at each inode
+	referenced := map[int]int{0: 1}
+	allRead := true
+	for i, inode := range scan.inodes {
+		if inode == nil || inode.Type != InodeTypeDirectory {
+			continue
+		}
+		read, err := fs.repairDir(i, scan, referenced, fixed)
+		if err != nil {
+			return repairs, err
+		}
+		allRead = allRead && read
+	}
+
+	for i, inode := range scan.inodes {
+		// inodes may be referenced from a directory that couldn't be read
+		if inode == nil || referenced[i] > 0 || !allRead {
+			continue
+		}
+		inode.Filename = fmt.Sprintf("#%d", i)
+		err = fs.addFileToDir(0, i)
+		if err != nil {
+			return repairs, fmt.Errorf("error linking inode %d into /: %w", i, err)
+		}
+		referenced[i] = 1
+		fixed("linked orphaned inode %d into / as %s", i, inode.Filename)
+	}
+	for i, inode := range scan.inodes {
+		if inode == nil || i == 0 || inode.Type != InodeTypeFile || !allRead {
+			continue
+		}
+		if links := uint32(referenced[i]); links != inode.links() {
+			fixed("inode %d: corrected its link count from %d to %d", i, inode.links(), links)
+			inode.Links = links
+		}
+	}
+	fs.repairQuotas(scan.inodes, fixed)
+	err = fs.writeInodeTable()
+	if err != nil {
+		return repairs, err
+	}
+
+	if fs.checksums != nil {
+		// the repairs rewrote much of the metadata with fresh checksums,
+		// which may have fixed the damaged blocks already
+		scan, err = fs.scanInodeTable(1, nil)
+		if err != nil {
+			return repairs, err
+		}
+		recomputed, err := fs.recomputeChecksums(scan)
+		if err != nil {
+			return repairs, err
+		}
+		for _, blockNum := range recomputed {
+			fixed("recomputed the checksum of block %d (%s)", blockNum, fs.describeBlock(blockNum))
+		}
+		for _, e := range damaged {
+			if !containsBlock(recomputed, e.Block) {
+				fixed("rewrote block %d (%s), which didn't match its checksum", e.Block, e.What)
+			}
+		}
+	}
+
+	// the superblock gets the counts of the rebuilt bitmaps when it is
+	// closed below
+	if countersWrong || fs.flags&FlagCheck != 0 {
+		fs.flags &^= FlagCheck
+		err = fs.markDirty()
+		if err != nil {
+			return repairs, err
+		}
+		if countersWrong {
+			fixed("rewrote the free counts of the superblock")
+		} else {
+			fixed("cleared the check flag of the superblock")
+		}
+	}
+
+	if wasDirty {
+		fixed("marked the filesystem clean")
+	}
+	return repairs, fs.Close()
+}
+
+// containsBlock reports whether blocks holds blockNum.
+func containsBlock(blocks []uint64, blockNum uint64) bool {
+	for _, b := range blocks {
+		if b == blockNum {
+			return true
+		}
+	}
+	return false
+}
+
+// repairInode fixes an inode read from slot i in place, reporting each fix,
+// and returns its block map; m is the map read by scanInodeTable, if the
+// inode was well formed. It returns false if the inode can't be salvaged and
+// should be freed.
+func (fs *FileSystem) repairInode(i int, inode *Inode, m *blockMap, fixed func(string, ...interface{})) (*blockMap, bool) {
+	if inode.Type != InodeTypeFile && inode.Type != InodeTypeDirectory {
+		fixed("freed inode %d of unknown type %d", i, inode.Type)
+		return nil, false
+	}
+	if int(inode.Index) != i {
+		fixed("inode %d: corrected stored index %d", i, inode.Index)
+		inode.Index = uint32(i)
+		if inode.validate(i) == nil {
+			m, _ = fs.readBlockMap(inode)
+		}
+	}
+	if inode.xattrBlock != 0 && !fs.isDataBlock(inode.xattrBlock) {
+		fixed("inode %d: dropped its extended attributes, whose block %d is outside the data region", i, inode.xattrBlock)
+		inode.xattrBlock = 0
+		if m != nil {
+			m.xattrs = 0
+		}
+	}
+	if m != nil {
+		intact := true
+		for _, blockIndex := range m.owned() {
+			intact = intact && fs.isDataBlock(blockIndex)
+		}
+		if intact {
+			return m, true
+		}
+	}
+
+	// otherwise keep the blocks the inode holds itself, which need no
+	// pointer or extent blocks
+	if inode.Indirect != 0 || inode.DoubleIndirect != 0 {
+		inode.Indirect, inode.DoubleIndirect = 0, 0
+		if inode.extentMapped {
+			fixed("inode %d: dropped its extent blocks", i)
+		} else {
+			fixed("inode %d: dropped its indirect blocks", i)
+		}
+	}
+	var blocks []uint32
+	if inode.extentMapped {
+		blocks = fs.salvageExtents(i, inode, fixed)
+	} else {
+		blocks = fs.salvagePointers(i, inode, fixed)
+	}
+
+	switch need := inode.StoredBlocks(); {
+	case need > len(blocks) && inode.compressed():
+		// what is left of compressed contents can't be decompressed
+		fixed("inode %d: dropped its compressed contents, which lost %d of their %d blocks", i, need-len(blocks), need)
+		inode.Size, inode.compression, inode.compressedSize = 0, CompressionDefault, 0
+		blocks = nil
+	case need > len(blocks):
+		fixed("inode %d: cut size %d down to the %d blocks it has", i, inode.Size, len(blocks))
+		inode.Size = uint32(len(blocks) * BlockSize)
+	case need < len(blocks):
+		fixed("inode %d: freed %d blocks past its size", i, len(blocks)-need)
+		blocks = blocks[:need]
+	}
+	if inode.extentMapped {
+		inode.setInlineExtents(blockExtents(blocks))
+	} else {
+		inode.Blocks = [directBlocks]uint32{}
+		copy(inode.Blocks[:], blocks)
+	}
+	// the checksum of the contents is that of what is left of them
+	if inode.Type == InodeTypeFile && fs.recomputeContentSum(inode) != nil {
+		inode.contentSummed = false
+	}
+	return &blockMap{data: blocks, extents: blockExtents(blocks), xattrs: inode.xattrBlock}, true
+}
+
+// salvagePointers returns the direct blocks of inode up to the first gap or
+// pointer outside the data region, reporting the pointers dropped past it.
+func (fs *FileSystem) salvagePointers(i int, inode *Inode, fixed func(string, ...interface{})) []uint32 {
+	n := 0
+	for n < len(inode.Blocks) && fs.isDataBlock(inode.Blocks[n]) {
+		n++
+	}
+	dropped := 0
+	for _, blockIndex := range inode.Blocks[n:] {
+		if blockIndex != 0 {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		fixed("inode %d: dropped %d block pointers past a gap or outside the data region", i, dropped)
+	}
+	return append([]uint32{}, inode.Blocks[:n]...)
+}
+
+// salvageExtents returns the blocks of the inline extents of inode up to the
+// first gap or block outside the data region, reporting the extents dropped
+// past it.
+func (fs *FileSystem) salvageExtents(i int, inode *Inode, fixed func(string, ...interface{})) []uint32 {
+	blocks := []uint32{}
+	kept := 0
+	for ; kept < inlineExtents; kept++ {
+		start, length := inode.Blocks[2*kept], inode.Blocks[2*kept+1]
+		if length == 0 || !fs.isDataBlock(start) || !fs.isDataBlock(start+length-1) || start+length < start {
+			break
+		}
+		for j := uint32(0); j < length; j++ {
+			blocks = append(blocks, start+j)
+		}
+	}
+	dropped := 0
+	for j := kept; j < inlineExtents; j++ {
+		if inode.Blocks[2*j] != 0 || inode.Blocks[2*j+1] != 0 {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		fixed("inode %d: dropped %d extents past a gap or outside the data region", i, dropped)
+	}
+	return blocks
+}
+
+// repairDir removes the malformed entries of a directory and those pointing
+// at free inodes or the root, and counts the entries pointing at each inode.
+// Past a malformed binary entry, the rest of the entries can't be found, so
+// they are removed too. Directories that can't be read are left alone, and
+// false is returned.
+func (fs *FileSystem) repairDir(dir int, scan *inodeScan, referenced map[int]int, fixed func(string, ...interface{})) (bool, error) {
+	contents, err := fs.readContents(scan.inodes[dir])
+	if err != nil {
+		return false, nil
+	}
+
+	kept := []dirRecord{}
+	changed := false
+	r := newDirReader(scan.inodes[dir], contents.Bytes())
+	for {
+		if !r.next() {
+			if r.err == nil {
+				break
+			}
+			changed = true
+			if r.binary {
+				fixed("directory %d: truncated at a malformed entry, dropping %d bytes (%v)", dir, len(r.contents), r.err)
+				break
+			}
+			// the reader is past the line already
+			fixed("directory %d: removed malformed entry (%v)", dir, r.err)
+			r.err = nil
+			continue
+		}
+		record := dirRecord{name: string(r.name), inode: r.inode, typ: r.typ}
+		switch {
+		case record.inode == 0:
+			fixed("directory %d: removed entry %s pointing at the root directory", dir, record.name)
+			changed = true
+			continue
+		case record.inode >= len(scan.inodes) || scan.inodes[record.inode] == nil:
+			fixed("directory %d: removed entry %s pointing at free inode %d", dir, record.name, record.inode)
+			changed = true
+			continue
+		}
+		if r.binary && record.typ != scan.inodes[record.inode].Type {
+			record.typ = scan.inodes[record.inode].Type
+			fixed("directory %d: corrected the type of entry %s to %s", dir, record.name, describeInodeType(record.typ))
+			changed = true
+		}
+		referenced[record.inode]++
+		kept = append(kept, record)
+	}
+	if !changed {
+		if n, ok := scan.inodes[dir].Entries(); ok && n != len(kept) {
+			fixed("directory %d: recounted its entries as %d, not %d", dir, len(kept), n)
+			scan.inodes[dir].entries = uint32(len(kept))
+		}
+		return true, nil
+	}
+	err = fs.writeDirRecords(dir, kept)
+	if err != nil {
+		return true, fmt.Errorf("error rewriting directory %d: %w", dir, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsckHealthy(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	before := bytes.Clone(disk)
+	var last Progress
+	report, err := Fsck(dev, FsckOptions{Repair: true, Progress: func(p Progress) { last = p }})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Empty(t, report.Repairs)
+	require.Empty(t, report.Remaining)
+	require.Equal(t, before, disk)
+	require.Equal(t, "fsck", last.Op)
+	require.NotZero(t, last.Items)
+	require.Equal(t, last.TotalItems, last.Items)
+}
+
+func TestFsckRepair(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+	bar, err := filesystem.CreateFile("/bar", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.NoError(t, err)
+	baz, err := filesystem.CreateFile("/baz", bytes.NewBufferString("baz"))
+	require.NoError(t, err)
+
+	// foo's block is marked free and another block leaks
+	filesystem.dataBitmap.set(int(foo.Blocks[0]-DataStartIndex), false)
+	filesystem.dataBitmap.set(20, true)
+	// bar claims less than it has
+	bar.Size = BlockSize
+	// baz drops out of the root directory, which holds text entries as on
+	// old images, and an entry points at a free inode
+	root, err := filesystem.allocatedInode(0)
+	require.NoError(t, err)
+	root.BinaryDir = false
+	require.NoError(t, filesystem.setInodeContents(0, bytes.NewBufferString("1 foo\n2 bar\n9 ghost\n")))
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.PersistDataBitmap())
+	// the filesystem is left dirty
+
+	check, err := Fsck(dev, FsckOptions{})
+	require.NoError(t, err)
+	require.NotEmpty(t, check.Problems)
+	require.Empty(t, check.Repairs)
+	require.Equal(t, check.Problems, check.Remaining)
+
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, check.Problems, report.Problems)
+	require.Equal(t, []string{
+		"inode 2: freed 2 blocks past its size",
+		"rebuilt the data bitmap",
+		"directory 0: removed entry ghost pointing at free inode 9",
+		"linked orphaned inode 3 into / as #3",
+		"marked the filesystem clean",
+	}, report.Repairs)
+	require.Empty(t, report.Remaining)
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, reloaded.CheckInvariants())
+	inode, err := reloaded.FindInodeByName("/#3")
+	require.NoError(t, err)
+	require.Equal(t, baz.Index, inode.Index)
+	contents, err := reloaded.ReadFileContents(int(foo.Index))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", contents.String())
+}
+
+func TestFsckUnrepairable(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	bar, err := filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+
+	// both files claim the same block
+	filesystem.setBlockAllocated(bar.Blocks[0], false)
+	bar.Blocks[0] = foo.Blocks[0]
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.Close())
+
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Empty(t, report.Repairs)
+	require.Len(t, report.Remaining, 1)
+	require.Contains(t, report.Remaining[0].Message, "is shared by inodes [1 2]")
+}
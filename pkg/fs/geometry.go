@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrGeometry is returned when mounting a filesystem whose geometry this
+// package can't handle, or that doesn't fit on its device.
+var ErrGeometry = errors.New("unsupported filesystem geometry")
+
+// Geometry describes the size and layout of a filesystem, as recorded in its
+// superblock when it was formatted.
+//
+// The superblock is followed by the journal, the checksum table and the
+// dedup table, if the filesystem has them, the inode bitmap, the data
+// bitmap, the inode table and the data blocks, each region starting at the
+// block recorded here. The bitmaps hold a bit per inode and per data block,
+// or a byte on filesystems formatted before version 14. Data block 0 is
+// reserved and always marked used; in the default geometry, it is also the
+// last block of the inode table, which newer layouts keep apart.
+type Geometry struct {
+	// BlockSize is the size of a block in bytes.
+	BlockSize uint32
+	// BlockCount is the number of blocks the filesystem spans, from the
+	// superblock to the last data block. The device may be bigger.
+	BlockCount uint32
+	// InodeCount is the number of slots in the inode table.
+	InodeCount uint32
+
+	// InodeBitmapStart, DataBitmapStart, InodeTableStart and DataStart are
+	// the first blocks of the regions of the filesystem.
+	InodeBitmapStart uint32
+	DataBitmapStart  uint32
+	InodeTableStart  uint32
+	DataStart        uint32
+
+	// JournalStart is the first block of the journal, and JournalBlocks its
+	// size in blocks; both are zero for filesystems without one. See
+	// MkfsOptions.
+	JournalStart  uint32
+	JournalBlocks uint32
+
+	// ChecksumStart is the first block of the checksum table, and
+	// ChecksumBlocks its size in blocks; both are zero for filesystems
+	// without one. See checksum.go.
+	ChecksumStart  uint32
+	ChecksumBlocks uint32
+
+	// DedupStart is the first block of the dedup table, and DedupBlocks
+	// its size in blocks; both are zero for filesystems without one. See
+	// dedup.go.
+	DedupStart  uint32
+	DedupBlocks uint32
+
+	// PackedBitmaps is set if the bitmaps hold a bit per entry, as they do
+	// on filesystems formatted by version 14 on, rather than a byte.
+	PackedBitmaps bool
+}
+
+// defaultGeometry is the geometry NewFileSystem formats devices with, laid
+// out as the layout constants say. Filesystems formatted before the geometry
+// was recorded all have it, but with a byte per bitmap entry; a block holds
+// the 32 entries either way. For their sake, the last block of its inode
+// table stays data block 0.
+var defaultGeometry = Geometry{
+	BlockSize:  BlockSize,
+	BlockCount: DataStartIndex + 32,
+	InodeCount: 32,
+
+	InodeBitmapStart: InodeBitmapIndex,
+	DataBitmapStart:  DataBitmapIndex,
+	InodeTableStart:  InodeStartIndex,
+	DataStart:        DataStartIndex,
+
+	PackedBitmaps: true,
+}
+
+// DefaultInodeRatio is the number of bytes of filesystem per inode used when
+// formatting with a block count but no inode ratio, see MkfsOptions.
+const DefaultInodeRatio = 4 * BlockSize
+
+// newGeometry lays out a filesystem of blockCount blocks with inodeCount
+// inodes, a journal of journalBlocks blocks and, if checksums and dedup are
+// set, a checksum table and a dedup table, with the regions packed one after
+// the other, and the data blocks after the inode table.
+func newGeometry(blockCount, inodeCount, journalBlocks uint32, checksums, dedup bool) (Geometry, error) {
+	g := Geometry{
+		BlockSize:        BlockSize,
+		BlockCount:       blockCount,
+		InodeCount:       inodeCount,
+		InodeBitmapStart: SuperblockIndex + 1,
+	}
+	if journalBlocks > 0 {
+		g.JournalStart = SuperblockIndex + 1
+		g.JournalBlocks = journalBlocks
+		g.InodeBitmapStart = g.JournalStart + journalBlocks
+	}
+	if checksums {
+		g.ChecksumStart = g.InodeBitmapStart
+		g.ChecksumBlocks = checksumBlocksFor(blockCount)
+		g.InodeBitmapStart = g.ChecksumStart + g.ChecksumBlocks
+	}
+	if dedup {
+		g.DedupStart = g.InodeBitmapStart
+		g.DedupBlocks = dedupBlocksFor(blockCount)
+		g.InodeBitmapStart = g.DedupStart + g.DedupBlocks
+	}
+	g.PackedBitmaps = true
+	g.DataBitmapStart = g.InodeBitmapStart + g.bitmapBlocks(inodeCount)
+	// there are fewer data blocks than blocks, so this is enough for the
+	// data bitmap
+	g.InodeTableStart = g.DataBitmapStart + g.bitmapBlocks(blockCount)
+	g.DataStart = g.InodeTableStart + g.inodeTableBlocks()
+	return g, g.check()
+}
+
+// inodeTableBlocks returns the number of blocks the inode table takes.
+func (g Geometry) inodeTableBlocks() uint32 {
+	return blocksFor(uint64(g.InodeCount) * InodeSize)
+}
+
+// bitmapBlocks returns the number of blocks a bitmap of n entries takes.
+func (g Geometry) bitmapBlocks(n uint32) uint32 {
+	return bitmapBlocks(n, g.PackedBitmaps)
+}
+
+// blocksFor returns the number of blocks needed to hold n bytes.
+func blocksFor(n uint64) uint32 {
+	return uint32((n + BlockSize - 1) / BlockSize)
+}
+
+// metadataStart returns the first block of the regions the journal logs:
+// the checksum table or the dedup table, if there is one, or the inode
+// bitmap.
+func (g Geometry) metadataStart() uint32 {
+	switch {
+	case g.ChecksumBlocks > 0:
+		return g.ChecksumStart
+	case g.DedupBlocks > 0:
+		return g.DedupStart
+	}
+	return g.InodeBitmapStart
+}
+
+// DataBlocks returns the number of data blocks, including data block 0.
+func (g Geometry) DataBlocks() uint32 {
+	return g.BlockCount - g.DataStart
+}
+
+// sizedDevice is implemented by block devices that know their size.
+type sizedDevice interface {
+	// BlockCount returns the number of blocks on the device, or 0 if it
+	// isn't known after all.
+	BlockCount() uint64
+}
+
+// Geometry returns the geometry recorded in the superblock.
+func (fs *FileSystem) Geometry() Geometry {
+	return fs.geometry
+}
+
+// check verifies that the regions of the geometry are in order and big
+// enough for what they hold, so the geometry can be mounted.
+func (g Geometry) check() error {
+	var problem string
+	switch {
+	case g.BlockSize != BlockSize:
+		problem = fmt.Sprintf("only %d-byte blocks are supported", BlockSize)
+	case g.InodeCount == 0:
+		problem = "there is no inode for the root directory"
+	case g.InodeBitmapStart <= SuperblockIndex:
+		problem = "the inode bitmap overlaps the superblock"
+	case g.JournalBlocks > 0 && g.JournalStart <= SuperblockIndex:
+		problem = "the journal overlaps the superblock"
+	case g.JournalBlocks > 0 && g.JournalBlocks < MinJournalBlocks:
+		problem = fmt.Sprintf("the journal has %d blocks, fewer than %d", g.JournalBlocks, MinJournalBlocks)
+	case g.JournalBlocks > 0 && uint64(g.metadataStart()) < uint64(g.JournalStart)+uint64(g.JournalBlocks):
+		problem = "the journal doesn't fit before the inode bitmap"
+		if g.ChecksumBlocks > 0 {
+			problem = "the journal doesn't fit before the checksum table"
+		} else if g.DedupBlocks > 0 {
+			problem = "the journal doesn't fit before the dedup table"
+		}
+	case g.ChecksumBlocks > 0 && g.ChecksumStart <= SuperblockIndex:
+		problem = "the checksum table overlaps the superblock"
+	case g.ChecksumBlocks > 0 && g.ChecksumBlocks < checksumBlocksFor(g.BlockCount):
+		problem = fmt.Sprintf("the checksum table has %d blocks, too few for %d blocks", g.ChecksumBlocks, g.BlockCount)
+	case g.ChecksumBlocks > 0 && uint64(g.InodeBitmapStart) < uint64(g.ChecksumStart)+uint64(g.ChecksumBlocks):
+		problem = "the checksum table doesn't fit before the inode bitmap"
+	case g.ChecksumBlocks > 0 && g.DedupBlocks > 0 && uint64(g.DedupStart) < uint64(g.ChecksumStart)+uint64(g.ChecksumBlocks):
+		problem = "the checksum table doesn't fit before the dedup table"
+	case g.DedupBlocks > 0 && g.DedupStart <= SuperblockIndex:
+		problem = "the dedup table overlaps the superblock"
+	case g.DedupBlocks > 0 && g.DataStart < g.BlockCount && uint64(g.DedupBlocks)*dedupEntriesPerBlock < uint64(g.DataBlocks()):
+		problem = fmt.Sprintf("the dedup table has %d blocks, too few for %d data blocks", g.DedupBlocks, g.DataBlocks())
+	case g.DedupBlocks > 0 && uint64(g.InodeBitmapStart) < uint64(g.DedupStart)+uint64(g.DedupBlocks):
+		problem = "the dedup table doesn't fit before the inode bitmap"
+	case uint64(g.DataBitmapStart) < uint64(g.InodeBitmapStart)+uint64(g.bitmapBlocks(g.InodeCount)):
+		problem = "the inode bitmap doesn't fit before the data bitmap"
+	case g.DataStart >= g.BlockCount || g.DataBlocks() < 2:
+		problem = "there is no room for data blocks"
+	case uint64(g.InodeTableStart) < uint64(g.DataBitmapStart)+uint64(g.bitmapBlocks(g.DataBlocks())):
+		problem = "the data bitmap doesn't fit before the inode table"
+	// the last block of the table may be data block 0, as in defaultGeometry
+	case uint64(g.DataStart)+1 < uint64(g.InodeTableStart)+uint64(g.inodeTableBlocks()):
+		problem = "the inode table doesn't fit before the data blocks"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %d-byte blocks, %d blocks and %d inodes: %s",
+		ErrGeometry, g.BlockSize, g.BlockCount, g.InodeCount, problem)
+}
+
+// checkGeometry verifies that the filesystem's geometry can be mounted and
+// that the device is big enough to hold it. Devices that don't report their
+// size are probed by reading the filesystem's last block, so for them a read
+// error is returned rather than ErrGeometry.
+func (fs *FileSystem) checkGeometry() error {
+	g := fs.geometry
+	err := g.check()
+	if err != nil {
+		return err
+	}
+
+	if n := deviceSize(fs.dev); n > 0 {
+		if n < uint64(g.BlockCount) {
+			return fmt.Errorf("%w: the filesystem spans %d blocks, but the device only has %d", ErrGeometry, g.BlockCount, n)
+		}
+		return nil
+	}
+	buf := make([]byte, g.BlockSize)
+	err = fs.dev.ReadBlock(uint64(g.BlockCount-1), buf)
+	if err != nil {
+		return fmt.Errorf("error reading block %d, the last of the filesystem (is the device too small?): %w", g.BlockCount-1, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeometryIsRecorded(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	require.Equal(t, Geometry{
+		BlockSize: 4096, BlockCount: 38, InodeCount: 32,
+		InodeBitmapStart: 1, DataBitmapStart: 2, InodeTableStart: 3, DataStart: 6,
+		PackedBitmaps: true,
+	}, filesystem.Geometry())
+	require.NoError(t, filesystem.Close())
+
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, filesystem.Geometry(), sb.Geometry)
+
+	// images written before the geometry was recorded have zeros there
+	copy(disk[12:24], make([]byte, 12))
+	copy(disk[40:56], make([]byte, 16))
+	copy(disk[340:344], make([]byte, 4))
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	// and bitmaps of a byte per entry, which the bitmaps of a filesystem
+	// holding only the root directory read the same as
+	want := filesystem.Geometry()
+	want.PackedBitmaps = false
+	require.Equal(t, want, reloaded.Geometry())
+}
+
+func TestLoadFilesystemChecksGeometry(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// the device is missing the last block
+	truncated := disk[:len(disk)-BlockSize]
+	_, err = LoadFilesystem(NewArrayBlockDevice(truncated))
+	require.ErrorIs(t, err, ErrGeometry)
+	require.ErrorContains(t, err, "the device only has 37")
+	// devices that don't know their size are probed
+	_, err = LoadFilesystem(&failingDevice{BlockDevice: NewArrayBlockDevice(truncated)})
+	require.ErrorContains(t, err, "is the device too small?")
+
+	findings := Diagnose(NewArrayBlockDevice(truncated))
+	require.Len(t, findings, 1)
+	require.Equal(t, "geometry", findings[0].Check)
+
+	// a geometry this package can't handle
+	binary.LittleEndian.PutUint32(disk[20:24], 64)
+	_, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.ErrorIs(t, err, ErrGeometry)
+	require.ErrorContains(t, err, "38 blocks and 64 inodes")
+}
+
+func TestMkfsGeometry(t *testing.T) {
+	g, err := MkfsOptions{}.geometry()
+	require.NoError(t, err)
+	require.Equal(t, defaultGeometry, g)
+	// newGeometry lays out the default size as the default geometry, but
+	// with the data blocks after the inode table rather than on its last
+	// block
+	g, err = newGeometry(defaultGeometry.BlockCount, defaultGeometry.InodeCount, 0, false, false)
+	require.NoError(t, err)
+	want := defaultGeometry
+	want.DataStart++
+	require.Equal(t, want, g)
+
+	// 200 blocks with an inode per 2 blocks: 100 inodes, rounded up to fill
+	// 13 inode table blocks
+	disk := make([]byte, 200*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 200, InodeRatio: 2 * BlockSize})
+	require.NoError(t, err)
+	require.Equal(t, Geometry{
+		BlockSize: 4096, BlockCount: 200, InodeCount: 104,
+		InodeBitmapStart: 1, DataBitmapStart: 2, InodeTableStart: 3, DataStart: 16,
+		PackedBitmaps: true,
+	}, filesystem.Geometry())
+	require.Equal(t, uint32(184), filesystem.Geometry().DataBlocks())
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Equal(t, BlockKindInodeTable, layout[15].Kind)
+	require.Equal(t, BlockKindReserved, layout[16].Kind)
+
+	// more files than the default geometry has inodes
+	for i := 0; i < 40; i++ {
+		_, err = filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/f39")
+	require.NoError(t, err)
+	require.Equal(t, uint32(40), inode.Index)
+	require.Greater(t, inode.Blocks[0], uint32(defaultGeometry.BlockCount))
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "hello", contents.String())
+	require.Empty(t, findingsBySeverity(Diagnose(dev), SeverityError))
+}
+
+// newSparseDevice returns a device on a sparse image file of the given
+// number of blocks, for filesystems too big to keep in memory.
+func newSparseDevice(t *testing.T, blocks int) *FileBlockDevice {
+	path := filepath.Join(t.TempDir(), "fs.img")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(int64(blocks)*BlockSize))
+	require.NoError(t, f.Close())
+	dev, err := OpenFileBlockDevice(path, FileDeviceOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func TestMkfsGeometryMultiBlockBitmaps(t *testing.T) {
+	// 40000 inodes and 34996 data blocks: at a bit per entry, both bitmaps
+	// take two blocks
+	dev := newSparseDevice(t, 40000)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 40000, InodeRatio: BlockSize})
+	require.NoError(t, err)
+	require.Equal(t, Geometry{
+		BlockSize: 4096, BlockCount: 40000, InodeCount: 40000,
+		InodeBitmapStart: 1, DataBitmapStart: 3, InodeTableStart: 5, DataStart: 5005,
+		PackedBitmaps: true,
+	}, filesystem.Geometry())
+
+	// entries in the second block of each bitmap survive remounting
+	filesystem.setInodeAllocated(36000, true)
+	filesystem.inodes.put(36000, &Inode{Index: 36000, Filename: "far"})
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.PersistInodeBitmap())
+	filesystem.setBlockAllocated(filesystem.Geometry().DataStart+34000, true)
+	require.NoError(t, filesystem.PersistDataBitmap())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	inode, err := reloaded.GetInode(36000)
+	require.NoError(t, err)
+	require.Equal(t, "far", inode.Filename)
+	require.True(t, reloaded.dataBitmap.test(34000))
+	require.Equal(t, 40000-2, reloaded.freeInodes.free)
+}
+
+func TestMkfsGeometryTooSmall(t *testing.T) {
+	_, err := NewFileSystemWithOptions(NewArrayBlockDevice(make([]byte, 8*BlockSize)), MkfsOptions{Blocks: 4})
+	require.ErrorIs(t, err, ErrGeometry)
+	require.ErrorContains(t, err, "no room for data blocks")
+
+	// the device is smaller than the filesystem
+	disk := make([]byte, 64*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 100})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	_, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.ErrorIs(t, err, ErrGeometry)
+	require.ErrorContains(t, err, "the device only has 64")
+}
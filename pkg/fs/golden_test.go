@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The golden images in testdata/golden are canonical images written by
+// every released format version. Generate the image for a new version with:
+//
+//go:generate go run ../../cmd/fs golden -o testdata/golden
+
+// goldenManifest mirrors the manifest written by 'fs golden'.
+type goldenManifest struct {
+	Version uint32 `json:"version"`
+	Files   []struct {
+		Path   string            `json:"path"`
+		Size   int               `json:"size"`
+		SHA256 string            `json:"sha256"`
+		Xattrs map[string]string `json:"xattrs"`
+		Uid    uint32            `json:"uid"`
+		Gid    uint32            `json:"gid"`
+	} `json:"files"`
+}
+
+func TestGoldenImages(t *testing.T) {
+	manifests, err := filepath.Glob("testdata/golden/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, manifests)
+
+	for _, manifestPath := range manifests {
+		base := strings.TrimSuffix(manifestPath, ".json")
+		t.Run(filepath.Base(base), func(t *testing.T) {
+			raw, err := os.ReadFile(manifestPath)
+			require.NoError(t, err)
+			var manifest goldenManifest
+			require.NoError(t, json.Unmarshal(raw, &manifest))
+
+			f, err := os.Open(base + ".img.gz")
+			require.NoError(t, err)
+			defer f.Close()
+			zr, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			disk, err := io.ReadAll(zr)
+			require.NoError(t, err)
+			dev := NewArrayBlockDevice(disk)
+
+			sb, err := ReadSuperblock(dev)
+			require.NoError(t, err)
+			require.Equal(t, manifest.Version, sb.Version)
+
+			filesystem, err := LoadFilesystem(dev)
+			require.NoError(t, err)
+
+			entries, err := filesystem.ReadDir(0)
+			require.NoError(t, err)
+			require.Len(t, entries, len(manifest.Files))
+
+			for i, expected := range manifest.Files {
+				require.Equal(t, expected.Path, "/"+entries[i].Name)
+
+				inode, err := filesystem.FindInodeByName(expected.Path)
+				require.NoError(t, err)
+				contents, err := filesystem.ReadFileContents(int(inode.Index))
+				require.NoError(t, err)
+				require.Equal(t, expected.Size, contents.Len())
+				sum := sha256.Sum256(contents.Bytes())
+				require.Equal(t, expected.SHA256, hex.EncodeToString(sum[:]))
+				for name, value := range expected.Xattrs {
+					stored, err := filesystem.GetXattr(expected.Path, name)
+					require.NoError(t, err)
+					require.Equal(t, value, string(stored))
+				}
+				uid, gid := inode.Owner()
+				require.Equal(t, expected.Uid, uid)
+				require.Equal(t, expected.Gid, gid)
+			}
+
+			findings := Diagnose(NewArrayBlockDevice(bytes.Clone(disk)))
+			for _, f := range findings {
+				require.NotEqual(t, SeverityError, f.Severity, f.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// Handle names an inode the way file handles of FUSE or NFS do: by index
+// and generation, see reuse.go, rather than by path. A handle outlives
+// renames of the inode, and once the inode is deleted, it stays stale even
+// if the index is reused: the operations taking a Handle fail with ErrStale
+// then, rather than using the new inode in its place. Handles can be kept
+// across mounts.
+type Handle struct {
+	Index      uint32
+	Generation uint32
+}
+
+// String formats the handle as "inode <index> generation <generation>".
+func (h Handle) String() string {
+	return fmt.Sprintf("inode %d generation %d", h.Index, h.Generation)
+}
+
+// Handle returns the handle of the file or directory with the given
+// absolute name.
+func (fs *FileSystem) Handle(filename string) (Handle, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(filename)
+	if err != nil {
+		return Handle{}, fmt.Errorf("error looking up %s: %w", filename, err)
+	}
+	return Handle{Index: inode.Index, Generation: inode.Generation}, nil
+}
+
+// handleInode returns the inode h names, failing with ErrStale if it was
+// deleted.
+func (fs *FileSystem) handleInode(h Handle) (*Inode, error) {
+	if h.Index >= fs.geometry.InodeCount {
+		return nil, fmt.Errorf("error accessing %s: %w", h, ErrStale)
+	}
+	inode, err := fs.inode(int(h.Index))
+	if err != nil {
+		return nil, fmt.Errorf("error accessing %s: %w", h, err)
+	}
+	if inode == nil || inode.Generation != h.Generation {
+		return nil, fmt.Errorf("error accessing %s: %w", h, ErrStale)
+	}
+	return inode, nil
+}
+
+// StatHandle describes the file or directory h names, as Stat does, under
+// the name the inode records: the last it was created or renamed as.
+func (fs *FileSystem) StatHandle(h Handle) (FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.handleInode(h)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fs.fileInfo(inode.Filename, inode), nil
+}
+
+// OpenHandle opens the file h names, with the flag semantics of OpenFile but
+// for O_CREATE and O_EXCL, which it ignores. The File is named as the inode
+// records, see StatHandle. Like any File, it fails with ErrStale once the
+// file is deleted.
+func (fs *FileSystem) OpenHandle(h Handle, flag int) (_ *File, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("OpenHandle %s", h)
+	defer fs.checkInvariantsAfter("OpenHandle")()
+
+	inode, err := fs.handleInode(h)
+	if err != nil {
+		return nil, err
+	}
+	return fs.openInode(inode.Filename, inode, flag&^(O_CREATE|O_EXCL))
+}
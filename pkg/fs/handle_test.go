@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandle(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/old", bytes.NewBufferString("old contents"))
+	require.NoError(t, err)
+	h, err := filesystem.Handle("/old")
+	require.NoError(t, err)
+	root, err := filesystem.Handle("/")
+	require.NoError(t, err)
+	require.Equal(t, Handle{}, root)
+
+	// handles follow renames, and survive remounting
+	require.NoError(t, filesystem.Rename("/old", "/renamed"))
+	require.NoError(t, filesystem.Close())
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	info, err := filesystem.StatHandle(h)
+	require.NoError(t, err)
+	require.Equal(t, "renamed", info.Name())
+	require.Equal(t, int64(12), info.Size())
+	f, err := filesystem.OpenHandle(h, O_RDWR)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("new"))
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile("/renamed")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new contents"), data)
+	info, err = filesystem.StatHandle(root)
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	_, err = filesystem.OpenHandle(root, O_RDONLY)
+	require.ErrorIs(t, err, ErrIsDirectory)
+
+	// a new file in the same slot isn't taken for the deleted one
+	require.NoError(t, filesystem.DeleteFile("/renamed"))
+	_, err = filesystem.CreateFile("/new", bytes.NewBufferString("someone else's"))
+	require.NoError(t, err)
+	newHandle, err := filesystem.Handle("/new")
+	require.NoError(t, err)
+	require.Equal(t, h.Index, newHandle.Index)
+	require.NotEqual(t, h.Generation, newHandle.Generation)
+	_, err = filesystem.StatHandle(h)
+	require.ErrorIs(t, err, ErrStale)
+	_, err = filesystem.OpenHandle(h, O_RDONLY)
+	require.ErrorIs(t, err, ErrStale)
+	_, err = io.ReadAll(f)
+	require.ErrorIs(t, err, ErrStale)
+	require.NoError(t, f.Close())
+	_, err = filesystem.StatHandle(Handle{Index: 1 << 20})
+	require.ErrorIs(t, err, ErrStale)
+}
@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// PutFromHost copies the file hostPath of the host into the filesystem as
+// fsPath, an absolute name, keeping its permission bits. The contents are
+// streamed, so the file needn't fit in memory. Like CreateFile, it fails
+// with ErrExist if fsPath is taken, and rolls back every change it made if
+// it fails.
+func (fs *FileSystem) PutFromHost(hostPath, fsPath string) (err error) {
+	src, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("error copying %s: not a regular file", hostPath)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("PutFromHost %s -> %s", hostPath, fsPath)
+	defer fs.checkInvariantsAfter("PutFromHost")()
+	var r io.Reader = src
+	if info.Size() <= MaxFileSize {
+		r = sizeHinted{Reader: src, n: int(info.Size())}
+	}
+	_, err = fs.createFile(fsPath, r, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", hostPath, err)
+	}
+	return nil
+}
+
+// GetToHost copies the file fsPath, an absolute name, out of the filesystem
+// to hostPath on the host, replacing it if it exists, with the permission
+// bits of the file. The contents are streamed, so the file needn't fit in
+// memory. If it fails, the partial copy is removed.
+func (fs *FileSystem) GetToHost(fsPath, hostPath string) (err error) {
+	src, err := fs.Open(fsPath, O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	perm := info.Mode().Perm()
+	if perm == 0 {
+		// inodes from before permission bits were kept
+		perm = DefaultFileMode
+	}
+
+	dst, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(hostPath)
+		}
+	}()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", fsPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutFromHostGetToHost(t *testing.T) {
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("host"), 3*BlockSize)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in"), contents, 0600))
+
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.PutFromHost(filepath.Join(dir, "in"), "/file"))
+	info, err := filesystem.Stat("/file")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode())
+	require.Equal(t, int64(len(contents)), info.Size())
+
+	require.NoError(t, filesystem.GetToHost("/file", filepath.Join(dir, "out")))
+	read, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	require.Equal(t, contents, read)
+	hostInfo, err := os.Stat(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), hostInfo.Mode().Perm())
+
+	// existing host files are replaced
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "out"), bytes.Repeat([]byte("x"), 5*BlockSize), 0644))
+	require.NoError(t, filesystem.GetToHost("/file", filepath.Join(dir, "out")))
+	read, err = os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	require.Equal(t, contents, read)
+}
+
+func TestPutFromHostGetToHostErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in"), []byte("in"), 0644))
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/taken", bytes.NewBufferString("taken"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	require.ErrorIs(t, filesystem.PutFromHost(filepath.Join(dir, "in"), "/taken"), ErrExist)
+	require.ErrorIs(t, filesystem.PutFromHost(filepath.Join(dir, "missing"), "/file"), os.ErrNotExist)
+	require.ErrorContains(t, filesystem.PutFromHost(dir, "/file"), "not a regular file")
+
+	require.ErrorIs(t, filesystem.GetToHost("/missing", filepath.Join(dir, "out")), ErrNotExist)
+	require.ErrorIs(t, filesystem.GetToHost("/dir", filepath.Join(dir, "out")), ErrIsDirectory)
+	_, err = os.Stat(filepath.Join(dir, "out"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
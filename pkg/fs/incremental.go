@@ -0,0 +1,418 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"path"
+	"strings"
+)
+
+// Incremental backups carry the changes from one state of a filesystem to
+// the next. Diff finds them by name: the files and directories added and
+// deleted, and those whose contents, permission bits or modification time
+// differ. ExportIncremental writes them as a change stream, which
+// ApplyIncremental applies to a copy of the older state, such as the image
+// the last backup went to, to bring it to the newer one.
+//
+// The stream is a tar archive, as written by ExportTar, opening with a
+// global header holding the record VSFS.incremental, and holding only the
+// changed files and directories, whole. Deleted names are entries with the
+// record VSFS.change set to "deleted", of the type the name had; they come
+// first, deepest first, so deleted directories are empty by their turn.
+// Like ExportTar, the stream doesn't
+// carry owners or extended attributes.
+
+// The PAX records marking change streams and their deletions.
+const (
+	paxIncremental = "VSFS.incremental"
+	paxChange      = "VSFS.change"
+)
+
+// ErrNotIncremental is returned by ApplyIncremental for streams that aren't
+// change streams, such as plain tar archives.
+var ErrNotIncremental = errors.New("not an incremental change stream")
+
+// ChangeKind says how a name differs between two filesystems, see Diff.
+type ChangeKind int
+
+const (
+	// ChangeAdded is a name only the newer filesystem has.
+	ChangeAdded ChangeKind = iota
+	// ChangeModified is a name of the same type in both, whose contents,
+	// permission bits or modification time differ.
+	ChangeModified
+	// ChangeDeleted is a name only the older filesystem has.
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is a difference between two filesystems, see Diff.
+type Change struct {
+	Kind ChangeKind
+	// Name is the absolute name that differs.
+	Name string
+	// Type is what Name names in the newer filesystem, or in the older one
+	// for deletions.
+	Type InodeType
+}
+
+// treeEntry is a name of a filesystem, as Diff finds it: the order Walk
+// visits it in, and what it names.
+type treeEntry struct {
+	order int
+	info  FileInfo
+}
+
+// Diff returns the changes that turn older into newer: first the deleted
+// names, deepest first, then the added and modified ones, as Walk visits
+// them, so directories come before their entries. A name whose type
+// changed is deleted and added again. Files with the same size, permission
+// bits and modification time are compared byte for byte.
+//
+// Names are compared rather than inodes, so renaming a file deletes its old
+// name and adds the new one, and links made between unchanged files aren't
+// changes. Both filesystems are walked as by Walk, see there.
+func Diff(older, newer *FileSystem) ([]Change, error) {
+	changes, _, err := diff(older, newer)
+	return changes, err
+}
+
+// diff is Diff, also returning the names of newer.
+func diff(older, newer *FileSystem) ([]Change, map[string]treeEntry, error) {
+	olderNames, olderTree, err := older.tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error walking the older filesystem: %w", err)
+	}
+	newerNames, newerTree, err := newer.tree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error walking the newer filesystem: %w", err)
+	}
+
+	changes := []Change{}
+	for i := len(olderNames) - 1; i >= 0; i-- {
+		name := olderNames[i]
+		was := olderTree[name]
+		is, ok := newerTree[name]
+		if !ok || is.info.inode.Type != was.info.inode.Type {
+			changes = append(changes, Change{Kind: ChangeDeleted, Name: name, Type: was.info.inode.Type})
+		}
+	}
+	for _, name := range newerNames {
+		is := newerTree[name]
+		was, ok := olderTree[name]
+		if !ok || is.info.inode.Type != was.info.inode.Type {
+			changes = append(changes, Change{Kind: ChangeAdded, Name: name, Type: is.info.inode.Type})
+			continue
+		}
+		same, err := sameEntry(older, newer, name, was.info, is.info)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !same {
+			changes = append(changes, Change{Kind: ChangeModified, Name: name, Type: is.info.inode.Type})
+		}
+	}
+	return changes, newerTree, nil
+}
+
+// tree returns the names of the filesystem in the order Walk visits them,
+// and what they name.
+func (fs *FileSystem) tree() ([]string, map[string]treeEntry, error) {
+	names := []string{}
+	tree := map[string]treeEntry{}
+	err := fs.Walk("/", func(name string, _ DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		tree[name] = treeEntry{order: len(names), info: info}
+		names = append(names, name)
+		return nil
+	})
+	return names, tree, err
+}
+
+// sameEntry says whether the file or directory name is the same in older,
+// where it is was, and newer, where it is is.
+func sameEntry(older, newer *FileSystem, name string, was, is FileInfo) (bool, error) {
+	if was.Mode().Perm() != is.Mode().Perm() || !was.ModTime().Equal(is.ModTime()) {
+		return false, nil
+	}
+	if is.IsDir() {
+		return true, nil
+	}
+	if was.Size() != is.Size() {
+		return false, nil
+	}
+	same, err := sameContents(older, newer, name)
+	if err != nil {
+		return false, fmt.Errorf("error comparing %s: %w", name, err)
+	}
+	return same, nil
+}
+
+// sameContents says whether the file name holds the same bytes in older
+// and newer, reading both a chunk at a time.
+func sameContents(older, newer *FileSystem, name string) (bool, error) {
+	a, err := older.Open(name, O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := newer.Open(name, O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+	bufA := make([]byte, 16*BlockSize)
+	bufB := make([]byte, 16*BlockSize)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, errB
+		}
+	}
+}
+
+// ExportIncremental writes the changes from the filesystem of the image
+// file since to this one to w, as a change stream that ApplyIncremental
+// reads back, see Diff. since is only read, and may have been left dirty.
+//
+// The changed names of a file with several links are written as hard
+// links to one of its unchanged names, or, if they all changed, to the one
+// the stream carries first.
+func (fs *FileSystem) ExportIncremental(w io.Writer, since string) (err error) {
+	dev, err := OpenFileBlockDevice(since, FileDeviceOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dev.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	// the reads would record access times, which Close would write, so
+	// the older filesystem is never closed
+	older, err := LoadFilesystemWithOptions(dev, MountOptions{Recovery: RecoveryForce})
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", since, err)
+	}
+	return fs.exportIncremental(w, older)
+}
+
+// exportIncremental is ExportIncremental from the filesystem older.
+func (fs *FileSystem) exportIncremental(w io.Writer, older *FileSystem) error {
+	changes, tree, err := diff(older, fs)
+	if err != nil {
+		return err
+	}
+	// the name the other names of each file with several links are linked
+	// to: the first unchanged one, which the target has already, or else
+	// the first one, which the stream carries before the others
+	changed := map[string]bool{}
+	for _, change := range changes {
+		changed[change.Name] = true
+	}
+	first := map[uint32]string{}
+	for name, entry := range tree {
+		if !entry.info.IsDir() && entry.info.Links() > 1 {
+			index := entry.info.inode.Index
+			other, ok := first[index]
+			if !ok || changed[other] && !changed[name] || changed[other] == changed[name] && entry.order < tree[other].order {
+				first[index] = name
+			}
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{paxIncremental: "1"},
+	})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Kind == ChangeDeleted {
+			typeflag := byte(tar.TypeReg)
+			if change.Type == InodeTypeDirectory {
+				typeflag = tar.TypeDir
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag:   typeflag,
+				Name:       strings.TrimPrefix(change.Name, "/"),
+				PAXRecords: map[string]string{paxChange: "deleted"},
+			})
+			if err != nil {
+				return fmt.Errorf("error exporting %s: %w", change.Name, err)
+			}
+			continue
+		}
+		entry := tree[change.Name]
+		link := ""
+		if other, ok := first[entry.info.inode.Index]; ok && other != change.Name {
+			link = other
+		}
+		hdr := tarHeader(change.Name, entry.info, link)
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %w", change.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = fs.exportContents(tw, change.Name)
+			if err != nil {
+				return fmt.Errorf("error exporting %s: %w", change.Name, err)
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// ApplyIncremental applies the change stream read from r, as written by
+// ExportIncremental, to the filesystem, which should be in the older state
+// the stream was exported from. Deleted names are deleted, changed files
+// replaced and directories given their permission bits and times. Deleted
+// directories are removed once their deleted entries are, failing with
+// ErrNotEmpty if the filesystem has entries in them the older state didn't.
+// Each entry is applied in its own operation, so if applying fails, the
+// entries before the failing one stay. Streams that aren't change streams
+// fail with ErrNotIncremental.
+func (fs *FileSystem) ApplyIncremental(r io.Reader) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == nil && (hdr.Typeflag != tar.TypeXGlobalHeader || hdr.PAXRecords[paxIncremental] == "") {
+		err = ErrNotIncremental
+	}
+	if err == io.EOF {
+		err = ErrNotIncremental
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the stream: %w", err)
+	}
+	// directories get their times once their contents are in, as with
+	// ImportTar. The directories the entries are in get back the times
+	// they had, unless the stream carries them too.
+	dirs := []*tar.Header{}
+	parents := map[string]*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the stream: %w", err)
+		}
+		name := tarPath(hdr.Name)
+		if parent := path.Dir(name); parents[parent] == nil {
+			info, err := fs.Stat(parent)
+			if err == nil {
+				parents[parent] = &tar.Header{ModTime: info.ModTime(), AccessTime: info.AccessTime()}
+			}
+		}
+		err = fs.applyEntry(name, hdr, tr)
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir && hdr.PAXRecords[paxChange] != "deleted" {
+			dirs = append(dirs, hdr)
+		}
+	}
+	for name, hdr := range parents {
+		err := fs.importTimes(name, hdr)
+		// the stream may have deleted it since
+		if err != nil && !errors.Is(err, ErrNotExist) {
+			return fmt.Errorf("error applying %s: %w", name, err)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := fs.importTimes(tarPath(dirs[i].Name), dirs[i])
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", dirs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// applyEntry applies an entry of a change stream to name, with r holding
+// the contents of files.
+func (fs *FileSystem) applyEntry(name string, hdr *tar.Header, r io.Reader) error {
+	info, err := fs.Stat(name)
+	if hdr.PAXRecords[paxChange] == "deleted" {
+		if err != nil {
+			return err
+		}
+		// what the name is here decides, as it is for streams that
+		// marked every deletion as a file
+		if info.IsDir() {
+			return fs.Rmdir(name)
+		}
+		return fs.DeleteFile(name)
+	}
+	if errors.Is(err, ErrNotExist) {
+		return fs.importEntry(name, hdr, r)
+	}
+	if err != nil {
+		return err
+	}
+	perm := iofs.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if !info.IsDir() {
+			return fmt.Errorf("%w, and %w", ErrExist, ErrNotDirectory)
+		}
+		return fs.Chmod(name, perm)
+	case tar.TypeReg:
+		if info.IsDir() {
+			return ErrIsDirectory
+		}
+		var contents io.Reader = r
+		if hdr.Size <= MaxFileSize {
+			contents = sizeHinted{Reader: r, n: int(hdr.Size)}
+		}
+		err = fs.WriteFileAtomic(name, contents)
+		if err == nil {
+			err = fs.Chmod(name, perm)
+		}
+		if err == nil {
+			err = fs.importTimes(name, hdr)
+		}
+		return err
+	case tar.TypeLink:
+		// the name is linked anew, to the file it now shares
+		err = fs.DeleteFile(name)
+		if err != nil {
+			return err
+		}
+		return fs.importEntry(name, hdr, r)
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+}
@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBackupPair returns a filesystem and a copy of it, the backup, both
+// with their clocks stopped, so that only contents tell most changes apart.
+func newBackupPair(t *testing.T) (*FileSystem, *FileSystem, []byte) {
+	disk := make([]byte, 600*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 600})
+	require.NoError(t, err)
+	filesystem.now = func() time.Time { return time.Unix(1e9, 0) }
+	filesystem.SetDirOrder(DirOrderName)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	for name, contents := range map[string]string{"/dir/same": "same", "/dir/edited": "hello", "/gone": "bye", "/shared": "shared"} {
+		_, err = filesystem.CreateFile(name, bytes.NewBufferString(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.Close())
+
+	backupDisk := append([]byte{}, disk...)
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	filesystem.now = func() time.Time { return time.Unix(1e9, 0) }
+	filesystem.SetDirOrder(DirOrderName)
+	backup, err := LoadFilesystem(NewArrayBlockDevice(backupDisk))
+	require.NoError(t, err)
+	backup.SetDirOrder(DirOrderName)
+	return filesystem, backup, backupDisk
+}
+
+func TestDiff(t *testing.T) {
+	filesystem, backup, _ := newBackupPair(t)
+	changes, err := Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	// same size and time, other contents
+	require.NoError(t, filesystem.WriteAt("/dir/edited", []byte("j"), 0))
+	require.NoError(t, filesystem.DeleteFile("/gone"))
+	require.NoError(t, filesystem.Mkdir("/new"))
+	_, err = filesystem.CreateFile("/new/file", bytes.NewBufferString("new"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Chmod("/shared", 0600))
+	changes, err = Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Kind: ChangeDeleted, Name: "/gone", Type: InodeTypeFile},
+		{Kind: ChangeModified, Name: "/dir/edited", Type: InodeTypeFile},
+		{Kind: ChangeAdded, Name: "/new", Type: InodeTypeDirectory},
+		{Kind: ChangeAdded, Name: "/new/file", Type: InodeTypeFile},
+		{Kind: ChangeModified, Name: "/shared", Type: InodeTypeFile},
+	}, changes)
+	require.Equal(t, "deleted", ChangeDeleted.String())
+}
+
+func TestIncremental(t *testing.T) {
+	filesystem, backup, backupDisk := newBackupPair(t)
+	since := filepath.Join(t.TempDir(), "since.img")
+	require.NoError(t, os.WriteFile(since, backupDisk, 0600))
+
+	filesystem.now = time.Now
+	require.NoError(t, filesystem.WriteAt("/dir/edited", []byte(" world"), 5))
+	require.NoError(t, filesystem.DeleteFile("/gone"))
+	require.NoError(t, filesystem.Mkdir("/new"))
+	_, err := filesystem.CreateFile("/new/file", bytes.NewBuffer(patterned(3*BlockSize+1)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Chmod("/dir", 0700))
+	// a new name of an unchanged file, and two names of a new one
+	require.NoError(t, filesystem.Link("/shared", "/new/shared"))
+	require.NoError(t, filesystem.Link("/new/file", "/new/other"))
+
+	stream := &bytes.Buffer{}
+	require.NoError(t, filesystem.ExportIncremental(stream, since))
+	require.NoError(t, backup.ApplyIncremental(stream))
+	changes, err := Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	require.NoError(t, backup.CheckInvariants())
+
+	// links are kept
+	info, err := backup.Stat("/new/shared")
+	require.NoError(t, err)
+	require.Equal(t, 2, info.Links())
+	info, err = backup.Stat("/new/other")
+	require.NoError(t, err)
+	require.Equal(t, 2, info.Links())
+	data, err := backup.ReadFile("/dir/edited")
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+}
+
+func TestIncrementalParentTimes(t *testing.T) {
+	filesystem, backup, _ := newBackupPair(t)
+	backup.now = func() time.Time { return time.Unix(2e9, 0) }
+
+	// the directories of the changed files don't change themselves
+	require.NoError(t, filesystem.WriteAt("/dir/edited", []byte("j"), 0))
+	require.NoError(t, filesystem.Chmod("/shared", 0600))
+	stream := &bytes.Buffer{}
+	require.NoError(t, filesystem.exportIncremental(stream, backup))
+	require.NoError(t, backup.ApplyIncremental(stream))
+	changes, err := Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
+
+func TestIncrementalRenamedDirectory(t *testing.T) {
+	filesystem, backup, _ := newBackupPair(t)
+	filesystem.now = time.Now
+	require.NoError(t, filesystem.Mkdir("/dir/sub"))
+	_, err := filesystem.CreateFile("/dir/sub/file", bytes.NewBufferString("deep"))
+	require.NoError(t, err)
+	stream := &bytes.Buffer{}
+	require.NoError(t, filesystem.exportIncremental(stream, backup))
+	require.NoError(t, backup.ApplyIncremental(stream))
+
+	// the directory and everything below it go under the new name
+	require.NoError(t, filesystem.Rename("/dir", "/moved"))
+	changes, err := Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Contains(t, changes, Change{Kind: ChangeDeleted, Name: "/dir", Type: InodeTypeDirectory})
+	stream.Reset()
+	require.NoError(t, filesystem.exportIncremental(stream, backup))
+	require.NoError(t, backup.ApplyIncremental(stream))
+
+	changes, err = Diff(backup, filesystem)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	_, err = backup.Stat("/dir")
+	require.ErrorIs(t, err, ErrNotExist)
+	data, err := backup.ReadFile("/moved/sub/file")
+	require.NoError(t, err)
+	require.Equal(t, "deep", string(data))
+	require.NoError(t, backup.CheckInvariants())
+}
+
+func TestApplyIncrementalErrors(t *testing.T) {
+	filesystem, backup, _ := newBackupPair(t)
+
+	// tar archives aren't change streams
+	archive := &bytes.Buffer{}
+	require.NoError(t, filesystem.ExportTar(archive))
+	require.ErrorIs(t, backup.ApplyIncremental(archive), ErrNotIncremental)
+	require.ErrorIs(t, backup.ApplyIncremental(&bytes.Buffer{}), ErrNotIncremental)
+
+	// a deleted directory the backup has new entries in
+	require.NoError(t, filesystem.Rename("/dir", "/moved"))
+	stream := &bytes.Buffer{}
+	require.NoError(t, filesystem.exportIncremental(stream, backup))
+	_, err := backup.CreateFile("/dir/extra", &bytes.Buffer{})
+	require.NoError(t, err)
+	require.ErrorIs(t, backup.ApplyIncremental(stream), ErrNotEmpty)
+
+	require.ErrorIs(t, filesystem.ExportIncremental(stream, filepath.Join(t.TempDir(), "missing.img")), os.ErrNotExist)
+}
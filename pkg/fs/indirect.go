@@ -0,0 +1,370 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Files bigger than the direct blocks of their inode reach the rest of their
+// data blocks through pointer blocks, each holding pointersPerBlock little
+// endian block indices. The indirect block points at the data blocks that
+// follow the direct ones. The double indirect block points at further
+// pointer blocks, which point at the data blocks after those.
+//
+// Only the entries covering the file's size are meaningful; the rest may
+// hold stale indices left over from when the file was bigger.
+const (
+	directBlocks     = len(Inode{}.Blocks)
+	pointersPerBlock = BlockSize / 4
+
+	// MaxFileSize is the size limit of a file, in bytes. Writes past it fail
+	// with ErrTooLarge.
+	MaxFileSize = math.MaxUint32
+
+	// indirectVersion is the first format version with indirect blocks;
+	// older filesystems are upgraded to it when a file first needs one.
+	indirectVersion = 2
+)
+
+// blockMap lists the data blocks of an inode in file order, along with the
+// pointer or extent blocks leading to them.
+type blockMap struct {
+	data []uint32
+	// indirect and double are the indirect and double indirect blocks, or
+	// zero if the file doesn't reach them
+	indirect uint32
+	double   uint32
+	// children are the pointer blocks the double indirect block points at
+	children []uint32
+	// extents are the extents of inodes mapped with extents, and
+	// extentBlocks the extent blocks holding those past the inline ones;
+	// see extent.go
+	extents      []extent
+	extentBlocks []uint32
+	// xattrs is the xattr block of the inode, or zero; see xattr.go
+	xattrs uint32
+}
+
+// pointers returns the pointer blocks of the map, extent blocks included.
+func (m *blockMap) pointers() []uint32 {
+	pointers := []uint32{}
+	if m.indirect != 0 {
+		pointers = append(pointers, m.indirect)
+	}
+	if m.double != 0 {
+		pointers = append(pointers, m.double)
+	}
+	pointers = append(pointers, m.children...)
+	return append(pointers, m.extentBlocks...)
+}
+
+// owned returns every block of the map, data blocks first and the xattr
+// block last.
+func (m *blockMap) owned() []uint32 {
+	owned := append(append([]uint32{}, m.data...), m.pointers()...)
+	if m.xattrs != 0 {
+		owned = append(owned, m.xattrs)
+	}
+	return owned
+}
+
+// pointerBlocksFor returns whether a file of n data blocks needs an indirect
+// block, and how many pointer blocks its double indirect block points at.
+func pointerBlocksFor(n int) (bool, int) {
+	rest := n - directBlocks
+	if rest <= 0 {
+		return false, 0
+	}
+	rest -= pointersPerBlock
+	if rest <= 0 {
+		return true, 0
+	}
+	return true, (rest + pointersPerBlock - 1) / pointersPerBlock
+}
+
+// validatePointers checks that an inode stored in slot index has the
+// pointer blocks its size needs, and no others.
+func (inode *Inode) validatePointers(index int) error {
+	needIndirect, nChildren := pointerBlocksFor(inode.StoredBlocks())
+	check := func(what string, need bool, blockIndex uint32) error {
+		switch {
+		case need && blockIndex == 0:
+			return corruptf("inode %d: size %d needs %s, but there is none", index, inode.storedSize(), what)
+		case !need && blockIndex != 0:
+			return corruptf("inode %d: size %d needs no %s, but there is one", index, inode.storedSize(), what)
+		}
+		return nil
+	}
+	err := check("indirect block", needIndirect, inode.Indirect)
+	if err != nil {
+		return err
+	}
+	return check("double indirect block", nChildren > 0, inode.DoubleIndirect)
+}
+
+// fileBlocks returns the data blocks of inode in file order. For files that
+// fit in the direct blocks it returns a slice of inode.Blocks without reading
+// anything, so the result mustn't be modified.
+func (fs *FileSystem) fileBlocks(inode *Inode) ([]uint32, error) {
+	if !inode.extentMapped && inode.Indirect == 0 && inode.DoubleIndirect == 0 {
+		n := inode.StoredBlocks()
+		if n <= directBlocks {
+			return inode.Blocks[:n], nil
+		}
+	}
+	m, err := fs.readBlockMap(inode)
+	if err != nil {
+		return nil, err
+	}
+	return m.data, nil
+}
+
+// readBlockMap reads the block map of inode, following its pointer blocks as
+// far as its size needs. The map is the caller's to change. It fails with
+// ErrCorrupt if a pointer the size needs is zero, or a pointer block is
+// outside the data region; see readExtentMap for inodes mapped with
+// extents. Other inconsistencies, such as data blocks outside the data
+// region, are left for validate to find. It doesn't use the inode cache, so
+// Diagnose can call it from several goroutines.
+func (fs *FileSystem) readBlockMap(inode *Inode) (*blockMap, error) {
+	m, err := fs.readContentsMap(inode)
+	if err != nil {
+		return nil, err
+	}
+	m.xattrs = inode.xattrBlock
+	return m, nil
+}
+
+// readContentsMap is readBlockMap without the xattr block.
+func (fs *FileSystem) readContentsMap(inode *Inode) (*blockMap, error) {
+	if inode.extentMapped {
+		return fs.readExtentMap(inode)
+	}
+	n := inode.StoredBlocks()
+	direct := n
+	if direct > directBlocks {
+		direct = directBlocks
+	}
+	m := &blockMap{data: make([]uint32, direct, n)}
+	copy(m.data, inode.Blocks[:direct])
+	if n == direct {
+		return m, nil
+	}
+
+	buf := make([]byte, BlockSize)
+	// readPointers returns the first count pointers of a pointer block
+	readPointers := func(blockIndex uint32, what string, count int) ([]uint32, error) {
+		if blockIndex == 0 {
+			return nil, corruptf("inode %d: size %d needs %s, but there is none", inode.Index, inode.Size, what)
+		}
+		if !fs.isDataBlock(blockIndex) {
+			return nil, corruptf("inode %d: %s %d is outside the data region", inode.Index, what, blockIndex)
+		}
+		err := fs.readMetadata(uint64(blockIndex), buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s %d of inode %d: %w", what, blockIndex, inode.Index, err)
+		}
+		if count > pointersPerBlock {
+			count = pointersPerBlock
+		}
+		pointers := make([]uint32, count)
+		for i := range pointers {
+			pointers[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		return pointers, nil
+	}
+
+	m.indirect = inode.Indirect
+	pointers, err := readPointers(m.indirect, "an indirect block", n-len(m.data))
+	if err != nil {
+		return nil, err
+	}
+	m.data = append(m.data, pointers...)
+	if len(m.data) == n {
+		return m, nil
+	}
+
+	_, nChildren := pointerBlocksFor(n)
+	m.double = inode.DoubleIndirect
+	m.children, err = readPointers(m.double, "a double indirect block", nChildren)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range m.children {
+		pointers, err = readPointers(child, "a pointer block", n-len(m.data))
+		if err != nil {
+			return nil, err
+		}
+		m.data = append(m.data, pointers...)
+	}
+	return m, nil
+}
+
+// blockAt returns the device index of data block i of inode, reading pointer
+// or extent blocks into buf as needed.
+func (fs *FileSystem) blockAt(inode *Inode, i int, buf []byte) (uint32, error) {
+	if inode.extentMapped {
+		blockIndex, _, err := fs.extentAt(inode, i, buf)
+		return blockIndex, err
+	}
+	if i < directBlocks {
+		return inode.Blocks[i], nil
+	}
+	pointer := func(blockIndex uint32, j int) (uint32, error) {
+		if !fs.isDataBlock(blockIndex) {
+			return 0, corruptf("inode %d: pointer block %d is outside the data region", inode.Index, blockIndex)
+		}
+		err := fs.readMetadata(uint64(blockIndex), buf)
+		if err != nil {
+			return 0, fmt.Errorf("error reading pointer block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+		return binary.LittleEndian.Uint32(buf[j*4:]), nil
+	}
+
+	i -= directBlocks
+	if i < pointersPerBlock {
+		return pointer(inode.Indirect, i)
+	}
+	i -= pointersPerBlock
+	child, err := pointer(inode.DoubleIndirect, i/pointersPerBlock)
+	if err != nil {
+		return 0, err
+	}
+	return pointer(child, i%pointersPerBlock)
+}
+
+// runAt is blockAt that also returns how many blocks of the file follow
+// block i on the device, counting itself, as far as the block map tells
+// without reading more: a block for files mapped with pointers.
+func (fs *FileSystem) runAt(inode *Inode, i int, buf []byte) (uint32, int, error) {
+	if inode.extentMapped {
+		return fs.extentAt(inode, i, buf)
+	}
+	blockIndex, err := fs.blockAt(inode, i, buf)
+	return blockIndex, 1, err
+}
+
+// mapBlocks makes data the data blocks of inode, whose block map was old
+// before the caller allocated or freed data blocks. The pointer blocks of old
+// are reused, and the ones data needs beyond them allocated in the in-memory
+// data bitmap; the rest are freed. The caller persists the inode and the
+// bitmap, or rolls them back on failure.
+//
+// Pointer blocks are written only to add pointers past the old end of the
+// file, so until the inode is written, they still describe the file as it
+// was. Filesystems mapping files with extents use mapExtents instead.
+func (fs *FileSystem) mapBlocks(inode *Inode, old *blockMap, data []uint32) error {
+	if inode.extentMapped || fs.version >= extentVersion {
+		return fs.mapExtents(inode, old, data)
+	}
+	needIndirect, nChildren := pointerBlocksFor(len(data))
+	m := &blockMap{data: data, indirect: old.indirect, double: old.double}
+	if nChildren < len(old.children) {
+		m.children = append([]uint32{}, old.children[:nChildren]...)
+	} else {
+		m.children = append([]uint32{}, old.children...)
+	}
+
+	// free the pointer blocks that aren't needed anymore
+	for _, child := range old.children[len(m.children):] {
+		fs.setBlockAllocated(child, false)
+	}
+	if nChildren == 0 && m.double != 0 {
+		fs.setBlockAllocated(m.double, false)
+		m.double = 0
+	}
+	if !needIndirect && m.indirect != 0 {
+		fs.setBlockAllocated(m.indirect, false)
+		m.indirect = 0
+	}
+
+	// allocate the missing ones
+	missing := nChildren - len(m.children)
+	if needIndirect && m.indirect == 0 {
+		missing++
+	}
+	if nChildren > 0 && m.double == 0 {
+		missing++
+	}
+	if missing > 0 {
+		if fs.version < indirectVersion {
+			fs.explainf("superblock: format version %d -> %d, as inode %d needs indirect blocks", fs.version, indirectVersion, inode.Index)
+			fs.version = indirectVersion
+			err := fs.writeState(StateDirty)
+			if err != nil {
+				return fmt.Errorf("error upgrading the format version: %w", err)
+			}
+		}
+		newBlocks, err := fs.findEmptyBlocks(missing)
+		if err != nil {
+			return fmt.Errorf("not enough free blocks for the pointer blocks of %d data blocks: %w", len(data), err)
+		}
+		for _, blockIndex := range newBlocks {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		if needIndirect && m.indirect == 0 {
+			m.indirect, newBlocks = newBlocks[0], newBlocks[1:]
+		}
+		if nChildren > 0 && m.double == 0 {
+			m.double, newBlocks = newBlocks[0], newBlocks[1:]
+		}
+		m.children = append(m.children, newBlocks...)
+	}
+
+	// write the pointer blocks that gained pointers
+	buf := make([]byte, BlockSize)
+	writePointers := func(blockIndex uint32, pointers, oldPointers []uint32, reused bool) error {
+		if reused && len(pointers) <= len(oldPointers) {
+			return nil
+		}
+		for i := range buf {
+			buf[i] = 0
+		}
+		for i, pointer := range pointers {
+			binary.LittleEndian.PutUint32(buf[i*4:], pointer)
+		}
+		err := fs.writeMetadata(uint64(blockIndex), buf)
+		if err != nil {
+			return fmt.Errorf("error writing pointer block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+		return nil
+	}
+	span := func(blocks []uint32, start int) []uint32 {
+		if start >= len(blocks) {
+			return nil
+		}
+		end := start + pointersPerBlock
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		return blocks[start:end]
+	}
+
+	if m.indirect != 0 {
+		err := writePointers(m.indirect, span(data, directBlocks), span(old.data, directBlocks), m.indirect == old.indirect)
+		if err != nil {
+			return err
+		}
+	}
+	if m.double != 0 {
+		err := writePointers(m.double, m.children, old.children, m.double == old.double)
+		if err != nil {
+			return err
+		}
+	}
+	for i, child := range m.children {
+		start := directBlocks + (i+1)*pointersPerBlock
+		reused := i < len(old.children) && old.children[i] == child
+		err := writePointers(child, span(data, start), span(old.data, start), reused)
+		if err != nil {
+			return err
+		}
+	}
+
+	inode.Blocks = [directBlocks]uint32{}
+	copy(inode.Blocks[:], data)
+	inode.Indirect = m.indirect
+	inode.DoubleIndirect = m.double
+	return nil
+}
@@ -0,0 +1,213 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newBigTestFileSystem creates a filesystem with room for files reaching
+// their double indirect block.
+func newBigTestFileSystem(t *testing.T) (*FileSystem, []byte) {
+	disk := make([]byte, 2400*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 2400})
+	require.NoError(t, err)
+	return filesystem, disk
+}
+
+// newPointerTestFileSystem is newBigTestFileSystem formatted before
+// extents, so files are mapped with pointer blocks.
+func newPointerTestFileSystem(t *testing.T) (*FileSystem, []byte) {
+	filesystem, disk := newBigTestFileSystem(t)
+	filesystem.version = extentVersion - 1
+	require.NoError(t, filesystem.writeState(StateClean))
+	return filesystem, disk
+}
+
+// patterned returns n bytes that differ from block to block.
+func patterned(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i/BlockSize + i%251)
+	}
+	return buf
+}
+
+func TestIndirectBlocks(t *testing.T) {
+	filesystem, disk := newPointerTestFileSystem(t)
+	free := filesystem.freeBlocks.free
+
+	// past the indirect block, into the second pointer block of the double
+	// indirect block
+	want := patterned((directBlocks+2*pointersPerBlock+3)*BlockSize + 100)
+	inode, err := filesystem.CreateFile("/big", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.NotZero(t, inode.Indirect)
+	require.NotZero(t, inode.DoubleIndirect)
+	require.NoError(t, filesystem.CheckInvariants())
+	// the data blocks, the indirect and double indirect blocks, two pointer
+	// blocks under the double indirect block and the root directory's block
+	require.Equal(t, free-GetSizeInBlocks(len(want))-5, filesystem.freeBlocks.free)
+
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+
+	// overwrite a block reached through each level, and grow the file
+	for _, offset := range []int{5, (directBlocks + 7) * BlockSize, (directBlocks+pointersPerBlock+1)*BlockSize - 3, len(want) - 1} {
+		require.NoError(t, filesystem.WriteAt("/big", []byte("hello"), int64(offset)))
+		if offset+5 > len(want) {
+			want = append(want, make([]byte, offset+5-len(want))...)
+		}
+		copy(want[offset:], "hello")
+	}
+	require.NoError(t, filesystem.Append("/big", patterned(3*BlockSize)))
+	want = append(want, patterned(3*BlockSize)...)
+
+	f, err := filesystem.Open("/big", O_RDONLY)
+	require.NoError(t, err)
+	read, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, want, read)
+	require.NoError(t, f.Close())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err = reloaded.FindInodeByName("/big")
+	require.NoError(t, err)
+	contents, err = reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	for _, f := range Diagnose(NewArrayBlockDevice(bytes.Clone(disk))) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+
+	// truncating and deleting free the pointer blocks too
+	_, err = reloaded.CreateFile("/other", bytes.NewBuffer(patterned((directBlocks+1)*BlockSize)))
+	require.NoError(t, err)
+	f, err = reloaded.Open("/big", O_WRONLY|O_TRUNC)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	inode, err = reloaded.FindInodeByName("/big")
+	require.NoError(t, err)
+	require.Zero(t, inode.Indirect)
+	require.Zero(t, inode.DoubleIndirect)
+	require.NoError(t, reloaded.DeleteFile("/other"))
+	require.NoError(t, reloaded.CheckInvariants())
+	require.Equal(t, free-1, reloaded.freeBlocks.free)
+}
+
+func TestIndirectBlocksShrink(t *testing.T) {
+	filesystem, disk := newPointerTestFileSystem(t)
+	_, err := filesystem.CreateFile("/dir", bytes.NewBuffer(nil))
+	require.NoError(t, err)
+	free := filesystem.freeBlocks.free
+
+	// setInodeContents shrinks the file level by level
+	inode, err := filesystem.CreateFile("/big", bytes.NewBuffer(patterned((directBlocks+pointersPerBlock+5)*BlockSize)))
+	require.NoError(t, err)
+	for _, size := range []int{(directBlocks+pointersPerBlock)*BlockSize + 1, (directBlocks + 3) * BlockSize, 2 * BlockSize} {
+		want := patterned(size)
+		require.NoError(t, filesystem.setInodeContents(int(inode.Index), bytes.NewBuffer(want)))
+		require.NoError(t, filesystem.CheckInvariants())
+		contents, err := filesystem.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, want, contents.Bytes())
+	}
+	require.Equal(t, free-2, filesystem.freeBlocks.free)
+	require.NoError(t, filesystem.Close())
+	_, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+}
+
+func TestIndirectBlocksRollBack(t *testing.T) {
+	disk := make([]byte, 200*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 200})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/big", bytes.NewBuffer(patterned((directBlocks+2)*BlockSize)))
+	require.NoError(t, err)
+	before := filesystem.describeMetadata()
+
+	// fail each write in turn until the append goes through
+	want := patterned((directBlocks + 2) * BlockSize)
+	for i := 1; ; i++ {
+		dev.failWriteAt = dev.writes + i
+		err = filesystem.Append("/big", patterned(20*BlockSize))
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, errInjected)
+		require.Equal(t, before, filesystem.describeMetadata(), "failing write %d", i)
+		require.NoError(t, filesystem.CheckInvariants())
+		inode, err := filesystem.FindInodeByName("/big")
+		require.NoError(t, err)
+		contents, err := filesystem.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, want, contents.Bytes())
+	}
+}
+
+func TestIndirectBlocksUpgradeFormatVersion(t *testing.T) {
+	disk := make([]byte, 100*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 100})
+	require.NoError(t, err)
+	// pretend it was formatted before indirect blocks
+	filesystem.version = 1
+	require.NoError(t, filesystem.writeState(StateClean))
+
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/small", bytes.NewBuffer(make([]byte, directBlocks*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), sb.Version)
+
+	filesystem, err = LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/big", bytes.NewBuffer(make([]byte, (directBlocks+1)*BlockSize)))
+	require.NoError(t, err)
+	sb, err = ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), sb.Version)
+	require.NoError(t, filesystem.Close())
+	sb, err = ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), sb.Version)
+}
+
+func TestIndirectBlocksCorruption(t *testing.T) {
+	filesystem, disk := newPointerTestFileSystem(t)
+	inode, err := filesystem.CreateFile("/big", bytes.NewBuffer(patterned((directBlocks+3)*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// a pointer the size needs is zero
+	buf := make([]byte, BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	require.NoError(t, dev.ReadBlock(uint64(inode.Indirect), buf))
+	for i := 4; i < 8; i++ {
+		buf[i] = 0
+	}
+	require.NoError(t, dev.WriteBlock(uint64(inode.Indirect), buf))
+	_, err = LoadFilesystem(dev)
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.ErrorContains(t, err, "outside the data region")
+
+	// fsck keeps the direct blocks
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Contains(t, report.Repairs, "inode 1: dropped its indirect blocks")
+	require.Empty(t, report.Remaining)
+	repaired, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	contents, err := repaired.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, patterned(directBlocks*BlockSize), contents.Bytes())
+}
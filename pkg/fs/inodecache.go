@@ -0,0 +1,185 @@
+package fs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultInodeCacheSize is the number of inodes a filesystem keeps loaded
+// unless MountOptions says otherwise.
+const DefaultInodeCacheSize = 1024
+
+// inodeCache holds the loaded inodes, evicting the least recently used ones
+// beyond its capacity. Two kinds of entries are never evicted:
+//   - pinned inodes, such as those of open files, so that everyone using
+//     them shares one copy
+//   - nil entries, which record freed inodes until WriteInodeTable clears
+//     their slots on the device
+//
+// Modified inodes must be written back before they become evictable, which
+// operations ensure by pinning what they change until they are done, and
+// transactions by holding the whole cache until they end.
+//
+// Lookups reorder the entries, so the cache has a mutex of its own for
+// goroutines holding the filesystem's lock for reading.
+type inodeCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[int]*list.Element
+	// lru orders the entries from most to least recently used
+	lru *list.List
+	// held stops evictions, see hold
+	held bool
+}
+
+type inodeCacheEntry struct {
+	index int
+	inode *Inode
+	pins  int
+}
+
+func newInodeCache(capacity int) *inodeCache {
+	if capacity <= 0 {
+		capacity = DefaultInodeCacheSize
+	}
+	return &inodeCache{
+		capacity: capacity,
+		entries:  map[int]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached inode and marks it as recently used.
+func (c *inodeCache) get(inodeIndex int) (*Inode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[inodeIndex]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*inodeCacheEntry).inode, true
+}
+
+// peek is get without marking the inode as used, for scans over the table.
+func (c *inodeCache) peek(inodeIndex int) (*Inode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[inodeIndex]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*inodeCacheEntry).inode, true
+}
+
+// put caches an inode, or nil for a freed one, replacing any cached entry
+// but keeping its pins.
+func (c *inodeCache) put(inodeIndex int, inode *Inode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[inodeIndex]; ok {
+		elem.Value.(*inodeCacheEntry).inode = inode
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[inodeIndex] = c.lru.PushFront(&inodeCacheEntry{index: inodeIndex, inode: inode})
+	}
+	c.evict()
+}
+
+// load caches an inode just read from the inode table and returns it, unless
+// another goroutine cached it first, in which case it returns that copy.
+func (c *inodeCache) load(inodeIndex int, inode *Inode) *Inode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[inodeIndex]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*inodeCacheEntry).inode
+	}
+	c.entries[inodeIndex] = c.lru.PushFront(&inodeCacheEntry{index: inodeIndex, inode: inode})
+	c.evict()
+	return inode
+}
+
+// remove drops an entry, pinned or not.
+func (c *inodeCache) remove(inodeIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[inodeIndex]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, inodeIndex)
+	}
+}
+
+// pin keeps a cached inode from being evicted until a matching unpin.
+// Pinning an inode that isn't cached does nothing.
+func (c *inodeCache) pin(inodeIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[inodeIndex]; ok {
+		elem.Value.(*inodeCacheEntry).pins++
+	}
+}
+
+func (c *inodeCache) unpin(inodeIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[inodeIndex]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*inodeCacheEntry)
+	if entry.pins > 0 {
+		entry.pins--
+	}
+	c.evict()
+}
+
+// hold keeps every entry cached until unhold, for transactions, which
+// write the inodes they change back only when they commit.
+func (c *inodeCache) hold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = true
+}
+
+func (c *inodeCache) unhold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = false
+	c.evict()
+}
+
+// indices returns the indices of the cached inodes, in no particular order.
+func (c *inodeCache) indices() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	indices := make([]int, 0, len(c.entries))
+	for inodeIndex := range c.entries {
+		indices = append(indices, inodeIndex)
+	}
+	return indices
+}
+
+func (c *inodeCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// evict drops least recently used entries while over capacity. The most
+// recently used entry is kept even if everything else is pinned, as its
+// user is about to need it. The caller holds c.mu.
+func (c *inodeCache) evict() {
+	if c.held {
+		return
+	}
+	for elem := c.lru.Back(); elem != c.lru.Front() && c.lru.Len() > c.capacity; {
+		prev := elem.Prev()
+		entry := elem.Value.(*inodeCacheEntry)
+		if entry.pins == 0 && entry.inode != nil {
+			c.lru.Remove(elem)
+			delete(c.entries, entry.index)
+		}
+		elem = prev
+	}
+}
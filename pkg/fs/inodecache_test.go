@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInodeCacheEviction(t *testing.T) {
+	c := newInodeCache(2)
+	a, b, d := &Inode{Index: 1}, &Inode{Index: 2}, &Inode{Index: 3}
+	c.put(1, a)
+	c.put(2, b)
+	// using 1 makes 2 the least recently used
+	_, ok := c.get(1)
+	require.True(t, ok)
+	c.put(3, d)
+	require.Equal(t, 2, c.len())
+	_, ok = c.peek(2)
+	require.False(t, ok)
+
+	// pinned and freed entries stay, as does the newest one, even if that
+	// goes over capacity
+	c.pin(1)
+	c.put(4, nil)
+	c.put(5, &Inode{Index: 5})
+	require.Equal(t, 3, c.len())
+	_, ok = c.peek(1)
+	require.True(t, ok)
+	_, ok = c.peek(4)
+	require.True(t, ok)
+	_, ok = c.peek(5)
+	require.True(t, ok)
+	_, ok = c.peek(3)
+	require.False(t, ok)
+
+	// once unpinned, the entry is evicted to get back to capacity
+	c.unpin(1)
+	_, ok = c.peek(1)
+	require.False(t, ok)
+	require.Equal(t, 2, c.len())
+}
+
+func TestSmallInodeCache(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	filesystem, err = LoadFilesystemWithOptions(NewArrayBlockDevice(disk), MountOptions{InodeCacheSize: 1})
+	require.NoError(t, err)
+
+	f, err := filesystem.OpenFile("/open", O_RDWR|O_CREATE, 0600)
+	require.NoError(t, err)
+	open, err := filesystem.GetInode(f.inodeIndex)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBufferString(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	_, err = f.Write([]byte("still open"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.CheckInvariants())
+
+	// the open file's inode was never evicted
+	inode, err := filesystem.GetInode(f.inodeIndex)
+	require.NoError(t, err)
+	require.Same(t, open, inode)
+	require.Equal(t, uint32(10), inode.Size)
+	require.NoError(t, f.Close())
+
+	for i := 0; i < 10; i++ {
+		inode, err := filesystem.FindInodeByName(fmt.Sprintf("/f%d", i))
+		require.NoError(t, err)
+		contents, err := filesystem.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), contents.String())
+	}
+	require.LessOrEqual(t, filesystem.inodes.len(), 2)
+}
@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+)
+
+// Inodes are loaded from the inode table the first time they are used,
+// rather than all at once when mounting, so the memory a mounted filesystem
+// takes grows with the inodes in use, not with the size of the table.
+// Loaded inodes are kept in an inodeCache and written back by
+// WriteInodeTable.
+
+// inode returns the inode with the given index, loading it on first use.
+// It returns nil if the inode isn't allocated.
+func (fs *FileSystem) inode(inodeIndex int) (*Inode, error) {
+	if inodeIndex < 0 || inodeIndex >= fs.inodeBitmap.len() {
+		return nil, fmt.Errorf("inode index out of bounds: %d", inodeIndex)
+	}
+	if inode, ok := fs.inodes.get(inodeIndex); ok {
+		return inode, nil
+	}
+	if !fs.inodeBitmap.test(inodeIndex) {
+		return nil, nil
+	}
+
+	inode, err := fs.readInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = inode.validate(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	return fs.inodes.load(inodeIndex, inode), nil
+}
+
+// allocatedInode is inode for callers that need the inode to exist.
+func (fs *FileSystem) allocatedInode(inodeIndex int) (*Inode, error) {
+	inode, err := fs.inode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if inode == nil {
+		return nil, fmt.Errorf("inode %d is not allocated", inodeIndex)
+	}
+	return inode, nil
+}
+
+// pinInode loads an allocated inode and pins it in the cache. Unpin it with
+// fs.inodes.unpin once done.
+func (fs *FileSystem) pinInode(inodeIndex int) (*Inode, error) {
+	inode, err := fs.allocatedInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	// loading made it the most recently used inode, so it is still cached
+	fs.inodes.pin(inodeIndex)
+	return inode, nil
+}
+
+// readInode decodes an inode from the inode table on the device, without
+// keeping or validating it.
+func (fs *FileSystem) readInode(inodeIndex int) (*Inode, error) {
+	buf := make([]byte, BlockSize)
+	blockIndex := inodeIndex * InodeSize / BlockSize
+	err := fs.readMetadata(uint64(blockIndex)+uint64(fs.geometry.InodeTableStart), buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inode %d: %w", inodeIndex, err)
+	}
+	inode, err := decodeInode(inodeIndex, buf)
+	if err != nil {
+		return nil, err
+	}
+	fs.explainInodeRead(inodeIndex, inode)
+	return inode, nil
+}
+
+// Inode slots hold the gob encoding of the inode, followed by records of the
+// fields kept outside it, each a tag byte and the value, and then zeros. The
+// records were added to keep slots from outgrowing InodeSize, as the gob
+// encoding spells out the name of every field; older code ignores them.
+const (
+	// inodeRecordEnd ends the records, or is the zero padding after the
+	// gob encoding of older inodes.
+	inodeRecordEnd = 0
+	// inodeRecordContentSum holds the checksum of the contents of a file,
+	// a little endian uint32.
+	inodeRecordContentSum = 1
+	// inodeRecordExtents marks inodes mapped with extents. It has no value.
+	// Only filesystems older code refuses to mount have it.
+	inodeRecordExtents = 2
+	// inodeRecordDirIndex marks indexed directories, like
+	// inodeRecordExtents.
+	inodeRecordDirIndex = 3
+	// inodeRecordQuotaDir holds the index of the quota directory the inode
+	// is charged to, a little endian uint32.
+	inodeRecordQuotaDir = 4
+	// inodeRecordQuota holds the quota of a directory: the limits on bytes
+	// and inodes and their usage, little endian uint64s in the order of
+	// QuotaUsage.
+	inodeRecordQuota = 5
+	// inodeRecordCompression holds how the contents of a file are
+	// compressed: the Compression, a byte, and the compressed size, a
+	// little endian uint32.
+	inodeRecordCompression = 6
+	// inodeRecordXattrs holds the extended attributes kept in the slot: the
+	// length of their encoding, a little endian uint16, and the encoding.
+	inodeRecordXattrs = 7
+	// inodeRecordXattrBlock holds the index of the xattr block, a little
+	// endian uint32.
+	inodeRecordXattrBlock = 8
+	// inodeRecordOwner holds the user and group owning the inode, little
+	// endian uint32s. Inodes owned by root have none.
+	inodeRecordOwner = 9
+	// inodeRecordEntries holds the number of entries of a directory, a
+	// uvarint, as slots of directories with the longest names have only a
+	// few bytes to spare.
+	inodeRecordEntries = 10
+)
+
+// encodeInode encodes an inode for its slot of the inode table.
+func encodeInode(inode *Inode) ([]byte, error) {
+	bb := &bytes.Buffer{}
+	err := gob.NewEncoder(bb).Encode(inode)
+	if err != nil {
+		return nil, err
+	}
+	if inode.contentSummed {
+		bb.WriteByte(inodeRecordContentSum)
+		binary.Write(bb, binary.LittleEndian, inode.contentSum)
+	}
+	if inode.extentMapped {
+		bb.WriteByte(inodeRecordExtents)
+	}
+	if inode.dirIndexed {
+		bb.WriteByte(inodeRecordDirIndex)
+	}
+	if inode.inQuota {
+		bb.WriteByte(inodeRecordQuotaDir)
+		binary.Write(bb, binary.LittleEndian, inode.quotaDir)
+	}
+	if inode.quotaSet {
+		bb.WriteByte(inodeRecordQuota)
+		q := inode.quota
+		binary.Write(bb, binary.LittleEndian, [4]uint64{q.MaxBytes, q.MaxInodes, q.Bytes, q.Inodes})
+	}
+	if inode.compressed() {
+		bb.WriteByte(inodeRecordCompression)
+		bb.WriteByte(byte(inode.compression))
+		binary.Write(bb, binary.LittleEndian, inode.compressedSize)
+	}
+	if len(inode.xattrs) > 0 {
+		encoded := encodeXattrs(inode.xattrs)
+		bb.WriteByte(inodeRecordXattrs)
+		binary.Write(bb, binary.LittleEndian, uint16(len(encoded)))
+		bb.Write(encoded)
+	}
+	if inode.xattrBlock != 0 {
+		bb.WriteByte(inodeRecordXattrBlock)
+		binary.Write(bb, binary.LittleEndian, inode.xattrBlock)
+	}
+	if inode.uid != 0 || inode.gid != 0 {
+		bb.WriteByte(inodeRecordOwner)
+		binary.Write(bb, binary.LittleEndian, [2]uint32{inode.uid, inode.gid})
+	}
+	if inode.entriesCounted {
+		bb.WriteByte(inodeRecordEntries)
+		bb.Write(binary.AppendUvarint(nil, uint64(inode.entries)))
+	}
+	return bb.Bytes(), nil
+}
+
+// decodeInode decodes an inode from the block of the inode table holding it.
+func decodeInode(inodeIndex int, block []byte) (*Inode, error) {
+	blockOffset := inodeIndex * InodeSize % BlockSize
+	// gob reads a bytes.Buffer without buffering ahead, so what it leaves
+	// are the records
+	bb := bytes.NewBuffer(block[blockOffset : blockOffset+InodeSize])
+	var inode Inode
+	err := gob.NewDecoder(bb).Decode(&inode)
+	if err != nil {
+		return nil, corruptf("inode %d can't be decoded: %v", inodeIndex, err)
+	}
+	for {
+		tag, err := bb.ReadByte()
+		if err != nil || tag == inodeRecordEnd {
+			return &inode, nil
+		}
+		switch tag {
+		case inodeRecordContentSum:
+			if bb.Len() < 4 {
+				return nil, corruptf("inode %d has a truncated content checksum", inodeIndex)
+			}
+			inode.contentSum, inode.contentSummed = binary.LittleEndian.Uint32(bb.Next(4)), true
+		case inodeRecordExtents:
+			inode.extentMapped = true
+		case inodeRecordDirIndex:
+			inode.dirIndexed = true
+		case inodeRecordQuotaDir:
+			if bb.Len() < 4 {
+				return nil, corruptf("inode %d has a truncated quota directory", inodeIndex)
+			}
+			inode.quotaDir, inode.inQuota = binary.LittleEndian.Uint32(bb.Next(4)), true
+		case inodeRecordQuota:
+			if bb.Len() < 32 {
+				return nil, corruptf("inode %d has a truncated quota", inodeIndex)
+			}
+			var q [4]uint64
+			binary.Read(bb, binary.LittleEndian, &q)
+			inode.quota = QuotaUsage{Quota: Quota{MaxBytes: q[0], MaxInodes: q[1]}, Bytes: q[2], Inodes: q[3]}
+			inode.quotaSet = true
+		case inodeRecordCompression:
+			if bb.Len() < 5 {
+				return nil, corruptf("inode %d has a truncated compression", inodeIndex)
+			}
+			inode.compression = Compression(bb.Next(1)[0])
+			inode.compressedSize = binary.LittleEndian.Uint32(bb.Next(4))
+			if !inode.compressed() {
+				return nil, corruptf("inode %d is compressed with unknown compression %d", inodeIndex, inode.compression)
+			}
+		case inodeRecordXattrs:
+			if bb.Len() < 2 {
+				return nil, corruptf("inode %d has truncated extended attributes", inodeIndex)
+			}
+			n := int(binary.LittleEndian.Uint16(bb.Next(2)))
+			if bb.Len() < n {
+				return nil, corruptf("inode %d has truncated extended attributes", inodeIndex)
+			}
+			inode.xattrs, err = decodeXattrs(bb.Next(n))
+			if err != nil {
+				return nil, corruptf("inode %d: %v", inodeIndex, err)
+			}
+		case inodeRecordXattrBlock:
+			if bb.Len() < 4 {
+				return nil, corruptf("inode %d has a truncated xattr block", inodeIndex)
+			}
+			inode.xattrBlock = binary.LittleEndian.Uint32(bb.Next(4))
+		case inodeRecordOwner:
+			if bb.Len() < 8 {
+				return nil, corruptf("inode %d has a truncated owner", inodeIndex)
+			}
+			inode.uid = binary.LittleEndian.Uint32(bb.Next(4))
+			inode.gid = binary.LittleEndian.Uint32(bb.Next(4))
+		case inodeRecordEntries:
+			n, err := binary.ReadUvarint(bb)
+			if err != nil || n > math.MaxUint32 {
+				return nil, corruptf("inode %d has a malformed entry count", inodeIndex)
+			}
+			inode.entries, inode.entriesCounted = uint32(n), true
+		default:
+			return nil, corruptf("inode %d has a record of unknown type %d", inodeIndex, tag)
+		}
+	}
+}
+
+// forEachInode calls fn for every allocated inode, in index order, stopping
+// at the first error. Inodes that aren't loaded are read for the call only
+// and aren't validated, so checks can walk the whole table without keeping
+// it in memory.
+func (fs *FileSystem) forEachInode(fn func(inodeIndex int, inode *Inode) error) error {
+	for i := 0; i < fs.inodeBitmap.len(); i++ {
+		inode, ok := fs.inodes.peek(i)
+		if !ok && fs.inodeBitmap.test(i) {
+			var err error
+			inode, err = fs.readInode(i)
+			if err != nil {
+				return err
+			}
+		}
+		if inode == nil {
+			continue
+		}
+		err := fn(i, inode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInodesLoadOnDemand(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBufferString(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.Close())
+
+	// mounting validates the inode table without keeping it
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Zero(t, reloaded.inodes.len())
+	_, err = reloaded.GetInode(3)
+	require.NoError(t, err)
+	require.Equal(t, 1, reloaded.inodes.len())
+
+	f, err := reloaded.OpenFile("/f12", O_WRONLY|O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, reloaded.Close())
+
+	// writing the loaded inodes back leaves the others intact
+	reloaded, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		inode, err := reloaded.FindInodeByName(fmt.Sprintf("/f%d", i))
+		require.NoError(t, err)
+		contents, err := reloaded.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		want := fmt.Sprint(i)
+		if i == 12 {
+			want += "!"
+		}
+		require.Equal(t, want, contents.String())
+	}
+}
+
+func TestWriteInodeTableKeepsUnloadedSlots(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// load only /foo, which shares its inode table block with /bar
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := reloaded.GetInode(int(foo.Index))
+	require.NoError(t, err)
+	inode.Mode = 0600
+	require.NoError(t, reloaded.WriteInodeTable())
+	require.NoError(t, reloaded.Close())
+
+	reloaded, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err = reloaded.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0600), inode.Mode)
+	_, err = reloaded.FindInodeByName("/bar")
+	require.NoError(t, err)
+}
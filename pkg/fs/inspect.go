@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Image gives read-only access to the structures of a filesystem as the
+// device holds them, for debugging damaged filesystems; see the fsdebug
+// package. Unlike LoadFilesystem it checks nothing past the superblock:
+// inodes are decoded whether or not they are valid, checksums aren't
+// verified, and the journal isn't replayed, so a committed transaction
+// shows only in the journal. It never writes to the device.
+type Image struct {
+	fs *FileSystem
+	sb *Superblock
+	// inodeBitmap is read on first use
+	inodeBitmap []byte
+}
+
+// OpenImage reads the superblock of dev, for inspecting the filesystem on
+// it.
+func OpenImage(dev BlockDevice) (*Image, error) {
+	sb, err := ReadSuperblock(dev)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := readSuperblockOnly(dev)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{fs: fs, sb: sb}, nil
+}
+
+// Superblock returns the superblock of the image.
+func (img *Image) Superblock() *Superblock {
+	return img.sb
+}
+
+// ReadBlock reads a block of the device, whichever region it is in.
+func (img *Image) ReadBlock(blockNum uint64, buf []byte) error {
+	return img.fs.dev.ReadBlock(blockNum, buf)
+}
+
+// DescribeBlock says what a block holds, by its place in the layout.
+func (img *Image) DescribeBlock(blockNum uint64) string {
+	if blockNum >= uint64(img.fs.geometry.BlockCount) {
+		return "past the end of the filesystem"
+	}
+	return img.fs.describeBlock(blockNum)
+}
+
+// InodeBitmap returns the inode bitmap, a byte per inode, 1 if it is taken.
+func (img *Image) InodeBitmap() ([]byte, error) {
+	if img.inodeBitmap == nil {
+		g := img.fs.geometry
+		b, err := img.fs.readBitmapEntries(g.InodeBitmapStart, g.InodeCount, g.PackedBitmaps)
+		if err != nil {
+			return nil, fmt.Errorf("error reading inode bitmap: %w", err)
+		}
+		img.inodeBitmap = b
+	}
+	return img.inodeBitmap, nil
+}
+
+// DataBitmap returns the data bitmap, a byte per data block, 1 if it is
+// taken.
+func (img *Image) DataBitmap() ([]byte, error) {
+	g := img.fs.geometry
+	b, err := img.fs.readBitmapEntries(g.DataBitmapStart, g.DataBlocks(), g.PackedBitmaps)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data bitmap: %w", err)
+	}
+	return b, nil
+}
+
+// InodeRecord is an inode as the inode table holds it.
+type InodeRecord struct {
+	Index int
+	// Allocated is set if the inode is taken in the inode bitmap.
+	Allocated bool
+	// Slot is the slot of the inode in the inode table.
+	Slot []byte
+	// Inode is the decoded inode, or nil if the slot doesn't decode.
+	Inode *Inode
+	// Invalid is why the slot doesn't decode or the inode is malformed, or
+	// nil if it is neither.
+	Invalid error
+
+	// Mapping is "blocks" for inodes mapping their blocks with pointers
+	// and "extents" for those mapping them with extents, and Mapped lists
+	// the blocks or extents the inode holds itself.
+	Mapping string
+	Mapped  string
+	// Data are the data blocks of the inode in file order, Pointers its
+	// pointer or extent blocks, and XattrBlock its xattr block, or zero.
+	// BlocksErr is set if the pointer or extent blocks can't be read, and
+	// Data and Pointers are then empty.
+	Data       []uint32
+	Pointers   []uint32
+	XattrBlock uint32
+	BlocksErr  error
+	// ContentSum is the checksum of the contents of a file, if
+	// ContentSummed is set; see contentsum.go.
+	ContentSum    uint32
+	ContentSummed bool
+}
+
+// Inode reads the slot of an inode from the inode table and decodes it. It
+// fails only if the slot can't be read.
+func (img *Image) Inode(inodeIndex int) (*InodeRecord, error) {
+	fs := img.fs
+	if inodeIndex < 0 || inodeIndex >= int(fs.geometry.InodeCount) {
+		return nil, fmt.Errorf("inode index out of bounds: %d", inodeIndex)
+	}
+	bitmap, err := img.InodeBitmap()
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, BlockSize)
+	err = fs.readBlock(uint64(fs.geometry.InodeTableStart)+uint64(inodeIndex*InodeSize/BlockSize), block)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inode %d: %w", inodeIndex, err)
+	}
+	offset := inodeIndex * InodeSize % BlockSize
+	r := &InodeRecord{
+		Index:     inodeIndex,
+		Allocated: bitmap[inodeIndex] != 0,
+		Slot:      bytes.Clone(block[offset : offset+InodeSize]),
+	}
+	r.Inode, r.Invalid = decodeInode(inodeIndex, block)
+	if r.Invalid != nil {
+		return r, nil
+	}
+	inode := r.Inode
+	r.Invalid = inode.validate(inodeIndex)
+	r.Mapping, r.Mapped = inode.describeBlocks()
+	r.ContentSum, r.ContentSummed = inode.contentSum, inode.contentSummed
+	r.XattrBlock = inode.xattrBlock
+	if r.Invalid == nil {
+		m, err := fs.readContentsMap(inode)
+		if err != nil {
+			r.BlocksErr = err
+		} else {
+			r.Data, r.Pointers = m.data, m.pointers()
+		}
+	}
+	return r, nil
+}
+
+// ReadDir decodes the entries of a directory, in the order they are
+// stored. The inodes they point at aren't read: Type is the type recorded
+// in the entry, which directories of text entries don't record, and Size is
+// zero.
+func (img *Image) ReadDir(dir *Inode) ([]DirEntry, error) {
+	if dir.Type != InodeTypeDirectory {
+		return nil, fmt.Errorf("inode %d: %w", dir.Index, ErrNotDirectory)
+	}
+	contents, err := img.fs.readContents(dir)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseDir(dir, contents)
+	entries := []DirEntry{}
+	for _, record := range records {
+		entries = append(entries, DirEntry{Name: record.name, Inode: uint32(record.inode), Type: record.typ})
+	}
+	return entries, err
+}
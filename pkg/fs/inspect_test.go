@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImage(t *testing.T) {
+	filesystem, disk := newBigTestFileSystem(t)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	file, err := filesystem.CreateFile("/dir/file", bytes.NewBuffer(patterned((directBlocks+2)*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.SetXattr("/dir/file", "user.big", make([]byte, 2000)))
+	blocks, err := filesystem.fileBlocks(file)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	img, err := OpenImage(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, filesystem.Geometry(), img.Superblock().Geometry)
+	require.Equal(t, "superblock", img.DescribeBlock(0))
+	require.Equal(t, "past the end of the filesystem", img.DescribeBlock(2400))
+
+	inodeBitmap, err := img.InodeBitmap()
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 1, 1, 0}, inodeBitmap[:4])
+	dataBitmap, err := img.DataBitmap()
+	require.NoError(t, err)
+	require.Equal(t, byte(1), dataBitmap[blocks[0]-filesystem.geometry.DataStart])
+
+	r, err := img.Inode(int(file.Index))
+	require.NoError(t, err)
+	require.True(t, r.Allocated)
+	require.NoError(t, r.Invalid)
+	require.Equal(t, "file", r.Inode.Filename)
+	require.Equal(t, "extents", r.Mapping)
+	require.Equal(t, blocks, r.Data)
+	// one extent, held by the inode itself
+	require.Empty(t, r.Pointers)
+	require.NotZero(t, r.XattrBlock)
+	require.True(t, r.ContentSummed)
+	require.Len(t, r.Slot, InodeSize)
+
+	dir, err := img.Inode(1)
+	require.NoError(t, err)
+	entries, err := img.ReadDir(dir.Inode)
+	require.NoError(t, err)
+	require.Equal(t, []DirEntry{{Name: "file", Inode: file.Index, Type: InodeTypeFile}}, entries)
+	_, err = img.ReadDir(r.Inode)
+	require.ErrorIs(t, err, ErrNotDirectory)
+
+	// free slots and damaged ones are read all the same
+	r, err = img.Inode(5)
+	require.NoError(t, err)
+	require.False(t, r.Allocated)
+	slot := int(filesystem.geometry.InodeTableStart)*BlockSize + int(file.Index)*InodeSize
+	copy(disk[slot:], bytes.Repeat([]byte{0xff}, 16))
+	r, err = img.Inode(int(file.Index))
+	require.NoError(t, err)
+	require.Nil(t, r.Inode)
+	require.ErrorIs(t, r.Invalid, ErrCorrupt)
+	_, err = img.Inode(-1)
+	require.Error(t, err)
+}
@@ -0,0 +1,331 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// InvariantMode selects what happens when a public operation leaves the
+// filesystem's metadata inconsistent. Checking is meant for development:
+// it re-reads every directory after each operation.
+//
+// Building with the fsdebug tag (go test -tags fsdebug ./...) makes
+// InvariantsPanic the default for every FileSystem.
+type InvariantMode int
+
+const (
+	// InvariantsOff disables checking.
+	InvariantsOff InvariantMode = iota
+	// InvariantsLog writes the violations, together with a diff of the
+	// metadata before and after the operation, to the configured writer.
+	InvariantsLog
+	// InvariantsPanic panics with the same report.
+	InvariantsPanic
+)
+
+// InvariantError lists the invariants a filesystem violates.
+type InvariantError struct {
+	Violations []string
+}
+
+func (e *InvariantError) Error() string {
+	return fmt.Sprintf("%d invariant violations:\n\t%s", len(e.Violations), strings.Join(e.Violations, "\n\t"))
+}
+
+// SetInvariantChecks sets what happens when a mutating operation (CreateFile,
+// OpenFile, File.Write) breaks an invariant. Reports in InvariantsLog mode go
+// to w, or to stderr if w is nil.
+func (fs *FileSystem) SetInvariantChecks(mode InvariantMode, w io.Writer) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if w == nil {
+		w = os.Stderr
+	}
+	fs.invariantMode = mode
+	fs.invariantLog = w
+}
+
+// CheckInvariants verifies the in-memory metadata:
+//   - the inode bitmap matches the allocated inodes, which know their index
+//   - inode sizes match their block counts, block lists have no gaps, and
+//     the pointer blocks a size needs are there
+//   - every referenced block is in the data region, marked used and owned
+//     by a single inode, or counted in the dedup table as many times as it
+//     is referenced, and every used block is referenced
+//   - the free-space indices match the bitmaps
+//   - directory entries resolve to allocated inodes with unique names, and
+//     every inode but the root is in as many directory entries as its link
+//     count
+//   - directories with an entry count hold that many entries
+//   - quota directories record the usage charged to them, and directories
+//     and files of a single name are charged to the quota directory of
+//     their directory
+//
+// It returns an *InvariantError listing the violations, or another error if
+// the directories can't be read.
+func (fs *FileSystem) CheckInvariants() error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.checkInvariants()
+}
+
+func (fs *FileSystem) checkInvariants() error {
+	violations := []string{}
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	// inodes that aren't loaded are allocated exactly when the bitmap says so
+	for i := 0; i < fs.inodeBitmap.len(); i++ {
+		if inode, ok := fs.inodes.peek(i); ok && fs.inodeBitmap.test(i) != (inode != nil) {
+			violate("inode %d: bitmap says allocated=%v, inode table disagrees", i, fs.inodeBitmap.test(i))
+		}
+	}
+
+	owners := map[uint32]int{}
+	refs := map[uint32]int{}
+	// charges holds the inodes that must be charged to the quota directory
+	// of their directory, and their charge
+	type charge struct {
+		quotaDir uint32
+		inQuota  bool
+	}
+	charges := map[uint32]charge{}
+	err := fs.forEachInode(func(i int, inode *Inode) error {
+		if inode.Type == InodeTypeDirectory || inode.links() == 1 {
+			charges[uint32(i)] = charge{inode.quotaDir, inode.inQuota}
+		}
+		if int(inode.Index) != i {
+			violate("inode %d: stored index is %d", i, inode.Index)
+		}
+
+		blocks := inode.usedBlocks()
+		if inode.extentMapped {
+			if err := inode.validateExtents(i); err != nil {
+				violate("%v", err)
+			}
+		} else {
+			for _, blockIndex := range inode.Blocks[len(blocks):] {
+				if blockIndex != 0 {
+					violate("inode %d: block list has a gap", i)
+					break
+				}
+			}
+			need := inode.StoredBlocks()
+			direct := need
+			if direct > directBlocks {
+				direct = directBlocks
+			}
+			if len(blocks) != direct {
+				violate("inode %d: size %d needs %d blocks, has %d", i, inode.storedSize(), need, len(blocks))
+			}
+			if err := inode.validatePointers(i); err != nil {
+				violate("%v", err)
+			}
+		}
+		if m, err := fs.readBlockMap(inode); err == nil {
+			blocks = m.owned()
+		} else if errors.Is(err, ErrCorrupt) {
+			violate("%v", err)
+		} else {
+			return err
+		}
+
+		for _, blockIndex := range blocks {
+			if !fs.isDataBlock(blockIndex) {
+				violate("inode %d: block %d is outside the data region", i, blockIndex)
+				continue
+			}
+			if owner, ok := owners[blockIndex]; ok && fs.dedup == nil {
+				violate("block %d is owned by inodes %d and %d", blockIndex, owner, i)
+			}
+			owners[blockIndex] = i
+			refs[blockIndex]++
+			if !fs.dataBitmap.test(int(blockIndex - fs.geometry.DataStart)) {
+				violate("block %d of inode %d is marked free", blockIndex, i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// data block 0 is reserved
+	for i := 1; i < fs.dataBitmap.len(); i++ {
+		if _, ok := owners[uint32(i)+fs.geometry.DataStart]; fs.dataBitmap.test(i) && !ok {
+			violate("block %d is marked used but owned by no inode", uint32(i)+fs.geometry.DataStart)
+		}
+	}
+	if fs.dedup != nil {
+		violations = append(violations, fs.dedupMismatches(refs)...)
+	}
+	violations = append(violations, fs.checkFreeSpaceIndex()...)
+
+	// referenced counts the entries pointing at each inode
+	referenced := map[uint32]uint32{0: 1}
+	err = fs.forEachInode(func(i int, inode *Inode) error {
+		if inode.Type != InodeTypeDirectory {
+			return nil
+		}
+		// tell device failures apart from malformed directories
+		if _, err := fs.readInodeContents(i); err != nil {
+			return fmt.Errorf("error reading directory %d: %w", i, err)
+		}
+		entries, err := fs.readDir(i)
+		if err != nil {
+			violate("directory %d: %v", i, err)
+			return nil
+		}
+		if n, ok := inode.Entries(); ok && n != len(entries) {
+			violate("directory %d: records %d entries, but holds %d", i, n, len(entries))
+		}
+		names := map[string]bool{}
+		for _, entry := range entries {
+			if names[entry.Name] {
+				violate("directory %d: duplicate entry %q", i, entry.Name)
+			}
+			names[entry.Name] = true
+			referenced[entry.Inode]++
+			owner, ok := quotaOwner(inode)
+			if c, single := charges[entry.Inode]; single && (c.inQuota != ok || ok && c.quotaDir != owner) {
+				violate("inode %d in directory %d: charged to quota directory %d (%v), not %d (%v)", entry.Inode, i, c.quotaDir, c.inQuota, owner, ok)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = fs.forEachInode(func(i int, inode *Inode) error {
+		switch n := referenced[uint32(i)]; {
+		case n == 0:
+			violate("inode %d is not referenced by any directory", i)
+		case n != inode.links():
+			violate("inode %d is referenced %d times, but its link count is %d", i, n, inode.links())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	counted, problems, err := countQuotas(fs.forEachInode)
+	if err != nil {
+		return err
+	}
+	violations = append(violations, problems...)
+	err = fs.forEachInode(func(i int, inode *Inode) error {
+		if u := counted[uint32(i)]; inode.quotaSet && (u.Bytes != inode.quota.Bytes || u.Inodes != inode.quota.Inodes) {
+			violate("directory %d: records a quota usage of %d bytes and %d inodes, but %d bytes and %d inodes are charged to it",
+				i, inode.quota.Bytes, inode.quota.Inodes, u.Bytes, u.Inodes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(violations) > 0 {
+		return &InvariantError{Violations: violations}
+	}
+	return nil
+}
+
+// checkInvariantsAfter is deferred by mutating operations:
+//
+//	defer fs.checkInvariantsAfter("CreateFile")()
+//
+// It records the metadata before the operation and, once the operation
+// returns, checks the invariants and reports violations along with a diff
+// of what the operation changed.
+func (fs *FileSystem) checkInvariantsAfter(op string) func() {
+	if fs.invariantMode == InvariantsOff {
+		return func() {}
+	}
+	before := fs.describeMetadata()
+
+	return func() {
+		// the checks' reads aren't part of the operation
+		explain := fs.explain
+		fs.explain = nil
+		defer func() { fs.explain = explain }()
+
+		err := fs.checkInvariants()
+		var invariantErr *InvariantError
+		if !errors.As(err, &invariantErr) {
+			// either everything is fine, or the device can't be read,
+			// which is the operation's problem to report
+			return
+		}
+
+		report := fmt.Sprintf("fs: %s broke %v\nmetadata diff:\n%s",
+			op, invariantErr, lineDiff(before, fs.describeMetadata()))
+		if fs.invariantMode == InvariantsPanic {
+			panic(report)
+		}
+		fmt.Fprint(fs.invariantLog, report)
+	}
+}
+
+// describeMetadata renders the in-memory metadata, one line per item.
+// Inodes that aren't loaded are left out, as operations load the inodes
+// they change.
+func (fs *FileSystem) describeMetadata() []string {
+	lines := []string{
+		"inode bitmap " + fs.inodeBitmap.entries.String(),
+		"data bitmap  " + fs.dataBitmap.entries.String(),
+	}
+	for i := 0; i < fs.inodeBitmap.len(); i++ {
+		inode, _ := fs.inodes.peek(i)
+		if inode == nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("inode %d: type=%d size=%d blocks=%v indirect=%d,%d name=%q",
+			i, inode.Type, inode.Size, inode.usedBlocks(), inode.Indirect, inode.DoubleIndirect, inode.Filename))
+	}
+	return lines
+}
+
+// lineDiff returns a minimal diff of two lists of lines, marking removed
+// lines with '-', added ones with '+' and unchanged ones with ' '.
+func lineDiff(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	sb := &strings.Builder{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(sb, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(sb, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(sb, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return sb.String()
+}
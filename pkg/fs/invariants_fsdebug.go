@@ -0,0 +1,5 @@
+//go:build fsdebug
+
+package fs
+
+const defaultInvariantMode = InvariantsPanic
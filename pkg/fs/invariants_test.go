@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	setup := func(t *testing.T) (filesystem *FileSystem, foo, bar *Inode) {
+		filesystem = newTestFileSystem(t)
+		require.NoError(t, filesystem.CheckInvariants())
+
+		_, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 2*BlockSize)))
+		require.NoError(t, err)
+		f, err := filesystem.OpenFile("/bar", O_RDWR|O_CREATE, 0600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, filesystem.CheckInvariants())
+
+		foo, err = filesystem.FindInodeByName("/foo")
+		require.NoError(t, err)
+		bar, err = filesystem.FindInodeByName("/bar")
+		require.NoError(t, err)
+		return filesystem, foo, bar
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(filesystem *FileSystem, foo, bar *Inode)
+		want    string
+	}{
+		{"leaked block", func(filesystem *FileSystem, foo, bar *Inode) {
+			filesystem.dataBitmap.set(31, true)
+		}, "owned by no inode"},
+		{"free block in use", func(filesystem *FileSystem, foo, bar *Inode) {
+			filesystem.dataBitmap.set(int(foo.Blocks[0]-DataStartIndex), false)
+		}, "is marked free"},
+		{"shared block", func(filesystem *FileSystem, foo, bar *Inode) {
+			bar.Blocks[0] = foo.Blocks[0]
+		}, "owned by inodes"},
+		{"size mismatch", func(filesystem *FileSystem, foo, bar *Inode) {
+			foo.Size = 5 * BlockSize
+		}, "needs 5 blocks"},
+		{"inode bitmap", func(filesystem *FileSystem, foo, bar *Inode) {
+			filesystem.inodeBitmap.set(int(bar.Index), false)
+		}, "bitmap says allocated=false"},
+		{"unreferenced inode", func(filesystem *FileSystem, foo, bar *Inode) {
+			filesystem.inodes.put(5, &Inode{Index: 5, Type: InodeTypeFile})
+			filesystem.inodeBitmap.set(5, true)
+		}, "inode 5 is not referenced"},
+		{"free space index", func(filesystem *FileSystem, foo, bar *Inode) {
+			filesystem.freeBlocks.take(20)
+		}, "free data index"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filesystem, foo, bar := setup(t)
+			tt.corrupt(filesystem, foo, bar)
+			err := filesystem.CheckInvariants()
+			var invariantErr *InvariantError
+			require.ErrorAs(t, err, &invariantErr)
+			require.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestInvariantChecksAfterOperations(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	log := &bytes.Buffer{}
+	filesystem.SetInvariantChecks(InvariantsLog, log)
+
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.Empty(t, log.String())
+
+	// leak a block, then make an operation that reports it
+	filesystem.dataBitmap.set(31, true)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("world"))
+	require.NoError(t, err)
+	report := log.String()
+	require.Contains(t, report, "CreateFile broke")
+	require.Contains(t, report, "owned by no inode")
+	// the diff shows what the operation changed
+	require.Contains(t, report, `+ inode 2: type=0 size=5`)
+	require.True(t, strings.Contains(report, "- inode 0:") && strings.Contains(report, "+ inode 0:"))
+
+	filesystem.SetInvariantChecks(InvariantsPanic, nil)
+	require.Panics(t, func() {
+		_, _ = filesystem.OpenFile("/baz", O_RDWR|O_CREATE, 0600)
+	})
+}
+
+func TestLineDiff(t *testing.T) {
+	require.Equal(t, "  a\n- b\n+ x\n  c\n+ d\n", lineDiff([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"}))
+	require.Equal(t, "", lineDiff(nil, nil))
+}
@@ -0,0 +1,239 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"sort"
+)
+
+// FS is a read-only view of a filesystem implementing io/fs.FS, along with
+// io/fs.ReadDirFS, io/fs.ReadFileFS and io/fs.StatFS, so images can be used
+// with fs.WalkDir, http.FS, template.ParseFS and the like. Names are
+// relative to the root and slash-separated, as io/fs expects: "." is the
+// root and "dir/file" is /dir/file. Files open with O_RDONLY.
+type FS struct {
+	fs *FileSystem
+}
+
+var (
+	_ iofs.ReadDirFS  = FS{}
+	_ iofs.ReadFileFS = FS{}
+	_ iofs.StatFS     = FS{}
+)
+
+// FS returns an io/fs view of the filesystem.
+func (fs *FileSystem) FS() FS {
+	return FS{fs: fs}
+}
+
+// absolute converts an io/fs name to an absolute one.
+func (fsys FS) absolute(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return "/" + name, nil
+}
+
+// Open opens the named file or directory for reading. Files are *File,
+// and directories implement io/fs.ReadDirFile.
+func (fsys FS) Open(name string) (iofs.File, error) {
+	filename, err := fsys.absolute("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirFile{fsys: fsys, name: name, info: info}, nil
+	}
+	f, err := fsys.fs.Open(filename, O_RDONLY)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// Stat describes the named file or directory; the FileInfo is a FileInfo.
+func (fsys FS) Stat(name string) (iofs.FileInfo, error) {
+	return fsys.stat("stat", name)
+}
+
+// stat is Stat, reporting errors as coming from op.
+func (fsys FS) stat(op, name string) (iofs.FileInfo, error) {
+	filename, err := fsys.absolute(op, name)
+	if err != nil {
+		return nil, err
+	}
+	fs := fsys.fs
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(filename)
+	if err != nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+	return fs.fileInfo(iofsBase(name), inode), nil
+}
+
+// ReadDir lists the named directory, sorted by name.
+func (fsys FS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	filename, err := fsys.absolute("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	fs := fsys.fs
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findInodeOrRoot(filename)
+	if err == nil && dir.Type != InodeTypeDirectory {
+		err = ErrNotDirectory
+	}
+	var entries []DirEntry
+	// the sizes are left to Info, so only the directory is read
+	if err == nil {
+		entries, err = fs.listDir(dir)
+	}
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	list := make([]iofs.DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = dirEntry{fsys: fsys, dir: name, entry: entry}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// ReadFile returns the contents of the named file.
+func (fsys FS) ReadFile(name string) ([]byte, error) {
+	filename, err := fsys.absolute("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	fs := fsys.fs
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(filename)
+	if err == nil && inode.Type != InodeTypeFile {
+		err = ErrIsDirectory
+	}
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	lock := fs.inodeLock(int(inode.Index))
+	lock.RLock()
+	defer lock.RUnlock()
+	contents, err := fs.readContents(inode)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	fs.noteAccess(int(inode.Index))
+	return contents.Bytes(), nil
+}
+
+// iofsBase returns the last element of an io/fs name.
+func iofsBase(name string) string {
+	if name == "." {
+		return name
+	}
+	return baseName("/" + name)
+}
+
+// iofsJoin joins an io/fs directory name and the name of an entry in it.
+func iofsJoin(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// dirEntry implements io/fs.DirEntry.
+type dirEntry struct {
+	fsys  FS
+	dir   string
+	entry DirEntry
+}
+
+func (d dirEntry) Name() string {
+	return d.entry.Name
+}
+
+func (d dirEntry) IsDir() bool {
+	return d.entry.Type == InodeTypeDirectory
+}
+
+func (d dirEntry) Type() iofs.FileMode {
+	if d.IsDir() {
+		return iofs.ModeDir
+	}
+	return 0
+}
+
+func (d dirEntry) Info() (iofs.FileInfo, error) {
+	return d.fsys.Stat(iofsJoin(d.dir, d.entry.Name))
+}
+
+// dirFile is a directory opened by FS.Open. It lists the directory on the
+// first call to ReadDir.
+type dirFile struct {
+	fsys    FS
+	name    string
+	info    iofs.FileInfo
+	entries []iofs.DirEntry
+	// read is set once entries is filled
+	read   bool
+	closed bool
+}
+
+func (d *dirFile) Stat() (iofs.FileInfo, error) {
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.name, Err: ErrIsDirectory}
+}
+
+// ReadDir returns the next n entries, or all the remaining ones if n <= 0,
+// as described by io/fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *dirFile) Close() error {
+	if d.closed {
+		return ErrClosed
+	}
+	d.closed = true
+	return nil
+}
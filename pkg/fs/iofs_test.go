@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/hello.txt", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.NoError(t, filesystem.Mkdir("/dir/empty"))
+	_, err = filesystem.CreateFile("/dir/b", bytes.NewBufferString("b"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/dir/a", bytes.NewBuffer(bytes.Repeat([]byte{'a'}, 2*BlockSize)))
+	require.NoError(t, err)
+
+	fsys := filesystem.FS()
+	require.NoError(t, fstest.TestFS(fsys, "hello.txt", "dir/a", "dir/b", "dir/empty"))
+
+	names := []string{}
+	err = iofs.WalkDir(fsys, ".", func(name string, d iofs.DirEntry, err error) error {
+		names = append(names, name)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{".", "dir", "dir/a", "dir/b", "dir/empty", "hello.txt"}, names)
+
+	_, err = fsys.Open("missing")
+	require.ErrorIs(t, err, iofs.ErrNotExist)
+	_, err = fsys.Open("/hello.txt")
+	require.ErrorIs(t, err, iofs.ErrInvalid)
+	_, err = fsys.ReadFile("dir")
+	require.ErrorIs(t, err, ErrIsDirectory)
+
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/hello.txt")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body := &bytes.Buffer{}
+	_, err = body.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello", body.String())
+}
@@ -0,0 +1,342 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// Filesystems formatted with a journal, see MkfsOptions.JournalBlocks, log
+// their metadata changes before making them in place. The metadata blocks an
+// operation writes, meaning the bitmaps, the inode table, pointer blocks and
+// the contents of directories, are held in memory as a transaction until the
+// operation is over, and reads see them there. Then the transaction is
+// committed:
+//  1. a descriptor block listing where the blocks go, and a copy of each
+//     block, are written to the journal, and the device is synced
+//  2. a commit block with a checksum of the above is written after them, and
+//     the device is synced again; from here on the operation survives a crash
+//  3. the blocks are written in place, the device is synced, and the
+//     descriptor is cleared
+//
+// Mounting replays a transaction that was committed, as it may not have been
+// written in place yet; one that wasn't committed is ignored, as nothing was
+// written in place for it. Either way the metadata is left as it was between
+// two operations, so a filesystem that wasn't closed cleanly mounts without
+// RecoveryForce. An operation that fails drops its transaction, so nothing it
+// did to the metadata reaches the device.
+//
+// File data isn't logged: it is written in place as the operation runs, so
+// after a crash, blocks an uncommitted operation wrote to are free again but
+// keep what it wrote. The superblock isn't logged either.
+//
+// If a commit fails, the journal is aborted: later changes fail, and Close
+// leaves the filesystem marked dirty, so the next mount replays what was
+// committed.
+//
+// The descriptor block, in the first block of the journal, is laid out as
+// (little endian):
+//
+//	offset 0: magic        (uint32, "JRNL")
+//	offset 4: block count  (uint32)
+//	offset 8: the blocks the copies go to, in order (uint32 each)
+//
+// The copies follow it, and the commit block follows them:
+//
+//	offset 0: magic        (uint32, "CMIT")
+//	offset 4: block count  (uint32)
+//	offset 8: CRC-32 (IEEE) of the descriptor and the copies (uint32)
+
+// ErrJournalFull is returned by operations that change more metadata blocks
+// than the journal holds. The operation is rolled back.
+var ErrJournalFull = errors.New("too many changes for the journal")
+
+// MinJournalBlocks is the size of the smallest journal, which holds a single
+// block: the descriptor, the copy and the commit block.
+const MinJournalBlocks = 3
+
+const (
+	journalMagic = 0x4a524e4c
+	commitMagic  = 0x434d4954
+)
+
+// journal is the transaction of the running operation.
+type journal struct {
+	// start is the first block of the journal
+	start uint64
+	// capacity is the number of blocks a transaction holds
+	capacity int
+	// blocks holds the new contents of the metadata blocks written since
+	// the last commit, by block number
+	blocks map[uint64][]byte
+	// err is why a commit failed, aborting the journal, or nil
+	err error
+}
+
+// newJournal returns the journal of a filesystem with geometry g, or nil if
+// it has none.
+func newJournal(g Geometry) *journal {
+	if g.JournalBlocks == 0 {
+		return nil
+	}
+	// the descriptor must fit the block numbers too
+	capacity := int(g.JournalBlocks) - 2
+	if limit := (BlockSize - 8) / 4; capacity > limit {
+		capacity = limit
+	}
+	return &journal{
+		start:    uint64(g.JournalStart),
+		capacity: capacity,
+		blocks:   map[uint64][]byte{},
+	}
+}
+
+// read copies the block from the transaction into buf, if the transaction
+// has it.
+func (j *journal) read(blockNum uint64, buf []byte) bool {
+	if j == nil {
+		return false
+	}
+	block, ok := j.blocks[blockNum]
+	if ok {
+		copy(buf, block)
+	}
+	return ok
+}
+
+// holdsAny reports whether the transaction holds any of the n blocks from
+// blockNum on.
+func (j *journal) holdsAny(blockNum, n uint64) bool {
+	if j == nil {
+		return false
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, ok := j.blocks[blockNum+i]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted returns the blocks of the transaction in ascending order.
+func (j *journal) sorted() []uint64 {
+	blockNums := make([]uint64, 0, len(j.blocks))
+	for blockNum := range j.blocks {
+		blockNums = append(blockNums, blockNum)
+	}
+	sort.Slice(blockNums, func(i, k int) bool { return blockNums[i] < blockNums[k] })
+	return blockNums
+}
+
+// writeMetadata writes a metadata block, into the transaction if there is a
+// journal, and updates its checksum if the filesystem has checksums. In the
+// transaction, the rest of the block past a short buf is zeroed.
+func (fs *FileSystem) writeMetadata(blockNum uint64, buf []byte) error {
+	if fs.checksums != nil {
+		return fs.writeChecksummed(blockNum, buf)
+	}
+	return fs.logBlock(blockNum, buf)
+}
+
+// logBlock is writeMetadata without the checksum.
+func (fs *FileSystem) logBlock(blockNum uint64, buf []byte) error {
+	j := fs.journal
+	if j == nil {
+		return fs.writeBlock(blockNum, buf)
+	}
+	if j.err != nil {
+		return fmt.Errorf("error writing block %d, the journal was aborted: %w", blockNum, j.err)
+	}
+	block, ok := j.blocks[blockNum]
+	if !ok {
+		if len(j.blocks) >= j.capacity {
+			return fmt.Errorf("error logging block %d, past the %d blocks the journal holds: %w", blockNum, j.capacity, ErrJournalFull)
+		}
+		block = make([]byte, BlockSize)
+		j.blocks[blockNum] = block
+	}
+	if fs.explain != nil {
+		fs.explainf("log block %d (%s) in the transaction", blockNum, fs.describeBlock(blockNum))
+	}
+	n := copy(block, buf)
+	for i := n; i < len(block); i++ {
+		block[i] = 0
+	}
+	return nil
+}
+
+// revoke drops a block about to be written as file data from the
+// transaction, so the commit doesn't overwrite the data with what the block
+// held earlier in the operation, such as the contents of a directory that
+// gave it up.
+func (fs *FileSystem) revoke(blockNum uint64) {
+	if j := fs.journal; j != nil {
+		if _, ok := j.blocks[blockNum]; ok {
+			delete(j.blocks, blockNum)
+		}
+	}
+}
+
+// journalAborted reports whether a commit failed; see journal.
+func (fs *FileSystem) journalAborted() bool {
+	return fs.journal != nil && fs.journal.err != nil
+}
+
+// commit ends the transaction of an operation. Operations defer it right
+// after taking fs.mu for writing, with a pointer to the error they return,
+// which is set if the commit fails and it isn't set already.
+func (fs *FileSystem) commit(errp *error) {
+	j := fs.journal
+	if j == nil || j.err != nil || len(j.blocks) == 0 {
+		return
+	}
+	err := fs.commitTransaction()
+	if err != nil {
+		j.err = err
+		if *errp == nil {
+			*errp = err
+		}
+	}
+}
+
+// commitTransaction writes the transaction to the journal and then in
+// place.
+func (fs *FileSystem) commitTransaction() error {
+	j := fs.journal
+	blockNums := j.sorted()
+	fs.explainf("journal: commit %d blocks", len(blockNums))
+
+	descriptor := make([]byte, BlockSize)
+	binary.LittleEndian.PutUint32(descriptor[0:4], journalMagic)
+	binary.LittleEndian.PutUint32(descriptor[4:8], uint32(len(blockNums)))
+	for i, blockNum := range blockNums {
+		binary.LittleEndian.PutUint32(descriptor[8+4*i:], uint32(blockNum))
+	}
+	sum := crc32.NewIEEE()
+	sum.Write(descriptor)
+	// the descriptor and the logged blocks are a run
+	logged := [][]byte{descriptor}
+	for _, blockNum := range blockNums {
+		sum.Write(j.blocks[blockNum])
+		logged = append(logged, j.blocks[blockNum])
+	}
+	err := fs.writeBlocks(j.start, logged)
+	if err != nil {
+		return fmt.Errorf("error logging %d blocks: %w", len(blockNums), err)
+	}
+	err = fs.syncDevice()
+	if err != nil {
+		return fmt.Errorf("error syncing the journal: %w", err)
+	}
+
+	commit := make([]byte, BlockSize)
+	binary.LittleEndian.PutUint32(commit[0:4], commitMagic)
+	binary.LittleEndian.PutUint32(commit[4:8], uint32(len(blockNums)))
+	binary.LittleEndian.PutUint32(commit[8:12], sum.Sum32())
+	err = fs.writeBlock(j.start+1+uint64(len(blockNums)), commit)
+	if err == nil {
+		err = fs.syncDevice()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing the journal commit block: %w", err)
+	}
+	return fs.checkpoint()
+}
+
+// checkpoint writes the blocks of a committed transaction in place and
+// clears the journal.
+func (fs *FileSystem) checkpoint() error {
+	j := fs.journal
+	blockNums := j.sorted()
+	fs.explainf("journal: write %d blocks in place", len(blockNums))
+	for i := 0; i < len(blockNums); {
+		run := [][]byte{j.blocks[blockNums[i]]}
+		for i+len(run) < len(blockNums) && blockNums[i+len(run)] == blockNums[i]+uint64(len(run)) {
+			run = append(run, j.blocks[blockNums[i+len(run)]])
+		}
+		err := fs.writeBlocks(blockNums[i], run)
+		if err != nil {
+			return fmt.Errorf("error checkpointing blocks %d to %d: %w", blockNums[i], blockNums[i]+uint64(len(run))-1, err)
+		}
+		i += len(run)
+	}
+	err := fs.syncDevice()
+	if err != nil {
+		return fmt.Errorf("error syncing the checkpoint: %w", err)
+	}
+	// if clearing the descriptor doesn't reach the device, the next
+	// mount replays the transaction again, which changes nothing
+	err = fs.writeBlock(j.start, make([]byte, BlockSize))
+	if err != nil {
+		return fmt.Errorf("error clearing the journal: %w", err)
+	}
+	j.blocks = map[uint64][]byte{}
+	return nil
+}
+
+// dropTransaction forgets the blocks written since the last commit, after
+// the operation that wrote them failed. The checksum table is read again,
+// as the checksums of the dropped blocks went with them.
+func (fs *FileSystem) dropTransaction() error {
+	fs.explainf("journal: drop the transaction")
+	fs.journal.blocks = map[uint64][]byte{}
+	if c := fs.checksums; c != nil {
+		return fs.readChecksums(c.verify)
+	}
+	return nil
+}
+
+// loadJournal reads the transaction committed to the journal, if there is
+// one, into the journal, so the filesystem reads as if it was written in
+// place; checkpoint writes it there. It returns the number of blocks. A
+// transaction without a valid commit block wasn't committed, and is
+// ignored.
+func (fs *FileSystem) loadJournal() (int, error) {
+	j := fs.journal
+	if j == nil {
+		return 0, nil
+	}
+	descriptor := make([]byte, BlockSize)
+	err := fs.dev.ReadBlock(j.start, descriptor)
+	if err != nil {
+		return 0, fmt.Errorf("error reading the journal descriptor: %w", err)
+	}
+	n := int(binary.LittleEndian.Uint32(descriptor[4:8]))
+	if binary.LittleEndian.Uint32(descriptor[0:4]) != journalMagic || n == 0 || n > j.capacity {
+		return 0, nil
+	}
+
+	sum := crc32.NewIEEE()
+	sum.Write(descriptor)
+	blocks := map[uint64][]byte{}
+	for i := 0; i < n; i++ {
+		block := make([]byte, BlockSize)
+		err = fs.dev.ReadBlock(j.start+1+uint64(i), block)
+		if err != nil {
+			return 0, fmt.Errorf("error reading block %d of the journal: %w", i+1, err)
+		}
+		sum.Write(block)
+		blocks[uint64(binary.LittleEndian.Uint32(descriptor[8+4*i:]))] = block
+	}
+	commit := make([]byte, BlockSize)
+	err = fs.dev.ReadBlock(j.start+1+uint64(n), commit)
+	if err != nil {
+		return 0, fmt.Errorf("error reading the journal commit block: %w", err)
+	}
+	if binary.LittleEndian.Uint32(commit[0:4]) != commitMagic ||
+		binary.LittleEndian.Uint32(commit[4:8]) != uint32(n) ||
+		binary.LittleEndian.Uint32(commit[8:12]) != sum.Sum32() {
+		return 0, nil
+	}
+
+	// the checksum matches, so these are as written
+	for blockNum := range blocks {
+		if blockNum < uint64(fs.geometry.metadataStart()) || blockNum >= uint64(fs.geometry.BlockCount) {
+			return 0, corruptf("the journal logs block %d, which doesn't hold metadata", blockNum)
+		}
+	}
+	j.blocks = blocks
+	return len(blocks), nil
+}
@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newJournaledFileSystem creates a filesystem of 200 blocks with a journal
+// on dev, holding /foo and the directory /dir.
+func newJournaledFileSystem(t *testing.T, dev BlockDevice) *FileSystem {
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 200, JournalBlocks: 32})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	return filesystem
+}
+
+func TestJournalGeometry(t *testing.T) {
+	g, err := MkfsOptions{Blocks: 200, JournalBlocks: 32}.geometry()
+	require.NoError(t, err)
+	require.Equal(t, Geometry{
+		BlockSize: 4096, BlockCount: 200, InodeCount: 56,
+		InodeBitmapStart: 33, DataBitmapStart: 34, InodeTableStart: 35, DataStart: 42,
+		JournalStart: 1, JournalBlocks: 32,
+		PackedBitmaps: true,
+	}, g)
+
+	_, err = MkfsOptions{Blocks: 200, JournalBlocks: MinJournalBlocks - 1}.geometry()
+	require.ErrorIs(t, err, ErrGeometry)
+	g.InodeBitmapStart = 32
+	require.ErrorContains(t, g.check(), "the journal doesn't fit before the inode bitmap")
+
+	// the geometry is recorded in the superblock
+	disk := make([]byte, 200*BlockSize)
+	filesystem := newJournaledFileSystem(t, NewArrayBlockDevice(disk))
+	require.NoError(t, filesystem.Close())
+	sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, uint32(32), sb.Geometry.JournalBlocks)
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Equal(t, BlockKindJournal, layout[1].Kind)
+	require.Equal(t, BlockKindJournal, layout[32].Kind)
+	require.Equal(t, BlockKindInodeBitmap, layout[33].Kind)
+}
+
+func TestJournalCrash(t *testing.T) {
+	ops := map[string]func(*FileSystem) error{
+		"create": func(fs *FileSystem) error {
+			_, err := fs.CreateFile("/dir/bar", bytes.NewBuffer(bytes.Repeat([]byte{'b'}, 2*BlockSize)))
+			return err
+		},
+		"rename": func(fs *FileSystem) error {
+			return fs.Rename("/foo", "/dir/foo")
+		},
+		"delete": func(fs *FileSystem) error {
+			return fs.DeleteFile("/foo")
+		},
+	}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			// the metadata of the filesystem before and after the op
+			states := func() []string {
+				disk := make([]byte, 200*BlockSize)
+				filesystem := newJournaledFileSystem(t, NewArrayBlockDevice(disk))
+				before := dumpTree(t, filesystem)
+				require.NoError(t, op(filesystem))
+				return []string{before, dumpTree(t, filesystem)}
+			}()
+
+			replayed := false
+			for failAt := 1; ; failAt++ {
+				disk := make([]byte, 200*BlockSize)
+				dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+				filesystem := newJournaledFileSystem(t, dev)
+
+				// crash at the failAt-th write of the op: no write after it
+				// reaches the device
+				dev.writes = 0
+				dev.failWriteAt = failAt
+				dev.sticky = true
+				err := op(filesystem)
+				if err == nil {
+					break
+				}
+
+				for _, f := range Diagnose(NewArrayBlockDevice(bytes.Clone(disk))) {
+					require.Equal(t, SeverityInfo, f.Severity, "crash at write %d: %s", failAt, f.Message)
+					replayed = replayed || f.Check == "journal"
+				}
+				reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+				require.NoError(t, err, "crash at write %d", failAt)
+				require.Contains(t, states, dumpTree(t, reloaded), "crash at write %d", failAt)
+				require.NoError(t, reloaded.CheckInvariants())
+				require.NoError(t, reloaded.Close())
+
+				// the replayed transaction was checkpointed
+				for _, f := range Diagnose(NewArrayBlockDevice(disk)) {
+					require.NotEqual(t, "journal", f.Check, f.Message)
+				}
+			}
+			require.True(t, replayed, "no crash left a transaction to replay")
+		})
+	}
+}
+
+// dumpTree describes every file and directory of the filesystem, with the
+// contents of the files.
+func dumpTree(t *testing.T, filesystem *FileSystem) string {
+	dump := &bytes.Buffer{}
+	err := filesystem.Walk("/", func(name string, entry DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dump.WriteString(name)
+		if entry.Type == InodeTypeFile {
+			contents, err := filesystem.ReadFileContents(int(entry.Inode))
+			if err != nil {
+				return err
+			}
+			dump.WriteString(" " + contents.String())
+		}
+		dump.WriteString("\n")
+		return nil
+	})
+	require.NoError(t, err)
+	return dump.String()
+}
+
+func TestJournalFull(t *testing.T) {
+	disk := make([]byte, 200*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 200, JournalBlocks: MinJournalBlocks})
+	require.NoError(t, err)
+
+	// the inode table, the bitmaps and the root directory don't fit
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.ErrorIs(t, err, ErrJournalFull)
+	entries, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.False(t, reloaded.inodeBitmap.test(1))
+	for _, f := range Diagnose(dev) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
+
+func TestJournalAborted(t *testing.T) {
+	disk := make([]byte, 200*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem := newJournaledFileSystem(t, dev)
+
+	// fail writing the descriptor of the commit
+	dev.writes = 0
+	dev.failWriteAt = 1
+	err := filesystem.DeleteFile("/foo")
+	require.ErrorIs(t, err, errInjected)
+	dev.failWriteAt = 0
+
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.ErrorIs(t, err, errInjected)
+	require.ErrorIs(t, filesystem.Close(), errInjected)
+
+	// the delete never reached the device
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, err = reloaded.FindInodeByName("/foo")
+	require.NoError(t, err)
+}
@@ -0,0 +1,294 @@
+package fs
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// BlockKind says what a device block is used for.
+type BlockKind int
+
+const (
+	BlockKindSuperblock BlockKind = iota
+	BlockKindInodeBitmap
+	BlockKindDataBitmap
+	BlockKindInodeTable
+	// BlockKindData blocks hold the contents of a file or directory.
+	BlockKindData
+	// BlockKindFree blocks are available for allocation.
+	BlockKindFree
+	// BlockKindLeaked blocks are marked used in the data bitmap, but no
+	// inode references them.
+	BlockKindLeaked
+	// BlockKindIndirect blocks hold pointers to the blocks of a big file.
+	BlockKindIndirect
+	// BlockKindJournal blocks hold the journal, see MkfsOptions.
+	BlockKindJournal
+	// BlockKindChecksums blocks hold the checksum table, see
+	// MkfsOptions.Checksums.
+	BlockKindChecksums
+	// BlockKindExtents blocks hold the extents of a file with many of them.
+	BlockKindExtents
+	// BlockKindXattrs blocks hold the extended attributes of an inode with
+	// too many to keep in the inode.
+	BlockKindXattrs
+	// BlockKindDedup blocks hold the dedup table, see MkfsOptions.Dedup.
+	BlockKindDedup
+	// BlockKindReserved is data block 0, which is always marked used, on
+	// filesystems whose inode table doesn't end in it.
+	BlockKindReserved
+)
+
+func (k BlockKind) String() string {
+	switch k {
+	case BlockKindSuperblock:
+		return "superblock"
+	case BlockKindInodeBitmap:
+		return "inode bitmap"
+	case BlockKindDataBitmap:
+		return "data bitmap"
+	case BlockKindInodeTable:
+		return "inode table"
+	case BlockKindData:
+		return "data"
+	case BlockKindFree:
+		return "free"
+	case BlockKindLeaked:
+		return "leaked"
+	case BlockKindIndirect:
+		return "indirect"
+	case BlockKindJournal:
+		return "journal"
+	case BlockKindChecksums:
+		return "checksums"
+	case BlockKindExtents:
+		return "extents"
+	case BlockKindXattrs:
+		return "xattrs"
+	case BlockKindDedup:
+		return "dedup table"
+	case BlockKindReserved:
+		return "reserved"
+	}
+	return fmt.Sprintf("BlockKind(%d)", int(k))
+}
+
+// BlockInfo describes a single block of the device.
+type BlockInfo struct {
+	Index uint64
+	Kind  BlockKind
+	// Inode is the index of the inode owning a data or indirect block, or -1
+	// for blocks not owned by an inode.
+	Inode int
+}
+
+// Layout describes every block of the device, in block order. It fails if
+// the inode table or an indirect block can't be read.
+func (fs *FileSystem) Layout() ([]BlockInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.layout()
+}
+
+func (fs *FileSystem) layout() ([]BlockInfo, error) {
+	g := fs.geometry
+	nBlocks := int(g.BlockCount)
+	layout := make([]BlockInfo, nBlocks)
+	for i := range layout {
+		layout[i] = BlockInfo{Index: uint64(i), Kind: fs.regionKind(uint32(i)), Inode: -1}
+	}
+
+	for i := 1; i < fs.dataBitmap.len(); i++ {
+		if fs.dataBitmap.test(i) {
+			layout[i+int(g.DataStart)].Kind = BlockKindLeaked
+		}
+	}
+
+	err := fs.forEachInode(func(_ int, inode *Inode) error {
+		blocks, err := fs.readBlockMap(inode)
+		if err != nil {
+			return err
+		}
+		mark := func(blockIndex uint32, kind BlockKind) {
+			if int(blockIndex) < nBlocks {
+				layout[blockIndex].Kind = kind
+				layout[blockIndex].Inode = int(inode.Index)
+			}
+		}
+		for _, blockIndex := range blocks.data {
+			mark(blockIndex, BlockKindData)
+		}
+		for _, blockIndex := range blocks.pointers() {
+			mark(blockIndex, BlockKindIndirect)
+		}
+		for _, blockIndex := range blocks.extentBlocks {
+			mark(blockIndex, BlockKindExtents)
+		}
+		if blocks.xattrs != 0 {
+			mark(blocks.xattrs, BlockKindXattrs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// regionKind says what a block holds by the region of the layout it is in;
+// blocks of the data region are all free.
+func (fs *FileSystem) regionKind(blockIndex uint32) BlockKind {
+	g := fs.geometry
+	switch {
+	case blockIndex == SuperblockIndex:
+		return BlockKindSuperblock
+	case g.JournalBlocks > 0 && blockIndex >= g.JournalStart && blockIndex < g.JournalStart+g.JournalBlocks:
+		return BlockKindJournal
+	case g.ChecksumBlocks > 0 && blockIndex >= g.ChecksumStart && blockIndex < g.ChecksumStart+g.ChecksumBlocks:
+		return BlockKindChecksums
+	case g.DedupBlocks > 0 && blockIndex >= g.DedupStart && blockIndex < g.DedupStart+g.DedupBlocks:
+		return BlockKindDedup
+	case blockIndex >= g.InodeBitmapStart && blockIndex < g.DataBitmapStart:
+		return BlockKindInodeBitmap
+	case blockIndex >= g.DataBitmapStart && blockIndex < g.InodeTableStart:
+		return BlockKindDataBitmap
+	case blockIndex >= g.InodeTableStart && blockIndex < g.InodeTableStart+g.inodeTableBlocks():
+		return BlockKindInodeTable
+	// data block 0, when the inode table doesn't spill over into it
+	case blockIndex == g.DataStart:
+		return BlockKindReserved
+	default:
+		return BlockKindFree
+	}
+}
+
+// layoutColumns is the number of blocks per row in the rendered layouts.
+const layoutColumns = 8
+
+// layoutColors maps the kinds of non-data blocks to fill colors.
+var layoutColors = map[BlockKind]string{
+	BlockKindSuperblock:  "#9e9e9e",
+	BlockKindInodeBitmap: "#bdbdbd",
+	BlockKindDataBitmap:  "#bdbdbd",
+	BlockKindInodeTable:  "#e0e0e0",
+	BlockKindJournal:     "#d7ccc8",
+	BlockKindFree:        "#ffffff",
+	BlockKindReserved:    "#e0e0e0",
+	BlockKindLeaked:      "#e53935",
+}
+
+// inodeColors are cycled through to color data blocks by owning inode.
+var inodeColors = []string{
+	"#64b5f6", "#81c784", "#ffb74d", "#ba68c8",
+	"#4dd0e1", "#fff176", "#a1887f", "#f06292",
+}
+
+func (b BlockInfo) color() string {
+	if b.Kind == BlockKindData || b.Kind == BlockKindIndirect || b.Kind == BlockKindExtents || b.Kind == BlockKindXattrs {
+		return inodeColors[b.Inode%len(inodeColors)]
+	}
+	return layoutColors[b.Kind]
+}
+
+func (b BlockInfo) label() string {
+	switch b.Kind {
+	case BlockKindData:
+		return fmt.Sprintf("inode %d", b.Inode)
+	case BlockKindIndirect:
+		return fmt.Sprintf("inode %d ptrs", b.Inode)
+	case BlockKindExtents:
+		return fmt.Sprintf("inode %d extents", b.Inode)
+	case BlockKindXattrs:
+		return fmt.Sprintf("inode %d xattrs", b.Inode)
+	}
+	return b.Kind.String()
+}
+
+// WriteLayoutDot renders the device layout as a Graphviz graph: a grid of
+// blocks, colored by what they hold, and one node per inode with edges to
+// the inode's blocks in file order.
+func (fs *FileSystem) WriteLayoutDot(w io.Writer) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	sb := &strings.Builder{}
+	sb.WriteString("digraph layout {\n")
+	sb.WriteString("\tnode [shape=plaintext fontname=\"monospace\"];\n")
+	sb.WriteString("\tdevice [label=<<table border=\"0\" cellborder=\"1\" cellspacing=\"0\">\n")
+
+	layout, err := fs.layout()
+	if err != nil {
+		return err
+	}
+	for i, b := range layout {
+		if i%layoutColumns == 0 {
+			sb.WriteString("\t\t<tr>")
+		}
+		fmt.Fprintf(sb, "<td port=\"b%d\" bgcolor=\"%s\">%d<br/>%s</td>", b.Index, b.color(), b.Index, b.label())
+		if i%layoutColumns == layoutColumns-1 || i == len(layout)-1 {
+			sb.WriteString("</tr>\n")
+		}
+	}
+	sb.WriteString("\t</table>>];\n")
+
+	err = fs.forEachInode(func(_ int, inode *Inode) error {
+		fmt.Fprintf(sb, "\tinode%d [shape=box style=filled fillcolor=\"%s\" label=\"inode %d\\n%s\\n%d bytes\"];\n",
+			inode.Index, inodeColors[int(inode.Index)%len(inodeColors)], inode.Index,
+			strings.ReplaceAll(inode.Filename, "\"", "\\\""), inode.Size)
+		blocks, err := fs.fileBlocks(inode)
+		if err != nil {
+			return err
+		}
+		for i, blockIndex := range blocks {
+			fmt.Fprintf(sb, "\tinode%d -> device:b%d [label=\"%d\"];\n", inode.Index, blockIndex, i)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sb.WriteString("}\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteLayoutSVG renders the device layout as an SVG image: a grid of
+// blocks, colored by what they hold and labeled with their index and owner.
+func (fs *FileSystem) WriteLayoutSVG(w io.Writer) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	const (
+		cellWidth  = 90
+		cellHeight = 40
+		margin     = 10
+	)
+
+	layout, err := fs.layout()
+	if err != nil {
+		return err
+	}
+	rows := (len(layout) + layoutColumns - 1) / layoutColumns
+	width := 2*margin + layoutColumns*cellWidth
+	height := 2*margin + rows*cellHeight
+
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\" font-size=\"11\">\n", width, height)
+	for i, b := range layout {
+		x := margin + (i%layoutColumns)*cellWidth
+		y := margin + (i/layoutColumns)*cellHeight
+		fmt.Fprintf(sb, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\" stroke=\"#424242\"/>\n",
+			x, y, cellWidth, cellHeight, b.color())
+		fmt.Fprintf(sb, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%d</text>\n",
+			x+cellWidth/2, y+cellHeight/2-3, b.Index)
+		fmt.Fprintf(sb, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%s</text>\n",
+			x+cellWidth/2, y+cellHeight/2+11, html.EscapeString(b.label()))
+	}
+	sb.WriteString("</svg>\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
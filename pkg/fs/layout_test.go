@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, BlockSize+1)))
+	require.NoError(t, err)
+
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Len(t, layout, DataStartIndex+32)
+	require.Equal(t, BlockKindSuperblock, layout[SuperblockIndex].Kind)
+	require.Equal(t, BlockKindInodeBitmap, layout[InodeBitmapIndex].Kind)
+	require.Equal(t, BlockKindDataBitmap, layout[DataBitmapIndex].Kind)
+	require.Equal(t, BlockKindInodeTable, layout[DataStartIndex].Kind)
+
+	// the file's blocks belong to it
+	for _, blockIndex := range inode.usedBlocks() {
+		require.Equal(t, BlockKindData, layout[blockIndex].Kind)
+		require.Equal(t, int(inode.Index), layout[blockIndex].Inode)
+	}
+	// so does the root directory's block
+	root, err := filesystem.GetInode(0)
+	require.NoError(t, err)
+	require.Equal(t, 0, layout[root.Blocks[0]].Inode)
+
+	require.Equal(t, BlockKindFree, layout[len(layout)-1].Kind)
+	require.Equal(t, -1, layout[len(layout)-1].Inode)
+}
+
+func TestWriteLayout(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello world"))
+	require.NoError(t, err)
+
+	dot := &bytes.Buffer{}
+	require.NoError(t, filesystem.WriteLayoutDot(dot))
+	require.Contains(t, dot.String(), "digraph layout {")
+	require.Contains(t, dot.String(), "inode1 -> device:b")
+	require.Contains(t, dot.String(), "foo")
+
+	svg := &bytes.Buffer{}
+	require.NoError(t, filesystem.WriteLayoutSVG(svg))
+
+	// the SVG must be well-formed XML
+	dec := xml.NewDecoder(svg)
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint32(1), inode.Index)
+}
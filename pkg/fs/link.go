@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Link adds newPath as another name of the file existingPath, both absolute,
+// like a hard link: the names share one inode, and its blocks are only freed
+// when the last of them is deleted. It fails with ErrExist if newPath is
+// taken, and with ErrCrossQuota if its directory is charged to another quota
+// directory than the file, see SetQuota. Directories can't be linked.
+func (fs *FileSystem) Link(existingPath, newPath string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Link %s -> %s", newPath, existingPath)
+	defer fs.checkInvariantsAfter("Link")()
+	return fs.link(existingPath, newPath)
+}
+
+// link is Link, for callers holding fs.mu.
+func (fs *FileSystem) link(existingPath, newPath string) (err error) {
+	inode, err := fs.findFile(existingPath)
+	if err != nil {
+		return fmt.Errorf("error linking %s: %w", existingPath, err)
+	}
+	newParent, err := fs.findParent(newPath)
+	if err != nil {
+		return fmt.Errorf("error linking %s to %s: %w", newPath, existingPath, err)
+	}
+	if newParent.Type != InodeTypeDirectory {
+		return fmt.Errorf("error linking %s to %s: parent: %w", newPath, existingPath, ErrNotDirectory)
+	}
+	err = fs.checkAccess(newParent, accessWrite)
+	if err != nil {
+		return fmt.Errorf("error linking %s to %s: %w", newPath, existingPath, err)
+	}
+	newName := baseName(newPath)
+	err = checkName(newName)
+	if err != nil {
+		return fmt.Errorf("error linking %s: %w", newPath, err)
+	}
+	_, err = fs.lookup(int(newParent.Index), newName)
+	if err == nil {
+		return fmt.Errorf("error linking %s: %w", newPath, ErrExist)
+	}
+	if !errors.Is(err, ErrNotExist) {
+		return err
+	}
+	err = checkQuotaOwners(inode.quotaDir, inode.inQuota, newParent)
+	if err != nil {
+		return fmt.Errorf("error linking %s to %s: %w", newPath, existingPath, err)
+	}
+
+	snapshot := fs.snapshot(int(inode.Index), int(newParent.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	err = fs.addEntry(int(newParent.Index), newName, int(inode.Index))
+	if err != nil {
+		return fmt.Errorf("error adding %s to its directory: %w", newPath, err)
+	}
+	inode.Links = inode.links() + 1
+	inode.Changed = fs.now().Unix()
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	return nil
+}
+
+// links returns the link count of the inode. Inodes that predate link
+// counts are in a single directory.
+func (inode *Inode) links() uint32 {
+	if inode.Links == 0 {
+		return 1
+	}
+	return inode.Links
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLink(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBuffer(bytes.Repeat([]byte{'f'}, 2*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.NoError(t, filesystem.Link("/foo", "/dir/bar"))
+	free := len(filesystem.freeBlocks.lowest(filesystem.dataBitmap.len()))
+	bar, err := filesystem.FindInodeByName("/dir/bar")
+	require.NoError(t, err)
+	require.Equal(t, foo.Index, bar.Index)
+	info, err := filesystem.Stat("/foo")
+	require.NoError(t, err)
+	require.Equal(t, 2, info.Links())
+
+	// writes through one name show through the other
+	require.NoError(t, filesystem.WriteAt("/dir/bar", []byte("b"), 0))
+	contents, err := filesystem.ReadFileContents(int(foo.Index))
+	require.NoError(t, err)
+	require.Equal(t, byte('b'), contents.Bytes()[0])
+
+	require.ErrorIs(t, filesystem.Link("/foo", "/dir/bar"), ErrExist)
+	require.ErrorIs(t, filesystem.Link("/missing", "/baz"), ErrNotExist)
+	require.ErrorIs(t, filesystem.Link("/dir", "/dir2"), ErrIsDirectory)
+	require.ErrorIs(t, filesystem.Link("/foo", "/missing/baz"), ErrNotExist)
+
+	// the blocks are freed with the last name
+	require.NoError(t, filesystem.DeleteFile("/foo"))
+	require.Len(t, filesystem.freeBlocks.lowest(filesystem.dataBitmap.len()), free)
+	info, err = filesystem.Stat("/dir/bar")
+	require.NoError(t, err)
+	require.Equal(t, 1, info.Links())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, reloaded.CheckInvariants())
+	require.NoError(t, reloaded.Link("/dir/bar", "/again"))
+	require.NoError(t, reloaded.DeleteFile("/dir/bar"))
+	require.NoError(t, reloaded.DeleteFile("/again"))
+	// the file's two blocks, and the block of the emptied /dir
+	require.Len(t, reloaded.freeBlocks.lowest(reloaded.dataBitmap.len()), free+3)
+	require.NoError(t, reloaded.Close())
+	for _, f := range Diagnose(dev) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
+
+func TestFsckLinkCount(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Link("/foo", "/bar"))
+	foo.Links = 5
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.NoError(t, filesystem.Close())
+
+	report, err := Fsck(dev, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"inode 1: corrected its link count from 5 to 2"}, report.Repairs)
+	require.Empty(t, report.Remaining)
+}
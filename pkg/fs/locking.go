@@ -0,0 +1,35 @@
+package fs
+
+import "sync"
+
+// A FileSystem can be used from several goroutines at once. Its metadata,
+// meaning the bitmaps and their free-space indices, the loaded inodes and
+// the superblock state, is guarded by fs.mu:
+//   - operations that may change metadata, such as creating, deleting,
+//     renaming or growing files, hold it for writing and run one at a time
+//   - the others, such as lookups, listings and reads, hold it for reading
+//     and run concurrently
+//
+// Public methods take fs.mu and unexported ones expect it taken, which is
+// why some public methods are wrappers around an unexported twin that the
+// rest of the package calls instead.
+//
+// File data is ordered by a lock per inode, taken while holding fs.mu for
+// reading: reads of a file hold it for reading, and writes that overwrite a
+// file in place, changing no metadata, hold it for writing. So reads never
+// wait for each other, in-place writes to different files don't either, and
+// a read never sees half of an in-place write.
+//
+// The inode cache, the times recorded by reads and explain mode have mutexes
+// of their own, as readers update them too.
+
+// inodeLockCount is the number of inode locks. Inodes share them by index,
+// which keeps the locks of a filesystem from growing with its inode table;
+// two inodes sharing a lock only wait for each other when one of them is
+// being overwritten in place.
+const inodeLockCount = 64
+
+// inodeLock returns the lock ordering the data of an inode.
+func (fs *FileSystem) inodeLock(inodeIndex int) *sync.RWMutex {
+	return &fs.inodeLocks[uint(inodeIndex)%inodeLockCount]
+}
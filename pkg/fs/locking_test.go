@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentUse(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 400})
+	require.NoError(t, err)
+	const nFiles, size = 4, 3 * BlockSize
+	for i := 0; i < nFiles; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBuffer(bytes.Repeat([]byte{'a'}, size)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.Mkdir("/tmp"))
+
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	for i := 0; i < nFiles; i++ {
+		name := fmt.Sprintf("/f%d", i)
+		// overwrite the whole file in place, through WriteAt and a File
+		run(func() {
+			for j := 0; j < 50; j++ {
+				require.NoError(t, filesystem.WriteAt(name, bytes.Repeat([]byte{'a' + byte(j%26)}, size), 0))
+			}
+		})
+		run(func() {
+			f, err := filesystem.Open(name, O_WRONLY)
+			require.NoError(t, err)
+			defer f.Close()
+			for j := 0; j < 50; j++ {
+				_, err = f.Seek(0, io.SeekStart)
+				require.NoError(t, err)
+				_, err = f.Write(bytes.Repeat([]byte{'A' + byte(j%26)}, size))
+				require.NoError(t, err)
+			}
+		})
+		// reads never see half of a write
+		run(func() {
+			inode, err := filesystem.FindInodeByName(name)
+			require.NoError(t, err)
+			for j := 0; j < 50; j++ {
+				contents, err := filesystem.ReadFileContents(int(inode.Index))
+				require.NoError(t, err)
+				require.Len(t, contents.Bytes(), size)
+				require.Equal(t, size, bytes.Count(contents.Bytes(), contents.Bytes()[:1]), "torn read of %s", name)
+			}
+		})
+		run(func() {
+			f, err := filesystem.Open(name, O_RDONLY)
+			require.NoError(t, err)
+			defer f.Close()
+			buf := make([]byte, size)
+			for j := 0; j < 50; j++ {
+				_, err = f.Seek(0, io.SeekStart)
+				require.NoError(t, err)
+				n, err := f.Read(buf)
+				require.NoError(t, err)
+				require.Equal(t, size, n)
+				require.Equal(t, size, bytes.Count(buf, buf[:1]), "torn read of %s", name)
+			}
+		})
+	}
+	// metadata changes meanwhile
+	run(func() {
+		for j := 0; j < 20; j++ {
+			name := fmt.Sprintf("/tmp/t%d", j)
+			_, err := filesystem.CreateFile(name, bytes.NewBuffer(make([]byte, BlockSize+j)))
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Append(name, []byte("more")))
+			if j%2 == 0 {
+				require.NoError(t, filesystem.DeleteFile(name))
+			}
+		}
+	})
+	run(func() {
+		for j := 0; j < 20; j++ {
+			err := filesystem.Walk("/", func(name string, entry DirEntry, err error) error {
+				return err
+			})
+			require.NoError(t, err)
+			_, err = filesystem.Layout()
+			require.NoError(t, err)
+		}
+	})
+	wg.Wait()
+
+	require.NoError(t, filesystem.CheckInvariants())
+	entries, err := filesystem.ReadDir(int(mustFind(t, filesystem, "/tmp").Index))
+	require.NoError(t, err)
+	require.Len(t, entries, 10)
+	require.NoError(t, filesystem.Close())
+	for _, f := range Diagnose(NewArrayBlockDevice(bytes.Clone(disk))) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
+
+// mustFind looks up an inode by name.
+func mustFind(t *testing.T, filesystem *FileSystem, name string) *Inode {
+	inode, err := filesystem.FindInodeByName(name)
+	require.NoError(t, err)
+	return inode
+}
+
+func TestInodeLocks(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/busy", bytes.NewBufferString("busy"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/idle", bytes.NewBufferString("idle"))
+	require.NoError(t, err)
+	busy := int(mustFind(t, filesystem, "/busy").Index)
+	idle := int(mustFind(t, filesystem, "/idle").Index)
+
+	read := func(inodeIndex int) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := filesystem.ReadFileContents(inodeIndex)
+			require.NoError(t, err)
+		}()
+		return done
+	}
+
+	// as if /busy was being overwritten in place
+	lock := filesystem.inodeLock(busy)
+	lock.Lock()
+	waiting := read(busy)
+	<-read(idle)
+	select {
+	case <-waiting:
+		t.Fatal("read /busy while it was being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	lock.Unlock()
+	<-waiting
+
+	// Walk doesn't hold the lock while calling fn
+	err = filesystem.Walk("/", func(name string, entry DirEntry, err error) error {
+		if name == "/idle" {
+			return filesystem.DeleteFile(name)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	_, err = filesystem.FindInodeByName("/idle")
+	require.ErrorIs(t, err, ErrNotExist)
+}
@@ -0,0 +1,26 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DefaultDirMode holds the permission bits of directories made by Mkdir.
+const DefaultDirMode = 0755
+
+// Mkdir creates an empty directory with the given absolute name. It fails
+// with ErrExist if the name is taken. The directory inherits the defaults of
+// its parent, see DirDefaults.
+func (fs *FileSystem) Mkdir(dirname string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Mkdir %s", dirname)
+	defer fs.checkInvariantsAfter("Mkdir")()
+
+	_, err = fs.createInode(dirname, InodeTypeDirectory, &bytes.Buffer{}, DefaultDirMode, CompressionNone)
+	if err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dirname, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMkdir(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.SetDirDefaults("/", DirDefaults{ModeMask: 0022, Project: 5}))
+
+	require.NoError(t, filesystem.Mkdir("/a"))
+	require.NoError(t, filesystem.Mkdir("/a/b"))
+	_, err = filesystem.CreateFile("/a/b/notes", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	dir, err := filesystem.FindInodeByName("/a/b")
+	require.NoError(t, err)
+	require.Equal(t, InodeTypeDirectory, dir.Type)
+	require.Equal(t, "b", dir.Filename)
+	require.Equal(t, uint32(0755), dir.Mode)
+	require.Equal(t, DirDefaults{ModeMask: 0022, Project: 5}, dir.Defaults)
+	entries, err := filesystem.ReadDir(int(dir.Index))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "notes", entries[0].Name)
+
+	require.ErrorIs(t, filesystem.Mkdir("/a"), ErrExist)
+	require.ErrorIs(t, filesystem.Mkdir("/missing/c"), ErrNotExist)
+	require.ErrorIs(t, filesystem.Mkdir("/a/b/notes/c"), ErrNotDirectory)
+	require.ErrorContains(t, filesystem.Mkdir("/a/"+strings.Repeat("x", MaxNameLength+1)), "invalid name")
+	require.NoError(t, filesystem.Mkdir("/a/"+strings.Repeat("x", MaxNameLength)))
+
+	// files in subdirectories can be renamed and deleted
+	require.NoError(t, filesystem.Rename("/a/b/notes", "/a/notes"))
+	require.NoError(t, filesystem.DeleteFile("/a/notes"))
+	require.NoError(t, filesystem.CheckInvariants())
+
+	require.NoError(t, filesystem.Close())
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	dir, err = reloaded.FindInodeByName("/a/b")
+	require.NoError(t, err)
+	require.Equal(t, InodeTypeDirectory, dir.Type)
+	for _, f := range Diagnose(NewArrayBlockDevice(bytes.Clone(disk))) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrFormatted is returned when formatting a device that already holds a
+// filesystem.
+var ErrFormatted = errors.New("device already holds a filesystem")
+
+// MkfsOptions controls how Mkfs and NewFileSystemWithOptions format a
+// device. The zero value is the default used by NewFileSystem.
+type MkfsOptions struct {
+	// Force formats the device even if it already holds a filesystem,
+	// destroying its contents.
+	Force bool
+	// WORM makes the filesystem write-once: files can be created and
+	// appended to, but truncating or overwriting them fails with ErrWORM.
+	// The mode is recorded in the superblock, so it can't be turned off by
+	// mounting differently.
+	WORM bool
+	// Retention is how long files of a WORM filesystem stay write-once
+	// after they are created, rounded down to whole seconds. Zero means
+	// forever.
+	Retention time.Duration
+	// Blocks is the number of blocks the filesystem spans. Zero means 38
+	// blocks. Mounting fails with ErrGeometry if the device has fewer.
+	Blocks uint32
+	// InodeRatio is the number of bytes of filesystem per inode, like the
+	// -i option of mke2fs. The inode count is rounded up to fill the last
+	// block of the inode table. Zero means DefaultInodeRatio, or 32 inodes
+	// if Blocks is zero too.
+	InodeRatio uint32
+	// Inodes is the number of inodes, rounded up like InodeRatio's. If set,
+	// InodeRatio is ignored.
+	Inodes uint32
+	// JournalBlocks is the size of the journal in blocks, taken from the
+	// blocks of the filesystem. Zero means no journal. With a journal, the
+	// metadata changed by an operation is logged before it is written in
+	// place, so a crash never leaves it half-updated; see journal.go. It
+	// must be at least MinJournalBlocks, and enough for the metadata blocks
+	// the biggest operation changes.
+	JournalBlocks uint32
+	// Checksums gives the filesystem a checksum table, so that metadata
+	// damaged on the device is reported with ErrChecksum when it is read,
+	// rather than misread; see checksum.go. It takes a block per 1024
+	// blocks of the filesystem.
+	Checksums bool
+	// Dedup gives the filesystem a dedup table, so that file contents
+	// written whole share the blocks they have in common with other files,
+	// and with themselves; see dedup.go. It takes a block per 256 blocks of
+	// the filesystem.
+	Dedup bool
+}
+
+// geometry lays out the filesystem described by the options.
+func (opts MkfsOptions) geometry() (Geometry, error) {
+	if opts.Blocks == 0 && opts.InodeRatio == 0 && opts.Inodes == 0 {
+		if opts.JournalBlocks == 0 && !opts.Checksums && !opts.Dedup {
+			return defaultGeometry, nil
+		}
+		return newGeometry(defaultGeometry.BlockCount, defaultGeometry.InodeCount, opts.JournalBlocks, opts.Checksums, opts.Dedup)
+	}
+	blocks, ratio := opts.Blocks, opts.InodeRatio
+	if blocks == 0 {
+		blocks = defaultGeometry.BlockCount
+	}
+	if ratio == 0 {
+		ratio = DefaultInodeRatio
+	}
+	const inodesPerBlock = BlockSize / InodeSize
+	inodes := (uint64(blocks)*BlockSize + uint64(ratio) - 1) / uint64(ratio)
+	if opts.Inodes != 0 {
+		inodes = uint64(opts.Inodes)
+	}
+	inodes = (inodes + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+	if inodes > math.MaxUint32 {
+		return Geometry{}, fmt.Errorf("%w: an inode ratio of %d gives too many inodes", ErrGeometry, ratio)
+	}
+	return newGeometry(blocks, uint32(inodes), opts.JournalBlocks, opts.Checksums, opts.Dedup)
+}
+
+// Mkfs formats dev with an empty filesystem, without mounting it; mount it
+// with LoadFilesystem, which never formats. It fails with ErrFormatted if dev
+// already holds a filesystem, unless opts.Force is set.
+func Mkfs(dev BlockDevice, opts MkfsOptions) error {
+	filesystem, err := NewFileSystemWithOptions(dev, opts)
+	if err != nil {
+		return err
+	}
+	return filesystem.Close()
+}
+
+// NewFileSystemWithOptions formats dev with an empty filesystem and mounts
+// it. See NewFileSystem.
+func NewFileSystemWithOptions(dev BlockDevice, opts MkfsOptions) (*FileSystem, error) {
+	if !opts.Force {
+		formatted, err := isFormatted(dev)
+		if err != nil {
+			return nil, err
+		}
+		if formatted {
+			return nil, ErrFormatted
+		}
+	}
+	return format(dev, opts)
+}
+
+// isFormatted reports whether dev starts with a superblock. Only the magic
+// number is checked, so that filesystems this code can't mount, such as
+// newer format versions or damaged ones, are protected too.
+func isFormatted(dev BlockDevice) (bool, error) {
+	buf := make([]byte, BlockSize)
+	err := dev.ReadBlock(SuperblockIndex, buf)
+	if err != nil {
+		return false, fmt.Errorf("error probing for an existing filesystem: %w", err)
+	}
+	return binary.LittleEndian.Uint32(buf[0:4]) == Magic, nil
+}
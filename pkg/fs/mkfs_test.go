@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMkfsRefusesToOverwrite(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	_, err = NewFileSystem(dev)
+	require.ErrorIs(t, err, ErrFormatted)
+	// filesystems that can't be mounted are protected too
+	binary.LittleEndian.PutUint32(disk[4:8], FormatVersion+1)
+	_, err = NewFileSystem(dev)
+	require.ErrorIs(t, err, ErrFormatted)
+	binary.LittleEndian.PutUint32(disk[4:8], FormatVersion)
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, err = reloaded.FindInodeByName("/foo")
+	require.NoError(t, err)
+
+	filesystem, err = NewFileSystemWithOptions(dev, MkfsOptions{Force: true})
+	require.NoError(t, err)
+	entries, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMkfsProbeFailure(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk), failReadAt: 1}
+	_, err := NewFileSystem(dev)
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, 0, dev.writes)
+}
+
+func TestMkfs(t *testing.T) {
+	disk := make([]byte, 100*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	require.NoError(t, Mkfs(dev, MkfsOptions{Blocks: 100, Inodes: 20}))
+	require.ErrorIs(t, Mkfs(dev, MkfsOptions{Blocks: 100}), ErrFormatted)
+
+	// the filesystem is left clean, ready to mount
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, uint32(StateClean), sb.State)
+	require.Equal(t, uint32(24), sb.Geometry.InodeCount)
+	filesystem, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.CheckInvariants())
+}
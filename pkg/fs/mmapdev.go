@@ -0,0 +1,200 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrMmapUnsupported is returned when opening a MmapBlockDevice on a
+// platform without mmap.
+var ErrMmapUnsupported = errors.New("memory-mapped images are not supported on this platform")
+
+// MmapDeviceOptions configures OpenMmapBlockDevice.
+type MmapDeviceOptions struct {
+	// ReadOnly maps the image for reading only. Writing to the device
+	// fails.
+	ReadOnly bool
+}
+
+// MmapBlockDevice is a BlockDevice backed by an image file mapped into
+// memory. Reads and writes are copies to and from the mapping rather than a
+// system call per block, which makes it much faster than FileBlockDevice
+// on large images. Changes reach the file when the host writes the mapping
+// back, or when Sync flushes it with msync. It is available on Linux and
+// macOS.
+//
+// Blocks can be read and written concurrently, but Close mustn't be called
+// while other calls are in flight: the mapping goes away with it.
+type MmapBlockDevice struct {
+	f        *os.File
+	data     []byte
+	nBlocks  uint64
+	readOnly bool
+	closed   bool
+}
+
+// OpenMmapBlockDevice opens the image file at path, whose size must be a
+// multiple of the block size, and maps it into memory. The image is locked
+// against concurrent use like OpenFileBlockDevice locks it.
+func OpenMmapBlockDevice(path string, opts MmapDeviceOptions) (*MmapBlockDevice, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, size, err := openImage(path, flag)
+	if err != nil {
+		return nil, err
+	}
+	if int64(int(size)) != size {
+		f.Close()
+		return nil, fmt.Errorf("image size %d is too big to map", size)
+	}
+	dev := &MmapBlockDevice{
+		f:        f,
+		nBlocks:  uint64(size / BlockSize),
+		readOnly: opts.ReadOnly,
+	}
+	// empty images can't be mapped, and need no mapping
+	if size > 0 {
+		dev.data, err = mmapFile(f, int(size), !opts.ReadOnly)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error mapping image %s: %w", path, err)
+		}
+	}
+	return dev, nil
+}
+
+// ReadBlock reads a block from the image into the buffer.
+func (dev *MmapBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	copy(buf, dev.data[blockNum*BlockSize:])
+	return nil
+}
+
+// ReadBlocks reads consecutive blocks, from start on, from the image, a
+// block into each buffer.
+func (dev *MmapBlockDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if len(buf) > BlockSize {
+			buf = buf[:BlockSize]
+		}
+		copy(buf, dev.data[(start+uint64(i))*BlockSize:])
+	}
+	return nil
+}
+
+// WriteBlocks writes the buffers to consecutive blocks of the image, from
+// start on.
+func (dev *MmapBlockDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	err := dev.checkBounds(start + uint64(len(bufs)) - 1)
+	if err != nil {
+		return err
+	}
+	if dev.readOnly {
+		return fmt.Errorf("error writing blocks %d to %d: the image is mapped read-only", start, start+uint64(len(bufs))-1)
+	}
+	for i, buf := range bufs {
+		if len(buf) > BlockSize {
+			buf = buf[:BlockSize]
+		}
+		copy(dev.data[(start+uint64(i))*BlockSize:], buf)
+	}
+	return nil
+}
+
+// WriteBlock writes the buffer to a block of the image. Like
+// ArrayBlockDevice, a buffer shorter than a block only overwrites the start
+// of the block.
+func (dev *MmapBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	err := dev.checkBounds(blockNum)
+	if err != nil {
+		return err
+	}
+	if dev.readOnly {
+		return fmt.Errorf("error writing block %d: the image is mapped read-only", blockNum)
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	copy(dev.data[blockNum*BlockSize:], buf)
+	return nil
+}
+
+// BlockCount returns the number of blocks in the image.
+func (dev *MmapBlockDevice) BlockCount() uint64 {
+	return dev.nBlocks
+}
+
+// Size returns the number of blocks in the image, like BlockCount.
+func (dev *MmapBlockDevice) Size() uint64 {
+	return dev.nBlocks
+}
+
+// checkBounds returns an error if the device is closed or blockNum is past
+// the end of the image.
+func (dev *MmapBlockDevice) checkBounds(blockNum uint64) error {
+	if dev.closed {
+		return ErrDeviceClosed
+	}
+	if blockNum >= dev.nBlocks {
+		return fmt.Errorf("block %d out of range (device has %d blocks)", blockNum, dev.nBlocks)
+	}
+	return nil
+}
+
+// Sync flushes the changes made through the mapping to the image file, and
+// waits for them to reach stable storage.
+func (dev *MmapBlockDevice) Sync() error {
+	if dev.closed {
+		return ErrDeviceClosed
+	}
+	if dev.readOnly || len(dev.data) == 0 {
+		return nil
+	}
+	err := msync(dev.data)
+	if err != nil {
+		return fmt.Errorf("error syncing image: %w", err)
+	}
+	return nil
+}
+
+// Flush is Sync.
+func (dev *MmapBlockDevice) Flush() error {
+	return dev.Sync()
+}
+
+// Close unmaps and closes the image file, releasing its lock. Changes not
+// synced yet are still written back by the host.
+func (dev *MmapBlockDevice) Close() error {
+	if dev.closed {
+		return ErrDeviceClosed
+	}
+	dev.closed = true
+	var err error
+	if len(dev.data) > 0 {
+		err = munmap(dev.data)
+		dev.data = nil
+	}
+	if closeErr := dev.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package fs
+
+import "os"
+
+// mmapFile fails where mapping images isn't supported.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return ErrMmapUnsupported
+}
+
+func msync(data []byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// openMmapDevice opens the image at path with OpenMmapBlockDevice, skipping
+// the test where mapping images isn't supported.
+func openMmapDevice(t *testing.T, path string, opts MmapDeviceOptions) *MmapBlockDevice {
+	dev, err := OpenMmapBlockDevice(path, opts)
+	if errors.Is(err, ErrMmapUnsupported) {
+		t.Skipf("mmap unavailable here: %v", err)
+	}
+	require.NoError(t, err)
+	return dev
+}
+
+func TestMmapBlockDevice(t *testing.T) {
+	path := newImageFile(t)
+	dev := openMmapDevice(t, path, MmapDeviceOptions{})
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// synced changes are in the file while it is still mapped
+	image, err := os.ReadFile(path)
+	require.NoError(t, err)
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(image))
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/foo")
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "hello", contents.String())
+
+	// short writes only change the start of the block, and runs read at once
+	block := bytes.Repeat([]byte{7}, BlockSize)
+	require.NoError(t, dev.WriteBlock(10, block))
+	require.NoError(t, dev.WriteBlock(10, []byte{1, 2}))
+	buf := make([]byte, 2*BlockSize)
+	require.NoError(t, dev.ReadBlocks(9, splitBlocks(buf)))
+	require.Equal(t, append([]byte{1, 2}, block[2:]...), buf[BlockSize:])
+	require.Equal(t, image[9*BlockSize:10*BlockSize], buf[:BlockSize])
+
+	require.Error(t, dev.ReadBlock(DataStartIndex+32, buf))
+	require.Error(t, dev.ReadBlocks(DataStartIndex+31, splitBlocks(buf)))
+	require.NoError(t, dev.Close())
+	require.ErrorIs(t, dev.ReadBlock(0, buf), ErrDeviceClosed)
+
+	// unsynced changes are written back once it is unmapped
+	image, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 7}, image[10*BlockSize:10*BlockSize+3])
+}
+
+func TestMmapBlockDeviceReadOnly(t *testing.T) {
+	path := newImageFile(t)
+	reader := openMmapDevice(t, path, MmapDeviceOptions{ReadOnly: true})
+	require.ErrorContains(t, reader.WriteBlock(0, make([]byte, BlockSize)), "read-only")
+	require.NoError(t, reader.Sync())
+
+	// it shares the image with other readers, but keeps writers out
+	other, err := OpenFileBlockDevice(path, FileDeviceOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	_, err = OpenMmapBlockDevice(path, MmapDeviceOptions{})
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, reader.Close())
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapFile maps the first size bytes of f into memory, shared with the
+// file so writes to the mapping reach it.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+// munmap unmaps a mapping made by mmapFile.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync writes the changes to a mapping back to its file, and waits for
+// them to reach stable storage.
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
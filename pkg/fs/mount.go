@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDirty is returned when mounting a filesystem that wasn't closed cleanly.
+var ErrDirty = errors.New("filesystem was not closed cleanly")
+
+// RecoveryMode selects what mounting does with a filesystem that wasn't
+// closed cleanly.
+type RecoveryMode int
+
+const (
+	// RecoveryRefuse fails with ErrDirty. Run Diagnose on the device to see
+	// whether the interrupted changes left it inconsistent. Filesystems with
+	// a journal are never refused: their journal is replayed instead.
+	RecoveryRefuse RecoveryMode = iota
+	// RecoveryForce mounts the filesystem anyway, as long as its metadata
+	// passes validation. It stays marked dirty until it is closed.
+	RecoveryForce
+)
+
+// MountOptions controls how LoadFilesystemWithOptions mounts a filesystem.
+// The zero value is the default used by LoadFilesystem.
+type MountOptions struct {
+	// Recovery handles filesystems that weren't closed cleanly.
+	Recovery RecoveryMode
+	// DirOrder is the order of directory listings, see SetDirOrder.
+	DirOrder DirOrder
+	// DataMode orders data writes against metadata, see SetDataMode.
+	DataMode DataMode
+	// InodeReuse delays the reuse of freed inode indices, see SetInodeReuse.
+	InodeReuse InodeReusePolicy
+	// Compression is how new files are compressed, see SetCompression.
+	Compression Compression
+	// AllocPolicy chooses the data blocks of file contents, see
+	// SetAllocPolicy.
+	AllocPolicy AllocPolicy
+	// Credentials are who uses the filesystem, see SetCredentials. Nil
+	// turns permission checks off.
+	Credentials *Credentials
+	// InodeCacheSize is the number of inodes kept loaded. Inodes of open
+	// files are kept on top of that. If zero, DefaultInodeCacheSize is used.
+	InodeCacheSize int
+	// WORM makes the filesystem write-once until it is unmounted, with
+	// files staying write-once for Retention after they are created; see
+	// MkfsOptions. Filesystems formatted as write-once always are, with the
+	// retention they were formatted with.
+	WORM      bool
+	Retention time.Duration
+}
+
+// LoadFilesystemWithOptions mounts the filesystem on dev. See LoadFilesystem.
+func LoadFilesystemWithOptions(dev BlockDevice, opts MountOptions) (*FileSystem, error) {
+	fs, err := readFilesystem(dev, true)
+	if err != nil {
+		return nil, err
+	}
+	if fs.dirty && fs.journal == nil && opts.Recovery != RecoveryForce {
+		return nil, ErrDirty
+	}
+	err = fs.validate()
+	if err != nil {
+		return nil, err
+	}
+	if fs.journal != nil && len(fs.journal.blocks) > 0 {
+		err = fs.checkpoint()
+		if err != nil {
+			return nil, fmt.Errorf("error replaying the journal: %w", err)
+		}
+	}
+	fs.SetDirOrder(opts.DirOrder)
+	fs.SetDataMode(opts.DataMode)
+	fs.SetInodeReuse(opts.InodeReuse)
+	fs.SetCompression(opts.Compression)
+	fs.SetAllocPolicy(opts.AllocPolicy)
+	fs.SetCredentials(opts.Credentials)
+	fs.inodes = newInodeCache(opts.InodeCacheSize)
+	err = fs.cleanupOrphans()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.checkCounters()
+	if err != nil {
+		return nil, err
+	}
+	if opts.WORM && fs.worm == nil {
+		fs.worm = &wormPolicy{retention: opts.Retention}
+	}
+	return fs, nil
+}
+
+// Close marks the filesystem clean. Changes are written as they are made, so
+// this only writes the times recorded by reads, see Stat, and updates the
+// superblock; the filesystem must not be used afterwards. On devices that
+// can sync, such as FileBlockDevice and MultiQueueDevice, the changes are
+// synced before the superblock is, so it is never marked clean ahead of
+// them. If the journal was aborted, the filesystem is left dirty and the
+// error is returned.
+func (fs *FileSystem) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.flushTimes()
+	if err != nil {
+		return err
+	}
+	if !fs.dirty {
+		return nil
+	}
+	if fs.journalAborted() {
+		return fmt.Errorf("error closing, the journal was aborted: %w", fs.journal.err)
+	}
+	err = fs.syncDevice()
+	if err != nil {
+		return fmt.Errorf("error syncing device: %w", err)
+	}
+	fs.explainOp("Close")
+	fs.explainf("superblock: state dirty -> clean")
+	// no generations are handed out until the next mount
+	fs.generationLimit = fs.nextGeneration
+	err = fs.writeState(StateClean)
+	if err == nil {
+		err = fs.syncDevice()
+	}
+	if err != nil {
+		return fmt.Errorf("error marking filesystem clean: %w", err)
+	}
+	fs.dirty = false
+	return nil
+}
+
+// markDirty records in the superblock that the filesystem is being changed,
+// before the first change after mounting. A crash leaves it marked, so the
+// next mount knows the metadata may be half-updated.
+func (fs *FileSystem) markDirty() error {
+	if fs.dirty {
+		return nil
+	}
+	fs.explainf("superblock: state clean -> dirty, so a crash before Close is noticed at the next mount")
+	if fs.generationLimit < fs.nextGeneration+generationReserve {
+		fs.generationLimit = fs.nextGeneration + generationReserve
+	}
+	err := fs.writeState(StateDirty)
+	if err != nil {
+		return fmt.Errorf("error marking filesystem dirty: %w", err)
+	}
+	fs.dirty = true
+	return nil
+}
+
+func (fs *FileSystem) writeState(state uint32) error {
+	return fs.writeBlock(SuperblockIndex, fs.superblock(state).encode())
+}
+
+// superblock returns the superblock of the filesystem in the given state.
+func (fs *FileSystem) superblock(state uint32) *Superblock {
+	sb := &Superblock{
+		Magic:    Magic,
+		Version:  fs.version,
+		State:    state,
+		Geometry: fs.geometry,
+		Flags:    fs.flags,
+
+		NextGeneration: fs.generationLimit,
+		Orphans:        fs.orphans,
+
+		FreeBlocks: uint32(fs.dataBitmap.free),
+		FreeInodes: uint32(fs.inodeBitmap.free),
+	}
+	if fs.flags&FlagWORM != 0 {
+		sb.Retention = fs.worm.retention
+	}
+	return sb
+}
@@ -0,0 +1,65 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirtyFlag(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	state := func() uint32 {
+		sb, err := ReadSuperblock(dev)
+		require.NoError(t, err)
+		return sb.State
+	}
+	require.Equal(t, uint32(StateClean), state())
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(StateDirty), state())
+
+	// an unclean shutdown is refused unless forced
+	_, err = LoadFilesystem(dev)
+	require.ErrorIs(t, err, ErrDirty)
+	forced, err := LoadFilesystemWithOptions(dev, MountOptions{Recovery: RecoveryForce})
+	require.NoError(t, err)
+	require.Equal(t, uint32(StateDirty), state())
+	require.NoError(t, forced.Close())
+	require.Equal(t, uint32(StateClean), state())
+
+	// mounting and reading doesn't mark the filesystem dirty
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	_, err = reloaded.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(StateClean), state())
+	require.NoError(t, reloaded.Close())
+}
+
+func TestDirtyFlagWriteFailure(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	// the create fails before changing anything if the filesystem can't
+	// be marked dirty first
+	dev.writes = 0
+	dev.failWriteAt = 1
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.ErrorIs(t, err, errInjected)
+	require.Contains(t, err.Error(), "marking filesystem dirty")
+
+	// rolling back marks it dirty though
+	reloaded, err := LoadFilesystemWithOptions(dev, MountOptions{Recovery: RecoveryForce})
+	require.NoError(t, err)
+	entries, err := reloaded.ReadDir(0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
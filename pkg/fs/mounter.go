@@ -0,0 +1,453 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrCrossMount is returned when renaming or linking a file into another
+// mounted filesystem.
+var ErrCrossMount = errors.New("can't move or link across mount points")
+
+// ErrMountBusy is returned when unmounting a filesystem that has others
+// mounted inside it, and when removing or renaming a mount point or a
+// directory holding one.
+var ErrMountBusy = errors.New("mount point is busy")
+
+// Mounter joins several filesystems into one tree of absolute paths, as
+// mounting does: a filesystem mounted at /mnt/b of the root filesystem
+// answers for /mnt/b and everything below it, hiding what the directory
+// holds in the root filesystem until it is unmounted. Filesystems can be
+// mounted inside other mounted filesystems.
+//
+// The path-based operations of a Mounter are those of FileSystem, routed to
+// the filesystem holding the path, with the path made relative to its mount
+// point. Inode indices, in DirEntry and Inode alike, are those of the
+// filesystem holding the entry. Operations on other filesystems, such as
+// SetQuota, go through Resolve.
+//
+// A Mounter doesn't own its filesystems: unmounting one, or dropping the
+// Mounter, leaves closing them to the caller. It is safe for concurrent
+// use, as FileSystem is.
+type Mounter struct {
+	mu sync.RWMutex
+	// mounts are sorted by path, longest first, so the first mount point
+	// a path is under is the innermost one. The root filesystem is last.
+	mounts []MountPoint
+}
+
+// MountPoint is a filesystem mounted by a Mounter, and the absolute path it
+// is mounted at.
+type MountPoint struct {
+	Path string
+	FS   *FileSystem
+}
+
+// NewMounter returns a Mounter with root mounted at "/".
+func NewMounter(root *FileSystem) *Mounter {
+	return &Mounter{mounts: []MountPoint{{Path: "/", FS: root}}}
+}
+
+// Mount mounts fs at the absolute path mountPoint, which must be a directory
+// and not already a mount point. The same filesystem may be mounted at
+// several places.
+func (m *Mounter) Mount(mountPoint string, fs *FileSystem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mountPoint, err := cleanPath(mountPoint)
+	if err != nil {
+		return fmt.Errorf("error mounting at %s: %w", mountPoint, err)
+	}
+	if m.find(mountPoint) >= 0 {
+		return fmt.Errorf("error mounting at %s: %w", mountPoint, ErrExist)
+	}
+	under, rel := m.resolve(mountPoint)
+	info, err := under.Stat(rel)
+	if err != nil {
+		return fmt.Errorf("error mounting at %s: %w", mountPoint, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("error mounting at %s: %w", mountPoint, ErrNotDirectory)
+	}
+	m.mounts = append(m.mounts, MountPoint{Path: mountPoint, FS: fs})
+	sort.SliceStable(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].Path) > len(m.mounts[j].Path)
+	})
+	return nil
+}
+
+// Unmount unmounts the filesystem mounted at mountPoint and returns it. It
+// fails with ErrMountBusy if other filesystems are mounted inside it; the
+// root filesystem can't be unmounted.
+func (m *Mounter) Unmount(mountPoint string) (*FileSystem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mountPoint, err := cleanPath(mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("error unmounting %s: %w", mountPoint, err)
+	}
+	i := m.find(mountPoint)
+	if i < 0 {
+		return nil, fmt.Errorf("error unmounting %s: not a mount point", mountPoint)
+	}
+	if mountPoint == "/" || m.holdsMount(mountPoint) {
+		return nil, fmt.Errorf("error unmounting %s: %w", mountPoint, ErrMountBusy)
+	}
+	fs := m.mounts[i].FS
+	m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+	return fs, nil
+}
+
+// Mounts returns the mounted filesystems, sorted by path, the root first.
+func (m *Mounter) Mounts() []MountPoint {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mounts := append([]MountPoint(nil), m.mounts...)
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Path < mounts[j].Path
+	})
+	return mounts
+}
+
+// Resolve returns the filesystem holding the absolute path name and the
+// path of name within it.
+func (m *Mounter) Resolve(name string) (*FileSystem, string, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fs, rel := m.resolve(name)
+	return fs, rel, nil
+}
+
+// cleanPath cleans an absolute path, failing if it isn't absolute.
+func cleanPath(name string) (string, error) {
+	if !strings.HasPrefix(name, "/") {
+		return name, errors.New("filename must be absolute")
+	}
+	return path.Clean(name), nil
+}
+
+// resolve is Resolve for a clean path, for callers holding m.mu.
+func (m *Mounter) resolve(name string) (*FileSystem, string) {
+	for _, mp := range m.mounts {
+		if mp.Path == "/" {
+			return mp.FS, name
+		}
+		if name == mp.Path {
+			return mp.FS, "/"
+		}
+		if strings.HasPrefix(name, mp.Path+"/") {
+			return mp.FS, name[len(mp.Path):]
+		}
+	}
+	panic("the root filesystem is always mounted")
+}
+
+// find returns the index of the mount at the clean path mountPoint in
+// m.mounts, or -1 if there is none.
+func (m *Mounter) find(mountPoint string) int {
+	for i, mp := range m.mounts {
+		if mp.Path == mountPoint {
+			return i
+		}
+	}
+	return -1
+}
+
+// holdsMount reports whether a filesystem is mounted strictly below the
+// clean path name.
+func (m *Mounter) holdsMount(name string) bool {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for _, mp := range m.mounts {
+		if mp.Path != name && strings.HasPrefix(mp.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// route resolves name for an operation op that fails on mount points with
+// ErrMountBusy if busy is set.
+func (m *Mounter) route(op, name string, busy bool) (*FileSystem, string, error) {
+	clean, err := cleanPath(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error %s %s: %w", op, name, err)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if busy && (m.find(clean) >= 0 || m.holdsMount(clean)) {
+		return nil, "", fmt.Errorf("error %s %s: %w", op, name, ErrMountBusy)
+	}
+	fs, rel := m.resolve(clean)
+	return fs, rel, nil
+}
+
+// routePair resolves two paths for an operation op that can't cross mount
+// points, such as renaming, failing with ErrCrossMount if they are on
+// different filesystems.
+func (m *Mounter) routePair(op, from, to string) (*FileSystem, string, string, error) {
+	fromFS, fromRel, err := m.route(op, from, true)
+	if err != nil {
+		return nil, "", "", err
+	}
+	toFS, toRel, err := m.route(op, to, true)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if fromFS != toFS {
+		return nil, "", "", fmt.Errorf("error %s %s: %w", op, from, ErrCrossMount)
+	}
+	return fromFS, fromRel, toRel, nil
+}
+
+// Stat describes the file or directory with the given absolute name. For a
+// mount point, that is the root of the filesystem mounted there.
+func (m *Mounter) Stat(name string) (FileInfo, error) {
+	fs, rel, err := m.route("statting", name, false)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := fs.Stat(rel)
+	if err == nil && rel == "/" {
+		info.name = path.Base(path.Clean(name))
+	}
+	return info, err
+}
+
+// Open opens a file as FileSystem.Open does.
+func (m *Mounter) Open(name string, flag int) (*File, error) {
+	fs, rel, err := m.route("opening", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(rel, flag)
+}
+
+// OpenFile opens a file as FileSystem.OpenFile does.
+func (m *Mounter) OpenFile(name string, flag int, perm iofs.FileMode) (*File, error) {
+	fs, rel, err := m.route("opening", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.OpenFile(rel, flag, perm)
+}
+
+// CreateFileFromReader creates a file as FileSystem.CreateFileFromReader
+// does.
+func (m *Mounter) CreateFileFromReader(name string, r io.Reader) (*Inode, error) {
+	fs, rel, err := m.route("creating", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.CreateFileFromReader(rel, r)
+}
+
+// ReadFile reads a whole file as FileSystem.ReadFile does.
+func (m *Mounter) ReadFile(name string) ([]byte, error) {
+	fs, rel, err := m.route("reading", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(rel)
+}
+
+// ReadAt reads part of a file as FileSystem.ReadAt does.
+func (m *Mounter) ReadAt(name string, p []byte, off int64) (int, error) {
+	fs, rel, err := m.route("reading", name, false)
+	if err != nil {
+		return 0, err
+	}
+	return fs.ReadAt(rel, p, off)
+}
+
+// WriteAt writes part of a file as FileSystem.WriteAt does.
+func (m *Mounter) WriteAt(name string, data []byte, offset int64) error {
+	fs, rel, err := m.route("writing", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.WriteAt(rel, data, offset)
+}
+
+// Append appends to a file as FileSystem.Append does.
+func (m *Mounter) Append(name string, data []byte) error {
+	fs, rel, err := m.route("appending to", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.Append(rel, data)
+}
+
+// Truncate resizes a file as FileSystem.Truncate does.
+func (m *Mounter) Truncate(name string, size int64) error {
+	fs, rel, err := m.route("truncating", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.Truncate(rel, size)
+}
+
+// DeleteFile deletes a file as FileSystem.DeleteFile does.
+func (m *Mounter) DeleteFile(name string) error {
+	fs, rel, err := m.route("deleting", name, true)
+	if err != nil {
+		return err
+	}
+	return fs.DeleteFile(rel)
+}
+
+// Mkdir creates a directory as FileSystem.Mkdir does.
+func (m *Mounter) Mkdir(name string) error {
+	fs, rel, err := m.route("creating", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.Mkdir(rel)
+}
+
+// ReadDirByPath lists a directory as FileSystem.ReadDirByPath does. The
+// entries of mount points are those of the directories they hide.
+func (m *Mounter) ReadDirByPath(name string) ([]DirEntry, error) {
+	fs, rel, err := m.route("listing", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDirByPath(rel)
+}
+
+// ListDir lists a directory as FileSystem.ListDir does.
+func (m *Mounter) ListDir(name string) ([]DirEntry, error) {
+	fs, rel, err := m.route("listing", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ListDir(rel)
+}
+
+// Rename moves a file or directory as FileSystem.Rename does. It fails with
+// ErrCrossMount if newPath is on another filesystem than oldPath, and with
+// ErrMountBusy if either is a mount point or holds one.
+func (m *Mounter) Rename(oldPath, newPath string) error {
+	fs, oldRel, newRel, err := m.routePair("renaming", oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(oldRel, newRel)
+}
+
+// Link adds another name of a file as FileSystem.Link does. It fails with
+// ErrCrossMount if newPath is on another filesystem than existingPath.
+func (m *Mounter) Link(existingPath, newPath string) error {
+	fs, existingRel, newRel, err := m.routePair("linking", existingPath, newPath)
+	if err != nil {
+		return err
+	}
+	return fs.Link(existingRel, newRel)
+}
+
+// CopyFile copies a file as FileSystem.CopyFile does. Across filesystems,
+// the copy gets the contents and permission bits of the original, and
+// is compressed as new files of its filesystem are.
+func (m *Mounter) CopyFile(srcPath, dstPath string) error {
+	srcFS, srcRel, err := m.route("copying", srcPath, false)
+	if err != nil {
+		return err
+	}
+	dstFS, dstRel, err := m.route("copying", dstPath, false)
+	if err != nil {
+		return err
+	}
+	if srcFS == dstFS {
+		return srcFS.CopyFile(srcRel, dstRel)
+	}
+
+	info, err := srcFS.Stat(srcRel)
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", srcPath, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("error copying %s: %w", srcPath, ErrIsDirectory)
+	}
+	src, err := srcFS.Open(srcRel, O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", srcPath, err)
+	}
+	defer src.Close()
+	_, err = dstFS.CreateFileWithOptions(dstRel, src, CreateOptions{SizeHint: info.Size()})
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", srcPath, dstPath, err)
+	}
+	err = dstFS.Chmod(dstRel, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", srcPath, dstPath, err)
+	}
+	return nil
+}
+
+// Chmod changes permission bits as FileSystem.Chmod does.
+func (m *Mounter) Chmod(name string, mode iofs.FileMode) error {
+	fs, rel, err := m.route("changing the mode of", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.Chmod(rel, mode)
+}
+
+// Chown changes the owner as FileSystem.Chown does.
+func (m *Mounter) Chown(name string, uid, gid int) error {
+	fs, rel, err := m.route("changing the owner of", name, false)
+	if err != nil {
+		return err
+	}
+	return fs.Chown(rel, uid, gid)
+}
+
+// Walk visits the tree rooted at the absolute path root as FileSystem.Walk
+// does, going into the filesystems mounted inside it. The entry of a mount
+// point is the root of the filesystem mounted there, under the mount
+// point's name.
+func (m *Mounter) Walk(root string, fn WalkFunc) error {
+	root, err := cleanPath(root)
+	if err != nil {
+		return err
+	}
+	fs, rel, err := m.route("walking", root, false)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(root, rel)
+	return fs.Walk(rel, func(name string, entry DirEntry, err error) error {
+		full := prefix + name
+		if name == "/" {
+			full = root
+		}
+		if full == root {
+			entry.Name = path.Base(root)
+		} else if m.isMountPoint(full) {
+			// the directory hidden by the mount isn't listed
+			err = m.Walk(full, fn)
+			if err != nil {
+				return err
+			}
+			return iofs.SkipDir
+		}
+		return fn(full, entry, err)
+	})
+}
+
+// isMountPoint reports whether a filesystem is mounted at the clean path
+// name.
+func (m *Mounter) isMountPoint(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.find(name) >= 0
+}
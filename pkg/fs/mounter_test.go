@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newMounterTestFileSystem(t *testing.T) *FileSystem {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, (DataStartIndex+64)*BlockSize)))
+	require.NoError(t, err)
+	return filesystem
+}
+
+func TestMounter(t *testing.T) {
+	a := newMounterTestFileSystem(t)
+	b := newMounterTestFileSystem(t)
+	c := newMounterTestFileSystem(t)
+	require.NoError(t, a.Mkdir("/mnt"))
+	require.NoError(t, a.Mkdir("/mnt/b"))
+	_, err := a.CreateFile("/mnt/b/hidden", bytes.NewBufferString("hidden"))
+	require.NoError(t, err)
+	require.NoError(t, b.Mkdir("/c"))
+	m := NewMounter(a)
+
+	require.NoError(t, m.Mount("/mnt/b/", b))
+	require.ErrorIs(t, m.Mount("/mnt/b", c), ErrExist)
+	require.ErrorIs(t, m.Mount("/mnt/b/hidden", c), ErrNotExist)
+	require.ErrorIs(t, m.Mount("/missing", c), ErrNotExist)
+	require.NoError(t, m.Mount("/mnt/b/c", c))
+	require.Equal(t, []MountPoint{{"/", a}, {"/mnt/b", b}, {"/mnt/b/c", c}}, m.Mounts())
+
+	// paths are routed to the innermost filesystem
+	_, err = m.CreateFileFromReader("/mnt/b/file", bytes.NewBufferString("in b"))
+	require.NoError(t, err)
+	_, err = m.CreateFileFromReader("/mnt/b/c/file", bytes.NewBufferString("in c"))
+	require.NoError(t, err)
+	data, err := b.ReadFile("/file")
+	require.NoError(t, err)
+	require.Equal(t, []byte("in b"), data)
+	data, err = m.ReadFile("/mnt/b/c/file")
+	require.NoError(t, err)
+	require.Equal(t, []byte("in c"), data)
+	_, err = m.ReadFile("/mnt/b/hidden")
+	require.ErrorIs(t, err, ErrNotExist)
+	fsys, rel, err := m.Resolve("/mnt/b/c/../file")
+	require.NoError(t, err)
+	require.Same(t, b, fsys)
+	require.Equal(t, "/file", rel)
+	info, err := m.Stat("/mnt/b/c")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	require.Equal(t, "c", info.Name())
+
+	require.NoError(t, m.Rename("/mnt/b/file", "/mnt/b/renamed"))
+	require.ErrorIs(t, m.Rename("/mnt/b/renamed", "/renamed"), ErrCrossMount)
+	require.ErrorIs(t, m.Link("/mnt/b/renamed", "/mnt/b/c/link"), ErrCrossMount)
+	require.ErrorIs(t, m.Rename("/mnt", "/elsewhere"), ErrMountBusy)
+	require.ErrorIs(t, m.Rename("/mnt/b/c", "/mnt/b/d"), ErrMountBusy)
+	require.NoError(t, m.CopyFile("/mnt/b/renamed", "/copy"))
+	data, err = a.ReadFile("/copy")
+	require.NoError(t, err)
+	require.Equal(t, []byte("in b"), data)
+
+	var walked []string
+	require.NoError(t, m.Walk("/", func(name string, entry DirEntry, err error) error {
+		require.NoError(t, err)
+		walked = append(walked, name)
+		return nil
+	}))
+	require.Equal(t, []string{"/", "/mnt", "/mnt/b", "/mnt/b/c", "/mnt/b/c/file", "/mnt/b/renamed", "/copy"}, walked)
+
+	_, err = m.Unmount("/mnt/b")
+	require.ErrorIs(t, err, ErrMountBusy)
+	_, err = m.Unmount("/")
+	require.ErrorIs(t, err, ErrMountBusy)
+	unmounted, err := m.Unmount("/mnt/b/c")
+	require.NoError(t, err)
+	require.Same(t, c, unmounted)
+	_, err = m.Unmount("/mnt/b")
+	require.NoError(t, err)
+	data, err = m.ReadFile("/mnt/b/hidden")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hidden"), data)
+}
@@ -0,0 +1,216 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDeviceClosed is returned by a MultiQueueDevice after Close.
+var ErrDeviceClosed = errors.New("device is closed")
+
+// queuedDevice is implemented by block devices that serve several
+// operations at once. The filesystem issues the block operations of one
+// request, such as the blocks of a file, concurrently on such devices.
+type queuedDevice interface {
+	// Queues returns how many operations the device serves at once.
+	Queues() int
+}
+
+// MultiQueueDevice wraps a BlockDevice that supports concurrent operations
+// on different blocks, such as a FileBlockDevice, and spreads operations over
+// several queues by block number. Each queue is served by its own goroutine,
+// so operations on the same block are serialized in the order they were
+// submitted, while operations on blocks in different queues proceed in
+// parallel.
+type MultiQueueDevice struct {
+	dev    BlockDevice
+	queues []chan ioRequest
+	// mu guards closed; submitting holds it for reading
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// ioRequest is an operation waiting in a queue. Requests without a buffer
+// are barriers.
+type ioRequest struct {
+	write    bool
+	blockNum uint64
+	buf      []byte
+	done     chan error
+}
+
+// NewMultiQueueDevice wraps dev with the given number of queues, or one if
+// queues is less than that. Close it to stop the queues.
+func NewMultiQueueDevice(dev BlockDevice, queues int) *MultiQueueDevice {
+	if queues < 1 {
+		queues = 1
+	}
+	d := &MultiQueueDevice{dev: dev}
+	for i := 0; i < queues; i++ {
+		queue := make(chan ioRequest, 16)
+		d.queues = append(d.queues, queue)
+		d.workers.Add(1)
+		go d.serve(queue)
+	}
+	return d
+}
+
+func (d *MultiQueueDevice) serve(queue chan ioRequest) {
+	defer d.workers.Done()
+	for req := range queue {
+		switch {
+		case req.buf == nil:
+			req.done <- nil
+		case req.write:
+			req.done <- d.dev.WriteBlock(req.blockNum, req.buf)
+		default:
+			req.done <- d.dev.ReadBlock(req.blockNum, req.buf)
+		}
+	}
+}
+
+// submit queues req and waits for it to complete.
+func (d *MultiQueueDevice) submit(req ioRequest) error {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return ErrDeviceClosed
+	}
+	req.done = make(chan error, 1)
+	d.queues[req.blockNum%uint64(len(d.queues))] <- req
+	d.mu.RUnlock()
+	return <-req.done
+}
+
+// ReadBlock reads a block from the device into the buffer.
+func (d *MultiQueueDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	return d.submit(ioRequest{blockNum: blockNum, buf: buf})
+}
+
+// WriteBlock writes a block from the buffer to the device.
+func (d *MultiQueueDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	return d.submit(ioRequest{write: true, blockNum: blockNum, buf: buf})
+}
+
+// Queues returns the number of queues.
+func (d *MultiQueueDevice) Queues() int {
+	return len(d.queues)
+}
+
+// Sync is a barrier across all queues: it waits for every operation
+// submitted before it to complete, then syncs the wrapped device if it
+// supports syncing.
+func (d *MultiQueueDevice) Sync() error {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return ErrDeviceClosed
+	}
+	barriers := make([]chan error, len(d.queues))
+	for i, queue := range d.queues {
+		barriers[i] = make(chan error, 1)
+		queue <- ioRequest{done: barriers[i]}
+	}
+	d.mu.RUnlock()
+	for _, done := range barriers {
+		<-done
+	}
+
+	return flushDevice(d.dev)
+}
+
+// Close waits for the queued operations to complete and stops the queues.
+// It doesn't close the wrapped device.
+func (d *MultiQueueDevice) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrDeviceClosed
+	}
+	d.closed = true
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.mu.Unlock()
+	d.workers.Wait()
+	return nil
+}
+
+// BlockCount returns the number of blocks of the wrapped device, or 0 if it
+// doesn't report its size.
+func (d *MultiQueueDevice) BlockCount() uint64 {
+	return deviceSize(d.dev)
+}
+
+// transferBlocks reads the given blocks of an inode into consecutive
+// block-sized parts of buf, or writes them from there. On devices with
+// several queues the blocks are transferred concurrently, and on
+// VectoredBlockDevices, runs of consecutive blocks are transferred at once.
+func (fs *FileSystem) transferBlocks(write bool, inodeIndex uint32, blocks []uint32, buf []byte) error {
+	if dev, ok := fs.dev.(queuedDevice); ok && dev.Queues() > 1 && len(blocks) > 1 {
+		return fs.transferBlocksConcurrently(dev.Queues(), write, inodeIndex, blocks, buf)
+	}
+	_, runs := fs.vectoredDevice()
+	for i := 0; i < len(blocks); {
+		n := 1
+		for runs && i+n < len(blocks) && blocks[i+n] == blocks[i]+uint32(n) {
+			n++
+		}
+		switch {
+		case n == 1:
+			err := fs.transferBlock(write, inodeIndex, blocks[i], buf[i*BlockSize:(i+1)*BlockSize])
+			if err != nil {
+				return err
+			}
+		case write:
+			err := fs.writeBlocks(uint64(blocks[i]), splitBlocks(buf[i*BlockSize:(i+n)*BlockSize]))
+			if err != nil {
+				return fmt.Errorf("error writing blocks %d to %d of inode %d: %w", blocks[i], blocks[i+n-1], inodeIndex, err)
+			}
+		default:
+			err := fs.readBlocks(uint64(blocks[i]), buf[i*BlockSize:(i+n)*BlockSize])
+			if err != nil {
+				return fmt.Errorf("error reading blocks %d to %d of inode %d: %w", blocks[i], blocks[i+n-1], inodeIndex, err)
+			}
+		}
+		i += n
+	}
+	return nil
+}
+
+// transferBlocksConcurrently is transferBlocks for devices with queues. It
+// lives apart so the sequential path doesn't allocate.
+func (fs *FileSystem) transferBlocksConcurrently(queues int, write bool, inodeIndex uint32, blocks []uint32, buf []byte) error {
+	errs := make([]error, len(blocks))
+	parallel(queues, len(blocks), func(i int) {
+		errs[i] = fs.transferBlock(write, inodeIndex, blocks[i], buf[i*BlockSize:(i+1)*BlockSize])
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) transferBlock(write bool, inodeIndex uint32, blockIndex uint32, buf []byte) error {
+	if write {
+		err := fs.writeBlock(uint64(blockIndex), buf)
+		if err != nil {
+			return fmt.Errorf("error writing block %d of inode %d: %w", blockIndex, inodeIndex, err)
+		}
+		return nil
+	}
+	err := fs.readBlock(uint64(blockIndex), buf)
+	if err != nil {
+		return fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inodeIndex, err)
+	}
+	return nil
+}
+
+// syncDevice flushes the device, if it supports it.
+func (fs *FileSystem) syncDevice() error {
+	return flushDevice(fs.dev)
+}
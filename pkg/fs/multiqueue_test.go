@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// slowDevice delays every operation and records how many ran at once, and
+// how often it was synced.
+type slowDevice struct {
+	BlockDevice
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	syncs    int
+}
+
+func (dev *slowDevice) track(op func() error) error {
+	dev.mu.Lock()
+	dev.inFlight++
+	if dev.inFlight > dev.peak {
+		dev.peak = dev.inFlight
+	}
+	dev.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	err := op()
+	dev.mu.Lock()
+	dev.inFlight--
+	dev.mu.Unlock()
+	return err
+}
+
+func (dev *slowDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	return dev.track(func() error { return dev.BlockDevice.ReadBlock(blockNum, buf) })
+}
+
+func (dev *slowDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	return dev.track(func() error { return dev.BlockDevice.WriteBlock(blockNum, buf) })
+}
+
+func (dev *slowDevice) Sync() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	dev.syncs++
+	return nil
+}
+
+func TestMultiQueueDevice(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	slow := &slowDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	dev := NewMultiQueueDevice(slow, 4)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	contents := make([]byte, 4*BlockSize)
+	for i := range contents {
+		contents[i] = byte(i / BlockSize)
+	}
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+
+	slow.peak = 0
+	read, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+	// the four blocks of the file were read at the same time
+	require.Greater(t, slow.peak, 1)
+
+	// closing syncs before and after marking the filesystem clean
+	require.NoError(t, filesystem.Close())
+	require.Equal(t, 2, slow.syncs)
+	require.NoError(t, dev.Close())
+	require.ErrorIs(t, dev.ReadBlock(0, make([]byte, BlockSize)), ErrDeviceClosed)
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	read, err = reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+}
+
+func TestMultiQueueDeviceSyncIsABarrier(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	slow := &slowDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	dev := NewMultiQueueDevice(slow, 4)
+	defer dev.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, dev.WriteBlock(uint64(i), bytes.Repeat([]byte{byte(i + 1)}, BlockSize)))
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, dev.Sync())
+	slow.mu.Lock()
+	require.Zero(t, slow.inFlight)
+	require.Equal(t, 1, slow.syncs)
+	slow.mu.Unlock()
+	for i := 0; i < 8; i++ {
+		require.Equal(t, byte(i+1), disk[i*BlockSize])
+	}
+}
@@ -0,0 +1,442 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A NetBlockDevice reaches a device served by ServeBlockDevice over a
+// stream connection, usually TCP, with a small protocol of its own.
+//
+// The server opens the connection with netMagic and the number of blocks of
+// the device, or 0 if it isn't known. The client then sends requests, each
+// an op byte, a block number and a count, and the server answers them in
+// order:
+//
+//   - netOpRead reads count consecutive blocks, at most netMaxRun, from the
+//     block number on.
+//   - netOpWrite is followed by count bytes, at most netMaxRun blocks,
+//     written over consecutive blocks from the block number on. A last
+//     partial block is written over the start of the block.
+//   - netOpSync syncs the device, if it can be synced.
+//
+// Answers are a status byte, netStatusOK followed by the blocks read, if
+// any, or netStatusError followed by the length of an error message and the
+// message. Numbers are big endian; block numbers take 8 bytes, and counts
+// and lengths 4.
+const (
+	netMagic = "VSFSNBD1"
+
+	netOpRead  = 1
+	netOpWrite = 2
+	netOpSync  = 3
+
+	netStatusOK    = 0
+	netStatusError = 1
+
+	// netMaxRun is the most blocks a read request asks for, so the server
+	// doesn't allocate without bound.
+	netMaxRun = 256
+	// netRequestSize is the size of a request, before the data of writes.
+	netRequestSize = 1 + 8 + 4
+	// netMaxMessage bounds the error messages a client reads.
+	netMaxMessage = 64 << 10
+)
+
+// ErrRemote wraps the errors a served device returns, as reported by the
+// server.
+var ErrRemote = errors.New("remote device error")
+
+// NetBlockDevice is a BlockDevice served by ServeBlockDevice on another
+// host or process. Requests are sent one at a time over a single
+// connection, so it is safe for concurrent use, but gains nothing from it.
+//
+// If the connection fails, the device is unusable from then on: every
+// call returns the error it failed with. It is a ContextBlockDevice, and
+// requests whose context is done while they wait for an answer fail the
+// connection as well, as the rest of the answer would be in the way of the
+// next one.
+type NetBlockDevice struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	nBlocks uint64
+	// broken is the error the connection failed with, if it did
+	broken error
+}
+
+// DialBlockDevice connects to the block server listening at the TCP
+// address addr.
+func DialBlockDevice(addr string) (*NetBlockDevice, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to block server: %w", err)
+	}
+	dev, err := NewNetBlockDevice(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// NewNetBlockDevice returns a device talking to the block server at the
+// other end of conn, which it takes over.
+func NewNetBlockDevice(conn net.Conn) (*NetBlockDevice, error) {
+	dev := &NetBlockDevice{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	hello := make([]byte, len(netMagic)+8)
+	_, err := io.ReadFull(dev.r, hello)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the block server's greeting: %w", err)
+	}
+	if string(hello[:len(netMagic)]) != netMagic {
+		return nil, errors.New("the peer is not a block server")
+	}
+	dev.nBlocks = binary.BigEndian.Uint64(hello[len(netMagic):])
+	return dev, nil
+}
+
+// request sends a request with the given data, and reads the answer into
+// out, until ctx is done.
+func (dev *NetBlockDevice) request(ctx context.Context, op byte, blockNum uint64, count uint32, data, out []byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.broken != nil {
+		return dev.broken
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	stop := dev.watch(ctx)
+	err = dev.exchange(op, blockNum, count, data, out)
+	cut := stop()
+	var remote remoteError
+	if err != nil && !errors.As(err, &remote) {
+		if cut != nil {
+			err = fmt.Errorf("%w: %w", cut, err)
+		}
+		dev.broken = fmt.Errorf("connection to block server failed: %w", err)
+		return dev.broken
+	}
+	return err
+}
+
+// watch cuts the exchange with the server short once ctx is done, by
+// moving the deadline of the connection into the past. The returned
+// function stops watching, and returns the error of ctx if it cut it short.
+func (dev *NetBlockDevice) watch(ctx context.Context) func() error {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	done := make(chan struct{})
+	var cut error
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			cut = ctx.Err()
+			dev.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		if cut != nil {
+			dev.conn.SetDeadline(time.Time{})
+		}
+		return cut
+	}
+}
+
+// remoteError is an error the server reported, which leaves the connection
+// usable.
+type remoteError struct {
+	msg string
+}
+
+func (e remoteError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrRemote, e.msg)
+}
+
+func (e remoteError) Unwrap() error {
+	return ErrRemote
+}
+
+func (dev *NetBlockDevice) exchange(op byte, blockNum uint64, count uint32, data, out []byte) error {
+	header := make([]byte, netRequestSize)
+	header[0] = op
+	binary.BigEndian.PutUint64(header[1:], blockNum)
+	binary.BigEndian.PutUint32(header[9:], count)
+	dev.w.Write(header)
+	dev.w.Write(data)
+	err := dev.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	status, err := dev.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case netStatusOK:
+		_, err = io.ReadFull(dev.r, out)
+		return err
+	case netStatusError:
+		var length [4]byte
+		_, err = io.ReadFull(dev.r, length[:])
+		if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n > netMaxMessage {
+			return fmt.Errorf("error message of %d bytes", n)
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(dev.r, msg)
+		if err != nil {
+			return err
+		}
+		return remoteError{msg: string(msg)}
+	}
+	return fmt.Errorf("unknown answer status %d", status)
+}
+
+// ReadBlock reads a block from the remote device into the buffer.
+func (dev *NetBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	return dev.ReadBlockCtx(context.Background(), blockNum, buf)
+}
+
+// ReadBlockCtx is ReadBlock under ctx.
+func (dev *NetBlockDevice) ReadBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	if len(buf) >= BlockSize {
+		return dev.request(ctx, netOpRead, blockNum, 1, nil, buf[:BlockSize])
+	}
+	block := make([]byte, BlockSize)
+	err := dev.request(ctx, netOpRead, blockNum, 1, nil, block)
+	copy(buf, block)
+	return err
+}
+
+// ReadBlocks reads consecutive blocks, from start on, from the remote
+// device, a block into each buffer, netMaxRun blocks per request.
+func (dev *NetBlockDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	for done := 0; done < len(bufs); {
+		run := len(bufs) - done
+		if run > netMaxRun {
+			run = netMaxRun
+		}
+		blockNum := start + uint64(done)
+		out := joinedBlocks(bufs[done : done+run])
+		if out == nil {
+			out = make([]byte, run*BlockSize)
+		}
+		err := dev.request(context.Background(), netOpRead, blockNum, uint32(run), nil, out)
+		if err != nil {
+			return err
+		}
+		for i, buf := range bufs[done : done+run] {
+			copy(buf, out[i*BlockSize:(i+1)*BlockSize])
+		}
+		done += run
+	}
+	return nil
+}
+
+// WriteBlock writes the buffer to a block of the remote device. Like
+// ArrayBlockDevice, a buffer shorter than a block only overwrites the start
+// of the block.
+func (dev *NetBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	return dev.WriteBlockCtx(context.Background(), blockNum, buf)
+}
+
+// WriteBlockCtx is WriteBlock under ctx.
+func (dev *NetBlockDevice) WriteBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	return dev.request(ctx, netOpWrite, blockNum, uint32(len(buf)), buf, nil)
+}
+
+// WriteBlocks writes the buffers to consecutive blocks of the remote
+// device, from start on, netMaxRun blocks per request. Buffers shorter than
+// a block end a request, as only the last block of one may be partial.
+func (dev *NetBlockDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	for done := 0; done < len(bufs); {
+		run := 1
+		for run < netMaxRun && done+run < len(bufs) && len(bufs[done+run-1]) >= BlockSize {
+			run++
+		}
+		data := joinedBlocks(bufs[done : done+run])
+		if data == nil {
+			data = make([]byte, 0, run*BlockSize)
+			for _, buf := range bufs[done : done+run] {
+				if len(buf) > BlockSize {
+					buf = buf[:BlockSize]
+				}
+				data = append(data, buf...)
+			}
+		}
+		err := dev.request(context.Background(), netOpWrite, start+uint64(done), uint32(len(data)), data, nil)
+		if err != nil {
+			return err
+		}
+		done += run
+	}
+	return nil
+}
+
+// Sync syncs the remote device, if it can be synced.
+func (dev *NetBlockDevice) Sync() error {
+	return dev.request(context.Background(), netOpSync, 0, 0, nil, nil)
+}
+
+// Flush is Sync.
+func (dev *NetBlockDevice) Flush() error {
+	return dev.Sync()
+}
+
+// BlockCount returns the number of blocks of the remote device, or 0 if
+// the server doesn't know it.
+func (dev *NetBlockDevice) BlockCount() uint64 {
+	return dev.nBlocks
+}
+
+// Size is BlockCount.
+func (dev *NetBlockDevice) Size() uint64 {
+	return dev.nBlocks
+}
+
+// Close closes the connection. Calls made afterwards fail with
+// ErrDeviceClosed.
+func (dev *NetBlockDevice) Close() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.broken == ErrDeviceClosed {
+		return ErrDeviceClosed
+	}
+	dev.broken = ErrDeviceClosed
+	return dev.conn.Close()
+}
+
+// ServeBlockDevice serves dev to the NetBlockDevices connecting to l, until
+// l is closed. Each connection is served on its own goroutine, and requests
+// from all of them are applied to dev one at a time, so dev needn't be safe
+// for concurrent use. Connections are served until the client closes them.
+func ServeBlockDevice(l net.Listener, dev BlockDevice) error {
+	mu := &sync.Mutex{}
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go serveBlockConn(conn, dev, mu)
+	}
+}
+
+// serveBlockConn answers the requests of one client until it disconnects or
+// sends something other than a request.
+func serveBlockConn(conn net.Conn, dev BlockDevice, mu *sync.Mutex) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	hello := make([]byte, len(netMagic)+8)
+	copy(hello, netMagic)
+	binary.BigEndian.PutUint64(hello[len(netMagic):], deviceSize(dev))
+	w.Write(hello)
+	if w.Flush() != nil {
+		return
+	}
+
+	header := make([]byte, netRequestSize)
+	buf := make([]byte, BlockSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return
+		}
+		op, blockNum, count := header[0], binary.BigEndian.Uint64(header[1:]), binary.BigEndian.Uint32(header[9:])
+		var out []byte
+		switch op {
+		case netOpRead:
+			if count == 0 || count > netMaxRun {
+				err = fmt.Errorf("can't read %d blocks at once", count)
+				break
+			}
+			if need := int(count) * BlockSize; cap(buf) < need {
+				buf = make([]byte, need)
+			}
+			out = buf[:int(count)*BlockSize]
+			mu.Lock()
+			err = readRun(dev, blockNum, out)
+			mu.Unlock()
+		case netOpWrite:
+			if count > netMaxRun*BlockSize {
+				// the data can't be skipped safely, so the stream is lost
+				return
+			}
+			if cap(buf) < int(count) {
+				buf = make([]byte, count)
+			}
+			_, err = io.ReadFull(r, buf[:count])
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			err = writeRun(dev, blockNum, buf[:count])
+			mu.Unlock()
+		case netOpSync:
+			mu.Lock()
+			err = flushDevice(dev)
+			mu.Unlock()
+		default:
+			return
+		}
+
+		if err != nil {
+			msg := err.Error()
+			if len(msg) > netMaxMessage {
+				msg = msg[:netMaxMessage]
+			}
+			w.WriteByte(netStatusError)
+			binary.Write(w, binary.BigEndian, uint32(len(msg)))
+			w.WriteString(msg)
+		} else {
+			w.WriteByte(netStatusOK)
+			w.Write(out)
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// readRun reads consecutive blocks of dev into buf, at once if dev is a
+// VectoredBlockDevice.
+func readRun(dev BlockDevice, blockNum uint64, buf []byte) error {
+	return AdaptBlockDevice(dev).ReadBlocks(blockNum, splitBlocks(buf))
+}
+
+// writeRun writes data over consecutive blocks of dev, at once if dev is a
+// VectoredBlockDevice. A last partial block only overwrites the start of the
+// block.
+func writeRun(dev BlockDevice, blockNum uint64, data []byte) error {
+	bufs := splitBlocks(data)
+	if rest := len(data) % BlockSize; rest != 0 {
+		bufs = append(bufs, data[len(data)-rest:])
+	}
+	return AdaptBlockDevice(dev).WriteBlocks(blockNum, bufs)
+}
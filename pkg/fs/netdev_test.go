@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncCountingDevice is an ArrayBlockDevice counting the calls to Sync.
+type syncCountingDevice struct {
+	*ArrayBlockDevice
+	syncs int
+}
+
+func (dev *syncCountingDevice) Sync() error {
+	dev.syncs++
+	return nil
+}
+
+// serveTestDevice serves dev on a local TCP port, and returns a client
+// connected to it.
+func serveTestDevice(t *testing.T, dev BlockDevice) *NetBlockDevice {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- ServeBlockDevice(l, dev) }()
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+		require.NoError(t, <-done)
+	})
+
+	client, err := DialBlockDevice(l.Addr().String())
+	require.NoError(t, err)
+	return client
+}
+
+func TestNetBlockDevice(t *testing.T) {
+	disk := make([]byte, 300*BlockSize)
+	served := &syncCountingDevice{ArrayBlockDevice: NewArrayBlockDevice(disk)}
+	dev := serveTestDevice(t, served)
+	require.Equal(t, uint64(300), dev.BlockCount())
+
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 300})
+	require.NoError(t, err)
+	want := patterned((netMaxRun + 10) * BlockSize)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	// the file is read in runs of netMaxRun blocks
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	require.NoError(t, filesystem.Close())
+	require.Equal(t, 2, served.syncs)
+
+	// the changes are on the served device
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents, err = reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+
+	// short writes only change the start of the block
+	require.NoError(t, dev.WriteBlock(299, bytes.Repeat([]byte{7}, BlockSize)))
+	require.NoError(t, dev.WriteBlock(299, []byte{1, 2}))
+	buf := make([]byte, 3)
+	require.NoError(t, dev.ReadBlock(299, buf))
+	require.Equal(t, []byte{1, 2, 7}, buf)
+
+	// errors of the served device leave the connection usable
+	err = dev.ReadBlock(300, make([]byte, BlockSize))
+	require.ErrorIs(t, err, ErrRemote)
+	require.ErrorContains(t, err, "out of range")
+	require.NoError(t, dev.ReadBlock(0, buf))
+
+	require.NoError(t, dev.Close())
+	require.ErrorIs(t, dev.ReadBlock(0, buf), ErrDeviceClosed)
+}
+
+func TestNetBlockDeviceBrokenConnection(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte(netMagic + "\x00\x00\x00\x00\x00\x00\x00\x20"))
+		// read the request and hang up without answering
+		server.Read(make([]byte, netRequestSize))
+		server.Close()
+	}()
+	dev, err := NewNetBlockDevice(client)
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), dev.BlockCount())
+
+	buf := make([]byte, BlockSize)
+	err = dev.ReadBlock(0, buf)
+	require.ErrorContains(t, err, "connection to block server failed")
+	require.NotErrorIs(t, err, ErrRemote)
+	require.Equal(t, err, dev.ReadBlock(1, buf))
+
+	// peers that aren't block servers are refused
+	client, server = net.Pipe()
+	go func() {
+		server.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
+		server.Close()
+	}()
+	_, err = NewNetBlockDevice(client)
+	require.ErrorContains(t, err, "not a block server")
+}
+
+func TestNetBlockDeviceContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		server.Write([]byte(netMagic + "\x00\x00\x00\x00\x00\x00\x00\x20"))
+		// read the request and never answer
+		server.Read(make([]byte, netRequestSize))
+	}()
+	dev, err := NewNetBlockDevice(client)
+	require.NoError(t, err)
+
+	buf := make([]byte, BlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = dev.ReadBlockCtx(ctx, 0, buf)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "connection to block server failed")
+	// the answer would be out of step, so the connection is given up
+	require.Equal(t, err, dev.ReadBlock(1, buf))
+
+	// contexts that are done already don't reach the server
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	dev = serveTestDevice(t, NewArrayBlockDevice(make([]byte, 4*BlockSize)))
+	require.ErrorIs(t, dev.WriteBlockCtx(ctx, 0, buf), context.Canceled)
+	require.NoError(t, dev.ReadBlockCtx(context.Background(), 0, buf))
+}
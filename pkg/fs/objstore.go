@@ -0,0 +1,382 @@
+package fs
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrObjectNotFound is returned by ObjectStores asked for an object they
+// don't hold.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore is a store of objects by key, such as an S3 bucket.
+type ObjectStore interface {
+	// GetObject returns the object with the given key, or fails with
+	// ErrObjectNotFound.
+	GetObject(key string) ([]byte, error)
+	// PutObject stores data as the object with the given key, replacing
+	// any object it had.
+	PutObject(key string, data []byte) error
+}
+
+// MemoryObjectStore is an ObjectStore holding its objects in memory. It is
+// safe for concurrent use.
+type MemoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemoryObjectStore returns an empty MemoryObjectStore.
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{objects: map[string][]byte{}}
+}
+
+// GetObject returns a copy of the object with the given key.
+func (s *MemoryObjectStore) GetObject(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return append([]byte{}, data...), nil
+}
+
+// PutObject stores a copy of data as the object with the given key.
+func (s *MemoryObjectStore) PutObject(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte{}, data...)
+	return nil
+}
+
+// Keys returns the keys of the objects in the store, sorted.
+func (s *MemoryObjectStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const (
+	// DefaultObjectChunkBlocks is the number of blocks an
+	// ObjectStoreBlockDevice keeps per object unless told otherwise, 1 MiB
+	// worth.
+	DefaultObjectChunkBlocks = 256
+	// DefaultObjectCacheChunks is the number of objects an
+	// ObjectStoreBlockDevice caches unless told otherwise.
+	DefaultObjectCacheChunks = 16
+	// DefaultObjectFlushWorkers is the number of objects an
+	// ObjectStoreBlockDevice writes at once unless told otherwise.
+	DefaultObjectFlushWorkers = 8
+
+	// objectManifestKey is the key, under the prefix, of the manifest.
+	objectManifestKey = "manifest.json"
+)
+
+// ObjectDeviceOptions configures OpenObjectStoreBlockDevice.
+type ObjectDeviceOptions struct {
+	// Prefix is prepended to the keys of the objects of the device, so
+	// several devices can share a store.
+	Prefix string
+	// Blocks is the size of the device, in blocks. It is needed to create
+	// a device, and must match the size of an existing one, if it is set.
+	Blocks uint64
+	// ChunkBlocks is the number of consecutive blocks each object holds
+	// when creating a device, or DefaultObjectChunkBlocks if it is 0.
+	// Existing devices keep theirs.
+	ChunkBlocks int
+	// CacheChunks is the number of objects cached in memory, or
+	// DefaultObjectCacheChunks if it is 0.
+	CacheChunks int
+	// FlushWorkers is the number of objects Sync writes at once, or
+	// DefaultObjectFlushWorkers if it is 0.
+	FlushWorkers int
+}
+
+// objectManifest describes an ObjectStoreBlockDevice; it is stored with
+// its objects.
+type objectManifest struct {
+	Blocks      uint64 `json:"blocks"`
+	ChunkBlocks int    `json:"chunkBlocks"`
+}
+
+// ObjectStoreBlockDevice is a BlockDevice whose blocks live in an
+// ObjectStore, such as an S3 bucket, so images can live in cloud storage.
+// Consecutive blocks are grouped into chunks stored as one object each,
+// keyed by the prefix and the chunk number in hexadecimal, next to a
+// manifest recording the size of the device. Chunks that were never
+// written aren't stored, and read as zeros.
+//
+// Chunks are cached in memory, and writes only reach the store when Sync
+// writes back the dirty chunks, several at once, or when a dirty chunk is
+// evicted to make room for another. Like CachedBlockDevice, it relies on
+// the FileSystem syncing it where writes must be stable.
+//
+// It is safe for concurrent use, but serves one operation at a time.
+type ObjectStoreBlockDevice struct {
+	store    ObjectStore
+	prefix   string
+	manifest objectManifest
+	capacity int
+	workers  int
+
+	mu     sync.Mutex
+	chunks map[uint64]*list.Element
+	// lru orders the cached chunks from most to least recently used
+	lru   *list.List
+	stats ObjectStoreStats
+}
+
+// ObjectStoreStats counts what an ObjectStoreBlockDevice did.
+type ObjectStoreStats struct {
+	// Gets counts the objects read from the store, and Puts those written.
+	Gets uint64
+	Puts uint64
+}
+
+type cachedChunk struct {
+	index uint64
+	data  []byte
+	// dirty is set on chunks written since they were last stored
+	dirty bool
+}
+
+// OpenObjectStoreBlockDevice opens the device stored in store under
+// opts.Prefix, creating it if the store holds no device there.
+func OpenObjectStoreBlockDevice(store ObjectStore, opts ObjectDeviceOptions) (*ObjectStoreBlockDevice, error) {
+	dev := &ObjectStoreBlockDevice{
+		store:    store,
+		prefix:   opts.Prefix,
+		capacity: opts.CacheChunks,
+		workers:  opts.FlushWorkers,
+		chunks:   map[uint64]*list.Element{},
+		lru:      list.New(),
+	}
+	if dev.capacity < 1 {
+		dev.capacity = DefaultObjectCacheChunks
+	}
+	if dev.workers < 1 {
+		dev.workers = DefaultObjectFlushWorkers
+	}
+
+	data, err := store.GetObject(dev.prefix + objectManifestKey)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		if opts.Blocks == 0 {
+			return nil, fmt.Errorf("there is no device at %q, and creating one needs its size", dev.prefix)
+		}
+		dev.manifest = objectManifest{Blocks: opts.Blocks, ChunkBlocks: opts.ChunkBlocks}
+		if dev.manifest.ChunkBlocks < 1 {
+			dev.manifest.ChunkBlocks = DefaultObjectChunkBlocks
+		}
+		data, err = json.Marshal(dev.manifest)
+		if err != nil {
+			return nil, err
+		}
+		err = store.PutObject(dev.prefix+objectManifestKey, data)
+		if err != nil {
+			return nil, fmt.Errorf("error writing the manifest of %q: %w", dev.prefix, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error reading the manifest of %q: %w", dev.prefix, err)
+	default:
+		err = json.Unmarshal(data, &dev.manifest)
+		if err != nil || dev.manifest.ChunkBlocks < 1 {
+			return nil, fmt.Errorf("the manifest of %q is malformed", dev.prefix)
+		}
+		if opts.Blocks != 0 && opts.Blocks != dev.manifest.Blocks {
+			return nil, fmt.Errorf("the device at %q has %d blocks, not %d", dev.prefix, dev.manifest.Blocks, opts.Blocks)
+		}
+	}
+	return dev, nil
+}
+
+// ReadBlock reads a block from its cached chunk, fetching the chunk from
+// the store if it isn't cached.
+func (dev *ObjectStoreBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.readBlock(blockNum, buf)
+}
+
+// ReadBlocks reads consecutive blocks, from start on, a block into each
+// buffer, fetching each chunk they are in once.
+func (dev *ObjectStoreBlockDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	for i, buf := range bufs {
+		err := dev.readBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *ObjectStoreBlockDevice) readBlock(blockNum uint64, buf []byte) error {
+	chunk, offset, err := dev.chunk(blockNum)
+	if err != nil {
+		return err
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	copy(buf, chunk.data[offset:])
+	return nil
+}
+
+// WriteBlock writes a block to its cached chunk. It reaches the store on
+// Sync, or earlier if the chunk is evicted. Like ArrayBlockDevice, a buffer
+// shorter than a block only overwrites the start of the block.
+func (dev *ObjectStoreBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.writeBlock(blockNum, buf)
+}
+
+// WriteBlocks writes the buffers to consecutive blocks, from start on, like
+// WriteBlock.
+func (dev *ObjectStoreBlockDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	for i, buf := range bufs {
+		err := dev.writeBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *ObjectStoreBlockDevice) writeBlock(blockNum uint64, buf []byte) error {
+	chunk, offset, err := dev.chunk(blockNum)
+	if err != nil {
+		return err
+	}
+	if len(buf) > BlockSize {
+		buf = buf[:BlockSize]
+	}
+	copy(chunk.data[offset:], buf)
+	chunk.dirty = true
+	return nil
+}
+
+// chunk returns the cached chunk holding a block, and the offset of the
+// block in it, making it the most recently used one.
+func (dev *ObjectStoreBlockDevice) chunk(blockNum uint64) (*cachedChunk, int, error) {
+	if blockNum >= dev.manifest.Blocks {
+		return nil, 0, fmt.Errorf("block %d out of range (device has %d blocks)", blockNum, dev.manifest.Blocks)
+	}
+	per := uint64(dev.manifest.ChunkBlocks)
+	index, offset := blockNum/per, int(blockNum%per)*BlockSize
+	if elem, ok := dev.chunks[index]; ok {
+		dev.lru.MoveToFront(elem)
+		return elem.Value.(*cachedChunk), offset, nil
+	}
+
+	err := dev.makeRoom()
+	if err != nil {
+		return nil, 0, err
+	}
+	dev.stats.Gets++
+	stored, err := dev.store.GetObject(dev.key(index))
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return nil, 0, fmt.Errorf("error reading chunk %d: %w", index, err)
+	}
+	chunk := &cachedChunk{index: index, data: make([]byte, dev.manifest.ChunkBlocks*BlockSize)}
+	copy(chunk.data, stored)
+	dev.chunks[index] = dev.lru.PushFront(chunk)
+	return chunk, offset, nil
+}
+
+// key returns the key of the object holding a chunk.
+func (dev *ObjectStoreBlockDevice) key(index uint64) string {
+	return fmt.Sprintf("%s%016x", dev.prefix, index)
+}
+
+// makeRoom evicts the least recently used chunk if the cache is full,
+// storing it if it is dirty. If that fails, the chunk stays cached.
+func (dev *ObjectStoreBlockDevice) makeRoom() error {
+	if dev.lru.Len() < dev.capacity {
+		return nil
+	}
+	elem := dev.lru.Back()
+	chunk := elem.Value.(*cachedChunk)
+	if chunk.dirty {
+		err := dev.store.PutObject(dev.key(chunk.index), chunk.data)
+		if err != nil {
+			return fmt.Errorf("error writing back chunk %d: %w", chunk.index, err)
+		}
+		dev.stats.Puts++
+	}
+	dev.lru.Remove(elem)
+	delete(dev.chunks, chunk.index)
+	return nil
+}
+
+// Sync writes the dirty chunks to the store, FlushWorkers at once. Chunks
+// that fail to be written stay dirty, and the failure of the lowest one is
+// returned.
+func (dev *ObjectStoreBlockDevice) Sync() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	dirty := []*cachedChunk{}
+	for _, elem := range dev.chunks {
+		if chunk := elem.Value.(*cachedChunk); chunk.dirty {
+			dirty = append(dirty, chunk)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].index < dirty[j].index })
+	errs := make([]error, len(dirty))
+	parallel(dev.workers, len(dirty), func(i int) {
+		errs[i] = dev.store.PutObject(dev.key(dirty[i].index), dirty[i].data)
+	})
+	var first error
+	for i, chunk := range dirty {
+		if errs[i] != nil {
+			if first == nil {
+				first = fmt.Errorf("error writing back chunk %d: %w", chunk.index, errs[i])
+			}
+			continue
+		}
+		chunk.dirty = false
+		dev.stats.Puts++
+	}
+	return first
+}
+
+// Flush is Sync.
+func (dev *ObjectStoreBlockDevice) Flush() error {
+	return dev.Sync()
+}
+
+// Close writes the dirty chunks to the store, like Sync.
+func (dev *ObjectStoreBlockDevice) Close() error {
+	return dev.Sync()
+}
+
+// Stats returns the counts of what the device did so far.
+func (dev *ObjectStoreBlockDevice) Stats() ObjectStoreStats {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.stats
+}
+
+// BlockCount returns the number of blocks of the device.
+func (dev *ObjectStoreBlockDevice) BlockCount() uint64 {
+	return dev.manifest.Blocks
+}
+
+// Size is BlockCount.
+func (dev *ObjectStoreBlockDevice) Size() uint64 {
+	return dev.manifest.Blocks
+}
@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingObjectStore is a MemoryObjectStore whose puts fail while fail is
+// set.
+type failingObjectStore struct {
+	*MemoryObjectStore
+	fail bool
+}
+
+func (s *failingObjectStore) PutObject(key string, data []byte) error {
+	if s.fail {
+		return errInjected
+	}
+	return s.MemoryObjectStore.PutObject(key, data)
+}
+
+func TestObjectStoreBlockDevice(t *testing.T) {
+	store := NewMemoryObjectStore()
+	opts := ObjectDeviceOptions{Prefix: "img/", Blocks: 300, ChunkBlocks: 16, CacheChunks: 4}
+	dev, err := OpenObjectStoreBlockDevice(store, opts)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), dev.BlockCount())
+
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 300})
+	require.NoError(t, err)
+	want := patterned(100 * BlockSize)
+	inode, err := filesystem.CreateFile("/foo", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	// only the chunks written to are stored
+	require.Less(t, len(store.Keys()), 300/16+1)
+	require.Contains(t, store.Keys(), "img/manifest.json")
+	require.Contains(t, store.Keys(), "img/0000000000000000")
+
+	// the device is found again with its size
+	reopened, err := OpenObjectStoreBlockDevice(store, ObjectDeviceOptions{Prefix: "img/"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), reopened.BlockCount())
+	reloaded, err := LoadFilesystem(reopened)
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+	require.Equal(t, uint64(0), reopened.Stats().Puts)
+
+	_, err = OpenObjectStoreBlockDevice(store, ObjectDeviceOptions{Prefix: "img/", Blocks: 200})
+	require.ErrorContains(t, err, "has 300 blocks, not 200")
+	_, err = OpenObjectStoreBlockDevice(store, ObjectDeviceOptions{Prefix: "other/"})
+	require.ErrorContains(t, err, "needs its size")
+	require.Error(t, reopened.ReadBlock(300, make([]byte, BlockSize)))
+}
+
+func TestObjectStoreBlockDeviceWriteBack(t *testing.T) {
+	store := &failingObjectStore{MemoryObjectStore: NewMemoryObjectStore()}
+	dev, err := OpenObjectStoreBlockDevice(store, ObjectDeviceOptions{Blocks: 64, ChunkBlocks: 4, CacheChunks: 2})
+	require.NoError(t, err)
+
+	// writes stay cached until Sync, and short ones only change the start
+	// of the block
+	block := bytes.Repeat([]byte{7}, BlockSize)
+	require.NoError(t, dev.WriteBlock(1, block))
+	require.NoError(t, dev.WriteBlock(1, []byte{1, 2}))
+	require.NoError(t, dev.WriteBlock(5, block))
+	require.Equal(t, uint64(0), dev.Stats().Puts)
+	buf := make([]byte, BlockSize)
+	require.NoError(t, dev.ReadBlock(1, buf))
+	require.Equal(t, append([]byte{1, 2}, block[2:]...), buf)
+
+	// failed flushes leave the chunks dirty
+	store.fail = true
+	require.ErrorIs(t, dev.Sync(), errInjected)
+	// and so does failing to evict one
+	require.ErrorIs(t, dev.WriteBlock(9, block), errInjected)
+	store.fail = false
+	require.NoError(t, dev.Sync())
+	require.Equal(t, uint64(2), dev.Stats().Puts)
+	require.NoError(t, dev.Sync())
+	require.Equal(t, uint64(2), dev.Stats().Puts)
+
+	// evicting a dirty chunk stores it
+	require.NoError(t, dev.WriteBlock(9, block))
+	require.NoError(t, dev.ReadBlock(13, buf))
+	require.NoError(t, dev.ReadBlock(17, buf))
+	require.Equal(t, uint64(3), dev.Stats().Puts)
+	data, err := store.GetObject("0000000000000002")
+	require.NoError(t, err)
+	require.Equal(t, block, data[BlockSize:2*BlockSize])
+	_, err = store.GetObject("0000000000000003")
+	require.ErrorIs(t, err, ErrObjectNotFound)
+
+	// closing writes back the rest
+	require.NoError(t, dev.WriteBlock(17, block))
+	require.NoError(t, dev.Close())
+	data, err = store.GetObject("0000000000000004")
+	require.NoError(t, err)
+	require.Equal(t, block, data[BlockSize:2*BlockSize])
+}
@@ -0,0 +1,150 @@
+package fs
+
+import "fmt"
+
+// maxOrphans is how many inodes the orphan list of the superblock holds.
+// Operations run one at a time and each has an inode or two on the list at
+// most, so it only fills up if cleaning up the list keeps failing.
+const maxOrphans = 64
+
+// Creating a file writes its inode and the bitmaps before the entry of its
+// directory, and deleting one removes the entry before freeing the inode.
+// Without a journal, a crash in between leaves an inode no directory refers
+// to, along with its blocks. So the inode is put on the orphan list of the
+// superblock first, and taken off once the entry is written or the inode
+// freed; mounting frees the inodes left on the list by a crash, see
+// cleanupOrphans.
+//
+// With a journal, each operation is committed whole or not at all, and the
+// list isn't used.
+
+// addOrphan puts an inode on the orphan list, writing the superblock before
+// the operation goes on. If the list is full, the inode is left off it, and
+// a crash leaks it as it would without the list; Fsck still finds it.
+func (fs *FileSystem) addOrphan(inodeIndex int) error {
+	if fs.journal != nil || len(fs.orphans) >= maxOrphans || fs.orphanIndex(inodeIndex) >= 0 {
+		return nil
+	}
+	err := fs.markDirty()
+	if err != nil {
+		return err
+	}
+	fs.explainf("superblock: inode %d is an orphan until the operation is over", inodeIndex)
+	fs.orphans = append(fs.orphans, uint32(inodeIndex))
+	err = fs.writeState(StateDirty)
+	if err != nil {
+		return fmt.Errorf("error adding inode %d to the orphan list: %w", inodeIndex, err)
+	}
+	return nil
+}
+
+// removeOrphan takes an inode off the orphan list, if it is on it.
+func (fs *FileSystem) removeOrphan(inodeIndex int) error {
+	i := fs.orphanIndex(inodeIndex)
+	if i < 0 {
+		return nil
+	}
+	fs.explainf("superblock: inode %d is no longer an orphan", inodeIndex)
+	// snapshots share the list, so it is copied rather than changed
+	orphans := append([]uint32{}, fs.orphans[:i]...)
+	fs.orphans = append(orphans, fs.orphans[i+1:]...)
+	err := fs.writeState(StateDirty)
+	if err != nil {
+		return fmt.Errorf("error removing inode %d from the orphan list: %w", inodeIndex, err)
+	}
+	return nil
+}
+
+// orphanIndex returns the position of an inode in the orphan list, or -1 if
+// it isn't on it.
+func (fs *FileSystem) orphanIndex(inodeIndex int) int {
+	for i, orphan := range fs.orphans {
+		if orphan == uint32(inodeIndex) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameOrphans reports whether two orphan lists are the same.
+func sameOrphans(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanupOrphans frees the inodes left on the orphan list by a crash, with
+// their blocks, and empties the list. Inodes that were freed before the
+// crash, or whose entry was written, are only taken off the list, so the
+// directories are read to find those; this happens only after a crash.
+func (fs *FileSystem) cleanupOrphans() error {
+	if len(fs.orphans) == 0 {
+		return nil
+	}
+	fs.explainOp("cleanupOrphans %v", fs.orphans)
+	referenced := map[uint32]bool{}
+	err := fs.forEachInode(func(i int, inode *Inode) error {
+		if inode.Type != InodeTypeDirectory {
+			return nil
+		}
+		entries, err := fs.readDir(i)
+		if err != nil {
+			return fmt.Errorf("error reading directory %d: %w", i, err)
+		}
+		for _, entry := range entries {
+			referenced[entry.Inode] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error cleaning up orphaned inodes: %w", err)
+	}
+
+	for _, inodeIndex := range fs.orphans {
+		if inodeIndex == 0 || inodeIndex >= fs.geometry.InodeCount || referenced[inodeIndex] {
+			continue
+		}
+		err = fs.freeOrphan(int(inodeIndex))
+		if err != nil {
+			return fmt.Errorf("error cleaning up orphaned inode %d: %w", inodeIndex, err)
+		}
+	}
+	fs.orphans = nil
+	err = fs.markDirty()
+	if err == nil {
+		err = fs.writeState(StateDirty)
+	}
+	if err != nil {
+		return fmt.Errorf("error emptying the orphan list: %w", err)
+	}
+	return nil
+}
+
+// freeOrphan frees an inode on the orphan list that no directory refers to,
+// as deleting its last name would.
+func (fs *FileSystem) freeOrphan(inodeIndex int) (err error) {
+	inode, err := fs.inode(inodeIndex)
+	if err != nil || inode == nil {
+		return err
+	}
+	blocks, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	snapshot := fs.snapshot(inodeIndex)
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+	fs.explainf("freeing orphaned inode %d", inodeIndex)
+	inode.Links = 1
+	return fs.dropLink(snapshot, inode, blocks)
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrphanCleanup(t *testing.T) {
+	old, contents := patterned(2*BlockSize), patterned(3*BlockSize)
+	for _, tt := range []struct {
+		name string
+		run  func(*FileSystem) error
+		// file is the name the run creates, changes or deletes, and before
+		// and after what it holds before and after the run, or nil
+		file          string
+		before, after []byte
+	}{
+		{"create", func(filesystem *FileSystem) error {
+			_, err := filesystem.CreateFile("/dir/new", bytes.NewBuffer(contents))
+			return err
+		}, "/dir/new", nil, contents},
+		{"delete", func(filesystem *FileSystem) error {
+			return filesystem.DeleteFile("/dir/old")
+		}, "/dir/old", old, nil},
+		{"replace", func(filesystem *FileSystem) error {
+			return filesystem.WriteFileAtomic("/dir/old", bytes.NewBuffer(contents))
+		}, "/dir/old", old, contents},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			image := make([]byte, 300*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(image), MkfsOptions{Blocks: 300})
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Mkdir("/dir"))
+			_, err = filesystem.CreateFile("/dir/old", bytes.NewBuffer(old))
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Close())
+
+			// count the writes of a run without a crash
+			dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(bytes.Clone(image)))
+			filesystem, err = LoadFilesystem(dev)
+			require.NoError(t, err)
+			_, before := dev.Operations()
+			require.NoError(t, tt.run(filesystem))
+			_, after := dev.Operations()
+			require.Empty(t, filesystem.orphans)
+
+			listed := false
+			for n := 0; n < after-before; n++ {
+				disk := bytes.Clone(image)
+				dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(disk))
+				filesystem, err := LoadFilesystem(dev)
+				require.NoError(t, err)
+				// the writes dropped from here on are read back by the checks
+				filesystem.SetInvariantChecks(InvariantsOff, nil)
+				dev.CrashAfter(n)
+				tt.run(filesystem)
+				sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+				require.NoError(t, err)
+				listed = listed || len(sb.Orphans) > 0
+
+				// mounting frees the orphans, leaving no inode that no
+				// directory refers to; blocks freed by the run may still be
+				// marked used, which Fsck reports as a warning
+				recovered, err := LoadFilesystemWithOptions(NewArrayBlockDevice(disk), MountOptions{Recovery: RecoveryForce})
+				require.NoError(t, err, "crash after %d writes", n)
+				require.Empty(t, recovered.orphans)
+				data, err := recovered.ReadFile(tt.file)
+				if err != nil {
+					require.ErrorIs(t, err, ErrNotExist, "crash after %d writes", n)
+					data = nil
+				}
+				require.Contains(t, [][]byte{tt.before, tt.after}, data, "crash after %d writes", n)
+				require.NoError(t, recovered.Close())
+				report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+				require.NoError(t, err)
+				require.Empty(t, findingsBySeverity(report.Remaining, SeverityError), "crash after %d writes", n)
+			}
+			require.True(t, listed)
+		})
+	}
+}
+
+func TestOrphanRollback(t *testing.T) {
+	dev := NewFaultInjectingBlockDevice(NewArrayBlockDevice(make([]byte, 300*BlockSize)))
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 300})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	_, err = filesystem.CreateFile("/dir/old", bytes.NewBufferString("old"))
+	require.NoError(t, err)
+	dir, err := filesystem.FindInodeByName("/dir")
+	require.NoError(t, err)
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+
+	// writing the directory fails, so the new file is never linked
+	dev.Inject(Fault{Kind: FaultFail, Write: true, Blocks: []uint64{uint64(dir.Blocks[0])}, Count: 1})
+	_, err = filesystem.CreateFile("/dir/new", bytes.NewBuffer(patterned(3*BlockSize)))
+	require.ErrorIs(t, err, ErrInjectedFault)
+	after, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, stats, after)
+	require.Empty(t, filesystem.orphans)
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Empty(t, sb.Orphans)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestSuperblockOrphans(t *testing.T) {
+	dev := NewArrayBlockDevice(make([]byte, 300*BlockSize))
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: 300})
+	require.NoError(t, err)
+	filesystem.orphans = []uint32{7, 3}
+	require.NoError(t, filesystem.writeState(StateDirty))
+	sb, err := ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{7, 3}, sb.Orphans)
+
+	// inodes on the list that are free are only taken off it
+	filesystem, err = LoadFilesystemWithOptions(dev, MountOptions{Recovery: RecoveryForce})
+	require.NoError(t, err)
+	require.Empty(t, filesystem.orphans)
+	require.NoError(t, filesystem.Close())
+	sb, err = ReadSuperblock(dev)
+	require.NoError(t, err)
+	require.Empty(t, sb.Orphans)
+}
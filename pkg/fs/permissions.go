@@ -0,0 +1,200 @@
+package fs
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"math"
+)
+
+// Every inode has an owner, a user and a group, along with the permission
+// bits in Mode. Owners are kept after the gob encoding like contentSum, and
+// only filesystems of ownerVersion or later have them; inodes without one
+// belong to user and group 0, root.
+//
+// Permissions are only enforced once the filesystem is told who is using it,
+// see SetCredentials, with the rules of Unix: the owner bits apply to the
+// owner, the group bits to members of the group and the others bits to
+// everyone else, and root may do anything. Reading and writing a file need
+// its read and write bits, when it is opened or for calls taking its name;
+// creating, deleting, renaming and linking need the write bit of the
+// directories changed. The search bits of the directories on the way to a
+// file aren't checked.
+
+// ownerVersion is the first format version with owners.
+const ownerVersion = 11
+
+// Permission bits, as checked against the owner, group or others bits of a
+// mode.
+const (
+	accessRead  = 4
+	accessWrite = 2
+)
+
+// Credentials identify who is using the filesystem, for permission checks.
+type Credentials struct {
+	Uid uint32
+	Gid uint32
+	// Groups lists the other groups the user is a member of.
+	Groups []uint32
+}
+
+// inGroup reports whether the credentials are of a member of group gid.
+func (c *Credentials) inGroup(gid uint32) bool {
+	if c.Gid == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCredentials sets who uses the filesystem from now on: permissions are
+// checked against them, and files and directories they create are owned by
+// their user and group. Nil, the default, turns the checks off, and new
+// inodes are owned by root.
+func (fs *FileSystem) SetCredentials(c *Credentials) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if c != nil {
+		copied := *c
+		copied.Groups = append([]uint32{}, c.Groups...)
+		c = &copied
+	}
+	fs.credentials = c
+}
+
+// Owner returns the user and group owning the inode.
+func (inode *Inode) Owner() (uid, gid uint32) {
+	return inode.uid, inode.gid
+}
+
+// Owner returns the user and group owning the file or directory.
+func (fi FileInfo) Owner() (uid, gid uint32) {
+	return fi.inode.Owner()
+}
+
+// checkAccess fails with ErrPermission unless the credentials in effect
+// grant the access bits want on inode.
+func (fs *FileSystem) checkAccess(inode *Inode, want uint32) error {
+	c := fs.credentials
+	if c == nil || c.Uid == 0 {
+		return nil
+	}
+	perm := inode.Mode
+	switch {
+	case c.Uid == inode.uid:
+		perm >>= 6
+	case c.inGroup(inode.gid):
+		perm >>= 3
+	}
+	if perm&want != want {
+		return ErrPermission
+	}
+	return nil
+}
+
+// checkOpenAccess checks the access the flags of OpenFile ask for.
+func (fs *FileSystem) checkOpenAccess(inode *Inode, flag int) error {
+	switch flag & accessModeMask {
+	case O_RDONLY:
+		return fs.checkAccess(inode, accessRead)
+	case O_WRONLY:
+		return fs.checkAccess(inode, accessWrite)
+	default:
+		return fs.checkAccess(inode, accessRead|accessWrite)
+	}
+}
+
+// setOwner makes a new inode owned by the credentials in effect, if the
+// format version records owners.
+func (fs *FileSystem) setOwner(inode *Inode) {
+	if c := fs.credentials; c != nil && fs.version >= ownerVersion {
+		inode.uid, inode.gid = c.Uid, c.Gid
+	}
+}
+
+// Chmod sets the permission bits of the file or directory with the given
+// absolute path. Only its owner and root may change them.
+func (fs *FileSystem) Chmod(path string, mode iofs.FileMode) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Chmod %s %o", path, mode.Perm())
+	defer fs.checkInvariantsAfter("Chmod")()
+
+	inode, err := fs.findInodeOrRoot(path)
+	if err != nil {
+		return fmt.Errorf("error changing the mode of %s: %w", path, err)
+	}
+	if c := fs.credentials; c != nil && c.Uid != 0 && c.Uid != inode.uid {
+		return fmt.Errorf("error changing the mode of %s: %w", path, ErrPermission)
+	}
+	return fs.changeInode(inode, func() {
+		inode.Mode = uint32(mode.Perm())
+	})
+}
+
+// Chown sets the user and group owning the file or directory with the given
+// absolute path; -1 leaves either as it is. Only root may change the user,
+// and the owner may change the group to one of its own. Filesystems older
+// than format version 11 have no owners.
+func (fs *FileSystem) Chown(path string, uid, gid int) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Chown %s %d:%d", path, uid, gid)
+	defer fs.checkInvariantsAfter("Chown")()
+
+	if fs.version < ownerVersion {
+		return fmt.Errorf("error changing the owner of %s: format version %d has no owners, they need version %d", path, fs.version, ownerVersion)
+	}
+	if uid < -1 || int64(uid) > math.MaxUint32 || gid < -1 || int64(gid) > math.MaxUint32 {
+		return fmt.Errorf("error changing the owner of %s: invalid owner %d:%d", path, uid, gid)
+	}
+	inode, err := fs.findInodeOrRoot(path)
+	if err != nil {
+		return fmt.Errorf("error changing the owner of %s: %w", path, err)
+	}
+	newUid, newGid := inode.uid, inode.gid
+	if uid != -1 {
+		newUid = uint32(uid)
+	}
+	if gid != -1 {
+		newGid = uint32(gid)
+	}
+	if c := fs.credentials; c != nil && c.Uid != 0 {
+		if newUid != inode.uid || c.Uid != inode.uid || newGid != inode.gid && !c.inGroup(newGid) {
+			return fmt.Errorf("error changing the owner of %s: %w", path, ErrPermission)
+		}
+	}
+	return fs.changeInode(inode, func() {
+		inode.uid, inode.gid = newUid, newGid
+	})
+}
+
+// changeInode applies change to the attributes of inode and writes it,
+// rolling the change back if that fails.
+func (fs *FileSystem) changeInode(inode *Inode, change func()) (err error) {
+	snapshot := fs.snapshot(int(inode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	change()
+	inode.Changed = fs.now().Unix()
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	return nil
+}
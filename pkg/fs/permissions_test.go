@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChmodChown(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	info, err := filesystem.Stat("/file")
+	require.NoError(t, err)
+	uid, gid := info.Owner()
+	require.Zero(t, uid)
+	require.Zero(t, gid)
+
+	require.NoError(t, filesystem.Chmod("/file", 0600))
+	require.NoError(t, filesystem.Chown("/file", 1000, 100))
+	require.NoError(t, filesystem.Chown("/file", -1, 200))
+	require.NoError(t, filesystem.Chown("/", 1000, -1))
+	require.ErrorIs(t, filesystem.Chmod("/missing", 0600), ErrNotExist)
+	require.Error(t, filesystem.Chown("/file", -2, 0))
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	info, err = reloaded.Stat("/file")
+	require.NoError(t, err)
+	require.Equal(t, "-rw-------", info.Mode().String())
+	uid, gid = info.Owner()
+	require.Equal(t, uint32(1000), uid)
+	require.Equal(t, uint32(200), gid)
+	info, err = reloaded.Stat("/")
+	require.NoError(t, err)
+	uid, gid = info.Owner()
+	require.Equal(t, uint32(1000), uid)
+	require.Zero(t, gid)
+
+	reloaded.version = ownerVersion - 1
+	require.ErrorContains(t, reloaded.Chown("/file", 0, 0), "no owners")
+}
+
+func TestPermissions(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/home"))
+	require.NoError(t, filesystem.Chown("/home", 1000, 100))
+	_, err = filesystem.CreateFile("/root-file", bytes.NewBufferString("root"))
+	require.NoError(t, err)
+
+	owner := &Credentials{Uid: 1000, Gid: 100}
+	filesystem.SetCredentials(owner)
+	_, err = filesystem.CreateFile("/home/file", bytes.NewBufferString("mine"))
+	require.NoError(t, err)
+	info, err := filesystem.Stat("/home/file")
+	require.NoError(t, err)
+	uid, gid := info.Owner()
+	require.Equal(t, uint32(1000), uid)
+	require.Equal(t, uint32(100), gid)
+	require.NoError(t, filesystem.Chmod("/home/file", 0640))
+
+	// the root directory and its files are root's
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("x"))
+	require.ErrorIs(t, err, ErrPermission)
+	require.ErrorIs(t, filesystem.Mkdir("/dir"), ErrPermission)
+	require.ErrorIs(t, filesystem.DeleteFile("/root-file"), ErrPermission)
+	require.ErrorIs(t, filesystem.Rename("/home/file", "/file"), ErrPermission)
+	require.ErrorIs(t, filesystem.Link("/home/file", "/file"), ErrPermission)
+	require.ErrorIs(t, filesystem.Append("/root-file", []byte("x")), ErrPermission)
+	require.ErrorIs(t, filesystem.Truncate("/root-file", 0), ErrPermission)
+	require.ErrorIs(t, filesystem.Chmod("/root-file", 0777), ErrPermission)
+	require.ErrorIs(t, filesystem.Chown("/home/file", 1001, -1), ErrPermission)
+	require.ErrorIs(t, filesystem.Chown("/home/file", -1, 300), ErrPermission)
+	_, err = filesystem.OpenFile("/root-file", O_WRONLY, 0)
+	require.ErrorIs(t, err, ErrPermission)
+	file, err := filesystem.OpenFile("/root-file", O_RDONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// members of the group may read, others nothing
+	filesystem.SetCredentials(&Credentials{Uid: 1001, Gid: 500, Groups: []uint32{100}})
+	file, err = filesystem.OpenFile("/home/file", O_RDONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.ErrorIs(t, filesystem.Append("/home/file", []byte("x")), ErrPermission)
+	require.ErrorIs(t, filesystem.SetXattr("/home/file", "user.x", nil), ErrPermission)
+	filesystem.SetCredentials(&Credentials{Uid: 1002, Gid: 500})
+	_, err = filesystem.OpenFile("/home/file", O_RDONLY, 0)
+	require.ErrorIs(t, err, ErrPermission)
+	require.ErrorIs(t, filesystem.CopyFile("/home/file", "/home/copy"), ErrPermission)
+
+	// the owner may do as the bits say
+	filesystem.SetCredentials(owner)
+	require.NoError(t, filesystem.Append("/home/file", []byte("!")))
+	require.NoError(t, filesystem.Rename("/home/file", "/home/renamed"))
+	require.NoError(t, filesystem.DeleteFile("/home/renamed"))
+
+	// root and no credentials skip the checks
+	filesystem.SetCredentials(&Credentials{})
+	require.NoError(t, filesystem.Append("/root-file", []byte("x")))
+	filesystem.SetCredentials(nil)
+	require.NoError(t, filesystem.DeleteFile("/root-file"))
+}
@@ -0,0 +1,40 @@
+package fs
+
+// Progress describes how far a long-running operation (import/export, fsck,
+// scrub, migrate, defrag) has come.
+type Progress struct {
+	// Op names the operation reporting progress, e.g. "fsck" or "export".
+	Op string
+	// Items is the number of items (files, inodes or blocks, depending on
+	// the operation) processed so far.
+	Items int
+	// TotalItems is the number of items the operation expects to process,
+	// or 0 if it isn't known up front.
+	TotalItems int
+	// Bytes is the number of bytes moved so far.
+	Bytes int64
+}
+
+// ProgressFunc receives progress updates from long-running operations.
+// Operations call it after every processed item, so it should return quickly.
+// A nil ProgressFunc disables reporting.
+type ProgressFunc func(Progress)
+
+// report calls fn with p, doing nothing if fn is nil.
+func (fn ProgressFunc) report(p Progress) {
+	if fn != nil {
+		fn(p)
+	}
+}
+
+// ProgressChannel returns a ProgressFunc that forwards updates to ch.
+// Sends never block: if ch is full the update is dropped, which is fine since
+// every update carries the running totals.
+func ProgressChannel(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressChannel(t *testing.T) {
+	ch := make(chan Progress, 1)
+	fn := ProgressChannel(ch)
+
+	// the first update fits in the channel
+	fn.report(Progress{Op: "test", Items: 1, Bytes: 10})
+	// the second one is dropped instead of blocking
+	fn.report(Progress{Op: "test", Items: 2, Bytes: 20})
+
+	p := <-ch
+	require.Equal(t, "test", p.Op)
+	require.Equal(t, 1, p.Items)
+	require.Equal(t, int64(10), p.Bytes)
+	require.Equal(t, 0, len(ch))
+
+	// a nil ProgressFunc is a no-op
+	var none ProgressFunc
+	none.report(Progress{Items: 1})
+}
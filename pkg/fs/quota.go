@@ -0,0 +1,360 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Directories can carry a quota limiting the bytes of the files and the
+// number of inodes anywhere below them, see SetQuota. Every inode records
+// the nearest quota directory above it, the one it is charged to, and
+// quota directories record the one they are charged to in turn, so a
+// change is charged up the chain without walking paths. Both are kept after
+// the gob encoding like contentSum, and only filesystems of quotaVersion or
+// later have them.
+//
+// Usage counts the sizes of the files, not the blocks they take, and every
+// file and directory below the quota directory, but not the directory
+// itself. A file with several names is charged once, to the quota directory
+// of the name it was created with; as files and directories can't be moved
+// or linked across quota directories, see ErrCrossQuota, every name of a
+// file stays below it, unless the quota is set on a directory holding only
+// some of the names.
+
+// quotaVersion is the first format version with quotas.
+const quotaVersion = 8
+
+var (
+	// ErrQuotaExceeded is returned by operations that would take the usage
+	// of a quota directory past one of its limits. The operation is rolled
+	// back.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrCrossQuota is returned when renaming or linking a file into a
+	// directory charged to another quota directory, like renaming across
+	// filesystems.
+	ErrCrossQuota = errors.New("can't move or link across quota directories")
+)
+
+// Quota holds the limits of a quota directory. Zero means no limit.
+type Quota struct {
+	// MaxBytes limits the sum of the sizes of the files below the
+	// directory.
+	MaxBytes uint64
+	// MaxInodes limits the number of files and directories below it.
+	MaxInodes uint64
+}
+
+// QuotaUsage is the quota of a directory and how much of it is used.
+type QuotaUsage struct {
+	Quota
+	// Bytes is the sum of the sizes of the files below the directory.
+	Bytes uint64
+	// Inodes is the number of files and directories below it.
+	Inodes uint64
+}
+
+// SetQuota sets the quota of the directory with the given absolute name,
+// replacing any quota it had; the zero Quota removes it. Setting a quota
+// on a directory without one counts the usage of everything below it, which
+// may already be past the limits; only growing further fails. Quotas nest:
+// a change below several quota directories is charged to each of them.
+// Filesystems older than format version 8 have no quotas.
+func (fs *FileSystem) SetQuota(dirname string, quota Quota) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("SetQuota %s", dirname)
+	defer fs.checkInvariantsAfter("SetQuota")()
+
+	if fs.version < quotaVersion {
+		return fmt.Errorf("error setting the quota of %s: format version %d has no quotas, they need version %d", dirname, fs.version, quotaVersion)
+	}
+	dir, err := fs.findDir(dirname)
+	if err != nil {
+		return fmt.Errorf("error setting the quota of %s: %w", dirname, err)
+	}
+	if !dir.quotaSet && quota == (Quota{}) {
+		return nil
+	}
+
+	snapshot := fs.snapshot(int(dir.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	switch {
+	case dir.quotaSet && quota != (Quota{}):
+		dir.quota.Quota = quota
+	case dir.quotaSet:
+		// what was charged to dir goes to the quota directory above it
+		_, err = fs.rechargeQuota(snapshot, dir, dir.Index, true, dir.quotaDir, dir.inQuota)
+		if err != nil {
+			return fmt.Errorf("error removing the quota of %s: %w", dirname, err)
+		}
+		dir.quota, dir.quotaSet = QuotaUsage{}, false
+	default:
+		usage, err := fs.rechargeQuota(snapshot, dir, dir.quotaDir, dir.inQuota, dir.Index, true)
+		if err != nil {
+			return fmt.Errorf("error setting the quota of %s: %w", dirname, err)
+		}
+		usage.Quota = quota
+		dir.quota, dir.quotaSet = usage, true
+	}
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	return nil
+}
+
+// GetQuotaUsage returns the quota of the directory with the given absolute
+// name and its usage. It fails if the directory has no quota.
+func (fs *FileSystem) GetQuotaUsage(dirname string) (QuotaUsage, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	dir, err := fs.findDir(dirname)
+	if err != nil {
+		return QuotaUsage{}, fmt.Errorf("error reading the quota of %s: %w", dirname, err)
+	}
+	if !dir.quotaSet {
+		return QuotaUsage{}, fmt.Errorf("error reading the quota of %s: the directory has no quota", dirname)
+	}
+	return dir.quota, nil
+}
+
+// quotaOwner returns the quota directory charged for what is created in dir:
+// dir itself if it has a quota, or else the one dir is charged to, if any.
+func quotaOwner(dir *Inode) (uint32, bool) {
+	if dir.quotaSet {
+		return dir.Index, true
+	}
+	return dir.quotaDir, dir.inQuota
+}
+
+// checkQuotaOwners fails with ErrCrossQuota unless inode, charged as given,
+// can go into dir.
+func checkQuotaOwners(quotaDir uint32, inQuota bool, dir *Inode) error {
+	owner, ok := quotaOwner(dir)
+	if ok != inQuota || ok && owner != quotaDir {
+		return ErrCrossQuota
+	}
+	return nil
+}
+
+// chargeQuota adds bytes and inodes, either of which may be negative, to the
+// usage of the quota directories inode is charged to. Bytes only count for
+// files; callers pass zero for directories. If an increase would take one
+// of them past a limit, nothing is charged and it fails with
+// ErrQuotaExceeded. The quota directories are added to s, so rolling the
+// operation back restores their usage.
+func (fs *FileSystem) chargeQuota(s *metadataSnapshot, inode *Inode, bytes, inodes int64) error {
+	if !inode.inQuota || bytes == 0 && inodes == 0 {
+		return nil
+	}
+	dirs := []*Inode{}
+	owner := inode.quotaDir
+	for {
+		if len(dirs) > fs.inodeBitmap.len() {
+			return corruptf("the quota directories above inode %d form a loop", inode.Index)
+		}
+		dir, err := fs.allocatedInode(int(owner))
+		if err != nil {
+			return fmt.Errorf("error reading quota directory %d: %w", owner, err)
+		}
+		if !dir.quotaSet {
+			return corruptf("inode %d is charged to inode %d, which has no quota", inode.Index, owner)
+		}
+		// pinned, so loading the next one doesn't evict it
+		fs.include(s, int(owner))
+		q := dir.quota
+		if bytes > 0 && q.MaxBytes != 0 && q.Bytes+uint64(bytes) > q.MaxBytes {
+			return fmt.Errorf("%d more bytes below %s, using %d of %d: %w", bytes, dir.Filename, q.Bytes, q.MaxBytes, ErrQuotaExceeded)
+		}
+		if inodes > 0 && q.MaxInodes != 0 && q.Inodes+uint64(inodes) > q.MaxInodes {
+			return fmt.Errorf("%d more inodes below %s, using %d of %d: %w", inodes, dir.Filename, q.Inodes, q.MaxInodes, ErrQuotaExceeded)
+		}
+		dirs = append(dirs, dir)
+		if !dir.inQuota {
+			break
+		}
+		owner = dir.quotaDir
+	}
+	for _, dir := range dirs {
+		dir.quota.Bytes = addUsage(dir.quota.Bytes, bytes)
+		dir.quota.Inodes = addUsage(dir.quota.Inodes, inodes)
+	}
+	return nil
+}
+
+// addUsage adds delta to usage, stopping at zero.
+func addUsage(usage uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > usage {
+		return 0
+	}
+	return usage + uint64(delta)
+}
+
+// rechargeQuota charges what is below dir and charged to the quota
+// directory from (none unless fromOK) to the quota directory to instead, and
+// returns the usage of everything below dir. Quota directories below dir
+// are recharged, but what is below them stays charged to them; their usage
+// counts for dir. Only the inodes are changed, not the usage of from or to.
+func (fs *FileSystem) rechargeQuota(s *metadataSnapshot, dir *Inode, from uint32, fromOK bool, to uint32, toOK bool) (QuotaUsage, error) {
+	usage := QuotaUsage{}
+	visited := map[uint32]bool{}
+	dirs := []uint32{dir.Index}
+	for len(dirs) > 0 {
+		dirIndex := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		records, err := fs.readDirRecords(int(dirIndex))
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+		for _, record := range records {
+			if visited[uint32(record.inode)] {
+				continue
+			}
+			visited[uint32(record.inode)] = true
+			inode, err := fs.allocatedInode(record.inode)
+			if err != nil {
+				return QuotaUsage{}, err
+			}
+			if inode.inQuota == fromOK && (!fromOK || inode.quotaDir == from) {
+				fs.include(s, record.inode)
+				inode.quotaDir, inode.inQuota = to, toOK
+			}
+			usage.Inodes++
+			switch {
+			case inode.Type == InodeTypeFile:
+				usage.Bytes += uint64(inode.Size)
+			case inode.quotaSet:
+				usage.Bytes += inode.quota.Bytes
+				usage.Inodes += inode.quota.Inodes
+			default:
+				dirs = append(dirs, inode.Index)
+			}
+		}
+	}
+	return usage, nil
+}
+
+// countQuotas counts the usage of every quota directory from the inodes
+// each visits, for checking the usage the directories record. It also
+// returns what is wrong with the charges.
+func countQuotas(each func(fn func(i int, inode *Inode) error) error) (map[uint32]QuotaUsage, []string, error) {
+	type charge struct {
+		index  int
+		owner  uint32
+		bytes  uint64
+		quotas bool
+	}
+	quotaDirs := map[uint32]*Inode{}
+	charges := []charge{}
+	err := each(func(i int, inode *Inode) error {
+		if inode.quotaSet {
+			quotaDirs[uint32(i)] = inode
+		}
+		if inode.inQuota {
+			c := charge{index: i, owner: inode.quotaDir}
+			if inode.Type == InodeTypeFile {
+				c.bytes = uint64(inode.Size)
+			}
+			charges = append(charges, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usage := map[uint32]QuotaUsage{}
+	for index := range quotaDirs {
+		usage[index] = QuotaUsage{}
+	}
+	problems := []string{}
+	for _, c := range charges {
+		owner := c.owner
+		for n := 0; ; n++ {
+			dir, ok := quotaDirs[owner]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("inode %d is charged to inode %d, which has no quota", c.index, owner))
+				break
+			}
+			if n > len(quotaDirs) {
+				problems = append(problems, fmt.Sprintf("the quota directories above inode %d form a loop", c.index))
+				break
+			}
+			u := usage[owner]
+			u.Bytes += c.bytes
+			u.Inodes++
+			usage[owner] = u
+			if !dir.inQuota {
+				break
+			}
+			owner = dir.quotaDir
+		}
+	}
+	return usage, problems, nil
+}
+
+// checkQuotas compares the usage quota directories record with what is
+// charged to them.
+func (fs *FileSystem) checkQuotas(scan *inodeScan) []Finding {
+	findings := []Finding{}
+	counted, problems, _ := countQuotas(scan.forEach)
+	for _, problem := range problems {
+		findings = append(findings, Finding{
+			Severity: SeverityWarning,
+			Check:    "quotas",
+			Message:  problem,
+			Remedy:   "repair the image with fsck, which charges the inode to no quota",
+		})
+	}
+	for i, inode := range scan.inodes {
+		if inode == nil || !inode.quotaSet {
+			continue
+		}
+		if u := counted[uint32(i)]; u.Bytes != inode.quota.Bytes || u.Inodes != inode.quota.Inodes {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Check:    "quotas",
+				Message: fmt.Sprintf("directory %d (%s) records a quota usage of %d bytes and %d inodes, but %d bytes and %d inodes are charged to it",
+					i, inode.Filename, inode.quota.Bytes, inode.quota.Inodes, u.Bytes, u.Inodes),
+				Remedy: "repair the image with fsck, which recounts the usage",
+			})
+		}
+	}
+	return findings
+}
+
+// repairQuotas charges inodes charged to directories without a quota to no
+// quota, and recounts the usage of the quota directories.
+func (fs *FileSystem) repairQuotas(inodes []*Inode, fixed func(string, ...interface{})) {
+	for i, inode := range inodes {
+		if inode == nil || !inode.inQuota {
+			continue
+		}
+		if int(inode.quotaDir) >= len(inodes) || inodes[inode.quotaDir] == nil || !inodes[inode.quotaDir].quotaSet {
+			fixed("inode %d: charged it to no quota instead of inode %d, which has none", i, inode.quotaDir)
+			inode.quotaDir, inode.inQuota = 0, false
+		}
+	}
+	scan := &inodeScan{inodes: inodes}
+	counted, _, _ := countQuotas(scan.forEach)
+	for i, inode := range inodes {
+		if inode == nil || !inode.quotaSet {
+			continue
+		}
+		if u := counted[uint32(i)]; u.Bytes != inode.quota.Bytes || u.Inodes != inode.quota.Inodes {
+			fixed("directory %d: recounted its quota usage as %d bytes and %d inodes", i, u.Bytes, u.Inodes)
+			inode.quota.Bytes, inode.quota.Inodes = u.Bytes, u.Inodes
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 400})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/q"))
+	require.NoError(t, filesystem.SetQuota("/q", Quota{MaxBytes: 100, MaxInodes: 3}))
+
+	_, err = filesystem.CreateFile("/q/a", bytes.NewBuffer(make([]byte, 60)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/q/b", bytes.NewBuffer(make([]byte, 50)))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = filesystem.FindInodeByName("/q/b")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.ErrorIs(t, filesystem.WriteAt("/q/a", make([]byte, 10), 95), ErrQuotaExceeded)
+	require.NoError(t, filesystem.Append("/q/a", make([]byte, 40)))
+
+	require.NoError(t, filesystem.Mkdir("/q/d"))
+	_, err = filesystem.CreateFile("/q/d/c", &bytes.Buffer{})
+	require.NoError(t, err)
+	require.ErrorIs(t, filesystem.Mkdir("/q/d/e"), ErrQuotaExceeded)
+	usage, err := filesystem.GetQuotaUsage("/q")
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{Quota: Quota{MaxBytes: 100, MaxInodes: 3}, Bytes: 100, Inodes: 3}, usage)
+
+	// outside the quota directory, nothing is limited
+	_, err = filesystem.CreateFile("/big", bytes.NewBuffer(make([]byte, 1000)))
+	require.NoError(t, err)
+
+	// shrinking and deleting give the space back
+	require.NoError(t, filesystem.Truncate("/q/a", 30))
+	require.NoError(t, filesystem.DeleteFile("/q/d/c"))
+	usage, err = filesystem.GetQuotaUsage("/q")
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), usage.Bytes)
+	require.Equal(t, uint64(2), usage.Inodes)
+	require.NoError(t, filesystem.CheckInvariants())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	reloadedUsage, err := reloaded.GetQuotaUsage("/q")
+	require.NoError(t, err)
+	require.Equal(t, usage, reloadedUsage)
+	_, err = reloaded.GetQuotaUsage("/")
+	require.ErrorContains(t, err, "no quota")
+	report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Remaining)
+}
+
+func TestQuotaNested(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/a"))
+	require.NoError(t, filesystem.Mkdir("/a/b"))
+	require.NoError(t, filesystem.Mkdir("/a/b/c"))
+	_, err = filesystem.CreateFile("/a/one", bytes.NewBufferString("1"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/a/b/c/two", bytes.NewBufferString("22"))
+	require.NoError(t, err)
+
+	// setting a quota counts what is already there, quotas below included
+	require.NoError(t, filesystem.SetQuota("/a/b", Quota{MaxInodes: 10}))
+	require.NoError(t, filesystem.SetQuota("/a", Quota{MaxBytes: 10}))
+	inner, err := filesystem.GetQuotaUsage("/a/b")
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{Quota: Quota{MaxInodes: 10}, Bytes: 2, Inodes: 2}, inner)
+	outer, err := filesystem.GetQuotaUsage("/a")
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{Quota: Quota{MaxBytes: 10}, Bytes: 3, Inodes: 4}, outer)
+
+	// a change below both is charged to both, and limited by either
+	_, err = filesystem.CreateFile("/a/b/c/three", bytes.NewBufferString("333"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/a/b/four", bytes.NewBufferString("44444"))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	inner, err = filesystem.GetQuotaUsage("/a/b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), inner.Bytes)
+	outer, err = filesystem.GetQuotaUsage("/a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), outer.Bytes)
+	require.Equal(t, uint64(5), outer.Inodes)
+
+	// changing the limits keeps the usage
+	require.NoError(t, filesystem.SetQuota("/a", Quota{MaxBytes: 100}))
+	outer, err = filesystem.GetQuotaUsage("/a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), outer.Bytes)
+
+	// removing the inner quota charges what was below it to the outer one
+	require.NoError(t, filesystem.SetQuota("/a/b", Quota{}))
+	_, err = filesystem.GetQuotaUsage("/a/b")
+	require.Error(t, err)
+	require.NoError(t, filesystem.DeleteFile("/a/b/c/two"))
+	outer, err = filesystem.GetQuotaUsage("/a")
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{Quota: Quota{MaxBytes: 100}, Bytes: 4, Inodes: 4}, outer)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestQuotaCrossing(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/q"))
+	require.NoError(t, filesystem.Mkdir("/q/d"))
+	require.NoError(t, filesystem.SetQuota("/q", Quota{MaxInodes: 100}))
+	_, err = filesystem.CreateFile("/q/file", &bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/outside", &bytes.Buffer{})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.Rename("/q/file", "/file"), ErrCrossQuota)
+	require.ErrorIs(t, filesystem.Rename("/outside", "/q/outside"), ErrCrossQuota)
+	require.ErrorIs(t, filesystem.Link("/q/file", "/file"), ErrCrossQuota)
+	require.ErrorIs(t, filesystem.Link("/outside", "/q/outside"), ErrCrossQuota)
+
+	// moving and linking below the same quota directory is fine, and so is
+	// moving the quota directory itself
+	require.NoError(t, filesystem.Rename("/q/file", "/q/d/file"))
+	require.NoError(t, filesystem.Link("/q/d/file", "/q/again"))
+	require.NoError(t, filesystem.Rename("/q", "/renamed"))
+	usage, err := filesystem.GetQuotaUsage("/renamed")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), usage.Inodes)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestQuotaTxnRollback(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/q"))
+	require.NoError(t, filesystem.SetQuota("/q", Quota{MaxBytes: 10}))
+
+	txn := filesystem.Begin()
+	_, err = txn.Create("/q/a", strings.NewReader("hello"))
+	require.NoError(t, err)
+	_, err = txn.Create("/q/b", strings.NewReader("hello!"))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	usage, err := filesystem.GetQuotaUsage("/q")
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{Quota: Quota{MaxBytes: 10}}, usage)
+}
+
+func TestQuotaOlderVersions(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	filesystem.version = quotaVersion - 1
+	require.ErrorContains(t, filesystem.SetQuota("/", Quota{MaxInodes: 1}), "no quotas")
+}
+
+func TestQuotaRepair(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/q"))
+	require.NoError(t, filesystem.SetQuota("/q", Quota{MaxBytes: 100}))
+	_, err = filesystem.CreateFile("/q/a", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	dir, err := filesystem.FindInodeByName("/q")
+	require.NoError(t, err)
+	dir.quota.Bytes = 42
+	require.NoError(t, filesystem.WriteInodeTable())
+	require.ErrorContains(t, filesystem.CheckInvariants(), "records a quota usage of 42 bytes")
+	require.NoError(t, filesystem.Close())
+
+	report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, "quotas", report.Problems[0].Check)
+	require.Contains(t, report.Repairs, "directory 1: recounted its quota usage as 5 bytes and 1 inodes")
+	require.Empty(t, report.Remaining)
+}
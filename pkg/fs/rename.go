@@ -0,0 +1,164 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Rename moves the file or directory oldPath to newPath, both absolute,
+// possibly into another directory. It fails with ErrExist if newPath is
+// taken, and with ErrCrossQuota if the new directory is charged to another
+// quota directory, see SetQuota. Open Files keep working. On write-once
+// filesystems, renaming a file fails with ErrWORM until its retention
+// period has passed.
+//
+// Across directories, the new entry is added before the old one is removed,
+// so a crash midway leaves the file under both names rather than under none.
+func (fs *FileSystem) Rename(oldPath, newPath string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Rename %s -> %s", oldPath, newPath)
+	defer fs.checkInvariantsAfter("Rename")()
+
+	oldParent, err := fs.findParent(oldPath)
+	if err != nil {
+		return fmt.Errorf("error renaming %s: %w", oldPath, err)
+	}
+	oldName := baseName(oldPath)
+	inode, err := fs.lookup(int(oldParent.Index), oldName)
+	if err != nil {
+		return fmt.Errorf("error renaming %s: %w", oldPath, err)
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		return fmt.Errorf("error renaming %s: can't move it into itself", oldPath)
+	}
+
+	newParent, err := fs.findParent(newPath)
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", oldPath, newPath, err)
+	}
+	if newParent.Type != InodeTypeDirectory {
+		return fmt.Errorf("error renaming %s to %s: parent: %w", oldPath, newPath, ErrNotDirectory)
+	}
+	err = fs.checkAccess(oldParent, accessWrite)
+	if err == nil {
+		err = fs.checkAccess(newParent, accessWrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", oldPath, newPath, err)
+	}
+	newName := baseName(newPath)
+	err = checkName(newName)
+	if err != nil {
+		return fmt.Errorf("error renaming %s: %w", oldPath, err)
+	}
+	_, err = fs.lookup(int(newParent.Index), newName)
+	if err == nil {
+		return fmt.Errorf("error renaming %s to %s: %w", oldPath, newPath, ErrExist)
+	}
+	if !errors.Is(err, ErrNotExist) {
+		return err
+	}
+	err = fs.checkRetained(inode)
+	if err != nil {
+		return fmt.Errorf("error renaming %s: %w", oldPath, err)
+	}
+	if oldParent.Index != newParent.Index {
+		owner, ok := quotaOwner(oldParent)
+		err = checkQuotaOwners(owner, ok, newParent)
+		if err != nil {
+			return fmt.Errorf("error renaming %s to %s: %w", oldPath, newPath, err)
+		}
+	}
+
+	snapshot := fs.snapshot(int(inode.Index), int(oldParent.Index), int(newParent.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	inode.Filename = newName
+	inode.Changed = fs.now().Unix()
+	// a longer name may leave no room for the extended attributes
+	if len(inode.xattrs) > 0 && !fs.xattrsFitInline(inode, encodeXattrs(inode.xattrs)) {
+		err = fs.storeXattrs(inode, inode.xattrs)
+		if err != nil {
+			return fmt.Errorf("error moving the attributes of %s: %w", oldPath, err)
+		}
+		err = fs.persistDataBitmap()
+		if err != nil {
+			return fmt.Errorf("error writing data bitmap: %w", err)
+		}
+	}
+	if oldParent.Index == newParent.Index {
+		err = fs.renameEntry(int(oldParent.Index), oldName, newName)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = fs.addFileToDir(int(newParent.Index), int(inode.Index))
+		if err != nil {
+			return fmt.Errorf("error adding %s to its new directory: %w", newPath, err)
+		}
+		err = fs.removeFromDir(int(oldParent.Index), oldName)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	return nil
+}
+
+// renameEntry renames the entry of a directory, rewriting its contents once.
+func (fs *FileSystem) renameEntry(dirInodeIndex int, oldName, newName string) error {
+	records, err := fs.readDirRecords(dirInodeIndex)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range records {
+		if records[i].name == oldName {
+			found = true
+			records[i].name = newName
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("error renaming %s in directory %d: %w", oldName, dirInodeIndex, ErrNotExist)
+	}
+
+	err = fs.writeDirRecords(dirInodeIndex, records)
+	if err != nil {
+		return fmt.Errorf("error updating directory contents: %w", err)
+	}
+	return nil
+}
+
+// checkName checks that name can be stored in a directory entry, see
+// MaxNameLength.
+func checkName(name string) error {
+	if name == "" || len(name) > MaxNameLength || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// baseName returns the last component of an absolute path.
+func baseName(filename string) string {
+	return filename[strings.LastIndexByte(filename, '/')+1:]
+}
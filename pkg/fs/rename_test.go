@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRename(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	f, err := filesystem.Open("/foo", O_RDONLY)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, filesystem.Rename("/foo", "/renamed"))
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, ErrNotExist)
+	inode, err := filesystem.FindInodeByName("/renamed")
+	require.NoError(t, err)
+	require.Equal(t, foo.Index, inode.Index)
+	require.Equal(t, "renamed", inode.Filename)
+	// entries keep their place
+	entries, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Equal(t, "renamed", entries[0].Name)
+	require.Equal(t, "bar", entries[1].Name)
+	// open files keep working
+	buf := make([]byte, 5)
+	_, err = f.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	require.ErrorIs(t, filesystem.Rename("/renamed", "/bar"), ErrExist)
+	require.ErrorIs(t, filesystem.Rename("/missing", "/other"), ErrNotExist)
+	require.ErrorContains(t, filesystem.Rename("/bar", "/"), "invalid name")
+	require.NoError(t, filesystem.Rename("/bar", "/bar"))
+
+	require.NoError(t, filesystem.Close())
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(foo.Index))
+	require.NoError(t, err)
+	require.Equal(t, "hello", contents.String())
+	inode, err = reloaded.FindInodeByName("/renamed")
+	require.NoError(t, err)
+	require.Equal(t, "renamed", inode.Filename)
+}
+
+func TestRenameAcrossDirectories(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	// there is no way to make directories yet, so make one by hand
+	dirIndex, err := filesystem.FindFreeInode()
+	require.NoError(t, err)
+	filesystem.inodes.put(dirIndex, &Inode{Index: uint32(dirIndex), Type: InodeTypeDirectory, Filename: "dir"})
+	filesystem.setInodeAllocated(dirIndex, true)
+	require.NoError(t, filesystem.AddFileToDir(0, dirIndex))
+
+	require.NoError(t, filesystem.Rename("/foo", "/dir/moved"))
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, ErrNotExist)
+	inode, err := filesystem.FindInodeByName("/dir/moved")
+	require.NoError(t, err)
+	require.Equal(t, foo.Index, inode.Index)
+	require.NoError(t, filesystem.CheckInvariants())
+
+	require.ErrorContains(t, filesystem.Rename("/dir", "/dir/sub"), "into itself")
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("file"))
+	require.NoError(t, err)
+	require.ErrorIs(t, filesystem.Rename("/dir/moved", "/file/x"), ErrNotDirectory)
+}
+
+func TestRenameRollback(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	// writing the directory fails
+	dev.failWriteAt = dev.writes + 1
+	require.ErrorIs(t, filesystem.Rename("/foo", "/bar"), errInjected)
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", inode.Filename)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestRenameWORM(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{WORM: true})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/audit", bytes.NewBufferString("entry"))
+	require.NoError(t, err)
+	require.ErrorIs(t, filesystem.Rename("/audit", "/other"), ErrWORM)
+}
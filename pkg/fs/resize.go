@@ -0,0 +1,328 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// Resize changes the number of blocks a filesystem spans, like resize2fs.
+// Only the data region changes size: the regions before it stay where they
+// are, so growing is bounded by the room the data bitmap and the checksum
+// and dedup tables were given when formatting, see maxBlockCount.
+//
+// Growing extends the data bitmap with free entries and then records the
+// new block count in the superblock. Shrinking first moves the blocks of
+// every inode with blocks past the new end, one inode at a time, to free
+// blocks before it, each move an operation of its own as in Defrag; the
+// blocks past the end are kept out of the free-space index meanwhile, so
+// nothing is allocated there. Once they are all free, the data bitmap is cut
+// short and the superblock records the new block count. Until the
+// superblock is written the filesystem keeps its old size, so an
+// interruption leaves it whole, with some inodes moved.
+
+// maxBlockCount returns the most blocks the filesystem can span without
+// moving the regions before the data blocks: as many as the data bitmap and
+// the checksum and dedup tables, if there are any, have room for.
+func (g Geometry) maxBlockCount() uint32 {
+	n := uint64(g.InodeTableStart-g.DataBitmapStart)*uint64(entriesPerBlock(g.PackedBitmaps)) + uint64(g.DataStart)
+	if g.ChecksumBlocks > 0 && uint64(g.ChecksumBlocks)*checksumsPerBlock < n {
+		n = uint64(g.ChecksumBlocks) * checksumsPerBlock
+	}
+	if g.DedupBlocks > 0 && uint64(g.DedupBlocks)*dedupEntriesPerBlock+uint64(g.DataStart) < n {
+		n = uint64(g.DedupBlocks)*dedupEntriesPerBlock + uint64(g.DataStart)
+	}
+	if n > 1<<32-1 {
+		n = 1<<32 - 1
+	}
+	return uint32(n)
+}
+
+// Resize grows or shrinks the filesystem to span newBlockCount blocks; see
+// above. Growing fails with ErrGeometry past the most blocks the filesystem
+// can span, and if the device is too small. Shrinking fails with
+// ErrGeometry if too few blocks are left for the data region, and with
+// ErrNoSpace if the blocks past the new end don't fit before it. The device
+// isn't truncated; the blocks past the new end are merely left unused.
+func (fs *FileSystem) Resize(newBlockCount uint64) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Resize to %d blocks", newBlockCount)
+	defer fs.checkInvariantsAfter("Resize")()
+
+	g := fs.geometry
+	if max := g.maxBlockCount(); newBlockCount > uint64(max) {
+		return fmt.Errorf("%w: can't resize to %d blocks, the data bitmap and checksum table have room for %d",
+			ErrGeometry, newBlockCount, max)
+	}
+	g.BlockCount = uint32(newBlockCount)
+	err = g.check()
+	if err != nil {
+		return err
+	}
+	switch {
+	case g.BlockCount > fs.geometry.BlockCount:
+		return fs.growTo(g)
+	case g.BlockCount < fs.geometry.BlockCount:
+		return fs.shrinkTo(g)
+	}
+	return nil
+}
+
+// growTo makes the filesystem span the blocks of g, which is its geometry
+// with more blocks.
+func (fs *FileSystem) growTo(g Geometry) (err error) {
+	old := fs.geometry
+	if n := deviceSize(fs.dev); n > 0 {
+		if n < uint64(g.BlockCount) {
+			return fmt.Errorf("%w: can't grow to %d blocks, the device only has %d", ErrGeometry, g.BlockCount, n)
+		}
+	} else {
+		err = fs.dev.ReadBlock(uint64(g.BlockCount-1), make([]byte, BlockSize))
+		if err != nil {
+			return fmt.Errorf("error reading block %d, the last of the grown filesystem (is the device too small?): %w", g.BlockCount-1, err)
+		}
+	}
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fs.explainf("failed (%v); keeping %d blocks", err, old.BlockCount)
+			fs.geometry = old
+			fs.dataBitmap.resize(int(old.DataBlocks()))
+			if fs.checksums != nil {
+				fs.checksums.sums = fs.checksums.sums[:old.BlockCount]
+			}
+			if fs.dedup != nil {
+				fs.dedup.resize(int(old.DataBlocks()))
+			}
+		}
+		fs.indexFreeSpace()
+	}()
+
+	// the new blocks hold no metadata yet; their checksums are zeroed, as
+	// the table may hold some from before the filesystem was shrunk
+	if fs.checksums != nil {
+		fs.checksums.sums = append(fs.checksums.sums, make([]uint32, g.BlockCount-old.BlockCount)...)
+		for i := old.BlockCount / checksumsPerBlock; i < checksumBlocksFor(g.BlockCount); i++ {
+			err = fs.writeChecksumBlock(int(i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	fs.explainf("data bitmap: %d -> %d entries", old.DataBlocks(), g.DataBlocks())
+	fs.dataBitmap.resize(int(g.DataBlocks()))
+	err = fs.flushBitmap(fs.dataBitmap)
+	if err != nil {
+		return fmt.Errorf("error writing data bitmap: %w", err)
+	}
+	// the new entries of the dedup table index nothing
+	if fs.dedup != nil {
+		fs.dedup.resize(int(g.DataBlocks()))
+		err = fs.flushDedup()
+		if err != nil {
+			return err
+		}
+	}
+	return fs.writeGeometry(g)
+}
+
+// shrinkTo makes the filesystem span the blocks of g, which is its geometry
+// with fewer blocks, moving the blocks past its end first.
+func (fs *FileSystem) shrinkTo(g Geometry) (err error) {
+	old := fs.geometry
+	// the entries of the data bitmap from limit on are cut off, so the
+	// blocks moved out of them aren't allocated again
+	limit := int(g.DataBlocks())
+	fs.shrinkLimit = limit
+	fs.indexFreeSpace()
+	defer func() {
+		fs.shrinkLimit = 0
+		fs.indexFreeSpace()
+	}()
+
+	used := 0
+	for i := limit; i < fs.dataBitmap.len(); i++ {
+		if fs.dataBitmap.test(i) {
+			used++
+		}
+	}
+	if used > fs.freeBlocks.free {
+		return fmt.Errorf("can't shrink to %d blocks, the %d blocks used past the new end don't fit in the %d free before it: %w",
+			g.BlockCount, used, fs.freeBlocks.free, ErrNoSpace)
+	}
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+
+	moving := []int{}
+	err = fs.forEachInode(func(inodeIndex int, inode *Inode) error {
+		m, err := fs.readBlockMap(inode)
+		if err != nil {
+			return err
+		}
+		for _, blockIndex := range m.owned() {
+			if blockIndex >= g.BlockCount {
+				moving = append(moving, inodeIndex)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, inodeIndex := range moving {
+		err = fs.relocate(inodeIndex, g.BlockCount)
+		// each inode moved is committed on its own, so the journal holds
+		// one inode's worth at a time
+		fs.commit(&err)
+		if err != nil {
+			return err
+		}
+	}
+	for i := limit; i < fs.dataBitmap.len(); i++ {
+		if fs.dataBitmap.test(i) {
+			return corruptf("can't shrink to %d blocks: block %d is used, but by no inode (run fsck)",
+				g.BlockCount, uint32(i)+old.DataStart)
+		}
+	}
+
+	sums := []uint32(nil)
+	if fs.checksums != nil {
+		sums = fs.checksums.sums
+		fs.checksums.sums = sums[:g.BlockCount]
+	}
+	fs.explainf("data bitmap: %d -> %d entries", old.DataBlocks(), g.DataBlocks())
+	fs.dataBitmap.resize(limit)
+	if fs.dedup != nil {
+		fs.dedup.resize(limit)
+	}
+	err = fs.writeGeometry(g)
+	if err != nil {
+		fs.geometry = old
+		fs.dataBitmap.resize(int(old.DataBlocks()))
+		if sums != nil {
+			fs.checksums.sums = sums
+		}
+		if fs.dedup != nil {
+			fs.dedup.resize(int(old.DataBlocks()))
+		}
+	}
+	return err
+}
+
+// writeGeometry commits what was logged and then records g as the geometry
+// in the superblock.
+func (fs *FileSystem) writeGeometry(g Geometry) (err error) {
+	fs.commit(&err)
+	if err != nil {
+		return err
+	}
+	fs.explainf("superblock: %d -> %d blocks", fs.geometry.BlockCount, g.BlockCount)
+	fs.geometry = g
+	err = fs.writeState(StateDirty)
+	if err != nil {
+		return fmt.Errorf("error writing superblock: %w", err)
+	}
+	return nil
+}
+
+// relocate moves the blocks of an inode at or past limit to free blocks
+// before it. The pointer or extent blocks are written afresh, as in
+// defragFile; the xattr block is stored again.
+func (fs *FileSystem) relocate(inodeIndex int, limit uint32) (err error) {
+	fs.explainf("relocate inode %d", inodeIndex)
+	inode, err := fs.inode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	snapshot := fs.snapshot(inodeIndex)
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	data := append([]uint32{}, old.data...)
+	from, to := []uint32{}, []uint32{}
+	for _, blockIndex := range old.data {
+		if blockIndex >= limit {
+			from = append(from, blockIndex)
+		}
+	}
+	if len(from) > 0 {
+		to, err = fs.findContiguousBlocks(len(from), nil)
+		if err != nil {
+			return err
+		}
+		for _, blockIndex := range to {
+			fs.setBlockAllocated(blockIndex, true)
+		}
+		err = fs.copyBlocks(inode, from, to)
+		if err != nil {
+			return err
+		}
+		fs.indexCopies(from, to)
+		k := 0
+		for i, blockIndex := range data {
+			if blockIndex >= limit {
+				data[i] = to[k]
+				k++
+			}
+		}
+	}
+	pointers := old.pointers()
+	if len(from) > 0 || anyAtOrPast(pointers, limit) {
+		err = fs.mapBlocks(inode, &blockMap{}, data)
+		if err != nil {
+			return err
+		}
+		// the inode has copies of its own of shared blocks, which just
+		// lose a reference
+		for _, blockIndex := range from {
+			fs.releaseBlock(blockIndex)
+		}
+		for _, blockIndex := range pointers {
+			fs.setBlockAllocated(blockIndex, false)
+		}
+	}
+	if old.xattrs >= limit {
+		xattrs, err := fs.readXattrs(inode)
+		if err != nil {
+			return err
+		}
+		err = fs.storeXattrs(inode, xattrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return fmt.Errorf("error writing data bitmap: %w", err)
+	}
+	return nil
+}
+
+// anyAtOrPast reports whether any of blocks is at or past limit.
+func anyAtOrPast(blocks []uint32, limit uint32) bool {
+	for _, blockIndex := range blocks {
+		if blockIndex >= limit {
+			return true
+		}
+	}
+	return false
+}
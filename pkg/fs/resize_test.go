@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResize(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts MkfsOptions
+		// version, if set, is the format version the filesystem is taken
+		// back to, for pointer blocks
+		version uint32
+	}{
+		{"extents", MkfsOptions{Blocks: 1200}, 0},
+		{"pointers", MkfsOptions{Blocks: 1200}, extentVersion - 1},
+		{"journal", MkfsOptions{Blocks: 1200, JournalBlocks: 32, Checksums: true}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := make([]byte, 2400*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), tt.opts)
+			require.NoError(t, err)
+			if tt.version != 0 {
+				filesystem.version = tt.version
+				require.NoError(t, filesystem.writeState(StateClean))
+			}
+			stats, err := filesystem.Statfs()
+			require.NoError(t, err)
+
+			require.NoError(t, filesystem.Resize(2000))
+			require.Equal(t, uint32(2000), filesystem.Geometry().BlockCount)
+			grown, err := filesystem.Statfs()
+			require.NoError(t, err)
+			require.Equal(t, stats.FreeBlocks+800, grown.FreeBlocks)
+
+			// fill the blocks up to the old end, so what comes next is past
+			// it, then free them
+			_, err = filesystem.CreateFile("/fill", bytes.NewBuffer(make([]byte, int(stats.FreeBlocks)*BlockSize)))
+			require.NoError(t, err)
+			want := patterned((directBlocks + 5) * BlockSize)
+			big, err := filesystem.CreateFile("/big", bytes.NewBuffer(want))
+			require.NoError(t, err)
+			require.Greater(t, big.usedBlocks()[0], uint32(1200))
+			require.NoError(t, filesystem.Mkdir("/dir"))
+			for i := 0; i < 80; i++ {
+				_, err = filesystem.CreateFile(fmt.Sprintf("/dir/entry-with-a-long-name-%d", i), bytes.NewBuffer([]byte{byte(i)}))
+				require.NoError(t, err)
+			}
+			attr := bytes.Repeat([]byte("v"), 2000)
+			if tt.version == 0 {
+				require.NoError(t, filesystem.SetXattr("/big", "user.big", attr))
+			}
+			require.NoError(t, filesystem.DeleteFile("/fill"))
+
+			require.NoError(t, filesystem.Resize(1200))
+			require.Equal(t, uint32(1200), filesystem.Geometry().BlockCount)
+			require.Equal(t, 1200-int(filesystem.Geometry().DataStart), filesystem.dataBitmap.len())
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			require.Equal(t, uint32(1200), reloaded.Geometry().BlockCount)
+			inode, err := reloaded.FindInodeByName("/big")
+			require.NoError(t, err)
+			for _, blockIndex := range inode.usedBlocks() {
+				require.Less(t, blockIndex, uint32(1200))
+			}
+			contents, err := reloaded.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, want, contents.Bytes())
+			if tt.version == 0 {
+				value, err := reloaded.GetXattr("/big", "user.big")
+				require.NoError(t, err)
+				require.Equal(t, attr, value)
+			}
+			entries, err := reloaded.ReadDirByPath("/dir")
+			require.NoError(t, err)
+			require.Len(t, entries, 80)
+			inode, err = reloaded.FindInodeByName("/dir/entry-with-a-long-name-79")
+			require.NoError(t, err)
+			contents, err = reloaded.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, []byte{79}, contents.Bytes())
+			report, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+
+			// and it grows again over the blocks it left
+			require.NoError(t, reloaded.Resize(2000))
+			require.NoError(t, reloaded.Close())
+			report, err = Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+		})
+	}
+}
+
+func TestResizeFragmented(t *testing.T) {
+	for name, opts := range map[string]MkfsOptions{
+		"plain":   {Blocks: 400, InodeRatio: BlockSize},
+		"dedup":   {Blocks: 400, InodeRatio: BlockSize, Dedup: true},
+		"journal": {Blocks: 400, InodeRatio: BlockSize, JournalBlocks: 64, Checksums: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, 500*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), opts)
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Resize(500))
+
+			// fill the blocks up to the old end a block at a time, put
+			// files of several blocks past it, then free every other block
+			// before it, so no hole there fits a whole file
+			fill := []string{}
+			for i := 0; ; i++ {
+				// small directories, for the journal
+				if i%16 == 0 {
+					require.NoError(t, filesystem.Mkdir(fmt.Sprintf("/fill%d", i/16)))
+				}
+				name := fmt.Sprintf("/fill%d/%d", i/16, i)
+				inode, err := filesystem.CreateFile(name, bytes.NewBufferString(name))
+				require.NoError(t, err)
+				fill = append(fill, name)
+				if inode.usedBlocks()[0] >= 400 {
+					break
+				}
+			}
+			want := map[string][]byte{}
+			for i := 0; i < 6; i++ {
+				name := fmt.Sprintf("/moved%d", i)
+				want[name] = patterned(4*BlockSize + i)
+				inode, err := filesystem.CreateFile(name, bytes.NewBuffer(want[name]))
+				require.NoError(t, err)
+				require.GreaterOrEqual(t, inode.usedBlocks()[0], uint32(400))
+			}
+			for i := 0; i < len(fill); i += 2 {
+				require.NoError(t, filesystem.DeleteFile(fill[i]))
+			}
+
+			require.NoError(t, filesystem.Resize(400))
+			require.NoError(t, filesystem.CheckInvariants())
+			for name, contents := range want {
+				data, err := filesystem.ReadFile(name)
+				require.NoError(t, err)
+				require.Equal(t, contents, data)
+			}
+			require.NoError(t, filesystem.Close())
+			report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+		})
+	}
+}
+
+func TestResizeLimits(t *testing.T) {
+	disk := make([]byte, 1200*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 600})
+	require.NoError(t, err)
+	g := filesystem.Geometry()
+
+	// past the device
+	err = filesystem.Resize(1201)
+	require.ErrorIs(t, err, ErrGeometry)
+	// past the room of the data bitmap
+	err = filesystem.Resize(uint64(g.maxBlockCount()) + 1)
+	require.ErrorIs(t, err, ErrGeometry)
+	// no room for data blocks
+	err = filesystem.Resize(uint64(g.DataStart) + 1)
+	require.ErrorIs(t, err, ErrGeometry)
+
+	// more used past the new end than is free before it
+	_, err = filesystem.CreateFile("/a", bytes.NewBuffer(make([]byte, 300*BlockSize)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/b", bytes.NewBuffer(make([]byte, 200*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.DeleteFile("/a"))
+	err = filesystem.Resize(uint64(g.DataStart) + 200)
+	require.ErrorIs(t, err, ErrNoSpace)
+	require.Equal(t, g, filesystem.Geometry())
+	require.NoError(t, filesystem.CheckInvariants())
+	require.Empty(t, filesystem.checkFreeSpaceIndex())
+}
+
+func TestFreeExtentsTruncate(t *testing.T) {
+	f := newFreeExtents(bitmapOf(0, 0, 1, 0, 0, 0, 1, 0))
+	f.truncate(4)
+	require.Equal(t, []extent{{0, 2}, {3, 1}}, f.runs)
+	require.Equal(t, 3, f.free)
+	f.truncate(2)
+	require.Equal(t, []extent{{0, 2}}, f.runs)
+	require.Equal(t, 2, f.free)
+}
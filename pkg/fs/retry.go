@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy controls how a RetryBlockDevice retries failed operations.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times an operation is tried,
+	// including the first try. Values below 1 mean 1.
+	Attempts int
+	// Backoff is how long to wait before the first retry. The wait doubles
+	// after every retry.
+	Backoff time.Duration
+	// Retryable reports whether an error is transient and worth retrying.
+	// If nil, every error is retried.
+	Retryable func(error) bool
+}
+
+// RetryBlockDevice wraps a BlockDevice and retries reads and writes that
+// fail with transient errors, according to its RetryPolicy. When all
+// attempts fail, the error of the last attempt is returned. It is a
+// ContextBlockDevice: once the context of an operation is done, it stops
+// retrying, and passes the context on to the device it wraps.
+type RetryBlockDevice struct {
+	dev    BlockDevice
+	policy RetryPolicy
+	// sleep waits between attempts, until ctx is done; it is replaced in
+	// tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryBlockDevice(dev BlockDevice, policy RetryPolicy) *RetryBlockDevice {
+	return &RetryBlockDevice{dev: dev, policy: policy, sleep: sleepContext}
+}
+
+// ReadBlock reads a block, retrying transient failures.
+func (dev *RetryBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	return dev.ReadBlockCtx(context.Background(), blockNum, buf)
+}
+
+// ReadBlockCtx is ReadBlock under ctx.
+func (dev *RetryBlockDevice) ReadBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	return dev.retry(ctx, func() error {
+		return readBlockContext(ctx, dev.dev, blockNum, buf)
+	})
+}
+
+// WriteBlock writes a block, retrying transient failures.
+func (dev *RetryBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	return dev.WriteBlockCtx(context.Background(), blockNum, buf)
+}
+
+// WriteBlockCtx is WriteBlock under ctx.
+func (dev *RetryBlockDevice) WriteBlockCtx(ctx context.Context, blockNum uint64, buf []byte) error {
+	return dev.retry(ctx, func() error {
+		return writeBlockContext(ctx, dev.dev, blockNum, buf)
+	})
+}
+
+func (dev *RetryBlockDevice) retry(ctx context.Context, op func() error) error {
+	backoff := dev.policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil {
+			return nil
+		}
+		if attempt >= dev.policy.Attempts || ctx.Err() != nil {
+			return err
+		}
+		if dev.policy.Retryable != nil && !dev.policy.Retryable(err) {
+			return err
+		}
+		if backoff > 0 {
+			if dev.sleep(ctx, backoff) != nil {
+				return err
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done, failing with its error.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBlockDevice(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	flaky := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	dev := NewRetryBlockDevice(flaky, RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+	sleeps := []time.Duration{}
+	dev.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	// a single failure is retried transparently
+	flaky.failWriteAt = 1
+	_, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{time.Millisecond}, sleeps)
+
+	// persistent failures are returned after the last attempt, with the
+	// backoff doubling in between
+	sleeps = sleeps[:0]
+	flaky.reads = 0
+	flaky.failReadAt = 1
+	flaky.sticky = true
+	_, err = LoadFilesystem(dev)
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, 3, flaky.reads)
+	require.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond}, sleeps)
+}
+
+func TestRetryBlockDeviceNonRetryable(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	flaky := &failingDevice{BlockDevice: NewArrayBlockDevice(disk), failWriteAt: 1}
+	dev := NewRetryBlockDevice(flaky, RetryPolicy{
+		Attempts:  5,
+		Retryable: func(err error) bool { return !errors.Is(err, errInjected) },
+	})
+
+	_, err := NewFileSystem(dev)
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, 1, flaky.writes)
+}
+
+func TestRetryBlockDeviceContext(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	flaky := &failingDevice{BlockDevice: NewArrayBlockDevice(disk), failReadAt: 1, sticky: true}
+	dev := NewRetryBlockDevice(flaky, RetryPolicy{Attempts: 3, Backoff: time.Hour})
+
+	// the backoff is cut short once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := dev.ReadBlockCtx(ctx, 0, make([]byte, BlockSize))
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, 1, flaky.reads)
+
+	// and nothing is tried after that
+	err = dev.ReadBlockCtx(ctx, 0, make([]byte, BlockSize))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, flaky.reads)
+}
@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Every inode gets a generation number when it is created, from a counter
+// kept in the superblock, so an inode index that is freed and reused comes
+// back with a different generation. Holders of an index, such as open Files,
+// record the generation too and can tell the inode they meant from a new one
+// in the same slot.
+//
+// So that the counter needs no write of its own per inode, marking the
+// filesystem dirty reserves a range of generations and records its end in
+// the superblock; Close records the exact next generation again. After a
+// crash, the counter resumes past the reserved range, and no generation is
+// handed out twice.
+
+// generationReserve is the number of generations reserved at a time.
+const generationReserve = 1024
+
+// InodeReusePolicy controls when freed inode indices can be allocated again.
+// Delaying reuse helps caches that remember indices without generations;
+// reuse never hands out a generation twice either way. The delay lasts for
+// the mount: indices freed before remounting are available right away.
+//
+// The zero value reuses indices as soon as they are freed. If both fields
+// are set, an index is reused once both conditions hold.
+type InodeReusePolicy struct {
+	// Grace keeps freed indices out of use for this long.
+	Grace time.Duration
+	// AfterSync keeps freed indices out of use until the next Sync.
+	AfterSync bool
+}
+
+// quarantinedInode is a freed inode index held back by the reuse policy.
+type quarantinedInode struct {
+	index   int
+	freedAt time.Time
+	// syncs is the number of Syncs done when the index was freed
+	syncs int
+}
+
+// SetInodeReuse sets when freed inode indices are allocated again, including
+// indices already held back.
+func (fs *FileSystem) SetInodeReuse(policy InodeReusePolicy) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.inodeReuse = policy
+}
+
+// Sync flushes the changes made so far to stable storage, on devices that
+// support it, along with the access times recorded by reads, and lets freed
+// inode indices held back until a sync be reused.
+func (fs *FileSystem) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.flushTimes()
+	if err != nil {
+		return err
+	}
+	err = fs.syncDevice()
+	if err != nil {
+		return fmt.Errorf("error syncing device: %w", err)
+	}
+	fs.syncs++
+	return nil
+}
+
+// nextInodeGeneration hands out a generation for a new inode, reserving more
+// in the superblock when the reserved ones run out.
+func (fs *FileSystem) nextInodeGeneration() (uint32, error) {
+	err := fs.markDirty()
+	if err != nil {
+		return 0, err
+	}
+	if fs.nextGeneration >= fs.generationLimit {
+		fs.generationLimit = fs.nextGeneration + generationReserve
+		err = fs.writeState(StateDirty)
+		if err != nil {
+			return 0, fmt.Errorf("error reserving inode generations: %w", err)
+		}
+	}
+	generation := fs.nextGeneration
+	fs.nextGeneration++
+	return generation, nil
+}
+
+// freeInode marks an inode free in the inode bitmap. Under a reuse policy,
+// its index is kept out of the free-space index until the policy lets it go.
+func (fs *FileSystem) freeInode(inodeIndex int) {
+	fs.setInodeAllocated(inodeIndex, false)
+	if fs.inodeReuse == (InodeReusePolicy{}) {
+		return
+	}
+	fs.freeInodes.take(inodeIndex)
+	fs.quarantine = append(fs.quarantine, quarantinedInode{
+		index:   inodeIndex,
+		freedAt: fs.now(),
+		syncs:   fs.syncs,
+	})
+}
+
+// releaseQuarantine returns the held back inode indices whose delay is over
+// to the free-space index.
+func (fs *FileSystem) releaseQuarantine() {
+	kept := fs.quarantine[:0]
+	for _, q := range fs.quarantine {
+		if fs.now().Sub(q.freedAt) < fs.inodeReuse.Grace || fs.inodeReuse.AfterSync && fs.syncs == q.syncs {
+			kept = append(kept, q)
+			continue
+		}
+		// an operation that was rolled back may have allocated it again
+		if !fs.inodeBitmap.test(q.index) {
+			fs.freeInodes.release(q.index)
+		}
+	}
+	fs.quarantine = kept
+}
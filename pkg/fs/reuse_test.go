@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInodeGenerations(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	bar, err := filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), foo.Generation)
+	require.Equal(t, uint32(2), bar.Generation)
+
+	// a clean unmount records the exact next generation
+	require.NoError(t, filesystem.Close())
+	sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), sb.NextGeneration)
+
+	// while mounted, the superblock records the end of the reserved range,
+	// so a crash doesn't hand out generations twice
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	baz, err := filesystem.CreateFile("/baz", bytes.NewBufferString("baz"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), baz.Generation)
+	crashed := bytes.Clone(disk)
+	filesystem, err = LoadFilesystemWithOptions(NewArrayBlockDevice(crashed), MountOptions{Recovery: RecoveryForce})
+	require.NoError(t, err)
+	qux, err := filesystem.CreateFile("/qux", bytes.NewBufferString("qux"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(3+generationReserve), qux.Generation)
+}
+
+func TestInodeGenerationsAreReserved(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	filesystem.nextGeneration = generationReserve
+	filesystem.generationLimit = generationReserve
+
+	// running out of reserved generations reserves more
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	filesystem.nextGeneration = filesystem.generationLimit
+	inode, err := filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, inode.Generation+generationReserve, sb.NextGeneration)
+}
+
+func TestInodeReusePolicy(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		policy InodeReusePolicy
+		// reused says whether the index is reused after each step: right
+		// away, after the grace period and after a sync
+		reused [3]bool
+	}{
+		{InodeReusePolicy{}, [3]bool{true, true, true}},
+		{InodeReusePolicy{Grace: time.Minute}, [3]bool{false, true, true}},
+		{InodeReusePolicy{AfterSync: true}, [3]bool{false, false, true}},
+		{InodeReusePolicy{Grace: time.Minute, AfterSync: true}, [3]bool{false, false, true}},
+	} {
+		t.Run(fmt.Sprintf("%+v", tc.policy), func(t *testing.T) {
+			filesystem := newTestFileSystem(t)
+			filesystem.now = func() time.Time { return now }
+			filesystem.SetInodeReuse(tc.policy)
+			inode, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+			require.NoError(t, err)
+
+			// free the inode; its directory entry stays, as only the
+			// allocator is exercised
+			filesystem.freeInode(int(inode.Index))
+			require.Empty(t, filesystem.checkFreeSpaceIndex())
+			steps := []func(){
+				func() {},
+				func() { filesystem.now = func() time.Time { return now.Add(time.Minute) } },
+				func() { require.NoError(t, filesystem.Sync()) },
+			}
+			for i, step := range steps {
+				step()
+				free, err := filesystem.FindFreeInode()
+				require.NoError(t, err)
+				require.Equal(t, tc.reused[i], free == int(inode.Index), "step %d", i)
+			}
+			require.Empty(t, filesystem.checkFreeSpaceIndex())
+		})
+	}
+}
+
+func TestStaleFile(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	f, err := filesystem.OpenFile("/foo", O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// the inode was freed and its index reused by another file
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	inode.Generation++
+
+	_, err = io.ReadAll(f)
+	require.ErrorIs(t, err, ErrStale)
+	_, err = f.Write([]byte("bar"))
+	require.ErrorIs(t, err, ErrStale)
+}
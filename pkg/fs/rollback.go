@@ -0,0 +1,127 @@
+package fs
+
+import "fmt"
+
+// metadataSnapshot is a copy of the in-memory metadata an operation may
+// modify, taken so the operation can be rolled back if it fails midway.
+type metadataSnapshot struct {
+	inodeBitmap *Bitmap
+	dataBitmap  *Bitmap
+	// dedup holds the entries of the dedup table, if there is one
+	dedup []dedupEntry
+	// inodes maps inode indices to copies of the inodes, or to nil for
+	// inodes that weren't allocated
+	inodes map[int]*Inode
+	// pinned lists the inodes pinned in the cache by snapshot
+	pinned []int
+	// orphans is the orphan list, see orphan.go
+	orphans []uint32
+}
+
+// snapshot copies the bitmaps, the dedup table and the given inodes.
+// Allocated inodes must be loaded already; the others are recorded as
+// unallocated. The loaded inodes stay pinned in the cache until the snapshot
+// is released, so changes to them can't be evicted before they are written.
+func (fs *FileSystem) snapshot(inodeIndices ...int) *metadataSnapshot {
+	s := &metadataSnapshot{
+		inodeBitmap: fs.inodeBitmap.clone(),
+		dataBitmap:  fs.dataBitmap.clone(),
+		inodes:      map[int]*Inode{},
+		orphans:     fs.orphans,
+	}
+	if fs.dedup != nil {
+		s.dedup = fs.dedup.clone()
+	}
+	for _, inodeIndex := range inodeIndices {
+		fs.include(s, inodeIndex)
+	}
+	return s
+}
+
+// include adds an inode to a snapshot, for inodes an operation finds out it
+// changes only after taking the snapshot, such as quota directories. Like
+// those given to snapshot, allocated inodes must be loaded. Inodes already
+// in the snapshot keep the copy taken first.
+func (fs *FileSystem) include(s *metadataSnapshot, inodeIndex int) {
+	if _, ok := s.inodes[inodeIndex]; ok {
+		return
+	}
+	inode, cached := fs.inodes.peek(inodeIndex)
+	if cached {
+		fs.inodes.pin(inodeIndex)
+		s.pinned = append(s.pinned, inodeIndex)
+	}
+	if inode == nil {
+		s.inodes[inodeIndex] = nil
+		return
+	}
+	saved := *inode
+	s.inodes[inodeIndex] = &saved
+}
+
+// rollback restores the metadata saved in s, both in memory and on the
+// device, after an operation failed with cause. It returns the error the
+// operation should report.
+//
+// Inodes that existed when the snapshot was taken are restored in place, so
+// pointers handed out earlier stay valid. Data blocks written by the failed
+// operation are left as they are; they are unreachable once the restored
+// bitmaps mark them free again.
+//
+// With a journal, the metadata the operation wrote is still in its
+// transaction, which is dropped instead of writing the metadata back.
+// The metadata is written back even if the operation failed as its context
+// is done.
+func (fs *FileSystem) rollback(s *metadataSnapshot, cause error) error {
+	fs.explainf("failed (%v); restoring the bitmaps and inodes from before the operation", cause)
+	defer fs.withContext(nil)()
+	fs.inodeBitmap.replace(s.inodeBitmap)
+	fs.dataBitmap.replace(s.dataBitmap)
+	if s.dedup != nil {
+		fs.dedup.replace(s.dedup)
+	}
+	fs.indexFreeSpace()
+	for inodeIndex, saved := range s.inodes {
+		current, _ := fs.inodes.peek(inodeIndex)
+		switch {
+		case saved == nil:
+			fs.inodes.put(inodeIndex, nil)
+		case current == nil:
+			// not loaded, or freed since
+			fs.inodes.put(inodeIndex, saved)
+		default:
+			*current = *saved
+		}
+	}
+
+	if fs.journal != nil && fs.journal.err == nil {
+		err := fs.dropTransaction()
+		if err != nil {
+			return fmt.Errorf("%w (rolling back also failed: %v)", cause, err)
+		}
+		return cause
+	}
+	err := fs.writeInodeTable()
+	if err == nil {
+		err = fs.persistInodeBitmap()
+	}
+	if err == nil {
+		err = fs.persistDataBitmap()
+	}
+	if err == nil && !sameOrphans(fs.orphans, s.orphans) {
+		// inodes put on the orphan list since are free again
+		fs.orphans = s.orphans
+		err = fs.writeState(StateDirty)
+	}
+	if err != nil {
+		return fmt.Errorf("%w (rolling back also failed, the device may be inconsistent: %v)", cause, err)
+	}
+	return cause
+}
+
+// release unpins the inodes pinned by snapshot, once the operation is over.
+func (fs *FileSystem) release(s *metadataSnapshot) {
+	for _, inodeIndex := range s.pinned {
+		fs.inodes.unpin(inodeIndex)
+	}
+}
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireUnchanged checks that filesystem, both in memory and as stored on
+// dev, has the same metadata as before, when it held the given root entries.
+func requireUnchanged(t *testing.T, filesystem *FileSystem, dev BlockDevice, inodeBitmap, dataBitmap *Bitmap, rootEntries []string) {
+	require.Equal(t, inodeBitmap, filesystem.inodeBitmap.entries)
+	require.Equal(t, dataBitmap, filesystem.dataBitmap.entries)
+
+	names := func(fs *FileSystem) []string {
+		entries, err := fs.ReadDir(0)
+		require.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+	require.Equal(t, rootEntries, names(filesystem))
+
+	// the failed operation may leave the filesystem dirty, as a crash would
+	reloaded, err := LoadFilesystemWithOptions(dev, MountOptions{Recovery: RecoveryForce})
+	require.NoError(t, err)
+	require.Equal(t, inodeBitmap, reloaded.inodeBitmap.entries)
+	require.Equal(t, dataBitmap, reloaded.dataBitmap.entries)
+	require.Equal(t, rootEntries, names(reloaded))
+
+	for _, f := range Diagnose(dev) {
+		if f.Check != "state" {
+			require.Equal(t, SeverityInfo, f.Severity, f.Message)
+		}
+	}
+}
+
+func TestCreateFileRollsBackWriteFailures(t *testing.T) {
+	for failAt := 1; ; failAt++ {
+		disk := make([]byte, (DataStartIndex+32)*BlockSize)
+		dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+		filesystem, err := NewFileSystem(dev)
+		require.NoError(t, err)
+		_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+
+		inodeBitmap, dataBitmap := filesystem.inodeBitmap.clone(), filesystem.dataBitmap.clone()
+
+		// fail the failAt-th write of the create
+		dev.writes = 0
+		dev.failWriteAt = failAt
+		_, err = filesystem.CreateFile("/bar", bytes.NewBuffer(make([]byte, 2*BlockSize)))
+		dev.failWriteAt = 0
+		if err == nil {
+			// every write of the create has had its turn to fail
+			require.Greater(t, failAt, 1)
+			return
+		}
+		require.ErrorIs(t, err, errInjected, "write %d", failAt)
+
+		requireUnchanged(t, filesystem, dev, inodeBitmap, dataBitmap, []string{"foo"})
+	}
+}
+
+func TestCreateFileReportsFailedRollback(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	// every write fails, including the ones made while rolling back
+	dev.writes = 0
+	dev.failWriteAt = 1
+	dev.sticky = true
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.ErrorIs(t, err, errInjected)
+	require.Contains(t, err.Error(), "rolling back also failed")
+
+	// the in-memory state is rolled back regardless
+	empty := NewBitmap(32)
+	empty.Set(0)
+	require.Equal(t, empty, filesystem.inodeBitmap.entries)
+	require.Equal(t, empty, filesystem.dataBitmap.entries)
+	inode, err := filesystem.GetInode(1)
+	require.NoError(t, err)
+	require.Nil(t, inode)
+}
+
+func TestCreateFileRollsBackFullDirectory(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+
+	// Fill the root directory's only block with long names, leaving room
+	// for exactly one more entry. Names are as long as they can be so that
+	// the block fills up before the inodes run out.
+	longName := func(i int) string {
+		return fmt.Sprintf("%03d%s", i, strings.Repeat("x", MaxNameLength-3))
+	}
+	const entrySize = direntHeaderSize + MaxNameLength
+	names := []string{}
+	root, err := filesystem.GetInode(0)
+	require.NoError(t, err)
+	for i := 0; root.Size+2*entrySize <= BlockSize; i++ {
+		_, err := filesystem.CreateFile("/"+longName(i), bytes.NewBuffer([]byte{}))
+		require.NoError(t, err)
+		names = append(names, longName(i))
+	}
+
+	// use up all data blocks but 16
+	free := filesystem.dataBitmap.entries.CountFree()
+	filler := longName(len(names))
+	_, err = filesystem.CreateFile("/"+filler, bytes.NewBuffer(make([]byte, (free-16)*BlockSize)))
+	require.NoError(t, err)
+	names = append(names, filler)
+
+	inodeBitmap, dataBitmap := filesystem.inodeBitmap.clone(), filesystem.dataBitmap.clone()
+
+	// the new file fits in the remaining blocks, but its directory entry
+	// needs a new block for the directory
+	_, err = filesystem.CreateFile("/"+longName(len(names)), bytes.NewBuffer(make([]byte, 16*BlockSize)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not enough free blocks")
+
+	requireUnchanged(t, filesystem, dev, inodeBitmap, dataBitmap, names)
+}
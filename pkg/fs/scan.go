@@ -0,0 +1,295 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Diagnose checks an image with a pool of workers: the inode table is read
+// and validated a block at a time, each block by whichever worker is free,
+// and directories are read as they are discovered, so sibling subtrees are
+// checked concurrently. Workers only read the device; they don't touch the
+// inode cache, which isn't safe for concurrent use.
+
+// inodeScan is the inode table as read by scanInodeTable.
+type inodeScan struct {
+	// inodes holds the allocated inodes by index, and nil for free slots
+	inodes []*Inode
+	// invalid maps the indices of malformed inodes to what is wrong with
+	// them
+	invalid map[int]error
+	// blockMaps holds the block maps of the well-formed inodes by index
+	blockMaps []*blockMap
+}
+
+// forEach calls fn for every allocated inode of the scan, in index order,
+// like FileSystem.forEachInode.
+func (scan *inodeScan) forEach(fn func(i int, inode *Inode) error) error {
+	for i, inode := range scan.inodes {
+		if inode == nil {
+			continue
+		}
+		err := fn(i, inode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedBlocks returns the blocks inode i owns, pointer blocks included.
+// For malformed inodes, only the direct blocks are known.
+func (scan *inodeScan) ownedBlocks(i int) []uint32 {
+	if m := scan.blockMaps[i]; m != nil {
+		return m.owned()
+	}
+	return scan.inodes[i].usedBlocks()
+}
+
+// dataBlocks returns the data blocks of inode i in file order, as far as
+// they are known; see ownedBlocks.
+func (scan *inodeScan) dataBlocks(i int) []uint32 {
+	if m := scan.blockMaps[i]; m != nil {
+		return m.data
+	}
+	return scan.inodes[i].usedBlocks()
+}
+
+// parallel calls fn for 0 through n-1 from up to workers goroutines, and
+// waits for the calls to return.
+func parallel(workers, n int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// scanInodeTable reads and validates every allocated inode, and the pointer
+// blocks of the well-formed ones, reporting progress per inode. It fails if
+// a block of the table can't be read or an inode can't be decoded, reporting
+// the failure with the lowest inode index.
+func (fs *FileSystem) scanInodeTable(workers int, progress ProgressFunc) (*inodeScan, error) {
+	scan := &inodeScan{
+		inodes:    make([]*Inode, fs.inodeBitmap.len()),
+		invalid:   map[int]error{},
+		blockMaps: make([]*blockMap, fs.inodeBitmap.len()),
+	}
+	total := fs.inodeBitmap.len() - fs.inodeBitmap.entries.CountFree()
+
+	inodesPerBlock := BlockSize / InodeSize
+	nBlocks := (fs.inodeBitmap.len() + inodesPerBlock - 1) / inodesPerBlock
+	errs := make([]error, nBlocks)
+	var mu sync.Mutex
+	scanned := 0
+	parallel(workers, nBlocks, func(b int) {
+		first := b * inodesPerBlock
+		last := first + inodesPerBlock
+		if last > fs.inodeBitmap.len() {
+			last = fs.inodeBitmap.len()
+		}
+		allocated := false
+		for i := first; i < last; i++ {
+			allocated = allocated || fs.inodeBitmap.test(i)
+		}
+		if !allocated {
+			return
+		}
+
+		buf := make([]byte, BlockSize)
+		err := fs.readBlock(uint64(b)+uint64(fs.geometry.InodeTableStart), buf)
+		if err != nil {
+			errs[b] = fmt.Errorf("error reading inode table block %d: %w", b, err)
+			return
+		}
+		for i := first; i < last; i++ {
+			if !fs.inodeBitmap.test(i) {
+				continue
+			}
+			inode, err := decodeInode(i, buf)
+			if err != nil {
+				errs[b] = err
+				return
+			}
+			// each worker writes its own slots; the map is shared
+			scan.inodes[i] = inode
+			err = inode.validate(i)
+			if err == nil {
+				scan.blockMaps[i], err = fs.readBlockMap(inode)
+			}
+
+			mu.Lock()
+			if err != nil {
+				scan.invalid[i] = err
+			}
+			scanned++
+			progress.report(Progress{Op: "fsck", Items: scanned, TotalItems: total})
+			mu.Unlock()
+		}
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scan, nil
+}
+
+// checkDirectories walks the directory tree from the root and reports
+// directories that can't be read, entries pointing at free or missing
+// inodes, duplicate names, inodes referenced more than once and allocated
+// inodes that can't be reached.
+func (fs *FileSystem) checkDirectories(scan *inodeScan, workers int) []Finding {
+	root := scan.inodes[0]
+	if root == nil || root.Type != InodeTypeDirectory || scan.invalid[0] != nil {
+		// checkInodes reports it; there is no tree to walk
+		return []Finding{}
+	}
+
+	// dirFindings collects the findings of each directory, so that they
+	// can be reported in a stable order
+	dirFindings := map[int][]Finding{}
+	// refs maps inode indices to the directories referencing them
+	refs := map[int][]int{0: {}}
+
+	// every directory is queued at most once, so the queue never fills up
+	// and workers can add to it while holding mu
+	queue := make(chan int, len(scan.inodes))
+	var mu sync.Mutex
+	var pending sync.WaitGroup
+	pending.Add(1)
+	queue <- 0
+
+	var workersDone sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			for dir := range queue {
+				findings, children := fs.checkDirectory(scan, dir)
+
+				mu.Lock()
+				dirFindings[dir] = findings
+				for _, child := range children {
+					refs[child] = append(refs[child], dir)
+					inode := scan.inodes[child]
+					if len(refs[child]) == 1 && inode.Type == InodeTypeDirectory && scan.invalid[child] == nil {
+						pending.Add(1)
+						queue <- child
+					}
+				}
+				mu.Unlock()
+				pending.Done()
+			}
+		}()
+	}
+	pending.Wait()
+	close(queue)
+	workersDone.Wait()
+
+	dirs := make([]int, 0, len(dirFindings))
+	for dir := range dirFindings {
+		dirs = append(dirs, dir)
+	}
+	sort.Ints(dirs)
+	findings := []Finding{}
+	for _, dir := range dirs {
+		findings = append(findings, dirFindings[dir]...)
+	}
+
+	unreachable := []int{}
+	for i, inode := range scan.inodes {
+		dirs := refs[i]
+		switch {
+		case inode == nil:
+		case dirs == nil:
+			unreachable = append(unreachable, i)
+		case inode.Type == InodeTypeDirectory && len(dirs) > 1 || i == 0 && len(dirs) > 0:
+			sort.Ints(dirs)
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Check:    "directories",
+				Message:  fmt.Sprintf("inode %d is referenced %d times, by directories %v", i, len(dirs), dirs),
+				Remedy:   "copy the files off the image and recreate it",
+			})
+		case i != 0 && uint32(len(dirs)) != inode.links():
+			sort.Ints(dirs)
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Check:    "directories",
+				Message:  fmt.Sprintf("inode %d is referenced %d times, by directories %v, but its link count is %d", i, len(dirs), dirs, inode.links()),
+				Remedy:   "repair the link count with fsck; until then, deleting its names may free it early or never",
+			})
+		}
+	}
+	if len(unreachable) > 0 {
+		findings = append(findings, Finding{
+			Severity: SeverityWarning,
+			Check:    "directories",
+			Message:  fmt.Sprintf("inodes %v are allocated but not in any directory", unreachable),
+			Remedy:   "the inodes and their blocks are lost until they are freed",
+		})
+	}
+
+	return findings
+}
+
+// checkDirectory reads one directory and checks its entries. It returns the
+// findings and the inodes its valid entries point at.
+func (fs *FileSystem) checkDirectory(scan *inodeScan, dir int) ([]Finding, []int) {
+	problem := func(severity Severity, format string, args ...interface{}) Finding {
+		return Finding{
+			Severity: severity,
+			Check:    "directories",
+			Message:  fmt.Sprintf("directory %d (%s): ", dir, scan.inodes[dir].Filename) + fmt.Sprintf(format, args...),
+			Remedy:   "copy the files off the image and recreate it",
+		}
+	}
+
+	contents, err := fs.readContents(scan.inodes[dir])
+	if err != nil {
+		return []Finding{problem(SeverityError, "%v", err)}, nil
+	}
+	records, err := parseDir(scan.inodes[dir], contents)
+	if err != nil {
+		return []Finding{problem(SeverityError, "%v", err)}, nil
+	}
+
+	findings := []Finding{}
+	children := []int{}
+	names := map[string]bool{}
+	for _, record := range records {
+		if names[record.name] {
+			findings = append(findings, problem(SeverityError, "name %s is used more than once", record.name))
+		}
+		names[record.name] = true
+		if record.inode < 0 || record.inode >= len(scan.inodes) || scan.inodes[record.inode] == nil {
+			findings = append(findings, problem(SeverityError, "entry %s points at unallocated inode %d", record.name, record.inode))
+			continue
+		}
+		if scan.inodes[dir].BinaryDir && record.typ != scan.inodes[record.inode].Type {
+			findings = append(findings, problem(SeverityWarning, "entry %s records inode %d as a %s, but it is a %s",
+				record.name, record.inode, describeInodeType(record.typ), describeInodeType(scan.inodes[record.inode].Type)))
+		}
+		children = append(children, record.inode)
+	}
+	if n, ok := scan.inodes[dir].Entries(); ok && n != len(records) {
+		f := problem(SeverityWarning, "records %d entries, but holds %d", n, len(records))
+		f.Remedy = "repair the image with fsck, which recounts the entries"
+		findings = append(findings, f)
+	}
+	return findings, children
+}
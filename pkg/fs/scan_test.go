@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnoseWorkers(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := filesystem.CreateFile(fmt.Sprintf("/f%d", i), bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, filesystem.Close())
+
+	sequential := DiagnoseWithOptions(dev, DiagnoseOptions{Workers: 1})
+	require.Empty(t, findingsBySeverity(sequential, SeverityError))
+	require.Empty(t, findingsBySeverity(sequential, SeverityWarning))
+
+	updates := []Progress{}
+	concurrent := DiagnoseWithOptions(dev, DiagnoseOptions{
+		Workers:  8,
+		Progress: func(p Progress) { updates = append(updates, p) },
+	})
+	require.Equal(t, sequential, concurrent)
+	require.Len(t, updates, 21)
+	require.Equal(t, Progress{Op: "fsck", Items: 21, TotalItems: 21}, updates[20])
+}
+
+func TestDiagnoseDirectories(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	foo, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/bar", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+
+	// list /foo twice, once as a directory, point at a free inode and drop
+	// /bar
+	root, err := encodeDir([]dirRecord{
+		{name: "foo", inode: int(foo.Index), typ: InodeTypeFile},
+		{name: "foo", inode: int(foo.Index), typ: InodeTypeDirectory},
+		{name: "ghost", inode: 9, typ: InodeTypeFile},
+	})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.setInodeContents(0, root))
+	require.NoError(t, filesystem.Close())
+
+	messages := []string{}
+	for _, f := range Diagnose(dev) {
+		if f.Check == "directories" {
+			messages = append(messages, f.Severity.String()+": "+f.Message)
+		}
+	}
+	require.Equal(t, []string{
+		"error: directory 0 (/): name foo is used more than once",
+		"error: directory 0 (/): entry ghost points at unallocated inode 9",
+		"warning: directory 0 (/): entry foo records inode 1 as a directory, but it is a file",
+		"warning: directory 0 (/): records 2 entries, but holds 3",
+		"warning: inode 1 is referenced 2 times, by directories [0 0], but its link count is 1",
+		"warning: inodes [2] are allocated but not in any directory",
+	}, messages)
+}
+
+func TestDiagnoseUnreadableDirectory(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// the superblock, the last block (to check the device size), the two
+	// bitmaps and the inode table block read fine; reading the root
+	// directory fails
+	dev.reads = 0
+	dev.failReadAt = 6
+	errors := findingsBySeverity(DiagnoseWithOptions(dev, DiagnoseOptions{Workers: 1}), SeverityError)
+	require.Len(t, errors, 1)
+	require.Equal(t, "directories", errors[0].Check)
+	require.Contains(t, errors[0].Message, errInjected.Error())
+}
@@ -0,0 +1,62 @@
+package fs
+
+import "fmt"
+
+// FsStats reports the capacity of a filesystem, as returned by Statfs.
+type FsStats struct {
+	// BlockSize is the size of a block in bytes.
+	BlockSize uint32
+	// Blocks is the number of data blocks, which hold the contents of files
+	// and directories along with their pointer blocks; the blocks of the
+	// superblock, journal, bitmaps and inode table aren't counted. FreeBlocks
+	// and UsedBlocks split it. Data block 0 is always used.
+	Blocks     uint64
+	FreeBlocks uint64
+	UsedBlocks uint64
+	// Inodes is the number of slots in the inode table, split by
+	// FreeInodes and UsedInodes. Quarantined inodes count as used.
+	Inodes     uint64
+	FreeInodes uint64
+	UsedInodes uint64
+	// MaxFileSize is the size limit of a single file, in bytes, regardless
+	// of the free space; see MaxFileSize.
+	MaxFileSize int64
+	// SavedBlocks is the number of data blocks the dedup table saves: the
+	// references to shared blocks past the first. It is zero on filesystems
+	// without one, see MkfsOptions.Dedup.
+	SavedBlocks uint64
+}
+
+// FreeBytes returns the free space of the data blocks in bytes. A file of
+// that size doesn't necessarily fit, as big files also need pointer blocks.
+func (s FsStats) FreeBytes() uint64 {
+	return s.FreeBlocks * uint64(s.BlockSize)
+}
+
+// Statfs reports how many blocks and inodes the filesystem has and how many
+// of them are free, so callers can check there is room before writing. The
+// counts are kept as blocks and inodes are taken and freed, so nothing is
+// counted or read, and the superblock records them, see counters.go. It
+// fails if the journal was aborted, as the filesystem no longer knows what
+// the device holds.
+func (fs *FileSystem) Statfs() (FsStats, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if fs.journalAborted() {
+		return FsStats{}, fmt.Errorf("error reading the free space, the journal was aborted: %w", fs.journal.err)
+	}
+	stats := FsStats{
+		BlockSize:   fs.geometry.BlockSize,
+		Blocks:      uint64(fs.geometry.DataBlocks()),
+		FreeBlocks:  uint64(fs.freeBlocks.free),
+		Inodes:      uint64(fs.geometry.InodeCount),
+		FreeInodes:  uint64(fs.freeInodes.free),
+		MaxFileSize: MaxFileSize,
+	}
+	if fs.dedup != nil {
+		stats.SavedBlocks = fs.dedup.saved
+	}
+	stats.UsedBlocks = stats.Blocks - stats.FreeBlocks
+	stats.UsedInodes = stats.Inodes - stats.FreeInodes
+	return stats, nil
+}
@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatfs(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	// only the root's inode and data block 0 are taken
+	require.Equal(t, FsStats{
+		BlockSize:   BlockSize,
+		Blocks:      32,
+		FreeBlocks:  31,
+		UsedBlocks:  1,
+		Inodes:      32,
+		FreeInodes:  31,
+		UsedInodes:  1,
+		MaxFileSize: MaxFileSize,
+	}, stats)
+	require.Equal(t, uint64(31*BlockSize), stats.FreeBytes())
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(make([]byte, 3*BlockSize)))
+	require.NoError(t, err)
+	stats, err = filesystem.Statfs()
+	require.NoError(t, err)
+	// the root gets a block for its entries
+	require.Equal(t, uint64(27), stats.FreeBlocks)
+	require.Equal(t, uint64(30), stats.FreeInodes)
+
+	require.NoError(t, filesystem.DeleteFile("/foo"))
+	stats, err = filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, uint64(31), stats.FreeBlocks)
+	require.Equal(t, uint64(31), stats.FreeInodes)
+}
+
+func TestStatfsAborted(t *testing.T) {
+	disk := make([]byte, 200*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem := newJournaledFileSystem(t, dev)
+
+	dev.writes = 0
+	dev.failWriteAt = 1
+	require.ErrorIs(t, filesystem.DeleteFile("/foo"), errInjected)
+	_, err := filesystem.Statfs()
+	require.ErrorIs(t, err, errInjected)
+}
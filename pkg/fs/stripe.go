@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// StripeBlockDevice combines several BlockDevices into one larger device.
+// With a stripe size, blocks are striped over the devices like RAID 0: the
+// first stripeBlocks blocks are on the first device, the next stripeBlocks
+// on the second, and so on round the devices, so runs of blocks are spread
+// over all of them. Without one, the devices are concatenated: the blocks
+// of the first device come first, then those of the second. Like RAID 0,
+// losing any of the devices loses the filesystem.
+type StripeBlockDevice struct {
+	devs []BlockDevice
+	// stripeBlocks is the stripe size in blocks, or 0 to concatenate
+	stripeBlocks uint64
+	// starts holds the first block of each device when concatenating
+	starts []uint64
+	blocks uint64
+}
+
+// NewStripeBlockDevice combines devs into one device, striping it with
+// stripes of stripeBlocks blocks, or concatenating the devices if
+// stripeBlocks is 0. The devices must know their size, see BlockCount.
+// Striping uses as many blocks of each device as the smallest one has,
+// rounded down to whole stripes.
+func NewStripeBlockDevice(devs []BlockDevice, stripeBlocks int) (*StripeBlockDevice, error) {
+	if len(devs) == 0 {
+		return nil, errors.New("a striped device needs at least one device")
+	}
+	if stripeBlocks < 0 {
+		return nil, fmt.Errorf("negative stripe size %d", stripeBlocks)
+	}
+	d := &StripeBlockDevice{devs: devs, stripeBlocks: uint64(stripeBlocks)}
+	smallest := uint64(0)
+	for i, dev := range devs {
+		n := deviceSize(dev)
+		if n == 0 {
+			return nil, fmt.Errorf("device %d doesn't know its size", i)
+		}
+		d.starts = append(d.starts, d.blocks)
+		d.blocks += n
+		if i == 0 || n < smallest {
+			smallest = n
+		}
+	}
+	if d.stripeBlocks > 0 {
+		d.blocks = smallest / d.stripeBlocks * d.stripeBlocks * uint64(len(devs))
+		if d.blocks == 0 {
+			return nil, fmt.Errorf("the smallest device has %d blocks, less than a stripe of %d", smallest, stripeBlocks)
+		}
+	}
+	return d, nil
+}
+
+// locate returns the device holding blockNum and the block number on it.
+func (d *StripeBlockDevice) locate(blockNum uint64) (BlockDevice, uint64, error) {
+	if blockNum >= d.blocks {
+		return nil, 0, fmt.Errorf("block %d out of range (device has %d blocks)", blockNum, d.blocks)
+	}
+	if d.stripeBlocks == 0 {
+		i := sort.Search(len(d.starts), func(i int) bool { return d.starts[i] > blockNum }) - 1
+		return d.devs[i], blockNum - d.starts[i], nil
+	}
+	stripe := blockNum / d.stripeBlocks
+	n := uint64(len(d.devs))
+	return d.devs[stripe%n], stripe/n*d.stripeBlocks + blockNum%d.stripeBlocks, nil
+}
+
+// ReadBlock reads a block from the device holding it.
+func (d *StripeBlockDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	dev, devBlock, err := d.locate(blockNum)
+	if err != nil {
+		return err
+	}
+	return dev.ReadBlock(devBlock, buf)
+}
+
+// WriteBlock writes a block to the device holding it.
+func (d *StripeBlockDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev, devBlock, err := d.locate(blockNum)
+	if err != nil {
+		return err
+	}
+	return dev.WriteBlock(devBlock, buf)
+}
+
+// BlockCount returns the number of blocks of the combined device.
+func (d *StripeBlockDevice) BlockCount() uint64 {
+	return d.blocks
+}
+
+// Sync syncs the devices that support syncing, returning the first error.
+func (d *StripeBlockDevice) Sync() error {
+	var err error
+	for _, dev := range d.devs {
+		if syncErr := flushDevice(dev); err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+// Close closes the devices that can be closed, returning the first error.
+func (d *StripeBlockDevice) Close() error {
+	var err error
+	for _, dev := range d.devs {
+		if c, ok := dev.(io.Closer); ok {
+			if closeErr := c.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripeBlockDevice(t *testing.T) {
+	disks := [][]byte{make([]byte, 10*BlockSize), make([]byte, 9*BlockSize), make([]byte, 12*BlockSize)}
+	devs := []BlockDevice{NewArrayBlockDevice(disks[0]), NewArrayBlockDevice(disks[1]), NewArrayBlockDevice(disks[2])}
+	dev, err := NewStripeBlockDevice(devs, 4)
+	require.NoError(t, err)
+	// two stripes of the smallest device, on each of them
+	require.Equal(t, uint64(24), dev.BlockCount())
+
+	for blockNum := uint64(0); blockNum < dev.BlockCount(); blockNum++ {
+		require.NoError(t, dev.WriteBlock(blockNum, bytes.Repeat([]byte{byte(blockNum)}, BlockSize)))
+	}
+	// block 13 is the second block of the fourth stripe, the second one on
+	// the first device
+	require.Equal(t, byte(13), disks[0][5*BlockSize])
+	require.Equal(t, byte(6), disks[1][2*BlockSize])
+	require.Equal(t, byte(23), disks[2][7*BlockSize])
+	buf := make([]byte, BlockSize)
+	require.NoError(t, dev.ReadBlock(13, buf))
+	require.Equal(t, bytes.Repeat([]byte{13}, BlockSize), buf)
+	require.ErrorContains(t, dev.ReadBlock(24, buf), "out of range")
+}
+
+func TestStripeBlockDeviceConcatenated(t *testing.T) {
+	disks := [][]byte{make([]byte, 3*BlockSize), make([]byte, 5*BlockSize)}
+	dev, err := NewStripeBlockDevice([]BlockDevice{NewArrayBlockDevice(disks[0]), NewArrayBlockDevice(disks[1])}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), dev.BlockCount())
+	require.NoError(t, dev.WriteBlock(2, []byte{2}))
+	require.NoError(t, dev.WriteBlock(3, []byte{3}))
+	require.NoError(t, dev.WriteBlock(7, []byte{7}))
+	require.Equal(t, byte(2), disks[0][2*BlockSize])
+	require.Equal(t, byte(3), disks[1][0])
+	require.Equal(t, byte(7), disks[1][4*BlockSize])
+	require.ErrorContains(t, dev.WriteBlock(8, []byte{8}), "out of range")
+}
+
+func TestStripeBlockDeviceFilesystem(t *testing.T) {
+	var devs []BlockDevice
+	var disks [][]byte
+	for i := 0; i < 4; i++ {
+		disks = append(disks, make([]byte, 100*BlockSize))
+		devs = append(devs, NewArrayBlockDevice(disks[i]))
+	}
+	dev, err := NewStripeBlockDevice(devs, 8)
+	require.NoError(t, err)
+	filesystem, err := NewFileSystemWithOptions(dev, MkfsOptions{Blocks: uint32(dev.BlockCount()), JournalBlocks: 32})
+	require.NoError(t, err)
+	contents := bytes.Repeat([]byte("striped"), 20*BlockSize)
+	_, err = filesystem.CreateFile("/file", bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	// the file is spread over every device
+	for _, disk := range disks {
+		require.True(t, bytes.Contains(disk, []byte("striped")))
+	}
+	dev, err = NewStripeBlockDevice(devs, 8)
+	require.NoError(t, err)
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/file")
+	require.NoError(t, err)
+	read, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, contents, read.Bytes())
+}
+
+func TestStripeBlockDeviceErrors(t *testing.T) {
+	_, err := NewStripeBlockDevice(nil, 4)
+	require.Error(t, err)
+	_, err = NewStripeBlockDevice([]BlockDevice{NewArrayBlockDevice(make([]byte, 2*BlockSize))}, 4)
+	require.ErrorContains(t, err, "less than a stripe")
+	_, err = NewStripeBlockDevice([]BlockDevice{NewRetryBlockDevice(NewArrayBlockDevice(make([]byte, 8*BlockSize)), RetryPolicy{})}, 4)
+	require.ErrorContains(t, err, "doesn't know its size")
+}
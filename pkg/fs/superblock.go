@@ -0,0 +1,254 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// Magic identifies a block device holding a filesystem. It is stored in
+	// the first bytes of the superblock.
+	Magic = 0xbafdb0
+
+	// FormatVersion is the version of the on-disk format written by
+	// NewFileSystem. It is bumped whenever the format changes in a way older
+	// code can't read; LoadFilesystem keeps reading every earlier version.
+	//
+	// Version 2 added indirect blocks. Filesystems of version 1 keep it
+	// until a file first needs an indirect block.
+	//
+	// Version 3 added the journal.
+	//
+	// Version 4 stores directory entries in binary. Filesystems of earlier
+	// versions keep it until a directory is first changed.
+	//
+	// Version 5 added the checksum table, see MkfsOptions.Checksums, and the
+	// checksum of the superblock.
+	//
+	// Version 6 maps the blocks of files with extents, see extent.go.
+	// Filesystems of earlier versions keep mapping them with pointers.
+	//
+	// Version 7 indexes directories of more than a block of entries, see
+	// dirindex.go. Directories of earlier versions stay unindexed.
+	//
+	// Version 8 added directory quotas, see quota.go. Filesystems of
+	// earlier versions have none.
+	//
+	// Version 9 added compressed files, see compression.go. Filesystems of
+	// earlier versions can't compress them.
+	//
+	// Version 10 added extended attributes, see xattr.go. Filesystems of
+	// earlier versions have none.
+	//
+	// Version 11 added the owners of inodes, see permissions.go. Inodes of
+	// earlier versions are owned by root.
+	//
+	// Version 12 added the entry counts of directories, see dircount.go.
+	// Directories of earlier versions have none.
+	//
+	// Version 13 added the dedup table, see MkfsOptions.Dedup. Filesystems
+	// of earlier versions have none.
+	//
+	// Version 14 packs the bitmaps a bit per entry, see
+	// Geometry.PackedBitmaps. Filesystems formatted before keep a byte per
+	// entry.
+	//
+	// Version 15 records the free data blocks and inodes in the superblock,
+	// see Superblock.FreeBlocks. Filesystems of earlier versions don't, and
+	// their counts aren't checked.
+	FormatVersion = 15
+)
+
+// superblockChecksumOffset is where the checksum of the superblock is.
+const superblockChecksumOffset = BlockSize - 4
+
+// Filesystem states recorded in the superblock.
+const (
+	// StateClean means the filesystem was closed after its last change.
+	StateClean = 0
+	// StateDirty means the filesystem was changed and not closed since, so
+	// the metadata on disk may be half-updated.
+	StateDirty = 1
+)
+
+// Superblock holds the filesystem-wide metadata stored in block 0.
+//
+// Layout (little endian):
+//
+//	offset 0:  magic       (uint32)
+//	offset 4:  version     (uint32)
+//	offset 8:  state       (uint32)
+//	offset 12: block size  (uint32)
+//	offset 16: block count (uint32)
+//	offset 20: inode count (uint32)
+//	offset 24: flags       (uint32)
+//	offset 28: retention   (uint64, seconds)
+//	offset 36: next generation (uint32)
+//	offset 40: inode bitmap start (uint32)
+//	offset 44: data bitmap start  (uint32)
+//	offset 48: inode table start  (uint32)
+//	offset 52: data start         (uint32)
+//	offset 56: journal start      (uint32)
+//	offset 60: journal blocks     (uint32)
+//	offset 64: checksum table start  (uint32)
+//	offset 68: checksum table blocks (uint32)
+//	offset 72: dedup table start     (uint32)
+//	offset 76: dedup table blocks    (uint32)
+//	offset 80: orphan count          (uint32)
+//	offset 84: orphan inodes         (uint32 each, up to maxOrphans)
+//	offset 340: packed bitmaps       (uint32, 1 if set)
+//	offset 344: free data blocks     (uint32)
+//	offset 348: free inodes          (uint32)
+//	offset 4092: CRC-32C of the rest of the block (uint32)
+//
+// The checksum is written by every version from 5 on, but only checked on
+// filesystems with a checksum table.
+type Superblock struct {
+	Magic uint32
+	// Version is the on-disk format version. Images written before the
+	// version was recorded read as version 1.
+	Version uint32
+	// State is StateClean or StateDirty. Images written before the state
+	// was recorded read as clean.
+	State uint32
+	// Geometry is the size and layout of the filesystem. Images written
+	// before the geometry was recorded read as having the one geometry
+	// there was, and so do the layouts of images written before the layout
+	// was recorded.
+	Geometry Geometry
+	// Flags holds features of the filesystem, such as FlagWORM. Older code
+	// ignores them.
+	Flags uint32
+	// Retention is how long files of a write-once filesystem stay
+	// write-once, in whole seconds; zero means forever.
+	Retention time.Duration
+	// NextGeneration is where the inode generation counter resumes after
+	// mounting. Images written before it was recorded read as 1.
+	NextGeneration uint32
+	// Orphans are the inodes allocated but not linked into a directory yet,
+	// or unlinked but not freed yet, see orphan.go. Older code ignores
+	// them.
+	Orphans []uint32
+	// FreeBlocks and FreeInodes are the free entries of the data bitmap and
+	// of the inode bitmap as of the last time the superblock was written,
+	// so they are exact when the filesystem is clean; see counters.go.
+	// Images of versions before 15 don't record them.
+	FreeBlocks uint32
+	FreeInodes uint32
+}
+
+// ReadSuperblock reads and validates the superblock of dev.
+func ReadSuperblock(dev BlockDevice) (*Superblock, error) {
+	buf := make([]byte, BlockSize)
+	err := dev.ReadBlock(SuperblockIndex, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading superblock: %w", err)
+	}
+
+	sb := &Superblock{
+		Magic:   binary.LittleEndian.Uint32(buf[0:4]),
+		Version: binary.LittleEndian.Uint32(buf[4:8]),
+		State:   binary.LittleEndian.Uint32(buf[8:12]),
+		Geometry: Geometry{
+			BlockSize:  binary.LittleEndian.Uint32(buf[12:16]),
+			BlockCount: binary.LittleEndian.Uint32(buf[16:20]),
+			InodeCount: binary.LittleEndian.Uint32(buf[20:24]),
+
+			InodeBitmapStart: binary.LittleEndian.Uint32(buf[40:44]),
+			DataBitmapStart:  binary.LittleEndian.Uint32(buf[44:48]),
+			InodeTableStart:  binary.LittleEndian.Uint32(buf[48:52]),
+			DataStart:        binary.LittleEndian.Uint32(buf[52:56]),
+
+			JournalStart:  binary.LittleEndian.Uint32(buf[56:60]),
+			JournalBlocks: binary.LittleEndian.Uint32(buf[60:64]),
+
+			ChecksumStart:  binary.LittleEndian.Uint32(buf[64:68]),
+			ChecksumBlocks: binary.LittleEndian.Uint32(buf[68:72]),
+
+			DedupStart:  binary.LittleEndian.Uint32(buf[72:76]),
+			DedupBlocks: binary.LittleEndian.Uint32(buf[76:80]),
+
+			PackedBitmaps: binary.LittleEndian.Uint32(buf[340:344]) == 1,
+		},
+		Flags:     binary.LittleEndian.Uint32(buf[24:28]),
+		Retention: time.Duration(binary.LittleEndian.Uint64(buf[28:36])) * time.Second,
+
+		NextGeneration: binary.LittleEndian.Uint32(buf[36:40]),
+
+		FreeBlocks: binary.LittleEndian.Uint32(buf[344:348]),
+		FreeInodes: binary.LittleEndian.Uint32(buf[348:352]),
+	}
+	if n := binary.LittleEndian.Uint32(buf[80:84]); n > 0 && n <= maxOrphans {
+		sb.Orphans = make([]uint32, n)
+		for i := range sb.Orphans {
+			sb.Orphans[i] = binary.LittleEndian.Uint32(buf[84+4*i:])
+		}
+	}
+	// check the magic number
+	if sb.Magic != Magic {
+		return nil, fmt.Errorf("Not a valid filesystem")
+	}
+	if sb.Geometry.ChecksumBlocks > 0 {
+		recorded := binary.LittleEndian.Uint32(buf[superblockChecksumOffset:])
+		if computed := checksum(buf[:superblockChecksumOffset]); recorded != computed {
+			return nil, &ChecksumError{Block: SuperblockIndex, What: "superblock", Recorded: recorded, Computed: computed}
+		}
+	}
+	if sb.Version == 0 {
+		sb.Version = 1
+	}
+	if sb.NextGeneration == 0 {
+		sb.NextGeneration = 1
+	}
+	if sb.Geometry == (Geometry{}) {
+		sb.Geometry = defaultGeometry
+		sb.Geometry.PackedBitmaps = false
+	}
+	if sb.Geometry.InodeBitmapStart == 0 {
+		sb.Geometry.InodeBitmapStart = defaultGeometry.InodeBitmapStart
+		sb.Geometry.DataBitmapStart = defaultGeometry.DataBitmapStart
+		sb.Geometry.InodeTableStart = defaultGeometry.InodeTableStart
+		sb.Geometry.DataStart = defaultGeometry.DataStart
+	}
+	if sb.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d (newest supported is %d)", sb.Version, FormatVersion)
+	}
+
+	return sb, nil
+}
+
+// encode serializes the superblock into a block-sized buffer.
+func (sb *Superblock) encode() []byte {
+	buf := make([]byte, BlockSize)
+	binary.LittleEndian.PutUint32(buf[0:4], sb.Magic)
+	binary.LittleEndian.PutUint32(buf[4:8], sb.Version)
+	binary.LittleEndian.PutUint32(buf[8:12], sb.State)
+	binary.LittleEndian.PutUint32(buf[12:16], sb.Geometry.BlockSize)
+	binary.LittleEndian.PutUint32(buf[16:20], sb.Geometry.BlockCount)
+	binary.LittleEndian.PutUint32(buf[20:24], sb.Geometry.InodeCount)
+	binary.LittleEndian.PutUint32(buf[24:28], sb.Flags)
+	binary.LittleEndian.PutUint64(buf[28:36], uint64(sb.Retention/time.Second))
+	binary.LittleEndian.PutUint32(buf[36:40], sb.NextGeneration)
+	binary.LittleEndian.PutUint32(buf[40:44], sb.Geometry.InodeBitmapStart)
+	binary.LittleEndian.PutUint32(buf[44:48], sb.Geometry.DataBitmapStart)
+	binary.LittleEndian.PutUint32(buf[48:52], sb.Geometry.InodeTableStart)
+	binary.LittleEndian.PutUint32(buf[52:56], sb.Geometry.DataStart)
+	binary.LittleEndian.PutUint32(buf[56:60], sb.Geometry.JournalStart)
+	binary.LittleEndian.PutUint32(buf[60:64], sb.Geometry.JournalBlocks)
+	binary.LittleEndian.PutUint32(buf[64:68], sb.Geometry.ChecksumStart)
+	binary.LittleEndian.PutUint32(buf[68:72], sb.Geometry.ChecksumBlocks)
+	binary.LittleEndian.PutUint32(buf[72:76], sb.Geometry.DedupStart)
+	binary.LittleEndian.PutUint32(buf[76:80], sb.Geometry.DedupBlocks)
+	binary.LittleEndian.PutUint32(buf[80:84], uint32(len(sb.Orphans)))
+	for i, inodeIndex := range sb.Orphans {
+		binary.LittleEndian.PutUint32(buf[84+4*i:], inodeIndex)
+	}
+	if sb.Geometry.PackedBitmaps {
+		binary.LittleEndian.PutUint32(buf[340:344], 1)
+	}
+	binary.LittleEndian.PutUint32(buf[344:348], sb.FreeBlocks)
+	binary.LittleEndian.PutUint32(buf[348:352], sb.FreeInodes)
+	binary.LittleEndian.PutUint32(buf[superblockChecksumOffset:], checksum(buf[:superblockChecksumOffset]))
+	return buf
+}
@@ -0,0 +1,288 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// TarOptions configures ImportTarWithOptions and ExportTarWithOptions.
+type TarOptions struct {
+	// Progress, if set, is called after each entry of the archive, with the
+	// entries and the bytes of file contents done so far.
+	Progress ProgressFunc
+}
+
+// ImportTar creates the directories, files and hard links of the tar
+// archive read from r, with the permission bits and modification times it
+// records. Names are taken relative to the root, and directories missing
+// from the archive are created as needed. Entries of other types, such as
+// symbolic links, fail the import.
+//
+// Directories the filesystem already has are kept, but files fail with
+// ErrExist. Each entry is created in its own operation, so if the import
+// fails, the entries before the failing one stay.
+func (fs *FileSystem) ImportTar(r io.Reader) error {
+	return fs.ImportTarWithOptions(r, TarOptions{})
+}
+
+// ImportTarWithOptions is ImportTar with options.
+func (fs *FileSystem) ImportTarWithOptions(r io.Reader, opts TarOptions) error {
+	tr := tar.NewReader(r)
+	progress := Progress{Op: "import"}
+	// directories get their times once their contents are in, as adding
+	// to a directory changes its modification time
+	dirs := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := tarPath(hdr.Name)
+		err = fs.importEntry(name, hdr, tr)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %w", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+		progress.Items++
+		if hdr.Typeflag == tar.TypeReg {
+			progress.Bytes += hdr.Size
+		}
+		opts.Progress.report(progress)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := fs.importTimes(tarPath(dirs[i].Name), dirs[i])
+		if err != nil {
+			return fmt.Errorf("error importing %s: %w", dirs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// tarPath turns the name of a tar entry into an absolute name. Names can't
+// climb out of the root, as cleaning drops the ".." leading out of it.
+func tarPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// importEntry creates what a tar entry describes, with r holding the
+// contents of files.
+func (fs *FileSystem) importEntry(name string, hdr *tar.Header, r io.Reader) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("ImportTar %s", name)
+	defer fs.checkInvariantsAfter("ImportTar")()
+
+	if name == "/" {
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("the root: %w", ErrIsDirectory)
+		}
+		return nil
+	}
+	err = fs.makeParents(name)
+	if err != nil {
+		return err
+	}
+	perm := iofs.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		inode, err := fs.findInode(name)
+		if err == nil {
+			if inode.Type != InodeTypeDirectory {
+				return fmt.Errorf("%w, and %w", ErrExist, ErrNotDirectory)
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrNotExist) {
+			return err
+		}
+		_, err = fs.createInode(name, InodeTypeDirectory, &bytes.Buffer{}, perm, CompressionNone)
+		return err
+	case tar.TypeReg:
+		var contents io.Reader = r
+		if hdr.Size <= MaxFileSize {
+			contents = sizeHinted{Reader: r, n: int(hdr.Size)}
+		}
+		inode, err := fs.createFile(name, contents, perm)
+		if err != nil {
+			return err
+		}
+		return fs.setImportedTimes(int(inode.Index), hdr)
+	case tar.TypeLink:
+		return fs.link(tarPath(hdr.Linkname), name)
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+}
+
+// makeParents creates the directories leading to name that are missing.
+func (fs *FileSystem) makeParents(name string) error {
+	dir := path.Dir(name)
+	if dir == "/" {
+		return nil
+	}
+	for i := 1; i <= len(dir); i++ {
+		if i < len(dir) && dir[i] != '/' {
+			continue
+		}
+		parent := dir[:i]
+		inode, err := fs.findInode(parent)
+		switch {
+		case err == nil && inode.Type != InodeTypeDirectory:
+			return fmt.Errorf("%s: %w", parent, ErrNotDirectory)
+		case errors.Is(err, ErrNotExist):
+			_, err = fs.createInode(parent, InodeTypeDirectory, &bytes.Buffer{}, DefaultDirMode, CompressionNone)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+// importTimes gives the file or directory name the times of a tar entry.
+func (fs *FileSystem) importTimes(name string, hdr *tar.Header) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("ImportTar %s times", name)
+	defer fs.checkInvariantsAfter("ImportTar")()
+
+	inode, err := fs.findInodeOrRoot(name)
+	if err != nil {
+		return err
+	}
+	return fs.setImportedTimes(int(inode.Index), hdr)
+}
+
+// setImportedTimes sets the modification and access times of an inode to
+// those of a tar entry, and writes it out. Entries without an access time
+// get their modification time.
+func (fs *FileSystem) setImportedTimes(inodeIndex int, hdr *tar.Header) error {
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+	inode, err := fs.pinInode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	defer fs.inodes.unpin(inodeIndex)
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	inode.Modified, inode.Accessed = hdr.ModTime.Unix(), hdr.ModTime.Unix()
+	if !hdr.AccessTime.IsZero() {
+		inode.Accessed = hdr.AccessTime.Unix()
+	}
+	// reads recorded since would take the access time back
+	delete(fs.times, inodeIndex)
+	return fs.writeInodeTable()
+}
+
+// ExportTar writes the files and directories of the filesystem to w as a
+// tar archive, which ImportTar reads back, with names relative to the root.
+// Files with several names are written once, and their other names as hard
+// links to the first.
+//
+// The tree is walked as by Walk, so other goroutines may change it while it
+// is exported; each file is copied as it is when it is reached.
+func (fs *FileSystem) ExportTar(w io.Writer) error {
+	return fs.ExportTarWithOptions(w, TarOptions{})
+}
+
+// ExportTarWithOptions is ExportTar with options.
+func (fs *FileSystem) ExportTarWithOptions(w io.Writer, opts TarOptions) error {
+	tw := tar.NewWriter(w)
+	progress := Progress{Op: "export"}
+	// the name each file with several links was exported under first
+	exported := map[uint32]string{}
+	err := fs.Walk("/", func(name string, entry DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "/" {
+			return nil
+		}
+		info, err := fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		first, linked := exported[entry.Inode]
+		hdr := tarHeader(name, info, first)
+		if !linked && !info.IsDir() && info.Links() > 1 {
+			exported[entry.Inode] = name
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %w", name, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			n, err := fs.exportContents(tw, name)
+			if err != nil {
+				return fmt.Errorf("error exporting %s: %w", name, err)
+			}
+			progress.Bytes += n
+		}
+		progress.Items++
+		opts.Progress.report(progress)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarHeader returns the header of the tar entry for the file or directory
+// name, or for a hard link to first if first isn't empty.
+func tarHeader(name string, info FileInfo, first string) *tar.Header {
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(name, "/"),
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	if hdr.ModTime.IsZero() {
+		// the inode predates modification times
+		hdr.ModTime = time.Unix(0, 0)
+	}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case first != "":
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = strings.TrimPrefix(first, "/")
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	}
+	return hdr
+}
+
+// exportContents copies the contents of the file name to w.
+func (fs *FileSystem) exportContents(w io.Writer, name string) (int64, error) {
+	f, err := fs.Open(name, O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
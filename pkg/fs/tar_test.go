@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	iofs "io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	filesystem, _ := newBigTestFileSystem(t)
+	filesystem.SetDirOrder(DirOrderName)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	require.NoError(t, filesystem.Mkdir("/dir/sub"))
+	_, err := filesystem.CreateFile("/dir/sub/big", bytes.NewBuffer(patterned((directBlocks+3)*BlockSize+5)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/empty", &bytes.Buffer{})
+	require.NoError(t, err)
+	f, err := filesystem.OpenFile("/dir/private", O_WRONLY|O_CREATE, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("secret"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, filesystem.Link("/dir/private", "/alias"))
+
+	archive := &bytes.Buffer{}
+	progress := []Progress{}
+	err = filesystem.ExportTarWithOptions(archive, TarOptions{Progress: func(p Progress) {
+		progress = append(progress, p)
+	}})
+	require.NoError(t, err)
+	require.Len(t, progress, 6)
+	require.Equal(t, Progress{Op: "export", Items: 6, Bytes: int64((directBlocks+3)*BlockSize + 5 + 6)}, progress[5])
+
+	// the second name of /dir/private is a hard link to the first
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "alias" {
+			require.Equal(t, int64(0600), hdr.Mode)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			require.Equal(t, "dir/private", hdr.Name)
+			require.Equal(t, "alias", hdr.Linkname)
+		}
+	}
+	require.Equal(t, []string{"alias", "dir/", "dir/private", "dir/sub/", "dir/sub/big", "empty"}, names)
+
+	imported, _ := newBigTestFileSystem(t)
+	imported.SetDirOrder(DirOrderName)
+	// the times come from the archive, not from the clock
+	imported.now = func() time.Time { return time.Unix(2e9, 0) }
+	require.NoError(t, imported.ImportTar(bytes.NewReader(archive.Bytes())))
+	require.NoError(t, imported.CheckInvariants())
+	require.Equal(t, dumpTree(t, filesystem), dumpTree(t, imported))
+	for _, name := range []string{"/dir", "/dir/sub", "/dir/private", "/alias", "/dir/sub/big"} {
+		want, err := filesystem.Stat(name)
+		require.NoError(t, err)
+		got, err := imported.Stat(name)
+		require.NoError(t, err)
+		require.Equal(t, want.Mode(), got.Mode(), name)
+		require.Equal(t, want.ModTime(), got.ModTime(), name)
+		require.Equal(t, want.Links(), got.Links(), name)
+	}
+}
+
+func TestImportTar(t *testing.T) {
+	archive := func(headers ...*tar.Header) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range headers {
+			if hdr.Typeflag == 0 {
+				hdr.Typeflag = tar.TypeReg
+				hdr.Size = int64(len(hdr.Name))
+			}
+			require.NoError(t, tw.WriteHeader(hdr))
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(hdr.Name))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, tw.Close())
+		return buf
+	}
+
+	// missing directories are created, and names stay in the root
+	filesystem := newTestFileSystem(t)
+	require.NoError(t, filesystem.ImportTar(archive(
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./a/b/c", Mode: 0640},
+		&tar.Header{Name: "../escape", Mode: 0644},
+		&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0700},
+	)))
+	require.Equal(t, "/\n/a\n/a/b\n/a/b/c ./a/b/c\n/escape ../escape\n", dumpTree(t, filesystem))
+	info, err := filesystem.Stat("/a/b")
+	require.NoError(t, err)
+	require.Equal(t, iofs.FileMode(DefaultDirMode), info.Mode().Perm())
+
+	// existing files aren't replaced, and the entries before stay
+	err = filesystem.ImportTar(archive(
+		&tar.Header{Name: "new"},
+		&tar.Header{Name: "escape"},
+	))
+	require.ErrorIs(t, err, ErrExist)
+	_, err = filesystem.Stat("/new")
+	require.NoError(t, err)
+
+	require.ErrorContains(t, filesystem.ImportTar(archive(
+		&tar.Header{Name: "symlink", Typeflag: tar.TypeSymlink, Linkname: "new"},
+	)), "unsupported entry type")
+	require.ErrorContains(t, filesystem.ImportTar(archive(
+		&tar.Header{Name: "new/file"},
+	)), "/new: not a directory")
+	require.ErrorContains(t, filesystem.ImportTar(bytes.NewBuffer(bytes.Repeat([]byte("not a tar archive"), 100))), "error reading the archive")
+	require.NoError(t, filesystem.CheckInvariants())
+}
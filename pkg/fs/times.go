@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"time"
+)
+
+// Inodes record when their file was last modified, accessed and changed,
+// meaning its contents or its inode, in seconds since the Unix epoch.
+// Operations holding fs.mu for writing set the times of the inodes they
+// change, and write them out with the rest of the inode. Reads, and writes
+// that overwrite a file in place, hold it only for reading and can't change
+// inodes, so they record the times in fs.times instead; Stat takes them into
+// account, and Sync and Close write them to the inode table.
+
+// pendingTimes are the times of an inode recorded by reads and in-place
+// writes, or zero.
+type pendingTimes struct {
+	accessed int64
+	modified int64
+}
+
+// touch sets the modification and change times of an inode whose contents
+// changed.
+func (fs *FileSystem) touch(inode *Inode) {
+	now := fs.now().Unix()
+	inode.Modified, inode.Changed = now, now
+}
+
+// noteAccess records that an inode was read, for goroutines holding fs.mu
+// for reading.
+func (fs *FileSystem) noteAccess(inodeIndex int) {
+	now := fs.now().Unix()
+	fs.timesMu.Lock()
+	defer fs.timesMu.Unlock()
+	t := fs.times[inodeIndex]
+	t.accessed = now
+	fs.times[inodeIndex] = t
+}
+
+// noteModified records that an inode was overwritten in place, for
+// goroutines holding fs.mu for reading.
+func (fs *FileSystem) noteModified(inodeIndex int) {
+	now := fs.now().Unix()
+	fs.timesMu.Lock()
+	defer fs.timesMu.Unlock()
+	t := fs.times[inodeIndex]
+	t.modified = now
+	fs.times[inodeIndex] = t
+}
+
+// pending returns the times recorded for an inode since they were last
+// written.
+func (fs *FileSystem) pending(inodeIndex int) pendingTimes {
+	fs.timesMu.Lock()
+	defer fs.timesMu.Unlock()
+	return fs.times[inodeIndex]
+}
+
+// apply sets the times of inode to the recorded ones that are later.
+func (t pendingTimes) apply(inode *Inode) {
+	if t.accessed > inode.Accessed {
+		inode.Accessed = t.accessed
+	}
+	if t.modified > inode.Modified {
+		inode.Modified = t.modified
+	}
+	if t.modified > inode.Changed {
+		inode.Changed = t.modified
+	}
+}
+
+// flushTimes writes the recorded times to the inode table. Times recorded
+// for inodes freed since are dropped; if the index was reused, the new inode
+// is younger than them anyway.
+func (fs *FileSystem) flushTimes() (err error) {
+	fs.timesMu.Lock()
+	times := fs.times
+	fs.times = map[int]pendingTimes{}
+	fs.timesMu.Unlock()
+	if len(times) == 0 {
+		return nil
+	}
+	defer fs.commit(&err)
+
+	for inodeIndex, t := range times {
+		inode, err := fs.allocatedInode(inodeIndex)
+		if err != nil {
+			continue
+		}
+		t.apply(inode)
+		if t.modified != 0 {
+			// the file was overwritten in place, see contentsum.go
+			err = fs.recomputeContentSum(inode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing the recorded times: %w", err)
+	}
+	return nil
+}
+
+// FileInfo describes a file or directory, as returned by Stat. It implements
+// io/fs.FileInfo. Times are the zero time.Time if the inode predates them.
+type FileInfo struct {
+	name  string
+	inode Inode
+}
+
+// Stat describes the file or directory with the given absolute name.
+func (fs *FileSystem) Stat(filename string) (FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(filename)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error statting %s: %w", filename, err)
+	}
+	name := baseName(filename)
+	if filename == "/" {
+		name = "/"
+	}
+	return fs.fileInfo(name, inode), nil
+}
+
+// findInodeOrRoot is findInode, also finding the root as "/".
+func (fs *FileSystem) findInodeOrRoot(filename string) (*Inode, error) {
+	if filename == "/" {
+		return fs.traversePath("")
+	}
+	return fs.findInode(filename)
+}
+
+// fileInfo describes inode, with the times recorded for it.
+func (fs *FileSystem) fileInfo(name string, inode *Inode) FileInfo {
+	info := FileInfo{name: name, inode: *inode}
+	fs.pending(int(inode.Index)).apply(&info.inode)
+	return info
+}
+
+// Name returns the last element of the name passed to Stat.
+func (fi FileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the size of the file in bytes.
+func (fi FileInfo) Size() int64 {
+	return int64(fi.inode.Size)
+}
+
+// Mode returns the permission bits, along with iofs.ModeDir for
+// directories.
+func (fi FileInfo) Mode() iofs.FileMode {
+	mode := iofs.FileMode(fi.inode.Mode).Perm()
+	if fi.IsDir() {
+		mode |= iofs.ModeDir
+	}
+	return mode
+}
+
+// ModTime returns when the contents were last modified.
+func (fi FileInfo) ModTime() time.Time {
+	return unixTime(fi.inode.Modified)
+}
+
+// AccessTime returns when the contents were last read.
+func (fi FileInfo) AccessTime() time.Time {
+	return unixTime(fi.inode.Accessed)
+}
+
+// ChangeTime returns when the contents or the inode last changed.
+func (fi FileInfo) ChangeTime() time.Time {
+	return unixTime(fi.inode.Changed)
+}
+
+// CreateTime returns when the file was created.
+func (fi FileInfo) CreateTime() time.Time {
+	return unixTime(fi.inode.Created)
+}
+
+// Links returns the number of directory entries naming the file.
+func (fi FileInfo) Links() int {
+	return int(fi.inode.links())
+}
+
+// IsDir reports whether the inode is a directory.
+func (fi FileInfo) IsDir() bool {
+	return fi.inode.Type == InodeTypeDirectory
+}
+
+// Sys returns a copy of the inode, an *Inode.
+func (fi FileInfo) Sys() interface{} {
+	inode := fi.inode
+	return &inode
+}
+
+// unixTime converts seconds since the Unix epoch to a time, with zero
+// meaning unknown.
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := NewArrayBlockDevice(disk)
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	filesystem.now = func() time.Time { return now }
+	created := now
+
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	var info iofs.FileInfo
+	info, err = filesystem.Stat("/foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", info.Name())
+	require.Equal(t, int64(5), info.Size())
+	require.Equal(t, iofs.FileMode(DefaultFileMode), info.Mode())
+	require.False(t, info.IsDir())
+	require.Equal(t, created, info.ModTime())
+	require.Equal(t, 1, info.(FileInfo).Links())
+	require.Equal(t, uint32(1), info.Sys().(*Inode).Index)
+
+	dir, err := filesystem.Stat("/dir")
+	require.NoError(t, err)
+	require.True(t, dir.IsDir())
+	require.True(t, dir.Mode().IsDir())
+	root, err := filesystem.Stat("/")
+	require.NoError(t, err)
+	require.Equal(t, "/", root.Name())
+	_, err = filesystem.Stat("/missing")
+	require.ErrorIs(t, err, ErrNotExist)
+
+	// reading only sets the access time
+	now = now.Add(time.Minute)
+	_, err = filesystem.ReadFileContents(1)
+	require.NoError(t, err)
+	foo, err := filesystem.Stat("/foo")
+	require.NoError(t, err)
+	require.Equal(t, now, foo.AccessTime())
+	require.Equal(t, created, foo.ModTime())
+	require.Equal(t, created, foo.ChangeTime())
+
+	// in-place writes set the modification and change times
+	now = now.Add(time.Minute)
+	require.NoError(t, filesystem.WriteAt("/foo", []byte("J"), 0))
+	foo, err = filesystem.Stat("/foo")
+	require.NoError(t, err)
+	require.Equal(t, now, foo.ModTime())
+	require.Equal(t, now, foo.ChangeTime())
+
+	// as do writes growing the file
+	now = now.Add(time.Minute)
+	require.NoError(t, filesystem.Append("/foo", []byte("!")))
+	foo, err = filesystem.Stat("/foo")
+	require.NoError(t, err)
+	require.Equal(t, now, foo.ModTime())
+
+	// renaming only changes the inode; the directories' contents change
+	now = now.Add(time.Minute)
+	require.NoError(t, filesystem.Rename("/foo", "/dir/foo"))
+	foo, err = filesystem.Stat("/dir/foo")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-time.Minute), foo.ModTime())
+	require.Equal(t, now, foo.ChangeTime())
+	dir, err = filesystem.Stat("/dir")
+	require.NoError(t, err)
+	require.Equal(t, now, dir.ModTime())
+
+	// the times recorded by reads reach the device on Close
+	now = now.Add(time.Minute)
+	f, err := filesystem.Open("/dir/foo", O_RDONLY)
+	require.NoError(t, err)
+	_, err = f.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(dev)
+	require.NoError(t, err)
+	foo, err = reloaded.Stat("/dir/foo")
+	require.NoError(t, err)
+	require.Equal(t, now, foo.AccessTime())
+	require.Equal(t, created, foo.CreateTime())
+	for _, f := range Diagnose(dev) {
+		require.Equal(t, SeverityInfo, f.Severity, f.Message)
+	}
+}
+
+func TestStatOldInode(t *testing.T) {
+	// inodes written before times and link counts have zeros
+	info := FileInfo{name: "old", inode: Inode{Type: InodeTypeFile, Mode: 0644}}
+	require.True(t, info.ModTime().IsZero())
+	require.True(t, info.AccessTime().IsZero())
+	require.Equal(t, 1, info.Links())
+	require.Equal(t, iofs.FileMode(0644), info.Mode())
+}
@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+)
+
+// Truncate changes the size of the file with the given absolute name.
+// Shrinking it frees the data blocks, and pointer blocks, past the new end;
+// extending it allocates blocks and fills them with zeros, like writing past
+// the end. On write-once filesystems, shrinking fails with ErrWORM until the
+// file's retention period has passed. If it fails, the file is left as it
+// was.
+func (fs *FileSystem) Truncate(filename string, size int64) (err error) {
+	return fs.TruncateContext(context.Background(), filename, size)
+}
+
+// TruncateContext is Truncate under ctx, see context.go.
+func (fs *FileSystem) TruncateContext(ctx context.Context, filename string, size int64) (err error) {
+	if size < 0 {
+		return fmt.Errorf("error truncating %s: negative size %d", filename, size)
+	}
+	if size > MaxFileSize {
+		return fmt.Errorf("error truncating %s to %d bytes: %w", filename, size, ErrTooLarge)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Truncate %s (to %d bytes)", filename, size)
+	defer fs.checkInvariantsAfter("Truncate")()
+	defer fs.withContext(ctx)()
+
+	inode, err := fs.findFile(filename)
+	if err == nil {
+		err = fs.checkAccess(inode, accessWrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error truncating %s: %w", filename, err)
+	}
+	err = fs.truncate(inode, size)
+	if err != nil {
+		return fmt.Errorf("error truncating %s to %d bytes: %w", filename, size, err)
+	}
+	return nil
+}
+
+// truncate changes the size of inode, as described by Truncate.
+func (fs *FileSystem) truncate(inode *Inode, size int64) error {
+	switch {
+	case size == int64(inode.Size):
+		return nil
+	case size > int64(inode.Size):
+		// writing nothing at the new end zero-fills the gap
+		return fs.writeAt(inode, nil, size, make([]byte, BlockSize))
+	}
+	err := fs.checkRetained(inode)
+	if err != nil {
+		return err
+	}
+	return fs.shrink(inode, size)
+}
+
+// shrink cuts inode down to size bytes, and persists the inode table and the
+// data bitmap. The rest of the new last block is zeroed, so growing the file
+// again doesn't bring back the old data. If it fails, the inode and the data
+// bitmap are left as they were.
+func (fs *FileSystem) shrink(inode *Inode, size int64) (err error) {
+	if inode.compressed() {
+		contents, err := fs.readContents(inode)
+		if err != nil {
+			return err
+		}
+		return fs.rewriteCompressed(inode, contents.Bytes()[:size])
+	}
+	old, err := fs.readBlockMap(inode)
+	if err != nil {
+		return err
+	}
+	nBlocks := GetSizeInBlocks(int(size))
+
+	snapshot := fs.snapshot(int(inode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	for _, blockIndex := range old.data[nBlocks:] {
+		fs.releaseBlock(blockIndex)
+	}
+	blocks := append([]uint32{}, old.data[:nBlocks]...)
+	if size%BlockSize != 0 {
+		// the last block is zeroed past the new end below, so a shared
+		// one is copied first
+		_, err = fs.unshare(inode, blocks, nBlocks-1, nBlocks, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.mapBlocks(inode, old, blocks)
+	if err != nil {
+		return err
+	}
+
+	if tail := size % BlockSize; tail != 0 {
+		blockIndex := blocks[nBlocks-1]
+		block := make([]byte, BlockSize)
+		err = fs.readBlock(uint64(blockIndex), block)
+		if err != nil {
+			return fmt.Errorf("error reading block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+		for i := tail; i < BlockSize; i++ {
+			block[i] = 0
+		}
+		fs.revoke(uint64(blockIndex))
+		err = fs.writeBlock(uint64(blockIndex), block)
+		if err != nil {
+			return fmt.Errorf("error writing block %d of inode %d: %w", blockIndex, inode.Index, err)
+		}
+	}
+
+	if inode.Type == InodeTypeFile {
+		err = fs.chargeQuota(snapshot, inode, size-int64(inode.Size), 0)
+		if err != nil {
+			return err
+		}
+	}
+	inode.Size = uint32(size)
+	err = fs.recomputeContentSum(inode)
+	if err != nil {
+		return err
+	}
+	fs.touch(inode)
+	err = fs.writeInodeTable()
+	if err != nil {
+		return err
+	}
+	return fs.persistDataBitmap()
+}
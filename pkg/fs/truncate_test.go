@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncate(t *testing.T) {
+	filesystem, disk := newPointerTestFileSystem(t)
+	free := filesystem.freeBlocks.free
+	readFile := func(fs *FileSystem) []byte {
+		inode, err := fs.FindInodeByName("/big")
+		require.NoError(t, err)
+		contents, err := fs.ReadFileContents(int(inode.Index))
+		require.NoError(t, err)
+		return contents.Bytes()
+	}
+
+	// shrinking frees the data blocks and the pointer blocks past the end
+	size := (directBlocks + pointersPerBlock + 5) * BlockSize
+	_, err := filesystem.CreateFile("/big", bytes.NewBuffer(patterned(size)))
+	require.NoError(t, err)
+	for _, size := range []int{(directBlocks+3)*BlockSize + 10, 3*BlockSize + 100, 0} {
+		require.NoError(t, filesystem.Truncate("/big", int64(size)))
+		require.NoError(t, filesystem.CheckInvariants())
+		require.Equal(t, patterned(size), append([]byte{}, readFile(filesystem)...))
+	}
+	// the root keeps its directory block
+	require.Equal(t, free-1, filesystem.freeBlocks.free)
+
+	// extending zero-fills, and doesn't bring back the data cut off
+	require.NoError(t, filesystem.WriteAt("/big", patterned(2*BlockSize), 0))
+	require.NoError(t, filesystem.Truncate("/big", BlockSize+10))
+	require.NoError(t, filesystem.Truncate("/big", int64(directBlocks+2)*BlockSize))
+	want := make([]byte, (directBlocks+2)*BlockSize)
+	copy(want, patterned(BlockSize+10))
+	require.Equal(t, want, readFile(filesystem))
+	require.Equal(t, free-1-(directBlocks+2)-1, filesystem.freeBlocks.free)
+
+	require.NoError(t, filesystem.Close())
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, want, readFile(reloaded))
+}
+
+func TestTruncateErrors(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(patterned(3*BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	require.ErrorIs(t, filesystem.Truncate("/missing", 0), ErrNotExist)
+	require.ErrorIs(t, filesystem.Truncate("/dir", 0), ErrIsDirectory)
+	require.ErrorContains(t, filesystem.Truncate("/foo", -1), "negative size")
+	require.ErrorIs(t, filesystem.Truncate("/foo", MaxFileSize+1), ErrTooLarge)
+
+	// a failed truncate leaves the file as it was
+	before := filesystem.describeMetadata()
+	for i := 1; ; i++ {
+		dev.failWriteAt = dev.writes + i
+		err = filesystem.Truncate("/foo", 10)
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, errInjected)
+		require.Equal(t, before, filesystem.describeMetadata(), "failing write %d", i)
+	}
+	dev.failWriteAt = 0
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, patterned(10), contents.Bytes())
+}
+
+func TestTruncateWORM(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{WORM: true})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/audit", bytes.NewBufferString("entry\n"))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.Truncate("/audit", 0), ErrWORM)
+	require.NoError(t, filesystem.Truncate("/audit", 10))
+}
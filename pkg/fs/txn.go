@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrTxnDone is returned when committing or rolling back a Txn that already
+// ended.
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn groups operations so that the metadata they change is written once,
+// when the transaction commits, rather than after each of them: creating a
+// hundred files in a transaction writes the inode table and the bitmaps once
+// instead of a hundred times. See Begin.
+type Txn struct {
+	fs *FileSystem
+	// inodeBitmap, dataBitmap, dedup and quarantine are as they were at
+	// Begin, for rolling back
+	inodeBitmap *Bitmap
+	dataBitmap  *Bitmap
+	dedup       []dedupEntry
+	quarantine  []quarantinedInode
+	// freedBlocks are the data bitmap indices of the blocks freed by the
+	// transaction, kept out of the free-space index until Commit: file data
+	// is written in place, so reusing them before would overwrite data that
+	// rolling back restores
+	freedBlocks []int
+	// buffered is set on filesystems without a journal, whose metadata
+	// blocks the transaction holds in a journal of its own until Commit
+	// writes them in place
+	buffered bool
+	// err is why the transaction ended: ErrTxnDone, or the error of the
+	// operation that failed
+	err error
+}
+
+// Begin starts a transaction. The filesystem stays locked until it is
+// committed or rolled back, so the goroutine running it must only call the
+// methods of the Txn until then.
+//
+// The operations of a transaction change the inodes and the bitmaps in
+// memory only, and the metadata blocks they write, such as the contents of
+// directories, are held in memory like the transaction of a journal, see
+// journal.go. Commit writes it all. On a journaled filesystem, everything
+// goes through the journal as a single transaction, so operations fail with
+// ErrJournalFull once the transaction outgrows it. File data is written in
+// place as the operations run, so the blocks the transaction frees are only
+// reused once it commits.
+//
+// If an operation fails, the whole transaction is rolled back and ends, and
+// the later operations and Commit return the same error.
+func (fs *FileSystem) Begin() *Txn {
+	fs.mu.Lock()
+	fs.explainOp("Begin")
+	t := &Txn{
+		fs:          fs,
+		inodeBitmap: fs.inodeBitmap.clone(),
+		dataBitmap:  fs.dataBitmap.clone(),
+		quarantine:  append([]quarantinedInode(nil), fs.quarantine...),
+	}
+	if fs.dedup != nil {
+		t.dedup = fs.dedup.clone()
+	}
+	if fs.journal == nil {
+		t.buffered = true
+		fs.journal = &journal{capacity: math.MaxInt, blocks: map[uint64][]byte{}}
+	}
+	fs.txn = t
+	fs.inodes.hold()
+	return t
+}
+
+// Create creates a file with the given absolute name and the contents read
+// from r until io.EOF, like CreateFileFromReader.
+func (t *Txn) Create(filename string, r io.Reader) (*Inode, error) {
+	var inode *Inode
+	err := t.run("Txn.Create", filename, func() (err error) {
+		inode, err = t.fs.createFile(filename, r, DefaultFileMode)
+		return err
+	})
+	return inode, err
+}
+
+// Write writes data at the given offset of the file with the given absolute
+// name, like WriteAt. Data overwritten in place isn't restored if the
+// transaction is rolled back.
+func (t *Txn) Write(filename string, data []byte, offset int64) error {
+	return t.run("Txn.Write", filename, func() error {
+		if offset < 0 {
+			return fmt.Errorf("error writing %s: negative offset %d", filename, offset)
+		}
+		return t.fs.writeFileAt(filename, data, offset)
+	})
+}
+
+// Delete removes the file with the given absolute name, like DeleteFile.
+func (t *Txn) Delete(filename string) error {
+	return t.run("Txn.Delete", filename, func() error {
+		return t.fs.deleteFile(filename)
+	})
+}
+
+// Mkdir creates an empty directory with the given absolute name, like
+// Mkdir.
+func (t *Txn) Mkdir(dirname string) error {
+	return t.run("Txn.Mkdir", dirname, func() error {
+		_, err := t.fs.createInode(dirname, InodeTypeDirectory, &bytes.Buffer{}, DefaultDirMode, CompressionNone)
+		if err != nil {
+			return fmt.Errorf("error creating directory %s: %w", dirname, err)
+		}
+		return nil
+	})
+}
+
+// run runs an operation of the transaction, and rolls the transaction back
+// and ends it if the operation fails.
+func (t *Txn) run(op, name string, f func() error) (err error) {
+	if t.err != nil {
+		return t.err
+	}
+	fs := t.fs
+	defer func() {
+		if err != nil {
+			t.end(err)
+		}
+	}()
+	fs.explainOp("%s %s", op, name)
+	defer fs.checkInvariantsAfter(op)()
+
+	err = f()
+	if err != nil {
+		// the operation rolled itself back, but the metadata blocks of
+		// the earlier ones were dropped with its own
+		if rollbackErr := t.discard(); rollbackErr != nil {
+			err = fmt.Errorf("%w (rolling back the transaction also failed: %v)", err, rollbackErr)
+		}
+	}
+	return err
+}
+
+// Commit writes the metadata the transaction changed and ends it. If that
+// fails, the transaction is rolled back in memory. With a journal, none of
+// it reaches the device then, as for a failed commit of an operation;
+// without one, the device may be left inconsistent.
+func (t *Txn) Commit() (err error) {
+	if t.err != nil {
+		return t.err
+	}
+	fs := t.fs
+	defer func() {
+		if err != nil {
+			t.end(err)
+		} else {
+			t.end(ErrTxnDone)
+		}
+	}()
+	fs.explainOp("Txn.Commit")
+	defer fs.checkInvariantsAfter("Txn.Commit")()
+
+	fs.txn = nil
+	err = fs.writeInodeTable()
+	if err != nil {
+		err = fmt.Errorf("error writing inode table: %w", err)
+	}
+	if err == nil {
+		err = fs.persistInodeBitmap()
+		if err != nil {
+			err = fmt.Errorf("error writing inode bitmap: %w", err)
+		}
+	}
+	if err == nil {
+		err = fs.persistDataBitmap()
+		if err != nil {
+			err = fmt.Errorf("error writing data bitmap: %w", err)
+		}
+	}
+	if err == nil {
+		if t.buffered {
+			err = t.writeBuffered()
+		} else {
+			fs.commit(&err)
+		}
+	}
+	if err != nil {
+		if rollbackErr := t.discard(); rollbackErr != nil {
+			err = fmt.Errorf("%w (rolling back the transaction also failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+	for _, i := range t.freedBlocks {
+		// a later operation of the transaction may have allocated it again
+		if !fs.dataBitmap.test(i) {
+			fs.freeBlocks.release(i)
+		}
+	}
+	t.freedBlocks = nil
+	return nil
+}
+
+// writeBuffered writes the metadata blocks held for a filesystem without a
+// journal in place.
+func (t *Txn) writeBuffered() error {
+	fs := t.fs
+	j := fs.journal
+	blockNums := j.sorted()
+	fs.explainf("transaction: write %d blocks in place", len(blockNums))
+	for _, blockNum := range blockNums {
+		err := fs.writeBlock(blockNum, j.blocks[blockNum])
+		if err != nil {
+			return fmt.Errorf("error writing block %d: %w", blockNum, err)
+		}
+	}
+	j.blocks = map[uint64][]byte{}
+	return nil
+}
+
+// Rollback discards the changes of the transaction and ends it. It returns
+// ErrTxnDone if the transaction already ended, so it can be deferred right
+// after Begin.
+func (t *Txn) Rollback() (err error) {
+	if t.err != nil {
+		return ErrTxnDone
+	}
+	fs := t.fs
+	defer t.end(ErrTxnDone)
+	fs.explainOp("Txn.Rollback")
+	defer fs.checkInvariantsAfter("Txn.Rollback")()
+	return t.discard()
+}
+
+// discard restores the metadata in memory as it was at Begin, and drops the
+// metadata blocks held for the device. Cached inodes are read again from the
+// device, in place so that pointers handed out earlier stay valid, and those
+// that weren't allocated at Begin are dropped.
+func (t *Txn) discard() error {
+	fs := t.fs
+	fs.explainf("discarding the changes of the transaction")
+	fs.inodeBitmap.replace(t.inodeBitmap)
+	fs.dataBitmap.replace(t.dataBitmap)
+	if t.dedup != nil {
+		fs.dedup.replace(t.dedup)
+	}
+	fs.quarantine = t.quarantine
+	t.freedBlocks = nil
+	fs.indexFreeSpace()
+	err := fs.dropTransaction()
+	for _, inodeIndex := range fs.inodes.indices() {
+		if !fs.inodeBitmap.test(inodeIndex) {
+			fs.inodes.remove(inodeIndex)
+			continue
+		}
+		saved, readErr := fs.readInode(inodeIndex)
+		if readErr != nil {
+			if err == nil {
+				err = readErr
+			}
+			fs.inodes.remove(inodeIndex)
+			continue
+		}
+		if current, _ := fs.inodes.peek(inodeIndex); current != nil {
+			*current = *saved
+		} else {
+			fs.inodes.put(inodeIndex, saved)
+		}
+	}
+	return err
+}
+
+// end ends the transaction with err and unlocks the filesystem.
+func (t *Txn) end(err error) {
+	fs := t.fs
+	t.err = err
+	fs.txn = nil
+	if t.buffered {
+		fs.journal = nil
+	}
+	fs.inodes.unhold()
+	fs.mu.Unlock()
+}
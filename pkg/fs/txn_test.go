@@ -0,0 +1,191 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var txnOptions = map[string]MkfsOptions{
+	"plain":   {Blocks: 400},
+	"journal": {Blocks: 400, JournalBlocks: 64},
+}
+
+func TestTxnCommit(t *testing.T) {
+	for name, opts := range txnOptions {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, int(opts.Blocks)*BlockSize)
+			dev := &orderDevice{BlockDevice: NewArrayBlockDevice(disk)}
+			filesystem, err := NewFileSystemWithOptions(dev, opts)
+			require.NoError(t, err)
+			_, err = filesystem.CreateFile("/old", bytes.NewBufferString("old"))
+			require.NoError(t, err)
+
+			dev.log = nil
+			txn := filesystem.Begin()
+			require.NoError(t, txn.Mkdir("/dir"))
+			for i := 0; i < 20; i++ {
+				_, err := txn.Create(fmt.Sprintf("/dir/file%d", i), strings.NewReader("hello"))
+				require.NoError(t, err)
+			}
+			require.NoError(t, txn.Write("/old", []byte(" and new"), 3))
+			require.NoError(t, txn.Delete("/dir/file0"))
+
+			// only file data was written so far
+			inodeTable := fmt.Sprintf("write %d", filesystem.geometry.InodeTableStart)
+			require.NotContains(t, dev.log, inodeTable)
+			require.NotContains(t, dev.log, fmt.Sprintf("write %d", filesystem.geometry.InodeBitmapStart))
+			require.NotContains(t, dev.log, fmt.Sprintf("write %d", filesystem.geometry.DataBitmapStart))
+
+			require.NoError(t, txn.Commit())
+			writes := 0
+			for _, entry := range dev.log {
+				if entry == inodeTable {
+					writes++
+				}
+			}
+			require.Equal(t, 1, writes)
+			require.ErrorIs(t, txn.Commit(), ErrTxnDone)
+			require.ErrorIs(t, txn.Rollback(), ErrTxnDone)
+
+			// the filesystem is usable again
+			_, err = filesystem.CreateFile("/after", &bytes.Buffer{})
+			require.NoError(t, err)
+			require.NoError(t, filesystem.Close())
+
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			inode, err := reloaded.FindInodeByName("/dir/file19")
+			require.NoError(t, err)
+			contents, err := reloaded.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, "hello", contents.String())
+			inode, err = reloaded.FindInodeByName("/old")
+			require.NoError(t, err)
+			contents, err = reloaded.ReadFileContents(int(inode.Index))
+			require.NoError(t, err)
+			require.Equal(t, "old and new", contents.String())
+			_, err = reloaded.FindInodeByName("/dir/file0")
+			require.ErrorIs(t, err, ErrNotExist)
+			report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+		})
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	for name, opts := range txnOptions {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, int(opts.Blocks)*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), opts)
+			require.NoError(t, err)
+			old, err := filesystem.CreateFile("/old", bytes.NewBufferString("old"))
+			require.NoError(t, err)
+			before, err := filesystem.Statfs()
+			require.NoError(t, err)
+
+			txn := filesystem.Begin()
+			require.NoError(t, txn.Mkdir("/dir"))
+			_, err = txn.Create("/dir/file", strings.NewReader("hello"))
+			require.NoError(t, err)
+			require.NoError(t, txn.Write("/old", bytes.Repeat([]byte("x"), 2*BlockSize), 3))
+			require.NoError(t, txn.Rollback())
+
+			_, err = filesystem.FindInodeByName("/dir")
+			require.ErrorIs(t, err, ErrNotExist)
+			require.Equal(t, uint32(3), old.Size)
+			after, err := filesystem.Statfs()
+			require.NoError(t, err)
+			require.Equal(t, before, after)
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+
+			report, err := Fsck(NewArrayBlockDevice(disk), FsckOptions{})
+			require.NoError(t, err)
+			require.Empty(t, report.Remaining)
+		})
+	}
+}
+
+func TestTxnRollbackDelete(t *testing.T) {
+	for name, opts := range txnOptions {
+		t.Run(name, func(t *testing.T) {
+			disk := make([]byte, int(opts.Blocks)*BlockSize)
+			filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), opts)
+			require.NoError(t, err)
+			empty, err := filesystem.Statfs()
+			require.NoError(t, err)
+			contents := bytes.Repeat([]byte("a"), 3*BlockSize)
+			_, err = filesystem.CreateFile("/a", bytes.NewBuffer(contents))
+			require.NoError(t, err)
+
+			// the blocks /a frees aren't reused by /b, so rolling back
+			// gets /a back intact
+			txn := filesystem.Begin()
+			require.NoError(t, txn.Delete("/a"))
+			_, err = txn.Create("/b", bytes.NewReader(bytes.Repeat([]byte("b"), 3*BlockSize)))
+			require.NoError(t, err)
+			require.NoError(t, txn.Rollback())
+
+			read, err := filesystem.ReadFile("/a")
+			require.NoError(t, err)
+			require.Equal(t, contents, read)
+			require.NoError(t, filesystem.CheckInvariants())
+			require.NoError(t, filesystem.Close())
+
+			reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+			require.NoError(t, err)
+			read, err = reloaded.ReadFile("/a")
+			require.NoError(t, err)
+			require.Equal(t, contents, read)
+
+			// once committed, the freed blocks are free again
+			txn = reloaded.Begin()
+			require.NoError(t, txn.Delete("/a"))
+			require.NoError(t, txn.Commit())
+			after, err := reloaded.Statfs()
+			require.NoError(t, err)
+			require.Equal(t, empty.FreeBlocks, after.FreeBlocks)
+			require.NoError(t, reloaded.CheckInvariants())
+		})
+	}
+}
+
+func TestTxnFailure(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+
+	// a failed operation rolls back the whole transaction and ends it
+	txn := filesystem.Begin()
+	_, err = txn.Create("/foo", &bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = txn.Create("/foo", &bytes.Buffer{})
+	require.ErrorIs(t, err, ErrExist)
+	require.ErrorIs(t, txn.Mkdir("/bar"), ErrExist)
+	require.ErrorIs(t, txn.Commit(), ErrExist)
+	require.ErrorIs(t, txn.Rollback(), ErrTxnDone)
+
+	_, err = filesystem.FindInodeByName("/foo")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.NoError(t, filesystem.CheckInvariants())
+}
+
+func TestTxnJournalFull(t *testing.T) {
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(make([]byte, 400*BlockSize)), MkfsOptions{Blocks: 400, InodeRatio: BlockSize, JournalBlocks: MinJournalBlocks + 2})
+	require.NoError(t, err)
+
+	txn := filesystem.Begin()
+	for i := 0; err == nil; i++ {
+		_, err = txn.Create(fmt.Sprintf("/a rather long name for file number %d", i), &bytes.Buffer{})
+	}
+	require.ErrorIs(t, err, ErrJournalFull)
+	require.ErrorIs(t, txn.Commit(), ErrJournalFull)
+	entries, err := filesystem.ReadDir(0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoError(t, filesystem.CheckInvariants())
+}
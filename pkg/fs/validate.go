@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupt is returned when the metadata on a device is inconsistent.
+var ErrCorrupt = errors.New("filesystem is corrupt")
+
+// corruptf returns an error wrapping ErrCorrupt.
+func corruptf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// validate checks the metadata read from the device: the bitmaps hold only
+// zeros and ones, the root directory exists, every inode is well formed, and
+// its blocks, pointer blocks included, lie in the data region, are marked
+// used and aren't shared, unless the dedup table counts their references.
+func (fs *FileSystem) validate() error {
+	if b := fs.inodeBitmap; b.invalidValue != 0 {
+		return corruptf("inode bitmap entry %d has invalid value %d", b.invalid, b.invalidValue)
+	}
+	if b := fs.dataBitmap; b.invalidValue != 0 {
+		return corruptf("data bitmap entry %d has invalid value %d", b.invalid, b.invalidValue)
+	}
+
+	if !fs.inodeBitmap.test(0) {
+		return corruptf("root directory inode is not allocated")
+	}
+
+	owners := map[uint32]int{}
+	refs := map[uint32]int{}
+	err := fs.forEachInode(func(i int, inode *Inode) error {
+		if i == 0 && inode.Type != InodeTypeDirectory {
+			return corruptf("root inode is not a directory")
+		}
+		err := inode.validate(i)
+		if err != nil {
+			return err
+		}
+		blocks, err := fs.readBlockMap(inode)
+		if err != nil {
+			return err
+		}
+		for _, blockIndex := range blocks.owned() {
+			if !fs.isDataBlock(blockIndex) {
+				return corruptf("inode %d: block %d is outside the data region", i, blockIndex)
+			}
+			if owner, ok := owners[blockIndex]; ok && fs.dedup == nil {
+				return corruptf("block %d is used by both inode %d and inode %d", blockIndex, owner, i)
+			}
+			owners[blockIndex] = i
+			refs[blockIndex]++
+			if !fs.dataBitmap.test(int(blockIndex - fs.geometry.DataStart)) {
+				return corruptf("inode %d: block %d is marked free", i, blockIndex)
+			}
+		}
+		return nil
+	})
+	if err != nil || fs.dedup == nil {
+		return err
+	}
+	if mismatches := fs.dedupMismatches(refs); len(mismatches) > 0 {
+		return corruptf("%s", mismatches[0])
+	}
+	return nil
+}
+
+// isDataBlock reports whether a device block index is in the data region,
+// past data block 0, so it can belong to a file.
+func (fs *FileSystem) isDataBlock(blockIndex uint32) bool {
+	return blockIndex > fs.geometry.DataStart && blockIndex < fs.geometry.BlockCount
+}
+
+// validate checks the fields of an inode stored in slot index, without
+// looking at other inodes or the bitmaps.
+func (inode *Inode) validate(index int) error {
+	if int(inode.Index) != index {
+		return corruptf("inode %d: stored index is %d", index, inode.Index)
+	}
+	if inode.Type != InodeTypeFile && inode.Type != InodeTypeDirectory {
+		return corruptf("inode %d: unknown type %d", index, inode.Type)
+	}
+
+	if inode.dirIndexed && (inode.Type != InodeTypeDirectory || !inode.BinaryDir) {
+		return corruptf("inode %d: only directories of binary entries can be indexed", index)
+	}
+	if inode.entriesCounted && inode.Type != InodeTypeDirectory {
+		return corruptf("inode %d: only directories have entry counts", index)
+	}
+	if inode.quotaSet && inode.Type != InodeTypeDirectory {
+		return corruptf("inode %d: only directories can have a quota", index)
+	}
+	if inode.compressed() && inode.Type != InodeTypeFile {
+		return corruptf("inode %d: only files can be compressed", index)
+	}
+	if len(inode.xattrs) > 0 && inode.xattrBlock != 0 {
+		return corruptf("inode %d: has extended attributes both in its slot and in xattr block %d", index, inode.xattrBlock)
+	}
+	if inode.extentMapped {
+		return inode.validateExtents(index)
+	}
+	blocks := inode.usedBlocks()
+	for _, blockIndex := range inode.Blocks[len(blocks):] {
+		if blockIndex != 0 {
+			return corruptf("inode %d: block list has a gap", index)
+		}
+	}
+	want := inode.StoredBlocks()
+	direct := want
+	if direct > directBlocks {
+		direct = directBlocks
+	}
+	if direct != len(blocks) {
+		return corruptf("inode %d: size %d needs %d blocks, but %d are allocated", index, inode.storedSize(), want, len(blocks))
+	}
+	return inode.validatePointers(index)
+}
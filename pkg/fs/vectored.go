@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"fmt"
+)
+
+// VectoredBlockDevice is the second version of the block device interface.
+// Runs of consecutive blocks are read and written in one call, which devices
+// reached over the network, such as a NetBlockDevice, turn into one round
+// trip instead of one per block. The FileSystem uses them for the blocks of
+// files that lie next to each other, and keeps using ReadBlock and
+// WriteBlock for single blocks. AdaptBlockDevice makes any BlockDevice a
+// VectoredBlockDevice.
+type VectoredBlockDevice interface {
+	BlockDevice
+	// ReadBlocks reads len(bufs) consecutive blocks, from start on, a block
+	// into each buffer.
+	ReadBlocks(start uint64, bufs [][]byte) error
+	// WriteBlocks writes the buffers to len(bufs) consecutive blocks, from
+	// start on. Like WriteBlock, a buffer shorter than a block only
+	// overwrites the start of its block. If it fails, any of the blocks may
+	// have been written.
+	WriteBlocks(start uint64, bufs [][]byte) error
+	// Flush makes the writes that completed stable.
+	Flush() error
+	// Size returns the number of blocks of the device, or 0 if it doesn't
+	// know.
+	Size() uint64
+}
+
+// AdaptBlockDevice returns dev as a VectoredBlockDevice: dev itself if it
+// is one already, and otherwise an adapter reading and writing runs a block
+// at a time. The adapter flushes devices that have a Sync method with it,
+// and sizes those that have a BlockCount method with it.
+func AdaptBlockDevice(dev BlockDevice) VectoredBlockDevice {
+	if v, ok := dev.(VectoredBlockDevice); ok {
+		return v
+	}
+	return blockDeviceAdapter{dev}
+}
+
+// blockDeviceAdapter is a BlockDevice made a VectoredBlockDevice by
+// AdaptBlockDevice.
+type blockDeviceAdapter struct {
+	BlockDevice
+}
+
+func (a blockDeviceAdapter) ReadBlocks(start uint64, bufs [][]byte) error {
+	for i, buf := range bufs {
+		err := a.ReadBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a blockDeviceAdapter) WriteBlocks(start uint64, bufs [][]byte) error {
+	for i, buf := range bufs {
+		err := a.WriteBlock(start+uint64(i), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a blockDeviceAdapter) Flush() error {
+	if dev, ok := a.BlockDevice.(syncer); ok {
+		return dev.Sync()
+	}
+	return nil
+}
+
+func (a blockDeviceAdapter) Size() uint64 {
+	if dev, ok := a.BlockDevice.(sizedDevice); ok {
+		return dev.BlockCount()
+	}
+	return 0
+}
+
+// syncer is implemented by block devices that can flush completed writes to
+// stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// flushDevice makes the completed writes to dev stable, if it can: with
+// Sync, or Flush on VectoredBlockDevices.
+func flushDevice(dev BlockDevice) error {
+	if dev, ok := dev.(syncer); ok {
+		return dev.Sync()
+	}
+	return AdaptBlockDevice(dev).Flush()
+}
+
+// deviceSize returns the number of blocks of dev, or 0 if it doesn't know:
+// with BlockCount, or Size on VectoredBlockDevices.
+func deviceSize(dev BlockDevice) uint64 {
+	if dev, ok := dev.(sizedDevice); ok {
+		return dev.BlockCount()
+	}
+	return AdaptBlockDevice(dev).Size()
+}
+
+// splitBlocks splits buf into a buffer per block, for ReadBlocks and
+// WriteBlocks.
+func splitBlocks(buf []byte) [][]byte {
+	bufs := make([][]byte, len(buf)/BlockSize)
+	for i := range bufs {
+		bufs[i] = buf[i*BlockSize : (i+1)*BlockSize]
+	}
+	return bufs
+}
+
+// joinedBlocks returns the buffer that the buffers of a run are the
+// consecutive blocks of, as splitBlocks makes them, so devices can transfer
+// the run at once; it returns nil if they aren't.
+func joinedBlocks(bufs [][]byte) []byte {
+	if len(bufs) == 0 || cap(bufs[0]) < len(bufs)*BlockSize {
+		return nil
+	}
+	joined := bufs[0][:len(bufs)*BlockSize]
+	for i, buf := range bufs {
+		if len(buf) != BlockSize || &buf[0] != &joined[i*BlockSize] {
+			return nil
+		}
+	}
+	return joined
+}
+
+// maxWriteRun is the most blocks a runWriter gathers into a run.
+const maxWriteRun = 64
+
+// runWriter gathers the blocks of an inode written one after another into
+// runs of consecutive blocks, which it writes with writeBlocks once they
+// end or hold maxWriteRun blocks, and on flush.
+type runWriter struct {
+	fs         *FileSystem
+	inodeIndex uint32
+	start      uint64
+	buf        []byte
+}
+
+// write writes block to blockNum, or holds it back to write it along with
+// the next ones.
+func (w *runWriter) write(blockNum uint64, block []byte) error {
+	n := uint64(len(w.buf) / BlockSize)
+	if n > 0 && (blockNum != w.start+n || n == maxWriteRun) {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.buf) == 0 {
+		w.start = blockNum
+	}
+	w.buf = append(w.buf, block...)
+	return nil
+}
+
+// flush writes the blocks held back.
+func (w *runWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	bufs := splitBlocks(w.buf)
+	w.buf = w.buf[:0]
+	err := w.fs.writeBlocks(w.start, bufs)
+	if err != nil {
+		return fmt.Errorf("error writing blocks %d to %d of inode %d: %w", w.start, w.start+uint64(len(bufs))-1, w.inodeIndex, err)
+	}
+	return nil
+}
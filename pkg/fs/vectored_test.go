@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// plainDevice hides the optional methods of the device it wraps, leaving
+// just a BlockDevice.
+type plainDevice struct {
+	BlockDevice
+}
+
+// runCountingDevice counts the runs read and written with ReadBlocks and
+// WriteBlocks, and the blocks read and written one at a time.
+type runCountingDevice struct {
+	*ArrayBlockDevice
+	runReads, runWrites     int
+	blockReads, blockWrites int
+}
+
+func (dev *runCountingDevice) ReadBlock(blockNum uint64, buf []byte) error {
+	dev.blockReads++
+	return dev.ArrayBlockDevice.ReadBlock(blockNum, buf)
+}
+
+func (dev *runCountingDevice) WriteBlock(blockNum uint64, buf []byte) error {
+	dev.blockWrites++
+	return dev.ArrayBlockDevice.WriteBlock(blockNum, buf)
+}
+
+func (dev *runCountingDevice) ReadBlocks(start uint64, bufs [][]byte) error {
+	dev.runReads++
+	return dev.ArrayBlockDevice.ReadBlocks(start, bufs)
+}
+
+func (dev *runCountingDevice) WriteBlocks(start uint64, bufs [][]byte) error {
+	dev.runWrites++
+	return dev.ArrayBlockDevice.WriteBlocks(start, bufs)
+}
+
+func TestAdaptBlockDevice(t *testing.T) {
+	array := NewArrayBlockDevice(make([]byte, 4*BlockSize))
+	require.Same(t, array, AdaptBlockDevice(array))
+
+	dev := AdaptBlockDevice(plainDevice{array})
+	require.Zero(t, dev.Size())
+	require.NoError(t, dev.Flush())
+	want := patterned(3 * BlockSize)
+	bufs := splitBlocks(want)
+	bufs[2] = bufs[2][:2]
+	require.NoError(t, dev.WriteBlocks(1, bufs))
+	got := make([]byte, 3*BlockSize)
+	require.NoError(t, dev.ReadBlocks(1, splitBlocks(got)))
+	require.Equal(t, want[:2*BlockSize+2], got[:2*BlockSize+2])
+	require.Equal(t, make([]byte, BlockSize-2), got[2*BlockSize+2:])
+	require.Error(t, dev.ReadBlocks(3, splitBlocks(got)))
+
+	// devices with BlockCount and Sync are sized and flushed with them
+	served := &syncCountingDevice{ArrayBlockDevice: array}
+	require.Equal(t, uint64(4), deviceSize(served))
+	require.NoError(t, flushDevice(served))
+	require.Equal(t, 1, served.syncs)
+}
+
+func TestJoinedBlocks(t *testing.T) {
+	buf := make([]byte, 3*BlockSize)
+	require.Equal(t, buf, joinedBlocks(splitBlocks(buf)))
+	require.Nil(t, joinedBlocks(nil))
+	bufs := splitBlocks(buf)
+	bufs[0], bufs[1] = bufs[1], bufs[0]
+	require.Nil(t, joinedBlocks(bufs))
+	bufs = splitBlocks(buf)
+	bufs[2] = bufs[2][:1]
+	require.Nil(t, joinedBlocks(bufs))
+}
+
+func TestVectoredFile(t *testing.T) {
+	dev := &runCountingDevice{ArrayBlockDevice: NewArrayBlockDevice(make([]byte, (DataStartIndex+64)*BlockSize))}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	want := patterned(8 * BlockSize)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBuffer(want))
+	require.NoError(t, err)
+	require.NotZero(t, dev.runWrites)
+
+	// the blocks of the file lie next to each other, so they are read in
+	// a run rather than one at a time
+	*dev = runCountingDevice{ArrayBlockDevice: dev.ArrayBlockDevice}
+	got, err := filesystem.ReadFile("/foo")
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, 1, dev.runReads)
+	require.Less(t, dev.blockReads, 8)
+}
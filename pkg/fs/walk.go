@@ -0,0 +1,110 @@
+package fs
+
+import (
+	iofs "io/fs"
+	"path"
+	"sort"
+)
+
+// DirOrder selects the order in which ReadDir and Walk return directory
+// entries. Both orders are deterministic: the same filesystem contents
+// always list the same way.
+type DirOrder int
+
+const (
+	// DirOrderInsertion lists entries in the order they were added to the
+	// directory, which is the order they are stored in.
+	DirOrderInsertion DirOrder = iota
+	// DirOrderName lists entries sorted by name, byte-wise.
+	DirOrderName
+)
+
+// SetDirOrder sets the order of directory listings. The default is
+// DirOrderInsertion.
+func (fs *FileSystem) SetDirOrder(order DirOrder) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dirOrder = order
+}
+
+// sortDirEntries puts entries, as stored, in the configured order.
+func (fs *FileSystem) sortDirEntries(entries []DirEntry) {
+	if fs.dirOrder == DirOrderName {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+	}
+}
+
+// WalkFunc is called by Walk for every file and directory. If reading a
+// directory fails, it is called a second time for that directory with the
+// error; returning nil then skips the directory's contents.
+//
+// Returning iofs.SkipDir from a call for a directory skips its contents, and
+// from a call for a file skips the rest of the file's directory, as with
+// io/fs.WalkDir. Any other error stops the walk and is returned by Walk.
+type WalkFunc func(name string, entry DirEntry, err error) error
+
+// Walk visits the tree rooted at the absolute path root depth first, calling
+// fn for every file and directory, root included. Directories are listed in
+// the order set with SetDirOrder, so walks are reproducible.
+//
+// Each directory is listed under the filesystem's lock, but fn is called
+// without it, so fn may use and change the filesystem. A walk sees the
+// changes made to directories it hasn't listed yet.
+func (fs *FileSystem) Walk(root string, fn WalkFunc) error {
+	root = path.Clean(root)
+	entry, err := fs.walkRoot(root)
+	if err != nil {
+		return err
+	}
+	err = fs.walk(root, entry, fn)
+	if err == iofs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkRoot returns the entry Walk starts from.
+func (fs *FileSystem) walkRoot(root string) (DirEntry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	entry := DirEntry{Name: path.Base(root)}
+	if root != "/" {
+		inode, err := fs.findInode(root)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		entry.Inode = inode.Index
+	}
+	inode, err := fs.allocatedInode(int(entry.Inode))
+	if err != nil {
+		return DirEntry{}, err
+	}
+	entry.Type = inode.Type
+	entry.Size = inode.Size
+	return entry, nil
+}
+
+func (fs *FileSystem) walk(name string, entry DirEntry, fn WalkFunc) error {
+	err := fn(name, entry, nil)
+	if err != nil || entry.Type != InodeTypeDirectory {
+		return err
+	}
+
+	entries, err := fs.ReadDir(int(entry.Inode))
+	if err != nil {
+		return fn(name, entry, err)
+	}
+	for _, child := range entries {
+		err := fs.walk(path.Join(name, child.Name), child, fn)
+		if err == iofs.SkipDir && child.Type == InodeTypeDirectory {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirOrder(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	for _, name := range []string{"/b", "/c", "/a"} {
+		_, err := filesystem.CreateFile(name, bytes.NewBufferString(name))
+		require.NoError(t, err)
+	}
+
+	names := func() []string {
+		entries, err := filesystem.ReadDir(0)
+		require.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"b", "c", "a"}, names())
+	filesystem.SetDirOrder(DirOrderName)
+	require.Equal(t, []string{"a", "b", "c"}, names())
+}
+
+func TestWalk(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	for _, name := range []string{"/b", "/a"} {
+		_, err := filesystem.CreateFile(name, bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+	}
+	filesystem.SetDirOrder(DirOrderName)
+
+	visited := []string{}
+	err := filesystem.Walk("/", func(name string, entry DirEntry, err error) error {
+		require.NoError(t, err)
+		visited = append(visited, name)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/", "/a", "/b"}, visited)
+
+	// skipping the root skips everything
+	visited = visited[:0]
+	err = filesystem.Walk("/", func(name string, entry DirEntry, err error) error {
+		visited = append(visited, name)
+		return iofs.SkipDir
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/"}, visited)
+
+	// walking a file visits just the file
+	visited = visited[:0]
+	err = filesystem.Walk("/b", func(name string, entry DirEntry, err error) error {
+		require.Equal(t, uint32(5), entry.Size)
+		visited = append(visited, name)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/b"}, visited)
+
+	err = filesystem.Walk("/missing", func(string, DirEntry, error) error { return nil })
+	require.ErrorIs(t, err, ErrNotExist)
+}
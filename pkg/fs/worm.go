@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWORM is returned when a write-once filesystem refuses to change data
+// that was already written.
+var ErrWORM = errors.New("file is write-once")
+
+// Superblock flags.
+const (
+	// FlagWORM marks write-once filesystems, see MkfsOptions.
+	FlagWORM = 1 << 0
+	// FlagCheck marks filesystems whose free counts disagreed with their
+	// bitmaps when they were mounted, see counters.go. Fsck with repair
+	// clears it.
+	FlagCheck = 1 << 1
+)
+
+// A write-once (WORM) filesystem keeps what was written, for audit logs and
+// the like: files can be created and appended to, but not truncated or
+// overwritten until their retention period has passed, and deleting or
+// renaming them is refused the same way.
+
+// wormPolicy is the write-once mode in effect on a mounted filesystem.
+type wormPolicy struct {
+	// retention is how long files stay write-once after they are created;
+	// zero means forever
+	retention time.Duration
+}
+
+// wormFromSuperblock returns the write-once mode recorded in sb, if any.
+func wormFromSuperblock(sb *Superblock) *wormPolicy {
+	if sb.Flags&FlagWORM == 0 {
+		return nil
+	}
+	return &wormPolicy{retention: sb.Retention}
+}
+
+// WORM reports whether the filesystem is write-once, and for how long files
+// stay write-once after they are created, zero meaning forever.
+func (fs *FileSystem) WORM() (bool, time.Duration) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if fs.worm == nil {
+		return false, 0
+	}
+	return true, fs.worm.retention
+}
+
+// checkRetained fails with ErrWORM if the filesystem is write-once and the
+// inode's retention period hasn't passed yet. Inodes written before creation
+// times were recorded count as created at the Unix epoch.
+func (fs *FileSystem) checkRetained(inode *Inode) error {
+	if fs.worm == nil {
+		return nil
+	}
+	if fs.worm.retention > 0 {
+		expires := time.Unix(inode.Created, 0).Add(fs.worm.retention)
+		if !fs.now().Before(expires) {
+			return nil
+		}
+		return fmt.Errorf("%w until %s", ErrWORM, expires.UTC().Format(time.RFC3339))
+	}
+	return ErrWORM
+}
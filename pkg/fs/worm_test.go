@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWORM(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{WORM: true})
+	require.NoError(t, err)
+	worm, retention := filesystem.WORM()
+	require.True(t, worm)
+	require.Zero(t, retention)
+
+	_, err = filesystem.CreateFile("/audit.log", bytes.NewBufferString("login\n"))
+	require.NoError(t, err)
+	f, err := filesystem.OpenFile("/audit.log", O_WRONLY|O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("logout\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = filesystem.OpenFile("/audit.log", O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("nothing"))
+	require.ErrorIs(t, err, ErrWORM)
+	// reading to the end makes the next write an append
+	_, err = io.ReadAll(f)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("login\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = filesystem.OpenFile("/audit.log", O_WRONLY|O_TRUNC, 0)
+	require.ErrorIs(t, err, ErrWORM)
+
+	inode, err := filesystem.FindInodeByName("/audit.log")
+	require.NoError(t, err)
+	contents, err := filesystem.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, "login\nlogout\nlogin\n", contents.String())
+
+	// the mode is recorded in the superblock and can't be mounted away
+	require.NoError(t, filesystem.Close())
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	worm, _ = filesystem.WORM()
+	require.True(t, worm)
+}
+
+func TestWORMRetention(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{
+		WORM:      true,
+		Retention: 24*time.Hour + time.Millisecond,
+	})
+	require.NoError(t, err)
+	_, retention := filesystem.WORM()
+	require.Equal(t, 24*time.Hour, retention)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	filesystem.now = func() time.Time { return now }
+	_, err = filesystem.CreateFile("/report", bytes.NewBufferString("draft"))
+	require.NoError(t, err)
+
+	now = now.Add(23 * time.Hour)
+	_, err = filesystem.OpenFile("/report", O_WRONLY|O_TRUNC, 0)
+	require.ErrorIs(t, err, ErrWORM)
+	require.ErrorContains(t, err, "until 2024-01-02T00:00:00Z")
+
+	now = now.Add(time.Hour)
+	f, err := filesystem.OpenFile("/report", O_WRONLY|O_TRUNC, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("final"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, filesystem.Close())
+	sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Equal(t, uint32(FlagWORM), sb.Flags)
+	require.Equal(t, 24*time.Hour, sb.Retention)
+}
+
+func TestWORMMount(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+
+	filesystem, err = LoadFilesystemWithOptions(NewArrayBlockDevice(disk), MountOptions{WORM: true})
+	require.NoError(t, err)
+	_, err = filesystem.OpenFile("/foo", O_WRONLY|O_TRUNC, 0)
+	require.ErrorIs(t, err, ErrWORM)
+	require.NoError(t, filesystem.Close())
+
+	// mounting write-once doesn't change the image
+	sb, err := ReadSuperblock(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	require.Zero(t, sb.Flags)
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	f, err := filesystem.OpenFile("/foo", O_WRONLY|O_TRUNC, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
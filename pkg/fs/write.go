@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+)
+
+// Append adds data to the end of the file with the given absolute name.
+// Only the last block of the file and the blocks after it are written, and
+// blocks are allocated only as the file grows into them. If it fails, the
+// file is left as it was.
+func (fs *FileSystem) Append(filename string, data []byte) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("Append %s (%d bytes)", filename, len(data))
+	defer fs.checkInvariantsAfter("Append")()
+
+	inode, err := fs.findFile(filename)
+	if err == nil {
+		err = fs.checkAccess(inode, accessWrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error appending to %s: %w", filename, err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	err = fs.writeAt(inode, data, int64(inode.Size), make([]byte, BlockSize))
+	if err != nil {
+		return fmt.Errorf("error appending to %s: %w", filename, err)
+	}
+	return nil
+}
+
+// WriteAt writes data at the given offset of the file with the given
+// absolute name, in place. Writing past the end of the file grows it,
+// filling any gap with zeros. On write-once filesystems, overwriting data
+// fails with ErrWORM until the file's retention period has passed. If it
+// fails, the file is left as it was. Writes that stay within the file run
+// concurrently with reads and writes of other files.
+func (fs *FileSystem) WriteAt(filename string, data []byte, offset int64) (err error) {
+	return fs.WriteAtContext(context.Background(), filename, data, offset)
+}
+
+// WriteAtContext is WriteAt under ctx, see context.go. With a ctx that can
+// be done, writes within the file don't run concurrently with other
+// operations.
+func (fs *FileSystem) WriteAtContext(ctx context.Context, filename string, data []byte, offset int64) (err error) {
+	if offset < 0 {
+		return fmt.Errorf("error writing %s: negative offset %d", filename, offset)
+	}
+	if ctx.Done() == nil {
+		done, err := fs.overwriteFile(filename, data, offset)
+		if done {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("WriteAt %s (%d bytes at offset %d)", filename, len(data), offset)
+	defer fs.checkInvariantsAfter("WriteAt")()
+	defer fs.withContext(ctx)()
+	return fs.writeFileAt(filename, data, offset)
+}
+
+// writeFileAt is WriteAt for callers holding fs.mu for writing.
+func (fs *FileSystem) writeFileAt(filename string, data []byte, offset int64) error {
+	inode, err := fs.findFile(filename)
+	if err == nil {
+		err = fs.checkAccess(inode, accessWrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	if offset < int64(inode.Size) {
+		err = fs.checkRetained(inode)
+		if err != nil {
+			return fmt.Errorf("error writing %s at offset %d: %w", filename, offset, err)
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	err = fs.writeAt(inode, data, offset, make([]byte, BlockSize))
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	return nil
+}
+
+// overwriteFile is WriteAt for writes within the file, like File.overwrite.
+func (fs *FileSystem) overwriteFile(filename string, data []byte, offset int64) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findFile(filename)
+	if err != nil || !fs.canOverwrite(inode, offset, len(data)) {
+		return false, nil
+	}
+	fs.explainOp("WriteAt %s (%d bytes at offset %d)", filename, len(data), offset)
+	lock := fs.inodeLock(int(inode.Index))
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = fs.checkAccess(inode, accessWrite)
+	if err != nil {
+		return true, fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	err = fs.checkRetained(inode)
+	if err != nil {
+		return true, fmt.Errorf("error writing %s at offset %d: %w", filename, offset, err)
+	}
+	err = fs.overwrite(inode, data, offset, make([]byte, BlockSize))
+	if err != nil {
+		return true, fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	fs.noteModified(int(inode.Index))
+	return true, nil
+}
+
+// findFile looks up a regular file by its absolute name.
+func (fs *FileSystem) findFile(filename string) (*Inode, error) {
+	inode, err := fs.findInode(filename)
+	if err != nil {
+		return nil, err
+	}
+	if inode.Type != InodeTypeFile {
+		return nil, ErrIsDirectory
+	}
+	return inode, nil
+}
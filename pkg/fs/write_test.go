@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAndWriteAt(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	dev := &failingDevice{BlockDevice: NewArrayBlockDevice(disk)}
+	filesystem, err := NewFileSystem(dev)
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/log", bytes.NewBufferString("one\n"))
+	require.NoError(t, err)
+	freeBlocks := filesystem.freeBlocks.free
+
+	// appending within the last block allocates nothing and writes only
+	// that block and the inode
+	writes := dev.writes
+	require.NoError(t, filesystem.Append("/log", []byte("two\n")))
+	require.Equal(t, 2, dev.writes-writes)
+	require.Equal(t, freeBlocks, filesystem.freeBlocks.free)
+
+	// growing into new blocks allocates them
+	big := bytes.Repeat([]byte("x"), BlockSize)
+	require.NoError(t, filesystem.Append("/log", big))
+	require.Equal(t, freeBlocks-1, filesystem.freeBlocks.free)
+	want := append([]byte("one\ntwo\n"), big...)
+
+	require.NoError(t, filesystem.WriteAt("/log", []byte("ONE"), 0))
+	copy(want, "ONE")
+	// past the end, leaving a gap of zeros
+	require.NoError(t, filesystem.WriteAt("/log", []byte("end"), int64(len(want))+2))
+	want = append(want, 0, 0, 'e', 'n', 'd')
+
+	require.NoError(t, filesystem.Close())
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	inode, err := reloaded.FindInodeByName("/log")
+	require.NoError(t, err)
+	contents, err := reloaded.ReadFileContents(int(inode.Index))
+	require.NoError(t, err)
+	require.Equal(t, want, contents.Bytes())
+}
+
+func TestAppendAndWriteAtErrors(t *testing.T) {
+	filesystem := newTestFileSystem(t)
+	_, err := filesystem.CreateFile("/foo", bytes.NewBufferString("foo"))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.Append("/missing", []byte("x")), ErrNotExist)
+	require.ErrorContains(t, filesystem.WriteAt("/foo", []byte("x"), -1), "negative offset")
+	require.ErrorIs(t, filesystem.WriteAt("/foo", []byte("x"), MaxFileSize), ErrTooLarge)
+
+	inode, err := filesystem.FindInodeByName("/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), inode.Size)
+}
+
+func TestWriteAtWORM(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{WORM: true})
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/audit", bytes.NewBufferString("entry\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, filesystem.Append("/audit", []byte("more\n")))
+	require.ErrorIs(t, filesystem.WriteAt("/audit", []byte("x"), 0), ErrWORM)
+	// writing at the end is appending
+	require.NoError(t, filesystem.WriteAt("/audit", []byte("last\n"), 11))
+}
@@ -0,0 +1,295 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Files and directories can carry extended attributes: small named values
+// applications tag them with, such as a MIME type or where a file came from,
+// see SetXattr. Each attribute is encoded as the length of its name, a byte,
+// the name, the length of its value, a little endian uint16, and the value.
+//
+// The attributes of an inode are kept in its slot of the inode table, after
+// the gob encoding like contentSum, if they fit in the space the slot has to
+// spare, short of a reserve; otherwise they move to a block of their own,
+// the xattr block, which the inode records instead. The xattr block is
+// metadata, journaled and checksummed like pointer blocks, and the encoded
+// attributes are followed by zeros, the length of a name being at least
+// one. Changes write a new xattr block rather than overwrite the old one, so
+// a failed change leaves the old attributes intact. Only filesystems of
+// xattrVersion or later have extended attributes.
+
+// xattrVersion is the first format version with extended attributes.
+const xattrVersion = 10
+
+const (
+	// MaxXattrNameLength is the length limit of the name of an extended
+	// attribute, in bytes.
+	MaxXattrNameLength = 255
+	// MaxXattrSize is the limit on the encoded size of the extended
+	// attributes of an inode: a block.
+	MaxXattrSize = BlockSize
+
+	// xattrInodeReserve is the space left free in an inode slot holding
+	// extended attributes, for the records and fields that may grow later.
+	// Only a longer name can take more; Rename moves the attributes to an
+	// xattr block then.
+	xattrInodeReserve = 64
+)
+
+// ErrNoXattr is returned when reading or removing an extended attribute an
+// inode doesn't have.
+var ErrNoXattr = errors.New("no such extended attribute")
+
+// SetXattr sets the extended attribute name of the file or directory with
+// the given absolute path to value, replacing any value it had. Names can't
+// be empty or longer than MaxXattrNameLength, and the attributes of an
+// inode, encoded, can't take more than MaxXattrSize bytes. Filesystems older
+// than format version 10 have no extended attributes.
+func (fs *FileSystem) SetXattr(path, name string, value []byte) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("SetXattr %s %s (%d bytes)", path, name, len(value))
+	defer fs.checkInvariantsAfter("SetXattr")()
+
+	if len(name) == 0 || len(name) > MaxXattrNameLength {
+		return fmt.Errorf("error setting attribute %q of %s: names take 1 to %d bytes", name, path, MaxXattrNameLength)
+	}
+	return fs.changeXattrs(path, func(xattrs map[string][]byte) error {
+		xattrs[name] = bytes.Clone(value)
+		return nil
+	})
+}
+
+// GetXattr returns the value of the extended attribute name of the file or
+// directory with the given absolute path. It fails with ErrNoXattr if there
+// is no such attribute.
+func (fs *FileSystem) GetXattr(path, name string) ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading attribute %q of %s: %w", name, path, err)
+	}
+	xattrs, err := fs.readXattrs(inode)
+	if err != nil {
+		return nil, fmt.Errorf("error reading attribute %q of %s: %w", name, path, err)
+	}
+	value, ok := xattrs[name]
+	if !ok {
+		return nil, fmt.Errorf("error reading attribute %q of %s: %w", name, path, ErrNoXattr)
+	}
+	return bytes.Clone(value), nil
+}
+
+// ListXattr returns the names of the extended attributes of the file or
+// directory with the given absolute path, sorted.
+func (fs *FileSystem) ListXattr(path string) ([]string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	inode, err := fs.findInodeOrRoot(path)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the attributes of %s: %w", path, err)
+	}
+	xattrs, err := fs.readXattrs(inode)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the attributes of %s: %w", path, err)
+	}
+	return xattrNames(xattrs), nil
+}
+
+// RemoveXattr removes the extended attribute name of the file or directory
+// with the given absolute path. It fails with ErrNoXattr if there is no such
+// attribute.
+func (fs *FileSystem) RemoveXattr(path, name string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.commit(&err)
+	fs.explainOp("RemoveXattr %s %s", path, name)
+	defer fs.checkInvariantsAfter("RemoveXattr")()
+
+	return fs.changeXattrs(path, func(xattrs map[string][]byte) error {
+		if _, ok := xattrs[name]; !ok {
+			return fmt.Errorf("error removing attribute %q of %s: %w", name, path, ErrNoXattr)
+		}
+		delete(xattrs, name)
+		return nil
+	})
+}
+
+// changeXattrs calls change with a copy of the extended attributes of the
+// inode at path, and stores the changed copy in its place, in the inode if
+// they fit and in a new xattr block otherwise.
+func (fs *FileSystem) changeXattrs(path string, change func(map[string][]byte) error) (err error) {
+	if fs.version < xattrVersion {
+		return fmt.Errorf("error changing the attributes of %s: format version %d has no extended attributes, they need version %d", path, fs.version, xattrVersion)
+	}
+	inode, err := fs.findInodeOrRoot(path)
+	if err == nil {
+		err = fs.checkAccess(inode, accessWrite)
+	}
+	if err != nil {
+		return fmt.Errorf("error changing the attributes of %s: %w", path, err)
+	}
+	old, err := fs.readXattrs(inode)
+	if err != nil {
+		return fmt.Errorf("error changing the attributes of %s: %w", path, err)
+	}
+	// the inode keeps the old map until the change is stored, so a
+	// snapshot of it restores the old attributes
+	xattrs := make(map[string][]byte, len(old)+1)
+	for name, value := range old {
+		xattrs[name] = value
+	}
+	err = change(xattrs)
+	if err != nil {
+		return err
+	}
+	encoded := encodeXattrs(xattrs)
+	if len(encoded) > MaxXattrSize {
+		return fmt.Errorf("error changing the attributes of %s: they take %d bytes, more than %d: %w", path, len(encoded), MaxXattrSize, ErrTooLarge)
+	}
+
+	snapshot := fs.snapshot(int(inode.Index))
+	defer func() {
+		if err != nil {
+			err = fs.rollback(snapshot, err)
+		}
+		fs.release(snapshot)
+	}()
+
+	err = fs.markDirty()
+	if err != nil {
+		return err
+	}
+	err = fs.storeXattrs(inode, xattrs)
+	if err != nil {
+		return fmt.Errorf("error writing the attributes of %s: %w", path, err)
+	}
+	inode.Changed = fs.now().Unix()
+
+	err = fs.writeInodeTable()
+	if err != nil {
+		return fmt.Errorf("error writing inode table: %w", err)
+	}
+	err = fs.persistDataBitmap()
+	if err != nil {
+		return fmt.Errorf("error writing data bitmap: %w", err)
+	}
+	return nil
+}
+
+// storeXattrs makes xattrs the extended attributes of inode, in its slot if
+// they fit and in a new xattr block otherwise, freeing the old one. The
+// caller writes the inode table and the data bitmap.
+func (fs *FileSystem) storeXattrs(inode *Inode, xattrs map[string][]byte) error {
+	encoded := encodeXattrs(xattrs)
+	oldBlock := inode.xattrBlock
+	inode.xattrs, inode.xattrBlock = nil, 0
+	switch {
+	case len(xattrs) == 0:
+	case fs.xattrsFitInline(inode, encoded):
+		inode.xattrs = xattrs
+	default:
+		blocks, err := fs.findContiguousBlocks(1, nil)
+		if err != nil {
+			return err
+		}
+		fs.setBlockAllocated(blocks[0], true)
+		err = fs.writeMetadata(uint64(blocks[0]), encoded)
+		if err != nil {
+			return err
+		}
+		inode.xattrBlock = blocks[0]
+	}
+	if oldBlock != 0 {
+		fs.setBlockAllocated(oldBlock, false)
+	}
+	return nil
+}
+
+// xattrsFitInline reports whether the encoded extended attributes fit in
+// the slot of inode, leaving room for it to grow later.
+func (fs *FileSystem) xattrsFitInline(inode *Inode, encoded []byte) bool {
+	bare := *inode
+	bare.xattrs, bare.xattrBlock = nil, 0
+	slot, err := encodeInode(&bare)
+	if err != nil {
+		return false
+	}
+	// the record takes a tag and the length of the attributes
+	return len(slot)+3+len(encoded)+xattrInodeReserve <= InodeSize
+}
+
+// readXattrs returns the extended attributes of inode, reading them from its
+// xattr block if it has one. The map is shared; don't change it.
+func (fs *FileSystem) readXattrs(inode *Inode) (map[string][]byte, error) {
+	if inode.xattrBlock == 0 {
+		return inode.xattrs, nil
+	}
+	if !fs.isDataBlock(inode.xattrBlock) {
+		return nil, corruptf("inode %d: xattr block %d is outside the data region", inode.Index, inode.xattrBlock)
+	}
+	buf := make([]byte, BlockSize)
+	err := fs.readMetadata(uint64(inode.xattrBlock), buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading xattr block %d of inode %d: %w", inode.xattrBlock, inode.Index, err)
+	}
+	xattrs, err := decodeXattrs(buf)
+	if err != nil {
+		return nil, corruptf("inode %d: xattr block %d: %v", inode.Index, inode.xattrBlock, err)
+	}
+	return xattrs, nil
+}
+
+// xattrNames returns the names of xattrs, sorted.
+func xattrNames(xattrs map[string][]byte) []string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encodeXattrs encodes extended attributes, sorted by name.
+func encodeXattrs(xattrs map[string][]byte) []byte {
+	bb := &bytes.Buffer{}
+	for _, name := range xattrNames(xattrs) {
+		value := xattrs[name]
+		bb.WriteByte(byte(len(name)))
+		bb.WriteString(name)
+		binary.Write(bb, binary.LittleEndian, uint16(len(value)))
+		bb.Write(value)
+	}
+	return bb.Bytes()
+}
+
+// decodeXattrs decodes extended attributes encoded by encodeXattrs, up to
+// the end of data or the first zero name length.
+func decodeXattrs(data []byte) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	for len(data) > 0 && data[0] != 0 {
+		n := int(data[0])
+		if len(data) < 1+n+2 {
+			return nil, errors.New("truncated extended attribute")
+		}
+		name := string(data[1 : 1+n])
+		size := int(binary.LittleEndian.Uint16(data[1+n:]))
+		data = data[1+n+2:]
+		if len(data) < size {
+			return nil, fmt.Errorf("extended attribute %q is truncated", name)
+		}
+		if _, ok := xattrs[name]; ok {
+			return nil, fmt.Errorf("extended attribute %q appears twice", name)
+		}
+		xattrs[name] = bytes.Clone(data[:size])
+		data = data[size:]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXattr(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+
+	require.NoError(t, filesystem.SetXattr("/file", "user.mime_type", []byte("text/plain")))
+	require.NoError(t, filesystem.SetXattr("/file", "user.origin", []byte("https://example.com")))
+	require.NoError(t, filesystem.SetXattr("/dir", "user.empty", nil))
+	require.NoError(t, filesystem.SetXattr("/file", "user.mime_type", []byte("text/markdown")))
+
+	value, err := filesystem.GetXattr("/file", "user.mime_type")
+	require.NoError(t, err)
+	require.Equal(t, "text/markdown", string(value))
+	names, err := filesystem.ListXattr("/file")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.mime_type", "user.origin"}, names)
+	value, err = filesystem.GetXattr("/dir", "user.empty")
+	require.NoError(t, err)
+	require.Empty(t, value)
+	_, err = filesystem.GetXattr("/file", "user.missing")
+	require.ErrorIs(t, err, ErrNoXattr)
+	names, err = filesystem.ListXattr("/")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	require.NoError(t, filesystem.RemoveXattr("/file", "user.origin"))
+	require.ErrorIs(t, filesystem.RemoveXattr("/file", "user.origin"), ErrNoXattr)
+	require.NoError(t, filesystem.Close())
+
+	reloaded, err := LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	names, err = reloaded.ListXattr("/file")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.mime_type"}, names)
+	value, err = reloaded.GetXattr("/file", "user.mime_type")
+	require.NoError(t, err)
+	require.Equal(t, "text/markdown", string(value))
+}
+
+func TestXattrBlock(t *testing.T) {
+	disk := make([]byte, 400*BlockSize)
+	filesystem, err := NewFileSystemWithOptions(NewArrayBlockDevice(disk), MkfsOptions{Blocks: 400, JournalBlocks: 32, Checksums: true})
+	require.NoError(t, err)
+	inode, err := filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	// keeps the root directory from giving up its block
+	_, err = filesystem.CreateFile("/other", bytes.NewBufferString("other"))
+	require.NoError(t, err)
+	before, err := filesystem.Statfs()
+	require.NoError(t, err)
+
+	// too big for the inode
+	big := bytes.Repeat([]byte("x"), 1000)
+	require.NoError(t, filesystem.SetXattr("/file", "user.big", big))
+	require.NotZero(t, inode.xattrBlock)
+	layout, err := filesystem.Layout()
+	require.NoError(t, err)
+	require.Equal(t, BlockKindXattrs, layout[inode.xattrBlock].Kind)
+	require.Equal(t, int(inode.Index), layout[inode.xattrBlock].Inode)
+	after, err := filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before.FreeBlocks-1, after.FreeBlocks)
+
+	// changes move the attributes to a new block
+	block := inode.xattrBlock
+	require.NoError(t, filesystem.SetXattr("/file", "user.small", []byte("small")))
+	require.NotEqual(t, block, inode.xattrBlock)
+	require.NoError(t, filesystem.Close())
+
+	filesystem, err = LoadFilesystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	value, err := filesystem.GetXattr("/file", "user.big")
+	require.NoError(t, err)
+	require.Equal(t, big, value)
+	report, err := Fsck(NewArrayBlockDevice(bytes.Clone(disk)), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Remaining)
+
+	// back in the inode once they fit
+	require.NoError(t, filesystem.RemoveXattr("/file", "user.big"))
+	inode, err = filesystem.FindInodeByName("/file")
+	require.NoError(t, err)
+	require.Zero(t, inode.xattrBlock)
+	value, err = filesystem.GetXattr("/file", "user.small")
+	require.NoError(t, err)
+	require.Equal(t, "small", string(value))
+	after, err = filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before.FreeBlocks, after.FreeBlocks)
+
+	// deleting the file frees its xattr block
+	require.NoError(t, filesystem.SetXattr("/file", "user.big", big))
+	require.NoError(t, filesystem.DeleteFile("/file"))
+	after, err = filesystem.Statfs()
+	require.NoError(t, err)
+	require.Equal(t, before.FreeBlocks+1, after.FreeBlocks)
+}
+
+func TestXattrErrors(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.SetXattr("/file", "user.kept", []byte("kept")))
+
+	require.Error(t, filesystem.SetXattr("/file", "", []byte("x")))
+	require.Error(t, filesystem.SetXattr("/file", strings.Repeat("n", MaxXattrNameLength+1), []byte("x")))
+	require.ErrorIs(t, filesystem.SetXattr("/file", "user.huge", make([]byte, MaxXattrSize)), ErrTooLarge)
+	require.ErrorIs(t, filesystem.SetXattr("/missing", "user.x", nil), ErrNotExist)
+	_, err = filesystem.GetXattr("/missing", "user.x")
+	require.ErrorIs(t, err, ErrNotExist)
+	names, err := filesystem.ListXattr("/file")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.kept"}, names)
+
+	filesystem.version = xattrVersion - 1
+	require.ErrorContains(t, filesystem.SetXattr("/file", "user.x", nil), "no extended attributes")
+}
+
+func TestXattrNoSpace(t *testing.T) {
+	disk := make([]byte, (DataStartIndex+32)*BlockSize)
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.SetXattr("/file", "user.kept", []byte("kept")))
+	stats, err := filesystem.Statfs()
+	require.NoError(t, err)
+	_, err = filesystem.CreateFile("/fill", bytes.NewBuffer(make([]byte, int(stats.FreeBlocks)*BlockSize)))
+	require.NoError(t, err)
+
+	require.ErrorIs(t, filesystem.SetXattr("/file", "user.big", make([]byte, 1000)), ErrNoSpace)
+	value, err := filesystem.GetXattr("/file", "user.kept")
+	require.NoError(t, err)
+	require.Equal(t, "kept", string(value))
+	_, err = filesystem.GetXattr("/file", "user.big")
+	require.ErrorIs(t, err, ErrNoXattr)
+}
+
+func TestXattrRename(t *testing.T) {
+	filesystem, err := NewFileSystem(NewArrayBlockDevice(make([]byte, 400*BlockSize)))
+	require.NoError(t, err)
+	inode, err := filesystem.CreateFile("/file", bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	value := bytes.Repeat([]byte("v"), 40)
+	require.NoError(t, filesystem.SetXattr("/file", "user.tag", value))
+	require.Zero(t, inode.xattrBlock)
+
+	// the longest name leaves no room in the inode
+	long := "/" + strings.Repeat("n", MaxNameLength)
+	require.NoError(t, filesystem.Rename("/file", long))
+	require.NotZero(t, inode.xattrBlock)
+	read, err := filesystem.GetXattr(long, "user.tag")
+	require.NoError(t, err)
+	require.Equal(t, value, read)
+}
@@ -0,0 +1,204 @@
+package fsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// Client uses a filesystem served by a Server. Its methods mirror those of
+// FileSystem; errors the server answers are *Error, wrapping the sentinel
+// errors of package fs, so errors.Is(err, fs.ErrNotExist) works as it does
+// locally. It is safe for concurrent use.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// NewClient returns a Client for the server at baseURL, such as
+// "http://localhost:8081". If httpClient is nil, http.DefaultClient is
+// used.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{base: strings.TrimSuffix(baseURL, "/"), http: httpClient}
+}
+
+// CreateFile creates a file with the given absolute name holding what r
+// holds. It fails with an error wrapping fs.ErrExist if the file exists.
+func (c *Client) CreateFile(name string, r io.Reader) error {
+	return c.do(http.MethodPut, "files", name, nil, r, nil)
+}
+
+// ReadFile returns the contents of a file.
+func (c *Client) ReadFile(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := c.do(http.MethodGet, "files", name, nil, nil, &buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadAt reads len(p) bytes of a file starting at offset off, as
+// io.ReaderAt does: if fewer bytes are read, it is because the file ends,
+// and the error is io.EOF.
+func (c *Client) ReadAt(name string, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		length := len(p) - n
+		if length > maxRead {
+			length = maxRead
+		}
+		query := url.Values{
+			"offset": {strconv.FormatInt(off+int64(n), 10)},
+			"length": {strconv.Itoa(length)},
+		}
+		w := &sliceWriter{p: p[n : n+length]}
+		err := c.do(http.MethodGet, "files", name, query, nil, w)
+		n += w.n
+		if err != nil {
+			return n, err
+		}
+		if w.n < length {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes data to a file at offset, growing the file if needed.
+// Data over the most a request may hold is written a request at a time, so
+// other clients may see part of it written.
+func (c *Client) WriteAt(name string, data []byte, offset int64) error {
+	return c.patch(name, data, func(n int) url.Values {
+		return url.Values{"offset": {strconv.FormatInt(offset+int64(n), 10)}}
+	})
+}
+
+// Append adds data to the end of a file, a request at a time as WriteAt
+// does.
+func (c *Client) Append(name string, data []byte) error {
+	return c.patch(name, data, func(int) url.Values {
+		return url.Values{"append": {"1"}}
+	})
+}
+
+// patch sends data to a file in PATCH requests of at most maxWrite bytes,
+// each with the parameters query returns for the number of bytes sent
+// before it.
+func (c *Client) patch(name string, data []byte, query func(n int) url.Values) error {
+	n := 0
+	for {
+		length := len(data) - n
+		if length > maxWrite {
+			length = maxWrite
+		}
+		err := c.do(http.MethodPatch, "files", name, query(n), bytes.NewReader(data[n:n+length]), nil)
+		if err != nil {
+			return err
+		}
+		n += length
+		if n == len(data) {
+			return nil
+		}
+	}
+}
+
+// DeleteFile removes a file.
+func (c *Client) DeleteFile(name string) error {
+	return c.do(http.MethodDelete, "files", name, nil, nil, nil)
+}
+
+// Mkdir creates a directory.
+func (c *Client) Mkdir(name string) error {
+	return c.do(http.MethodPut, "dirs", name, nil, nil, nil)
+}
+
+// ReadDirByPath lists a directory. The inode indices of the entries are
+// those of the served filesystem.
+func (c *Client) ReadDirByPath(name string) ([]fs.DirEntry, error) {
+	var buf bytes.Buffer
+	err := c.do(http.MethodGet, "dirs", name, nil, nil, &buf)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fs.DirEntry
+	err = json.Unmarshal(buf.Bytes(), &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the entries of %s: %w", name, err)
+	}
+	return entries, nil
+}
+
+// Stat describes a file or directory.
+func (c *Client) Stat(name string) (Stat, error) {
+	var buf bytes.Buffer
+	err := c.do(http.MethodGet, "stat", name, nil, nil, &buf)
+	if err != nil {
+		return Stat{}, err
+	}
+	var stat Stat
+	err = json.Unmarshal(buf.Bytes(), &stat)
+	if err != nil {
+		return Stat{}, fmt.Errorf("error decoding the description of %s: %w", name, err)
+	}
+	return stat, nil
+}
+
+// do sends a request for the absolute path name under /v1/<kind>, copying
+// the body of a successful response to out, if not nil.
+func (c *Client) do(method, kind, name string, query url.Values, body io.Reader, out io.Writer) error {
+	if !strings.HasPrefix(name, "/") {
+		return fmt.Errorf("%s: filename must be absolute", name)
+	}
+	u := c.base + (&url.URL{Path: "/v1/" + kind + name}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e := &Error{}
+		err = json.NewDecoder(resp.Body).Decode(e)
+		if err != nil {
+			e.Code, e.Message = "internal", resp.Status
+		}
+		e.StatusCode = resp.StatusCode
+		return e
+	}
+	if out != nil {
+		_, err = io.Copy(out, resp.Body)
+	}
+	return err
+}
+
+// sliceWriter writes to a slice, failing once it is full.
+type sliceWriter struct {
+	p []byte
+	n int
+}
+
+func (w *sliceWriter) Write(data []byte) (int, error) {
+	n := copy(w.p[w.n:], data)
+	w.n += n
+	if n < len(data) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
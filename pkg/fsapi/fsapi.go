@@ -0,0 +1,103 @@
+// Package fsapi lets several processes, or machines, use one filesystem
+// image through a single daemon owning it: Server exposes the operations of
+// a FileSystem as a REST API over HTTP, and Client calls them.
+//
+// The API is rooted at /v1, the rest of the URL path being the absolute
+// path of a file or directory, each segment escaped:
+//
+//	GET    /v1/files/<path>                   read the file; with offset and
+//	                                          length, only those bytes
+//	PUT    /v1/files/<path>                   create the file with the body
+//	PATCH  /v1/files/<path>?offset=n          write the body at offset n
+//	PATCH  /v1/files/<path>?append=1          append the body
+//	DELETE /v1/files/<path>                   delete the file
+//	GET    /v1/dirs/<path>                    list the directory, as JSON
+//	PUT    /v1/dirs/<path>                    create the directory
+//	GET    /v1/stat/<path>                    describe a file or directory
+//
+// Ranged reads answer with at most 64 MiB, and PATCH bodies over 64 MiB
+// are refused with 413; Client splits bigger reads and writes.
+//
+// Errors are answered with a status matching them and an Error as JSON,
+// whose Code lets Client return errors wrapping the sentinel errors of
+// package fs, such as fs.ErrNotExist.
+package fsapi
+
+import (
+	"errors"
+	iofs "io/fs"
+	"net/http"
+	"time"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// Stat describes a file or directory, as returned by GET /v1/stat.
+type Stat struct {
+	Name    string        `json:"name"`
+	Size    int64         `json:"size"`
+	Mode    iofs.FileMode `json:"mode"`
+	ModTime time.Time     `json:"modTime"`
+	IsDir   bool          `json:"isDir"`
+	Links   int           `json:"links"`
+}
+
+// Error is an error answered by the server.
+type Error struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int `json:"-"`
+	// Code names the error, such as "not_exist", or is "internal" for
+	// errors without one.
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the sentinel error of package fs that Code names, if any.
+func (e *Error) Unwrap() error {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// errorCodes are the errors with codes, and the status they are answered
+// with.
+var errorCodes = []struct {
+	code   string
+	status int
+	err    error
+}{
+	{"not_exist", http.StatusNotFound, fs.ErrNotExist},
+	{"exist", http.StatusConflict, fs.ErrExist},
+	{"is_directory", http.StatusConflict, fs.ErrIsDirectory},
+	{"not_directory", http.StatusConflict, fs.ErrNotDirectory},
+	{"permission", http.StatusForbidden, fs.ErrPermission},
+	{"worm", http.StatusForbidden, fs.ErrWORM},
+	{"no_space", http.StatusInsufficientStorage, fs.ErrNoSpace},
+	{"quota_exceeded", http.StatusInsufficientStorage, fs.ErrQuotaExceeded},
+	{"too_large", http.StatusRequestEntityTooLarge, fs.ErrTooLarge},
+	{"stale", http.StatusConflict, fs.ErrStale},
+	{"invalid_name", http.StatusBadRequest, fs.ErrInvalidName},
+}
+
+// errInvalid marks requests the server can't make sense of.
+var errInvalid = errors.New("invalid request")
+
+// toError converts an error of the filesystem to the Error answered for it.
+func toError(err error) *Error {
+	if errors.Is(err, errInvalid) {
+		return &Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: err.Error()}
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return &Error{StatusCode: c.status, Code: c.code, Message: err.Error()}
+		}
+	}
+	return &Error{StatusCode: http.StatusInternalServerError, Code: "internal", Message: err.Error()}
+}
@@ -0,0 +1,163 @@
+package fsapi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"github.com/stretchr/testify/require"
+)
+
+// newClient serves a new filesystem and returns a client for it.
+func newClient(t *testing.T) (*Client, *fs.FileSystem) {
+	disk := make([]byte, 300*fs.BlockSize)
+	filesystem, err := fs.NewFileSystemWithOptions(fs.NewArrayBlockDevice(disk), fs.MkfsOptions{Blocks: 300})
+	require.NoError(t, err)
+	server := httptest.NewServer(NewServer(filesystem))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL, server.Client()), filesystem
+}
+
+func TestClient(t *testing.T) {
+	c, filesystem := newClient(t)
+
+	require.NoError(t, c.Mkdir("/dir"))
+	require.NoError(t, c.CreateFile("/dir/a file", bytes.NewBufferString("hello, world")))
+	data, err := filesystem.ReadFile("/dir/a file")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello, world"), data)
+
+	require.NoError(t, c.WriteAt("/dir/a file", []byte("W"), 7))
+	require.NoError(t, c.Append("/dir/a file", []byte("!")))
+	data, err = c.ReadFile("/dir/a file")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello, World!"), data)
+	p := make([]byte, 5)
+	n, err := c.ReadAt("/dir/a file", p, 7)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, []byte("World"), p)
+	n, err = c.ReadAt("/dir/a file", p, 10)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, []byte("ld!"), p[:n])
+
+	entries, err := c.ReadDirByPath("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "dir", entries[0].Name)
+	require.Equal(t, fs.InodeTypeDirectory, entries[0].Type)
+	stat, err := c.Stat("/dir/a file")
+	require.NoError(t, err)
+	require.Equal(t, "a file", stat.Name)
+	require.Equal(t, int64(13), stat.Size)
+	require.False(t, stat.IsDir)
+	stat, err = c.Stat("/")
+	require.NoError(t, err)
+	require.True(t, stat.IsDir)
+
+	require.NoError(t, c.DeleteFile("/dir/a file"))
+	_, err = c.ReadFile("/dir/a file")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	var e *Error
+	require.ErrorAs(t, err, &e)
+	require.Equal(t, http.StatusNotFound, e.StatusCode)
+	require.ErrorIs(t, c.Mkdir("/dir"), fs.ErrExist)
+	require.ErrorIs(t, c.DeleteFile("/dir"), fs.ErrIsDirectory)
+	_, err = c.ReadDirByPath("/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestServerRequests(t *testing.T) {
+	c, _ := newClient(t)
+	require.NoError(t, c.CreateFile("/file", bytes.NewBufferString("data")))
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodPost, "/v1/files/file", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v1/files/file?offset=-1", http.StatusBadRequest},
+		{http.MethodGet, "/v1/files/file?length=1000000000", http.StatusBadRequest},
+		{http.MethodGet, "/v1/other/file", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(tt.method, c.base+tt.target, nil)
+		require.NoError(t, err)
+		resp, err := c.http.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, tt.status, resp.StatusCode, "%s %s", tt.method, tt.target)
+	}
+
+	// writes over maxWrite are refused rather than read into memory
+	body := io.LimitReader(zeroReader{}, maxWrite+1)
+	req, err := http.NewRequest(http.MethodPatch, c.base+"/v1/files/file?append=1", body)
+	require.NoError(t, err)
+	resp, err := c.http.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestServerReadOffset(t *testing.T) {
+	c, _ := newClient(t)
+	require.NoError(t, c.CreateFile("/file", bytes.NewBufferString("data")))
+
+	for _, tt := range []struct {
+		target string
+		body   string
+	}{
+		{"/v1/files/file?offset=1", "ata"},
+		{"/v1/files/file?offset=4", ""},
+		{"/v1/files/file?offset=9", ""},
+		{"/v1/files/file?offset=1&length=2", "at"},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		resp, err := c.http.Get(c.base + tt.target)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		runtime.ReadMemStats(&after)
+		require.Equal(t, http.StatusOK, resp.StatusCode, tt.target)
+		require.Equal(t, tt.body, string(body), tt.target)
+		// the buffer fits the file rather than being maxRead
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(maxRead/2), tt.target)
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestClientsShareTheFilesystem(t *testing.T) {
+	c, filesystem := newClient(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "/file" + string(rune('a'+i))
+			require.NoError(t, c.CreateFile(name, bytes.NewBufferString(name)))
+			data, err := c.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, name, string(data))
+		}(i)
+	}
+	wg.Wait()
+	entries, err := filesystem.ReadDirByPath("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 8)
+	require.NoError(t, filesystem.CheckInvariants())
+}
@@ -0,0 +1,16 @@
+module brenoafb.com/very-simple-filesystem/pkg/fsapi
+
+go 1.20
+
+replace brenoafb.com/very-simple-filesystem/pkg/fs => ../fs
+
+require (
+	brenoafb.com/very-simple-filesystem/pkg/fs v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.8.2
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,245 @@
+package fsapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// maxRead is the most bytes a ranged read answers with.
+const maxRead = 64 << 20
+
+// maxWrite is the most bytes the body of a write may hold.
+const maxWrite = 64 << 20
+
+// Server is an http.Handler serving the API of the package for a
+// filesystem. FileSystem is safe for concurrent use, so requests are
+// answered concurrently, each operation being atomic as it is on the
+// filesystem.
+type Server struct {
+	filesystem *fs.FileSystem
+	mux        *http.ServeMux
+}
+
+// NewServer returns a Server for filesystem. The filesystem stays the
+// caller's to close once the server is done.
+func NewServer(filesystem *fs.FileSystem) *Server {
+	s := &Server{filesystem: filesystem, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/v1/files/", s.handle(s.files))
+	s.mux.HandleFunc("/v1/dirs/", s.handle(s.dirs))
+	s.mux.HandleFunc("/v1/stat/", s.handle(s.stat))
+	return s
+}
+
+// ServeHTTP answers a request of the API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handler answers a request for the file or directory at the absolute
+// path name, or returns an error for ServeHTTP to answer.
+type handler func(w http.ResponseWriter, r *http.Request, name string) error
+
+// handle adapts h to http.HandlerFunc, taking the path from the URL and
+// answering the errors h returns.
+func (s *Server) handle(h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the route is /v1/<kind>/, and the rest is the path
+		rest := strings.TrimPrefix(r.URL.Path, "/v1/")
+		name := "/" + rest[strings.IndexByte(rest, '/')+1:]
+		if name != "/" {
+			name = strings.TrimSuffix(name, "/")
+		}
+		err := h(w, r, name)
+		if err != nil {
+			writeError(w, toError(err))
+		}
+	}
+}
+
+// files answers the requests for files.
+func (s *Server) files(w http.ResponseWriter, r *http.Request, name string) error {
+	switch r.Method {
+	case http.MethodGet:
+		return s.read(w, r, name)
+	case http.MethodPut:
+		_, err := s.filesystem.CreateFileWithOptions(name, r.Body, fs.CreateOptions{SizeHint: r.ContentLength})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case http.MethodPatch:
+		return s.write(w, r, name)
+	case http.MethodDelete:
+		err := s.filesystem.DeleteFile(name)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+}
+
+// read answers GET for a file, with the whole file, or with the bytes the
+// offset and length parameters select.
+func (s *Server) read(w http.ResponseWriter, r *http.Request, name string) error {
+	query := r.URL.Query()
+	if !query.Has("offset") && !query.Has("length") {
+		data, err := s.filesystem.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return writeBytes(w, data)
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil {
+		return err
+	}
+	length, err := intParam(query.Get("length"), maxRead)
+	if err != nil {
+		return err
+	}
+	if length > maxRead {
+		return fmt.Errorf("length %d is over %d: %w", length, maxRead, errInvalid)
+	}
+	// the buffer is only as big as what is left of the file
+	info, err := s.filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	if rest := info.Size() - offset; length > rest {
+		length = max64(rest, 0)
+	}
+	p := make([]byte, length)
+	n, err := s.filesystem.ReadAt(name, p, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return writeBytes(w, p[:n])
+}
+
+// write answers PATCH for a file, writing the body at the offset
+// parameter, or at the end of the file if the append parameter is set.
+// Bodies over maxWrite are refused, as they are held in memory.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, name string) error {
+	query := r.URL.Query()
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWrite))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("the request is over %d bytes: %w", maxWrite, fs.ErrTooLarge)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the request: %w", errInvalid)
+	}
+	if query.Get("append") != "" {
+		err = s.filesystem.Append(name, data)
+	} else {
+		var offset int64
+		offset, err = intParam(query.Get("offset"), 0)
+		if err == nil {
+			err = s.filesystem.WriteAt(name, data, offset)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// dirs answers the requests for directories.
+func (s *Server) dirs(w http.ResponseWriter, r *http.Request, name string) error {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := s.filesystem.ReadDirByPath(name)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, entries)
+	case http.MethodPut:
+		err := s.filesystem.Mkdir(name)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	return methodNotAllowed(w, "GET, PUT")
+}
+
+// stat answers the requests describing files and directories.
+func (s *Server) stat(w http.ResponseWriter, r *http.Request, name string) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(w, "GET")
+	}
+	info, err := s.filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, Stat{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+		Links:   info.Links(),
+	})
+}
+
+// max64 returns the larger of a and b.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// intParam parses a non-negative integer parameter, which is def if
+// missing.
+func intParam(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a valid offset or length: %w", value, errInvalid)
+	}
+	return n, nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) error {
+	w.Header().Set("Allow", allow)
+	writeError(w, &Error{StatusCode: http.StatusMethodNotAllowed, Code: "invalid", Message: "method not allowed"})
+	return nil
+}
+
+func writeBytes(w http.ResponseWriter, data []byte) error {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// the status is sent, so errors can't be answered any more
+	w.Write(data)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	writeJSON(w, e.StatusCode, e)
+}
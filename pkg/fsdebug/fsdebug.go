@@ -0,0 +1,364 @@
+// Package fsdebug prints the structures of filesystem images, in the manner
+// of debugfs: the superblock, the bitmaps, inodes, raw blocks, and the steps
+// of resolving a path. It reads images through fs.Image, so it shows what
+// the device holds, however damaged, and never writes to it. HexDump prints
+// the blocks of any device, holding a filesystem or not.
+package fsdebug
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// bitmapRow is the number of bitmap entries DumpBitmap prints per line.
+const bitmapRow = 64
+
+// DumpSuperblock prints the fields of the superblock and the layout they
+// describe.
+func DumpSuperblock(w io.Writer, img *fs.Image) error {
+	sb := img.Superblock()
+	g := sb.Geometry
+	state := "clean"
+	if sb.State == fs.StateDirty {
+		state = "dirty"
+	}
+	p := &printer{w: w}
+	p.printf("magic:           %#x\n", sb.Magic)
+	p.printf("version:         %d\n", sb.Version)
+	p.printf("state:           %s\n", state)
+	p.printf("flags:           %#x\n", sb.Flags)
+	if sb.Flags&fs.FlagWORM != 0 {
+		p.printf("retention:       %s\n", sb.Retention)
+	}
+	p.printf("next generation: %d\n", sb.NextGeneration)
+	if len(sb.Orphans) > 0 {
+		p.printf("orphans:         %v\n", sb.Orphans)
+	}
+	p.printf("block size:      %d\n", g.BlockSize)
+	p.printf("blocks:          %d\n", g.BlockCount)
+	p.printf("inodes:          %d\n", g.InodeCount)
+	if sb.Version >= 15 {
+		p.printf("free:            %d data blocks, %d inodes\n", sb.FreeBlocks, sb.FreeInodes)
+	}
+	if g.PackedBitmaps {
+		p.printf("bitmaps:         a bit per entry\n")
+	} else {
+		p.printf("bitmaps:         a byte per entry\n")
+	}
+	region := func(name string, start, end uint32) {
+		if end > start {
+			p.printf("%-16s %d-%d (%d blocks)\n", name+":", start, end-1, end-start)
+		}
+	}
+	p.printf("layout:\n")
+	region("  superblock", fs.SuperblockIndex, fs.SuperblockIndex+1)
+	region("  journal", g.JournalStart, g.JournalStart+g.JournalBlocks)
+	region("  checksums", g.ChecksumStart, g.ChecksumStart+g.ChecksumBlocks)
+	region("  dedup table", g.DedupStart, g.DedupStart+g.DedupBlocks)
+	region("  inode bitmap", g.InodeBitmapStart, g.DataBitmapStart)
+	region("  data bitmap", g.DataBitmapStart, g.InodeTableStart)
+	// in the default geometry, the last block of the inode table doubles as
+	// data block 0
+	tableBlocks := uint32((uint64(g.InodeCount)*fs.InodeSize + fs.BlockSize - 1) / fs.BlockSize)
+	region("  inode table", g.InodeTableStart, g.InodeTableStart+tableBlocks)
+	region("  data", g.DataStart, g.BlockCount)
+	return p.err
+}
+
+// DumpBitmap prints the inode bitmap, for which "inode", or the data
+// bitmap, for which "data": how many entries are taken, and every entry, 1
+// if it is taken and 0 if not, a row at a time.
+func DumpBitmap(w io.Writer, img *fs.Image, which string) error {
+	var bits []byte
+	var err error
+	g := img.Superblock().Geometry
+	first := uint32(0)
+	switch which {
+	case "inode":
+		bits, err = img.InodeBitmap()
+	case "data":
+		bits, err = img.DataBitmap()
+		first = g.DataStart
+	default:
+		return fmt.Errorf("unknown bitmap %q, want inode or data", which)
+	}
+	if err != nil {
+		return err
+	}
+	taken := 0
+	for _, b := range bits {
+		if b != 0 {
+			taken++
+		}
+	}
+	p := &printer{w: w}
+	p.printf("%s bitmap: %d of %d entries taken", which, taken, len(bits))
+	if which == "data" {
+		p.printf("; entry i is block %d+i", first)
+	}
+	p.printf("\n")
+	row := make([]byte, 0, bitmapRow+bitmapRow/8)
+	for start := 0; start < len(bits); start += bitmapRow {
+		row = row[:0]
+		for i := start; i < start+bitmapRow && i < len(bits); i++ {
+			if i > start && i%8 == 0 {
+				row = append(row, ' ')
+			}
+			switch bits[i] {
+			case 0:
+				row = append(row, '0')
+			case 1:
+				row = append(row, '1')
+			default:
+				// neither taken nor free
+				row = append(row, '?')
+			}
+		}
+		p.printf("%8d  %s\n", start, row)
+	}
+	return p.err
+}
+
+// DumpInode prints an inode as the inode table holds it: its fields, the
+// blocks it maps, any problem with it, and the raw slot.
+func DumpInode(w io.Writer, img *fs.Image, inodeIndex int) error {
+	r, err := img.Inode(inodeIndex)
+	if err != nil {
+		return err
+	}
+	p := &printer{w: w}
+	allocated := "free"
+	if r.Allocated {
+		allocated = "allocated"
+	}
+	p.printf("inode %d: %s\n", r.Index, allocated)
+	if inode := r.Inode; inode != nil {
+		uid, gid := inode.Owner()
+		p.printf("  index:      %d\n", inode.Index)
+		p.printf("  type:       %s\n", typeName(inode.Type))
+		p.printf("  name:       %q\n", inode.Filename)
+		p.printf("  size:       %d bytes, %d blocks stored, compression %s\n", inode.Size, inode.StoredBlocks(), inode.Compression())
+		p.printf("  mode:       %04o\n", inode.Mode)
+		p.printf("  owner:      %d:%d\n", uid, gid)
+		p.printf("  links:      %d\n", inode.Links)
+		p.printf("  generation: %d\n", inode.Generation)
+		p.printf("  created:    %s\n", formatTime(inode.Created))
+		p.printf("  modified:   %s\n", formatTime(inode.Modified))
+		p.printf("  accessed:   %s\n", formatTime(inode.Accessed))
+		p.printf("  changed:    %s\n", formatTime(inode.Changed))
+		if inode.Type == fs.InodeTypeDirectory {
+			format := "text"
+			if inode.BinaryDir {
+				format = "binary"
+			}
+			if n, ok := inode.Entries(); ok {
+				p.printf("  entries:    %s, %d\n", format, n)
+			} else {
+				p.printf("  entries:    %s, not counted\n", format)
+			}
+		}
+		p.printf("  %-11s %s\n", r.Mapping+":", r.Mapped)
+		p.printf("  indirect:   %d, double indirect %d\n", inode.Indirect, inode.DoubleIndirect)
+		if r.BlocksErr != nil {
+			p.printf("  data:       unreadable: %v\n", r.BlocksErr)
+		} else if r.Invalid == nil {
+			p.printf("  data:       %s\n", formatRuns(r.Data))
+			p.printf("  pointers:   %s\n", formatRuns(r.Pointers))
+		}
+		if r.XattrBlock != 0 {
+			p.printf("  xattrs:     block %d\n", r.XattrBlock)
+		}
+		if r.ContentSummed {
+			p.printf("  checksum:   %08x\n", r.ContentSum)
+		}
+	}
+	if r.Invalid != nil {
+		p.printf("  problem:    %v\n", r.Invalid)
+	}
+	p.printf("slot:\n%s", hex.Dump(r.Slot))
+	return p.err
+}
+
+// DumpBlock prints a block of dev in hex, saying what it holds if the
+// superblock can be read. It works on devices with a damaged superblock.
+func DumpBlock(w io.Writer, dev fs.BlockDevice, blockNum uint64) error {
+	buf := make([]byte, fs.BlockSize)
+	err := dev.ReadBlock(blockNum, buf)
+	if err != nil {
+		return fmt.Errorf("error reading block %d: %w", blockNum, err)
+	}
+	p := &printer{w: w}
+	if img, err := fs.OpenImage(dev); err == nil {
+		p.printf("block %d: %s\n", blockNum, img.DescribeBlock(blockNum))
+	} else {
+		p.printf("block %d\n", blockNum)
+	}
+	p.printf("%s", hex.Dump(buf))
+	return p.err
+}
+
+// BlockRange is a range of blocks of a device, from Start up to End,
+// exclusive. An End of 0 stands for the end of the device.
+type BlockRange struct {
+	Start, End uint64
+}
+
+// HexDump prints the blocks of dev in blockRange to w in hex, each under a
+// line with its number. Blocks holding only zeroes are printed as a single
+// line. The end of the device is known only for devices that report their
+// size, see fs.VectoredBlockDevice.
+func HexDump(dev fs.BlockDevice, blockRange BlockRange, w io.Writer) error {
+	end := blockRange.End
+	if end == 0 {
+		end = fs.AdaptBlockDevice(dev).Size()
+		if end == 0 {
+			return errors.New("the device doesn't report its size, so the range needs an end")
+		}
+	}
+	buf := make([]byte, fs.BlockSize)
+	zero := make([]byte, fs.BlockSize)
+	p := &printer{w: w}
+	for blockNum := blockRange.Start; blockNum < end && p.err == nil; blockNum++ {
+		err := dev.ReadBlock(blockNum, buf)
+		if err != nil {
+			return fmt.Errorf("error reading block %d: %w", blockNum, err)
+		}
+		if bytes.Equal(buf, zero) {
+			p.printf("block %d: zero\n", blockNum)
+			continue
+		}
+		p.printf("block %d:\n%s", blockNum, hex.Dump(buf))
+	}
+	return p.err
+}
+
+// TracePath resolves an absolute path from the root directory as the
+// filesystem does, printing each directory it reads and the entry it
+// follows. It stops at the first step that fails, with an error wrapping
+// fs.ErrNotExist if an entry is missing.
+func TracePath(w io.Writer, img *fs.Image, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("filename must be absolute")
+	}
+	p := &printer{w: w}
+	inodeIndex := 0
+	describe := func() (*fs.Inode, error) {
+		r, err := img.Inode(inodeIndex)
+		if err != nil {
+			return nil, err
+		}
+		if !r.Allocated {
+			p.printf("inode %d: not allocated\n", inodeIndex)
+			return nil, fmt.Errorf("inode %d is not allocated", inodeIndex)
+		}
+		if r.Invalid != nil {
+			p.printf("inode %d: %v\n", inodeIndex, r.Invalid)
+			return nil, r.Invalid
+		}
+		inode := r.Inode
+		p.printf("inode %d: %s %q, %d bytes, %s %s\n",
+			inodeIndex, typeName(inode.Type), inode.Filename, inode.Size, r.Mapping, r.Mapped)
+		return inode, nil
+	}
+	inode, err := describe()
+	if err != nil {
+		return err
+	}
+	// "/" is the root itself
+	for _, name := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if name == "" && path == "/" {
+			break
+		}
+		if inode.Type != fs.InodeTypeDirectory {
+			p.printf("  %q: inode %d isn't a directory\n", name, inodeIndex)
+			return fmt.Errorf("%s: %w", name, fs.ErrNotDirectory)
+		}
+		entries, err := img.ReadDir(inode)
+		if err != nil {
+			p.printf("  can't read the entries: %v\n", err)
+			return err
+		}
+		found := false
+		for i, entry := range entries {
+			if entry.Name == name {
+				p.printf("  %q: entry %d of %d -> inode %d\n", name, i+1, len(entries), entry.Inode)
+				inodeIndex = int(entry.Inode)
+				found = true
+				break
+			}
+		}
+		if !found {
+			p.printf("  %q: not among the %d entries\n", name, len(entries))
+			return fmt.Errorf("%s not found: %w", name, fs.ErrNotExist)
+		}
+		if inodeIndex >= int(img.Superblock().Geometry.InodeCount) {
+			p.printf("inode %d: out of bounds\n", inodeIndex)
+			return fmt.Errorf("directory entry %s points at invalid inode %d", name, inodeIndex)
+		}
+		inode, err = describe()
+		if err != nil {
+			return err
+		}
+	}
+	return p.err
+}
+
+// printer writes formatted output, keeping the first error.
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func typeName(t fs.InodeType) string {
+	switch t {
+	case fs.InodeTypeFile:
+		return "file"
+	case fs.InodeTypeDirectory:
+		return "directory"
+	}
+	return fmt.Sprintf("type %d", uint32(t))
+}
+
+// formatTime formats a time in seconds since the Unix epoch, or "-" for
+// zero.
+func formatTime(seconds int64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// formatRuns formats blocks as runs of consecutive blocks, such as
+// "100-103 110", or "none".
+func formatRuns(blocks []uint32) string {
+	if len(blocks) == 0 {
+		return "none"
+	}
+	runs := []string{}
+	for i := 0; i < len(blocks); {
+		j := i + 1
+		for j < len(blocks) && blocks[j] == blocks[j-1]+1 {
+			j++
+		}
+		if j-i == 1 {
+			runs = append(runs, fmt.Sprint(blocks[i]))
+		} else {
+			runs = append(runs, fmt.Sprintf("%d-%d", blocks[i], blocks[j-1]))
+		}
+		i = j
+	}
+	return strings.Join(runs, " ")
+}
@@ -0,0 +1,138 @@
+package fsdebug
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"github.com/stretchr/testify/require"
+)
+
+// newImage returns the device of a filesystem holding /dir/file, and the
+// inode of the file.
+func newImage(t *testing.T) ([]byte, *fs.Inode) {
+	disk := make([]byte, 600*fs.BlockSize)
+	filesystem, err := fs.NewFileSystemWithOptions(fs.NewArrayBlockDevice(disk), fs.MkfsOptions{Blocks: 600})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	file, err := filesystem.CreateFile("/dir/file", bytes.NewBuffer(make([]byte, 3*fs.BlockSize)))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close())
+	return disk, file
+}
+
+func TestDumpSuperblock(t *testing.T) {
+	disk, _ := newImage(t)
+	img, err := fs.OpenImage(fs.NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	require.NoError(t, DumpSuperblock(out, img))
+	require.Contains(t, out.String(), "state:           clean\n")
+	require.Contains(t, out.String(), "blocks:          600\n")
+	require.Contains(t, out.String(), "bitmaps:         a bit per entry\n")
+	require.Contains(t, out.String(), "free:            572 data blocks, 149 inodes\n")
+	require.Contains(t, out.String(), "  superblock:    0-0 (1 blocks)\n")
+}
+
+func TestDumpBitmap(t *testing.T) {
+	disk, _ := newImage(t)
+	img, err := fs.OpenImage(fs.NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	require.NoError(t, DumpBitmap(out, img, "inode"))
+	require.Contains(t, out.String(), "inode bitmap: 3 of ")
+	require.Contains(t, out.String(), "       0  11100000 00000000")
+
+	out.Reset()
+	require.NoError(t, DumpBitmap(out, img, "data"))
+	require.Contains(t, out.String(), "data bitmap: ")
+	require.Error(t, DumpBitmap(out, img, "blocks"))
+}
+
+func TestDumpInode(t *testing.T) {
+	disk, file := newImage(t)
+	img, err := fs.OpenImage(fs.NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	require.NoError(t, DumpInode(out, img, int(file.Index)))
+	require.Contains(t, out.String(), "allocated\n")
+	require.Contains(t, out.String(), "  type:       file\n")
+	require.Contains(t, out.String(), "  name:       \"file\"\n")
+	require.Regexp(t, `  data:       \d+-\d+\n`, out.String())
+	require.Contains(t, out.String(), "slot:\n00000000  ")
+	out.Reset()
+	require.NoError(t, DumpInode(out, img, 0))
+	require.Contains(t, out.String(), "  entries:    binary, 1\n")
+
+	// a slot that doesn't decode is still shown
+	g := img.Superblock().Geometry
+	slot := int(g.InodeTableStart)*fs.BlockSize + int(file.Index)*fs.InodeSize
+	copy(disk[slot:], bytes.Repeat([]byte{0xff}, 16))
+	out.Reset()
+	require.NoError(t, DumpInode(out, img, int(file.Index)))
+	require.Contains(t, out.String(), "  problem:    ")
+	require.Contains(t, out.String(), "ff ff ff ff")
+}
+
+func TestDumpBlock(t *testing.T) {
+	disk, _ := newImage(t)
+	out := &bytes.Buffer{}
+	require.NoError(t, DumpBlock(out, fs.NewArrayBlockDevice(disk), 0))
+	require.Contains(t, out.String(), "block 0: superblock\n")
+
+	// with the superblock gone, blocks are still dumped
+	copy(disk, make([]byte, fs.BlockSize))
+	out.Reset()
+	require.NoError(t, DumpBlock(out, fs.NewArrayBlockDevice(disk), 0))
+	require.Contains(t, out.String(), "block 0\n00000000  00 00")
+}
+
+func TestHexDump(t *testing.T) {
+	disk := make([]byte, 4*fs.BlockSize)
+	copy(disk[fs.BlockSize:], "hello")
+	out := &bytes.Buffer{}
+	require.NoError(t, HexDump(fs.NewArrayBlockDevice(disk), BlockRange{}, out))
+	lines := out.String()
+	require.True(t, strings.HasPrefix(lines, "block 0: zero\nblock 1:\n00000000  68 65 6c 6c 6f 00"), lines)
+	require.True(t, strings.HasSuffix(lines, "block 2: zero\nblock 3: zero\n"), lines)
+
+	out.Reset()
+	require.NoError(t, HexDump(fs.NewArrayBlockDevice(disk), BlockRange{Start: 2, End: 3}, out))
+	require.Equal(t, "block 2: zero\n", out.String())
+	require.Error(t, HexDump(fs.NewArrayBlockDevice(disk), BlockRange{Start: 3, End: 5}, out))
+
+	// devices that don't report their size need an end
+	require.Error(t, HexDump(plainDevice{fs.NewArrayBlockDevice(disk)}, BlockRange{}, out))
+	out.Reset()
+	require.NoError(t, HexDump(plainDevice{fs.NewArrayBlockDevice(disk)}, BlockRange{End: 1}, out))
+	require.Equal(t, "block 0: zero\n", out.String())
+}
+
+// plainDevice hides the optional methods of the device it wraps.
+type plainDevice struct {
+	fs.BlockDevice
+}
+
+func TestTracePath(t *testing.T) {
+	disk, file := newImage(t)
+	img, err := fs.OpenImage(fs.NewArrayBlockDevice(disk))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	require.NoError(t, TracePath(out, img, "/dir/file"))
+	lines := out.String()
+	require.Contains(t, lines, "inode 0: directory")
+	require.Contains(t, lines, "  \"dir\": entry 1 of 1 -> inode 1\n")
+	require.Contains(t, lines, "inode 1: directory \"dir\"")
+	require.Regexp(t, `inode \d+: file "file", 12288 bytes`, lines)
+	require.Contains(t, lines, fmt.Sprintf("-> inode %d\n", file.Index))
+
+	out.Reset()
+	err = TracePath(out, img, "/dir/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Contains(t, out.String(), "  \"missing\": not among the 1 entries\n")
+
+	err = TracePath(out, img, "/dir/file/more")
+	require.ErrorIs(t, err, fs.ErrNotDirectory)
+}
@@ -0,0 +1,72 @@
+// Package httpfs serves the files of a filesystem image over HTTP, through
+// its io/fs view, so an image can be published without extracting it. It
+// serves what http.FileServer does: files with their modification times and
+// ranges, index.html for directories that have one, and listings of those
+// that don't.
+package httpfs
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+)
+
+// Options controls what a Handler serves. The zero value serves every file
+// and lists directories.
+type Options struct {
+	// NoListing answers requests for directories without an index.html
+	// with 404 Not Found instead of listing them.
+	NoListing bool
+}
+
+// Handler is an http.Handler serving the files of a filesystem for GET and
+// HEAD requests, and refusing other methods with 405 Method Not Allowed.
+// The filesystem is only read, so it can be used and changed while it is
+// served; requests see it as it is when they are answered.
+type Handler struct {
+	fsys  fs.FS
+	files http.Handler
+	opts  Options
+}
+
+// NewHandler returns a Handler serving the files of filesystem, the URL
+// path of a request being the absolute path of a file.
+func NewHandler(filesystem *fs.FileSystem, opts Options) *Handler {
+	fsys := filesystem.FS()
+	return &Handler{
+		fsys:  fsys,
+		files: http.FileServer(http.FS(fsys)),
+		opts:  opts,
+	}
+}
+
+// ServeHTTP serves the file or directory named by the URL path.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.opts.NoListing && h.isUnindexedDir(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+// isUnindexedDir reports whether the URL path names a directory without an
+// index.html, which http.FileServer would list.
+func (h *Handler) isUnindexedDir(urlPath string) bool {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := h.fsys.Stat(name)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	_, err = h.fsys.Stat(path.Join(name, "index.html"))
+	return err != nil
+}
@@ -0,0 +1,92 @@
+package httpfs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"brenoafb.com/very-simple-filesystem/pkg/fs"
+	"github.com/stretchr/testify/require"
+)
+
+// newFileSystem returns a filesystem holding /hello.txt, /site/index.html
+// and /dir/file.
+func newFileSystem(t *testing.T) *fs.FileSystem {
+	disk := make([]byte, 200*fs.BlockSize)
+	filesystem, err := fs.NewFileSystemWithOptions(fs.NewArrayBlockDevice(disk), fs.MkfsOptions{Blocks: 200})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Mkdir("/site"))
+	require.NoError(t, filesystem.Mkdir("/dir"))
+	for name, contents := range map[string]string{
+		"/hello.txt":       "hello, world\n",
+		"/site/index.html": "<h1>site</h1>",
+		"/dir/file":        "file",
+	} {
+		_, err = filesystem.CreateFile(name, bytes.NewBufferString(contents))
+		require.NoError(t, err)
+	}
+	return filesystem
+}
+
+func get(t *testing.T, h http.Handler, method, target string, header http.Header) (*http.Response, string) {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	h := NewHandler(newFileSystem(t), Options{})
+
+	resp, body := get(t, h, http.MethodGet, "/hello.txt", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello, world\n", body)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	resp, body = get(t, h, http.MethodGet, "/hello.txt", http.Header{"Range": {"bytes=7-11"}})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "world", body)
+
+	resp, body = get(t, h, http.MethodHead, "/hello.txt", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, body)
+	require.Equal(t, "13", resp.Header.Get("Content-Length"))
+
+	resp, body = get(t, h, http.MethodGet, "/site/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "<h1>site</h1>", body)
+
+	resp, body = get(t, h, http.MethodGet, "/dir/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, body, `<a href="file">file</a>`)
+
+	resp, _ = get(t, h, http.MethodGet, "/missing", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get(t, h, http.MethodPut, "/hello.txt", nil)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestHandlerNoListing(t *testing.T) {
+	h := NewHandler(newFileSystem(t), Options{NoListing: true})
+
+	resp, _ := get(t, h, http.MethodGet, "/dir/", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get(t, h, http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, body := get(t, h, http.MethodGet, "/site/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "<h1>site</h1>", body)
+	resp, body = get(t, h, http.MethodGet, "/dir/file", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "file", body)
+}